@@ -0,0 +1,121 @@
+// Package client is a Go client for kiwi, and for the servers speaking
+// RESP.
+//
+// A Client is a pool of connections, safe for concurrent use. Commands
+// are executed with Do, or with the typed methods returning Go values, and
+// several commands can be sent in a single round trip with a Pipeline, or
+// executed atomically with a transaction, see TxPipeline. Subscriptions to
+// channels use a dedicated connection, see PubSub.
+//
+//	c := client.New(&client.Options{Addr: "127.0.0.1:6379"})
+//	defer c.Close()
+//	if err := c.Set(ctx, "greeting", "hello", 0); err != nil {
+//		return err
+//	}
+//	greeting, err := c.Get(ctx, "greeting")
+//
+// The connections are authenticated and select their database when they
+// are dialed. Read only commands failing with a network error can be
+// retried on a new connection, see Options.MaxRetries. The other commands
+// are only retried when they could not be sent: the server may have
+// executed them before the connection broke.
+package client
+
+import (
+	"context"
+	"time"
+
+	"github.com/zhaotong0312/kiwi/resp"
+)
+
+// Client is a pool of connections to a server.
+type Client struct {
+	opt  Options
+	pool *pool
+}
+
+// New returns a client connecting with opt, nil for the defaults. No
+// connection is dialed until a command is executed.
+func New(opt *Options) *Client {
+	c := &Client{}
+	if opt != nil {
+		c.opt = *opt
+	}
+	c.opt.init()
+	c.pool = newPool(&c.opt)
+	return c
+}
+
+// Options returns the options of the client, with the defaults applied.
+func (c *Client) Options() Options {
+	return c.opt
+}
+
+// Close closes the connections. The commands in progress complete first.
+func (c *Client) Close() error {
+	return c.pool.close()
+}
+
+// withConn runs fn with a connection of the pool, retrying with a new
+// connection after a network error, see Options.MaxRetries. fn is only
+// retried if repeatable, otherwise only failing to dial or to write before
+// any byte was sent is.
+func (c *Client) withConn(ctx context.Context, repeatable bool, fn func(cn *conn) error) error {
+	var err error
+	for attempt := 0; attempt <= c.opt.MaxRetries; attempt++ {
+		if attempt > 0 {
+			t := time.NewTimer(c.opt.backoff(attempt - 1))
+			select {
+			case <-ctx.Done():
+				t.Stop()
+				return ctx.Err()
+			case <-t.C:
+			}
+		}
+		var cn *conn
+		if cn, err = c.pool.get(ctx); err == nil {
+			err = fn(cn)
+			unsent := cn.unsent
+			c.pool.put(cn)
+			if err != nil && !repeatable && !unsent {
+				return err
+			}
+		}
+		if err == nil || !shouldRetry(err) {
+			return err
+		}
+	}
+	return err
+}
+
+// process executes the commands in a single round trip. The error of a
+// command that could not be executed is stored in it too.
+func (c *Client) process(ctx context.Context, cmds []*Cmd) error {
+	err := c.withConn(ctx, repeatable(cmds), func(cn *conn) error {
+		for _, cmd := range cmds {
+			cmd.reset()
+		}
+		return cn.roundTrip(ctx, &c.opt, cmds)
+	})
+	if err != nil {
+		for _, cmd := range cmds {
+			if cmd.err == nil && cmd.val.Type == 0 {
+				cmd.err = err
+			}
+		}
+	}
+	return err
+}
+
+// Cmd executes a command and returns it, with its reply or its error.
+func (c *Client) Cmd(ctx context.Context, args ...string) *Cmd {
+	cmd := newCmd(args)
+	c.process(ctx, []*Cmd{cmd})
+	return cmd
+}
+
+// Do executes a command and returns its reply. Error replies are returned
+// as a resp.ServerError.
+func (c *Client) Do(ctx context.Context, args ...string) (resp.Value, error) {
+	return c.Cmd(ctx, args...).Value()
+}
@@ -0,0 +1,467 @@
+package client
+
+import (
+	"context"
+	"errors"
+	"net"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/zhaotong0312/kiwi"
+	"github.com/zhaotong0312/kiwi/resp"
+)
+
+// fakeServer is a minimal RESP server: strings, MULTI/EXEC, pub/sub, AUTH
+// with the password "secret", SELECT, and SLEEP ms to simulate slow
+// commands.
+type fakeServer struct {
+	ln    net.Listener
+	mu    sync.Mutex
+	dbs   map[string]map[string]string
+	conns map[net.Conn]*fakeConn
+	auth  bool // Require AUTH
+}
+
+type fakeConn struct {
+	wr       *resp.Writer
+	db       string
+	authed   bool
+	multi    [][]string
+	channels map[string]bool
+}
+
+func newFakeServer(t *testing.T) *fakeServer {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &fakeServer{ln: ln, dbs: make(map[string]map[string]string), conns: make(map[net.Conn]*fakeConn)}
+	go func() {
+		for {
+			nc, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go s.serve(nc)
+		}
+	}()
+	t.Cleanup(func() {
+		ln.Close()
+		s.dropConns()
+	})
+	return s
+}
+
+func (s *fakeServer) addr() string {
+	return s.ln.Addr().String()
+}
+
+// dropConns closes all the connections, like a server restart.
+func (s *fakeServer) dropConns() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for nc := range s.conns {
+		nc.Close()
+		delete(s.conns, nc)
+	}
+}
+
+func (s *fakeServer) serve(nc net.Conn) {
+	fc := &fakeConn{wr: resp.NewWriter(nc), db: "0", channels: make(map[string]bool)}
+	s.mu.Lock()
+	s.conns[nc] = fc
+	s.mu.Unlock()
+	defer func() {
+		s.mu.Lock()
+		delete(s.conns, nc)
+		s.mu.Unlock()
+		nc.Close()
+	}()
+	rd := resp.NewReader(nc)
+	for {
+		argv, err := rd.ReadCommand()
+		if err != nil {
+			return
+		}
+		if len(argv) > 0 && argv[0] == "sleep" {
+			d, _ := time.ParseDuration(argv[1] + "ms")
+			time.Sleep(d)
+		}
+		s.mu.Lock()
+		s.exec(fc, argv)
+		err = fc.wr.Flush()
+		s.mu.Unlock()
+		if err != nil {
+			return
+		}
+	}
+}
+
+// exec writes the reply of a command, with s.mu held.
+func (s *fakeServer) exec(fc *fakeConn, argv []string) {
+	w := fc.wr
+	name := strings.ToLower(argv[0])
+	if name == "auth" {
+		if argv[len(argv)-1] != "secret" {
+			w.WriteError("WRONGPASS invalid password")
+			return
+		}
+		fc.authed = true
+		w.WriteSimpleString("OK")
+		return
+	}
+	if s.auth && !fc.authed {
+		w.WriteError("NOAUTH Authentication required.")
+		return
+	}
+	if fc.multi != nil && name != "exec" {
+		if name == "bad" {
+			fc.multi = append(fc.multi, nil)
+			w.WriteError("ERR unknown command 'bad'")
+			return
+		}
+		fc.multi = append(fc.multi, argv)
+		w.WriteSimpleString("QUEUED")
+		return
+	}
+	db := s.dbs[fc.db]
+	if db == nil {
+		db = make(map[string]string)
+		s.dbs[fc.db] = db
+	}
+	switch name {
+	case "ping", "sleep":
+		w.WriteSimpleString("PONG")
+	case "select":
+		fc.db = argv[1]
+		w.WriteSimpleString("OK")
+	case "set":
+		db[argv[1]] = argv[2]
+		w.WriteSimpleString("OK")
+	case "get":
+		if v, ok := db[argv[1]]; ok {
+			w.WriteBulkString(v)
+		} else {
+			w.WriteNull()
+		}
+	case "incr":
+		n := len(db[argv[1]]) + 1
+		db[argv[1]] = strings.Repeat("x", n)
+		w.WriteInteger(int64(n))
+	case "hgetall":
+		w.WriteArrayLen(4)
+		for _, s := range []string{"f1", "v1", "f2", "v2"} {
+			w.WriteBulkString(s)
+		}
+	case "multi":
+		fc.multi = [][]string{}
+		w.WriteSimpleString("OK")
+	case "exec":
+		cmds := fc.multi
+		fc.multi = nil
+		for _, argv := range cmds {
+			if argv == nil {
+				w.WriteError("EXECABORT Transaction discarded because of previous errors.")
+				return
+			}
+		}
+		w.WriteArrayLen(len(cmds))
+		for _, argv := range cmds {
+			s.exec(fc, argv)
+		}
+	case "subscribe":
+		for _, ch := range argv[1:] {
+			fc.channels[ch] = true
+			w.WriteArrayLen(3)
+			w.WriteBulkString("subscribe")
+			w.WriteBulkString(ch)
+			w.WriteInteger(int64(len(fc.channels)))
+		}
+	case "publish":
+		n := 0
+		for _, other := range s.conns {
+			if other.channels[argv[1]] {
+				other.wr.WriteArrayLen(3)
+				other.wr.WriteBulkString("message")
+				other.wr.WriteBulkString(argv[1])
+				other.wr.WriteBulkString(argv[2])
+				if other != fc {
+					other.wr.Flush()
+				}
+				n++
+			}
+		}
+		w.WriteInteger(int64(n))
+	default:
+		w.WriteError("ERR unknown command '" + argv[0] + "'")
+	}
+}
+
+func TestCommands(t *testing.T) {
+	s := newFakeServer(t)
+	c := New(&Options{Addr: s.addr()})
+	defer c.Close()
+	ctx := context.Background()
+
+	if err := c.Set(ctx, "k", "v", 0); err != nil {
+		t.Fatal(err)
+	}
+	if v, err := c.Get(ctx, "k"); v != "v" || err != nil {
+		t.Errorf("Get = %q, %v", v, err)
+	}
+	if _, err := c.Get(ctx, "missing"); err != Nil {
+		t.Errorf("Get of a missing key: %v, want Nil", err)
+	}
+	if n, err := c.Incr(ctx, "n"); n != 1 || err != nil {
+		t.Errorf("Incr = %d, %v", n, err)
+	}
+	m, err := c.HGetAll(ctx, "h")
+	if want := map[string]string{"f1": "v1", "f2": "v2"}; !reflect.DeepEqual(m, want) || err != nil {
+		t.Errorf("HGetAll = %v, %v", m, err)
+	}
+	var se resp.ServerError
+	if _, err := c.Do(ctx, "nosuch"); !errors.As(err, &se) || se.Code() != "ERR" {
+		t.Errorf("unknown command: %v", err)
+	}
+}
+
+func TestAuthAndSelect(t *testing.T) {
+	s := newFakeServer(t)
+	s.auth = true
+	ctx := context.Background()
+
+	bad := New(&Options{Addr: s.addr(), Password: "wrong"})
+	defer bad.Close()
+	if err := bad.Ping(ctx); err == nil || !strings.HasPrefix(err.Error(), "WRONGPASS") {
+		t.Errorf("Ping with a wrong password: %v", err)
+	}
+
+	c1 := New(&Options{Addr: s.addr(), Password: "secret", DB: 1})
+	defer c1.Close()
+	c2 := New(&Options{Addr: s.addr(), Password: "secret", DB: 2})
+	defer c2.Close()
+	c1.Set(ctx, "k", "one", 0)
+	c2.Set(ctx, "k", "two", 0)
+	if v, _ := c1.Get(ctx, "k"); v != "one" {
+		t.Errorf("Get in db 1 = %q", v)
+	}
+	if v, _ := c2.Get(ctx, "k"); v != "two" {
+		t.Errorf("Get in db 2 = %q", v)
+	}
+}
+
+func TestPipeline(t *testing.T) {
+	s := newFakeServer(t)
+	c := New(&Options{Addr: s.addr()})
+	defer c.Close()
+	ctx := context.Background()
+
+	p := c.Pipeline()
+	set := p.Do("set", "k", "v")
+	get := p.Do("get", "k")
+	bad := p.Do("nosuch")
+	missing := p.Do("get", "missing")
+	cmds, err := p.Exec(ctx)
+	if len(cmds) != 4 || err == nil || err != bad.Err() {
+		t.Fatalf("Exec = %d commands, %v", len(cmds), err)
+	}
+	if set.Err() != nil {
+		t.Errorf("SET: %v", set.Err())
+	}
+	if v, err := get.Text(); v != "v" || err != nil {
+		t.Errorf("GET = %q, %v", v, err)
+	}
+	if _, err := missing.Text(); err != Nil {
+		t.Errorf("GET of a missing key: %v, want Nil", err)
+	}
+	if p.Len() != 0 {
+		t.Errorf("the pipeline is not empty after Exec")
+	}
+}
+
+func TestTxPipeline(t *testing.T) {
+	s := newFakeServer(t)
+	c := New(&Options{Addr: s.addr()})
+	defer c.Close()
+	ctx := context.Background()
+
+	tx := c.TxPipeline()
+	tx.Do("set", "k", "v")
+	incr := tx.Do("incr", "n")
+	get := tx.Do("get", "k")
+	if _, err := tx.Exec(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if n, _ := incr.Int(); n != 1 {
+		t.Errorf("INCR = %d", n)
+	}
+	if v, _ := get.Text(); v != "v" {
+		t.Errorf("GET = %q", v)
+	}
+
+	tx.Do("set", "k", "other")
+	bad := tx.Do("bad")
+	_, err := tx.Exec(ctx)
+	if err == nil || !strings.HasPrefix(err.Error(), "EXECABORT") {
+		t.Errorf("Exec with a rejected command: %v", err)
+	}
+	if bad.Err() == nil || !strings.HasPrefix(bad.Err().Error(), "ERR") {
+		t.Errorf("rejected command: %v", bad.Err())
+	}
+	if v, _ := c.Get(ctx, "k"); v != "v" {
+		t.Errorf("the aborted transaction was executed")
+	}
+}
+
+func TestRetry(t *testing.T) {
+	s := newFakeServer(t)
+	ctx := context.Background()
+
+	c := New(&Options{Addr: s.addr(), MaxRetries: 2, MinRetryBackoff: time.Millisecond})
+	defer c.Close()
+	if err := c.Set(ctx, "k", "v", 0); err != nil {
+		t.Fatal(err)
+	}
+	// The pooled connection is now broken.
+	s.dropConns()
+	if v, err := c.Get(ctx, "k"); v != "v" || err != nil {
+		t.Errorf("Get after the connection broke = %q, %v", v, err)
+	}
+	// The server may have executed a write before the connection broke.
+	s.dropConns()
+	if _, err := c.Incr(ctx, "n"); err == nil {
+		t.Errorf("Incr was retried after the connection broke")
+	}
+	// A write failing before sending anything is retried.
+	cn, err := c.pool.get(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cn.nc.Close()
+	c.pool.put(cn)
+	if n, err := c.Incr(ctx, "n"); err != nil {
+		t.Errorf("Incr after a failed write = %d, %v", n, err)
+	}
+
+	noretry := New(&Options{Addr: s.addr(), MaxRetries: -1})
+	defer noretry.Close()
+	noretry.Ping(ctx)
+	s.dropConns()
+	if err := noretry.Ping(ctx); err == nil {
+		t.Errorf("Ping without retries succeeded on a broken connection")
+	}
+}
+
+func TestTimeouts(t *testing.T) {
+	s := newFakeServer(t)
+	c := New(&Options{Addr: s.addr(), ReadTimeout: 20 * time.Millisecond, MaxRetries: 2})
+	defer c.Close()
+	var ne net.Error
+	if _, err := c.Do(context.Background(), "sleep", "200"); !errors.As(err, &ne) || !ne.Timeout() {
+		t.Errorf("slow command: %v, want a timeout", err)
+	}
+
+	// The context is honoured while waiting for a connection of the
+	// pool, and while waiting for the reply.
+	c1 := New(&Options{Addr: s.addr(), PoolSize: 1})
+	defer c1.Close()
+	go c1.Do(context.Background(), "sleep", "200")
+	time.Sleep(50 * time.Millisecond)
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	if err := c1.Ping(ctx); err != context.DeadlineExceeded {
+		t.Errorf("Ping with the pool exhausted: %v", err)
+	}
+	c2 := New(&Options{Addr: s.addr()})
+	defer c2.Close()
+	ctx, cancel = context.WithCancel(context.Background())
+	time.AfterFunc(20*time.Millisecond, cancel)
+	if _, err := c2.Do(ctx, "sleep", "200"); err != context.Canceled {
+		t.Errorf("canceled command: %v", err)
+	}
+}
+
+func TestPubSubResubscribe(t *testing.T) {
+	s := newFakeServer(t)
+	c := New(&Options{Addr: s.addr(), MinRetryBackoff: time.Millisecond})
+	defer c.Close()
+	ctx := context.Background()
+
+	ps, err := c.Subscribe(ctx, "news")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ps.Close()
+	// Publish until the subscription is effective, then once the
+	// connection of the subscription was dropped.
+	for round := 0; round < 2; round++ {
+		deadline := time.After(5 * time.Second)
+	wait:
+		for {
+			c.Publish(ctx, "news", "hello")
+			select {
+			case msg := <-ps.Channel():
+				if msg.Channel != "news" || msg.Payload != "hello" {
+					t.Fatalf("message = %+v", msg)
+				}
+				break wait
+			case <-time.After(10 * time.Millisecond):
+			case <-deadline:
+				t.Fatalf("no message received in round %d", round)
+			}
+		}
+		s.dropConns()
+	}
+	ps.Close()
+	for range ps.Channel() {
+	}
+}
+
+// The client against an embedded server.
+func TestServer(t *testing.T) {
+	sock := filepath.Join(t.TempDir(), "kiwi.sock")
+	db, err := kiwi.Open("port 0\nunixsocket " + sock + "\n")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	if err := db.Serve(); err != nil {
+		t.Fatal(err)
+	}
+	c := New(&Options{Network: "unix", Addr: sock})
+	defer c.Close()
+	ctx := context.Background()
+
+	if err := c.Ping(ctx); err != nil {
+		t.Fatalf("Ping: %v", err)
+	}
+	if v, err := c.Do(ctx, "echo", "hello"); v.Str != "hello" || err != nil {
+		t.Errorf("ECHO = %q, %v", v.Str, err)
+	}
+	if err := c.Set(ctx, "k", "v", time.Minute); err != nil {
+		t.Fatal(err)
+	}
+	if v, err := c.Get(ctx, "k"); v != "v" || err != nil {
+		t.Errorf("Get = %q, %v", v, err)
+	}
+	if ttl, err := c.TTL(ctx, "k"); ttl <= 0 || ttl > time.Minute || err != nil {
+		t.Errorf("TTL = %v, %v", ttl, err)
+	}
+	if _, err := c.Get(ctx, "missing"); err != Nil {
+		t.Errorf("Get of a missing key: %v, want Nil", err)
+	}
+
+	tx := c.TxPipeline()
+	incr := tx.Do("incr", "n")
+	tx.Do("lpush", "k", "x")
+	if _, err := tx.Exec(ctx); err == nil || !strings.HasPrefix(err.Error(), "WRONGTYPE") {
+		t.Errorf("Exec: %v, want WRONGTYPE", err)
+	}
+	if n, err := incr.Int(); n != 1 || err != nil {
+		t.Errorf("INCR in the transaction = %d, %v", n, err)
+	}
+}
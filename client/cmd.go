@@ -0,0 +1,168 @@
+package client
+
+import (
+	"errors"
+	"strconv"
+
+	"github.com/zhaotong0312/kiwi/resp"
+)
+
+// Nil is the error returned when the reply is null, like the reply of GET
+// for a missing key.
+var Nil = errors.New("kiwi: nil")
+
+// Cmd is a command and, once executed, its reply. The methods converting
+// the reply to Go values return the error of the command first, like a
+// resp.ServerError for an error reply, then Nil for a null reply.
+type Cmd struct {
+	args []string
+	val  resp.Value
+	err  error
+}
+
+func newCmd(args []string) *Cmd {
+	return &Cmd{args: args}
+}
+
+func (cmd *Cmd) setValue(v resp.Value) {
+	cmd.val = v
+	cmd.err = v.Err()
+}
+
+func (cmd *Cmd) reset() {
+	cmd.val = resp.Value{}
+	cmd.err = nil
+}
+
+// Args returns the command and its arguments.
+func (cmd *Cmd) Args() []string {
+	return cmd.args
+}
+
+// Err returns the error of the command: an error reply, or the error that
+// prevented its execution.
+func (cmd *Cmd) Err() error {
+	return cmd.err
+}
+
+// Value returns the reply as decoded.
+func (cmd *Cmd) Value() (resp.Value, error) {
+	return cmd.val, cmd.err
+}
+
+func (cmd *Cmd) value() (resp.Value, error) {
+	if cmd.err != nil {
+		return cmd.val, cmd.err
+	}
+	if cmd.val.IsNull() {
+		return cmd.val, Nil
+	}
+	return cmd.val, nil
+}
+
+// Text returns a string reply: simple, bulk or verbatim string.
+func (cmd *Cmd) Text() (string, error) {
+	v, err := cmd.value()
+	if err != nil {
+		return "", err
+	}
+	switch v.Type {
+	case resp.SimpleString, resp.BulkString, resp.VerbatimString, resp.BigNumber:
+		return v.Str, nil
+	case resp.Integer:
+		return strconv.FormatInt(v.Int, 10), nil
+	case resp.Double:
+		return resp.FormatDouble(v.Float), nil
+	}
+	return "", typeError(v, "string")
+}
+
+// Int returns an integer reply, or a string reply holding an integer.
+func (cmd *Cmd) Int() (int64, error) {
+	v, err := cmd.value()
+	if err != nil {
+		return 0, err
+	}
+	switch v.Type {
+	case resp.Integer:
+		return v.Int, nil
+	case resp.SimpleString, resp.BulkString:
+		return strconv.ParseInt(v.Str, 10, 64)
+	}
+	return 0, typeError(v, "integer")
+}
+
+// Float returns a double reply, or a string reply holding a number.
+func (cmd *Cmd) Float() (float64, error) {
+	v, err := cmd.value()
+	if err != nil {
+		return 0, err
+	}
+	switch v.Type {
+	case resp.Double:
+		return v.Float, nil
+	case resp.Integer:
+		return float64(v.Int), nil
+	case resp.SimpleString, resp.BulkString:
+		return strconv.ParseFloat(v.Str, 64)
+	}
+	return 0, typeError(v, "double")
+}
+
+// Bool returns a boolean reply, or an integer reply as a boolean: true for
+// 1, like the replies of SISMEMBER or EXPIRE.
+func (cmd *Cmd) Bool() (bool, error) {
+	v, err := cmd.value()
+	if err != nil {
+		return false, err
+	}
+	switch v.Type {
+	case resp.Boolean:
+		return v.Bool, nil
+	case resp.Integer:
+		return v.Int == 1, nil
+	}
+	return false, typeError(v, "boolean")
+}
+
+// Strings returns the elements of an array or set reply as strings. The
+// null elements are empty strings.
+func (cmd *Cmd) Strings() ([]string, error) {
+	v, err := cmd.value()
+	if err != nil {
+		return nil, err
+	}
+	if v.Type != resp.Array && v.Type != resp.Set && v.Type != resp.Push {
+		return nil, typeError(v, "array")
+	}
+	strs := make([]string, len(v.Elems))
+	for i, e := range v.Elems {
+		strs[i] = e.Str
+	}
+	return strs, nil
+}
+
+// StringMap returns a map reply, or an array reply of keys and values
+// alternated as sent to RESP2 clients.
+func (cmd *Cmd) StringMap() (map[string]string, error) {
+	v, err := cmd.value()
+	if err != nil {
+		return nil, err
+	}
+	if v.Type != resp.Map && v.Type != resp.Array {
+		return nil, typeError(v, "map")
+	}
+	m := make(map[string]string, len(v.Elems)/2)
+	for i := 0; i+1 < len(v.Elems); i += 2 {
+		m[v.Elems[i].Str] = v.Elems[i+1].Str
+	}
+	return m, nil
+}
+
+func typeError(v resp.Value, want string) error {
+	return errors.New("kiwi: unexpected " + v.Type.String() + " reply, expected " + want)
+}
+
+func itoa(n int64) string {
+	return strconv.FormatInt(n, 10)
+}
@@ -0,0 +1,270 @@
+package client
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/zhaotong0312/kiwi/resp"
+)
+
+// The typed methods return Nil when the key, the field or the member
+// doesn't exist, like the null reply of the commands.
+
+func durationArg(d time.Duration) string {
+	return itoa(int64(d / time.Millisecond))
+}
+
+// Ping checks that the server is reachable.
+func (c *Client) Ping(ctx context.Context) error {
+	return c.Cmd(ctx, "ping").Err()
+}
+
+// Keyspace
+
+// Del deletes the keys and returns the number of keys deleted.
+func (c *Client) Del(ctx context.Context, keys ...string) (int64, error) {
+	return c.Cmd(ctx, append([]string{"del"}, keys...)...).Int()
+}
+
+// Exists returns the number of keys existing among keys.
+func (c *Client) Exists(ctx context.Context, keys ...string) (int64, error) {
+	return c.Cmd(ctx, append([]string{"exists"}, keys...)...).Int()
+}
+
+// Type returns the type of the value of key, "none" if it doesn't exist.
+func (c *Client) Type(ctx context.Context, key string) (string, error) {
+	return c.Cmd(ctx, "type", key).Text()
+}
+
+// Expire sets a time to live on key, with a millisecond resolution. It
+// returns false if the key doesn't exist.
+func (c *Client) Expire(ctx context.Context, key string, ttl time.Duration) (bool, error) {
+	return c.Cmd(ctx, "pexpire", key, durationArg(ttl)).Bool()
+}
+
+// TTL returns the remaining time to live of key. It returns -1 if the key
+// has no expire, and Nil if the key doesn't exist.
+func (c *Client) TTL(ctx context.Context, key string) (time.Duration, error) {
+	ms, err := c.Cmd(ctx, "pttl", key).Int()
+	switch {
+	case err != nil:
+		return 0, err
+	case ms == -2:
+		return 0, Nil
+	case ms == -1:
+		return -1, nil
+	}
+	return time.Duration(ms) * time.Millisecond, nil
+}
+
+// Persist removes the expire of key. It returns false if the key doesn't
+// exist or has no expire.
+func (c *Client) Persist(ctx context.Context, key string) (bool, error) {
+	return c.Cmd(ctx, "persist", key).Bool()
+}
+
+// Strings
+
+// Get returns the value of key.
+func (c *Client) Get(ctx context.Context, key string) (string, error) {
+	return c.Cmd(ctx, "get", key).Text()
+}
+
+// Set sets the value of key. The key expires after ttl, unless ttl is 0.
+func (c *Client) Set(ctx context.Context, key, value string, ttl time.Duration) error {
+	if ttl > 0 {
+		return c.Cmd(ctx, "set", key, value, "px", durationArg(ttl)).Err()
+	}
+	return c.Cmd(ctx, "set", key, value).Err()
+}
+
+// SetNX sets the value of key only if the key doesn't exist, and reports
+// whether it was set.
+func (c *Client) SetNX(ctx context.Context, key, value string) (bool, error) {
+	return c.Cmd(ctx, "setnx", key, value).Bool()
+}
+
+// MGet returns the values of the keys. The values of the keys that don't
+// exist are empty strings.
+func (c *Client) MGet(ctx context.Context, keys ...string) ([]string, error) {
+	return c.Cmd(ctx, append([]string{"mget"}, keys...)...).Strings()
+}
+
+// MSet sets the values of several keys, given as key, value pairs.
+func (c *Client) MSet(ctx context.Context, pairs ...string) error {
+	return c.Cmd(ctx, append([]string{"mset"}, pairs...)...).Err()
+}
+
+// Incr increments the integer value of key and returns the new value.
+func (c *Client) Incr(ctx context.Context, key string) (int64, error) {
+	return c.Cmd(ctx, "incr", key).Int()
+}
+
+// Decr decrements the integer value of key and returns the new value.
+func (c *Client) Decr(ctx context.Context, key string) (int64, error) {
+	return c.Cmd(ctx, "decr", key).Int()
+}
+
+// Lists
+
+// LPush inserts the values at the head of the list and returns its
+// length.
+func (c *Client) LPush(ctx context.Context, key string, values ...string) (int64, error) {
+	return c.Cmd(ctx, append([]string{"lpush", key}, values...)...).Int()
+}
+
+// RPush inserts the values at the tail of the list and returns its
+// length.
+func (c *Client) RPush(ctx context.Context, key string, values ...string) (int64, error) {
+	return c.Cmd(ctx, append([]string{"rpush", key}, values...)...).Int()
+}
+
+// LPop removes and returns the head of the list.
+func (c *Client) LPop(ctx context.Context, key string) (string, error) {
+	return c.Cmd(ctx, "lpop", key).Text()
+}
+
+// RPop removes and returns the tail of the list.
+func (c *Client) RPop(ctx context.Context, key string) (string, error) {
+	return c.Cmd(ctx, "rpop", key).Text()
+}
+
+// LLen returns the length of the list.
+func (c *Client) LLen(ctx context.Context, key string) (int64, error) {
+	return c.Cmd(ctx, "llen", key).Int()
+}
+
+// LRange returns the elements from start to stop included, negative
+// indexes counting from the tail.
+func (c *Client) LRange(ctx context.Context, key string, start, stop int64) ([]string, error) {
+	return c.Cmd(ctx, "lrange", key, itoa(start), itoa(stop)).Strings()
+}
+
+// Hashes
+
+// HSet sets the value of field, and reports whether the field was
+// created.
+func (c *Client) HSet(ctx context.Context, key, field, value string) (bool, error) {
+	return c.Cmd(ctx, "hset", key, field, value).Bool()
+}
+
+// HGet returns the value of field.
+func (c *Client) HGet(ctx context.Context, key, field string) (string, error) {
+	return c.Cmd(ctx, "hget", key, field).Text()
+}
+
+// HDel deletes the fields and returns the number of fields deleted.
+func (c *Client) HDel(ctx context.Context, key string, fields ...string) (int64, error) {
+	return c.Cmd(ctx, append([]string{"hdel", key}, fields...)...).Int()
+}
+
+// HGetAll returns the fields of the hash and their values.
+func (c *Client) HGetAll(ctx context.Context, key string) (map[string]string, error) {
+	return c.Cmd(ctx, "hgetall", key).StringMap()
+}
+
+// HIncrBy increments the integer value of field and returns the new
+// value.
+func (c *Client) HIncrBy(ctx context.Context, key, field string, incr int64) (int64, error) {
+	return c.Cmd(ctx, "hincrby", key, field, itoa(incr)).Int()
+}
+
+// Sets
+
+// SAdd adds the members to the set and returns the number of members
+// added.
+func (c *Client) SAdd(ctx context.Context, key string, members ...string) (int64, error) {
+	return c.Cmd(ctx, append([]string{"sadd", key}, members...)...).Int()
+}
+
+// SRem removes the members from the set and returns the number of members
+// removed.
+func (c *Client) SRem(ctx context.Context, key string, members ...string) (int64, error) {
+	return c.Cmd(ctx, append([]string{"srem", key}, members...)...).Int()
+}
+
+// SIsMember reports whether member belongs to the set.
+func (c *Client) SIsMember(ctx context.Context, key, member string) (bool, error) {
+	return c.Cmd(ctx, "sismember", key, member).Bool()
+}
+
+// SMembers returns the members of the set, in no particular order.
+func (c *Client) SMembers(ctx context.Context, key string) ([]string, error) {
+	return c.Cmd(ctx, "smembers", key).Strings()
+}
+
+// Sorted sets
+
+// Z is a member of a sorted set and its score.
+type Z struct {
+	Score  float64
+	Member string
+}
+
+// ZAdd adds the members to the sorted set, or updates their scores, and
+// returns the number of members added.
+func (c *Client) ZAdd(ctx context.Context, key string, members ...Z) (int64, error) {
+	args := make([]string, 0, 2+len(members)*2)
+	args = append(args, "zadd", key)
+	for _, z := range members {
+		args = append(args, resp.FormatDouble(z.Score), z.Member)
+	}
+	return c.Cmd(ctx, args...).Int()
+}
+
+// ZRem removes the members from the sorted set and returns the number of
+// members removed.
+func (c *Client) ZRem(ctx context.Context, key string, members ...string) (int64, error) {
+	return c.Cmd(ctx, append([]string{"zrem", key}, members...)...).Int()
+}
+
+// ZScore returns the score of member.
+func (c *Client) ZScore(ctx context.Context, key, member string) (float64, error) {
+	return c.Cmd(ctx, "zscore", key, member).Float()
+}
+
+// ZRange returns the members from rank start to stop included, ordered by
+// score, negative ranks counting from the highest score.
+func (c *Client) ZRange(ctx context.Context, key string, start, stop int64) ([]string, error) {
+	return c.Cmd(ctx, "zrange", key, itoa(start), itoa(stop)).Strings()
+}
+
+// ZRangeWithScores is like ZRange, but returns the scores too.
+func (c *Client) ZRangeWithScores(ctx context.Context, key string, start, stop int64) ([]Z, error) {
+	v, err := c.Cmd(ctx, "zrange", key, itoa(start), itoa(stop), "withscores").Value()
+	if err != nil {
+		return nil, err
+	}
+	var zs []Z
+	for i := 0; i < len(v.Elems); i++ {
+		var member, score resp.Value
+		if e := v.Elems[i]; e.Type == resp.Array {
+			// RESP3: every member and its score in a nested array.
+			if len(e.Elems) != 2 {
+				return nil, errors.New("kiwi: unexpected reply to ZRANGE")
+			}
+			member, score = e.Elems[0], e.Elems[1]
+		} else {
+			if i+1 == len(v.Elems) {
+				return nil, errors.New("kiwi: unexpected reply to ZRANGE")
+			}
+			member, score = e, v.Elems[i+1]
+			i++
+		}
+		s, err := (&Cmd{val: score}).Float()
+		if err != nil {
+			return nil, err
+		}
+		zs = append(zs, Z{Score: s, Member: member.Str})
+	}
+	return zs, nil
+}
+
+// Pub/Sub
+
+// Publish posts a message to a channel and returns the number of clients
+// that received it.
+func (c *Client) Publish(ctx context.Context, channel, message string) (int64, error) {
+	return c.Cmd(ctx, "publish", channel, message).Int()
+}
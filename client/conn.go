@@ -0,0 +1,220 @@
+package client
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"io"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/zhaotong0312/kiwi/resp"
+)
+
+// conn is a connection to the server. A conn is used by a single
+// goroutine at a time, see pool.
+type conn struct {
+	nc     net.Conn
+	rd     *resp.Reader
+	wr     *resp.Writer
+	usedAt time.Time // When the conn was put back in the pool
+	broken bool      // The stream can't be trusted anymore
+	sent   int64     // Bytes written to nc
+	unsent bool      // The last write failed before sending any byte
+}
+
+// countingWriter writes to the connection, counting the bytes sent.
+type countingWriter struct{ cn *conn }
+
+func (w countingWriter) Write(p []byte) (int, error) {
+	n, err := w.cn.nc.Write(p)
+	w.cn.sent += int64(n)
+	return n, err
+}
+
+// dial connects to the server, then authenticates and selects the
+// database of the options.
+func dial(ctx context.Context, opt *Options) (*conn, error) {
+	d := &net.Dialer{Timeout: opt.DialTimeout}
+	var nc net.Conn
+	var err error
+	if opt.TLSConfig != nil {
+		td := &tls.Dialer{NetDialer: d, Config: opt.TLSConfig}
+		nc, err = td.DialContext(ctx, opt.Network, opt.Addr)
+	} else {
+		nc, err = d.DialContext(ctx, opt.Network, opt.Addr)
+	}
+	if err != nil {
+		return nil, err
+	}
+	cn := &conn{nc: nc, rd: resp.NewReader(nc)}
+	cn.wr = resp.NewWriter(countingWriter{cn})
+	if err := cn.init(ctx, opt); err != nil {
+		nc.Close()
+		return nil, err
+	}
+	return cn, nil
+}
+
+// init sends the commands preparing a new connection, in a single round
+// trip: HELLO or AUTH, and SELECT.
+func (cn *conn) init(ctx context.Context, opt *Options) error {
+	var cmds []*Cmd
+	if opt.Protocol == 3 {
+		hello := []string{"hello", "3"}
+		if opt.Password != "" {
+			user := opt.Username
+			if user == "" {
+				user = "default"
+			}
+			hello = append(hello, "auth", user, opt.Password)
+		}
+		cmds = append(cmds, newCmd(hello))
+	} else if opt.Password != "" {
+		if opt.Username != "" {
+			cmds = append(cmds, newCmd([]string{"auth", opt.Username, opt.Password}))
+		} else {
+			cmds = append(cmds, newCmd([]string{"auth", opt.Password}))
+		}
+	}
+	if opt.DB != 0 {
+		cmds = append(cmds, newCmd([]string{"select", itoa(int64(opt.DB))}))
+	}
+	if len(cmds) == 0 {
+		return nil
+	}
+	if err := cn.roundTrip(ctx, opt, cmds); err != nil {
+		return err
+	}
+	for _, cmd := range cmds {
+		if cmd.err != nil {
+			return cmd.err
+		}
+	}
+	return nil
+}
+
+// deadline returns the earliest of the timeout and the deadline of ctx,
+// the zero time if there is none.
+func deadline(ctx context.Context, timeout time.Duration) time.Time {
+	var t time.Time
+	if timeout > 0 {
+		t = time.Now().Add(timeout)
+	}
+	if d, ok := ctx.Deadline(); ok && (t.IsZero() || d.Before(t)) {
+		t = d
+	}
+	return t
+}
+
+// roundTrip writes the commands, then reads their replies into them. The
+// error replies are stored in the commands: the returned error is a
+// network or protocol error, after which the conn is broken.
+func (cn *conn) roundTrip(ctx context.Context, opt *Options, cmds []*Cmd) error {
+	if err := cn.write(ctx, opt, cmds); err != nil {
+		return err
+	}
+	return cn.read(ctx, opt, cmds)
+}
+
+func (cn *conn) write(ctx context.Context, opt *Options, cmds []*Cmd) error {
+	sent := cn.sent
+	err := cn.interruptible(ctx, func() error {
+		cn.nc.SetWriteDeadline(deadline(ctx, opt.WriteTimeout))
+		for _, cmd := range cmds {
+			cn.wr.WriteCommand(cmd.args...)
+		}
+		return cn.wr.Flush()
+	})
+	cn.unsent = err != nil && cn.sent == sent
+	if err != nil {
+		cn.broken = true
+		// The writer errors are sticky.
+		cn.wr.Reset(countingWriter{cn})
+	}
+	return err
+}
+
+func (cn *conn) read(ctx context.Context, opt *Options, cmds []*Cmd) error {
+	err := cn.interruptible(ctx, func() error {
+		cn.nc.SetReadDeadline(deadline(ctx, opt.ReadTimeout))
+		for _, cmd := range cmds {
+			v, err := cn.rd.ReadValue()
+			if err != nil {
+				return err
+			}
+			cmd.setValue(v)
+		}
+		return nil
+	})
+	if err != nil {
+		cn.broken = true
+	}
+	return err
+}
+
+// interruptible runs fn, interrupting its reads and writes if ctx is done
+// meanwhile. The error of ctx is returned then.
+func (cn *conn) interruptible(ctx context.Context, fn func() error) error {
+	if ctx.Done() == nil {
+		return fn()
+	}
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	stop := context.AfterFunc(ctx, func() {
+		cn.nc.SetDeadline(time.Unix(1, 0))
+	})
+	err := fn()
+	if !stop() && ctx.Err() != nil {
+		cn.broken = true
+		return ctx.Err()
+	}
+	return err
+}
+
+func (cn *conn) Close() error {
+	return cn.nc.Close()
+}
+
+// shouldRetry reports whether a command failed with err can be retried on
+// another connection: the connection broke, but not because of a timeout
+// or of the context.
+func shouldRetry(err error) bool {
+	if errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) {
+		return false
+	}
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
+		return true
+	}
+	var ne net.Error
+	if errors.As(err, &ne) {
+		return !ne.Timeout()
+	}
+	return false
+}
+
+// readOnlyCommands are the commands that can be executed twice without
+// harm, if the connection broke after they were sent.
+var readOnlyCommands = map[string]bool{
+	"ping": true, "echo": true, "get": true, "mget": true, "strlen": true,
+	"getrange": true, "exists": true, "type": true, "ttl": true, "pttl": true,
+	"keys": true, "dbsize": true, "info": true, "time": true,
+	"hget": true, "hmget": true, "hgetall": true, "hkeys": true, "hvals": true,
+	"hlen": true, "hexists": true, "llen": true, "lrange": true, "lindex": true,
+	"scard": true, "smembers": true, "sismember": true, "zcard": true,
+	"zscore": true, "zrank": true, "zrevrank": true, "zrange": true,
+	"zrevrange": true, "zrangebyscore": true, "zcount": true,
+}
+
+// repeatable reports whether the commands can be sent again after a
+// network error: they are all read only.
+func repeatable(cmds []*Cmd) bool {
+	for _, cmd := range cmds {
+		if len(cmd.args) == 0 || !readOnlyCommands[strings.ToLower(cmd.args[0])] {
+			return false
+		}
+	}
+	return true
+}
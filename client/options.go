@@ -0,0 +1,88 @@
+package client
+
+import (
+	"crypto/tls"
+	"time"
+)
+
+// Options configure a Client. The zero value connects to 127.0.0.1:6379.
+type Options struct {
+	// Network is "tcp" or "unix", "tcp" by default.
+	Network string
+	// Addr is the address of the server, like "127.0.0.1:6379" or the
+	// path of a unix socket.
+	Addr string
+	// TLSConfig enables TLS when set.
+	TLSConfig *tls.Config
+
+	// Username and Password authenticate the connections with AUTH. The
+	// username is optional, the default user is used without it.
+	Username string
+	Password string
+	// DB is the database selected on connect, with SELECT.
+	DB int
+	// Protocol is the version of RESP spoken, switched to with HELLO when
+	// it is 3. RESP2 by default.
+	Protocol int
+
+	// Timeouts of dialing, of reading a reply and of writing a command.
+	// Zero means no timeout. The deadline of the context, if any, is used
+	// when it expires first.
+	DialTimeout  time.Duration
+	ReadTimeout  time.Duration
+	WriteTimeout time.Duration
+
+	// PoolSize is the maximum number of connections of the pool, 10 by
+	// default. Callers wait for a free connection once they are all in
+	// use.
+	PoolSize int
+	// IdleTimeout closes the connections idle in the pool for longer.
+	// Zero means they are never closed.
+	IdleTimeout time.Duration
+
+	// MaxRetries is the number of times a command is retried after a
+	// network error, none by default, see the package documentation for
+	// the commands that are retried.
+	MaxRetries int
+	// The backoff between the retries doubles at every retry, from
+	// MinRetryBackoff up to MaxRetryBackoff: 8ms and 512ms by default.
+	MinRetryBackoff time.Duration
+	MaxRetryBackoff time.Duration
+}
+
+func (opt *Options) init() {
+	if opt.Network == "" {
+		opt.Network = "tcp"
+	}
+	if opt.Addr == "" {
+		opt.Addr = "127.0.0.1:6379"
+	}
+	if opt.Protocol == 0 {
+		opt.Protocol = 2
+	}
+	if opt.PoolSize <= 0 {
+		opt.PoolSize = 10
+	}
+	if opt.MaxRetries < 0 {
+		opt.MaxRetries = 0
+	}
+	if opt.MinRetryBackoff == 0 {
+		opt.MinRetryBackoff = 8 * time.Millisecond
+	}
+	if opt.MaxRetryBackoff == 0 {
+		opt.MaxRetryBackoff = 512 * time.Millisecond
+	}
+}
+
+// backoff returns the time to wait before the retry number attempt, the
+// first being 0.
+func (opt *Options) backoff(attempt int) time.Duration {
+	d := opt.MinRetryBackoff
+	for i := 0; i < attempt && d < opt.MaxRetryBackoff; i++ {
+		d *= 2
+	}
+	if d > opt.MaxRetryBackoff {
+		d = opt.MaxRetryBackoff
+	}
+	return d
+}
@@ -0,0 +1,113 @@
+package client
+
+import (
+	"context"
+	"errors"
+)
+
+// ErrTxAborted is the error of the commands of a transaction discarded by
+// the server, with a null reply to EXEC.
+var ErrTxAborted = errors.New("kiwi: transaction aborted")
+
+// Pipeline queues commands to execute them in a single round trip. A
+// Pipeline is not safe for concurrent use.
+type Pipeline struct {
+	c    *Client
+	tx   bool
+	cmds []*Cmd
+}
+
+// Pipeline returns a pipeline executing its commands in a single round
+// trip. The commands of other clients may be executed between them.
+func (c *Client) Pipeline() *Pipeline {
+	return &Pipeline{c: c}
+}
+
+// TxPipeline returns a pipeline executing its commands as a transaction,
+// wrapped in MULTI and EXEC: they are executed atomically.
+func (c *Client) TxPipeline() *Pipeline {
+	return &Pipeline{c: c, tx: true}
+}
+
+// Do queues a command. Its reply is available once the pipeline is
+// executed.
+func (p *Pipeline) Do(args ...string) *Cmd {
+	cmd := newCmd(args)
+	p.cmds = append(p.cmds, cmd)
+	return cmd
+}
+
+// Len returns the number of commands queued.
+func (p *Pipeline) Len() int {
+	return len(p.cmds)
+}
+
+// Discard forgets the commands queued.
+func (p *Pipeline) Discard() {
+	p.cmds = nil
+}
+
+// Exec executes the commands queued and empties the pipeline. It returns
+// the commands, and the first error among them: the replies of the other
+// commands are still available.
+func (p *Pipeline) Exec(ctx context.Context) ([]*Cmd, error) {
+	cmds := p.cmds
+	p.cmds = nil
+	if len(cmds) == 0 {
+		return nil, nil
+	}
+	if p.tx {
+		p.c.processTx(ctx, cmds)
+	} else {
+		p.c.process(ctx, cmds)
+	}
+	for _, cmd := range cmds {
+		if cmd.err != nil {
+			return cmds, cmd.err
+		}
+	}
+	return cmds, nil
+}
+
+// processTx executes the commands between MULTI and EXEC, and stores the
+// replies of EXEC in them. A command rejected while being queued keeps its
+// error, and makes EXEC fail for the others.
+func (c *Client) processTx(ctx context.Context, cmds []*Cmd) {
+	multi := newCmd([]string{"multi"})
+	exec := newCmd([]string{"exec"})
+	wire := make([]*Cmd, 0, len(cmds)+2)
+	wire = append(wire, multi)
+	wire = append(wire, cmds...)
+	wire = append(wire, exec)
+	if err := c.process(ctx, wire); err != nil {
+		return
+	}
+	if multi.err != nil {
+		setErr(cmds, multi.err)
+		return
+	}
+	queued := make([]*Cmd, 0, len(cmds))
+	for _, cmd := range cmds {
+		if cmd.err == nil {
+			queued = append(queued, cmd)
+		}
+	}
+	switch {
+	case exec.err != nil:
+		setErr(queued, exec.err)
+	case exec.val.IsNull():
+		setErr(queued, ErrTxAborted)
+	case len(exec.val.Elems) != len(queued):
+		setErr(queued, errors.New("kiwi: unexpected number of replies to EXEC"))
+	default:
+		for i, cmd := range queued {
+			cmd.setValue(exec.val.Elems[i])
+		}
+	}
+}
+
+func setErr(cmds []*Cmd, err error) {
+	for _, cmd := range cmds {
+		cmd.err = err
+	}
+}
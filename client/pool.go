@@ -0,0 +1,93 @@
+package client
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+)
+
+// ErrClosed is returned by the methods of a closed Client.
+var ErrClosed = errors.New("kiwi: client is closed")
+
+// pool limits the number of connections to Options.PoolSize: a connection
+// is dialed only when none is idle, holding one of the tokens of sem, so
+// that callers wait for a token once all the connections are in use.
+type pool struct {
+	opt    *Options
+	sem    chan struct{} // One token per connection in use
+	mu     sync.Mutex
+	idle   []*conn // Last used at the end
+	closed bool
+}
+
+func newPool(opt *Options) *pool {
+	return &pool{opt: opt, sem: make(chan struct{}, opt.PoolSize)}
+}
+
+// get returns an idle connection, or dials a new one. It waits for a
+// connection to be put back if they are all in use, until ctx is done.
+func (p *pool) get(ctx context.Context) (*conn, error) {
+	select {
+	case p.sem <- struct{}{}:
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+	for {
+		p.mu.Lock()
+		if p.closed {
+			p.mu.Unlock()
+			<-p.sem
+			return nil, ErrClosed
+		}
+		if len(p.idle) == 0 {
+			p.mu.Unlock()
+			break
+		}
+		cn := p.idle[len(p.idle)-1]
+		p.idle = p.idle[:len(p.idle)-1]
+		p.mu.Unlock()
+		if p.opt.IdleTimeout > 0 && time.Since(cn.usedAt) > p.opt.IdleTimeout {
+			cn.Close()
+			continue
+		}
+		return cn, nil
+	}
+	cn, err := dial(ctx, p.opt)
+	if err != nil {
+		<-p.sem
+		return nil, err
+	}
+	return cn, nil
+}
+
+// put gives back a connection obtained with get. Broken connections are
+// closed.
+func (p *pool) put(cn *conn) {
+	p.mu.Lock()
+	if cn.broken || p.closed {
+		p.mu.Unlock()
+		cn.Close()
+	} else {
+		cn.usedAt = time.Now()
+		p.idle = append(p.idle, cn)
+		p.mu.Unlock()
+	}
+	<-p.sem
+}
+
+// close closes the idle connections. The connections in use are closed
+// when they are put back.
+func (p *pool) close() error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.closed {
+		return ErrClosed
+	}
+	p.closed = true
+	for _, cn := range p.idle {
+		cn.Close()
+	}
+	p.idle = nil
+	return nil
+}
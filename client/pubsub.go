@@ -0,0 +1,263 @@
+package client
+
+import (
+	"context"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/zhaotong0312/kiwi/resp"
+)
+
+// Message is a message received by a PubSub.
+type Message struct {
+	Channel string
+	Pattern string // The pattern matched by the channel, for PSUBSCRIBE
+	Payload string
+}
+
+// PubSub is a subscription to channels and patterns, on a dedicated
+// connection. When the connection breaks, a new one is dialed with a
+// backoff and the channels and patterns are subscribed again: the messages
+// published meanwhile are lost.
+type PubSub struct {
+	c        *Client
+	mu       sync.Mutex
+	cn       *conn // nil until connected, and while reconnecting
+	channels map[string]struct{}
+	patterns map[string]struct{}
+	closed   bool
+	msgs     chan *Message
+	ready    chan struct{} // Signaled when cn is set
+	done     chan struct{} // Closed by Close
+}
+
+func (c *Client) newPubSub() *PubSub {
+	ps := &PubSub{
+		c:        c,
+		channels: make(map[string]struct{}),
+		patterns: make(map[string]struct{}),
+		msgs:     make(chan *Message, 100),
+		ready:    make(chan struct{}, 1),
+		done:     make(chan struct{}),
+	}
+	go ps.run()
+	return ps
+}
+
+// Subscribe returns a PubSub subscribed to the channels.
+func (c *Client) Subscribe(ctx context.Context, channels ...string) (*PubSub, error) {
+	ps := c.newPubSub()
+	if err := ps.Subscribe(ctx, channels...); err != nil {
+		ps.Close()
+		return nil, err
+	}
+	return ps, nil
+}
+
+// PSubscribe returns a PubSub subscribed to the channels matching the
+// patterns.
+func (c *Client) PSubscribe(ctx context.Context, patterns ...string) (*PubSub, error) {
+	ps := c.newPubSub()
+	if err := ps.PSubscribe(ctx, patterns...); err != nil {
+		ps.Close()
+		return nil, err
+	}
+	return ps, nil
+}
+
+// Channel returns the channel of the messages received. It is closed by
+// Close.
+func (ps *PubSub) Channel() <-chan *Message {
+	return ps.msgs
+}
+
+// Subscribe subscribes to more channels. It returns once the command is
+// sent.
+func (ps *PubSub) Subscribe(ctx context.Context, channels ...string) error {
+	return ps.update(ctx, "subscribe", ps.channels, channels, true)
+}
+
+// Unsubscribe unsubscribes from the channels, from all of them if none is
+// given.
+func (ps *PubSub) Unsubscribe(ctx context.Context, channels ...string) error {
+	return ps.update(ctx, "unsubscribe", ps.channels, channels, false)
+}
+
+// PSubscribe subscribes to more patterns.
+func (ps *PubSub) PSubscribe(ctx context.Context, patterns ...string) error {
+	return ps.update(ctx, "psubscribe", ps.patterns, patterns, true)
+}
+
+// PUnsubscribe unsubscribes from the patterns, from all of them if none is
+// given.
+func (ps *PubSub) PUnsubscribe(ctx context.Context, patterns ...string) error {
+	return ps.update(ctx, "punsubscribe", ps.patterns, patterns, false)
+}
+
+// update adds or removes the names of set, and sends the command.
+func (ps *PubSub) update(ctx context.Context, command string, set map[string]struct{}, names []string, add bool) error {
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+	if ps.closed {
+		return ErrClosed
+	}
+	if !add && len(names) == 0 {
+		for name := range set {
+			delete(set, name)
+		}
+	}
+	for _, name := range names {
+		if add {
+			set[name] = struct{}{}
+		} else {
+			delete(set, name)
+		}
+	}
+	if add && len(names) == 0 {
+		return nil
+	}
+	cn, fresh, err := ps.connLocked(ctx)
+	if err != nil || fresh {
+		// A new connection subscribes to the whole set.
+		return err
+	}
+	return cn.write(ctx, &ps.c.opt, []*Cmd{newCmd(append([]string{command}, names...))})
+}
+
+// connLocked returns the connection, dialing it if needed: fresh is true
+// then, and the connection is subscribed to the channels and patterns.
+func (ps *PubSub) connLocked(ctx context.Context) (cn *conn, fresh bool, err error) {
+	if ps.cn != nil {
+		return ps.cn, false, nil
+	}
+	if cn, err = dial(ctx, &ps.c.opt); err != nil {
+		return nil, false, err
+	}
+	var cmds []*Cmd
+	if len(ps.channels) > 0 {
+		cmds = append(cmds, newCmd(append([]string{"subscribe"}, keys(ps.channels)...)))
+	}
+	if len(ps.patterns) > 0 {
+		cmds = append(cmds, newCmd(append([]string{"psubscribe"}, keys(ps.patterns)...)))
+	}
+	if len(cmds) > 0 {
+		if err = cn.write(ctx, &ps.c.opt, cmds); err != nil {
+			cn.Close()
+			return nil, false, err
+		}
+	}
+	// Messages can be received at any time.
+	cn.nc.SetReadDeadline(time.Time{})
+	ps.cn = cn
+	select {
+	case ps.ready <- struct{}{}:
+	default:
+	}
+	return cn, true, nil
+}
+
+func keys(set map[string]struct{}) []string {
+	names := make([]string, 0, len(set))
+	for name := range set {
+		names = append(names, name)
+	}
+	return names
+}
+
+// run receives the messages of the current connection, and reconnects
+// when it breaks.
+func (ps *PubSub) run() {
+	defer close(ps.msgs)
+	for {
+		select {
+		case <-ps.ready:
+		case <-ps.done:
+			return
+		}
+		ps.mu.Lock()
+		cn := ps.cn
+		ps.mu.Unlock()
+		if cn == nil {
+			continue
+		}
+		ps.receive(cn)
+		ps.mu.Lock()
+		if ps.cn == cn {
+			ps.cn = nil
+		}
+		ps.mu.Unlock()
+		cn.Close()
+		if !ps.reconnect() {
+			return
+		}
+	}
+}
+
+// reconnect dials a new connection with a backoff, until it succeeds or
+// the PubSub is closed. It returns false if the PubSub is closed.
+func (ps *PubSub) reconnect() bool {
+	for attempt := 0; ; attempt++ {
+		t := time.NewTimer(ps.c.opt.backoff(attempt))
+		select {
+		case <-ps.done:
+			t.Stop()
+			return false
+		case <-t.C:
+		}
+		ps.mu.Lock()
+		if ps.closed {
+			ps.mu.Unlock()
+			return false
+		}
+		_, _, err := ps.connLocked(context.Background())
+		ps.mu.Unlock()
+		if err == nil {
+			return true
+		}
+	}
+}
+
+// receive reads the messages of cn until it breaks or the PubSub is
+// closed. The confirmations of the subscriptions are skipped.
+func (ps *PubSub) receive(cn *conn) {
+	for {
+		v, err := cn.rd.ReadValue()
+		if err != nil {
+			return
+		}
+		if v.Type != resp.Array && v.Type != resp.Push {
+			continue
+		}
+		var msg *Message
+		switch e := v.Elems; {
+		case len(e) == 3 && strings.EqualFold(e[0].Str, "message"):
+			msg = &Message{Channel: e[1].Str, Payload: e[2].Str}
+		case len(e) == 4 && strings.EqualFold(e[0].Str, "pmessage"):
+			msg = &Message{Pattern: e[1].Str, Channel: e[2].Str, Payload: e[3].Str}
+		default:
+			continue
+		}
+		select {
+		case ps.msgs <- msg:
+		case <-ps.done:
+			return
+		}
+	}
+}
+
+// Close unsubscribes from everything and closes the connection. The
+// channel of the messages is closed.
+func (ps *PubSub) Close() error {
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+	if ps.closed {
+		return ErrClosed
+	}
+	ps.closed = true
+	close(ps.done)
+	if ps.cn != nil {
+		ps.cn.Close()
+	}
+	return nil
+}
@@ -0,0 +1,121 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/zhaotong0312/kiwi/resp"
+	"github.com/zhaotong0312/kiwi/server"
+)
+
+// formatTTY formats a reply for humans, like:
+//
+//  1. "first"
+//  2. (integer) 2
+//  3. 1) "nested"
+//  2. (nil)
+//
+// Strings are quoted so that they can be pasted back in a command, see
+// resp.SplitArgs. indent is written before every line but the first.
+func formatTTY(v resp.Value, indent string) string {
+	var b strings.Builder
+	switch v.Type {
+	case resp.Error, resp.BulkError:
+		b.WriteString("(error) " + v.Str)
+	case resp.SimpleString:
+		b.WriteString(v.Str)
+	case resp.Integer:
+		b.WriteString("(integer) " + strconv.FormatInt(v.Int, 10))
+	case resp.Double:
+		b.WriteString("(double) " + resp.FormatDouble(v.Float))
+	case resp.BigNumber:
+		b.WriteString("(big number) " + v.Str)
+	case resp.Boolean:
+		if v.Bool {
+			b.WriteString("(true)")
+		} else {
+			b.WriteString("(false)")
+		}
+	case resp.Null:
+		b.WriteString("(nil)")
+	case resp.BulkString:
+		b.WriteString(server.CatRepr(v.Str))
+	case resp.VerbatimString:
+		b.WriteString(v.Str)
+	case resp.Array, resp.Set, resp.Push, resp.Map:
+		formatAggregate(&b, v, indent)
+		return b.String()
+	default:
+		b.WriteString("(unknown reply type " + v.Type.String() + ")")
+	}
+	b.WriteByte('\n')
+	return b.String()
+}
+
+func formatAggregate(b *strings.Builder, v resp.Value, indent string) {
+	n, sep := len(v.Elems), ")"
+	switch v.Type {
+	case resp.Map:
+		n, sep = n/2, "#"
+	case resp.Set:
+		sep = "~"
+	}
+	if n == 0 {
+		switch v.Type {
+		case resp.Map:
+			b.WriteString("(empty hash)\n")
+		case resp.Set:
+			b.WriteString("(empty set)\n")
+		default:
+			b.WriteString("(empty array)\n")
+		}
+		return
+	}
+	width := len(strconv.Itoa(n))
+	for i := 0; i < n; i++ {
+		if i > 0 {
+			b.WriteString(indent)
+		}
+		label := fmt.Sprintf("%*d%s ", width, i+1, sep)
+		b.WriteString(label)
+		inner := indent + strings.Repeat(" ", len(label))
+		if v.Type == resp.Map {
+			key := formatTTY(v.Elems[2*i], inner)
+			b.WriteString(strings.TrimSuffix(key, "\n"))
+			b.WriteString(" => ")
+			b.WriteString(formatTTY(v.Elems[2*i+1], inner+strings.Repeat(" ", len(key)+3)))
+		} else {
+			b.WriteString(formatTTY(v.Elems[i], inner))
+		}
+	}
+}
+
+// formatRaw formats a reply for programs, when the output is not a
+// terminal: the strings are written as is, and the elements of aggregates
+// on their own lines.
+func formatRaw(v resp.Value) string {
+	var b strings.Builder
+	switch v.Type {
+	case resp.Integer:
+		b.WriteString(strconv.FormatInt(v.Int, 10))
+	case resp.Double:
+		b.WriteString(resp.FormatDouble(v.Float))
+	case resp.Boolean:
+		if v.Bool {
+			b.WriteString("1")
+		} else {
+			b.WriteString("0")
+		}
+	case resp.Null:
+	case resp.Array, resp.Set, resp.Push, resp.Map:
+		for _, e := range v.Elems {
+			b.WriteString(formatRaw(e))
+		}
+		return b.String()
+	default:
+		b.WriteString(v.Str)
+	}
+	b.WriteByte('\n')
+	return b.String()
+}
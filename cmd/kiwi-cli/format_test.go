@@ -0,0 +1,68 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/zhaotong0312/kiwi/resp"
+	"github.com/zhaotong0312/kiwi/server"
+)
+
+func TestFormatTTY(t *testing.T) {
+	bulk := func(s string) resp.Value { return resp.Value{Type: resp.BulkString, Str: s} }
+	tests := []struct {
+		v    resp.Value
+		want string
+	}{
+		{resp.Value{Type: resp.SimpleString, Str: "OK"}, "OK\n"},
+		{resp.Value{Type: resp.Error, Str: "ERR wrong"}, "(error) ERR wrong\n"},
+		{resp.Value{Type: resp.Integer, Int: -3}, "(integer) -3\n"},
+		{resp.Value{Type: resp.Null}, "(nil)\n"},
+		{bulk("a b\n"), "\"a b\\n\"\n"},
+		{resp.Value{Type: resp.Array}, "(empty array)\n"},
+		{
+			resp.Value{Type: resp.Array, Elems: []resp.Value{
+				bulk("first"),
+				{Type: resp.Integer, Int: 2},
+				{Type: resp.Array, Elems: []resp.Value{bulk("nested"), {Type: resp.Null}}},
+			}},
+			"1) \"first\"\n2) (integer) 2\n3) 1) \"nested\"\n   2) (nil)\n",
+		},
+		{
+			resp.Value{Type: resp.Map, Elems: []resp.Value{bulk("k"), bulk("v")}},
+			"1# \"k\" => \"v\"\n",
+		},
+	}
+	for _, tt := range tests {
+		if got := formatTTY(tt.v, ""); got != tt.want {
+			t.Errorf("formatTTY(%+v) = %q, want %q", tt.v, got, tt.want)
+		}
+	}
+}
+
+func TestQuotingRoundTrip(t *testing.T) {
+	args := []string{"plain", "with space", "quote\"d", "\x00\xff\r\n\t", "'", ""}
+	line := ""
+	for _, arg := range args {
+		line += server.CatRepr(arg) + " "
+	}
+	if got := resp.SplitArgs([]byte(line)); !reflect.DeepEqual(got, args) {
+		t.Errorf("SplitArgs(%q) = %q, want %q", line, got, args)
+	}
+}
+
+func TestHintLine(t *testing.T) {
+	tests := []struct{ line, want string }{
+		{"get", ""},
+		{"get ", "key"},
+		{"set foo", " arg [arg ...]"},
+		{"mset ", "key arg [key arg ...]"},
+		{"mset a b ", "[key arg ...]"},
+		{"nosuchcommand ", ""},
+	}
+	for _, tt := range tests {
+		if got := hintLine(tt.line); got != tt.want {
+			t.Errorf("hintLine(%q) = %q, want %q", tt.line, got, tt.want)
+		}
+	}
+}
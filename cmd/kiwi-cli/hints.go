@@ -0,0 +1,124 @@
+package main
+
+import (
+	"sort"
+	"strings"
+
+	"github.com/zhaotong0312/kiwi/resp"
+	"github.com/zhaotong0312/kiwi/server"
+)
+
+// commandHelp describes the arguments of a command, derived from its
+// arity and its key positions in the command table.
+type commandHelp struct {
+	name string
+	args []string // Like "key", "arg", or "[key arg ...]" for the variadic ones
+}
+
+var commands = loadCommands()
+
+// commandNames are the names of the commands, sorted.
+var commandNames []string
+
+func loadCommands() map[string]*commandHelp {
+	helps := make(map[string]*commandHelp)
+	for i := range server.CommandTable {
+		cmd := &server.CommandTable[i]
+		if _, ok := helps[cmd.Name]; ok {
+			continue
+		}
+		helps[cmd.Name] = &commandHelp{name: cmd.Name, args: argNames(cmd)}
+		commandNames = append(commandNames, cmd.Name)
+	}
+	sort.Strings(commandNames)
+	return helps
+}
+
+// argNames returns the names of the arguments of cmd: the mandatory ones,
+// then the group of arguments repeated by variadic commands, like the key
+// and value pairs of MSET.
+func argNames(cmd *server.Command) []string {
+	name := func(i int) string {
+		if cmd.FirstKey > 0 && i >= cmd.FirstKey && (cmd.LastKey < 0 || i <= cmd.LastKey) &&
+			(i-cmd.FirstKey)%cmd.KeyStep == 0 {
+			return "key"
+		}
+		return "arg"
+	}
+	arity := cmd.Arity
+	if arity < 0 {
+		arity = -arity
+	}
+	var args []string
+	for i := 1; i < arity; i++ {
+		args = append(args, name(i))
+	}
+	if cmd.Arity < 0 {
+		step := 1
+		if cmd.LastKey < 0 && cmd.KeyStep > 1 {
+			step = cmd.KeyStep
+		}
+		group := make([]string, 0, step)
+		for i := arity; i < arity+step; i++ {
+			group = append(group, name(i))
+		}
+		args = append(args, "["+strings.Join(group, " ")+" ...]")
+	}
+	return args
+}
+
+// usage returns the synopsis of the command, like "MSET key arg [key arg
+// ...]".
+func (h *commandHelp) usage() string {
+	return strings.TrimSpace(strings.ToUpper(h.name) + " " + strings.Join(h.args, " "))
+}
+
+// completeLine returns the completions of the command name being typed
+// at the start of line, in the case of what was typed.
+func completeLine(line string) []string {
+	if strings.ContainsAny(line, " \t") {
+		return nil
+	}
+	prefix := strings.ToLower(line)
+	upper := line != "" && line == strings.ToUpper(line) && line != prefix
+	var completions []string
+	for _, name := range commandNames {
+		if strings.HasPrefix(name, prefix) {
+			if upper {
+				name = strings.ToUpper(name)
+			}
+			completions = append(completions, name)
+		}
+	}
+	return completions
+}
+
+// hintLine returns the names of the arguments not typed yet, to show
+// after the cursor.
+func hintLine(line string) string {
+	argv := resp.SplitArgs([]byte(line))
+	if len(argv) == 0 {
+		return ""
+	}
+	h := commands[strings.ToLower(argv[0])]
+	if h == nil || len(h.args) == 0 {
+		return ""
+	}
+	typed := len(argv) - 1
+	prefix := ""
+	if !strings.HasSuffix(line, " ") {
+		if typed == 0 {
+			// The name of the command is still being typed.
+			return ""
+		}
+		prefix = " "
+	}
+	if typed >= len(h.args) {
+		last := h.args[len(h.args)-1]
+		if !strings.HasPrefix(last, "[") {
+			return ""
+		}
+		return prefix + last
+	}
+	return prefix + strings.Join(h.args[typed:], " ")
+}
@@ -0,0 +1,291 @@
+// Command kiwi-cli is the command line interface of kiwi.
+//
+// Without a command, it starts an interactive prompt, with a history,
+// the completion of the command names and hints about their arguments:
+//
+//	kiwi-cli -h 127.0.0.1 -p 6379
+//	127.0.0.1:6379> set foo bar
+//	OK
+//
+// Otherwise, it executes the command given as arguments, or one command
+// per line of its input when it is not a terminal:
+//
+//	kiwi-cli -r 3 -i 0.5 incr counter
+//	echo "get foo" | kiwi-cli
+package main
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/zhaotong0312/kiwi/client"
+	"github.com/zhaotong0312/kiwi/resp"
+)
+
+type cli struct {
+	opt      client.Options
+	c        *client.Client
+	tty      bool
+	repeat   int
+	interval time.Duration
+}
+
+func main() {
+	var (
+		host     = flag.String("h", "127.0.0.1", "Server hostname.")
+		port     = flag.Int("p", 6379, "Server port.")
+		password = flag.String("a", "", "Password to use when connecting to the server.")
+		user     = flag.String("user", "", "Used to send ACL style 'AUTH username pass'. Needs -a.")
+		db       = flag.Int("n", 0, "Database number.")
+		repeat   = flag.Int("r", 1, "Execute specified command N times, forever if negative.")
+		interval = flag.Float64("i", 0, "When -r is used, waits <interval> seconds per command.\n"+
+			"It is possible to specify sub-second times like -i 0.1.")
+		resp3 = flag.Bool("3", false, "Start session in RESP3 protocol mode.")
+	)
+	flag.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: kiwi-cli [OPTIONS] [cmd [arg [arg ...]]]\n")
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+
+	cl := &cli{
+		opt: client.Options{
+			Addr:        net.JoinHostPort(*host, strconv.Itoa(*port)),
+			Username:    *user,
+			Password:    *password,
+			DB:          *db,
+			Protocol:    2,
+			DialTimeout: 5 * time.Second,
+			PoolSize:    1,
+			MaxRetries:  1,
+		},
+		tty:      isTerminal(int(os.Stdout.Fd())),
+		repeat:   *repeat,
+		interval: time.Duration(*interval * float64(time.Second)),
+	}
+	if *resp3 {
+		cl.opt.Protocol = 3
+	}
+	cl.c = client.New(&cl.opt)
+	defer cl.c.Close()
+
+	switch {
+	case flag.NArg() > 0:
+		if !cl.repeatCommand(flag.Args(), cl.repeat) {
+			os.Exit(1)
+		}
+	case !isTerminal(int(os.Stdin.Fd())):
+		if !cl.readCommands(os.Stdin) {
+			os.Exit(1)
+		}
+	default:
+		cl.repl()
+	}
+}
+
+// repl runs the interactive prompt until Ctrl-D or "quit".
+func (cl *cli) repl() {
+	historyFile := ""
+	if home, err := os.UserHomeDir(); err == nil {
+		historyFile = filepath.Join(home, ".kiwicli_history")
+	}
+	e := newLineEditor(historyFile)
+
+	connected := cl.connect()
+	for {
+		prompt := "not connected> "
+		if connected {
+			prompt = cl.prompt()
+		}
+		line, err := e.readLine(prompt)
+		if err == errInterrupted {
+			continue
+		} else if err != nil {
+			if err != io.EOF {
+				fmt.Fprintln(os.Stderr, err)
+			}
+			return
+		}
+		argv := resp.SplitArgs([]byte(line))
+		if argv == nil {
+			fmt.Println("Invalid argument(s)")
+			continue
+		}
+		if len(argv) == 0 {
+			continue
+		}
+		e.addHistory(strings.TrimSpace(line))
+
+		switch strings.ToLower(argv[0]) {
+		case "quit", "exit":
+			return
+		case "help":
+			cl.help(argv[1:])
+			continue
+		case "clear":
+			fmt.Print("\x1b[H\x1b[2J")
+			continue
+		}
+		// "3 incr foo" executes "incr foo" three times.
+		repeat := 1
+		if n, err := strconv.Atoi(argv[0]); err == nil && len(argv) > 1 {
+			repeat, argv = n, argv[1:]
+		}
+		connected = cl.repeatCommand(argv, repeat)
+	}
+}
+
+// connect checks that the server can be reached, printing the error if
+// not.
+func (cl *cli) connect() bool {
+	if _, err := cl.c.Do(context.Background(), "ping"); err != nil && !isServerError(err) {
+		cl.connectionError(err)
+		return false
+	}
+	return true
+}
+
+func (cl *cli) prompt() string {
+	if cl.opt.DB != 0 {
+		return fmt.Sprintf("%s[%d]> ", cl.opt.Addr, cl.opt.DB)
+	}
+	return cl.opt.Addr + "> "
+}
+
+func (cl *cli) help(args []string) {
+	if len(args) == 0 {
+		fmt.Println("kiwi-cli")
+		fmt.Println(`To get help about a command, type "help <command>".`)
+		fmt.Println("Use the TAB key to complete the command names.")
+		fmt.Println(`To quit, type "quit" or press Ctrl-D.`)
+		return
+	}
+	h := commands[strings.ToLower(args[0])]
+	if h == nil {
+		fmt.Printf("No help for %q\n", args[0])
+		return
+	}
+	fmt.Println("\n  " + h.usage() + "\n")
+}
+
+// readCommands executes one command per line of r.
+func (cl *cli) readCommands(r io.Reader) bool {
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(nil, 512*1024*1024)
+	ok := true
+	for scanner.Scan() {
+		argv := resp.SplitArgs(scanner.Bytes())
+		if argv == nil {
+			fmt.Fprintln(os.Stderr, "Invalid argument(s)")
+			ok = false
+			continue
+		}
+		if len(argv) == 0 {
+			continue
+		}
+		if !cl.repeatCommand(argv, cl.repeat) {
+			return false
+		}
+	}
+	return ok
+}
+
+// repeatCommand executes argv repeat times, forever if negative, waiting
+// for the interval in between. It returns false on a connection error.
+func (cl *cli) repeatCommand(argv []string, repeat int) bool {
+	for i := 0; repeat < 0 || i < repeat; i++ {
+		if i > 0 && cl.interval > 0 {
+			time.Sleep(cl.interval)
+		}
+		if !cl.command(argv) {
+			return false
+		}
+	}
+	return true
+}
+
+// command executes argv and prints its reply.
+func (cl *cli) command(argv []string) bool {
+	v, err := cl.c.Do(context.Background(), argv...)
+	if err != nil && !isServerError(err) {
+		if strings.EqualFold(argv[0], "shutdown") {
+			// The server closes the connection on success, without
+			// replying.
+			return true
+		}
+		cl.connectionError(err)
+		return false
+	}
+	if cl.tty {
+		fmt.Print(formatTTY(v, ""))
+	} else {
+		fmt.Print(formatRaw(v))
+	}
+	if err == nil {
+		cl.update(argv)
+	}
+	return true
+}
+
+// update keeps the options in sync with the state of the connection
+// changed by argv, so that they are restored on reconnection.
+func (cl *cli) update(argv []string) {
+	opt := cl.opt
+	switch strings.ToLower(argv[0]) {
+	case "select":
+		if len(argv) != 2 {
+			return
+		}
+		db, err := strconv.Atoi(argv[1])
+		if err != nil {
+			return
+		}
+		opt.DB = db
+	case "auth":
+		switch len(argv) {
+		case 2:
+			opt.Username, opt.Password = "", argv[1]
+		case 3:
+			opt.Username, opt.Password = argv[1], argv[2]
+		default:
+			return
+		}
+	case "hello":
+		if len(argv) < 2 {
+			return
+		}
+		if proto, err := strconv.Atoi(argv[1]); err == nil {
+			opt.Protocol = proto
+		}
+		for i := 2; i < len(argv); i++ {
+			if strings.EqualFold(argv[i], "auth") && i+2 < len(argv) {
+				opt.Username, opt.Password = argv[i+1], argv[i+2]
+				i += 2
+			}
+		}
+	default:
+		return
+	}
+	cl.c.Close()
+	cl.opt = opt
+	cl.c = client.New(&cl.opt)
+}
+
+func (cl *cli) connectionError(err error) {
+	fmt.Fprintf(os.Stderr, "Could not connect to Kiwi at %s: %v\n", cl.opt.Addr, err)
+}
+
+func isServerError(err error) bool {
+	var se resp.ServerError
+	return errors.As(err, &se)
+}
@@ -0,0 +1,291 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+// errInterrupted is returned by readLine when the line is canceled with
+// Ctrl-C.
+var errInterrupted = errors.New("interrupted")
+
+const historyMaxLen = 1000
+
+// lineEditor reads lines from a terminal in raw mode, with the usual
+// emacs key bindings, a history, the completion of the command names and
+// hints about their arguments.
+type lineEditor struct {
+	in  *bufio.Reader
+	out *os.File
+
+	history     []string
+	historyFile string
+
+	// State of the line being edited.
+	prompt string
+	buf    []rune
+	pos    int
+}
+
+func newLineEditor(historyFile string) *lineEditor {
+	e := &lineEditor{
+		in:          bufio.NewReader(os.Stdin),
+		out:         os.Stdout,
+		historyFile: historyFile,
+	}
+	e.loadHistory()
+	return e
+}
+
+func (e *lineEditor) loadHistory() {
+	if e.historyFile == "" {
+		return
+	}
+	f, err := os.Open(e.historyFile)
+	if err != nil {
+		return
+	}
+	defer f.Close()
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		if line := scanner.Text(); line != "" {
+			e.history = append(e.history, line)
+		}
+	}
+	if len(e.history) > historyMaxLen {
+		e.history = e.history[len(e.history)-historyMaxLen:]
+	}
+}
+
+// addHistory appends line to the history, and to the history file.
+func (e *lineEditor) addHistory(line string) {
+	if line == "" || strings.ContainsAny(line, "\r\n") {
+		return
+	}
+	if n := len(e.history); n > 0 && e.history[n-1] == line {
+		return
+	}
+	e.history = append(e.history, line)
+	if len(e.history) > historyMaxLen {
+		e.history = e.history[1:]
+	}
+	if e.historyFile == "" {
+		return
+	}
+	f, err := os.OpenFile(e.historyFile, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0600)
+	if err != nil {
+		return
+	}
+	f.WriteString(line + "\n")
+	f.Close()
+}
+
+// readLine reads a line after writing prompt. It returns io.EOF on Ctrl-D
+// on an empty line, and errInterrupted on Ctrl-C.
+func (e *lineEditor) readLine(prompt string) (string, error) {
+	fd := int(os.Stdin.Fd())
+	old, err := makeRaw(fd)
+	if err != nil {
+		return "", err
+	}
+	defer restoreTerminal(fd, old)
+
+	e.prompt, e.buf, e.pos = prompt, e.buf[:0], 0
+	// The history being browsed: the entry edited last is the line being
+	// typed, saved there while the older entries are shown.
+	entries := append(append([]string(nil), e.history...), "")
+	current := len(entries) - 1
+	var completions []string
+	completion := -1
+	e.refresh()
+
+	for {
+		r, _, err := e.in.ReadRune()
+		if err != nil {
+			return "", err
+		}
+		if r != '\t' {
+			completions, completion = nil, -1
+		}
+		switch r {
+		case '\r', '\n':
+			e.pos = len(e.buf)
+			e.refreshWith("")
+			e.write("\n")
+			return string(e.buf), nil
+		case 3: // Ctrl-C
+			e.write("^C\n")
+			return "", errInterrupted
+		case 4: // Ctrl-D
+			if len(e.buf) == 0 {
+				e.write("\n")
+				return "", io.EOF
+			}
+			e.deleteAt(e.pos)
+		case '\t':
+			if completions == nil {
+				completions = completeLine(string(e.buf))
+				if len(completions) == 0 {
+					e.write("\a")
+					completions = nil
+					continue
+				}
+				// The typed line is the last candidate, back where it started.
+				completions = append(completions, string(e.buf))
+			}
+			completion = (completion + 1) % len(completions)
+			e.buf = []rune(completions[completion])
+			e.pos = len(e.buf)
+		case 127, 8: // Backspace, Ctrl-H
+			if e.pos > 0 {
+				e.pos--
+				e.deleteAt(e.pos)
+			}
+		case 1: // Ctrl-A
+			e.pos = 0
+		case 5: // Ctrl-E
+			e.pos = len(e.buf)
+		case 2: // Ctrl-B
+			if e.pos > 0 {
+				e.pos--
+			}
+		case 6: // Ctrl-F
+			if e.pos < len(e.buf) {
+				e.pos++
+			}
+		case 11: // Ctrl-K
+			e.buf = e.buf[:e.pos]
+		case 21: // Ctrl-U
+			e.buf = append(e.buf[:0], e.buf[e.pos:]...)
+			e.pos = 0
+		case 23: // Ctrl-W
+			i := e.pos
+			for i > 0 && e.buf[i-1] == ' ' {
+				i--
+			}
+			for i > 0 && e.buf[i-1] != ' ' {
+				i--
+			}
+			e.buf = append(e.buf[:i], e.buf[e.pos:]...)
+			e.pos = i
+		case 12: // Ctrl-L
+			e.write("\x1b[H\x1b[2J")
+		case 16: // Ctrl-P
+			current = e.browse(entries, current, -1)
+		case 14: // Ctrl-N
+			current = e.browse(entries, current, 1)
+		case 27: // Escape sequence
+			current = e.escape(entries, current)
+		default:
+			if r < ' ' {
+				continue
+			}
+			e.buf = append(e.buf, 0)
+			copy(e.buf[e.pos+1:], e.buf[e.pos:])
+			e.buf[e.pos] = r
+			e.pos++
+		}
+		e.refresh()
+	}
+}
+
+// escape handles the escape sequences of the arrow keys, Home, End and
+// Delete.
+func (e *lineEditor) escape(entries []string, current int) int {
+	b, err := e.in.ReadByte()
+	if err != nil || (b != '[' && b != 'O') {
+		return current
+	}
+	b, err = e.in.ReadByte()
+	if err != nil {
+		return current
+	}
+	if b >= '0' && b <= '9' {
+		// Extended sequence, like "\x1b[3~".
+		if next, err := e.in.ReadByte(); err != nil || next != '~' {
+			return current
+		}
+		switch b {
+		case '1', '7':
+			e.pos = 0
+		case '4', '8':
+			e.pos = len(e.buf)
+		case '3':
+			e.deleteAt(e.pos)
+		}
+		return current
+	}
+	switch b {
+	case 'A':
+		current = e.browse(entries, current, -1)
+	case 'B':
+		current = e.browse(entries, current, 1)
+	case 'C':
+		if e.pos < len(e.buf) {
+			e.pos++
+		}
+	case 'D':
+		if e.pos > 0 {
+			e.pos--
+		}
+	case 'H':
+		e.pos = 0
+	case 'F':
+		e.pos = len(e.buf)
+	}
+	return current
+}
+
+// browse moves in the history by dir, saving the edits of the current
+// entry.
+func (e *lineEditor) browse(entries []string, current, dir int) int {
+	next := current + dir
+	if next < 0 || next >= len(entries) {
+		return current
+	}
+	entries[current] = string(e.buf)
+	e.buf = []rune(entries[next])
+	e.pos = len(e.buf)
+	return next
+}
+
+func (e *lineEditor) deleteAt(i int) {
+	if i < len(e.buf) {
+		e.buf = append(e.buf[:i], e.buf[i+1:]...)
+	}
+}
+
+// refresh redraws the line, followed by the hint of the arguments when
+// the cursor is at its end.
+func (e *lineEditor) refresh() {
+	hint := ""
+	if e.pos == len(e.buf) {
+		hint = hintLine(string(e.buf))
+	}
+	e.refreshWith(hint)
+}
+
+func (e *lineEditor) refreshWith(hint string) {
+	var b strings.Builder
+	b.WriteString("\r")
+	b.WriteString(e.prompt)
+	b.WriteString(string(e.buf))
+	if hint != "" {
+		b.WriteString("\x1b[90m" + hint + "\x1b[0m")
+	}
+	// Erase to the end of the line, then move the cursor back in place.
+	b.WriteString("\x1b[0K\r")
+	if col := utf8.RuneCountInString(e.prompt) + e.pos; col > 0 {
+		b.WriteString("\x1b[" + strconv.Itoa(col) + "C")
+	}
+	e.write(b.String())
+}
+
+func (e *lineEditor) write(s string) {
+	e.out.WriteString(s)
+}
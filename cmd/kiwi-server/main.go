@@ -0,0 +1,74 @@
+// Command kiwi-server runs a kiwi server.
+//
+// It takes the path of a config file, and options overriding it in the
+// format of the config file, prefixed with "--":
+//
+//	kiwi-server /etc/kiwi/kiwi.conf --port 6380 --loglevel debug
+//	kiwi-server --port 6380 --pidfile /run/kiwi/kiwi-6380.pid
+//	kiwi-server - < kiwi.conf
+//
+// The pid of the server is written to the pidfile, a temporary kiwi.pid by
+// default, and the server refuses to start while another server using the
+// same pidfile is alive. With "--supervised systemd", the readiness and
+// the shutdown are notified to systemd, as for a Type=notify unit.
+//
+// SIGTERM and SIGINT shut the server down like SHUTDOWN: the clients are
+// given shutdown-timeout seconds to read their replies. The exit status
+// is 0 once the server was shut down, 1 if it stopped on an error.
+package main
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/zhaotong0312/kiwi/server"
+)
+
+func usage() {
+	fmt.Fprintf(os.Stderr, `Usage: kiwi-server [/path/to/kiwi.conf] [options] [-]
+       kiwi-server - (read config from stdin)
+       kiwi-server -v or --version
+       kiwi-server -h or --help
+
+Examples:
+       kiwi-server (run the server with default config)
+       kiwi-server /etc/kiwi/6379.conf
+       kiwi-server --port 7777
+       kiwi-server /etc/mykiwi.conf --loglevel verbose
+`)
+}
+
+func main() {
+	args := os.Args[1:]
+	if len(args) > 0 {
+		switch args[0] {
+		case "-v", "--version":
+			fmt.Printf("Kiwi server v=%s\n", server.KIWI_VERSION)
+			return
+		case "-h", "--help":
+			usage()
+			return
+		}
+	}
+
+	s, err := server.NewServerFromArgs(args)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	if err := s.CreatePidFile(); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	if err := s.Start(); err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to start the server: %v\n", err)
+		s.CloseServer()
+		os.Exit(1)
+	}
+	go s.SignalHandle()
+	s.Wait()
+	if err := s.CloseServer(); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+}
@@ -1,7 +1,7 @@
 package event
 
 import (
-	"fmt"
+	"crypto/tls"
 	"io"
 	"net"
 	"strings"
@@ -27,6 +27,12 @@ const (
 	LeastConnections
 )
 
+// Flags of the connections passed to Events.Accepted.
+const (
+	// The connection was accepted by a unix socket listener.
+	UnixSocket = 1 << iota
+)
+
 // Options are set when the client opens.
 type Options struct {
 	TCPKeepAlive time.Duration
@@ -35,12 +41,15 @@ type Options struct {
 
 type addrOpts struct {
 	reusePort bool
+	tls       bool
 }
 
 type Conn interface {
 	Context() interface{}
 	SetContext(interface{})
 	AddrIndex() int
+	// LoopIndex returns the index of the loop serving the connection.
+	LoopIndex() int
 	LocalAddr() net.Addr
 	RemoteAddr() net.Addr
 	Wake()
@@ -65,17 +74,46 @@ type Events struct {
 
 	PreWrite func()
 
-	Data func(c Client, in []byte) (out []byte, action Action)
+	// Data returns its output as a list of chunks, that are written in
+	// order with writev. The chunks are referenced, not copied, until they
+	// have been written: then they are handed to Release, if set, so that
+	// their memory can be reused.
+	Data func(c Client, in []byte) (out [][]byte, action Action)
+
+	Release func(c Client, chunk []byte)
 
 	Written func(c Client, n int) (action Action)
 
+	// Busy reports whether the client still has work in progress, whose
+	// output is to come: during a GracefulShutdown, its connection is not
+	// closed before the output is written.
+	Busy func(c Client) bool
+
 	Tick func() (delay time.Duration, action Action)
 
+	// Stopped is fired by every loop once it stopped handling events,
+	// before the connections are closed. The functions posted to the loop
+	// from then on never run.
+	Stopped func(loop int)
+
+	// Latency reports how long loop spent handling an event, see the
+	// LATENCY command.
+	Latency func(loop int, event string, duration time.Duration)
+
+	// TLSConfig returns the configuration used for the connections accepted
+	// by tls:// listeners. It is called for every new connection, so that
+	// certificates can be reloaded without a restart.
+	TLSConfig func() *tls.Config
+
+	// TLSHandshakeTimeout is the time given to the TLS handshake of the
+	// new connections, DefaultTLSHandshakeTimeout if zero. The connection
+	// is closed once it elapsed.
+	TLSHandshakeTimeout time.Duration
+
 	Shutdown func()
 }
 
 func parseAddr(addr string) (network string, address string, opts addrOpts) {
-	fmt.Println("parseAddr")
 	network = "tcp"
 	address = addr
 	opts.reusePort = false
@@ -83,6 +121,11 @@ func parseAddr(addr string) (network string, address string, opts addrOpts) {
 		network = strings.Split(address, "://")[0]
 		address = strings.Split(address, "://")[1]
 	}
+	// tls:// listens on TCP, encrypting the connections.
+	if network == "tls" {
+		network = "tcp"
+		opts.tls = true
+	}
 	q := strings.Index(address, "?")
 	if q != -1 {
 		for _, part := range strings.Split(address[q+1:], "&") {
@@ -103,6 +146,5 @@ func parseAddr(addr string) (network string, address string, opts addrOpts) {
 		}
 		address = address[:q]
 	}
-	fmt.Println(network, address, opts)
 	return
 }
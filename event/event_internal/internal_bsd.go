@@ -7,6 +7,7 @@
 package internal
 
 import (
+	"sync"
 	"syscall"
 )
 
@@ -15,6 +16,8 @@ type Poll struct {
 	fd      int
 	changes []syscall.Kevent_t
 	notes   noteQueue
+	mu      sync.RWMutex // guards closed against Trigger
+	closed  bool
 }
 
 // OpenPoll ...
@@ -39,11 +42,20 @@ func OpenPoll() *Poll {
 
 // Close ...
 func (p *Poll) Close() error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.closed = true
 	return syscall.Close(p.fd)
 }
 
 // Trigger ...
 func (p *Poll) Trigger(note interface{}) error {
+	// Once closed, the kqueue fd may already be reused by another file.
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	if p.closed {
+		return syscall.EBADF
+	}
 	p.notes.Add(note)
 	_, err := syscall.Kevent(p.fd, []syscall.Kevent_t{{
 		Ident:  0,
@@ -5,14 +5,17 @@
 package internal
 
 import (
+	"sync"
 	"syscall"
 )
 
 // Poll ...
 type Poll struct {
-	fd    int // epoll fd
-	wfd   int // wake fd
-	notes noteQueue
+	fd     int // epoll fd
+	wfd    int // wake fd
+	notes  noteQueue
+	mu     sync.RWMutex // guards closed against Trigger
+	closed bool
 }
 
 // OpenPoll ...
@@ -35,6 +38,9 @@ func OpenPoll() *Poll {
 
 // Close ...
 func (p *Poll) Close() error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.closed = true
 	if err := syscall.Close(p.wfd); err != nil {
 		return err
 	}
@@ -43,6 +49,13 @@ func (p *Poll) Close() error {
 
 // Trigger ...
 func (p *Poll) Trigger(note interface{}) error {
+	// Once closed, the wake fd may already be reused by another file:
+	// writing to it would corrupt it.
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	if p.closed {
+		return syscall.EBADF
+	}
 	p.notes.Add(note)
 	_, err := syscall.Write(p.wfd, []byte{0, 0, 0, 0, 0, 0, 0, 1})
 	return err
@@ -56,6 +69,15 @@ func (p *Poll) Wait(iter func(fd int, note interface{}) error) error {
 		if err != nil && err != syscall.EINTR {
 			return err
 		}
+		// Reset the wake fd before running the notes: the counter would
+		// overflow and block Trigger otherwise, and a note added after the
+		// reset wakes the next wait.
+		for i := 0; i < n; i++ {
+			if int(events[i].Fd) == p.wfd {
+				var data [8]byte
+				syscall.Read(p.wfd, data[:])
+			}
+		}
 		if err := p.notes.ForEach(func(note interface{}) error {
 			return iter(0, note)
 		}); err != nil {
@@ -66,8 +88,6 @@ func (p *Poll) Wait(iter func(fd int, note interface{}) error) error {
 				if err := iter(fd, nil); err != nil {
 					return err
 				}
-			} else {
-
 			}
 		}
 	}
@@ -0,0 +1,45 @@
+package internal
+
+import (
+	"syscall"
+	"unsafe"
+)
+
+// IOV_MAX on the supported systems: a single writev can't take more
+// buffers than this.
+const maxIovecs = 1024
+
+// Writev writes the buffers with a single writev system call, skipping
+// the first off bytes of bufs[0]. iov is a scratch slice reused between
+// calls, the grown slice is returned along with the number of bytes
+// written.
+func Writev(fd int, iov []syscall.Iovec, bufs [][]byte, off int) (int, []syscall.Iovec, error) {
+	iov = iov[:0]
+	for i, b := range bufs {
+		if i == 0 {
+			b = b[off:]
+		}
+		if len(b) == 0 {
+			continue
+		}
+		v := syscall.Iovec{Base: &b[0]}
+		v.SetLen(len(b))
+		iov = append(iov, v)
+		if len(iov) == maxIovecs {
+			break
+		}
+	}
+	if len(iov) == 0 {
+		return 0, iov, nil
+	}
+	n, _, errno := syscall.Syscall(syscall.SYS_WRITEV, uintptr(fd),
+		uintptr(unsafe.Pointer(&iov[0])), uintptr(len(iov)))
+	// Don't keep the written buffers alive through the scratch slice.
+	for i := range iov {
+		iov[i] = syscall.Iovec{}
+	}
+	if errno != 0 {
+		return 0, iov, errno
+	}
+	return int(n), iov, nil
+}
@@ -1,11 +1,10 @@
 package event
 
 import (
+	"crypto/tls"
 	"errors"
-	"fmt"
 	"github.com/kavu/go_reuseport"
 	"github.com/zhaotong0312/kiwi/event/event_internal"
-	"github.com/zhaotong0312/kiwi/server"
 	"net"
 	"os"
 	"runtime"
@@ -17,6 +16,7 @@ import (
 
 
 var errClosing = errors.New("closing")
+var errDraining = errors.New("draining")
 //var errCloseConns = errors.New("close conns")
 
 func reusePortListen(proto, addr string) (l net.Listener, err error) {
@@ -24,18 +24,21 @@ func reusePortListen(proto, addr string) (l net.Listener, err error) {
 }
 
 type loop struct {
-	idx    int            // loop index in the EventServer loops list
-	poll   *internal.Poll // epoll or kqueue
-	buf    []byte         // read packet buffer
-	fdclis map[int]Client // loop connections fd -> clients
-	count  int32          // connection count
+	idx    int             // loop index in the EventServer loops list
+	poll   *internal.Poll  // epoll or kqueue
+	buf    []byte          // read packet buffer
+	iov    []syscall.Iovec // scratch vector for writev
+	fdclis map[int]Client  // loop connections fd -> clients
+	count  int32           // connection count
+	drain  bool            // draining the connections, see GracefulShutdown
 }
 
 
 type conn struct {
 	fd         int              // file descriptor
 	lnidx      int              // listener index in the server lns list
-	out        []byte           // write buffer
+	out        [][]byte         // chunks to write, in order
+	outOff     int              // bytes of out[0] already written
 	sa         syscall.Sockaddr // remote socket address
 	reuse      bool             // should reuse input buffer
 	opened     bool             // connection opened event fired
@@ -45,11 +48,53 @@ type conn struct {
 	localAddr  net.Addr         // local addre
 	remoteAddr net.Addr         // remote addr
 	loop       *loop            // connected loop
+	tls        *tlsConn         // TLS state, nil for plain connections
+}
+
+// push appends a chunk owned by the loop, like TLS records, to the write
+// queue.
+func (c *conn) push(chunk []byte) {
+	if len(chunk) > 0 {
+		c.out = append(c.out, chunk)
+	}
+}
+
+// loopQueue appends the output of the user events to the write queue. The
+// chunks are referenced, not copied, until they are written. On TLS
+// connections they are encrypted at once, and released.
+func loopQueue(es *EventServer, c Client, out [][]byte) error {
+	conn := c.GetConn().(*conn)
+	for _, chunk := range out {
+		if conn.tls == nil {
+			if len(chunk) == 0 {
+				loopRelease(es, c, chunk)
+				continue
+			}
+			conn.out = append(conn.out, chunk)
+			continue
+		}
+		records, err := conn.tls.queue(chunk)
+		conn.push(records)
+		loopRelease(es, c, chunk)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// loopRelease hands a chunk of output back to the user once the loop
+// doesn't reference it anymore.
+func loopRelease(es *EventServer, c Client, chunk []byte) {
+	if es.events.Release != nil && chunk != nil {
+		es.events.Release(c, chunk)
+	}
 }
 
 func (c *conn) Context() interface{}       { return c.ctx }
 func (c *conn) SetContext(ctx interface{}) { c.ctx = ctx }
 func (c *conn) AddrIndex() int             { return c.addrIndex }
+func (c *conn) LoopIndex() int             { return c.loop.idx }
 func (c *conn) LocalAddr() net.Addr        { return c.localAddr }
 func (c *conn) RemoteAddr() net.Addr       { return c.remoteAddr }
 func (c *conn) Wake() {
@@ -95,9 +140,15 @@ type listener struct {
 	fd      int
 	network string
 	addr    string
+	closed  bool
 }
 
 func (ln *listener) close() {
+	// Closed once: the file descriptor may be reused afterwards.
+	if ln.closed {
+		return
+	}
+	ln.closed = true
 	if ln.fd != 0 {
 		syscall.Close(ln.fd)
 	}
@@ -143,24 +194,56 @@ type EventServer struct {
 	loops    []*loop            // all the loops
 	lns      []*listener        // all the listeners
 	wg       sync.WaitGroup     // loop close waitgroup
-	cond     *sync.Cond         // shutdown signaler
+	shutdown chan struct{}      // closed to begin the shutdown
+	once     sync.Once          // closes shutdown only once
+	drain    time.Duration      // grace period of GracefulShutdown
+	detached int32              // loops that stopped accepting, while draining
+	done     chan struct{}      // closed once the server is closed
 	balance  LoadBalance        // load balancing method
 	accepted uintptr            // accept counter
 	tch      chan time.Duration // ticker channel
 }
 
+// Post runs fn in the loop with the given index, between two events of the
+// loop. It fails once the loops are closing.
+func (es *EventServer) Post(loop int, fn func()) error {
+	return es.loops[loop].poll.Trigger(fn)
+}
+
 // waitForShutdown waits for a signal to shutdown
 func (es *EventServer) waitForShutdown() {
-	es.cond.L.Lock()
-	es.cond.Wait()
-	es.cond.L.Unlock()
+	<-es.shutdown
 }
 
-// signalShutdown signals a shutdown an begins EventServer closing
+// signalShutdown signals a shutdown an begins EventServer closing. Signals
+// sent before Serve waits for them are not lost.
 func (es *EventServer) signalShutdown() {
-	es.cond.L.Lock()
-	es.cond.Signal()
-	es.cond.L.Unlock()
+	es.once.Do(func() { close(es.shutdown) })
+}
+
+// Shutdown begins closing the server: the listeners and all the
+// connections are closed, then the Shutdown event is fired. It doesn't
+// wait for the server to be closed, see Done.
+func (es *EventServer) Shutdown() {
+	es.signalShutdown()
+}
+
+// GracefulShutdown begins closing the server like Shutdown, but lets the
+// connections drain first: the loops stop accepting connections and
+// reading requests, and close every connection once its output is
+// written, unless it is Busy. The connections not drained after timeout
+// are closed like with Shutdown.
+func (es *EventServer) GracefulShutdown(timeout time.Duration) {
+	es.once.Do(func() {
+		es.drain = timeout
+		close(es.shutdown)
+	})
+}
+
+// Done returns a channel closed once Serve returned, after the Shutdown
+// event.
+func (es *EventServer) Done() <-chan struct{} {
+	return es.done
 }
 
 // Serve starts handling events for the specified addresses.
@@ -172,6 +255,7 @@ func (es *EventServer) signalShutdown() {
 //  tcp4  - IPv4
 //  tcp6  - IPv6
 //  unix  - Unix Domain Socket
+//  tls   - TCP, encrypted with the config returned by Events.TLSConfig
 //
 // The "tcp" network scheme is assumed when one is not specified.
 func CreateEventServer(events Events, addrs ...string) (*EventServer, error) {
@@ -210,32 +294,52 @@ func CreateEventServer(events Events, addrs ...string) (*EventServer, error) {
 	es := &EventServer{}
 	es.events = events
 	es.lns = lns
-	es.cond = sync.NewCond(&sync.Mutex{})
+	es.NumLoops = events.NumLoops
+	es.Addrs = make([]net.Addr, len(lns))
+	for i, ln := range lns {
+		es.Addrs[i] = ln.lnaddr
+	}
+	es.shutdown = make(chan struct{})
+	es.done = make(chan struct{})
 	es.balance = events.LoadBalance
 	es.tch = make(chan time.Duration)
 	return es, nil
 }
 
 func Serve(es *EventServer) error {
-
-	fmt.Println("numLoops---->", es.events.NumLoops)
-	if es.events.Serving != nil {
-		es.NumLoops = es.events.NumLoops
-		es.Addrs = make([]net.Addr, len(es.lns))
-		for i, ln := range es.lns {
-			es.Addrs[i] = ln.lnaddr
+	defer close(es.done)
+	// create loops locally and bind the listeners.
+	for i := 0; i < es.events.NumLoops; i++ {
+		l := &loop{
+			idx:    i,
+			poll:   internal.OpenPoll(),
+			buf:    make([]byte, 0xFFFF),
+			fdclis: make(map[int]Client),
 		}
+		for _, ln := range es.lns {
+			l.poll.AddRead(ln.fd)
+		}
+		es.loops = append(es.loops, l)
+	}
+	// The loops exist before the Serving event, so that functions can be
+	// posted to them from then on: they run once the loops are started.
+	if es.events.Serving != nil {
 		action := es.events.Serving(es)
 		switch action {
 		case None:
 		case Shutdown:
+			for _, l := range es.loops {
+				l.poll.Close()
+			}
+			for _, ln := range es.lns {
+				ln.close()
+			}
 			return nil
 		}
 	}
 
 	defer func() {
 		for _, ln := range es.lns {
-			fmt.Println("Closing Listeners at", ln.addr, "... Finished.")
 			ln.close()
 		}
 	}()
@@ -243,9 +347,22 @@ func Serve(es *EventServer) error {
 	defer func() {
 		// wait on a signal for shutdown
 		es.waitForShutdown()
-		// notify all loops to close by closing all listeners
-		for _, l := range es.loops {
-			l.poll.Trigger(errClosing)
+		if es.drain > 0 {
+			// let the loops drain the connections, up to the timeout
+			for _, l := range es.loops {
+				l.poll.Trigger(errDraining)
+			}
+			timer := time.AfterFunc(es.drain, func() {
+				for _, l := range es.loops {
+					l.poll.Trigger(errClosing)
+				}
+			})
+			defer timer.Stop()
+		} else {
+			// notify all loops to close by closing all listeners
+			for _, l := range es.loops {
+				l.poll.Trigger(errClosing)
+			}
 		}
 		// wait on all loops to complete reading events
 		es.wg.Wait()
@@ -261,19 +378,6 @@ func Serve(es *EventServer) error {
 		es.events.Shutdown()
 	}()
 
-	// create loops locally and bind the listeners.
-	for i := 0; i < es.events.NumLoops; i++ {
-		l := &loop{
-			idx:    i,
-			poll:   internal.OpenPoll(),
-			buf:    make([]byte, 0xFFFF),
-			fdclis: make(map[int]Client),
-		}
-		for _, ln := range es.lns {
-			l.poll.AddRead(ln.fd)
-		}
-		es.loops = append(es.loops, l)
-	}
 	// start loops in background
 	es.wg.Add(len(es.loops))
 	for _, l := range es.loops {
@@ -286,7 +390,15 @@ func loopCloseConn(es *EventServer, l *loop, c Client, err error) error {
 	conn := c.GetConn().(*conn)
 	atomic.AddInt32(&l.count, -1)
 	delete(l.fdclis, conn.fd)
+	if conn.tls != nil {
+		conn.tls.close()
+	}
 	syscall.Close(conn.fd)
+	// The output that could not be sent is released too.
+	for _, chunk := range conn.out {
+		loopRelease(es, c, chunk)
+	}
+	conn.out = nil
 	if es.events.Closed != nil {
 		switch es.events.Closed(c, err) {
 		case None:
@@ -299,7 +411,8 @@ func loopCloseConn(es *EventServer, l *loop, c Client, err error) error {
 
 func loopDetachConn(es *EventServer, l *loop, c Client, err error) error {
 	conn := c.GetConn().(*conn)
-	if es.events.Detached == nil {
+	// TLS connections can't be handed over as raw sockets.
+	if es.events.Detached == nil || conn.tls != nil {
 		return loopCloseConn(es, l, c, err)
 	}
 	l.poll.ModDetach(conn.fd)
@@ -328,11 +441,136 @@ func loopNote(es *EventServer, l *loop, note interface{}) error {
 		}
 		es.tch <- delay
 	case error: // shutdown
+		if v == errDraining {
+			return loopDrain(es, l)
+		}
 		err = v
+	case func(): // posted
+		v()
+	case *conn:
+		// Wake called for connection
+		if c, ok := l.fdclis[v.fd]; ok && c.GetConn() == v {
+			if err := loopWake(es, l, c); err != nil || !l.drain {
+				return err
+			}
+			return loopDrainConn(es, l, c)
+		}
 	}
 	return err
 }
 
+// loopDrain stops accepting connections, and begins draining the
+// connections of the loop. The loop returns once they are all closed.
+func loopDrain(es *EventServer, l *loop) error {
+	l.drain = true
+	for _, ln := range es.lns {
+		l.poll.ModDetach(ln.fd)
+	}
+	// The last loop to stop accepting closes the listeners, so that new
+	// connections are refused rather than left in the backlog.
+	if int(atomic.AddInt32(&es.detached, 1)) == len(es.loops) {
+		for _, ln := range es.lns {
+			ln.close()
+		}
+	}
+	for _, c := range l.fdclis {
+		if !c.GetConn().(*conn).opened {
+			if err := loopCloseConn(es, l, c, nil); err != nil {
+				return err
+			}
+			continue
+		}
+		if err := loopDrainConn(es, l, c); err != nil {
+			return err
+		}
+	}
+	if len(l.fdclis) == 0 {
+		return errClosing
+	}
+	return nil
+}
+
+// loopDrainConn serves the events of a connection while the loop drains:
+// the input is discarded and the output written, then the connection is
+// closed once it has nothing left to send.
+func loopDrainConn(es *EventServer, l *loop, c Client) error {
+	conn := c.GetConn().(*conn)
+	n, err := syscall.Read(conn.fd, l.buf)
+	if n == 0 || (err != nil && err != syscall.EAGAIN) {
+		// The peer is gone, and can't read the output anyway.
+		if err := loopCloseConn(es, l, c, err); err != nil {
+			return err
+		}
+	} else if len(conn.out) > 0 {
+		if err := loopWrite(es, l, c); err != nil {
+			return err
+		}
+	}
+	if l.fdclis[conn.fd] == c && len(conn.out) == 0 &&
+		(es.events.Busy == nil || !es.events.Busy(c)) {
+		if err := loopCloseConn(es, l, c, nil); err != nil {
+			return err
+		}
+	}
+	if len(l.fdclis) == 0 {
+		return errClosing
+	}
+	return nil
+}
+
+func loopWake(es *EventServer, l *loop, c Client) error {
+	conn := c.GetConn().(*conn)
+	var in []byte
+	if conn.tls != nil {
+		// The handshake goroutine has records to send, or is done.
+		var err error
+		if in, err = loopTLSProgress(conn); err != nil {
+			return loopCloseConn(es, l, c, err)
+		}
+	}
+	if es.events.Data != nil {
+		out, action := es.events.Data(c, nil)
+		conn.action = action
+		if err := loopQueue(es, c, out); err != nil {
+			return loopCloseConn(es, l, c, err)
+		}
+		// Input pipelined by the client right after the handshake.
+		if len(in) > 0 && conn.action == None {
+			out, action := es.events.Data(c, in)
+			conn.action = action
+			if err := loopQueue(es, c, out); err != nil {
+				return loopCloseConn(es, l, c, err)
+			}
+		}
+	}
+	if len(conn.out) != 0 || conn.action != None {
+		l.poll.ModReadWrite(conn.fd)
+	}
+	return nil
+}
+
+// loopTLSProgress moves the records produced by the handshake to the write
+// buffer. Once the handshake is complete it flushes the output queued
+// meanwhile, and returns the input the client already sent.
+func loopTLSProgress(conn *conn) ([]byte, error) {
+	conn.push(conn.tls.takeOut())
+	state, err := conn.tls.status()
+	switch {
+	case state == tlsFailed:
+		return nil, err
+	case state == tlsEstablished && !conn.tls.ready:
+		out, err := conn.tls.established()
+		conn.push(out)
+		if err != nil {
+			return nil, err
+		}
+		in, err := conn.tls.feed(nil)
+		conn.push(conn.tls.takeOut())
+		return in, err
+	}
+	return nil, nil
+}
+
 func loopTicker(es *EventServer, l *loop) {
 	for {
 		if err := l.poll.Trigger(time.Duration(0)); err != nil {
@@ -345,6 +583,9 @@ func loopTicker(es *EventServer, l *loop) {
 func loopRun(es *EventServer, l *loop) {
 	defer func() {
 		//fmt.Println("-- loop stopped --", l.idx)
+		if es.events.Stopped != nil {
+			es.events.Stopped(l.idx)
+		}
 		es.signalShutdown()
 		es.wg.Done()
 	}()
@@ -355,13 +596,23 @@ func loopRun(es *EventServer, l *loop) {
 
 	//fmt.Println("-- loop started --", l.idx)
 	l.poll.Wait(func(fd int, note interface{}) error {
+		if es.events.Latency != nil {
+			start := time.Now()
+			defer func() {
+				es.events.Latency(l.idx, "event-loop", time.Since(start))
+			}()
+		}
 		if fd == 0 {
 			return loopNote(es, l, note)
 		}
 		c := l.fdclis[fd]
 		switch {
+		case c == nil && l.drain:
+			return nil
 		case c == nil:
 			return loopAccept(es, l, fd)
+		case l.drain:
+			return loopDrainConn(es, l, c)
 		case !c.GetConn().(*conn).opened:
 			return loopOpened(es, l, c)
 		case len(c.GetConn().(*conn).out) > 0:
@@ -406,17 +657,33 @@ func loopAccept(es *EventServer, l *loop, fd int) error {
 			if err := syscall.SetNonblock(nfd, true); err != nil {
 				return err
 			}
-			conn := &conn{fd: nfd, sa: sa, lnidx: i}
+			conn := &conn{fd: nfd, sa: sa, lnidx: i, loop: l}
+			if ln.opts.tls {
+				var config *tls.Config
+				if es.events.TLSConfig != nil {
+					config = es.events.TLSConfig()
+				}
+				if config == nil {
+					// TLS is not configured: refuse the connection.
+					syscall.Close(nfd)
+					return nil
+				}
+				conn.tls = newTLSConn(conn, config, es.events.TLSHandshakeTimeout)
+			}
 			flag := 0
 			if ln.network == "unix" {
-				flag |= server.CLIENT_UNIX_SOCKET
+				flag |= UnixSocket
 			}
 			l.poll.AddReadWrite(conn.fd)
 			c, action := es.events.Accepted(conn, flag)
-			if c == nil || action != None {
-				return err
-				conn.action = action
+			if c == nil {
+				// Closing the fd removes it from the poller too.
+				syscall.Close(nfd)
+				return nil
 			}
+			// The action, like Close, is performed once the connection
+			// is writable.
+			conn.action = action
 			l.fdclis[conn.fd] = c
 			atomic.AddInt32(&l.count, 1)
 			break
@@ -430,10 +697,16 @@ func loopOpened(es *EventServer, l *loop, c Client) error {
 	conn.opened = true
 	conn.addrIndex = conn.lnidx
 	conn.remoteAddr = internal.SockaddrToAddr(conn.sa)
+	conn.localAddr = es.lns[conn.lnidx].lnaddr
+	if conn.tls != nil {
+		conn.tls.handshake()
+	}
 	if es.events.Opened != nil {
 		out, opts, action := es.events.Opened(c)
 		if len(out) > 0 {
-			conn.out = append([]byte{}, out...)
+			if err := loopQueue(es, c, [][]byte{out}); err != nil {
+				return loopCloseConn(es, l, c, err)
+			}
 		}
 		conn.action = action
 		conn.reuse = opts.ReuseInputBuffer
@@ -443,7 +716,7 @@ func loopOpened(es *EventServer, l *loop, c Client) error {
 			}
 		}
 	}
-	if len(conn.out) > 0 && conn.action == None {
+	if len(conn.out) == 0 && conn.action == None {
 		l.poll.ModRead(conn.fd)
 	}
 	return nil
@@ -478,14 +751,28 @@ func loopRead(es *EventServer, l *loop, c Client) error {
 		return loopCloseConn(es, l, c, err)
 	}
 	in = l.buf[:n]
-	if !conn.reuse {
+	if conn.tls != nil {
+		// Decrypt the input: there is nothing to process until the
+		// handshake is complete or a whole record was received.
+		if in, err = conn.tls.feed(in); err != nil {
+			return loopCloseConn(es, l, c, err)
+		}
+		// Reading may produce records too, like KeyUpdate responses.
+		conn.push(conn.tls.takeOut())
+		if len(in) == 0 {
+			if len(conn.out) != 0 {
+				l.poll.ModReadWrite(conn.fd)
+			}
+			return nil
+		}
+	} else if !conn.reuse {
 		in = append([]byte{}, in...)
 	}
 	if es.events.Data != nil {
 		out, action := es.events.Data(c, in)
 		conn.action = action
-		if len(out) > 0 {
-			conn.out = append([]byte{}, out...)
+		if err := loopQueue(es, c, out); err != nil {
+			return loopCloseConn(es, l, c, err)
 		}
 	}
 	if len(conn.out) != 0 || conn.action != None {
@@ -499,18 +786,28 @@ func loopWrite(es *EventServer, l *loop, c Client) error {
 	if es.events.PreWrite != nil {
 		es.events.PreWrite()
 	}
-	n, err := syscall.Write(conn.fd, conn.out)
+	// All the queued chunks go with a single writev.
+	n, iov, err := internal.Writev(conn.fd, l.iov, conn.out, conn.outOff)
+	l.iov = iov
 	if err != nil {
 		if err == syscall.EAGAIN {
 			return nil
 		}
 		return loopCloseConn(es, l, c, err)
 	}
-	if n == len(conn.out) {
-		conn.out = nil
-	} else {
-		conn.out = conn.out[n:]
+	// Drop the chunks completely written, and release them.
+	conn.outOff += n
+	k := 0
+	for k < len(conn.out) && conn.outOff >= len(conn.out[k]) {
+		conn.outOff -= len(conn.out[k])
+		loopRelease(es, c, conn.out[k])
+		k++
+	}
+	rest := copy(conn.out, conn.out[k:])
+	for i := rest; i < len(conn.out); i++ {
+		conn.out[i] = nil
 	}
+	conn.out = conn.out[:rest]
 	if es.events.Written != nil {
 		conn.action = es.events.Written(c, n)
 	}
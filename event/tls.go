@@ -0,0 +1,239 @@
+package event
+
+import (
+	"crypto/tls"
+	"errors"
+	"net"
+	"sync"
+	"time"
+)
+
+// TLS connections are served by the loops like plain ones: the loop owns
+// the socket, reads the encrypted bytes from it and writes the encrypted
+// bytes to it, while crypto/tls only sees an in-memory transport.
+//
+// Once the handshake is complete the record layer runs inline in the loop:
+// the transport returns a temporary error when no more input is buffered,
+// which crypto/tls treats as "try again later" keeping partial records.
+// crypto/tls can't resume a handshake interrupted this way, so the
+// handshake alone runs in a helper goroutine that only waits for the bytes
+// handed over by the loop, and wakes the loop when it has records to send
+// or when it is done.
+//
+// A peer that never completes the handshake would keep its goroutine
+// forever: the handshake is given Events.TLSHandshakeTimeout, after which
+// the goroutine is released and the loop closes the connection.
+
+const (
+	tlsHandshaking = iota
+	tlsEstablished
+	tlsFailed
+)
+
+// DefaultTLSHandshakeTimeout is the handshake timeout used when
+// Events.TLSHandshakeTimeout is not set.
+const DefaultTLSHandshakeTimeout = 10 * time.Second
+
+var errTLSHandshakeTimeout = errors.New("tls: handshake timeout")
+
+// errWouldBlock is returned by the transport when the loop has no more
+// input for crypto/tls.
+var errWouldBlock = wouldBlockError{}
+
+type wouldBlockError struct{}
+
+func (wouldBlockError) Error() string   { return "tls: would block" }
+func (wouldBlockError) Timeout() bool   { return true }
+func (wouldBlockError) Temporary() bool { return true }
+
+type tlsConn struct {
+	tc      *tls.Conn
+	mu      sync.Mutex
+	cond    *sync.Cond
+	in      []byte // encrypted bytes read from the socket
+	out     []byte // encrypted bytes to write to the socket
+	pending []byte // plaintext output queued during the handshake
+	state   int
+	started bool // handshake goroutine started
+	ready   bool // handshake completion handled by the loop
+	closed  bool
+	err     error
+	wake    func()
+	timeout time.Duration
+	timer   *time.Timer // fails the handshake once timeout elapsed
+}
+
+func newTLSConn(c *conn, config *tls.Config, timeout time.Duration) *tlsConn {
+	if timeout <= 0 {
+		timeout = DefaultTLSHandshakeTimeout
+	}
+	t := &tlsConn{wake: c.Wake, timeout: timeout}
+	t.cond = sync.NewCond(&t.mu)
+	t.tc = tls.Server(&tlsTransport{t: t, c: c}, config)
+	return t
+}
+
+// handshake runs the server side of the handshake in the background, up to
+// the handshake timeout.
+func (t *tlsConn) handshake() {
+	t.started = true
+	t.timer = time.AfterFunc(t.timeout, func() {
+		t.mu.Lock()
+		if t.state == tlsHandshaking {
+			t.state = tlsFailed
+			t.err = errTLSHandshakeTimeout
+			// Unblock the goroutine waiting for input.
+			t.closed = true
+			t.cond.Broadcast()
+		}
+		t.mu.Unlock()
+		t.wake()
+	})
+	go func() {
+		err := t.tc.Handshake()
+		t.timer.Stop()
+		t.mu.Lock()
+		// The handshake may have timed out already.
+		if t.state == tlsHandshaking {
+			if err != nil {
+				t.state = tlsFailed
+				t.err = err
+			} else {
+				t.state = tlsEstablished
+			}
+		}
+		t.mu.Unlock()
+		t.wake()
+	}()
+}
+
+func (t *tlsConn) status() (int, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.state, t.err
+}
+
+// takeOut returns the encrypted bytes ready to be written to the socket.
+func (t *tlsConn) takeOut() []byte {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	out := t.out
+	t.out = nil
+	return out
+}
+
+// feed hands the bytes read from the socket to crypto/tls and returns the
+// decrypted input available so far. Nothing is returned while the
+// handshake is still in progress.
+func (t *tlsConn) feed(in []byte) ([]byte, error) {
+	t.mu.Lock()
+	t.in = append(t.in, in...)
+	state, err := t.state, t.err
+	t.cond.Signal()
+	t.mu.Unlock()
+	switch state {
+	case tlsFailed:
+		return nil, err
+	case tlsHandshaking:
+		return nil, nil
+	}
+	var plain []byte
+	buf := make([]byte, 0x4000)
+	for {
+		n, err := t.tc.Read(buf)
+		plain = append(plain, buf[:n]...)
+		if err != nil {
+			if err == errWouldBlock || len(plain) > 0 {
+				return plain, nil
+			}
+			return nil, err
+		}
+	}
+}
+
+// queue encrypts the output, or keeps it aside until the handshake is
+// complete, and returns the records ready to be written to the socket.
+func (t *tlsConn) queue(out []byte) ([]byte, error) {
+	if !t.ready {
+		t.pending = append(t.pending, out...)
+		return nil, nil
+	}
+	if _, err := t.tc.Write(out); err != nil {
+		return nil, err
+	}
+	return t.takeOut(), nil
+}
+
+// established is called by the loop once the handshake is complete: it
+// flushes the output queued meanwhile.
+func (t *tlsConn) established() ([]byte, error) {
+	t.ready = true
+	pending := t.pending
+	t.pending = nil
+	if len(pending) == 0 {
+		return t.takeOut(), nil
+	}
+	return t.queue(pending)
+}
+
+// close unblocks the handshake goroutine, if it is still waiting for input.
+func (t *tlsConn) close() {
+	if t.timer != nil {
+		t.timer.Stop()
+	}
+	t.mu.Lock()
+	t.closed = true
+	t.cond.Broadcast()
+	t.mu.Unlock()
+}
+
+// tlsTransport is the net.Conn crypto/tls reads from and writes to.
+type tlsTransport struct {
+	t *tlsConn
+	c *conn
+}
+
+var errTLSClosed = errors.New("tls: connection closed")
+
+func (tr *tlsTransport) Read(p []byte) (int, error) {
+	t := tr.t
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for len(t.in) == 0 {
+		if t.closed {
+			return 0, errTLSClosed
+		}
+		// Only the handshake goroutine can wait: the loop must never block.
+		if t.state != tlsHandshaking {
+			return 0, errWouldBlock
+		}
+		t.cond.Wait()
+	}
+	n := copy(p, t.in)
+	t.in = t.in[n:]
+	return n, nil
+}
+
+func (tr *tlsTransport) Write(p []byte) (int, error) {
+	t := tr.t
+	t.mu.Lock()
+	if t.closed {
+		t.mu.Unlock()
+		return 0, errTLSClosed
+	}
+	t.out = append(t.out, p...)
+	handshaking := t.state == tlsHandshaking
+	t.mu.Unlock()
+	// The handshake goroutine wakes the loop to get its records sent.
+	if handshaking {
+		t.wake()
+	}
+	return len(p), nil
+}
+
+func (tr *tlsTransport) Close() error                       { tr.t.close(); return nil }
+func (tr *tlsTransport) LocalAddr() net.Addr                { return tr.c.localAddr }
+func (tr *tlsTransport) RemoteAddr() net.Addr               { return tr.c.remoteAddr }
+func (tr *tlsTransport) SetDeadline(t time.Time) error      { return nil }
+func (tr *tlsTransport) SetReadDeadline(t time.Time) error  { return nil }
+func (tr *tlsTransport) SetWriteDeadline(t time.Time) error { return nil }
@@ -2,8 +2,12 @@ package examples
 
 
 func main() {
-	//server.InitServer()
-	//server.StartServer()
-	//server.WaitEventServerClosed()
-	//server.CloseServer()
-}
\ No newline at end of file
+	//s, err := server.NewServerFromArgs(os.Args[1:])
+	//if err != nil {
+	//	log.Fatal(err)
+	//}
+	//s.Start()
+	//go s.SignalHandle()
+	//s.Wait()
+	//s.CloseServer()
+}
@@ -0,0 +1,523 @@
+// Package kiwi embeds a kiwi server in a Go program.
+//
+// A DB is a server without networking: its typed methods run the same
+// command implementations as the network server, through internal clients
+// that need no connection, so the data, the expires, the memory limit and
+// the ACL log behave the same whether a key is written by the program or
+// by a client. Networking can be attached at any time with Serve, and the
+// clients connected then see the same data as the program.
+//
+//	db, err := kiwi.Open("maxmemory 100mb")
+//	if err != nil {
+//		log.Fatal(err)
+//	}
+//	defer db.Close()
+//	db.Set("greeting", "hello", 0)
+//	greeting, err := db.Get("greeting")
+//
+// The cron job of the server, that expires keys actively and updates the
+// statistics, runs in the event loops: until Serve is called, expired keys
+// are only removed when they are accessed.
+package kiwi
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/zhaotong0312/kiwi/resp"
+	"github.com/zhaotong0312/kiwi/server"
+)
+
+// ErrNil is returned by the typed methods when the key, the field or the
+// member doesn't exist, like the null reply of the commands.
+var ErrNil = errors.New("kiwi: nil")
+
+// ErrClosed is returned by the methods of a closed DB.
+var ErrClosed = errors.New("kiwi: database closed")
+
+// ErrTxAborted is returned by Tx when the transaction was discarded by the
+// server, because a command was rejected while being queued.
+var ErrTxAborted = errors.New("kiwi: transaction aborted")
+
+// DB is an embedded kiwi server. It is safe for concurrent use.
+type DB struct {
+	srv     *server.Server
+	mu      sync.RWMutex
+	closed  bool
+	serving bool
+	clients sync.Pool // Idle internal clients
+}
+
+// Open creates an embedded server from a configuration, in the format of
+// the configuration file, like "maxmemory 100mb\nmaxmemory-policy
+// allkeys-lru". The server doesn't listen until Serve is called.
+func Open(config string) (*DB, error) {
+	srv, err := server.NewServer(config)
+	if err != nil {
+		return nil, err
+	}
+	return &DB{srv: srv}, nil
+}
+
+// Server returns the underlying server.
+func (db *DB) Server() *server.Server {
+	return db.srv
+}
+
+// Serve attaches networking to the database: the server starts listening
+// on the addresses of its configuration, and serves the same data as the
+// typed methods. It returns once the listeners are bound.
+func (db *DB) Serve() error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	if db.closed {
+		return ErrClosed
+	}
+	if db.serving {
+		return errors.New("kiwi: already serving")
+	}
+	if err := db.srv.Start(); err != nil {
+		return err
+	}
+	db.serving = true
+	return nil
+}
+
+// Addr returns the address of the first listener, nil until Serve is
+// called.
+func (db *DB) Addr() net.Addr {
+	return db.srv.Addr()
+}
+
+// Close closes the database, and its listeners and connections if it is
+// serving. The calls in progress are completed first.
+func (db *DB) Close() error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	if db.closed {
+		return nil
+	}
+	db.closed = true
+	return db.srv.Shutdown(context.Background())
+}
+
+func (db *DB) getClient() *server.KiwiClient {
+	if c, ok := db.clients.Get().(*server.KiwiClient); ok {
+		return c
+	}
+	return db.srv.CreateInternalClient()
+}
+
+// Clients are only reused in their initial state: commands like SELECT or
+// HELLO change the client for the next commands.
+func (db *DB) putClient(c *server.KiwiClient) {
+	if c.Db == db.srv.Dbs[0] && c.Flags == server.CLIENT_INTERNAL && c.Resp == 3 && c.User == nil {
+		db.clients.Put(c)
+	}
+}
+
+func (db *DB) exec(c *server.KiwiClient, args []string) (resp.Value, error) {
+	v, err := resp.NewReader(bytes.NewReader(c.Execute(args))).ReadValue()
+	if err != nil {
+		return v, err
+	}
+	return v, v.Err()
+}
+
+// Do executes a command and returns its reply, decoded from RESP3. Error
+// replies are returned as a resp.ServerError.
+func (db *DB) Do(args ...string) (resp.Value, error) {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+	if db.closed {
+		return resp.Value{}, ErrClosed
+	}
+	c := db.getClient()
+	defer db.putClient(c)
+	return db.exec(c, args)
+}
+
+// Tx queues the commands of a transaction, see DB.Tx.
+type Tx struct {
+	db *DB
+	c  *server.KiwiClient
+}
+
+// Do queues a command. An error is returned if the server rejected it,
+// and then the whole transaction is aborted.
+func (tx *Tx) Do(args ...string) error {
+	_, err := tx.db.exec(tx.c, args)
+	return err
+}
+
+// Tx executes the commands queued by fn as a transaction, with MULTI and
+// EXEC: they are executed atomically, and their replies are returned in
+// order. The transaction is discarded if fn returns an error, and aborted
+// with ErrTxAborted if a command was rejected while being queued. The
+// error replies of the commands executed by EXEC are not errors of Tx:
+// they are in the replies, see resp.Value.Err.
+func (db *DB) Tx(fn func(tx *Tx) error) ([]resp.Value, error) {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+	if db.closed {
+		return nil, ErrClosed
+	}
+	c := db.getClient()
+	defer db.putClient(c)
+	tx := &Tx{db: db, c: c}
+	if _, err := db.exec(c, []string{"multi"}); err != nil {
+		return nil, err
+	}
+	if err := fn(tx); err != nil {
+		db.exec(c, []string{"discard"})
+		return nil, err
+	}
+	v, err := db.exec(c, []string{"exec"})
+	if err != nil {
+		if e, ok := err.(resp.ServerError); ok && e.Code() == "EXECABORT" {
+			return nil, ErrTxAborted
+		}
+		return nil, err
+	}
+	if v.IsNull() {
+		return nil, ErrTxAborted
+	}
+	return v.Elems, nil
+}
+
+func replyString(v resp.Value, err error) (string, error) {
+	if err != nil {
+		return "", err
+	}
+	if v.IsNull() {
+		return "", ErrNil
+	}
+	return v.Str, nil
+}
+
+func replyInt(v resp.Value, err error) (int64, error) {
+	if err != nil {
+		return 0, err
+	}
+	return v.Int, nil
+}
+
+func replyBool(v resp.Value, err error) (bool, error) {
+	n, err := replyInt(v, err)
+	return n == 1, err
+}
+
+func replyOk(v resp.Value, err error) error {
+	return err
+}
+
+func replyFloat(v resp.Value, err error) (float64, error) {
+	if err != nil {
+		return 0, err
+	}
+	switch v.Type {
+	case resp.Null:
+		return 0, ErrNil
+	case resp.Double:
+		return v.Float, nil
+	}
+	return strconv.ParseFloat(v.Str, 64)
+}
+
+func replyStrings(v resp.Value, err error) ([]string, error) {
+	if err != nil {
+		return nil, err
+	}
+	strs := make([]string, len(v.Elems))
+	for i, e := range v.Elems {
+		strs[i] = e.Str
+	}
+	return strs, nil
+}
+
+func replyMap(v resp.Value, err error) (map[string]string, error) {
+	if err != nil {
+		return nil, err
+	}
+	m := make(map[string]string, len(v.Elems)/2)
+	for i := 0; i+1 < len(v.Elems); i += 2 {
+		m[v.Elems[i].Str] = v.Elems[i+1].Str
+	}
+	return m, nil
+}
+
+func durationArg(d time.Duration) string {
+	return strconv.FormatInt(int64(d/time.Millisecond), 10)
+}
+
+// Del deletes the keys and returns the number of keys deleted.
+func (db *DB) Del(keys ...string) (int64, error) {
+	return replyInt(db.Do(append([]string{"del"}, keys...)...))
+}
+
+// Exists returns the number of keys existing among keys.
+func (db *DB) Exists(keys ...string) (int64, error) {
+	return replyInt(db.Do(append([]string{"exists"}, keys...)...))
+}
+
+// Type returns the type of the value of key, like "string" or "zset", or
+// "none" if the key doesn't exist.
+func (db *DB) Type(key string) (string, error) {
+	return replyString(db.Do("type", key))
+}
+
+// Expire sets a time to live on key, with a millisecond resolution. It
+// returns false if the key doesn't exist.
+func (db *DB) Expire(key string, ttl time.Duration) (bool, error) {
+	return replyBool(db.Do("pexpire", key, durationArg(ttl)))
+}
+
+// ExpireAt sets the time key expires at, with a millisecond resolution. It
+// returns false if the key doesn't exist.
+func (db *DB) ExpireAt(key string, t time.Time) (bool, error) {
+	ms := t.UnixNano() / int64(time.Millisecond)
+	return replyBool(db.Do("pexpireat", key, strconv.FormatInt(ms, 10)))
+}
+
+// TTL returns the remaining time to live of key. It returns -1 if the key
+// has no expire, and ErrNil if the key doesn't exist.
+func (db *DB) TTL(key string) (time.Duration, error) {
+	ms, err := replyInt(db.Do("pttl", key))
+	switch {
+	case err != nil:
+		return 0, err
+	case ms == -2:
+		return 0, ErrNil
+	case ms == -1:
+		return -1, nil
+	}
+	return time.Duration(ms) * time.Millisecond, nil
+}
+
+// Persist removes the expire of key. It returns false if the key doesn't
+// exist or has no expire.
+func (db *DB) Persist(key string) (bool, error) {
+	return replyBool(db.Do("persist", key))
+}
+
+// Get returns the value of key, or ErrNil if the key doesn't exist.
+func (db *DB) Get(key string) (string, error) {
+	return replyString(db.Do("get", key))
+}
+
+// Set sets the value of key. The key expires after ttl, unless ttl is 0.
+func (db *DB) Set(key string, value string, ttl time.Duration) error {
+	if ttl > 0 {
+		return replyOk(db.Do("set", key, value, "px", durationArg(ttl)))
+	}
+	return replyOk(db.Do("set", key, value))
+}
+
+// SetNX sets the value of key only if the key doesn't exist, and reports
+// whether it was set.
+func (db *DB) SetNX(key string, value string) (bool, error) {
+	return replyBool(db.Do("setnx", key, value))
+}
+
+// MGet returns the values of the keys. The values of the keys that don't
+// exist are empty strings.
+func (db *DB) MGet(keys ...string) ([]string, error) {
+	return replyStrings(db.Do(append([]string{"mget"}, keys...)...))
+}
+
+// MSet sets the values of several keys, given as key, value pairs.
+func (db *DB) MSet(pairs ...string) error {
+	return replyOk(db.Do(append([]string{"mset"}, pairs...)...))
+}
+
+// Incr increments the integer value of key and returns the new value.
+func (db *DB) Incr(key string) (int64, error) {
+	return replyInt(db.Do("incr", key))
+}
+
+// Decr decrements the integer value of key and returns the new value.
+func (db *DB) Decr(key string) (int64, error) {
+	return replyInt(db.Do("decr", key))
+}
+
+// Append appends value to the value of key and returns the new length.
+func (db *DB) Append(key string, value string) (int64, error) {
+	return replyInt(db.Do("append", key, value))
+}
+
+// LPush inserts the values at the head of the list and returns its
+// length.
+func (db *DB) LPush(key string, values ...string) (int64, error) {
+	return replyInt(db.Do(append([]string{"lpush", key}, values...)...))
+}
+
+// RPush inserts the values at the tail of the list and returns its
+// length.
+func (db *DB) RPush(key string, values ...string) (int64, error) {
+	return replyInt(db.Do(append([]string{"rpush", key}, values...)...))
+}
+
+// LPop removes and returns the head of the list, or ErrNil if the list is
+// empty.
+func (db *DB) LPop(key string) (string, error) {
+	return replyString(db.Do("lpop", key))
+}
+
+// RPop removes and returns the tail of the list, or ErrNil if the list is
+// empty.
+func (db *DB) RPop(key string) (string, error) {
+	return replyString(db.Do("rpop", key))
+}
+
+// LLen returns the length of the list.
+func (db *DB) LLen(key string) (int64, error) {
+	return replyInt(db.Do("llen", key))
+}
+
+// LIndex returns the element at index, negative indexes counting from the
+// tail, or ErrNil if the index is out of range.
+func (db *DB) LIndex(key string, index int64) (string, error) {
+	return replyString(db.Do("lindex", key, strconv.FormatInt(index, 10)))
+}
+
+// LRange returns the elements from start to stop included, negative
+// indexes counting from the tail.
+func (db *DB) LRange(key string, start, stop int64) ([]string, error) {
+	return replyStrings(db.Do("lrange", key, strconv.FormatInt(start, 10), strconv.FormatInt(stop, 10)))
+}
+
+// HSet sets the value of field, and reports whether the field was
+// created.
+func (db *DB) HSet(key, field, value string) (bool, error) {
+	return replyBool(db.Do("hset", key, field, value))
+}
+
+// HGet returns the value of field, or ErrNil if the field doesn't exist.
+func (db *DB) HGet(key, field string) (string, error) {
+	return replyString(db.Do("hget", key, field))
+}
+
+// HDel deletes the fields and returns the number of fields deleted.
+func (db *DB) HDel(key string, fields ...string) (int64, error) {
+	return replyInt(db.Do(append([]string{"hdel", key}, fields...)...))
+}
+
+// HLen returns the number of fields of the hash.
+func (db *DB) HLen(key string) (int64, error) {
+	return replyInt(db.Do("hlen", key))
+}
+
+// HGetAll returns the fields of the hash and their values.
+func (db *DB) HGetAll(key string) (map[string]string, error) {
+	return replyMap(db.Do("hgetall", key))
+}
+
+// HIncrBy increments the integer value of field and returns the new
+// value.
+func (db *DB) HIncrBy(key, field string, incr int64) (int64, error) {
+	return replyInt(db.Do("hincrby", key, field, strconv.FormatInt(incr, 10)))
+}
+
+// SAdd adds the members to the set and returns the number of members
+// added.
+func (db *DB) SAdd(key string, members ...string) (int64, error) {
+	return replyInt(db.Do(append([]string{"sadd", key}, members...)...))
+}
+
+// SRem removes the members from the set and returns the number of members
+// removed.
+func (db *DB) SRem(key string, members ...string) (int64, error) {
+	return replyInt(db.Do(append([]string{"srem", key}, members...)...))
+}
+
+// SIsMember reports whether member belongs to the set.
+func (db *DB) SIsMember(key, member string) (bool, error) {
+	return replyBool(db.Do("sismember", key, member))
+}
+
+// SCard returns the number of members of the set.
+func (db *DB) SCard(key string) (int64, error) {
+	return replyInt(db.Do("scard", key))
+}
+
+// SMembers returns the members of the set, in no particular order.
+func (db *DB) SMembers(key string) ([]string, error) {
+	return replyStrings(db.Do("smembers", key))
+}
+
+// Z is a member of a sorted set and its score.
+type Z struct {
+	Score  float64
+	Member string
+}
+
+// ZAdd adds the members to the sorted set, or updates their scores, and
+// returns the number of members added.
+func (db *DB) ZAdd(key string, members ...Z) (int64, error) {
+	args := make([]string, 0, 2+len(members)*2)
+	args = append(args, "zadd", key)
+	for _, z := range members {
+		args = append(args, resp.FormatDouble(z.Score), z.Member)
+	}
+	return replyInt(db.Do(args...))
+}
+
+// ZIncrBy increments the score of member and returns the new score.
+func (db *DB) ZIncrBy(key string, incr float64, member string) (float64, error) {
+	return replyFloat(db.Do("zincrby", key, resp.FormatDouble(incr), member))
+}
+
+// ZRem removes the members from the sorted set and returns the number of
+// members removed.
+func (db *DB) ZRem(key string, members ...string) (int64, error) {
+	return replyInt(db.Do(append([]string{"zrem", key}, members...)...))
+}
+
+// ZScore returns the score of member, or ErrNil if it doesn't belong to
+// the sorted set.
+func (db *DB) ZScore(key, member string) (float64, error) {
+	return replyFloat(db.Do("zscore", key, member))
+}
+
+// ZRank returns the rank of member, from the lowest score, or ErrNil if
+// it doesn't belong to the sorted set.
+func (db *DB) ZRank(key, member string) (int64, error) {
+	v, err := db.Do("zrank", key, member)
+	if err == nil && v.IsNull() {
+		return 0, ErrNil
+	}
+	return replyInt(v, err)
+}
+
+// ZCard returns the number of members of the sorted set.
+func (db *DB) ZCard(key string) (int64, error) {
+	return replyInt(db.Do("zcard", key))
+}
+
+// ZRange returns the members from rank start to stop included, ordered by
+// score, negative ranks counting from the highest score.
+func (db *DB) ZRange(key string, start, stop int64) ([]string, error) {
+	return replyStrings(db.Do("zrange", key, strconv.FormatInt(start, 10), strconv.FormatInt(stop, 10)))
+}
+
+// ZRangeWithScores is like ZRange, but returns the scores too.
+func (db *DB) ZRangeWithScores(key string, start, stop int64) ([]Z, error) {
+	v, err := db.Do("zrange", key, strconv.FormatInt(start, 10), strconv.FormatInt(stop, 10), "withscores")
+	if err != nil {
+		return nil, err
+	}
+	// RESP3 replies every member and its score in a nested array.
+	zs := make([]Z, len(v.Elems))
+	for i, e := range v.Elems {
+		if len(e.Elems) != 2 {
+			return nil, errors.New("kiwi: unexpected reply to ZRANGE")
+		}
+		zs[i] = Z{Member: e.Elems[0].Str, Score: e.Elems[1].Float}
+	}
+	return zs, nil
+}
@@ -0,0 +1,419 @@
+package kiwi
+
+import (
+	"bufio"
+	"errors"
+	"net"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/zhaotong0312/kiwi/resp"
+)
+
+func open(t *testing.T, config string) *DB {
+	t.Helper()
+	db, err := Open(config)
+	if err != nil {
+		t.Fatalf("Open: %v", err)
+	}
+	t.Cleanup(func() { db.Close() })
+	return db
+}
+
+// checker fails the test if the error of a call is not nil, and returns
+// the value of the call, like must.str(db.Get("a")).
+type checker struct {
+	*testing.T
+}
+
+func (c checker) check(err error) {
+	c.Helper()
+	if err != nil {
+		c.Fatal(err)
+	}
+}
+
+func (c checker) str(s string, err error) string {
+	c.Helper()
+	c.check(err)
+	return s
+}
+
+func (c checker) strs(s []string, err error) []string {
+	c.Helper()
+	c.check(err)
+	return s
+}
+
+func (c checker) num(n int64, err error) int64 {
+	c.Helper()
+	c.check(err)
+	return n
+}
+
+func (c checker) float(f float64, err error) float64 {
+	c.Helper()
+	c.check(err)
+	return f
+}
+
+func (c checker) flag(b bool, err error) bool {
+	c.Helper()
+	c.check(err)
+	return b
+}
+
+func (c checker) ttl(d time.Duration, err error) time.Duration {
+	c.Helper()
+	c.check(err)
+	return d
+}
+
+func wantCode(t *testing.T, err error, code string) {
+	t.Helper()
+	var e resp.ServerError
+	if !errors.As(err, &e) || e.Code() != code {
+		t.Errorf("err = %v, want a %s error", err, code)
+	}
+}
+
+func TestStrings(t *testing.T) {
+	db := open(t, "")
+	must := checker{t}
+	if _, err := db.Get("a"); err != ErrNil {
+		t.Errorf("Get of a missing key: %v, want ErrNil", err)
+	}
+	must.check(db.Set("a", "1", 0))
+	if got := must.str(db.Get("a")); got != "1" {
+		t.Errorf("Get = %q", got)
+	}
+	if must.flag(db.SetNX("a", "2")) || !must.flag(db.SetNX("b", "2")) {
+		t.Error("SetNX set an existing key, or didn't set a new one")
+	}
+	if got := must.num(db.Incr("a")); got != 2 {
+		t.Errorf("Incr = %d", got)
+	}
+	if got := must.num(db.Decr("c")); got != -1 {
+		t.Errorf("Decr of a missing key = %d", got)
+	}
+	if got := must.num(db.Append("a", "x")); got != 2 {
+		t.Errorf("Append = %d", got)
+	}
+	_, err := db.Incr("a")
+	wantCode(t, err, "ERR")
+	must.check(db.MSet("d", "4", "e", ""))
+	if got := must.strs(db.MGet("d", "e", "missing")); !reflect.DeepEqual(got, []string{"4", "", ""}) {
+		t.Errorf("MGet = %q", got)
+	}
+	if got := must.num(db.Exists("a", "b", "missing")); got != 2 {
+		t.Errorf("Exists = %d", got)
+	}
+	if got := must.str(db.Type("a")); got != "string" {
+		t.Errorf("Type = %q", got)
+	}
+	if got := must.num(db.Del("a", "missing")); got != 1 {
+		t.Errorf("Del = %d", got)
+	}
+	if got := must.str(db.Type("a")); got != "none" {
+		t.Errorf("Type of a deleted key = %q", got)
+	}
+	if v, err := db.Do("strlen", "b"); err != nil || v.Int != 1 {
+		t.Errorf("Do(strlen) = %+v", v)
+	}
+	_, err = db.Do("nosuchcommand")
+	wantCode(t, err, "ERR")
+}
+
+func TestTTL(t *testing.T) {
+	db := open(t, "")
+	must := checker{t}
+	if _, err := db.TTL("missing"); err != ErrNil {
+		t.Errorf("TTL of a missing key: %v, want ErrNil", err)
+	}
+	if must.flag(db.Expire("missing", time.Second)) {
+		t.Error("Expire of a missing key returned true")
+	}
+	must.check(db.Set("a", "1", 0))
+	if got := must.ttl(db.TTL("a")); got != -1 {
+		t.Errorf("TTL without expire = %v", got)
+	}
+	if !must.flag(db.Expire("a", time.Hour)) {
+		t.Error("Expire returned false")
+	}
+	if got := must.ttl(db.TTL("a")); got <= 59*time.Minute || got > time.Hour {
+		t.Errorf("TTL = %v, want about an hour", got)
+	}
+	if !must.flag(db.Persist("a")) || must.flag(db.Persist("a")) {
+		t.Error("Persist didn't remove the expire once")
+	}
+	must.flag(db.ExpireAt("a", time.Now().Add(-time.Second)))
+	if _, err := db.Get("a"); err != ErrNil {
+		t.Errorf("Get of a key expired in the past: %v, want ErrNil", err)
+	}
+
+	// Without Serve there is no active expire: the key is removed when
+	// it is accessed.
+	must.check(db.Set("b", "1", 20*time.Millisecond))
+	if got := must.ttl(db.TTL("b")); got <= 0 || got > 20*time.Millisecond {
+		t.Errorf("TTL = %v", got)
+	}
+	time.Sleep(50 * time.Millisecond)
+	if _, err := db.Get("b"); err != ErrNil {
+		t.Errorf("Get of an expired key: %v, want ErrNil", err)
+	}
+	if got := must.num(db.Exists("b")); got != 0 {
+		t.Errorf("Exists of an expired key = %d", got)
+	}
+}
+
+func TestLists(t *testing.T) {
+	db := open(t, "")
+	must := checker{t}
+	if got := must.num(db.RPush("l", "b", "c")); got != 2 {
+		t.Errorf("RPush = %d", got)
+	}
+	if got := must.num(db.LPush("l", "a")); got != 3 {
+		t.Errorf("LPush = %d", got)
+	}
+	if got := must.strs(db.LRange("l", 0, -1)); !reflect.DeepEqual(got, []string{"a", "b", "c"}) {
+		t.Errorf("LRange = %q", got)
+	}
+	if got := must.str(db.LIndex("l", -1)); got != "c" {
+		t.Errorf("LIndex -1 = %q", got)
+	}
+	if _, err := db.LIndex("l", 3); err != ErrNil {
+		t.Errorf("LIndex out of range: %v, want ErrNil", err)
+	}
+	if got := must.str(db.LPop("l")); got != "a" {
+		t.Errorf("LPop = %q", got)
+	}
+	if got := must.str(db.RPop("l")); got != "c" {
+		t.Errorf("RPop = %q", got)
+	}
+	if got := must.num(db.LLen("l")); got != 1 {
+		t.Errorf("LLen = %d", got)
+	}
+	must.str(db.RPop("l"))
+	if _, err := db.LPop("l"); err != ErrNil {
+		t.Errorf("LPop of an empty list: %v, want ErrNil", err)
+	}
+	if got := must.num(db.Exists("l")); got != 0 {
+		t.Error("the empty list was not deleted")
+	}
+	must.check(db.Set("s", "x", 0))
+	_, err := db.LPush("s", "a")
+	wantCode(t, err, "WRONGTYPE")
+}
+
+func TestHashes(t *testing.T) {
+	db := open(t, "")
+	must := checker{t}
+	if !must.flag(db.HSet("h", "a", "1")) || must.flag(db.HSet("h", "a", "2")) {
+		t.Error("HSet didn't report the new field only")
+	}
+	if got := must.str(db.HGet("h", "a")); got != "2" {
+		t.Errorf("HGet = %q", got)
+	}
+	if _, err := db.HGet("h", "missing"); err != ErrNil {
+		t.Errorf("HGet of a missing field: %v, want ErrNil", err)
+	}
+	if got := must.num(db.HIncrBy("h", "b", 5)); got != 5 {
+		t.Errorf("HIncrBy = %d", got)
+	}
+	if got, err := db.HGetAll("h"); err != nil || !reflect.DeepEqual(got, map[string]string{"a": "2", "b": "5"}) {
+		t.Errorf("HGetAll = %q, %v", got, err)
+	}
+	if got := must.num(db.HLen("h")); got != 2 {
+		t.Errorf("HLen = %d", got)
+	}
+	if got := must.num(db.HDel("h", "a", "b", "missing")); got != 2 {
+		t.Errorf("HDel = %d", got)
+	}
+	if got := must.num(db.Exists("h")); got != 0 {
+		t.Error("the empty hash was not deleted")
+	}
+	if got, err := db.HGetAll("h"); err != nil || len(got) != 0 {
+		t.Errorf("HGetAll of a missing key = %q, %v", got, err)
+	}
+}
+
+func TestSets(t *testing.T) {
+	db := open(t, "")
+	must := checker{t}
+	if got := must.num(db.SAdd("s", "a", "b", "a")); got != 2 {
+		t.Errorf("SAdd = %d", got)
+	}
+	if !must.flag(db.SIsMember("s", "a")) || must.flag(db.SIsMember("s", "c")) {
+		t.Error("SIsMember")
+	}
+	members := must.strs(db.SMembers("s"))
+	sort.Strings(members)
+	if !reflect.DeepEqual(members, []string{"a", "b"}) {
+		t.Errorf("SMembers = %q", members)
+	}
+	if got := must.num(db.SCard("s")); got != 2 {
+		t.Errorf("SCard = %d", got)
+	}
+	if got := must.num(db.SRem("s", "a", "b", "c")); got != 2 {
+		t.Errorf("SRem = %d", got)
+	}
+	if got := must.num(db.Exists("s")); got != 0 {
+		t.Error("the empty set was not deleted")
+	}
+}
+
+func TestSortedSets(t *testing.T) {
+	db := open(t, "")
+	must := checker{t}
+	if got := must.num(db.ZAdd("z", Z{1, "a"}, Z{2, "b"}, Z{3, "c"})); got != 3 {
+		t.Errorf("ZAdd = %d", got)
+	}
+	if got := must.num(db.ZAdd("z", Z{0.5, "c"})); got != 0 {
+		t.Errorf("ZAdd of an existing member = %d", got)
+	}
+	if got := must.float(db.ZIncrBy("z", 2.5, "a")); got != 3.5 {
+		t.Errorf("ZIncrBy = %v", got)
+	}
+	if got := must.float(db.ZScore("z", "b")); got != 2 {
+		t.Errorf("ZScore = %v", got)
+	}
+	if _, err := db.ZScore("z", "missing"); err != ErrNil {
+		t.Errorf("ZScore of a missing member: %v, want ErrNil", err)
+	}
+	if got := must.num(db.ZRank("z", "a")); got != 2 {
+		t.Errorf("ZRank = %d", got)
+	}
+	if _, err := db.ZRank("z", "missing"); err != ErrNil {
+		t.Errorf("ZRank of a missing member: %v, want ErrNil", err)
+	}
+	if got := must.strs(db.ZRange("z", 0, -1)); !reflect.DeepEqual(got, []string{"c", "b", "a"}) {
+		t.Errorf("ZRange = %q", got)
+	}
+	want := []Z{{2, "b"}, {3.5, "a"}}
+	if got, err := db.ZRangeWithScores("z", -2, -1); err != nil || !reflect.DeepEqual(got, want) {
+		t.Errorf("ZRangeWithScores = %v, %v, want %v", got, err, want)
+	}
+	if got := must.num(db.ZCard("z")); got != 3 {
+		t.Errorf("ZCard = %d", got)
+	}
+	if got := must.num(db.ZRem("z", "a", "b", "c")); got != 3 {
+		t.Errorf("ZRem = %d", got)
+	}
+	if got := must.num(db.Exists("z")); got != 0 {
+		t.Error("the empty sorted set was not deleted")
+	}
+}
+
+func TestTx(t *testing.T) {
+	db := open(t, "")
+	must := checker{t}
+	replies, err := db.Tx(func(tx *Tx) error {
+		tx.Do("set", "a", "1")
+		tx.Do("incr", "a")
+		tx.Do("lpush", "a", "x")
+		return tx.Do("get", "a")
+	})
+	if err != nil {
+		t.Fatalf("Tx: %v", err)
+	}
+	if len(replies) != 4 || replies[1].Int != 2 || replies[3].Str != "2" {
+		t.Errorf("Tx replies = %+v", replies)
+	}
+	// The error of a command executed by EXEC is in its reply.
+	wantCode(t, replies[2].Err(), "WRONGTYPE")
+
+	// A command rejected while queued aborts the transaction.
+	_, err = db.Tx(func(tx *Tx) error {
+		tx.Do("set", "a", "3")
+		if err := tx.Do("nosuchcommand"); err == nil {
+			t.Error("Tx.Do of an unknown command succeeded")
+		}
+		return nil
+	})
+	if err != ErrTxAborted {
+		t.Errorf("Tx with a rejected command: %v, want ErrTxAborted", err)
+	}
+
+	// The transaction is discarded when fn fails.
+	failed := errors.New("failed")
+	if _, err := db.Tx(func(tx *Tx) error {
+		tx.Do("set", "a", "4")
+		return failed
+	}); err != failed {
+		t.Errorf("Tx = %v, want the error of fn", err)
+	}
+	if got := must.str(db.Get("a")); got != "2" {
+		t.Errorf("Get after aborted transactions = %q", got)
+	}
+
+	// The client of a transaction is reused in its initial state.
+	if _, err := db.Tx(func(tx *Tx) error { return tx.Do("select", "1") }); err != nil {
+		t.Fatal(err)
+	}
+	must.check(db.Set("b", "1", 0))
+	if got := must.num(db.Exists("b")); got != 1 {
+		t.Error("the client of a transaction kept its database")
+	}
+}
+
+func TestServe(t *testing.T) {
+	sock := filepath.Join(t.TempDir(), "kiwi.sock")
+	db := open(t, "port 0\nunixsocket "+sock)
+	must := checker{t}
+	if db.Addr() != nil {
+		t.Errorf("Addr before Serve = %v", db.Addr())
+	}
+	must.check(db.Set("a", "1", 0))
+	if err := db.Serve(); err != nil {
+		t.Fatalf("Serve: %v", err)
+	}
+	if db.Addr() == nil {
+		t.Error("Addr after Serve = nil")
+	}
+	if err := db.Serve(); err == nil {
+		t.Error("Serve twice succeeded")
+	}
+
+	// The clients see the data of the typed methods, and the other way
+	// around.
+	conn, err := net.Dial("unix", sock)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	r := resp.NewReader(bufio.NewReader(conn))
+	for _, cmd := range []struct{ req, want string }{
+		{"*2\r\n$3\r\nget\r\n$1\r\na\r\n", "1"},
+		{"*3\r\n$3\r\nset\r\n$1\r\nb\r\n$1\r\n2\r\n", "OK"},
+	} {
+		if _, err := conn.Write([]byte(cmd.req)); err != nil {
+			t.Fatal(err)
+		}
+		if v, err := r.ReadValue(); err != nil || v.Str != cmd.want {
+			t.Errorf("%q = %+v, %v, want %q", cmd.req, v, err, cmd.want)
+		}
+	}
+	if got := must.str(db.Get("b")); got != "2" {
+		t.Errorf("Get of a key set by a client = %q", got)
+	}
+
+	if err := db.Close(); err != nil {
+		t.Errorf("Close: %v", err)
+	}
+	if _, err := r.ReadValue(); err == nil {
+		t.Error("the connection was not closed by Close")
+	}
+	if _, err := db.Get("a"); err != ErrClosed {
+		t.Errorf("Get after Close: %v, want ErrClosed", err)
+	}
+	if _, err := db.Tx(func(tx *Tx) error { return nil }); err != ErrClosed {
+		t.Errorf("Tx after Close: %v, want ErrClosed", err)
+	}
+	if err := db.Serve(); err != ErrClosed {
+		t.Errorf("Serve after Close: %v, want ErrClosed", err)
+	}
+}
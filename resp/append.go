@@ -0,0 +1,198 @@
+package resp
+
+import (
+	"math"
+	"strconv"
+	"strings"
+)
+
+// The Append functions encode a value at the end of dst and return the
+// extended buffer, like strconv.AppendInt. They always use the encoding of
+// the type they are named after: downgrading the RESP3 types for RESP2
+// peers is up to the caller, see Writer.
+
+// AppendHeader appends a type byte followed by a number and CRLF: the
+// header of aggregates and bulk strings, like "*3\r\n", or an integer.
+func AppendHeader(dst []byte, t Type, n int64) []byte {
+	dst = append(dst, byte(t))
+	dst = strconv.AppendInt(dst, n, 10)
+	return append(dst, '\r', '\n')
+}
+
+// AppendSimpleString appends a simple string. s must not contain CR or LF.
+func AppendSimpleString(dst []byte, s string) []byte {
+	dst = append(dst, byte(SimpleString))
+	dst = append(dst, s...)
+	return append(dst, '\r', '\n')
+}
+
+// AppendError appends an error. s should start with an error code, like
+// "ERR" or "WRONGTYPE". Newlines are replaced by spaces, since errors are
+// single lines.
+func AppendError(dst []byte, s string) []byte {
+	dst = append(dst, byte(Error))
+	if s == "" {
+		s = "ERR"
+	}
+	if strings.ContainsAny(s, "\r\n") {
+		s = strings.NewReplacer("\r", " ", "\n", " ").Replace(s)
+	}
+	dst = append(dst, s...)
+	return append(dst, '\r', '\n')
+}
+
+func AppendInteger(dst []byte, n int64) []byte {
+	return AppendHeader(dst, Integer, n)
+}
+
+func AppendBulkString(dst []byte, s string) []byte {
+	dst = AppendHeader(dst, BulkString, int64(len(s)))
+	dst = append(dst, s...)
+	return append(dst, '\r', '\n')
+}
+
+func AppendBulk(dst []byte, b []byte) []byte {
+	dst = AppendHeader(dst, BulkString, int64(len(b)))
+	dst = append(dst, b...)
+	return append(dst, '\r', '\n')
+}
+
+func AppendArrayLen(dst []byte, n int) []byte {
+	return AppendHeader(dst, Array, int64(n))
+}
+
+// AppendMapLen appends the header of a map of n key-value pairs.
+func AppendMapLen(dst []byte, n int) []byte {
+	return AppendHeader(dst, Map, int64(n))
+}
+
+func AppendSetLen(dst []byte, n int) []byte {
+	return AppendHeader(dst, Set, int64(n))
+}
+
+func AppendPushLen(dst []byte, n int) []byte {
+	return AppendHeader(dst, Push, int64(n))
+}
+
+// AppendAttributeLen appends the header of an attribute of n key-value
+// pairs. The attribute is followed by the value it describes.
+func AppendAttributeLen(dst []byte, n int) []byte {
+	return AppendHeader(dst, Attribute, int64(n))
+}
+
+// AppendNull appends the RESP3 null.
+func AppendNull(dst []byte) []byte {
+	return append(dst, "_\r\n"...)
+}
+
+// AppendNullBulk appends the RESP2 null, a bulk string of length -1.
+func AppendNullBulk(dst []byte) []byte {
+	return append(dst, "$-1\r\n"...)
+}
+
+// AppendNullArray appends the RESP2 null array, an array of length -1.
+func AppendNullArray(dst []byte) []byte {
+	return append(dst, "*-1\r\n"...)
+}
+
+func AppendBool(dst []byte, b bool) []byte {
+	if b {
+		return append(dst, "#t\r\n"...)
+	}
+	return append(dst, "#f\r\n"...)
+}
+
+// FormatDouble returns the representation of a double used by RESP3, also
+// used for the bulk strings replacing doubles in RESP2.
+func FormatDouble(f float64) string {
+	switch {
+	case math.IsInf(f, 1):
+		return "inf"
+	case math.IsInf(f, -1):
+		return "-inf"
+	case math.IsNaN(f):
+		return "nan"
+	}
+	return strconv.FormatFloat(f, 'g', 17, 64)
+}
+
+func AppendDouble(dst []byte, f float64) []byte {
+	dst = append(dst, byte(Double))
+	dst = append(dst, FormatDouble(f)...)
+	return append(dst, '\r', '\n')
+}
+
+// AppendBigNumber appends an integer that may not fit in 64 bits, given in
+// its decimal representation.
+func AppendBigNumber(dst []byte, num string) []byte {
+	dst = append(dst, byte(BigNumber))
+	dst = append(dst, num...)
+	return append(dst, '\r', '\n')
+}
+
+func AppendBulkError(dst []byte, s string) []byte {
+	dst = AppendHeader(dst, BulkError, int64(len(s)))
+	dst = append(dst, s...)
+	return append(dst, '\r', '\n')
+}
+
+// AppendVerbatim appends a string meant to be shown as is to the user.
+// format is three characters long, "txt" for plain text or "mkd" for
+// markdown.
+func AppendVerbatim(dst []byte, s, format string) []byte {
+	dst = AppendHeader(dst, VerbatimString, int64(len(s)+len(format)+1))
+	dst = append(dst, format...)
+	dst = append(dst, ':')
+	dst = append(dst, s...)
+	return append(dst, '\r', '\n')
+}
+
+// AppendCommand appends a command as sent by clients, an array of bulk
+// strings.
+func AppendCommand(dst []byte, args ...string) []byte {
+	dst = AppendArrayLen(dst, len(args))
+	for _, arg := range args {
+		dst = AppendBulkString(dst, arg)
+	}
+	return dst
+}
+
+// AppendValue appends v, with its attributes, using the RESP3 encoding.
+func AppendValue(dst []byte, v Value) []byte {
+	if len(v.Attrs) > 0 {
+		dst = AppendAttributeLen(dst, len(v.Attrs)/2)
+		for _, a := range v.Attrs {
+			dst = AppendValue(dst, a)
+		}
+	}
+	switch v.Type {
+	case SimpleString:
+		return AppendSimpleString(dst, v.Str)
+	case Error:
+		return AppendError(dst, v.Str)
+	case Integer:
+		return AppendInteger(dst, v.Int)
+	case BulkString:
+		return AppendBulkString(dst, v.Str)
+	case Null:
+		return AppendNull(dst)
+	case Boolean:
+		return AppendBool(dst, v.Bool)
+	case Double:
+		return AppendDouble(dst, v.Float)
+	case BigNumber:
+		return AppendBigNumber(dst, v.Str)
+	case BulkError:
+		return AppendBulkError(dst, v.Str)
+	case VerbatimString:
+		return AppendVerbatim(dst, v.Str, v.Format)
+	case Map, Attribute:
+		dst = AppendHeader(dst, v.Type, int64(len(v.Elems)/2))
+	default:
+		dst = AppendHeader(dst, v.Type, int64(len(v.Elems)))
+	}
+	for _, e := range v.Elems {
+		dst = AppendValue(dst, e)
+	}
+	return dst
+}
@@ -0,0 +1,146 @@
+package resp
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"io"
+	"reflect"
+	"testing"
+)
+
+// parseAll parses the commands in data, handing it to the parser in
+// chunks of the given size as reads would, and returns the commands and
+// the protocol error, if any.
+func parseAll(data []byte, chunk int) ([][]string, error) {
+	var p CommandParser
+	p.MaxBulkLen = 1024 * 1024
+	var cmds [][]string
+	var buf []byte
+	for off := 0; off < len(data); off += chunk {
+		end := off + chunk
+		if end > len(data) {
+			end = len(data)
+		}
+		buf = append(buf, data[off:end]...)
+		for len(buf) > 0 {
+			argv, n, err := p.Parse(buf)
+			if err != nil {
+				return cmds, err
+			}
+			if n < 0 || n > len(buf) {
+				panic("consumed more than the buffer")
+			}
+			buf = buf[n:]
+			if argv == nil {
+				break
+			}
+			if len(argv) > 0 {
+				cmds = append(cmds, argv)
+			}
+		}
+	}
+	return cmds, nil
+}
+
+// The commands parsed must not depend on how the input is split across
+// reads.
+func FuzzCommandParser(f *testing.F) {
+	f.Add([]byte("*3\r\n$3\r\nSET\r\n$3\r\nkey\r\n$5\r\nvalue\r\n"))
+	f.Add([]byte("*1\r\n$4\r\nPING\r\n*2\r\n$3\r\nGET\r\n$3\r\nkey\r\n"))
+	f.Add([]byte("SET key \"quoted \\x41 value\"\r\nGET key\n\r\n"))
+	f.Add([]byte("*0\r\n*-1\r\n*1\r\n$0\r\n\r\n"))
+	f.Add([]byte("*2\r\n$3\r\nGET\r\n:1\r\n"))
+	f.Fuzz(func(t *testing.T, data []byte) {
+		want, wantErr := parseAll(data, len(data)+1)
+		for _, chunk := range []int{1, 2, 3, 7, 64} {
+			got, err := parseAll(data, chunk)
+			if !reflect.DeepEqual(got, want) || (err == nil) != (wantErr == nil) {
+				t.Fatalf("chunk %d: got %q, %v; want %q, %v", chunk, got, err, want, wantErr)
+			}
+			var perr *ProtocolError
+			if err != nil && !errors.As(err, &perr) {
+				t.Fatalf("unexpected error type %T", err)
+			}
+		}
+		// Commands encoded back must be parsed the same way.
+		var enc []byte
+		for _, argv := range want {
+			enc = AppendCommand(enc, argv...)
+		}
+		again, err := parseAll(enc, len(enc)+1)
+		if err != nil || !reflect.DeepEqual(again, want) {
+			t.Fatalf("round trip: got %q, %v; want %q", again, err, want)
+		}
+	})
+}
+
+// Decoding and encoding a value again must be stable.
+func FuzzReadValue(f *testing.F) {
+	f.Add([]byte("+OK\r\n"))
+	f.Add([]byte("-ERR unknown command\r\n"))
+	f.Add([]byte("*3\r\n:1\r\n$-1\r\n*-1\r\n"))
+	f.Add([]byte("%2\r\n+first\r\n:1\r\n+second\r\n,3.14\r\n"))
+	f.Add([]byte("|1\r\n+ttl\r\n:3600\r\n~2\r\n#t\r\n#f\r\n"))
+	f.Add([]byte(">3\r\n$7\r\nmessage\r\n$4\r\nnews\r\n$5\r\nhello\r\n"))
+	f.Add([]byte("=15\r\ntxt:Some string\r\n(3492890328409238509324850943850943825024385\r\n_\r\n"))
+	f.Add([]byte("!21\r\nSYNTAX invalid syntax\r\n,inf\r\n,-inf\r\n,nan\r\n"))
+	f.Fuzz(func(t *testing.T, data []byte) {
+		r := NewReader(bytes.NewReader(data))
+		r.MaxBulkLen = 1024 * 1024
+		for {
+			v, err := r.ReadValue()
+			if err != nil {
+				var perr *ProtocolError
+				if err != io.EOF && err != io.ErrUnexpectedEOF && !errors.As(err, &perr) {
+					t.Fatalf("unexpected error %v", err)
+				}
+				return
+			}
+			enc := AppendValue(nil, v)
+			v2, err := NewReader(bytes.NewReader(enc)).ReadValue()
+			if err != nil {
+				t.Fatalf("can't decode %q: %v", enc, err)
+			}
+			if enc2 := AppendValue(nil, v2); !bytes.Equal(enc, enc2) {
+				t.Fatalf("unstable encoding: %q then %q", enc, enc2)
+			}
+			// The Writer must produce the same encoding for RESP3.
+			var out bytes.Buffer
+			w := NewWriter(&out)
+			w.Proto = 3
+			if err := w.WriteValue(v); err != nil {
+				t.Fatal(err)
+			}
+			w.Flush()
+			if !bytes.Equal(out.Bytes(), enc) {
+				t.Fatalf("writer: got %q, want %q", out.Bytes(), enc)
+			}
+		}
+	})
+}
+
+// Commands read from a stream must be the ones parsed from a buffer.
+func FuzzReadCommand(f *testing.F) {
+	f.Add([]byte("*3\r\n$3\r\nSET\r\n$3\r\nkey\r\n$5\r\nvalue\r\nPING\r\n"))
+	f.Add([]byte("\r\n\r\nGET 'single quoted'\r\n*0\r\n"))
+	f.Fuzz(func(t *testing.T, data []byte) {
+		want, _ := parseAll(data, len(data)+1)
+		r := NewReader(bufio.NewReader(bytes.NewReader(data)))
+		r.MaxBulkLen = 1024 * 1024
+		for _, argv := range want {
+			got, err := r.ReadCommand()
+			if err != nil {
+				// The Reader is stricter about line terminators.
+				var perr *ProtocolError
+				if !errors.As(err, &perr) {
+					t.Fatalf("unexpected error %v", err)
+				}
+				return
+			}
+			if !reflect.DeepEqual(got, argv) {
+				t.Fatalf("got %q, want %q", got, argv)
+			}
+		}
+	})
+}
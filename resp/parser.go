@@ -0,0 +1,214 @@
+package resp
+
+import "strconv"
+
+const (
+	reqInline = iota + 1
+	reqMultiBulk
+)
+
+// CommandParser parses the commands sent by a client from a buffer filled
+// by non-blocking reads. A command may be split across many reads: the
+// arguments parsed so far are kept in the parser until the rest of the
+// command is available.
+//
+// The limits can be changed between calls, zero means the default limit.
+type CommandParser struct {
+	MaxInlineSize   int
+	MaxMultiBulkLen int
+	MaxBulkLen      int
+
+	reqType      int      // reqInline or reqMultiBulk, 0 between commands
+	multiBulkLen int      // Number of multi bulk arguments left to read
+	bulkLen      int      // Length of the bulk argument being read, -1 if unknown
+	argv         []string // Arguments parsed so far
+}
+
+// Reset discards the partial command, if any.
+func (p *CommandParser) Reset() {
+	p.reqType = 0
+	p.multiBulkLen = 0
+	p.bulkLen = -1
+	p.argv = nil
+}
+
+// Partial reports whether the parser holds a partial command.
+func (p *CommandParser) Partial() bool {
+	return p.reqType != 0
+}
+
+// Pending returns the number of bytes needed to complete the bulk argument
+// being read, 0 if its length is not known yet. Callers can use it to make
+// room for big arguments at once.
+func (p *CommandParser) Pending() int {
+	if p.multiBulkLen == 0 || p.bulkLen == -1 {
+		return 0
+	}
+	return p.bulkLen + 2
+}
+
+func (p *CommandParser) maxInlineSize() int {
+	if p.MaxInlineSize > 0 {
+		return p.MaxInlineSize
+	}
+	return DefaultMaxInlineSize
+}
+
+// Parse parses the command at the head of buf, and returns the number of
+// bytes consumed: the caller must discard them before the next call, and
+// append the next read to what is left.
+//
+// argv is not nil when a whole command was parsed, and is empty for the
+// empty commands clients may send, like empty lines, that should be
+// skipped. On protocol errors the error is a *ProtocolError, and the rest
+// of the input can't be trusted.
+func (p *CommandParser) Parse(buf []byte) (argv []string, n int, err error) {
+	if len(buf) == 0 {
+		return nil, 0, nil
+	}
+	if p.reqType == 0 {
+		if buf[0] == byte(Array) {
+			p.reqType = reqMultiBulk
+		} else {
+			p.reqType = reqInline
+		}
+	}
+	var done bool
+	if p.reqType == reqInline {
+		n, done, err = p.parseInline(buf)
+	} else {
+		n, done, err = p.parseMultiBulk(buf)
+	}
+	if err != nil {
+		p.Reset()
+		return nil, n, err
+	}
+	if !done {
+		return nil, n, nil
+	}
+	argv = p.argv
+	if argv == nil {
+		argv = []string{}
+	}
+	p.Reset()
+	return argv, n, nil
+}
+
+func (p *CommandParser) parseInline(buf []byte) (int, bool, error) {
+	newline := -1
+	for i, c := range buf {
+		if c == '\n' {
+			newline = i
+			break
+		}
+	}
+	if newline == -1 {
+		if len(buf) > p.maxInlineSize() {
+			return 0, false, protocolError("too big inline request")
+		}
+		return 0, false, nil
+	}
+	line := buf[:newline]
+	if len(line) > 0 && line[len(line)-1] == '\r' {
+		// Handle the \r\n case.
+		line = line[:len(line)-1]
+	}
+	argv := SplitArgs(line)
+	if argv == nil {
+		return 0, false, protocolError("unbalanced quotes in request")
+	}
+	p.argv = argv
+	return newline + 1, true, nil
+}
+
+// readLine returns the length of the line at the head of buf, without the
+// CRLF, or -1 if the whole line is not available yet.
+func (p *CommandParser) readLine(buf []byte, what string) (int, error) {
+	for i, c := range buf {
+		if c == '\r' {
+			// Buffer should also contain \n
+			if i+1 >= len(buf) {
+				return -1, nil
+			}
+			return i, nil
+		}
+	}
+	if len(buf) > p.maxInlineSize() {
+		return -1, protocolError("too big " + what + " count string")
+	}
+	return -1, nil
+}
+
+func (p *CommandParser) parseMultiBulk(buf []byte) (int, bool, error) {
+	pos := 0
+	if p.multiBulkLen == 0 {
+		// A new command: find out the multi bulk length.
+		newline, err := p.readLine(buf, "mbulk")
+		if newline == -1 {
+			return 0, false, err
+		}
+		max := p.MaxMultiBulkLen
+		if max <= 0 {
+			max = DefaultMaxMultiBulkLen
+		}
+		ll, ok := parseInt(buf[1:newline])
+		if !ok || ll > int64(max) {
+			return 0, false, protocolError("invalid multibulk length")
+		}
+		pos = newline + 2
+		if ll <= 0 {
+			return pos, true, nil
+		}
+		p.multiBulkLen = int(ll)
+		// Don't trust the length announced by the client to allocate.
+		p.argv = make([]string, 0, minInt(int(ll), 1024))
+		p.bulkLen = -1
+	}
+
+	for p.multiBulkLen > 0 {
+		// Read bulk length if unknown.
+		if p.bulkLen == -1 {
+			newline, err := p.readLine(buf[pos:], "bulk")
+			if newline == -1 {
+				return pos, false, err
+			}
+			line := buf[pos : pos+newline]
+			if len(line) == 0 || line[0] != byte(BulkString) {
+				got := buf[pos]
+				return pos, false, protocolError("expected '$', got '" + string(rune(got)) + "'")
+			}
+			max := p.MaxBulkLen
+			if max <= 0 {
+				max = DefaultMaxBulkLen
+			}
+			ll, ok := parseInt(line[1:])
+			if !ok || ll < 0 || ll > int64(max) {
+				return pos, false, protocolError("invalid bulk length")
+			}
+			pos += newline + 2
+			p.bulkLen = int(ll)
+		}
+
+		// Read bulk argument.
+		if len(buf)-pos < p.bulkLen+2 {
+			// Not enough data (+2 == trailing \r\n)
+			return pos, false, nil
+		}
+		if buf[pos+p.bulkLen] != '\r' || buf[pos+p.bulkLen+1] != '\n' {
+			return pos, false, protocolError("invalid bulk format")
+		}
+		p.argv = append(p.argv, string(buf[pos:pos+p.bulkLen]))
+		pos += p.bulkLen + 2
+		p.bulkLen = -1
+		p.multiBulkLen--
+	}
+	return pos, true, nil
+}
+
+// String returns the state of the parser, for debugging.
+func (p *CommandParser) String() string {
+	return "reqtype=" + strconv.Itoa(p.reqType) +
+		" multibulklen=" + strconv.Itoa(p.multiBulkLen) +
+		" bulklen=" + strconv.Itoa(p.bulkLen) +
+		" argc=" + strconv.Itoa(len(p.argv))
+}
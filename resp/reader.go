@@ -0,0 +1,356 @@
+package resp
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"math"
+	"strconv"
+)
+
+// Reader decodes RESP values and commands from a stream. Both RESP2 and
+// RESP3 are accepted: a RESP2 reply is a subset of RESP3.
+type Reader struct {
+	br *bufio.Reader
+	// Limits applied to the input: longer lines, aggregates or bulk
+	// strings are protocol errors. Zero means the default limit.
+	MaxInlineSize   int
+	MaxMultiBulkLen int
+	MaxBulkLen      int
+	line            []byte // Lines longer than the bufio buffer
+}
+
+func NewReader(r io.Reader) *Reader {
+	return NewReaderSize(r, 16*1024)
+}
+
+// NewReaderSize returns a Reader reading from r with a buffer of at least
+// size bytes.
+func NewReaderSize(r io.Reader, size int) *Reader {
+	if br, ok := r.(*bufio.Reader); ok && br.Size() >= size {
+		return &Reader{br: br}
+	}
+	return &Reader{br: bufio.NewReaderSize(r, size)}
+}
+
+// Buffered returns the number of bytes already read from the stream and
+// not yet decoded.
+func (r *Reader) Buffered() int {
+	return r.br.Buffered()
+}
+
+func (r *Reader) maxInlineSize() int {
+	if r.MaxInlineSize > 0 {
+		return r.MaxInlineSize
+	}
+	return DefaultMaxInlineSize
+}
+
+func (r *Reader) maxMultiBulkLen() int {
+	if r.MaxMultiBulkLen > 0 {
+		return r.MaxMultiBulkLen
+	}
+	return DefaultMaxMultiBulkLen
+}
+
+func (r *Reader) maxBulkLen() int {
+	if r.MaxBulkLen > 0 {
+		return r.MaxBulkLen
+	}
+	return DefaultMaxBulkLen
+}
+
+// readLine returns the next line without the line terminator. The line is
+// only valid until the next read. If crlf is set the line must end with
+// CRLF, otherwise a single LF is accepted too, as in inline commands.
+func (r *Reader) readLine(crlf bool) ([]byte, error) {
+	line, err := r.br.ReadSlice('\n')
+	if err == bufio.ErrBufferFull {
+		r.line = append(r.line[:0], line...)
+		for err == bufio.ErrBufferFull {
+			if len(r.line) > r.maxInlineSize() {
+				return nil, protocolError("too big inline request")
+			}
+			line, err = r.br.ReadSlice('\n')
+			r.line = append(r.line, line...)
+		}
+		line = r.line
+	}
+	if err != nil {
+		if err == io.EOF && len(line) > 0 {
+			err = io.ErrUnexpectedEOF
+		}
+		return nil, err
+	}
+	if len(line) > r.maxInlineSize()+2 {
+		return nil, protocolError("too big inline request")
+	}
+	n := len(line) - 1
+	if n > 0 && line[n-1] == '\r' {
+		n--
+	} else if crlf {
+		return nil, protocolError("expected CRLF line terminator")
+	}
+	return line[:n], nil
+}
+
+// readLength parses the length in the header of aggregates and bulk
+// strings: -1 is returned for RESP2 nulls.
+func readLength(line []byte, max int, what string) (int, error) {
+	n, ok := parseInt(line[1:])
+	if !ok || n < -1 || n > int64(max) {
+		return 0, protocolError("invalid " + what + " length")
+	}
+	return int(n), nil
+}
+
+// readBulk reads the payload of a bulk string of n bytes and its CRLF.
+func (r *Reader) readBulk(n int) (string, error) {
+	var buf []byte
+	if n <= bigBulkLen {
+		buf = make([]byte, n+2)
+		if _, err := io.ReadFull(r.br, buf); err != nil {
+			if err == io.EOF {
+				err = io.ErrUnexpectedEOF
+			}
+			return "", err
+		}
+	} else {
+		// Don't trust the length announced by the peer to allocate: the
+		// buffer grows as the payload arrives.
+		var b bytes.Buffer
+		b.Grow(bigBulkLen)
+		if _, err := io.CopyN(&b, r.br, int64(n+2)); err != nil {
+			if err == io.EOF {
+				err = io.ErrUnexpectedEOF
+			}
+			return "", err
+		}
+		buf = b.Bytes()
+	}
+	if buf[n] != '\r' || buf[n+1] != '\n' {
+		return "", protocolError("invalid bulk format")
+	}
+	return string(buf[:n]), nil
+}
+
+// ReadValue reads the next value. Attributes are not returned as values:
+// they are attached to the value that follows them. Error replies are
+// returned as values of type Error or BulkError, see Value.Err.
+func (r *Reader) ReadValue() (Value, error) {
+	return r.readValue(0)
+}
+
+func (r *Reader) readValue(depth int) (Value, error) {
+	if depth > maxNesting {
+		return Value{}, protocolError("too many nested aggregates")
+	}
+	var attrs []Value
+	for {
+		v, err := r.readSingle(depth)
+		if err != nil {
+			return Value{}, err
+		}
+		if v.Type != Attribute {
+			v.Attrs = attrs
+			return v, nil
+		}
+		attrs = append(attrs, v.Elems...)
+	}
+}
+
+func (r *Reader) readSingle(depth int) (Value, error) {
+	line, err := r.readLine(true)
+	if err != nil {
+		return Value{}, err
+	}
+	if len(line) == 0 {
+		return Value{}, protocolError("empty line")
+	}
+	v := Value{Type: Type(line[0])}
+	switch v.Type {
+	case SimpleString, Error:
+		v.Str = string(line[1:])
+	case Integer:
+		n, ok := parseInt(line[1:])
+		if !ok {
+			return Value{}, protocolError("invalid integer")
+		}
+		v.Int = n
+	case Null:
+		if len(line) != 1 {
+			return Value{}, protocolError("invalid null")
+		}
+	case Boolean:
+		if len(line) != 2 || (line[1] != 't' && line[1] != 'f') {
+			return Value{}, protocolError("invalid boolean")
+		}
+		v.Bool = line[1] == 't'
+	case Double:
+		f, ok := parseDouble(line[1:])
+		if !ok {
+			return Value{}, protocolError("invalid double")
+		}
+		v.Float = f
+	case BigNumber:
+		if !validBigNumber(line[1:]) {
+			return Value{}, protocolError("invalid big number")
+		}
+		v.Str = string(line[1:])
+	case BulkString, BulkError, VerbatimString:
+		n, err := readLength(line, r.maxBulkLen(), "bulk")
+		if err != nil {
+			return Value{}, err
+		}
+		if n == -1 {
+			if v.Type != BulkString {
+				return Value{}, protocolError("invalid bulk length")
+			}
+			return Value{Type: Null}, nil
+		}
+		if v.Str, err = r.readBulk(n); err != nil {
+			return Value{}, err
+		}
+		if v.Type == VerbatimString {
+			if len(v.Str) < 4 || v.Str[3] != ':' {
+				return Value{}, protocolError("invalid verbatim string")
+			}
+			v.Format, v.Str = v.Str[:3], v.Str[4:]
+		}
+	case Array, Set, Push, Map, Attribute:
+		n, err := readLength(line, r.maxMultiBulkLen(), "multibulk")
+		if err != nil {
+			return Value{}, err
+		}
+		if n == -1 {
+			if v.Type != Array {
+				return Value{}, protocolError("invalid multibulk length")
+			}
+			return Value{Type: Null}, nil
+		}
+		if v.Type == Map || v.Type == Attribute {
+			if n > r.maxMultiBulkLen()/2 {
+				return Value{}, protocolError("invalid multibulk length")
+			}
+			n *= 2
+		}
+		// Don't trust the length announced by the peer to allocate.
+		v.Elems = make([]Value, 0, minInt(n, 1024))
+		for i := 0; i < n; i++ {
+			e, err := r.readValue(depth + 1)
+			if err != nil {
+				if err == io.EOF {
+					err = io.ErrUnexpectedEOF
+				}
+				return Value{}, err
+			}
+			v.Elems = append(v.Elems, e)
+		}
+	default:
+		return Value{}, protocolError("unknown type " + strconv.QuoteRune(rune(line[0])))
+	}
+	return v, nil
+}
+
+func minInt(a, b int) int {
+	if a < b {
+		return a
+	}
+	return b
+}
+
+func parseDouble(b []byte) (float64, bool) {
+	switch string(b) {
+	case "inf", "+inf":
+		return math.Inf(1), true
+	case "-inf":
+		return math.Inf(-1), true
+	case "nan", "-nan":
+		return math.NaN(), true
+	}
+	if len(b) == 0 {
+		return 0, false
+	}
+	f, err := strconv.ParseFloat(string(b), 64)
+	return f, err == nil
+}
+
+func validBigNumber(b []byte) bool {
+	if len(b) > 0 && (b[0] == '-' || b[0] == '+') {
+		b = b[1:]
+	}
+	if len(b) == 0 {
+		return false
+	}
+	for _, c := range b {
+		if c < '0' || c > '9' {
+			return false
+		}
+	}
+	return true
+}
+
+// ReadCommand reads the next command sent by a client, either an array of
+// bulk strings or an inline command like "SET key value". Empty commands
+// are skipped.
+func (r *Reader) ReadCommand() ([]string, error) {
+	for {
+		b, err := r.br.Peek(1)
+		if err != nil {
+			return nil, err
+		}
+		if b[0] != byte(Array) {
+			line, err := r.readLine(false)
+			if err != nil {
+				return nil, err
+			}
+			argv := SplitArgs(line)
+			if argv == nil {
+				return nil, protocolError("unbalanced quotes in request")
+			}
+			if len(argv) > 0 {
+				return argv, nil
+			}
+			continue
+		}
+
+		line, err := r.readLine(true)
+		if err != nil {
+			return nil, err
+		}
+		n, ok := parseInt(line[1:])
+		if !ok || n > int64(r.maxMultiBulkLen()) {
+			return nil, protocolError("invalid multibulk length")
+		}
+		if n <= 0 {
+			continue
+		}
+		argv := make([]string, 0, minInt(int(n), 1024))
+		for i := 0; i < int(n); i++ {
+			line, err := r.readLine(true)
+			if err != nil {
+				if err == io.EOF {
+					err = io.ErrUnexpectedEOF
+				}
+				return nil, err
+			}
+			if len(line) == 0 || line[0] != byte(BulkString) {
+				c := byte(0)
+				if len(line) > 0 {
+					c = line[0]
+				}
+				return nil, protocolError("expected '$', got '" + string(c) + "'")
+			}
+			l, ok := parseInt(line[1:])
+			if !ok || l < 0 || l > int64(r.maxBulkLen()) {
+				return nil, protocolError("invalid bulk length")
+			}
+			arg, err := r.readBulk(int(l))
+			if err != nil {
+				return nil, err
+			}
+			argv = append(argv, arg)
+		}
+		return argv, nil
+	}
+}
@@ -0,0 +1,179 @@
+// Package resp implements RESP, the REdis Serialization Protocol spoken by
+// kiwi, in its versions 2 and 3.
+//
+// Reader decodes replies and commands from a stream and Writer encodes
+// them, downgrading RESP3 types when talking to a RESP2 peer. The Append
+// functions encode single values into a byte slice, for callers that
+// manage their own buffers, and CommandParser parses the commands sent by
+// clients from a buffer filled by non-blocking reads, keeping the state of
+// a partial command between reads.
+//
+// The server, the Go client and the tools all use this package, so that
+// there is a single implementation of the protocol.
+package resp
+
+import "strconv"
+
+// Type is the type of a RESP value, that is the first byte of its
+// encoding.
+type Type byte
+
+const (
+	SimpleString   Type = '+'
+	Error          Type = '-'
+	Integer        Type = ':'
+	BulkString     Type = '$'
+	Array          Type = '*'
+	Null           Type = '_' // RESP3, RESP2 nulls are decoded as Null too
+	Boolean        Type = '#' // RESP3
+	Double         Type = ',' // RESP3
+	BigNumber      Type = '(' // RESP3
+	BulkError      Type = '!' // RESP3
+	VerbatimString Type = '=' // RESP3
+	Map            Type = '%' // RESP3
+	Set            Type = '~' // RESP3
+	Attribute      Type = '|' // RESP3
+	Push           Type = '>' // RESP3
+)
+
+var typeNames = map[Type]string{
+	SimpleString:   "simple-string",
+	Error:          "error",
+	Integer:        "integer",
+	BulkString:     "bulk-string",
+	Array:          "array",
+	Null:           "null",
+	Boolean:        "boolean",
+	Double:         "double",
+	BigNumber:      "big-number",
+	BulkError:      "bulk-error",
+	VerbatimString: "verbatim-string",
+	Map:            "map",
+	Set:            "set",
+	Attribute:      "attribute",
+	Push:           "push",
+}
+
+func (t Type) String() string {
+	if name, ok := typeNames[t]; ok {
+		return name
+	}
+	return "unknown(" + strconv.QuoteRune(rune(t)) + ")"
+}
+
+// Aggregate reports whether values of the type contain other values.
+func (t Type) Aggregate() bool {
+	switch t {
+	case Array, Map, Set, Attribute, Push:
+		return true
+	}
+	return false
+}
+
+// Value is a decoded RESP value.
+type Value struct {
+	Type Type
+	// The payload of simple strings, errors, bulk strings, bulk errors,
+	// verbatim strings and big numbers.
+	Str string
+	// The format of verbatim strings, like "txt" or "mkd".
+	Format string
+	Int    int64
+	Float  float64
+	Bool   bool
+	// The elements of arrays, sets and push messages. Maps hold their
+	// keys and values alternated.
+	Elems []Value
+	// The attributes sent before the value, keys and values alternated.
+	Attrs []Value
+}
+
+// IsNull reports whether v is a null, including the RESP2 null bulk
+// string and null array.
+func (v Value) IsNull() bool {
+	return v.Type == Null
+}
+
+// Err returns the error carried by an error or bulk error value, nil for
+// the other types.
+func (v Value) Err() error {
+	if v.Type == Error || v.Type == BulkError {
+		return ServerError(v.Str)
+	}
+	return nil
+}
+
+// ServerError is an error reply, like "ERR unknown command".
+type ServerError string
+
+func (e ServerError) Error() string {
+	return string(e)
+}
+
+// Code returns the error code, that is the first word of the error, like
+// "WRONGTYPE".
+func (e ServerError) Code() string {
+	for i := 0; i < len(e); i++ {
+		if e[i] == ' ' {
+			return string(e[:i])
+		}
+	}
+	return string(e)
+}
+
+// ProtocolError is returned when the input is not valid RESP. The stream
+// can't be trusted anymore after a protocol error.
+type ProtocolError struct {
+	Reason string // like "invalid bulk length"
+}
+
+func (e *ProtocolError) Error() string {
+	return "Protocol error: " + e.Reason
+}
+
+func protocolError(reason string) error {
+	return &ProtocolError{Reason: reason}
+}
+
+// Default limits applied to the input, the same as the server defaults.
+const (
+	DefaultMaxInlineSize   = 64 * 1024         // Max size of inline commands and of lines
+	DefaultMaxMultiBulkLen = 1024 * 1024       // Max number of elements of an aggregate
+	DefaultMaxBulkLen      = 512 * 1024 * 1024 // Max length of a bulk string
+	maxNesting             = 128               // Max depth of nested aggregates
+	bigBulkLen             = 1024 * 1024       // Bulk strings read in chunks above this length
+)
+
+// parseInt parses the decimal integer in b, without allocating.
+func parseInt(b []byte) (int64, bool) {
+	if len(b) == 0 || len(b) > 20 {
+		return 0, false
+	}
+	neg := false
+	if b[0] == '-' {
+		neg = true
+		b = b[1:]
+		if len(b) == 0 {
+			return 0, false
+		}
+	}
+	var n uint64
+	for _, c := range b {
+		if c < '0' || c > '9' {
+			return 0, false
+		}
+		d := uint64(c - '0')
+		if n > (1<<63-d)/10 {
+			// Only -9223372036854775808 may need the extra unit.
+			return 0, false
+		}
+		n = n*10 + d
+	}
+	if neg {
+		return -int64(n), true
+	}
+	if n > 1<<63-1 {
+		return 0, false
+	}
+	return int64(n), true
+}
@@ -0,0 +1,161 @@
+package resp
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"math"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestWriter(t *testing.T) {
+	for _, tt := range []struct {
+		v            Value
+		resp2, resp3 string
+	}{
+		{Value{Type: SimpleString, Str: "OK"}, "+OK\r\n", "+OK\r\n"},
+		{Value{Type: Error, Str: "ERR bad"}, "-ERR bad\r\n", "-ERR bad\r\n"},
+		{Value{Type: Integer, Int: -42}, ":-42\r\n", ":-42\r\n"},
+		{Value{Type: BulkString, Str: ""}, "$0\r\n\r\n", "$0\r\n\r\n"},
+		{Value{Type: Null}, "$-1\r\n", "_\r\n"},
+		{Value{Type: Boolean, Bool: true}, ":1\r\n", "#t\r\n"},
+		{Value{Type: Double, Float: 1.5}, "$3\r\n1.5\r\n", ",1.5\r\n"},
+		{Value{Type: Double, Float: math.Inf(-1)}, "$4\r\n-inf\r\n", ",-inf\r\n"},
+		{Value{Type: BigNumber, Str: "12345678901234567890"}, "$20\r\n12345678901234567890\r\n", "(12345678901234567890\r\n"},
+		{Value{Type: BulkError, Str: "ERR a"}, "-ERR a\r\n", "!5\r\nERR a\r\n"},
+		{Value{Type: VerbatimString, Str: "hi", Format: "txt"}, "$2\r\nhi\r\n", "=6\r\ntxt:hi\r\n"},
+		{
+			Value{Type: Map, Elems: []Value{{Type: BulkString, Str: "a"}, {Type: Integer, Int: 1}}},
+			"*2\r\n$1\r\na\r\n:1\r\n", "%1\r\n$1\r\na\r\n:1\r\n",
+		},
+		{Value{Type: Set, Elems: []Value{{Type: Boolean}}}, "*1\r\n:0\r\n", "~1\r\n#f\r\n"},
+		{Value{Type: Push, Elems: []Value{{Type: SimpleString, Str: "x"}}}, "*1\r\n+x\r\n", ">1\r\n+x\r\n"},
+		{
+			// The attributes are only sent to RESP3 peers.
+			Value{Type: Integer, Int: 1, Attrs: []Value{{Type: SimpleString, Str: "ttl"}, {Type: Integer, Int: 3}}},
+			":1\r\n", "|1\r\n+ttl\r\n:3\r\n:1\r\n",
+		},
+	} {
+		for proto, want := range map[int]string{2: tt.resp2, 3: tt.resp3} {
+			var b bytes.Buffer
+			w := NewWriter(&b)
+			w.Proto = proto
+			if err := w.WriteValue(tt.v); err != nil {
+				t.Fatalf("RESP%d WriteValue(%v): %v", proto, tt.v, err)
+			}
+			w.Flush()
+			if b.String() != want {
+				t.Errorf("RESP%d WriteValue(%v) = %q, want %q", proto, tt.v, b.String(), want)
+			}
+			if proto == 2 {
+				continue
+			}
+			// The RESP3 encoding is read back as the same value.
+			got, err := NewReader(&b).ReadValue()
+			if err != nil || !reflect.DeepEqual(got, tt.v) {
+				t.Errorf("ReadValue(%q) = %v, %v, want %v", want, got, err, tt.v)
+			}
+		}
+	}
+
+	var b bytes.Buffer
+	w := NewWriter(&b)
+	w.WriteCommand("set", "a b", "")
+	w.WriteInline("get", "a")
+	w.WriteNullArray()
+	w.Flush()
+	if want := "*3\r\n$3\r\nset\r\n$3\r\na b\r\n$0\r\n\r\nget a\r\n*-1\r\n"; b.String() != want {
+		t.Errorf("written %q, want %q", b.String(), want)
+	}
+}
+
+func TestReadValueErrors(t *testing.T) {
+	for _, tt := range []struct {
+		in   string
+		want string
+	}{
+		{"\r\n", "empty line"},
+		{":1x\r\n", "invalid integer"},
+		{":99999999999999999999\r\n", "invalid integer"},
+		{"_x\r\n", "invalid null"},
+		{"#x\r\n", "invalid boolean"},
+		{",1.5.5\r\n", "invalid double"},
+		{"(12a\r\n", "invalid big number"},
+		{"$-2\r\n", "invalid bulk length"},
+		{"!-1\r\n", "invalid bulk length"},
+		{"$2000\r\n", "invalid bulk length"},
+		{"$3\r\nabcd\r\n", "invalid bulk format"},
+		{"=3\r\ntxt\r\n", "invalid verbatim string"},
+		{"*x\r\n", "invalid multibulk length"},
+		{"%-1\r\n", "invalid multibulk length"},
+		{"*2000\r\n", "invalid multibulk length"},
+		{"+OK\n", "expected CRLF line terminator"},
+		{"+" + strings.Repeat("x", 2000) + "\r\n", "too big inline request"},
+		{strings.Repeat("*1\r\n", 200) + ":1\r\n", "too many nested aggregates"},
+		{"?\r\n", "unknown type '?'"},
+	} {
+		r := NewReader(strings.NewReader(tt.in))
+		r.MaxInlineSize, r.MaxMultiBulkLen, r.MaxBulkLen = 1000, 1000, 1000
+		_, err := r.ReadValue()
+		var perr *ProtocolError
+		if !errors.As(err, &perr) || perr.Reason != tt.want {
+			t.Errorf("ReadValue(%.20q) = %v, want %q", tt.in, err, tt.want)
+		}
+	}
+
+	// A value cut by the end of the stream is not a protocol error.
+	for _, in := range []string{"", "+OK", "$5\r\nab", "*2\r\n:1\r\n"} {
+		_, err := NewReader(strings.NewReader(in)).ReadValue()
+		if err != io.EOF && err != io.ErrUnexpectedEOF {
+			t.Errorf("ReadValue(%q) = %v, want EOF", in, err)
+		}
+	}
+}
+
+func TestReadCommand(t *testing.T) {
+	r := NewReader(strings.NewReader("*2\r\n$3\r\nget\r\n$1\r\na\r\nset a \"b c\"\nping\r\n\"x\r\n"))
+	for _, want := range [][]string{{"get", "a"}, {"set", "a", "b c"}, {"ping"}} {
+		if got, err := r.ReadCommand(); err != nil || !reflect.DeepEqual(got, want) {
+			t.Errorf("ReadCommand() = %q, %v, want %q", got, err, want)
+		}
+	}
+	if _, err := r.ReadCommand(); err == nil || err.Error() != "Protocol error: unbalanced quotes in request" {
+		t.Errorf("ReadCommand() = %v, want unbalanced quotes", err)
+	}
+}
+
+func TestSplitArgs(t *testing.T) {
+	for _, tt := range []struct {
+		line string
+		want []string
+	}{
+		{"", []string{}},
+		{"  get   a ", []string{"get", "a"}},
+		{`set a "b c\n\x41\"" 'd "e'`, []string{"set", "a", "b c\nA\"", `d "e`}},
+		{`set a ""`, []string{"set", "a", ""}},
+		{`"a`, nil},
+		{`'a`, nil},
+		{`"a"b`, nil},
+		{`'a'b`, nil},
+	} {
+		if got := SplitArgs([]byte(tt.line)); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("SplitArgs(%q) = %q, want %q", tt.line, got, tt.want)
+		}
+	}
+}
+
+func TestServerError(t *testing.T) {
+	v := Value{Type: Error, Str: "WRONGTYPE Operation against a key"}
+	var serr ServerError
+	if err := v.Err(); !errors.As(err, &serr) || serr.Code() != "WRONGTYPE" {
+		t.Errorf("Err() = %v", err)
+	}
+	if err := (Value{Type: BulkString}).Err(); err != nil {
+		t.Errorf("Err() of a bulk string = %v", err)
+	}
+	if got := ServerError("OOM").Code(); got != "OOM" {
+		t.Errorf("Code() = %q", got)
+	}
+}
@@ -0,0 +1,121 @@
+package resp
+
+import "strings"
+
+func isSpace(b byte) bool {
+	return b == ' ' || b == '\r' || b == '\n'
+}
+
+func isHexDigit(b byte) bool {
+	return ('0' <= b && b <= '9') || ('a' <= b && b <= 'f') || ('A' <= b && b <= 'F')
+}
+
+func hexDigitToInt(b byte) byte {
+	switch {
+	case '0' <= b && b <= '9':
+		return b - '0'
+	case 'a' <= b && b <= 'f':
+		return b - 'a' + 10
+	default:
+		return b - 'A' + 10
+	}
+}
+
+// SplitArgs splits an inline command into arguments, where every argument
+// can be in the following programming-language REPL-alike form:
+//
+//	foo bar "newline are supported\n" and "\xff\x00otherstuff"
+//
+// It returns the arguments, an empty slice if the line is empty, or nil if
+// the line contains unbalanced quotes or closed quotes followed by non
+// space characters, as in: "foo"bar or "foo'
+func SplitArgs(line []byte) []string {
+	vector := []string{}
+	i := 0
+	for {
+		// skip blanks
+		for i < len(line) && isSpace(line[i]) {
+			i++
+		}
+		if i >= len(line) {
+			// end of string
+			return vector
+		}
+		inQuotes := false       // set to true if we are in "quotes"
+		inSingleQuotes := false // set to true if we are in 'single quotes'
+		done := false
+		var buf strings.Builder
+		for !done {
+			if inQuotes {
+				if i >= len(line) {
+					// unterminated quotes
+					return nil
+				}
+				if line[i] == '\\' && i+3 < len(line) && line[i+1] == 'x' &&
+					isHexDigit(line[i+2]) && isHexDigit(line[i+3]) {
+					buf.WriteByte(hexDigitToInt(line[i+2])*16 + hexDigitToInt(line[i+3]))
+					i += 3
+				} else if line[i] == '\\' && i+1 < len(line) {
+					i++
+					switch line[i] {
+					case 'n':
+						buf.WriteByte('\n')
+					case 'r':
+						buf.WriteByte('\r')
+					case 't':
+						buf.WriteByte('\t')
+					case 'b':
+						buf.WriteByte('\b')
+					case 'a':
+						buf.WriteByte('\a')
+					default:
+						buf.WriteByte(line[i])
+					}
+				} else if line[i] == '"' {
+					// closing quote must be followed by a space or nothing at all.
+					if i+1 < len(line) && !isSpace(line[i+1]) {
+						return nil
+					}
+					done = true
+				} else {
+					buf.WriteByte(line[i])
+				}
+			} else if inSingleQuotes {
+				if i >= len(line) {
+					// unterminated quotes
+					return nil
+				}
+				if line[i] == '\\' && i+1 < len(line) && line[i+1] == '\'' {
+					buf.WriteByte('\'')
+					i++
+				} else if line[i] == '\'' {
+					// closing quote must be followed by a space or nothing at all.
+					if i+1 < len(line) && !isSpace(line[i+1]) {
+						return nil
+					}
+					done = true
+				} else {
+					buf.WriteByte(line[i])
+				}
+			} else if i >= len(line) {
+				done = true
+			} else {
+				switch line[i] {
+				case ' ', '\n', '\r', '\t', 0:
+					done = true
+				case '"':
+					inQuotes = true
+				case '\'':
+					inSingleQuotes = true
+				default:
+					buf.WriteByte(line[i])
+				}
+			}
+			if i < len(line) {
+				i++
+			}
+		}
+		// add the token to the vector
+		vector = append(vector, buf.String())
+	}
+}
@@ -0,0 +1,308 @@
+package resp
+
+import (
+	"errors"
+	"io"
+	"strings"
+)
+
+// Writer encodes values to a stream. Values are buffered until Flush is
+// called, or until the buffer is full.
+//
+// When Proto is 2 the RESP3 types are encoded as the closest RESP2 type,
+// like the server does for clients that did not switch to RESP3 with
+// HELLO: maps and sets are flat arrays, doubles, big numbers and verbatim
+// strings are bulk strings, booleans are integers. Attributes can't be
+// sent to RESP2 peers.
+type Writer struct {
+	Proto int // Protocol version of the peer, 2 or 3
+	w     io.Writer
+	buf   []byte
+	err   error
+}
+
+const writerBufLen = 16 * 1024
+
+// ErrAttributeRESP2 is returned when writing an attribute with Proto 2.
+var ErrAttributeRESP2 = errors.New("resp: attributes require RESP3")
+
+func NewWriter(w io.Writer) *Writer {
+	return &Writer{Proto: 2, w: w, buf: make([]byte, 0, writerBufLen)}
+}
+
+// Reset discards the buffered data and makes the Writer write to w.
+func (w *Writer) Reset(wr io.Writer) {
+	w.w = wr
+	w.buf = w.buf[:0]
+	w.err = nil
+}
+
+// Buffered returns the number of bytes not flushed yet.
+func (w *Writer) Buffered() int {
+	return len(w.buf)
+}
+
+// Flush writes the buffered data. Errors are sticky: once a write failed,
+// the following calls return the same error.
+func (w *Writer) Flush() error {
+	if w.err != nil {
+		return w.err
+	}
+	if len(w.buf) == 0 {
+		return nil
+	}
+	_, w.err = w.w.Write(w.buf)
+	w.buf = w.buf[:0]
+	return w.err
+}
+
+// done flushes the buffer when it is full.
+func (w *Writer) done() error {
+	if w.err != nil {
+		return w.err
+	}
+	if len(w.buf) >= writerBufLen {
+		return w.Flush()
+	}
+	return nil
+}
+
+func (w *Writer) WriteSimpleString(s string) error {
+	w.buf = AppendSimpleString(w.buf, s)
+	return w.done()
+}
+
+// WriteError writes an error reply. s should start with an error code,
+// like "ERR".
+func (w *Writer) WriteError(s string) error {
+	w.buf = AppendError(w.buf, s)
+	return w.done()
+}
+
+func (w *Writer) WriteInteger(n int64) error {
+	w.buf = AppendInteger(w.buf, n)
+	return w.done()
+}
+
+func (w *Writer) WriteBulkString(s string) error {
+	if len(s) < writerBufLen {
+		w.buf = AppendBulkString(w.buf, s)
+		return w.done()
+	}
+	// Big payloads are written directly, without copying them.
+	w.buf = AppendHeader(w.buf, BulkString, int64(len(s)))
+	if err := w.Flush(); err != nil {
+		return err
+	}
+	if _, w.err = io.WriteString(w.w, s); w.err != nil {
+		return w.err
+	}
+	w.buf = append(w.buf, '\r', '\n')
+	return nil
+}
+
+func (w *Writer) WriteBulk(b []byte) error {
+	if len(b) < writerBufLen {
+		w.buf = AppendBulk(w.buf, b)
+		return w.done()
+	}
+	w.buf = AppendHeader(w.buf, BulkString, int64(len(b)))
+	if err := w.Flush(); err != nil {
+		return err
+	}
+	if _, w.err = w.w.Write(b); w.err != nil {
+		return w.err
+	}
+	w.buf = append(w.buf, '\r', '\n')
+	return nil
+}
+
+func (w *Writer) WriteArrayLen(n int) error {
+	w.buf = AppendArrayLen(w.buf, n)
+	return w.done()
+}
+
+// WriteMapLen writes the header of a map of n key-value pairs, followed
+// by the keys and values alternated.
+func (w *Writer) WriteMapLen(n int) error {
+	if w.Proto == 2 {
+		return w.WriteArrayLen(n * 2)
+	}
+	w.buf = AppendMapLen(w.buf, n)
+	return w.done()
+}
+
+func (w *Writer) WriteSetLen(n int) error {
+	if w.Proto == 2 {
+		return w.WriteArrayLen(n)
+	}
+	w.buf = AppendSetLen(w.buf, n)
+	return w.done()
+}
+
+// WritePushLen writes the header of an out-of-band push message, an array
+// for RESP2 peers.
+func (w *Writer) WritePushLen(n int) error {
+	if w.Proto == 2 {
+		return w.WriteArrayLen(n)
+	}
+	w.buf = AppendPushLen(w.buf, n)
+	return w.done()
+}
+
+// WriteAttributeLen writes the header of an attribute of n key-value
+// pairs, to be followed by the value it describes.
+func (w *Writer) WriteAttributeLen(n int) error {
+	if w.Proto == 2 {
+		return ErrAttributeRESP2
+	}
+	w.buf = AppendAttributeLen(w.buf, n)
+	return w.done()
+}
+
+// WriteNull writes a null, the null bulk string for RESP2 peers.
+func (w *Writer) WriteNull() error {
+	if w.Proto == 2 {
+		w.buf = AppendNullBulk(w.buf)
+	} else {
+		w.buf = AppendNull(w.buf)
+	}
+	return w.done()
+}
+
+// WriteNullArray writes a null, the null array for RESP2 peers.
+func (w *Writer) WriteNullArray() error {
+	if w.Proto == 2 {
+		w.buf = AppendNullArray(w.buf)
+	} else {
+		w.buf = AppendNull(w.buf)
+	}
+	return w.done()
+}
+
+func (w *Writer) WriteBool(b bool) error {
+	if w.Proto == 2 {
+		if b {
+			return w.WriteInteger(1)
+		}
+		return w.WriteInteger(0)
+	}
+	w.buf = AppendBool(w.buf, b)
+	return w.done()
+}
+
+func (w *Writer) WriteDouble(f float64) error {
+	if w.Proto == 2 {
+		return w.WriteBulkString(FormatDouble(f))
+	}
+	w.buf = AppendDouble(w.buf, f)
+	return w.done()
+}
+
+func (w *Writer) WriteBigNumber(num string) error {
+	if w.Proto == 2 {
+		return w.WriteBulkString(num)
+	}
+	w.buf = AppendBigNumber(w.buf, num)
+	return w.done()
+}
+
+// WriteBulkError writes an error that may contain newlines, a simple
+// error for RESP2 peers.
+func (w *Writer) WriteBulkError(s string) error {
+	if w.Proto == 2 {
+		return w.WriteError(s)
+	}
+	w.buf = AppendBulkError(w.buf, s)
+	return w.done()
+}
+
+// WriteVerbatim writes a string meant to be shown as is to the user, with
+// its three characters format, like "txt".
+func (w *Writer) WriteVerbatim(s, format string) error {
+	if w.Proto == 2 {
+		return w.WriteBulkString(s)
+	}
+	w.buf = AppendVerbatim(w.buf, s, format)
+	return w.done()
+}
+
+// WriteCommand writes a command as sent by clients.
+func (w *Writer) WriteCommand(args ...string) error {
+	if err := w.WriteArrayLen(len(args)); err != nil {
+		return err
+	}
+	for _, arg := range args {
+		if err := w.WriteBulkString(arg); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// WriteInline writes a command in the inline format, like "SET key value",
+// as typed by humans. The arguments must not contain spaces or newlines.
+func (w *Writer) WriteInline(args ...string) error {
+	w.buf = append(w.buf, strings.Join(args, " ")...)
+	w.buf = append(w.buf, '\r', '\n')
+	return w.done()
+}
+
+// WriteValue writes v, downgrading it for RESP2 peers. The attributes of v
+// are only sent to RESP3 peers.
+func (w *Writer) WriteValue(v Value) error {
+	if w.Proto != 2 && len(v.Attrs) > 0 {
+		if err := w.WriteAttributeLen(len(v.Attrs) / 2); err != nil {
+			return err
+		}
+		for _, a := range v.Attrs {
+			if err := w.WriteValue(a); err != nil {
+				return err
+			}
+		}
+	}
+	var err error
+	switch v.Type {
+	case SimpleString:
+		return w.WriteSimpleString(v.Str)
+	case Error:
+		return w.WriteError(v.Str)
+	case Integer:
+		return w.WriteInteger(v.Int)
+	case BulkString:
+		return w.WriteBulkString(v.Str)
+	case Null:
+		return w.WriteNull()
+	case Boolean:
+		return w.WriteBool(v.Bool)
+	case Double:
+		return w.WriteDouble(v.Float)
+	case BigNumber:
+		return w.WriteBigNumber(v.Str)
+	case BulkError:
+		return w.WriteBulkError(v.Str)
+	case VerbatimString:
+		return w.WriteVerbatim(v.Str, v.Format)
+	case Array:
+		err = w.WriteArrayLen(len(v.Elems))
+	case Map:
+		err = w.WriteMapLen(len(v.Elems) / 2)
+	case Set:
+		err = w.WriteSetLen(len(v.Elems))
+	case Push:
+		err = w.WritePushLen(len(v.Elems))
+	case Attribute:
+		err = w.WriteAttributeLen(len(v.Elems) / 2)
+	default:
+		return errors.New("resp: can't write a value of type " + v.Type.String())
+	}
+	if err != nil {
+		return err
+	}
+	for _, e := range v.Elems {
+		if err := w.WriteValue(e); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,988 @@
+package server
+
+import (
+	"bufio"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/zhaotong0312/kiwi/structure"
+)
+
+/* Access control lists.
+ *
+ * Every connection is associated with a user: new connections are
+ * associated with the "default" user, and can switch to a different one
+ * using AUTH <username> <password>. A user describes:
+ *
+ * 1) If the user is enabled or not (on / off).
+ * 2) The set of SHA256 hashes of the passwords that can be used to
+ *    authenticate as the user (or nopass).
+ * 3) The commands the user can call, either one by one (+get -set) or by
+ *    category (+@read -@write). Categories are derived from the flags of
+ *    the command table.
+ * 4) The glob-style patterns of the keys (~pattern) the user can access.
+ *
+ * There is no Pub/Sub, so the channel rules of Redis (&pattern,
+ * allchannels, resetchannels) are not supported: they are syntax errors.
+ *
+ * Commands or keys denied to a user are recorded in the ACL LOG. */
+
+type User struct {
+	Name      string
+	Flags     int      // See USER_FLAG_*
+	Passwords []string // SHA256 hashes of the passwords, as hex strings.
+	Patterns  []string // Allowed key patterns, unless USER_FLAG_ALLKEYS.
+	// The set of commands the user can call, and, for commands that are
+	// not fully allowed, the first arguments that can be used with them.
+	allowedCommands    map[string]bool
+	allowedSubcommands map[string][]string
+	// The command rules, as provided by the user, used to describe it.
+	commandRules []string
+}
+
+/* An ACL category, and the command flags that put a command into it. */
+type ACLCategory struct {
+	Name string
+	Test func(cmd *Command) bool
+}
+
+var ACLCommandCategories = []ACLCategory{
+	{"keyspace", func(cmd *Command) bool { return cmd.FirstKey != 0 || cmd.GetKeyProcess != nil }},
+	{"read", func(cmd *Command) bool { return cmd.Flags&CMD_READONLY != 0 }},
+	{"write", func(cmd *Command) bool { return cmd.Flags&CMD_WRITE != 0 }},
+	{"admin", func(cmd *Command) bool { return cmd.Flags&CMD_ADMIN != 0 }},
+	{"pubsub", func(cmd *Command) bool { return cmd.Flags&CMD_PUBSUB != 0 }},
+	{"fast", func(cmd *Command) bool { return cmd.Flags&CMD_FAST != 0 }},
+	{"slow", func(cmd *Command) bool { return cmd.Flags&CMD_FAST == 0 }},
+	{"connection", func(cmd *Command) bool { return cmd.Flags&CMD_NO_AUTH != 0 }},
+	{"transaction", func(cmd *Command) bool { return IsMultiControlCommand(cmd) }},
+	// Administrative commands and writes that don't name their keys (like
+	// FLUSHALL) can destroy the whole dataset.
+	{"dangerous", func(cmd *Command) bool {
+		return cmd.Flags&CMD_ADMIN != 0 ||
+			(cmd.Flags&CMD_WRITE != 0 && cmd.FirstKey == 0 && cmd.GetKeyProcess == nil)
+	}},
+}
+
+/* An entry of the ACL LOG. */
+type ACLLogEntry struct {
+	Count    int       // Number of times this happened recently.
+	Reason   int       // ACL_DENIED_* reason.
+	Context  int       // ACL_LOG_CTX_* context.
+	Object   string    // The key name or command name.
+	Username string    // User the client is authenticated with.
+	Ctime    time.Time // Last time this happened.
+	Cinfo    string    // Client info (last client if updated).
+}
+
+/* The users and the ACL LOG of a server. */
+type aclState struct {
+	users   map[string]*User
+	log     *structure.List // Newest entries on the left
+	mutex   sync.RWMutex    // Protects users and their rules
+	logLock sync.Mutex
+}
+
+/* ==========================================================================
+ * Users
+ * ========================================================================== */
+
+/* Create a new user with the given name: the user is created disabled,
+ * without passwords and without any permission. */
+func newUser(name string) *User {
+	return &User{
+		Name:               name,
+		allowedCommands:    make(map[string]bool),
+		allowedSubcommands: make(map[string][]string),
+		commandRules:       []string{"-@all"},
+	}
+}
+
+/* Return a deep copy of the user, so that rules can be applied to the copy
+ * and committed only if all of them are valid. */
+func (u *User) dup() *User {
+	n := newUser(u.Name)
+	n.Flags = u.Flags
+	n.Passwords = append([]string(nil), u.Passwords...)
+	n.Patterns = append([]string(nil), u.Patterns...)
+	for name := range u.allowedCommands {
+		n.allowedCommands[name] = true
+	}
+	for name, args := range u.allowedSubcommands {
+		n.allowedSubcommands[name] = append([]string(nil), args...)
+	}
+	n.commandRules = append([]string(nil), u.commandRules...)
+	return n
+}
+
+/* Return the user with the given name, or nil. */
+func (s *Server) ACLGetUserByName(name string) *User {
+	s.acl.mutex.RLock()
+	defer s.acl.mutex.RUnlock()
+	return s.acl.users[name]
+}
+
+/* Create the default user, which has no password and can run every
+ * command against every key. */
+func (s *Server) ACLCreateDefaultUser() *User {
+	u := newUser("default")
+	for _, op := range []string{"+@all", "~*", "on", "nopass"} {
+		s.ACLSetUser(u, op)
+	}
+	return u
+}
+
+/* Initialization of the ACL subsystem. Must be called after the command
+ * table is populated and before the configuration is loaded, since the
+ * requirepass directive sets the default user password. */
+func (s *Server) ACLInit() {
+	s.acl.users = make(map[string]*User)
+	s.acl.log = structure.ListCreate()
+	s.DefaultUser = s.ACLCreateDefaultUser()
+	s.acl.users[s.DefaultUser.Name] = s.DefaultUser
+}
+
+/* Set the password of the default user, this implements the old
+ * "requirepass" directive: an empty password makes the default user
+ * nopass. */
+func (s *Server) ACLUpdateDefaultUserPassword(password string) {
+	s.acl.mutex.Lock()
+	defer s.acl.mutex.Unlock()
+	s.ACLSetUser(s.DefaultUser, "resetpass")
+	if password != "" {
+		s.ACLSetUser(s.DefaultUser, ">"+password)
+	} else {
+		s.ACLSetUser(s.DefaultUser, "nopass")
+	}
+}
+
+/* Return true if the connections associated with the default user must
+ * authenticate before running commands: that is when the default user has
+ * passwords or is disabled. */
+func (s *Server) ACLDefaultUserRequiresAuth() bool {
+	s.acl.mutex.RLock()
+	defer s.acl.mutex.RUnlock()
+	return s.DefaultUser.Flags&USER_FLAG_NOPASS == 0 || s.DefaultUser.Flags&USER_FLAG_ENABLED == 0
+}
+
+func ACLHashPassword(password string) string {
+	sum := sha256.Sum256([]byte(password))
+	return hex.EncodeToString(sum[:])
+}
+
+/* Return the category with the given name, or nil if there is no such
+ * category. */
+func ACLGetCategory(name string) *ACLCategory {
+	for i := range ACLCommandCategories {
+		if ACLCommandCategories[i].Name == name {
+			return &ACLCommandCategories[i]
+		}
+	}
+	return nil
+}
+
+/* Replace any previous rule about the same command with the new one, so
+ * that the description of the user doesn't grow forever. */
+func (u *User) updateCommandRules(rule string) {
+	name := rule[1:]
+	rules := u.commandRules[:0]
+	for _, r := range u.commandRules {
+		if r[1:] != name {
+			rules = append(rules, r)
+		}
+	}
+	u.commandRules = append(rules, rule)
+}
+
+func (u *User) setCommand(name string, allow bool) {
+	if allow {
+		u.allowedCommands[name] = true
+	} else {
+		delete(u.allowedCommands, name)
+	}
+	delete(u.allowedSubcommands, name)
+}
+
+var (
+	errACLSyntax          = errors.New("Syntax error")
+	errACLUnknownCommand  = errors.New("Unknown command or category name in ACL")
+	errACLPatternAfterAll = errors.New("Adding a pattern after the * pattern (or the 'allkeys' flag) is not valid and does not have any effect. Try 'resetkeys' to start with an empty list of patterns")
+	errACLBadHash         = errors.New("The password hash must be exactly 64 characters and contain only lowercase hexadecimal characters")
+	errACLNoSuchPassword  = errors.New("The password you are trying to remove from the user does not exist")
+	errACLSubcommand      = errors.New("Allowing first-arg of a subcommand is only supported with '+'")
+)
+
+/* Set user properties according to the string "op". The following
+ * is a description of what different strings will do:
+ *
+ * on           Enable the user: it is possible to authenticate as this user.
+ * off          Disable the user: it's no longer possible to authenticate
+ *              with this user, however the already authenticated connections
+ *              will still work.
+ * +<command>   Allow the execution of that command.
+ * -<command>   Disallow the execution of that command.
+ * +@<category> Allow the execution of all the commands in such category.
+ * -@<category> Disallow the execution of all the commands in such category.
+ * +<command>|subcommand Allow a specific subcommand of an otherwise
+ *              disabled command.
+ * allcommands  Alias for +@all.
+ * nocommands   Alias for -@all.
+ * ~<pattern>   Add a pattern of keys that can be mentioned as part of
+ *              commands. For instance ~* allows all the keys.
+ * allkeys      Alias for ~*.
+ * resetkeys    Flush the list of allowed keys patterns.
+ * ><password>  Add this password to the list of valid password for the user.
+ * #<hash>      Add this password hash to the list of valid hashes.
+ * <<password>  Remove this password from the list of valid passwords.
+ * !<hash>      Remove this hashed password from the list of valid passwords.
+ * nopass       All the set passwords of the user are removed, and the user
+ *              is flagged as requiring no password.
+ * resetpass    Flush the list of allowed passwords and remove the nopass
+ *              status.
+ * reset        Performs the following actions: resetpass, resetkeys, off,
+ *              -@all.
+ *
+ * The caller must hold the ACL lock, unless the user is not yet visible
+ * to other connections. */
+func (s *Server) ACLSetUser(u *User, op string) error {
+	lop := strings.ToLower(op)
+	switch {
+	case lop == "on":
+		u.Flags |= USER_FLAG_ENABLED
+	case lop == "off":
+		u.Flags &^= USER_FLAG_ENABLED
+	case lop == "allkeys" || op == "~*":
+		u.Flags |= USER_FLAG_ALLKEYS
+		u.Patterns = nil
+	case lop == "resetkeys":
+		u.Flags &^= USER_FLAG_ALLKEYS
+		u.Patterns = nil
+	case lop == "allcommands" || lop == "+@all":
+		for name := range s.Commands {
+			u.allowedCommands[name] = true
+		}
+		u.allowedSubcommands = make(map[string][]string)
+		u.commandRules = []string{"+@all"}
+	case lop == "nocommands" || lop == "-@all":
+		u.allowedCommands = make(map[string]bool)
+		u.allowedSubcommands = make(map[string][]string)
+		u.commandRules = []string{"-@all"}
+	case lop == "nopass":
+		u.Flags |= USER_FLAG_NOPASS
+		u.Passwords = nil
+	case lop == "resetpass":
+		u.Flags &^= USER_FLAG_NOPASS
+		u.Passwords = nil
+	case op[0] == '>' || op[0] == '#':
+		var hash string
+		if op[0] == '>' {
+			hash = ACLHashPassword(op[1:])
+		} else {
+			hash = op[1:]
+			if len(hash) != 64 || strings.Trim(hash, "0123456789abcdef") != "" {
+				return errACLBadHash
+			}
+		}
+		// Adding a password means the user is no longer nopass.
+		u.Flags &^= USER_FLAG_NOPASS
+		for _, p := range u.Passwords {
+			if p == hash {
+				return nil
+			}
+		}
+		u.Passwords = append(u.Passwords, hash)
+	case op[0] == '<' || op[0] == '!':
+		hash := op[1:]
+		if op[0] == '<' {
+			hash = ACLHashPassword(op[1:])
+		}
+		for i, p := range u.Passwords {
+			if p == hash {
+				u.Passwords = append(u.Passwords[:i], u.Passwords[i+1:]...)
+				return nil
+			}
+		}
+		return errACLNoSuchPassword
+	case op[0] == '~':
+		if u.Flags&USER_FLAG_ALLKEYS != 0 {
+			return errACLPatternAfterAll
+		}
+		u.Patterns = appendPattern(u.Patterns, op[1:])
+	case (op[0] == '+' || op[0] == '-') && len(op) > 1 && op[1] == '@':
+		category := ACLGetCategory(lop[2:])
+		if category == nil {
+			return errACLUnknownCommand
+		}
+		for name, cmd := range s.Commands {
+			if category.Test(cmd) {
+				u.setCommand(name, op[0] == '+')
+			}
+		}
+		u.commandRules = append(u.commandRules, lop)
+	case op[0] == '+' || op[0] == '-':
+		name, sub := lop[1:], ""
+		if i := strings.IndexByte(name, '|'); i != -1 {
+			name, sub = name[:i], name[i+1:]
+		}
+		if s.LookUpCommand(name) == nil {
+			return errACLUnknownCommand
+		}
+		if sub == "" {
+			u.setCommand(name, op[0] == '+')
+			u.updateCommandRules(lop)
+			return nil
+		}
+		// Subcommands can only be allowed: the command must be otherwise
+		// disabled for the rule to make any difference.
+		if op[0] == '-' || strings.IndexByte(sub, '|') != -1 {
+			return errACLSubcommand
+		}
+		if !u.allowedCommands[name] {
+			u.allowedSubcommands[name] = appendPattern(u.allowedSubcommands[name], sub)
+		}
+		u.updateCommandRules(lop)
+	case lop == "reset":
+		for _, o := range []string{"resetpass", "resetkeys", "off", "-@all"} {
+			s.ACLSetUser(u, o)
+		}
+	default:
+		return errACLSyntax
+	}
+	return nil
+}
+
+func appendPattern(patterns []string, pattern string) []string {
+	for _, p := range patterns {
+		if p == pattern {
+			return patterns
+		}
+	}
+	return append(patterns, pattern)
+}
+
+/* Describe the user with the same rules that would recreate it, as used by
+ * ACL LIST and the ACL file: "on #<hash> ~* +@all". */
+func ACLDescribeUser(u *User) string {
+	parts := []string{}
+	if u.Flags&USER_FLAG_ENABLED != 0 {
+		parts = append(parts, "on")
+	} else {
+		parts = append(parts, "off")
+	}
+	if u.Flags&USER_FLAG_NOPASS != 0 {
+		parts = append(parts, "nopass")
+	}
+	for _, p := range u.Passwords {
+		parts = append(parts, "#"+p)
+	}
+	if u.Flags&USER_FLAG_ALLKEYS != 0 {
+		parts = append(parts, "~*")
+	} else {
+		for _, p := range u.Patterns {
+			parts = append(parts, "~"+p)
+		}
+	}
+	parts = append(parts, u.commandRules...)
+	return strings.Join(parts, " ")
+}
+
+/* Return true if the user can run every command of the table. */
+func (u *User) allCommands(commands map[string]*Command) bool {
+	for name := range commands {
+		if !u.allowedCommands[name] {
+			return false
+		}
+	}
+	return true
+}
+
+/* ==========================================================================
+ * Authentication and permissions
+ * ========================================================================== */
+
+/* Check the username and password pair and return true if they are valid.
+ * Disabled users can never authenticate. */
+func (s *Server) ACLCheckUserCredentials(username, password string) bool {
+	s.acl.mutex.RLock()
+	defer s.acl.mutex.RUnlock()
+	u := s.acl.users[username]
+	if u == nil || u.Flags&USER_FLAG_ENABLED == 0 {
+		return false
+	}
+	if u.Flags&USER_FLAG_NOPASS != 0 {
+		return true
+	}
+	hash := ACLHashPassword(password)
+	for _, p := range u.Passwords {
+		if subtle.ConstantTimeCompare([]byte(p), []byte(hash)) == 1 {
+			return true
+		}
+	}
+	return false
+}
+
+/* Authenticate the client as 'username'. On failure C_ERR is returned and
+ * the attempt is recorded in the ACL LOG. */
+func ACLAuthenticateUser(c *KiwiClient, username, password string) int {
+	if c.srv.ACLCheckUserCredentials(username, password) {
+		c.Authenticated = 1
+		c.User = c.srv.ACLGetUserByName(username)
+		return C_OK
+	}
+	ACLAddLogEntry(c, ACL_DENIED_AUTH, ACL_LOG_CTX_TOPLEVEL, "AUTH", username)
+	return C_ERR
+}
+
+/* Return true if the key matches one of the patterns of the user. */
+func (u *User) canAccessKey(key string) bool {
+	if u.Flags&USER_FLAG_ALLKEYS != 0 {
+		return true
+	}
+	for _, p := range u.Patterns {
+		if StringMatch(p, key, false) {
+			return true
+		}
+	}
+	return false
+}
+
+/* Check if the command is ready to be executed in the client 'c', already
+ * referenced by c.Cmd, and can be executed by this client according to the
+ * ACLs associated to the client user. ACL_OK is returned if the command
+ * can be executed, otherwise ACL_DENIED_CMD or ACL_DENIED_KEY, together
+ * with the position of the offending key. */
+func ACLCheckAllPerm(c *KiwiClient) (int, int) {
+	u := c.User
+	// If there is no associated user, the connection can run anything.
+	if u == nil {
+		return ACL_OK, -1
+	}
+	// Commands used to authenticate can always be called.
+	if c.Cmd.Flags&CMD_NO_AUTH != 0 {
+		return ACL_OK, -1
+	}
+	c.srv.acl.mutex.RLock()
+	defer c.srv.acl.mutex.RUnlock()
+
+	// Check if the user can execute this command, or at least the
+	// subcommand in the first argument.
+	if !u.allowedCommands[c.Cmd.Name] {
+		allowed := false
+		if c.Argc > 1 {
+			sub := strings.ToLower(c.Argv[1])
+			for _, s := range u.allowedSubcommands[c.Cmd.Name] {
+				if s == sub {
+					allowed = true
+					break
+				}
+			}
+		}
+		if !allowed {
+			return ACL_DENIED_CMD, -1
+		}
+	}
+
+	// Check if the user can execute commands explicitly touching the keys
+	// mentioned in the command arguments.
+	if u.Flags&USER_FLAG_ALLKEYS == 0 && (c.Cmd.FirstKey != 0 || c.Cmd.GetKeyProcess != nil) {
+		for _, pos := range GetKeysFromCommand(c.Cmd, c.Argv, c.Argc) {
+			if !u.canAccessKey(c.Argv[pos]) {
+				return ACL_DENIED_KEY, pos
+			}
+		}
+	}
+	return ACL_OK, -1
+}
+
+/* Reply to a client whose command was denied by the ACLs. */
+func ACLReplyDenied(c *KiwiClient, reason int) {
+	switch reason {
+	case ACL_DENIED_CMD:
+		AddReplyErrorFormat(c, "-NOPERM this user has no permissions to run the '%s' command or its subcommand", c.Cmd.Name)
+	case ACL_DENIED_KEY:
+		AddReplyError(c, "-NOPERM this user has no permissions to access one of the keys used as arguments")
+	}
+}
+
+/* Kill the clients authenticated with the given user, because the user
+ * was deleted. The calling client, if any, is closed after the reply. */
+func ACLKillClientsOfUser(c *KiwiClient, u *User) {
+	for _, cl := range c.srv.GetClients() {
+		if cl.User != u {
+			continue
+		}
+		if cl == c {
+			c.AddFlags(CLIENT_CLOSE_AFTER_REPLY)
+		} else {
+			FreeClientAsync(cl)
+		}
+	}
+}
+
+/* ==========================================================================
+ * ACL LOG
+ * ========================================================================== */
+
+func aclLogReasonString(reason int) string {
+	switch reason {
+	case ACL_DENIED_CMD:
+		return "command"
+	case ACL_DENIED_KEY:
+		return "key"
+	case ACL_DENIED_AUTH:
+		return "auth"
+	}
+	return "unknown"
+}
+
+func aclLogContextString(context int) string {
+	switch context {
+	case ACL_LOG_CTX_TOPLEVEL:
+		return "toplevel"
+	case ACL_LOG_CTX_MULTI:
+		return "multi"
+	}
+	return "unknown"
+}
+
+/* Add a new entry in the ACL log, making sure to delete the old entry if
+ * we reach the maximum length allowed for the log. If a similar entry was
+ * logged recently, it is updated instead of adding a new one.
+ *
+ * 'object' is the name of the denied command or key, and 'username' the
+ * user involved: when empty the user of the client is used. */
+func ACLAddLogEntry(c *KiwiClient, reason, context int, object, username string) {
+	if username == "" && c.User != nil {
+		username = c.User.Name
+	}
+	le := &ACLLogEntry{
+		Count:    1,
+		Reason:   reason,
+		Context:  context,
+		Object:   object,
+		Username: username,
+		Ctime:    time.Now(),
+		Cinfo:    CatClientInfoString(c),
+	}
+
+	c.srv.acl.logLock.Lock()
+	defer c.srv.acl.logLock.Unlock()
+
+	// Try to match this entry with past ones, to see if we can just
+	// update an existing entry instead of creating a new one.
+	iter := c.srv.acl.log.Iterator(structure.ITERATION_DIRECTION_INORDER)
+	for node := iter.Next(); iter.HasNext(); node = iter.Next() {
+		e := node.Value.(*ACLLogEntry)
+		if e.Reason == le.Reason && e.Context == le.Context && e.Object == le.Object &&
+			e.Username == le.Username &&
+			le.Ctime.Sub(e.Ctime) <= ACL_LOG_GROUPING_MAX_TIME_DELTA*time.Millisecond {
+			// Update the old entry with the new information and move it to
+			// the head of the log.
+			le.Count = e.Count + 1
+			c.srv.acl.log.RemoveNode(node)
+			break
+		}
+	}
+	c.srv.acl.log.LeftAppend(le)
+	for int(c.srv.acl.log.Len()) > c.srv.AclLogMaxLen {
+		c.srv.acl.log.Pop()
+	}
+}
+
+/* ==========================================================================
+ * ACL file
+ * ========================================================================== */
+
+/* Load the users from the ACL file. The whole file is validated before
+ * applying it: on error nothing changes and the returned error lists the
+ * problems found, with their line numbers.
+ *
+ * Users defined in the file replace the existing ones, keeping the
+ * connections authenticated with them. Users not defined in the file are
+ * deleted, and their connections killed. If the file doesn't define the
+ * default user it is reset to "on nopass ~* +@all". */
+func (s *Server) ACLLoadFromFile(filename string) error {
+	f, err := os.Open(filename)
+	if err != nil {
+		return fmt.Errorf("Error loading ACLs, opening file '%s': %s", filename, err)
+	}
+	defer f.Close()
+
+	users := map[string]*User{"default": s.ACLCreateDefaultUser()}
+	seen := map[string]bool{}
+	var errs strings.Builder
+	scanner := bufio.NewScanner(f)
+	linenum := 0
+	for scanner.Scan() {
+		linenum++
+		line := strings.TrimSpace(scanner.Text())
+		// Skip blank lines and comments.
+		if line == "" || line[0] == '#' {
+			continue
+		}
+		argv := SplitArgs([]byte(line))
+		if argv == nil {
+			fmt.Fprintf(&errs, "%s:%d: unbalanced quotes in acl line. ", filename, linenum)
+			continue
+		}
+		if len(argv) < 2 || argv[0] != "user" {
+			fmt.Fprintf(&errs, "%s:%d should start with user keyword followed by the username. ", filename, linenum)
+			continue
+		}
+		name := argv[1]
+		if seen[name] {
+			fmt.Fprintf(&errs, "%s:%d: duplicate user '%s' found. ", filename, linenum, name)
+			continue
+		}
+		seen[name] = true
+		u := users[name]
+		if u == nil {
+			u = newUser(name)
+			users[name] = u
+		} else {
+			s.ACLSetUser(u, "reset")
+		}
+		for _, op := range argv[2:] {
+			if err := s.ACLSetUser(u, op); err != nil {
+				fmt.Fprintf(&errs, "%s:%d: %s. ", filename, linenum, err)
+				break
+			}
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return fmt.Errorf("Error loading ACLs, reading file '%s': %s", filename, err)
+	}
+	if errs.Len() > 0 {
+		return errors.New(strings.TrimSuffix(errs.String(), " "))
+	}
+
+	// The file is valid: commit the new set of users, updating in place the
+	// users that already exist so that authenticated clients see the new
+	// rules.
+	s.acl.mutex.Lock()
+	var deleted []*User
+	for name, u := range s.acl.users {
+		if nu := users[name]; nu != nil {
+			*u = *nu
+			users[name] = u
+		} else {
+			deleted = append(deleted, u)
+		}
+	}
+	s.acl.users = users
+	s.DefaultUser = users["default"]
+	s.acl.mutex.Unlock()
+	for _, u := range deleted {
+		ACLKillClientsOfUser(nil, u)
+	}
+	return nil
+}
+
+/* Save the users in the ACL file, writing a temporary file first and then
+ * renaming it, so that the file is never left half written. */
+func (s *Server) ACLSaveToFile(filename string) error {
+	s.acl.mutex.RLock()
+	names := make([]string, 0, len(s.acl.users))
+	for name := range s.acl.users {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var buf strings.Builder
+	for _, name := range names {
+		fmt.Fprintf(&buf, "user %s %s\n", name, ACLDescribeUser(s.acl.users[name]))
+	}
+	s.acl.mutex.RUnlock()
+
+	tmpfile := filepath.Join(filepath.Dir(filename), fmt.Sprintf("temp-%d.acl", os.Getpid()))
+	f, err := os.OpenFile(tmpfile, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return fmt.Errorf("Opening temp ACL file for ACL SAVE: %s", err)
+	}
+	if _, err = f.WriteString(buf.String()); err == nil {
+		err = f.Sync()
+	}
+	f.Close()
+	if err == nil {
+		err = os.Rename(tmpfile, filename)
+	}
+	if err != nil {
+		os.Remove(tmpfile)
+		return fmt.Errorf("Writing ACL file for ACL SAVE: %s", err)
+	}
+	return nil
+}
+
+/* Load the ACL file at startup, if configured. An invalid ACL file is a
+ * fatal error. */
+func (s *Server) ACLLoadUsersAtStartup() {
+	if s.AclFile == "" {
+		return
+	}
+	if err := s.ACLLoadFromFile(s.AclFile); err != nil {
+		s.ServerLogWarnF("Aborting Kiwi startup because of ACL errors: %s\n", err)
+		os.Exit(1)
+	}
+}
+
+/* ==========================================================================
+ * ACL related commands
+ * ========================================================================== */
+
+/* ACL -- show and modify the configuration of ACL users.
+ * ACL HELP
+ * ACL LOAD
+ * ACL SAVE
+ * ACL LIST
+ * ACL USERS
+ * ACL CAT [<category>]
+ * ACL SETUSER <username> ... acl rules ...
+ * ACL DELUSER <username> [...]
+ * ACL GETUSER <username>
+ * ACL GENPASS [<bits>]
+ * ACL WHOAMI
+ * ACL LOG [<count> | RESET] */
+var AclCommand CommandProcess = func(c *KiwiClient) {
+	sub := strings.ToLower(c.Argv[1])
+	if sub == "setuser" && c.Argc >= 3 {
+		name := c.Argv[2]
+		if strings.ContainsAny(name, " \t\r\n") {
+			AddReplyError(c, "Usernames can't contain spaces or null characters")
+			return
+		}
+		c.srv.acl.mutex.Lock()
+		defer c.srv.acl.mutex.Unlock()
+		// Apply the rules to a copy of the user, so that the user is not
+		// modified if one of the rules is invalid.
+		u := c.srv.acl.users[name]
+		var tmp *User
+		if u != nil {
+			tmp = u.dup()
+		} else {
+			tmp = newUser(name)
+		}
+		for j := 3; j < c.Argc; j++ {
+			if err := c.srv.ACLSetUser(tmp, c.Argv[j]); err != nil {
+				AddReplyErrorFormat(c, "Error in ACL SETUSER modifier '%s': %s", c.Argv[j], err)
+				return
+			}
+		}
+		if u != nil {
+			*u = *tmp
+		} else {
+			c.srv.acl.users[name] = tmp
+		}
+		AddReply(c, c.srv.Shared.Ok)
+	} else if sub == "deluser" && c.Argc >= 3 {
+		deleted := 0
+		for j := 2; j < c.Argc; j++ {
+			name := c.Argv[j]
+			if name == "default" {
+				AddReplyError(c, "The 'default' user cannot be removed")
+				return
+			}
+		}
+		for j := 2; j < c.Argc; j++ {
+			c.srv.acl.mutex.Lock()
+			u := c.srv.acl.users[c.Argv[j]]
+			delete(c.srv.acl.users, c.Argv[j])
+			c.srv.acl.mutex.Unlock()
+			if u != nil {
+				ACLKillClientsOfUser(c, u)
+				deleted++
+			}
+		}
+		AddReplyInt(c, deleted)
+	} else if sub == "getuser" && c.Argc == 3 {
+		c.srv.acl.mutex.RLock()
+		defer c.srv.acl.mutex.RUnlock()
+		u := c.srv.acl.users[c.Argv[2]]
+		if u == nil {
+			AddReplyNull(c)
+			return
+		}
+		AddReplyMapLen(c, 4)
+
+		// Flags
+		flags := []string{}
+		if u.Flags&USER_FLAG_ENABLED != 0 {
+			flags = append(flags, "on")
+		} else {
+			flags = append(flags, "off")
+		}
+		if u.Flags&USER_FLAG_ALLKEYS != 0 {
+			flags = append(flags, "allkeys")
+		}
+		if u.allCommands(c.srv.Commands) {
+			flags = append(flags, "allcommands")
+		}
+		if u.Flags&USER_FLAG_NOPASS != 0 {
+			flags = append(flags, "nopass")
+		}
+		AddReplyBulkStr(c, "flags")
+		addReplyStringArray(c, flags)
+
+		// Passwords
+		AddReplyBulkStr(c, "passwords")
+		addReplyStringArray(c, u.Passwords)
+
+		// Commands
+		AddReplyBulkStr(c, "commands")
+		AddReplyBulkStr(c, strings.Join(u.commandRules, " "))
+
+		// Key patterns
+		AddReplyBulkStr(c, "keys")
+		if u.Flags&USER_FLAG_ALLKEYS != 0 {
+			addReplyStringArray(c, []string{"*"})
+		} else {
+			addReplyStringArray(c, u.Patterns)
+		}
+	} else if (sub == "list" || sub == "users") && c.Argc == 2 {
+		c.srv.acl.mutex.RLock()
+		defer c.srv.acl.mutex.RUnlock()
+		names := make([]string, 0, len(c.srv.acl.users))
+		for name := range c.srv.acl.users {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		AddReplyMultiBulkLen(c, len(names))
+		for _, name := range names {
+			if sub == "users" {
+				AddReplyBulkStr(c, name)
+			} else {
+				AddReplyBulkStr(c, fmt.Sprintf("user %s %s", name, ACLDescribeUser(c.srv.acl.users[name])))
+			}
+		}
+	} else if sub == "whoami" && c.Argc == 2 {
+		if c.User != nil {
+			AddReplyBulkStr(c, c.User.Name)
+		} else {
+			AddReplyNull(c)
+		}
+	} else if c.srv.AclFile == "" && (sub == "load" || sub == "save") && c.Argc == 2 {
+		AddReplyError(c, "This Kiwi instance is not configured to use an ACL file. You may want to specify users via the ACL SETUSER command and set the 'aclfile' directive in order to store them.")
+	} else if sub == "load" && c.Argc == 2 {
+		if err := c.srv.ACLLoadFromFile(c.srv.AclFile); err != nil {
+			AddReplyError(c, err.Error())
+		} else {
+			AddReply(c, c.srv.Shared.Ok)
+		}
+	} else if sub == "save" && c.Argc == 2 {
+		if err := c.srv.ACLSaveToFile(c.srv.AclFile); err != nil {
+			AddReplyError(c, "There was an error trying to save the ACLs. Please check the server logs for more information")
+			c.srv.ServerLogWarnF("%s\n", err)
+		} else {
+			AddReply(c, c.srv.Shared.Ok)
+		}
+	} else if sub == "cat" && c.Argc == 2 {
+		AddReplyMultiBulkLen(c, len(ACLCommandCategories))
+		for _, category := range ACLCommandCategories {
+			AddReplyBulkStr(c, category.Name)
+		}
+	} else if sub == "cat" && c.Argc == 3 {
+		category := ACLGetCategory(strings.ToLower(c.Argv[2]))
+		if category == nil {
+			AddReplyErrorFormat(c, "Unknown category '%s'", c.Argv[2])
+			return
+		}
+		names := []string{}
+		for name, cmd := range c.srv.Commands {
+			if category.Test(cmd) {
+				names = append(names, name)
+			}
+		}
+		sort.Strings(names)
+		addReplyStringArray(c, names)
+	} else if sub == "genpass" && (c.Argc == 2 || c.Argc == 3) {
+		bits := 256
+		if c.Argc == 3 {
+			n, err := strconv.Atoi(c.Argv[2])
+			if err != nil || n <= 0 || n > 4096 {
+				AddReplyError(c, "ACL GENPASS argument must be the number of bits for the output password, a positive number up to 4096")
+				return
+			}
+			bits = n
+		}
+		chars := (bits + 3) / 4 // Round to number of characters to emit.
+		buf := make([]byte, (chars+1)/2)
+		rand.Read(buf)
+		AddReplyBulkStr(c, hex.EncodeToString(buf)[:chars])
+	} else if sub == "log" && (c.Argc == 2 || c.Argc == 3) {
+		count := 10 // By default reply with 10 entries.
+		if c.Argc == 3 {
+			if strings.ToLower(c.Argv[2]) == "reset" {
+				c.srv.acl.logLock.Lock()
+				c.srv.acl.log.Clear()
+				c.srv.acl.logLock.Unlock()
+				AddReply(c, c.srv.Shared.Ok)
+				return
+			}
+			n, err := strconv.Atoi(c.Argv[2])
+			if err != nil || n < 0 {
+				AddReplyError(c, "value is out of range, must be positive")
+				return
+			}
+			count = n
+		}
+		c.srv.acl.logLock.Lock()
+		entries := []*ACLLogEntry{}
+		iter := c.srv.acl.log.Iterator(structure.ITERATION_DIRECTION_INORDER)
+		for node := iter.Next(); iter.HasNext() && len(entries) < count; node = iter.Next() {
+			entries = append(entries, node.Value.(*ACLLogEntry))
+		}
+		c.srv.acl.logLock.Unlock()
+
+		now := time.Now()
+		AddReplyMultiBulkLen(c, len(entries))
+		for _, e := range entries {
+			AddReplyMapLen(c, 7)
+			AddReplyBulkStr(c, "count")
+			AddReplyInt(c, e.Count)
+			AddReplyBulkStr(c, "reason")
+			AddReplyBulkStr(c, aclLogReasonString(e.Reason))
+			AddReplyBulkStr(c, "context")
+			AddReplyBulkStr(c, aclLogContextString(e.Context))
+			AddReplyBulkStr(c, "object")
+			AddReplyBulkStr(c, e.Object)
+			AddReplyBulkStr(c, "username")
+			AddReplyBulkStr(c, e.Username)
+			AddReplyBulkStr(c, "age-seconds")
+			AddReplyDouble(c, now.Sub(e.Ctime).Seconds())
+			AddReplyBulkStr(c, "client-info")
+			AddReplyBulkStr(c, e.Cinfo)
+		}
+	} else if c.Argc == 2 && sub == "help" {
+		AddReplyHelp(c, []string{
+			"CAT [<category>] -- List all commands that belong to <category>, or all command categories when no category is specified.",
+			"DELUSER <username> [<username> ...] -- Delete a list of users.",
+			"GETUSER <username> -- Get the user's details.",
+			"GENPASS [<bits>] -- Generate a secure user password (default: 256 bits).",
+			"LIST -- Show users details in config file format.",
+			"LOAD -- Reload users from the ACL file.",
+			"LOG [<count> | RESET] -- Show the ACL log entries, or reset the log.",
+			"SAVE -- Save the current users to the ACL file.",
+			"SETUSER <username> <attribute> [<attribute> ...] -- Create or modify a user with the specified attributes.",
+			"USERS -- List all the registered usernames.",
+			"WHOAMI -- Return the current connection username.",
+		})
+	} else {
+		AddReplySubcommandSyntaxError(c)
+	}
+}
+
+func addReplyStringArray(c *KiwiClient, strs []string) {
+	AddReplyMultiBulkLen(c, len(strs))
+	for _, s := range strs {
+		AddReplyBulkStr(c, s)
+	}
+}
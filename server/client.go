@@ -3,54 +3,118 @@ package server
 import (
 	"time"
 	"fmt"
+	"strconv"
+	"strings"
+	"sync"
 	"sync/atomic"
 	"github.com/zhaotong0312/kiwi/structure"
 	"github.com/zhaotong0312/kiwi/event"
+	"github.com/zhaotong0312/kiwi/resp"
 )
 
 type KiwiClient struct {
+	srv             *Server // The server of the client
 	Id              int64
 	Conn            event.Conn
 	Db              *Db
 	Name            string
 	PeerId          string
-	InBuf           *LargeBuffer
-	OutBuf          *LargeBuffer
+	InBuf           *Buffer    // Partial command left by the previous reads
+	OutBuf          *ReplyList // Replies not handed to the event loop yet
 	Argc            int      // count of arguments
 	Argv            []string // arguments of current command
 	Cmd             *Command
+	LastCmd         *Command // Last command executed, for CLIENT LIST
+	User            *User    // User associated with this connection
 	CreateTime      time.Time
-	LastInteraction time.Time
-	Flags           int
+	lastInteraction int64 // UnixNano, updated out of the keyspace lock
+	Flags           int64 // Set and cleared by other loops too, see AddFlags()
+	Btype           int // Type of blocking op if CLIENT_BLOCKED.
 	Node            *structure.ListNode
-	RequestType     int // Request protocol type: PROTO_REQ_*
-	MultiBulkLen    int // Number of multi bulk arguments left to read.
+	Parser          resp.CommandParser // State of the command being read from InBuf
 	Authenticated   int
+	Resp            int // RESP protocol version, 2 or 3, set by HELLO.
 	QueryCount      int
+	ErrorReplies    int // Number of error replies, to detect failed calls
+	Mstate          MultiState // MULTI/EXEC state
+	asyncOut        []byte // Replies queued from other event loops
+	asyncMutex      sync.Mutex
+	loop            int // Loop executing the commands of an internal client
+	bufSizes        [4]int64 // qbuf, qbuf-free, obl and omem, see PublishBufferSizes()
 }
 
 func (c *KiwiClient) GetConn() event.Conn {
 	return c.Conn
 }
 
+/* Return the index of the event loop executing the commands of the client,
+ * or -1 for an internal client executing with the whole keyspace locked,
+ * see internal.go. */
+func (c *KiwiClient) LoopIndex() int {
+	if c.Conn == nil {
+		return c.loop
+	}
+	return c.Conn.LoopIndex()
+}
+
 func (c *KiwiClient) GetLastInteraction() time.Time {
-	return c.LastInteraction
+	return time.Unix(0, atomic.LoadInt64(&c.lastInteraction))
 }
 
 func (c *KiwiClient) SetLastInteraction() {
-	c.LastInteraction = LruClock()
+	// Called out of the keyspace lock, when the replies are written: the
+	// LRU clock is updated by the cron meanwhile.
+	atomic.StoreInt64(&c.lastInteraction, time.Now().UnixNano())
 }
 
+/* The flags are read and written atomically: other loops flag the client
+ * too, like CLIENT KILL or CLIENT UNPAUSE do, and read them for CLIENT
+ * LIST. */
 func (c *KiwiClient) WithFlags(flags int) bool {
-	return c.Flags&flags != 0
+	return atomic.LoadInt64(&c.Flags)&int64(flags) != 0
 }
 
 func (c *KiwiClient) AddFlags(flags int) {
-	c.Flags |= flags
+	for {
+		old := atomic.LoadInt64(&c.Flags)
+		if atomic.CompareAndSwapInt64(&c.Flags, old, old|int64(flags)) {
+			return
+		}
+	}
 }
 
 func (c *KiwiClient) DeleteFlags(flags int) {
-	c.Flags &= ^flags
+	for {
+		old := atomic.LoadInt64(&c.Flags)
+		if atomic.CompareAndSwapInt64(&c.Flags, old, old&^int64(flags)) {
+			return
+		}
+	}
+}
+
+/* Publish the sizes of the client buffers for the other loops, that can't
+ * access the buffers themselves: called by the loop of the client once it
+ * handled an event. */
+func (c *KiwiClient) PublishBufferSizes() {
+	var qbuf, qbufFree, obl, omem int
+	if c.InBuf != nil {
+		qbuf = c.InBuf.Len()
+		qbufFree = c.InBuf.Cap() - c.InBuf.Len()
+	}
+	if c.OutBuf != nil {
+		obl = c.OutBuf.Len()
+		omem = c.OutBuf.Cap()
+	}
+	atomic.StoreInt64(&c.bufSizes[0], int64(qbuf))
+	atomic.StoreInt64(&c.bufSizes[1], int64(qbufFree))
+	atomic.StoreInt64(&c.bufSizes[2], int64(obl))
+	atomic.StoreInt64(&c.bufSizes[3], int64(omem))
+}
+
+/* Return the buffer sizes last published, see PublishBufferSizes(). */
+func (c *KiwiClient) BufferSizes() (qbuf, qbufFree, obl, omem int64) {
+	return atomic.LoadInt64(&c.bufSizes[0]), atomic.LoadInt64(&c.bufSizes[1]),
+		atomic.LoadInt64(&c.bufSizes[2]), atomic.LoadInt64(&c.bufSizes[3])
 }
 
 func (c *KiwiClient) GeneratePeerId(s *Server) {
@@ -69,8 +133,8 @@ func (c *KiwiClient) GetPeerId(s *Server) string {
 }
 
 func (c *KiwiClient) GetNextClientId() {
-	c.Id = atomic.LoadInt64(&kiwiS.NextClientId)
-	atomic.AddInt64(&kiwiS.NextClientId, 1)
+	// Client ids start from 1: CLIENT KILL ID and CLIENT LIST ID reject 0.
+	c.Id = atomic.AddInt64(&c.srv.NextClientId, 1)
 }
 
 func (c *KiwiClient) GetClientType() int {
@@ -122,28 +186,18 @@ func (c *KiwiClient) ResetArgv() {
 	c.Argv = nil
 }
 
-func (c *KiwiClient) Reset(in []byte) {
-	if len(in) > 0 {
-		c.InBuf = NewLargeBuffer(in)
-	} else {
-		c.InBuf.Reset()
-	}
-	c.ResetArgv()
-	c.RequestType = 0
-	c.MultiBulkLen = 0
-	c.OutBuf.Reset()
-}
-
 func (c *KiwiClient) PrepareClientToWrite() int {
 	if c.WithFlags(CLIENT_REPLY_OFF | CLIENT_REPLY_SKIP) {
 		return C_ERR
 	}
-	if c.Conn == nil {
+	if c.Conn == nil && !c.WithFlags(CLIENT_INTERNAL) {
 		return C_ERR
 	}
 	return C_OK
 }
 
+/* Concatenate a string representing the state of a client in a human
+ * readable format. */
 func CatClientInfoString(c *KiwiClient) string {
 	flags := Buffer{}
 	if c.WithFlags(CLIENT_SLAVE) {
@@ -184,38 +238,86 @@ func CatClientInfoString(c *KiwiClient) string {
 	if c.WithFlags(CLIENT_READONLY) {
 		flags.WriteByte('r')
 	}
+	if c.WithFlags(CLIENT_NO_EVICT) {
+		flags.WriteByte('e')
+	}
 	if flags.Len() == 0 {
 		flags.WriteByte('N')
 	}
-	flags.WriteByte(0)
-	flags.WriteByte('r')
-	flags.WriteByte('w')
-	flags.WriteByte(0)
-	cmd := "nil"
-	clientFmt := "id=%d addr=%kiwiS conn=%kiwiS name=%kiwiS age=%d idle=%d flags=%kiwiS db=%d cmd=%kiwiS"
-	return fmt.Sprintf(clientFmt, c.Id, c.GetPeerId(kiwiS), c.Conn.LocalAddr().String(), c.Name, kiwiS.UnixTime.Sub(c.CreateTime).Nanoseconds()/1000,
-		kiwiS.UnixTime.Sub(c.LastInteraction).Nanoseconds()/1000, flags.String(), c.Db.id, cmd)
+	cmd := "NULL"
+	if c.LastCmd != nil {
+		cmd = c.LastCmd.Name
+	}
+	// The client may belong to another loop.
+	qbuf, qbufFree, obl, omem := c.BufferSizes()
+	dbId := -1
+	if c.Db != nil {
+		dbId = c.Db.id
+	}
+	userName := "(null)"
+	if c.User != nil {
+		userName = c.User.Name
+	}
+	clientFmt := "id=%d addr=%s laddr=%s name=%s age=%d idle=%d flags=%s db=%d " +
+		"qbuf=%d qbuf-free=%d obl=%d omem=%d tot-mem=%d cmd=%s user=%s resp=%d"
+	return fmt.Sprintf(clientFmt, c.Id, c.GetPeerId(c.srv), c.GetLocalAddr(), c.Name,
+		int64(c.srv.UnixTime.Sub(c.CreateTime)/time.Second),
+		int64(c.srv.UnixTime.Sub(c.GetLastInteraction())/time.Second),
+		flags.String(), dbId, qbuf, qbufFree, obl, omem, ClientComputeSize(c), cmd, userName, c.Resp)
+}
+
+/* Return the local address the client is connected to, as a string. */
+func (c *KiwiClient) GetLocalAddr() string {
+	if c.WithFlags(CLIENT_UNIX_SOCKET) {
+		return c.srv.UnixSocketPath + ":0"
+	}
+	if c.Conn == nil || c.Conn.LocalAddr() == nil {
+		return ""
+	}
+	return c.Conn.LocalAddr().String()
+}
+
+/* Return the info line of every client of the given type, or of every
+ * client if ctype is -1. */
+func (s *Server) GetAllClientsInfoString(ctype int) string {
+	var o strings.Builder
+	for _, c := range s.GetClients() {
+		if ctype != -1 && c.GetClientType() != ctype {
+			continue
+		}
+		o.WriteString(CatClientInfoString(c))
+		o.WriteByte('\n')
+	}
+	return o.String()
 }
 
-func CreateClient(conn event.Conn, flags int) (c *KiwiClient, action event.Action) {
-	createTime := kiwiS.UnixTime
+func (s *Server) CreateClient(conn event.Conn, flags int) (c *KiwiClient, action event.Action) {
+	// Called out of the keyspace lock: the cached time is updated by the
+	// cron job meanwhile.
+	createTime := time.Now()
 	c = &KiwiClient{
+		srv:             s,
 		Id:              0,
 		Conn:            conn,
 		Name:            "",
 		PeerId:          "",
-		InBuf:           &LargeBuffer{},
-		OutBuf:          &LargeBuffer{},
+		InBuf:           GetQueryBuffer(),
+		OutBuf:          &ReplyList{},
 		Cmd:             nil,
+		User:            s.DefaultUser,
 		CreateTime:      createTime,
-		LastInteraction: createTime,
-		Flags:           flags,
+		lastInteraction: createTime.UnixNano(),
+		Flags:           int64(flags),
 		Node:            nil,
-		RequestType:     0,
-		MultiBulkLen:    0,
 		Authenticated:   0,
+		Resp:            2,
 		QueryCount:      0,
 	}
+	// The client is authenticated only if the default user requires no
+	// password and is enabled.
+	if !s.ACLDefaultUserRequiresAuth() {
+		c.Authenticated = 1
+	}
 	c.GetNextClientId()
 	SelectDB(c, 0)
 	LinkClient(c)
@@ -223,23 +325,82 @@ func CreateClient(conn event.Conn, flags int) (c *KiwiClient, action event.Actio
 }
 
 func LinkClient(c *KiwiClient) {
-	kiwiS.Clients.Append(c)
-	kiwiS.ClientsMap[c.Id] = c
-	c.Node = kiwiS.Clients.Right()
-	atomic.AddInt64(&kiwiS.StatConnCount, 1)
+	c.srv.mutex.Lock()
+	c.srv.Clients.Append(c)
+	c.srv.ClientsMap[c.Id] = c
+	// Right() is the list sentinel, the node we just appended is before it.
+	c.Node = c.srv.Clients.RightFirst()
+	c.srv.mutex.Unlock()
+	atomic.AddInt64(&c.srv.StatConnCount, 1)
+	atomic.AddInt64(&c.srv.StatNumConnections, 1)
 }
 
 func UnLinkClient(c *KiwiClient) {
-	kiwiS.Clients.RemoveNode(c.Node)
-	c.Node = nil
-	delete(kiwiS.ClientsMap, c.Id)
-	atomic.AddInt64(&kiwiS.StatConnCount, -1)
+	c.srv.mutex.Lock()
+	if c.Node != nil {
+		c.srv.Clients.RemoveNode(c.Node)
+		c.Node = nil
+	}
+	delete(c.srv.ClientsMap, c.Id)
+	c.srv.mutex.Unlock()
+	RemovePausedClient(c)
+	if c.WithFlags(CLIENT_MONITOR) {
+		RemoveMonitor(c)
+	}
+	atomic.AddInt64(&c.srv.StatConnCount, -1)
+}
+
+/* Return a snapshot of the connected clients, in connection order. */
+func (s *Server) GetClients() []*KiwiClient {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	clients := make([]*KiwiClient, 0, s.Clients.Len())
+	iter := s.Clients.Iterator(structure.ITERATION_DIRECTION_INORDER)
+	for node := iter.Next(); iter.HasNext(); node = iter.Next() {
+		clients = append(clients, node.Value.(*KiwiClient))
+	}
+	return clients
+}
+
+func (s *Server) LookupClientByID(id int64) *KiwiClient {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	return s.ClientsMap[id]
+}
+
+/* Schedule a client to be closed by its own event loop: it is flagged
+ * CLIENT_CLOSE_ASAP and woken up, so that the next event on its connection
+ * closes it. */
+func FreeClientAsync(c *KiwiClient) {
+	if c.WithFlags(CLIENT_CLOSE_ASAP) {
+		return
+	}
+	c.AddFlags(CLIENT_CLOSE_ASAP)
+	if c.Conn != nil {
+		c.Conn.Wake()
+	}
+}
+
+/* This function is called just after a command was processed, to rotate
+ * the CLIENT REPLY SKIP state: the reply to the next command will be sent,
+ * unless the command we just processed was "CLIENT REPLY SKIP". */
+func (c *KiwiClient) UpdateReplySkip() {
+	c.DeleteFlags(CLIENT_REPLY_SKIP)
+	if c.WithFlags(CLIENT_REPLY_SKIP_NEXT) {
+		c.AddFlags(CLIENT_REPLY_SKIP)
+		c.DeleteFlags(CLIENT_REPLY_SKIP_NEXT)
+	}
 }
 
 func CloseClient(c *KiwiClient) {
 	if c != nil {
 		c.ResetArgv()
+		FreeClientMultiState(c)
+		ReleaseQueryBuffer(c.InBuf)
 		c.InBuf = nil
+		if c.OutBuf != nil {
+			c.OutBuf.Release()
+		}
 		c.OutBuf = nil
 		c.Conn = nil
 		UnLinkClient(c)
@@ -247,21 +408,465 @@ func CloseClient(c *KiwiClient) {
 }
 
 func SelectDB(c *KiwiClient, dbId int) int {
-	if dbId < 0 || dbId >= kiwiS.DbNum {
+	if dbId < 0 || dbId >= c.srv.DbNum {
 		return C_ERR
 	}
-	c.Db = kiwiS.Dbs[dbId]
+	c.Db = c.srv.Dbs[dbId]
 	return C_OK
 }
 
 func DbDeleteSync(c *KiwiClient, key string) bool {
-	// TODO expire things
-	c.Db.Delete(key)
-	return true
+	ExpireIfNeeded(c.Db, key)
+	latency := c.srv.LatencyStartMonitor()
+	deleted := c.Db.Delete(key)
+	c.srv.LatencyAddSampleIfNeeded("delete", LatencyEndMonitor(latency))
+	return deleted
 }
 
 func DbDeleteAsync(c *KiwiClient, key string) bool {
 	// TODO
-	c.Db.Delete(key)
+	ExpireIfNeeded(c.Db, key)
+	latency := c.srv.LatencyStartMonitor()
+	deleted := c.Db.Delete(key)
+	c.srv.LatencyAddSampleIfNeeded("delete", LatencyEndMonitor(latency))
+	return deleted
+}
+
+/* ---------------------------- Client pause -------------------------------- */
+
+/* Pause clients up to the specified unixtime. While paused, commands of
+ * the affected clients are postponed: CLIENT_PAUSE_WRITE postpones only
+ * the write commands, CLIENT_PAUSE_ALL every command. Replicas are never
+ * paused.
+ *
+ * A stricter pause type or a later end time than the current ones always
+ * prevail, so that a CLIENT PAUSE can't shorten a pause already in place. */
+func (s *Server) PauseClients(end time.Time, ptype int32) {
+	s.pauseMutex.Lock()
+	defer s.pauseMutex.Unlock()
+	if ptype > atomic.LoadInt32(&s.ClientPauseType) {
+		atomic.StoreInt32(&s.ClientPauseType, ptype)
+	}
+	if end.After(s.ClientPauseEndTime) {
+		s.ClientPauseEndTime = end
+	}
+}
+
+/* Unpause clients and queue the postponed clients to be resumed by their
+ * own event loops. */
+func (s *Server) UnpauseClients() {
+	s.pauseMutex.Lock()
+	atomic.StoreInt32(&s.ClientPauseType, CLIENT_PAUSE_OFF)
+	paused := s.pausedClients
+	s.pausedClients = nil
+	s.pauseMutex.Unlock()
+	for _, c := range paused {
+		UnblockClient(c)
+	}
+}
+
+/* Return the current pause type, unpausing the clients first if the
+ * pause time has elapsed. */
+func (s *Server) GetClientPauseType() int32 {
+	if atomic.LoadInt32(&s.ClientPauseType) == CLIENT_PAUSE_OFF {
+		return CLIENT_PAUSE_OFF
+	}
+	s.pauseMutex.Lock()
+	expired := !time.Now().Before(s.ClientPauseEndTime)
+	s.pauseMutex.Unlock()
+	if expired {
+		s.UnpauseClients()
+	}
+	return atomic.LoadInt32(&s.ClientPauseType)
+}
+
+/* Return true if clients are paused. The server should not expire or
+ * evict keys while paused, since that would modify the dataset. */
+func (s *Server) ClientsArePaused() bool {
+	return s.GetClientPauseType() != CLIENT_PAUSE_OFF
+}
+
+/* Postpone the execution of the current command of the client until
+ * the pause is over. The argv is preserved so that UnblockClient() can
+ * resume it. */
+func BlockClientForPause(c *KiwiClient) {
+	c.AddFlags(CLIENT_BLOCKED)
+	c.Btype = BLOCKED_POSTPONE
+	c.srv.pauseMutex.Lock()
+	c.srv.pausedClients = append(c.srv.pausedClients, c)
+	c.srv.pauseMutex.Unlock()
+	// The pause may have been lifted while we were queueing the client.
+	if !c.srv.ClientsArePaused() {
+		c.srv.UnpauseClients()
+	}
+}
+
+/* Unblock a postponed client: it is flagged CLIENT_UNBLOCKED and woken
+ * up, so that its event loop executes the postponed command. */
+func UnblockClient(c *KiwiClient) {
+	if !c.WithFlags(CLIENT_BLOCKED) {
+		return
+	}
+	// Flagged unblocked first: if the client had neither flag for a
+	// moment, its loop could execute the next commands before this one.
+	c.AddFlags(CLIENT_UNBLOCKED)
+	c.DeleteFlags(CLIENT_BLOCKED)
+	if c.Conn != nil {
+		c.Conn.Wake()
+	}
+}
+
+/* Remove a client that is going away from the postponed clients. */
+func RemovePausedClient(c *KiwiClient) {
+	c.srv.pauseMutex.Lock()
+	defer c.srv.pauseMutex.Unlock()
+	for i, pc := range c.srv.pausedClients {
+		if pc == c {
+			c.srv.pausedClients = append(c.srv.pausedClients[:i], c.srv.pausedClients[i+1:]...)
+			return
+		}
+	}
+}
+
+func (s *Server) BlockedClientsCount() int {
+	s.pauseMutex.Lock()
+	defer s.pauseMutex.Unlock()
+	return len(s.pausedClients)
+}
+
+/* ---------------------------- CLIENT command ------------------------------ */
+
+/* Parse a CLIENT KILL / CLIENT LIST client id. */
+func getClientIdFromString(s string) (int64, bool) {
+	id, err := strconv.ParseInt(s, 10, 64)
+	if err != nil || id <= 0 {
+		return 0, false
+	}
+	return id, true
+}
+
+var ClientCommand CommandProcess = func(c *KiwiClient) {
+	sub := strings.ToLower(c.Argv[1])
+	if c.Argc == 2 && sub == "help" {
+		AddReplyHelp(c, []string{
+			"ID -- Return the ID of the current connection.",
+			"INFO -- Return information about the current client connection.",
+			"GETNAME -- Return the name of the current connection.",
+			"KILL <ip:port> -- Kill connection made from <ip:port>.",
+			"KILL <option> <value> [<option> <value> [...]] -- Kill connections. Options are:",
+			"     ADDR <ip:port> -- Kill connection made from <ip:port>",
+			"     LADDR <ip:port> -- Kill connection made to <ip:port>",
+			"     TYPE (normal|master|replica|pubsub) -- Kill connections by type.",
+			"     USER <username> -- Kill connections authenticated with such user.",
+			"     SKIPME (yes|no) -- Skip killing current connection (default: yes).",
+			"     ID <client-id> -- Kill connection by client id.",
+			"LIST [TYPE (normal|master|replica|pubsub)] -- Return information about client connections.",
+			"LIST ID <client-id> [<client-id> ...] -- Return information about specific client connections.",
+			"NO-EVICT (on|off) -- Protect the current client connection from client eviction.",
+			"PAUSE <timeout> [WRITE|ALL] -- Suspend all, or just write, clients for <timeout> milliseconds.",
+			"UNPAUSE -- Stop the current client pause, resuming traffic.",
+			"REPLY (on|off|skip) -- Control the replies sent to the current connection.",
+			"SETNAME <name> -- Assign the name <name> to the current connection.",
+		})
+	} else if c.Argc == 2 && sub == "id" {
+		// CLIENT ID
+		AddReplyInt(c, int(c.Id))
+	} else if c.Argc == 2 && sub == "info" {
+		// CLIENT INFO
+		AddReplyVerbatim(c, CatClientInfoString(c)+"\n", "txt")
+	} else if sub == "list" {
+		// CLIENT LIST
+		ctype := -1
+		if c.Argc == 4 && strings.ToLower(c.Argv[2]) == "type" {
+			ctype = c.GetClientTypeByName(strings.ToLower(c.Argv[3]))
+			if ctype == -1 {
+				AddReplyErrorFormat(c, "Unknown client type '%s'", c.Argv[3])
+				return
+			}
+		} else if c.Argc > 3 && strings.ToLower(c.Argv[2]) == "id" {
+			var o strings.Builder
+			for j := 3; j < c.Argc; j++ {
+				id, ok := getClientIdFromString(c.Argv[j])
+				if !ok {
+					AddReplyError(c, "Invalid client ID")
+					return
+				}
+				if cl := c.srv.LookupClientByID(id); cl != nil {
+					o.WriteString(CatClientInfoString(cl))
+					o.WriteByte('\n')
+				}
+			}
+			AddReplyVerbatim(c, o.String(), "txt")
+			return
+		} else if c.Argc != 2 {
+			AddReplyErrorObject(c, c.srv.Shared.SyntaxErr)
+			return
+		}
+		AddReplyVerbatim(c, c.srv.GetAllClientsInfoString(ctype), "txt")
+	} else if c.Argc == 3 && sub == "reply" {
+		// CLIENT REPLY ON|OFF|SKIP
+		switch strings.ToLower(c.Argv[2]) {
+		case "on":
+			c.DeleteFlags(CLIENT_REPLY_SKIP | CLIENT_REPLY_OFF)
+			AddReply(c, c.srv.Shared.Ok)
+		case "off":
+			c.AddFlags(CLIENT_REPLY_OFF)
+		case "skip":
+			if !c.WithFlags(CLIENT_REPLY_OFF) {
+				c.AddFlags(CLIENT_REPLY_SKIP_NEXT)
+			}
+		default:
+			AddReplyErrorObject(c, c.srv.Shared.SyntaxErr)
+		}
+	} else if c.Argc == 3 && sub == "no-evict" {
+		// CLIENT NO-EVICT ON|OFF
+		switch strings.ToLower(c.Argv[2]) {
+		case "on":
+			c.AddFlags(CLIENT_NO_EVICT)
+			AddReply(c, c.srv.Shared.Ok)
+		case "off":
+			c.DeleteFlags(CLIENT_NO_EVICT)
+			AddReply(c, c.srv.Shared.Ok)
+		default:
+			AddReplyErrorObject(c, c.srv.Shared.SyntaxErr)
+		}
+	} else if sub == "kill" && c.Argc >= 3 {
+		// CLIENT KILL <ip:port>
+		// CLIENT KILL <option> [value] ... <option> [value]
+		var addr, laddr, user string
+		var id int64
+		ctype := -1
+		skipme := true
+		if c.Argc == 3 {
+			// Old style syntax: CLIENT KILL <addr>
+			addr = c.Argv[2]
+			skipme = false // With the old form, you can kill yourself.
+		} else if c.Argc%2 == 0 {
+			// New style syntax: parse options.
+			for i := 2; i < c.Argc; i += 2 {
+				opt := strings.ToLower(c.Argv[i])
+				val := c.Argv[i+1]
+				switch opt {
+				case "id":
+					var ok bool
+					if id, ok = getClientIdFromString(val); !ok {
+						AddReplyError(c, "client-id should be greater than 0")
+						return
+					}
+				case "type":
+					ctype = c.GetClientTypeByName(strings.ToLower(val))
+					if ctype == -1 {
+						AddReplyErrorFormat(c, "Unknown client type '%s'", val)
+						return
+					}
+				case "addr":
+					addr = val
+				case "laddr":
+					laddr = val
+				case "user":
+					user = val
+				case "skipme":
+					switch strings.ToLower(val) {
+					case "yes":
+						skipme = true
+					case "no":
+						skipme = false
+					default:
+						AddReplyErrorObject(c, c.srv.Shared.SyntaxErr)
+						return
+					}
+				default:
+					AddReplyErrorObject(c, c.srv.Shared.SyntaxErr)
+					return
+				}
+			}
+		} else {
+			AddReplyErrorObject(c, c.srv.Shared.SyntaxErr)
+			return
+		}
+
+		// Iterate clients killing all the matching clients.
+		killed := 0
+		for _, cl := range c.srv.GetClients() {
+			if addr != "" && cl.GetPeerId(c.srv) != addr {
+				continue
+			}
+			if laddr != "" && cl.GetLocalAddr() != laddr {
+				continue
+			}
+			if ctype != -1 && cl.GetClientType() != ctype {
+				continue
+			}
+			if id != 0 && cl.Id != id {
+				continue
+			}
+			if user != "" && (cl.User == nil || cl.User.Name != user) {
+				continue
+			}
+			if c == cl && skipme {
+				continue
+			}
+			// Kill it.
+			if c == cl {
+				c.AddFlags(CLIENT_CLOSE_AFTER_REPLY)
+			} else {
+				FreeClientAsync(cl)
+			}
+			killed++
+		}
+
+		// If this is the old style syntax, reply with an error if no
+		// client was found, otherwise with OK.
+		if c.Argc == 3 {
+			if killed == 0 {
+				AddReplyError(c, "No such client")
+			} else {
+				AddReply(c, c.srv.Shared.Ok)
+			}
+		} else {
+			AddReplyInt(c, killed)
+		}
+	} else if c.Argc == 3 && sub == "setname" {
+		// CLIENT SETNAME
+		if ClientSetNameOrReply(c, c.Argv[2]) {
+			AddReply(c, c.srv.Shared.Ok)
+		}
+	} else if c.Argc == 2 && sub == "getname" {
+		// CLIENT GETNAME
+		if c.Name != "" {
+			AddReplyBulkStr(c, c.Name)
+		} else {
+			AddReplyNull(c)
+		}
+	} else if (c.Argc == 3 || c.Argc == 4) && sub == "pause" {
+		// CLIENT PAUSE TIMEOUT [WRITE|ALL]
+		timeout, err := strconv.ParseInt(c.Argv[2], 10, 64)
+		if err != nil || timeout < 0 {
+			AddReplyError(c, "timeout is not an integer or out of range")
+			return
+		}
+		ptype := int32(CLIENT_PAUSE_ALL)
+		if c.Argc == 4 {
+			switch strings.ToLower(c.Argv[3]) {
+			case "write":
+				ptype = CLIENT_PAUSE_WRITE
+			case "all":
+				ptype = CLIENT_PAUSE_ALL
+			default:
+				AddReplyError(c, "CLIENT PAUSE mode must be WRITE or ALL")
+				return
+			}
+		}
+		c.srv.PauseClients(time.Now().Add(time.Duration(timeout)*time.Millisecond), ptype)
+		AddReply(c, c.srv.Shared.Ok)
+	} else if c.Argc == 2 && sub == "unpause" {
+		// CLIENT UNPAUSE
+		c.srv.UnpauseClients()
+		AddReply(c, c.srv.Shared.Ok)
+	} else {
+		AddReplySubcommandSyntaxError(c)
+	}
+}
+
+/* Set the name of the client, replying with an error and returning false if
+ * the name is not valid. An empty name removes the name of the client. */
+func ClientSetNameOrReply(c *KiwiClient, name string) bool {
+	// Check if the charset is ok. We need to do this otherwise
+	// CLIENT LIST format will break. You should always be able to
+	// split by space to get the different fields.
+	for j := 0; j < len(name); j++ {
+		if name[j] < '!' || name[j] > '~' {
+			AddReplyError(c, "Client names cannot contain spaces, newlines or special characters.")
+			return false
+		}
+	}
+	c.Name = name
 	return true
 }
+
+/* HELLO [<protocol-version> [AUTH <username> <password>] [SETNAME <name>]]
+ *
+ * Switch the connection to the given protocol version, optionally
+ * authenticating and naming the client at the same time, and reply with
+ * the properties of the server as a map. */
+var HelloCommand CommandProcess = func(c *KiwiClient) {
+	ver := 0
+	nextArg := 1
+	if c.Argc >= 2 {
+		v, err := strconv.ParseInt(c.Argv[nextArg], 10, 64)
+		nextArg++
+		if err != nil {
+			AddReplyError(c, "Protocol version is not an integer or out of range")
+			return
+		}
+		if v < 2 || v > 3 {
+			AddReplyError(c, "-NOPROTO unsupported protocol version")
+			return
+		}
+		ver = int(v)
+	}
+
+	var username, password, clientName string
+	auth, setName := false, false
+	for j := nextArg; j < c.Argc; j++ {
+		moreargs := c.Argc - 1 - j
+		opt := strings.ToLower(c.Argv[j])
+		if opt == "auth" && moreargs >= 2 {
+			// Don't keep the password around: the arguments end in the
+			// slow log.
+			username, password = c.Argv[j+1], c.Argv[j+2]
+			c.Argv[j+1], c.Argv[j+2] = "(redacted)", "(redacted)"
+			auth = true
+			j += 2
+		} else if opt == "setname" && moreargs >= 1 {
+			clientName = c.Argv[j+1]
+			setName = true
+			j++
+		} else {
+			AddReplyErrorFormat(c, "Syntax error in HELLO option '%s'", c.Argv[j])
+			return
+		}
+	}
+
+	if auth && ACLAuthenticateUser(c, username, password) != C_OK {
+		AddReplyError(c, "-WRONGPASS invalid username-password pair or user is disabled.")
+		return
+	}
+
+	// At this point we need to be authenticated to continue.
+	if c.Authenticated == 0 {
+		AddReplyError(c, "-NOAUTH HELLO must be called with the client already authenticated, "+
+			"otherwise the HELLO <proto> AUTH <user> <pass> option can be used to authenticate "+
+			"the client and select the RESP protocol version at the same time")
+		return
+	}
+
+	// Now that we're authenticated, set the client name.
+	if setName && !ClientSetNameOrReply(c, clientName) {
+		return
+	}
+
+	// Let's switch to the specified RESP mode.
+	if ver != 0 {
+		c.Resp = ver
+	}
+	mode := "standalone"
+	if c.srv.ClusterEnabled {
+		mode = "cluster"
+	}
+	AddReplyMapLen(c, 7)
+	AddReplyBulkStr(c, "server")
+	AddReplyBulkStr(c, "kiwi")
+	AddReplyBulkStr(c, "version")
+	AddReplyBulkStr(c, KIWI_VERSION)
+	AddReplyBulkStr(c, "proto")
+	AddReplyInt(c, c.Resp)
+	AddReplyBulkStr(c, "id")
+	AddReplyInt(c, int(c.Id))
+	AddReplyBulkStr(c, "mode")
+	AddReplyBulkStr(c, mode)
+	AddReplyBulkStr(c, "role")
+	AddReplyBulkStr(c, "master")
+	AddReplyBulkStr(c, "modules")
+	AddReplyMultiBulkLen(c, 0)
+}
@@ -0,0 +1,1196 @@
+package server
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+type ClusterNode struct {
+	Name         string
+	Flags        int
+	CTime        time.Time // Node object creation time.
+	ConfigEpoch  uint64    // Last configEpoch observed for this node
+	Slots        [CLUSTER_SLOTS / 8]byte
+	NumSlots     int
+	Ip           string
+	Port         int
+	BusPort      int
+	PingSent     time.Time // Unix time we sent latest ping
+	PongReceived time.Time // Unix time we received the pong
+	FailTime     time.Time // Unix time when FAIL flag was set
+	Link         *ClusterLink
+	FailReports  map[string]time.Time // Reporter node name -> time of the report
+}
+
+type ClusterState struct {
+	Myself             *ClusterNode
+	CurrentEpoch       uint64
+	State              int
+	Size               int // Num of master nodes with at least one slot
+	Nodes              map[string]*ClusterNode
+	Blacklist          map[string]time.Time // Nodes we don't re-add for a few seconds.
+	Slots              [CLUSTER_SLOTS]*ClusterNode
+	MigratingSlotsTo   [CLUSTER_SLOTS]*ClusterNode
+	ImportingSlotsFrom [CLUSTER_SLOTS]*ClusterNode
+	StatsMessagesSent  [CLUSTERMSG_TYPE_COUNT]int64
+	StatsMessagesRecv  [CLUSTERMSG_TYPE_COUNT]int64
+	ConfigDirty        bool
+	listener           net.Listener
+	mutex              sync.RWMutex
+}
+
+/* -------------------------- Initialization -------------------------- */
+
+func (s *Server) ClusterInit() {
+	s.Cluster = &ClusterState{
+		State:     CLUSTER_FAIL,
+		Nodes:     make(map[string]*ClusterNode),
+		Blacklist: make(map[string]time.Time),
+	}
+	if s.ClusterLoadConfig(s.ClusterConfigFile) == C_ERR {
+		myself := CreateClusterNode("", CLUSTER_NODE_MYSELF|CLUSTER_NODE_MASTER)
+		s.Cluster.Myself = myself
+		s.ClusterAddNode(myself)
+		s.ServerLogNoticeF("No cluster configuration found, I'm %s\n", myself.Name)
+		s.ClusterSaveConfig()
+	}
+	myself := s.Cluster.Myself
+	myself.Port = s.ClusterPort()
+	myself.BusPort = s.ClusterPort() + CLUSTER_PORT_INCR
+	if s.ClusterAnnounceIp != "" {
+		myself.Ip = s.ClusterAnnounceIp
+	}
+	s.ClusterUpdateState()
+}
+
+/* The port announced to the other nodes and to the clients: when the cluster
+ * bus uses TLS, the clients are expected to use TLS too. */
+func (s *Server) ClusterPort() int {
+	if s.TlsCluster {
+		return s.TlsPort
+	}
+	return s.Port
+}
+
+func (s *Server) ClusterStart() error {
+	if !s.ClusterEnabled {
+		return nil
+	}
+	addr := fmt.Sprintf("%s:%d", s.BindAddrs[0], s.ClusterPort()+CLUSTER_PORT_INCR)
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		s.ServerLogWarnF("Could not bind cluster bus on %s: %v\n", addr, err)
+		return err
+	}
+	ln = s.TlsClusterListener(ln)
+	s.Cluster.listener = ln
+	go s.ClusterAcceptHandler(ln)
+	return nil
+}
+
+/* Stop accepting cluster bus connections and close the links to the other
+ * nodes, when the server shuts down. */
+func (s *Server) closeClusterBus() {
+	if s.Cluster == nil || s.Cluster.listener == nil {
+		return
+	}
+	s.Cluster.listener.Close()
+	var links []*ClusterLink
+	s.Cluster.mutex.Lock()
+	for _, n := range s.Cluster.Nodes {
+		if n.Link != nil {
+			links = append(links, n.Link)
+		}
+	}
+	s.Cluster.mutex.Unlock()
+	for _, link := range links {
+		s.FreeClusterLink(link)
+	}
+}
+
+func ClusterGetRandomName() string {
+	return GetRandomHexChars(CLUSTER_NAMELEN)
+}
+
+func CreateClusterNode(name string, flags int) *ClusterNode {
+	if name == "" {
+		name = ClusterGetRandomName()
+	}
+	return &ClusterNode{
+		Name:        name,
+		Flags:       flags,
+		CTime:       time.Now(),
+		FailReports: make(map[string]time.Time),
+	}
+}
+
+func (n *ClusterNode) WithFlags(flags int) bool {
+	return n.Flags&flags != 0
+}
+
+func (n *ClusterNode) AddFlags(flags int) {
+	n.Flags |= flags
+}
+
+func (n *ClusterNode) DeleteFlags(flags int) {
+	n.Flags &= ^flags
+}
+
+func (n *ClusterNode) HasSlot(slot int) bool {
+	return bitmapTestBit(n.Slots[:], slot)
+}
+
+func (n *ClusterNode) Addr() string {
+	return fmt.Sprintf("%s:%d", n.Ip, n.Port)
+}
+
+func (n *ClusterNode) BusAddr() string {
+	return fmt.Sprintf("%s:%d", n.Ip, n.BusPort)
+}
+
+func bitmapTestBit(bitmap []byte, pos int) bool {
+	return bitmap[pos/8]&(1<<uint(pos&7)) != 0
+}
+
+func bitmapSetBit(bitmap []byte, pos int) {
+	bitmap[pos/8] |= 1 << uint(pos&7)
+}
+
+func bitmapClearBit(bitmap []byte, pos int) {
+	bitmap[pos/8] &= ^(1 << uint(pos&7))
+}
+
+/* ---------------------- Node and slot bookkeeping ---------------------- */
+
+func (s *Server) ClusterLookupNode(name string) *ClusterNode {
+	return s.Cluster.Nodes[name]
+}
+
+func (s *Server) ClusterAddNode(node *ClusterNode) {
+	s.Cluster.Nodes[node.Name] = node
+}
+
+func (s *Server) ClusterDelNode(delnode *ClusterNode) {
+	cs := s.Cluster
+	for j := 0; j < CLUSTER_SLOTS; j++ {
+		if cs.ImportingSlotsFrom[j] == delnode {
+			cs.ImportingSlotsFrom[j] = nil
+		}
+		if cs.MigratingSlotsTo[j] == delnode {
+			cs.MigratingSlotsTo[j] = nil
+		}
+		if cs.Slots[j] == delnode {
+			s.ClusterDelSlot(j)
+		}
+	}
+	for _, node := range cs.Nodes {
+		delete(node.FailReports, delnode.Name)
+	}
+	if delnode.Link != nil {
+		delnode.Link.close()
+		delnode.Link = nil
+	}
+	delete(cs.Nodes, delnode.Name)
+}
+
+func (s *Server) ClusterRenameNode(node *ClusterNode, newName string) {
+	s.ServerLogDebugF("Renaming node %s into %s\n", node.Name, newName)
+	delete(s.Cluster.Nodes, node.Name)
+	node.Name = newName
+	s.ClusterAddNode(node)
+}
+
+func (s *Server) ClusterAddSlot(n *ClusterNode, slot int) int {
+	if s.Cluster.Slots[slot] != nil {
+		return C_ERR
+	}
+	bitmapSetBit(n.Slots[:], slot)
+	n.NumSlots++
+	s.Cluster.Slots[slot] = n
+	return C_OK
+}
+
+func (s *Server) ClusterDelSlot(slot int) int {
+	n := s.Cluster.Slots[slot]
+	if n == nil {
+		return C_ERR
+	}
+	bitmapClearBit(n.Slots[:], slot)
+	n.NumSlots--
+	s.Cluster.Slots[slot] = nil
+	return C_OK
+}
+
+func (s *Server) ClusterCountNonFailingMasters() int {
+	count := 0
+	for _, node := range s.Cluster.Nodes {
+		if node.WithFlags(CLUSTER_NODE_MASTER) && node.NumSlots > 0 && !node.WithFlags(CLUSTER_NODE_FAIL|CLUSTER_NODE_PFAIL) {
+			count++
+		}
+	}
+	return count
+}
+
+/* Return the greatest configEpoch found in the cluster, or the current
+ * epoch if greater than any node configEpoch. */
+func (s *Server) ClusterGetMaxEpoch() uint64 {
+	max := s.Cluster.CurrentEpoch
+	for _, node := range s.Cluster.Nodes {
+		if node.ConfigEpoch > max {
+			max = node.ConfigEpoch
+		}
+	}
+	return max
+}
+
+/* Used when a slot is moved to this node by the administrator with SETSLOT
+ * NODE: we need our claim to win against the previous owner, so we take a
+ * new configEpoch without asking the other masters. */
+func (s *Server) ClusterBumpConfigEpochWithoutConsensus() bool {
+	cs := s.Cluster
+	maxEpoch := s.ClusterGetMaxEpoch()
+	if cs.Myself.ConfigEpoch == 0 || cs.Myself.ConfigEpoch != maxEpoch {
+		cs.CurrentEpoch++
+		cs.Myself.ConfigEpoch = cs.CurrentEpoch
+		cs.ConfigDirty = true
+		s.ServerLogNoticeF("New configEpoch set to %d\n", cs.Myself.ConfigEpoch)
+		return true
+	}
+	return false
+}
+
+/* When two masters share the same configEpoch the one with the
+ * lexicographically smaller node name takes a new epoch, so that every
+ * node eventually ends with a unique configEpoch. */
+func (s *Server) ClusterHandleConfigEpochCollision(sender *ClusterNode) {
+	cs := s.Cluster
+	myself := cs.Myself
+	if sender.ConfigEpoch != myself.ConfigEpoch ||
+		!sender.WithFlags(CLUSTER_NODE_MASTER) || !myself.WithFlags(CLUSTER_NODE_MASTER) {
+		return
+	}
+	if sender.Name <= myself.Name {
+		return
+	}
+	cs.CurrentEpoch++
+	myself.ConfigEpoch = cs.CurrentEpoch
+	cs.ConfigDirty = true
+	s.ServerLogNoticeF("WARNING: configEpoch collision with node %s. configEpoch set to %d\n",
+		sender.Name, myself.ConfigEpoch)
+}
+
+/* Update our view of the slots served by sender, according to the
+ * configEpoch the sender advertises for them. Slots we are importing are
+ * left alone: they are under the control of the administrator. */
+func (s *Server) ClusterUpdateSlotsConfigWith(sender *ClusterNode, senderConfigEpoch uint64, slots []byte) {
+	cs := s.Cluster
+	if sender == cs.Myself {
+		return
+	}
+	for j := 0; j < CLUSTER_SLOTS; j++ {
+		if !bitmapTestBit(slots, j) {
+			continue
+		}
+		owner := cs.Slots[j]
+		if owner == sender || cs.ImportingSlotsFrom[j] != nil {
+			continue
+		}
+		if owner == nil || owner.ConfigEpoch < senderConfigEpoch {
+			if owner == cs.Myself && sender != cs.Myself && s.CountKeysInSlot(j) > 0 {
+				// We lost a slot we still have keys for: they are stale now.
+				s.DelKeysInSlot(j)
+			}
+			if cs.MigratingSlotsTo[j] == sender {
+				cs.MigratingSlotsTo[j] = nil
+			}
+			s.ClusterDelSlot(j)
+			s.ClusterAddSlot(sender, j)
+			cs.ConfigDirty = true
+		} else if owner.ConfigEpoch > senderConfigEpoch && sender.Link != nil {
+			// The sender has a stale configuration, tell it who owns the slot.
+			s.ClusterSendUpdate(sender.Link, owner)
+		}
+	}
+}
+
+func (s *Server) ClusterUpdateState() {
+	cs := s.Cluster
+	newState := CLUSTER_OK
+	if s.ClusterRequireFullCoverage {
+		for j := 0; j < CLUSTER_SLOTS; j++ {
+			if cs.Slots[j] == nil || cs.Slots[j].WithFlags(CLUSTER_NODE_FAIL) {
+				newState = CLUSTER_FAIL
+				break
+			}
+		}
+	}
+	cs.Size = 0
+	reachable := 0
+	for _, node := range cs.Nodes {
+		if node.WithFlags(CLUSTER_NODE_MASTER) && node.NumSlots > 0 {
+			cs.Size++
+			if !node.WithFlags(CLUSTER_NODE_FAIL | CLUSTER_NODE_PFAIL) {
+				reachable++
+			}
+		}
+	}
+	// A minority partition stops accepting queries.
+	if reachable < cs.Size/2+1 {
+		newState = CLUSTER_FAIL
+	}
+	if newState != cs.State {
+		if newState == CLUSTER_OK {
+			s.ServerLogNoticeF("Cluster state changed: ok\n")
+		} else {
+			s.ServerLogNoticeF("Cluster state changed: fail\n")
+		}
+		cs.State = newState
+	}
+}
+
+/* -------------------------- Key space helpers -------------------------- */
+
+/* We have 16384 hash slots. The hash slot of a given key is obtained
+ * as the least significant 14 bits of the crc16 of the key.
+ *
+ * However if the key contains the {...} pattern, only the part between
+ * { and } is hashed. This may be useful in the future to force certain
+ * keys to be in the same node (assuming no resharding is in progress). */
+func KeyHashSlot(key string) int {
+	s := strings.IndexByte(key, '{')
+	if s == -1 {
+		return int(Crc16(key) & 0x3FFF)
+	}
+	e := strings.IndexByte(key[s+1:], '}')
+	// No '}' or nothing between {} ? Hash the whole key.
+	if e <= 0 {
+		return int(Crc16(key) & 0x3FFF)
+	}
+	return int(Crc16(key[s+1:s+1+e]) & 0x3FFF)
+}
+
+func (s *Server) CountKeysInSlot(slot int) int {
+	return s.Dbs[0].CountKeysInSlot(slot)
+}
+
+func (s *Server) GetKeysInSlot(slot int, count int) []string {
+	return s.Dbs[0].GetKeysInSlot(slot, count)
+}
+
+func (s *Server) DelKeysInSlot(slot int) int {
+	db := s.Dbs[0]
+	keys := db.GetKeysInSlot(slot, -1)
+	for _, key := range keys {
+		db.Delete(key)
+	}
+	return len(keys)
+}
+
+/* --------------------------- Query routing --------------------------- */
+
+/* Return the node that is able to serve the command, or nil together with
+ * an error code. For ASK and MOVED the returned node is the one to
+ * redirect the client to, and slot is the hash slot of the keys.
+ *
+ * EXEC is served like the commands of the transaction: all their keys
+ * must belong to the same slot. */
+func GetNodeByQuery(c *KiwiClient, cmd *Command, argv []string, argc int) (n *ClusterNode, slot int, errCode int) {
+	cs := c.srv.Cluster
+	var firstKey string
+	multipleKeys := false
+	migrating := false
+	importing := false
+	missingKeys := 0
+
+	cmds := []MultiCmd{{Argv: argv, Argc: argc, Cmd: cmd}}
+	cmdFlags := cmd.Flags
+	if cmd.Name == "exec" {
+		cmds = c.Mstate.Commands
+		cmdFlags = c.Mstate.CmdFlags
+	}
+	for _, mc := range cmds {
+		keys := GetKeysFromCommand(mc.Cmd, mc.Argv, mc.Argc)
+		for _, pos := range keys {
+			key := mc.Argv[pos]
+			if firstKey == "" && n == nil {
+				firstKey = key
+				slot = KeyHashSlot(key)
+				n = cs.Slots[slot]
+				if n == nil {
+					return nil, slot, CLUSTER_REDIR_DOWN_UNBOUND
+				}
+				if n == cs.Myself && cs.MigratingSlotsTo[slot] != nil {
+					migrating = true
+				} else if cs.ImportingSlotsFrom[slot] != nil {
+					importing = true
+				}
+			} else if key != firstKey {
+				if KeyHashSlot(key) != slot {
+					return nil, slot, CLUSTER_REDIR_CROSS_SLOT
+				}
+				multipleKeys = true
+			}
+			if (migrating || importing) && !c.Db.Exist(key) {
+				missingKeys++
+			}
+		}
+	}
+
+	// No key at all in command? then we can serve the request without redirections.
+	if n == nil {
+		return cs.Myself, 0, CLUSTER_REDIR_NONE
+	}
+	if cs.State != CLUSTER_OK {
+		return nil, slot, CLUSTER_REDIR_DOWN_STATE
+	}
+	// If we are migrating the slot and some key is missing, the client
+	// should ask the target node.
+	if migrating && missingKeys > 0 {
+		return cs.MigratingSlotsTo[slot], slot, CLUSTER_REDIR_ASK
+	}
+	// If we are importing the slot and the client is flagged as ASKING we
+	// serve it, unless a multi key request can't be served atomically.
+	if importing && (c.WithFlags(CLIENT_ASKING) || cmdFlags&CMD_ASKING != 0) {
+		if multipleKeys && missingKeys > 0 {
+			return nil, slot, CLUSTER_REDIR_UNSTABLE
+		}
+		return cs.Myself, slot, CLUSTER_REDIR_NONE
+	}
+	// Read only queries from a READONLY client may be served if the slot
+	// is served by our master.
+	if c.WithFlags(CLIENT_READONLY) && cmdFlags&CMD_WRITE == 0 &&
+		cs.Myself.WithFlags(CLUSTER_NODE_SLAVE) && n == cs.Myself {
+		return cs.Myself, slot, CLUSTER_REDIR_NONE
+	}
+	if n != cs.Myself {
+		return n, slot, CLUSTER_REDIR_MOVED
+	}
+	return n, slot, CLUSTER_REDIR_NONE
+}
+
+/* Send the client the right redirection code, according to errCode. */
+func ClusterRedirectClient(c *KiwiClient, n *ClusterNode, slot int, errCode int) {
+	AddReplyError(c, clusterRedirectError(n, slot, errCode))
+}
+
+func clusterRedirectError(n *ClusterNode, slot int, errCode int) string {
+	switch errCode {
+	case CLUSTER_REDIR_CROSS_SLOT:
+		return "-CROSSSLOT Keys in request don't hash to the same slot"
+	case CLUSTER_REDIR_UNSTABLE:
+		return "-TRYAGAIN Multiple keys request during rehashing of slot"
+	case CLUSTER_REDIR_DOWN_STATE:
+		return "-CLUSTERDOWN The cluster is down"
+	case CLUSTER_REDIR_DOWN_UNBOUND:
+		return "-CLUSTERDOWN Hash slot not served"
+	case CLUSTER_REDIR_MOVED:
+		return fmt.Sprintf("-MOVED %d %s", slot, n.Addr())
+	case CLUSTER_REDIR_ASK:
+		return fmt.Sprintf("-ASK %d %s", slot, n.Addr())
+	default:
+		panic("getNodeByQuery() unknown error.")
+	}
+}
+
+/* Called by ProcessCommand before executing the command: returns C_ERR if
+ * the client was redirected and the command must not be executed. A
+ * redirected EXEC discards the transaction. */
+func ClusterProcessCommand(c *KiwiClient) int {
+	if c.WithFlags(CLIENT_MASTER) {
+		return C_OK
+	}
+	if c.Cmd.FirstKey == 0 && c.Cmd.GetKeyProcess == nil && c.Cmd.Name != "exec" {
+		return C_OK
+	}
+	c.srv.Cluster.mutex.RLock()
+	defer c.srv.Cluster.mutex.RUnlock()
+	n, slot, errCode := GetNodeByQuery(c, c.Cmd, c.Argv, c.Argc)
+	if errCode != CLUSTER_REDIR_NONE {
+		if c.Cmd.Name == "exec" && c.WithFlags(CLIENT_MULTI) {
+			ExecCommandAbort(c, clusterRedirectError(n, slot, errCode))
+		} else {
+			ClusterRedirectClient(c, n, slot, errCode)
+		}
+		return C_ERR
+	}
+	return C_OK
+}
+
+/* ------------------------ Nodes description ------------------------ */
+
+func RepresentClusterNodeFlags(node *ClusterNode) string {
+	flags := []string{}
+	if node.WithFlags(CLUSTER_NODE_MYSELF) {
+		flags = append(flags, "myself")
+	}
+	if node.WithFlags(CLUSTER_NODE_MASTER) {
+		flags = append(flags, "master")
+	}
+	if node.WithFlags(CLUSTER_NODE_SLAVE) {
+		flags = append(flags, "slave")
+	}
+	if node.WithFlags(CLUSTER_NODE_PFAIL) {
+		flags = append(flags, "fail?")
+	}
+	if node.WithFlags(CLUSTER_NODE_FAIL) {
+		flags = append(flags, "fail")
+	}
+	if node.WithFlags(CLUSTER_NODE_HANDSHAKE) {
+		flags = append(flags, "handshake")
+	}
+	if node.WithFlags(CLUSTER_NODE_NOADDR) {
+		flags = append(flags, "noaddr")
+	}
+	if len(flags) == 0 {
+		return "noflags"
+	}
+	return strings.Join(flags, ",")
+}
+
+func unixMilli(t time.Time) int64 {
+	if t.IsZero() {
+		return 0
+	}
+	return t.UnixNano() / int64(time.Millisecond)
+}
+
+/* Generate a csv-alike representation of the specified cluster node.
+ * This is the format used both by CLUSTER NODES and nodes.conf. */
+func (s *Server) ClusterGenNodeDescription(node *ClusterNode) string {
+	cs := s.Cluster
+	buf := Buffer{}
+	buf.WriteString(fmt.Sprintf("%s %s:%d@%d %s - %d %d %d ",
+		node.Name, node.Ip, node.Port, node.BusPort, RepresentClusterNodeFlags(node),
+		unixMilli(node.PingSent), unixMilli(node.PongReceived), node.ConfigEpoch))
+	if node.Link != nil || node.WithFlags(CLUSTER_NODE_MYSELF) {
+		buf.WriteString("connected")
+	} else {
+		buf.WriteString("disconnected")
+	}
+	start := -1
+	for j := 0; j <= CLUSTER_SLOTS; j++ {
+		bit := j < CLUSTER_SLOTS && node.HasSlot(j)
+		if bit && start == -1 {
+			start = j
+		}
+		if start != -1 && !bit {
+			if start == j-1 {
+				buf.WriteString(fmt.Sprintf(" %d", start))
+			} else {
+				buf.WriteString(fmt.Sprintf(" %d-%d", start, j-1))
+			}
+			start = -1
+		}
+	}
+	// Just for MYSELF node we also dump info about slots that we are
+	// migrating to other instances or importing from other instances.
+	if node.WithFlags(CLUSTER_NODE_MYSELF) {
+		for j := 0; j < CLUSTER_SLOTS; j++ {
+			if cs.MigratingSlotsTo[j] != nil {
+				buf.WriteString(fmt.Sprintf(" [%d->-%s]", j, cs.MigratingSlotsTo[j].Name))
+			} else if cs.ImportingSlotsFrom[j] != nil {
+				buf.WriteString(fmt.Sprintf(" [%d-<-%s]", j, cs.ImportingSlotsFrom[j].Name))
+			}
+		}
+	}
+	return buf.String()
+}
+
+func (s *Server) ClusterGenNodesDescription(filter int) string {
+	cs := s.Cluster
+	names := make([]string, 0, len(cs.Nodes))
+	for name := range cs.Nodes {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	buf := Buffer{}
+	for _, name := range names {
+		node := cs.Nodes[name]
+		if node.WithFlags(filter) {
+			continue
+		}
+		buf.WriteString(s.ClusterGenNodeDescription(node))
+		buf.WriteByte('\n')
+	}
+	return buf.String()
+}
+
+/* Return the [start, end] ranges of the slots served by node. */
+func ClusterNodeSlotRanges(node *ClusterNode) [][2]int {
+	ranges := [][2]int{}
+	start := -1
+	for j := 0; j <= CLUSTER_SLOTS; j++ {
+		bit := j < CLUSTER_SLOTS && node.HasSlot(j)
+		if bit && start == -1 {
+			start = j
+		}
+		if start != -1 && !bit {
+			ranges = append(ranges, [2]int{start, j - 1})
+			start = -1
+		}
+	}
+	return ranges
+}
+
+/* ------------------------- Config persistence ------------------------- */
+
+func (s *Server) ClusterSaveConfig() int {
+	cs := s.Cluster
+	content := s.ClusterGenNodesDescription(CLUSTER_NODE_HANDSHAKE)
+	content += fmt.Sprintf("vars currentEpoch %d lastVoteEpoch 0\n", cs.CurrentEpoch)
+	tmpFile := s.ClusterConfigFile + ".tmp"
+	f, err := os.OpenFile(tmpFile, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		s.ServerLogWarnF("Could not save cluster config %s: %v\n", s.ClusterConfigFile, err)
+		return C_ERR
+	}
+	_, err = f.WriteString(content)
+	if err == nil {
+		latency := s.LatencyStartMonitor()
+		err = f.Sync()
+		s.LatencyAddSampleIfNeeded("cluster-config-fsync", LatencyEndMonitor(latency))
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		s.ServerLogWarnF("Could not save cluster config %s: %v\n", s.ClusterConfigFile, err)
+		return C_ERR
+	}
+	if err := os.Rename(tmpFile, s.ClusterConfigFile); err != nil {
+		s.ServerLogWarnF("Could not save cluster config %s: %v\n", s.ClusterConfigFile, err)
+		return C_ERR
+	}
+	cs.ConfigDirty = false
+	return C_OK
+}
+
+/* Load the cluster config from 'filename'. Returns C_ERR if the file does
+ * not exist or is empty, so that the caller creates a new identity. */
+func (s *Server) ClusterLoadConfig(filename string) int {
+	f, err := os.Open(filename)
+	if err != nil {
+		return C_ERR
+	}
+	defer f.Close()
+	cs := s.Cluster
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 0, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		argv := strings.Fields(scanner.Text())
+		if len(argv) == 0 {
+			continue
+		}
+		if argv[0] == "vars" {
+			for j := 1; j+1 < len(argv); j += 2 {
+				if argv[j] == "currentEpoch" {
+					cs.CurrentEpoch, _ = strconv.ParseUint(argv[j+1], 10, 64)
+				}
+			}
+			continue
+		}
+		if len(argv) < 8 {
+			s.ServerLogWarnF("Unrecoverable error: corrupted cluster config file %s\n", filename)
+			os.Exit(1)
+		}
+		n := s.ClusterLookupNode(argv[0])
+		if n == nil {
+			n = CreateClusterNode(argv[0], 0)
+			s.ClusterAddNode(n)
+		}
+		ip, port, busPort, ok := parseClusterNodeAddr(argv[1])
+		if !ok {
+			s.ServerLogWarnF("Unrecoverable error: corrupted cluster config file %s\n", filename)
+			os.Exit(1)
+		}
+		n.Ip, n.Port, n.BusPort = ip, port, busPort
+		for _, flag := range strings.Split(argv[2], ",") {
+			switch flag {
+			case "myself":
+				cs.Myself = n
+				n.AddFlags(CLUSTER_NODE_MYSELF)
+			case "master":
+				n.AddFlags(CLUSTER_NODE_MASTER)
+			case "slave":
+				n.AddFlags(CLUSTER_NODE_SLAVE)
+			case "fail?":
+				n.AddFlags(CLUSTER_NODE_PFAIL)
+			case "fail":
+				n.AddFlags(CLUSTER_NODE_FAIL)
+				n.FailTime = time.Now()
+			case "noaddr":
+				n.AddFlags(CLUSTER_NODE_NOADDR)
+			}
+		}
+		n.ConfigEpoch, _ = strconv.ParseUint(argv[6], 10, 64)
+		for _, arg := range argv[8:] {
+			if arg[0] == '[' {
+				// Slot in migrating/importing state.
+				var slot int
+				var dir, name string
+				if p := strings.Index(arg, "->-"); p != -1 {
+					slot, _ = strconv.Atoi(arg[1:p])
+					dir, name = ">", arg[p+3:len(arg)-1]
+				} else if p := strings.Index(arg, "-<-"); p != -1 {
+					slot, _ = strconv.Atoi(arg[1:p])
+					dir, name = "<", arg[p+3:len(arg)-1]
+				} else {
+					continue
+				}
+				target := s.ClusterLookupNode(name)
+				if target == nil {
+					target = CreateClusterNode(name, 0)
+					s.ClusterAddNode(target)
+				}
+				if dir == ">" {
+					cs.MigratingSlotsTo[slot] = target
+				} else {
+					cs.ImportingSlotsFrom[slot] = target
+				}
+				continue
+			}
+			start, stop := 0, 0
+			if p := strings.IndexByte(arg, '-'); p != -1 {
+				start, _ = strconv.Atoi(arg[:p])
+				stop, _ = strconv.Atoi(arg[p+1:])
+			} else {
+				start, _ = strconv.Atoi(arg)
+				stop = start
+			}
+			for ; start <= stop && start < CLUSTER_SLOTS; start++ {
+				s.ClusterAddSlot(n, start)
+			}
+		}
+	}
+	if cs.Myself == nil {
+		return C_ERR
+	}
+	s.ServerLogNoticeF("Node configuration loaded, I'm %s\n", cs.Myself.Name)
+	return C_OK
+}
+
+/* Parse ip:port@cport, the bus port is optional. */
+func parseClusterNodeAddr(addr string) (ip string, port int, busPort int, ok bool) {
+	busPort = -1
+	if p := strings.IndexByte(addr, '@'); p != -1 {
+		var err error
+		if busPort, err = strconv.Atoi(addr[p+1:]); err != nil {
+			return
+		}
+		addr = addr[:p]
+	}
+	p := strings.LastIndexByte(addr, ':')
+	if p == -1 {
+		return
+	}
+	var err error
+	if port, err = strconv.Atoi(addr[p+1:]); err != nil {
+		return
+	}
+	ip = addr[:p]
+	if busPort == -1 {
+		busPort = port + CLUSTER_PORT_INCR
+	}
+	return ip, port, busPort, true
+}
+
+/* ------------------------------ Commands ------------------------------ */
+
+func getSlotOrReply(c *KiwiClient, arg string) int {
+	slot, err := strconv.Atoi(arg)
+	if err != nil || slot < 0 || slot >= CLUSTER_SLOTS {
+		AddReplyError(c, "Invalid or out of range slot")
+		return -1
+	}
+	return slot
+}
+
+func addReplyClusterNode(c *KiwiClient, node *ClusterNode) {
+	AddReplyMultiBulkLen(c, 3)
+	AddReplyBulkStr(c, node.Ip)
+	AddReplyInt(c, node.Port)
+	AddReplyBulkStr(c, node.Name)
+}
+
+func clusterReplySlots(c *KiwiClient) {
+	cs := c.srv.Cluster
+	type slotRange struct {
+		start, end int
+		node       *ClusterNode
+	}
+	ranges := []slotRange{}
+	start := -1
+	for j := 0; j <= CLUSTER_SLOTS; j++ {
+		if start != -1 && (j == CLUSTER_SLOTS || cs.Slots[j] != cs.Slots[start]) {
+			ranges = append(ranges, slotRange{start, j - 1, cs.Slots[start]})
+			start = -1
+		}
+		if j < CLUSTER_SLOTS && start == -1 && cs.Slots[j] != nil {
+			start = j
+		}
+	}
+	AddReplyMultiBulkLen(c, len(ranges))
+	for _, r := range ranges {
+		AddReplyMultiBulkLen(c, 3)
+		AddReplyInt(c, r.start)
+		AddReplyInt(c, r.end)
+		addReplyClusterNode(c, r.node)
+	}
+}
+
+func clusterReplyShards(c *KiwiClient) {
+	cs := c.srv.Cluster
+	masters := []*ClusterNode{}
+	for _, node := range cs.Nodes {
+		if node.WithFlags(CLUSTER_NODE_MASTER) && !node.WithFlags(CLUSTER_NODE_HANDSHAKE) {
+			masters = append(masters, node)
+		}
+	}
+	sort.Slice(masters, func(i, j int) bool { return masters[i].Name < masters[j].Name })
+	AddReplyMultiBulkLen(c, len(masters))
+	for _, node := range masters {
+		AddReplyMapLen(c, 2)
+		AddReplyBulkStr(c, "slots")
+		ranges := ClusterNodeSlotRanges(node)
+		AddReplyMultiBulkLen(c, len(ranges)*2)
+		for _, r := range ranges {
+			AddReplyInt(c, r[0])
+			AddReplyInt(c, r[1])
+		}
+		AddReplyBulkStr(c, "nodes")
+		AddReplyMultiBulkLen(c, 1)
+		health := "online"
+		if node.WithFlags(CLUSTER_NODE_FAIL | CLUSTER_NODE_PFAIL) {
+			health = "fail"
+		}
+		AddReplyMapLen(c, 7)
+		AddReplyBulkStr(c, "id")
+		AddReplyBulkStr(c, node.Name)
+		AddReplyBulkStr(c, "port")
+		AddReplyInt(c, node.Port)
+		AddReplyBulkStr(c, "ip")
+		AddReplyBulkStr(c, node.Ip)
+		AddReplyBulkStr(c, "endpoint")
+		AddReplyBulkStr(c, node.Ip)
+		AddReplyBulkStr(c, "role")
+		AddReplyBulkStr(c, "master")
+		AddReplyBulkStr(c, "replication-offset")
+		AddReplyInt(c, 0)
+		AddReplyBulkStr(c, "health")
+		AddReplyBulkStr(c, health)
+	}
+}
+
+func (s *Server) clusterGenInfoString() string {
+	cs := s.Cluster
+	slotsAssigned, slotsOk, slotsPFail, slotsFail := 0, 0, 0, 0
+	for j := 0; j < CLUSTER_SLOTS; j++ {
+		n := cs.Slots[j]
+		if n == nil {
+			continue
+		}
+		slotsAssigned++
+		if n.WithFlags(CLUSTER_NODE_FAIL) {
+			slotsFail++
+		} else if n.WithFlags(CLUSTER_NODE_PFAIL) {
+			slotsPFail++
+		} else {
+			slotsOk++
+		}
+	}
+	state := "ok"
+	if cs.State != CLUSTER_OK {
+		state = "fail"
+	}
+	var sent, received int64
+	for j := 0; j < CLUSTERMSG_TYPE_COUNT; j++ {
+		sent += cs.StatsMessagesSent[j]
+		received += cs.StatsMessagesRecv[j]
+	}
+	info := fmt.Sprintf("cluster_state:%s\r\n"+
+		"cluster_slots_assigned:%d\r\n"+
+		"cluster_slots_ok:%d\r\n"+
+		"cluster_slots_pfail:%d\r\n"+
+		"cluster_slots_fail:%d\r\n"+
+		"cluster_known_nodes:%d\r\n"+
+		"cluster_size:%d\r\n"+
+		"cluster_current_epoch:%d\r\n"+
+		"cluster_my_epoch:%d\r\n"+
+		"cluster_stats_messages_sent:%d\r\n"+
+		"cluster_stats_messages_received:%d\r\n",
+		state, slotsAssigned, slotsOk, slotsPFail, slotsFail, len(cs.Nodes), cs.Size,
+		cs.CurrentEpoch, cs.Myself.ConfigEpoch, sent, received)
+	return info
+}
+
+/* CLUSTER SETSLOT <slot> IMPORTING <node ID>
+ * CLUSTER SETSLOT <slot> MIGRATING <node ID>
+ * CLUSTER SETSLOT <slot> STABLE
+ * CLUSTER SETSLOT <slot> NODE <node ID> */
+func clusterSetSlotCommand(c *KiwiClient) {
+	cs := c.srv.Cluster
+	slot := getSlotOrReply(c, c.Argv[2])
+	if slot == -1 {
+		return
+	}
+	action := strings.ToLower(c.Argv[3])
+	if action != "stable" && c.Argc != 5 {
+		AddReplyErrorObject(c, c.srv.Shared.SyntaxErr)
+		return
+	}
+	switch action {
+	case "migrating":
+		if cs.Slots[slot] != cs.Myself {
+			AddReplyError(c, fmt.Sprintf("I'm not the owner of hash slot %d", slot))
+			return
+		}
+		n := c.srv.ClusterLookupNode(c.Argv[4])
+		if n == nil {
+			AddReplyError(c, fmt.Sprintf("I don't know about node %s", c.Argv[4]))
+			return
+		}
+		cs.MigratingSlotsTo[slot] = n
+	case "importing":
+		if cs.Slots[slot] == cs.Myself {
+			AddReplyError(c, fmt.Sprintf("I'm already the owner of hash slot %d", slot))
+			return
+		}
+		n := c.srv.ClusterLookupNode(c.Argv[4])
+		if n == nil {
+			AddReplyError(c, fmt.Sprintf("I don't know about node %s", c.Argv[4]))
+			return
+		}
+		cs.ImportingSlotsFrom[slot] = n
+	case "stable":
+		cs.ImportingSlotsFrom[slot] = nil
+		cs.MigratingSlotsTo[slot] = nil
+	case "node":
+		n := c.srv.ClusterLookupNode(c.Argv[4])
+		if n == nil {
+			AddReplyError(c, fmt.Sprintf("Unknown node %s", c.Argv[4]))
+			return
+		}
+		// If this hash slot was served by 'myself' before to switch
+		// make sure there are no longer local keys for this hash slot.
+		if cs.Slots[slot] == cs.Myself && n != cs.Myself && c.srv.CountKeysInSlot(slot) != 0 {
+			AddReplyError(c, fmt.Sprintf("Can't assign hashslot %d to a different node while I still hold keys for this hash slot.", slot))
+			return
+		}
+		// If this slot is in migrating status but we have no keys
+		// for it assigning the slot to another node will clear
+		// the migrating status.
+		if c.srv.CountKeysInSlot(slot) == 0 && cs.MigratingSlotsTo[slot] != nil {
+			cs.MigratingSlotsTo[slot] = nil
+		}
+		c.srv.ClusterDelSlot(slot)
+		c.srv.ClusterAddSlot(n, slot)
+		// If this node was importing this slot, assigning the slot to
+		// itself also clears the importing status, and we take a new
+		// configEpoch so the rest of the cluster accepts our claim.
+		if n == cs.Myself && cs.ImportingSlotsFrom[slot] != nil {
+			c.srv.ClusterBumpConfigEpochWithoutConsensus()
+			cs.ImportingSlotsFrom[slot] = nil
+		}
+	default:
+		AddReplyError(c, "Invalid CLUSTER SETSLOT action or number of arguments. Try CLUSTER HELP")
+		return
+	}
+	cs.ConfigDirty = true
+	c.srv.ClusterUpdateState()
+	c.srv.ClusterBroadcastPong()
+	AddReply(c, c.srv.Shared.Ok)
+}
+
+/* CLUSTER ADDSLOTS <slot> [slot] ...
+ * CLUSTER DELSLOTS <slot> [slot] ... */
+func clusterAddDelSlotsCommand(c *KiwiClient, del bool) {
+	cs := c.srv.Cluster
+	slots := make([]int, 0, c.Argc-2)
+	seen := make(map[int]bool)
+	for j := 2; j < c.Argc; j++ {
+		slot := getSlotOrReply(c, c.Argv[j])
+		if slot == -1 {
+			return
+		}
+		if del && cs.Slots[slot] == nil {
+			AddReplyError(c, fmt.Sprintf("Slot %d is already unassigned", slot))
+			return
+		} else if !del && cs.Slots[slot] != nil {
+			AddReplyError(c, fmt.Sprintf("Slot %d is already busy", slot))
+			return
+		}
+		if seen[slot] {
+			AddReplyError(c, fmt.Sprintf("Slot %d specified multiple times", slot))
+			return
+		}
+		seen[slot] = true
+		slots = append(slots, slot)
+	}
+	for _, slot := range slots {
+		if del {
+			c.srv.ClusterDelSlot(slot)
+		} else {
+			// If this node was importing this slot, assigning the slot to
+			// itself also clears the importing status.
+			cs.ImportingSlotsFrom[slot] = nil
+			c.srv.ClusterAddSlot(cs.Myself, slot)
+		}
+	}
+	cs.ConfigDirty = true
+	c.srv.ClusterUpdateState()
+	c.srv.ClusterBroadcastPong()
+	AddReply(c, c.srv.Shared.Ok)
+}
+
+var ClusterCommand CommandProcess = func(c *KiwiClient) {
+	if !c.srv.ClusterEnabled {
+		AddReplyError(c, "This instance has cluster support disabled")
+		return
+	}
+	cs := c.srv.Cluster
+	sub := strings.ToLower(c.Argv[1])
+
+	// Read only subcommands.
+	switch {
+	case sub == "myid" && c.Argc == 2:
+		cs.mutex.RLock()
+		AddReplyBulkStr(c, cs.Myself.Name)
+		cs.mutex.RUnlock()
+		return
+	case sub == "keyslot" && c.Argc == 3:
+		AddReplyInt(c, KeyHashSlot(c.Argv[2]))
+		return
+	case sub == "nodes" && c.Argc == 2:
+		cs.mutex.RLock()
+		AddReplyVerbatim(c, c.srv.ClusterGenNodesDescription(0), "txt")
+		cs.mutex.RUnlock()
+		return
+	case sub == "slots" && c.Argc == 2:
+		cs.mutex.RLock()
+		clusterReplySlots(c)
+		cs.mutex.RUnlock()
+		return
+	case sub == "shards" && c.Argc == 2:
+		cs.mutex.RLock()
+		clusterReplyShards(c)
+		cs.mutex.RUnlock()
+		return
+	case sub == "info" && c.Argc == 2:
+		cs.mutex.RLock()
+		AddReplyVerbatim(c, c.srv.clusterGenInfoString(), "txt")
+		cs.mutex.RUnlock()
+		return
+	case sub == "countkeysinslot" && c.Argc == 3:
+		slot := getSlotOrReply(c, c.Argv[2])
+		if slot == -1 {
+			return
+		}
+		AddReplyInt(c, c.srv.CountKeysInSlot(slot))
+		return
+	case sub == "getkeysinslot" && c.Argc == 4:
+		slot := getSlotOrReply(c, c.Argv[2])
+		if slot == -1 {
+			return
+		}
+		maxKeys, err := strconv.Atoi(c.Argv[3])
+		if err != nil || maxKeys < 0 {
+			AddReplyError(c, "Invalid number of keys")
+			return
+		}
+		keys := c.srv.GetKeysInSlot(slot, maxKeys)
+		AddReplyMultiBulkLen(c, len(keys))
+		for _, key := range keys {
+			AddReplyBulkStr(c, key)
+		}
+		return
+	}
+
+	cs.mutex.Lock()
+	defer cs.mutex.Unlock()
+	switch {
+	case sub == "meet" && (c.Argc == 4 || c.Argc == 5):
+		// CLUSTER MEET <ip> <port> [cport]
+		port, err1 := strconv.Atoi(c.Argv[3])
+		busPort := port + CLUSTER_PORT_INCR
+		var err2 error
+		if c.Argc == 5 {
+			busPort, err2 = strconv.Atoi(c.Argv[4])
+		}
+		if err1 != nil || err2 != nil {
+			AddReplyError(c, fmt.Sprintf("Invalid TCP base port specified: %s", c.Argv[3]))
+			return
+		}
+		if c.srv.ClusterStartHandshake(c.Argv[2], port, busPort) == C_ERR {
+			AddReplyError(c, fmt.Sprintf("Invalid node address specified: %s:%s", c.Argv[2], c.Argv[3]))
+			return
+		}
+		AddReply(c, c.srv.Shared.Ok)
+	case sub == "addslots" && c.Argc >= 3:
+		clusterAddDelSlotsCommand(c, false)
+	case sub == "delslots" && c.Argc >= 3:
+		clusterAddDelSlotsCommand(c, true)
+	case sub == "setslot" && c.Argc >= 4:
+		clusterSetSlotCommand(c)
+	case sub == "forget" && c.Argc == 3:
+		n := c.srv.ClusterLookupNode(c.Argv[2])
+		if n == nil {
+			AddReplyError(c, fmt.Sprintf("Unknown node %s", c.Argv[2]))
+			return
+		} else if n == cs.Myself {
+			AddReplyError(c, "I tried hard but I can't forget myself...")
+			return
+		}
+		cs.Blacklist[n.Name] = time.Now().Add(60 * time.Second)
+		c.srv.ClusterDelNode(n)
+		cs.ConfigDirty = true
+		c.srv.ClusterUpdateState()
+		AddReply(c, c.srv.Shared.Ok)
+	case sub == "saveconfig" && c.Argc == 2:
+		if c.srv.ClusterSaveConfig() == C_ERR {
+			AddReplyError(c, "error saving the cluster node config")
+			return
+		}
+		AddReply(c, c.srv.Shared.Ok)
+	case sub == "bumpepoch" && c.Argc == 2:
+		if c.srv.ClusterBumpConfigEpochWithoutConsensus() {
+			AddReplyStatus(c, fmt.Sprintf("BUMPED %d", cs.Myself.ConfigEpoch))
+		} else {
+			AddReplyStatus(c, fmt.Sprintf("STILL %d", cs.Myself.ConfigEpoch))
+		}
+	default:
+		AddReplyError(c, fmt.Sprintf("Unknown subcommand or wrong number of arguments for '%.128s'. Try CLUSTER HELP.", c.Argv[1]))
+	}
+}
+
+var AskingCommand CommandProcess = func(c *KiwiClient) {
+	if !c.srv.ClusterEnabled {
+		AddReplyError(c, "This instance has cluster support disabled")
+		return
+	}
+	c.AddFlags(CLIENT_ASKING)
+	AddReply(c, c.srv.Shared.Ok)
+}
+
+/* The READONLY command is used by clients to enter the read-only mode.
+ * In this mode slaves will not redirect clients as long as clients access
+ * with read-only commands to keys that are served by the slave's master. */
+var ReadOnlyCommand CommandProcess = func(c *KiwiClient) {
+	if !c.srv.ClusterEnabled {
+		AddReplyError(c, "This instance has cluster support disabled")
+		return
+	}
+	c.AddFlags(CLIENT_READONLY)
+	AddReply(c, c.srv.Shared.Ok)
+}
+
+var ReadWriteCommand CommandProcess = func(c *KiwiClient) {
+	c.DeleteFlags(CLIENT_READONLY)
+	AddReply(c, c.srv.Shared.Ok)
+}
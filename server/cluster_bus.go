@@ -0,0 +1,636 @@
+package server
+
+import (
+	"encoding/gob"
+	"math/rand"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+/* The cluster bus is a node-to-node TCP channel listening on the client port
+ * plus CLUSTER_PORT_INCR. Every node keeps an outbound link towards every
+ * other known node, and sends PING/MEET messages on it; PONGs are sent back
+ * on the same connection. Every message carries the sender slots bitmap and
+ * configEpoch plus a few gossip sections, so the configuration converges
+ * even if the administrator only talks to a single node. */
+
+type ClusterMsgGossip struct {
+	Name         string
+	Ip           string
+	Port         int
+	BusPort      int
+	Flags        int
+	PingSent     int64
+	PongReceived int64
+}
+
+type ClusterMsg struct {
+	Type         int
+	Sender       string
+	CurrentEpoch uint64
+	ConfigEpoch  uint64
+	Myslots      [CLUSTER_SLOTS / 8]byte
+	MyIp         string
+	Port         int
+	BusPort      int
+	Flags        int
+	State        int
+	Gossip       []ClusterMsgGossip
+	// FAIL and UPDATE messages: the node the message is about.
+	About            string
+	AboutConfigEpoch uint64
+	AboutSlots       [CLUSTER_SLOTS / 8]byte
+}
+
+type ClusterLink struct {
+	srv    *Server
+	CTime  time.Time
+	Node   *ClusterNode // Node related to this link if any, or nil
+	conn   net.Conn
+	sendCh chan *ClusterMsg
+	closed chan struct{}
+	mutex  sync.Mutex
+}
+
+func (s *Server) CreateClusterLink(node *ClusterNode) *ClusterLink {
+	return &ClusterLink{
+		srv:    s,
+		CTime:  time.Now(),
+		Node:   node,
+		sendCh: make(chan *ClusterMsg, CLUSTER_LINK_SEND_QUEUE),
+		closed: make(chan struct{}),
+	}
+}
+
+func (link *ClusterLink) close() {
+	link.mutex.Lock()
+	defer link.mutex.Unlock()
+	select {
+	case <-link.closed:
+		return
+	default:
+	}
+	close(link.closed)
+	if link.conn != nil {
+		link.conn.Close()
+	}
+}
+
+/* Attach the connection to the link, unless the link was closed while we
+ * were connecting. */
+func (link *ClusterLink) setConn(conn net.Conn) bool {
+	link.mutex.Lock()
+	defer link.mutex.Unlock()
+	select {
+	case <-link.closed:
+		conn.Close()
+		return false
+	default:
+	}
+	link.conn = conn
+	return true
+}
+
+/* Queue a message on the link. The write happens in the link writer
+ * goroutine so callers may hold the cluster lock. A link whose queue is full
+ * is considered broken and gets closed. */
+func (link *ClusterLink) send(msg *ClusterMsg) {
+	select {
+	case link.sendCh <- msg:
+		link.srv.Cluster.StatsMessagesSent[msg.Type]++
+	case <-link.closed:
+	default:
+		link.close()
+	}
+}
+
+func (link *ClusterLink) writeHandler(enc *gob.Encoder) {
+	for {
+		select {
+		case msg := <-link.sendCh:
+			link.conn.SetWriteDeadline(time.Now().Add(link.srv.ClusterNodeTimeout))
+			if err := enc.Encode(msg); err != nil {
+				link.close()
+				return
+			}
+		case <-link.closed:
+			return
+		}
+	}
+}
+
+func (link *ClusterLink) readHandler() {
+	dec := gob.NewDecoder(link.conn)
+	for {
+		msg := &ClusterMsg{}
+		if err := dec.Decode(msg); err != nil {
+			break
+		}
+		if msg.Type < 0 || msg.Type >= CLUSTERMSG_TYPE_COUNT {
+			break
+		}
+		link.srv.Cluster.mutex.Lock()
+		ok := link.srv.ClusterProcessPacket(link, msg)
+		link.srv.Cluster.mutex.Unlock()
+		if !ok {
+			break
+		}
+	}
+	link.srv.FreeClusterLink(link)
+}
+
+/* Start the goroutines serving an established connection. */
+func (link *ClusterLink) serve(conn net.Conn) {
+	if !link.setConn(conn) {
+		link.srv.FreeClusterLink(link)
+		return
+	}
+	if tcpConn, ok := conn.(*net.TCPConn); ok {
+		AnetSetTcpKeepALive(tcpConn, true)
+		AnetSetTcpNoDelay(tcpConn, true)
+	}
+	go link.writeHandler(gob.NewEncoder(conn))
+	go link.readHandler()
+}
+
+func (s *Server) FreeClusterLink(link *ClusterLink) {
+	link.close()
+	s.Cluster.mutex.Lock()
+	if link.Node != nil && link.Node.Link == link {
+		link.Node.Link = nil
+	}
+	s.Cluster.mutex.Unlock()
+}
+
+func (s *Server) ClusterAcceptHandler(ln net.Listener) {
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			select {
+			case <-s.CloseCh:
+				return
+			default:
+			}
+			s.ServerLogWarnF("Error accepting cluster node: %v\n", err)
+			continue
+		}
+		s.ServerLogDebugF("Accepted cluster node %s\n", conn.RemoteAddr())
+		// Inbound links are not associated to a node: we only use them to
+		// receive PING/MEET messages and reply with PONG.
+		s.CreateClusterLink(nil).serve(conn)
+	}
+}
+
+/* Create the outbound link for the node and dial it in the background. The
+ * first message is queued right away and sent as soon as we are connected. */
+func (s *Server) ClusterConnectNode(node *ClusterNode) {
+	link := s.CreateClusterLink(node)
+	node.Link = link
+	msgType := CLUSTERMSG_TYPE_PING
+	if node.WithFlags(CLUSTER_NODE_MEET) {
+		msgType = CLUSTERMSG_TYPE_MEET
+	}
+	node.PingSent = time.Now()
+	s.ClusterSendPing(link, msgType)
+	node.DeleteFlags(CLUSTER_NODE_MEET)
+
+	addr := node.BusAddr()
+	go func() {
+		conn, err := s.TlsClusterDial(addr, s.ClusterNodeTimeout)
+		if err != nil {
+			s.ServerLogDebugF("Connecting with Node %s at %s: %v\n", node.Name, addr, err)
+			s.FreeClusterLink(link)
+			return
+		}
+		link.serve(conn)
+	}()
+}
+
+/* ------------------------- Building messages ------------------------- */
+
+func (s *Server) ClusterBuildMessageHdr(msgType int) *ClusterMsg {
+	cs := s.Cluster
+	myself := cs.Myself
+	return &ClusterMsg{
+		Type:         msgType,
+		Sender:       myself.Name,
+		CurrentEpoch: cs.CurrentEpoch,
+		ConfigEpoch:  myself.ConfigEpoch,
+		Myslots:      myself.Slots,
+		MyIp:         s.ClusterAnnounceIp,
+		Port:         myself.Port,
+		BusPort:      myself.BusPort,
+		Flags:        myself.Flags,
+		State:        cs.State,
+	}
+}
+
+func clusterSetGossipEntry(msg *ClusterMsg, n *ClusterNode) {
+	msg.Gossip = append(msg.Gossip, ClusterMsgGossip{
+		Name:         n.Name,
+		Ip:           n.Ip,
+		Port:         n.Port,
+		BusPort:      n.BusPort,
+		Flags:        n.Flags,
+		PingSent:     unixMilli(n.PingSent),
+		PongReceived: unixMilli(n.PongReceived),
+	})
+}
+
+/* Send a PING, PONG or MEET message on the link, with a few gossip sections
+ * about random nodes. Nodes in PFAIL state are always included so failure
+ * reports propagate fast. */
+func (s *Server) ClusterSendPing(link *ClusterLink, msgType int) {
+	cs := s.Cluster
+	msg := s.ClusterBuildMessageHdr(msgType)
+	candidates := make([]*ClusterNode, 0, len(cs.Nodes))
+	for _, n := range cs.Nodes {
+		if n == cs.Myself || n == link.Node || n.WithFlags(CLUSTER_NODE_HANDSHAKE|CLUSTER_NODE_NOADDR) {
+			continue
+		}
+		if n.WithFlags(CLUSTER_NODE_PFAIL) {
+			clusterSetGossipEntry(msg, n)
+			continue
+		}
+		candidates = append(candidates, n)
+	}
+	wanted := len(cs.Nodes) / 10
+	if wanted < CLUSTER_MAX_GOSSIP_ENTRIES {
+		wanted = CLUSTER_MAX_GOSSIP_ENTRIES
+	}
+	rand.Shuffle(len(candidates), func(i, j int) {
+		candidates[i], candidates[j] = candidates[j], candidates[i]
+	})
+	for j := 0; j < len(candidates) && j < wanted; j++ {
+		clusterSetGossipEntry(msg, candidates[j])
+	}
+	link.send(msg)
+}
+
+/* Send a PONG to every connected node, used to propagate a new
+ * configuration as fast as possible. */
+func (s *Server) ClusterBroadcastPong() {
+	for _, node := range s.Cluster.Nodes {
+		if node.Link == nil || node == s.Cluster.Myself || node.WithFlags(CLUSTER_NODE_HANDSHAKE) {
+			continue
+		}
+		s.ClusterSendPing(node.Link, CLUSTERMSG_TYPE_PONG)
+	}
+}
+
+func (s *Server) ClusterSendFail(nodename string) {
+	msg := s.ClusterBuildMessageHdr(CLUSTERMSG_TYPE_FAIL)
+	msg.About = nodename
+	for _, node := range s.Cluster.Nodes {
+		if node.Link == nil || node == s.Cluster.Myself || node.WithFlags(CLUSTER_NODE_HANDSHAKE) {
+			continue
+		}
+		node.Link.send(msg)
+	}
+}
+
+/* Tell the node at the other side of link that 'node' owns the slots it
+ * advertises with the given configEpoch. */
+func (s *Server) ClusterSendUpdate(link *ClusterLink, node *ClusterNode) {
+	msg := s.ClusterBuildMessageHdr(CLUSTERMSG_TYPE_UPDATE)
+	msg.About = node.Name
+	msg.AboutConfigEpoch = node.ConfigEpoch
+	msg.AboutSlots = node.Slots
+	link.send(msg)
+}
+
+/* ---------------------- Processing messages ---------------------- */
+
+/* Start a handshake with the node at the given address: it is added with a
+ * random name and the HANDSHAKE flag, and renamed once it replies to our
+ * MEET with its real name. */
+func (s *Server) ClusterStartHandshake(ip string, port int, busPort int) int {
+	parsed := net.ParseIP(ip)
+	if parsed == nil || port <= 0 || port > 65535 || busPort <= 0 || busPort > 65535 {
+		return C_ERR
+	}
+	ip = parsed.String()
+	// Don't start a second handshake with the same node.
+	for _, n := range s.Cluster.Nodes {
+		if n.WithFlags(CLUSTER_NODE_HANDSHAKE) && n.Ip == ip && n.Port == port && n.BusPort == busPort {
+			return C_OK
+		}
+	}
+	n := CreateClusterNode("", CLUSTER_NODE_HANDSHAKE|CLUSTER_NODE_MEET)
+	n.Ip, n.Port, n.BusPort = ip, port, busPort
+	s.ClusterAddNode(n)
+	return C_OK
+}
+
+func clusterNodeAddFailureReport(failing *ClusterNode, sender *ClusterNode) {
+	failing.FailReports[sender.Name] = time.Now()
+}
+
+func clusterNodeDelFailureReport(failing *ClusterNode, sender *ClusterNode) {
+	delete(failing.FailReports, sender.Name)
+}
+
+func (s *Server) clusterNodeFailureReportsCount(node *ClusterNode) int {
+	maxAge := s.ClusterNodeTimeout * CLUSTER_FAIL_REPORT_VALIDITY_MULT
+	now := time.Now()
+	for name, t := range node.FailReports {
+		if now.Sub(t) > maxAge {
+			delete(node.FailReports, name)
+		}
+	}
+	return len(node.FailReports)
+}
+
+/* Check if the node marked as PFAIL is reported as failing by the majority
+ * of the masters: in that case mark it as FAIL and broadcast it. */
+func (s *Server) markNodeAsFailingIfNeeded(node *ClusterNode) {
+	cs := s.Cluster
+	neededQuorum := cs.Size/2 + 1
+	if !node.WithFlags(CLUSTER_NODE_PFAIL) || node.WithFlags(CLUSTER_NODE_FAIL) {
+		return
+	}
+	failures := s.clusterNodeFailureReportsCount(node)
+	if cs.Myself.WithFlags(CLUSTER_NODE_MASTER) {
+		failures++
+	}
+	if failures < neededQuorum {
+		return
+	}
+	s.ServerLogNoticeF("Marking node %s as failing (quorum reached).\n", node.Name)
+	node.DeleteFlags(CLUSTER_NODE_PFAIL)
+	node.AddFlags(CLUSTER_NODE_FAIL)
+	node.FailTime = time.Now()
+	s.ClusterSendFail(node.Name)
+	cs.ConfigDirty = true
+}
+
+func (s *Server) clusterProcessGossipSection(msg *ClusterMsg, sender *ClusterNode) {
+	cs := s.Cluster
+	for _, g := range msg.Gossip {
+		node := s.ClusterLookupNode(g.Name)
+		if node != nil {
+			if sender != nil && sender.WithFlags(CLUSTER_NODE_MASTER) && node != cs.Myself {
+				if g.Flags&(CLUSTER_NODE_FAIL|CLUSTER_NODE_PFAIL) != 0 {
+					clusterNodeAddFailureReport(node, sender)
+					s.markNodeAsFailingIfNeeded(node)
+				} else {
+					clusterNodeDelFailureReport(node, sender)
+				}
+			}
+			continue
+		}
+		// If it's not in NOADDR state and we don't have it, we start a
+		// handshake process against this IP/PORT pairs.
+		if sender == nil || g.Flags&CLUSTER_NODE_NOADDR != 0 {
+			continue
+		}
+		if until, ok := cs.Blacklist[g.Name]; ok && time.Now().Before(until) {
+			continue
+		}
+		s.ClusterStartHandshake(g.Ip, g.Port, g.BusPort)
+	}
+}
+
+/* Process a message received on the link with the cluster lock held.
+ * Returns false if the link must be closed. */
+func (s *Server) ClusterProcessPacket(link *ClusterLink, msg *ClusterMsg) bool {
+	cs := s.Cluster
+	cs.StatsMessagesRecv[msg.Type]++
+	now := time.Now()
+
+	sender := s.ClusterLookupNode(msg.Sender)
+	if sender != nil && sender.WithFlags(CLUSTER_NODE_HANDSHAKE) {
+		sender = nil
+	}
+	if msg.CurrentEpoch > cs.CurrentEpoch {
+		cs.CurrentEpoch = msg.CurrentEpoch
+		cs.ConfigDirty = true
+	}
+
+	if msg.Type == CLUSTERMSG_TYPE_PING || msg.Type == CLUSTERMSG_TYPE_MEET {
+		remoteIp := ""
+		if host, _, err := net.SplitHostPort(link.conn.RemoteAddr().String()); err == nil {
+			remoteIp = host
+		}
+		// Use the address the node connected to us from to learn our own
+		// address, if we don't know it yet.
+		if cs.Myself.Ip == "" && s.ClusterAnnounceIp == "" {
+			if host, _, err := net.SplitHostPort(link.conn.LocalAddr().String()); err == nil {
+				cs.Myself.Ip = host
+				cs.ConfigDirty = true
+			}
+		}
+		// Add the node if it's a MEET from an unknown node.
+		if sender == nil && msg.Type == CLUSTERMSG_TYPE_MEET {
+			node := s.ClusterLookupNode(msg.Sender)
+			if node == nil {
+				node = CreateClusterNode(msg.Sender, CLUSTER_NODE_MASTER)
+				s.ClusterAddNode(node)
+			}
+			node.DeleteFlags(CLUSTER_NODE_HANDSHAKE | CLUSTER_NODE_MEET)
+			node.Ip = remoteIp
+			if msg.MyIp != "" {
+				node.Ip = msg.MyIp
+			}
+			node.Port, node.BusPort = msg.Port, msg.BusPort
+			sender = node
+			s.clusterProcessGossipSection(msg, sender)
+			cs.ConfigDirty = true
+		}
+		s.ClusterSendPing(link, CLUSTERMSG_TYPE_PONG)
+	}
+
+	if msg.Type == CLUSTERMSG_TYPE_PING || msg.Type == CLUSTERMSG_TYPE_PONG || msg.Type == CLUSTERMSG_TYPE_MEET {
+		if link.Node != nil && link.Node.WithFlags(CLUSTER_NODE_HANDSHAKE) {
+			if msg.Type != CLUSTERMSG_TYPE_PONG {
+				return true
+			}
+			// The handshake node replied: learn its real name.
+			if sender != nil {
+				// We already know this node: drop the handshake one.
+				s.ClusterDelNode(link.Node)
+				return false
+			}
+			s.ClusterRenameNode(link.Node, msg.Sender)
+			link.Node.DeleteFlags(CLUSTER_NODE_HANDSHAKE)
+			link.Node.AddFlags(msg.Flags & (CLUSTER_NODE_MASTER | CLUSTER_NODE_SLAVE))
+			sender = link.Node
+			cs.ConfigDirty = true
+		} else if link.Node != nil && link.Node.Name != msg.Sender {
+			// The node changed name, likely reset: forget the old identity.
+			s.ServerLogNoticeF("PONG contains mismatching sender ID %s, expected %s\n", msg.Sender, link.Node.Name)
+			link.Node.AddFlags(CLUSTER_NODE_NOADDR)
+			link.Node.Ip = ""
+			link.Node.Port = 0
+			FreeClusterLinkLocked(link)
+			cs.ConfigDirty = true
+			return false
+		}
+
+		if link.Node != nil && msg.Type == CLUSTERMSG_TYPE_PONG {
+			link.Node.PongReceived = now
+			link.Node.PingSent = time.Time{}
+			if link.Node.WithFlags(CLUSTER_NODE_PFAIL) {
+				link.Node.DeleteFlags(CLUSTER_NODE_PFAIL)
+			} else if link.Node.WithFlags(CLUSTER_NODE_FAIL) &&
+				(link.Node.NumSlots == 0 || now.Sub(link.Node.FailTime) > s.ClusterNodeTimeout*CLUSTER_FAIL_UNDO_TIME_MULT) {
+				s.ServerLogNoticeF("Clear FAIL state for node %s: is reachable again.\n", link.Node.Name)
+				link.Node.DeleteFlags(CLUSTER_NODE_FAIL)
+				cs.ConfigDirty = true
+			}
+		}
+
+		if sender != nil {
+			if msg.ConfigEpoch > sender.ConfigEpoch {
+				sender.ConfigEpoch = msg.ConfigEpoch
+				cs.ConfigDirty = true
+			}
+			if sender.Port != msg.Port || sender.BusPort != msg.BusPort {
+				sender.Port, sender.BusPort = msg.Port, msg.BusPort
+				cs.ConfigDirty = true
+			}
+			s.ClusterUpdateSlotsConfigWith(sender, msg.ConfigEpoch, msg.Myslots[:])
+			s.ClusterHandleConfigEpochCollision(sender)
+			s.clusterProcessGossipSection(msg, sender)
+		}
+	} else if msg.Type == CLUSTERMSG_TYPE_FAIL {
+		if sender == nil {
+			return true
+		}
+		failing := s.ClusterLookupNode(msg.About)
+		if failing != nil && !failing.WithFlags(CLUSTER_NODE_FAIL|CLUSTER_NODE_MYSELF) {
+			s.ServerLogNoticeF("FAIL message received from %s about %s\n", msg.Sender, msg.About)
+			failing.AddFlags(CLUSTER_NODE_FAIL)
+			failing.FailTime = now
+			failing.DeleteFlags(CLUSTER_NODE_PFAIL)
+			cs.ConfigDirty = true
+		}
+	} else if msg.Type == CLUSTERMSG_TYPE_UPDATE {
+		if sender == nil {
+			return true
+		}
+		n := s.ClusterLookupNode(msg.About)
+		if n == nil || n.ConfigEpoch >= msg.AboutConfigEpoch {
+			return true
+		}
+		n.ConfigEpoch = msg.AboutConfigEpoch
+		s.ClusterUpdateSlotsConfigWith(n, msg.AboutConfigEpoch, msg.AboutSlots[:])
+		cs.ConfigDirty = true
+	}
+	s.ClusterUpdateState()
+	return true
+}
+
+/* Same as FreeClusterLink but to be called with the cluster lock held. */
+func FreeClusterLinkLocked(link *ClusterLink) {
+	link.close()
+	if link.Node != nil && link.Node.Link == link {
+		link.Node.Link = nil
+	}
+}
+
+/* ------------------------------- Cron ------------------------------- */
+
+/* ClusterCron is called 10 times per second by the server cron. */
+func (s *Server) ClusterCron() {
+	cs := s.Cluster
+	cs.mutex.Lock()
+	defer cs.mutex.Unlock()
+
+	now := time.Now()
+	nodeTimeout := s.ClusterNodeTimeout
+	handshakeTimeout := nodeTimeout
+	if handshakeTimeout < time.Second {
+		handshakeTimeout = time.Second
+	}
+
+	for name, until := range cs.Blacklist {
+		if now.After(until) {
+			delete(cs.Blacklist, name)
+		}
+	}
+
+	// Check if we have disconnected nodes and re-establish the connection.
+	for _, node := range cs.Nodes {
+		if node.WithFlags(CLUSTER_NODE_MYSELF | CLUSTER_NODE_NOADDR) {
+			continue
+		}
+		// A Node in HANDSHAKE state has a limited lifespan.
+		if node.WithFlags(CLUSTER_NODE_HANDSHAKE) && now.Sub(node.CTime) > handshakeTimeout {
+			s.ClusterDelNode(node)
+			continue
+		}
+		if node.Link == nil {
+			s.ClusterConnectNode(node)
+		}
+	}
+
+	// Ping some random node once every 10 iterations, so that we usually
+	// ping one random node every second.
+	if atomic.LoadInt64(&s.CronLoopCount)%10 == 0 {
+		var minPongNode *ClusterNode
+		for j := 0; j < 5 && len(cs.Nodes) > 0; j++ {
+			node := s.clusterRandomNode()
+			if node == nil || node.Link == nil || !node.PingSent.IsZero() ||
+				node.WithFlags(CLUSTER_NODE_MYSELF|CLUSTER_NODE_HANDSHAKE) {
+				continue
+			}
+			if minPongNode == nil || node.PongReceived.Before(minPongNode.PongReceived) {
+				minPongNode = node
+			}
+		}
+		if minPongNode != nil {
+			minPongNode.PingSent = now
+			s.ClusterSendPing(minPongNode.Link, CLUSTERMSG_TYPE_PING)
+		}
+	}
+
+	for _, node := range cs.Nodes {
+		if node.WithFlags(CLUSTER_NODE_MYSELF|CLUSTER_NODE_NOADDR|CLUSTER_NODE_HANDSHAKE) || node.Link == nil {
+			continue
+		}
+		// If we are waiting for the PONG more than half the cluster
+		// timeout, reconnect the link: maybe there is a connection
+		// issue even if the node is alive.
+		if !node.PingSent.IsZero() && now.Sub(node.PingSent) > nodeTimeout/2 &&
+			now.Sub(node.Link.CTime) > nodeTimeout {
+			FreeClusterLinkLocked(node.Link)
+		}
+		// If we have currently no active ping in this instance, and the
+		// received PONG is older than half the cluster timeout, send
+		// a new ping now, to ensure all the nodes are pinged without
+		// a too big delay.
+		if node.Link != nil && node.PingSent.IsZero() && now.Sub(node.PongReceived) > nodeTimeout/2 {
+			node.PingSent = now
+			s.ClusterSendPing(node.Link, CLUSTERMSG_TYPE_PING)
+			continue
+		}
+		// Check only if we have an active ping for this instance.
+		if node.PingSent.IsZero() {
+			continue
+		}
+		if now.Sub(node.PingSent) > nodeTimeout && !node.WithFlags(CLUSTER_NODE_PFAIL|CLUSTER_NODE_FAIL) {
+			s.ServerLogDebugF("*** NODE %s possibly failing\n", node.Name)
+			node.AddFlags(CLUSTER_NODE_PFAIL)
+		}
+	}
+
+	s.ClusterUpdateState()
+	if cs.ConfigDirty {
+		s.ClusterSaveConfig()
+	}
+}
+
+func (s *Server) clusterRandomNode() *ClusterNode {
+	cs := s.Cluster
+	i := rand.Intn(len(cs.Nodes))
+	for _, node := range cs.Nodes {
+		if i == 0 {
+			return node
+		}
+		i--
+	}
+	return nil
+}
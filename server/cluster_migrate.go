@@ -0,0 +1,411 @@
+package server
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc64"
+	"math"
+	"net"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+/* DUMP/RESTORE payload format:
+ *
+ * [type byte][object value][2 bytes version][8 bytes CRC64]
+ *
+ * The CRC64 covers everything before it. The value of a string is stored
+ * as is, the value of the other types is their number of elements followed
+ * by the elements:
+ *
+ * list: [len][element]...   set: [len][member]...
+ * hash: [len][field][value]...   zset: [len][member][8 bytes score]...
+ *
+ * The lengths are uvarints, and the strings are prefixed by their length.
+ * The scores are the IEEE 754 bits of the float64, little endian. */
+
+const DUMP_PAYLOAD_VERSION = 1
+
+var crc64Table = crc64.MakeTable(crc64.ECMA)
+
+func DumpObject(o Objector) (string, error) {
+	buf := Buffer{}
+	switch o.getOType() {
+	case OBJ_RTYPE_STR:
+		str, err := GetStrObjectValueString(o.(*StrObject))
+		if err != nil {
+			return "", err
+		}
+		buf.WriteByte(OBJ_RTYPE_STR)
+		buf.WriteString(str)
+	case OBJ_RTYPE_LIST:
+		list := o.(*ListObject)
+		buf.WriteByte(OBJ_RTYPE_LIST)
+		dumpWriteLen(&buf, int(list.Value.Len()))
+		for _, element := range listElements(list, 0, int(list.Value.Len())-1) {
+			dumpWriteString(&buf, element)
+		}
+	case OBJ_RTYPE_SET:
+		set := o.(*SetObject)
+		buf.WriteByte(OBJ_RTYPE_SET)
+		dumpWriteLen(&buf, len(*set.Value))
+		for member := range *set.Value {
+			dumpWriteString(&buf, member)
+		}
+	case OBJ_RTYPE_HASH:
+		hash := o.(*HashObject)
+		buf.WriteByte(OBJ_RTYPE_HASH)
+		dumpWriteLen(&buf, len(*hash.Value))
+		for field, value := range *hash.Value {
+			dumpWriteString(&buf, field)
+			dumpWriteString(&buf, value)
+		}
+	case OBJ_RTYPE_ZSET:
+		zset := o.(*ZSetObject)
+		buf.WriteByte(OBJ_RTYPE_ZSET)
+		dumpWriteLen(&buf, len(zset.Dict))
+		score := make([]byte, 8)
+		for node := zset.Value.ZSkiplistGetElementByRank(1); node != nil; node = node.Level[0].Forward {
+			dumpWriteString(&buf, node.Ele)
+			binary.LittleEndian.PutUint64(score, math.Float64bits(node.Score))
+			buf.Write(score)
+		}
+	default:
+		return "", errors.New("DUMP of " + o.getOTypeInString() + " objects is not supported")
+	}
+	footer := make([]byte, 10)
+	binary.LittleEndian.PutUint16(footer, DUMP_PAYLOAD_VERSION)
+	buf.Write(footer[:2])
+	binary.LittleEndian.PutUint64(footer[2:], crc64.Checksum(buf.Bytes(), crc64Table))
+	buf.Write(footer[2:])
+	return buf.String(), nil
+}
+
+func (s *Server) RestoreObject(payload string) (Objector, error) {
+	if len(payload) < 11 {
+		return nil, errors.New("DUMP payload version or checksum are wrong")
+	}
+	body := payload[:len(payload)-8]
+	crc := binary.LittleEndian.Uint64([]byte(payload[len(payload)-8:]))
+	version := binary.LittleEndian.Uint16([]byte(payload[len(payload)-10 : len(payload)-8]))
+	if version > DUMP_PAYLOAD_VERSION || crc64.Checksum([]byte(body), crc64Table) != crc {
+		return nil, errors.New("DUMP payload version or checksum are wrong")
+	}
+	value := payload[1 : len(payload)-10]
+	if payload[0] == OBJ_RTYPE_STR {
+		return s.CreateStrObjectByStr(value), nil
+	}
+	r := &dumpReader{data: value}
+	n := r.readLen()
+	var o Objector
+	switch payload[0] {
+	case OBJ_RTYPE_LIST:
+		list := s.CreateListObject()
+		for j := 0; j < n && !r.err; j++ {
+			list.Value.Append(r.readString())
+		}
+		o = list
+	case OBJ_RTYPE_SET:
+		set := s.CreateSetObject()
+		for j := 0; j < n && !r.err; j++ {
+			(*set.Value)[r.readString()] = ""
+		}
+		o = set
+	case OBJ_RTYPE_HASH:
+		hash := s.CreateHashObject()
+		for j := 0; j < n && !r.err; j++ {
+			field := r.readString()
+			(*hash.Value)[field] = r.readString()
+		}
+		o = hash
+	case OBJ_RTYPE_ZSET:
+		zset := s.CreateZsetObject()
+		for j := 0; j < n && !r.err; j++ {
+			member := r.readString()
+			zset.add(member, r.readScore())
+		}
+		o = zset
+	default:
+		return nil, errors.New("Bad data format")
+	}
+	// Empty aggregates are never kept in the keyspace, and the elements
+	// must account for the whole value.
+	if r.err || n == 0 || len(r.data) != 0 {
+		return nil, errors.New("Bad data format")
+	}
+	return o, nil
+}
+
+func dumpWriteLen(buf *Buffer, n int) {
+	var b [binary.MaxVarintLen64]byte
+	buf.Write(b[:binary.PutUvarint(b[:], uint64(n))])
+}
+
+func dumpWriteString(buf *Buffer, str string) {
+	dumpWriteLen(buf, len(str))
+	buf.WriteString(str)
+}
+
+/* Read the elements of a DUMP payload. On malformed input err is set and
+ * the zero values are returned. */
+type dumpReader struct {
+	data string
+	err  bool
+}
+
+func (r *dumpReader) readLen() int {
+	n, size := binary.Uvarint([]byte(r.data))
+	// Every element takes a byte at least: a bigger length is corrupted,
+	// and is not trusted to preallocate anything.
+	if size <= 0 || n > uint64(len(r.data)-size) {
+		r.err = true
+		return 0
+	}
+	r.data = r.data[size:]
+	return int(n)
+}
+
+func (r *dumpReader) readString() string {
+	n := r.readLen()
+	str := r.data[:n]
+	r.data = r.data[n:]
+	return str
+}
+
+func (r *dumpReader) readScore() float64 {
+	if len(r.data) < 8 {
+		r.err = true
+		return 0
+	}
+	score := math.Float64frombits(binary.LittleEndian.Uint64([]byte(r.data[:8])))
+	r.data = r.data[8:]
+	if math.IsNaN(score) {
+		r.err = true
+	}
+	return score
+}
+
+var DumpCommand CommandProcess = func(c *KiwiClient) {
+	o := DbGetOrReply(c, c.Argv[1], c.srv.Shared.Null[c.Resp])
+	if o == nil {
+		return
+	}
+	payload, err := DumpObject(o)
+	if err != nil {
+		AddReplyError(c, err.Error())
+		return
+	}
+	AddReplyBulkStr(c, payload)
+}
+
+/* RESTORE key ttl serialized-value [REPLACE] */
+var RestoreCommand CommandProcess = func(c *KiwiClient) {
+	replace := false
+	for j := 4; j < c.Argc; j++ {
+		if strings.ToUpper(c.Argv[j]) == "REPLACE" {
+			replace = true
+		} else {
+			AddReplyErrorObject(c, c.srv.Shared.SyntaxErr)
+			return
+		}
+	}
+	key := c.Argv[1]
+	if !replace && LookupKeyWrite(c.Db, key) != nil {
+		AddReplyError(c, "-BUSYKEY Target key name already exists.")
+		return
+	}
+	ttl, err := strconv.ParseInt(c.Argv[2], 10, 64)
+	if err != nil || ttl < 0 {
+		AddReplyError(c, "Invalid TTL value, must be >= 0")
+		return
+	}
+	o, err := c.srv.RestoreObject(c.Argv[3])
+	if err != nil {
+		AddReplyError(c, err.Error())
+		return
+	}
+	SetKey(c.Db, key, o)
+	if ttl > 0 {
+		c.Db.SetExpire(key, time.Now().Add(time.Duration(ttl)*time.Millisecond))
+	}
+	atomic.AddInt64(&c.srv.Dirty, 1)
+	AddReply(c, c.srv.Shared.Ok)
+}
+
+/* MIGRATE host port key dbid timeout [COPY | REPLACE | AUTH password]
+ *
+ * On in the multiple keys form:
+ *
+ * MIGRATE host port "" dbid timeout [COPY | REPLACE | AUTH password] KEYS key1
+ * key2 ... keyN */
+var MigrateCommand CommandProcess = func(c *KiwiClient) {
+	copyKeys, replace := false, false
+	password := ""
+	firstKey, numKeys := 3, 1
+	for j := 6; j < c.Argc; j++ {
+		moreArgs := c.Argc - 1 - j
+		switch strings.ToUpper(c.Argv[j]) {
+		case "COPY":
+			copyKeys = true
+		case "REPLACE":
+			replace = true
+		case "AUTH":
+			if moreArgs == 0 {
+				AddReplyErrorObject(c, c.srv.Shared.SyntaxErr)
+				return
+			}
+			j++
+			password = c.Argv[j]
+		case "KEYS":
+			if c.Argv[3] != "" {
+				AddReplyError(c, "When using MIGRATE KEYS option, the key argument must be set to the empty string")
+				return
+			}
+			firstKey = j + 1
+			numKeys = c.Argc - j - 1
+			j = c.Argc
+		default:
+			AddReplyErrorObject(c, c.srv.Shared.SyntaxErr)
+			return
+		}
+	}
+	dbid, err1 := strconv.Atoi(c.Argv[4])
+	timeout, err2 := strconv.Atoi(c.Argv[5])
+	if err1 != nil || err2 != nil {
+		AddReplyError(c, "value is not an integer or out of range")
+		return
+	}
+	if timeout <= 0 {
+		timeout = 1000
+	}
+
+	// Check if the keys are here. If at least one key is to migrate, do it
+	// otherwise if all the keys are missing reply with "NOKEY" to signal
+	// the caller there was nothing to migrate.
+	keys := []string{}
+	payloads := []string{}
+	ttls := []int64{}
+	for j := 0; j < numKeys; j++ {
+		key := c.Argv[firstKey+j]
+		o := LookupKeyRead(c.Db, key)
+		if o == nil {
+			continue
+		}
+		payload, err := DumpObject(o)
+		if err != nil {
+			AddReplyError(c, err.Error())
+			return
+		}
+		var ttl int64
+		if when, ok := c.Db.GetExpire(key); ok {
+			if ttl = int64(time.Until(when) / time.Millisecond); ttl < 1 {
+				ttl = 1
+			}
+		}
+		keys = append(keys, key)
+		payloads = append(payloads, payload)
+		ttls = append(ttls, ttl)
+	}
+	if len(keys) == 0 {
+		AddReplyStatus(c, "NOKEY")
+		return
+	}
+
+	deadline := time.Duration(timeout) * time.Millisecond
+	addr := net.JoinHostPort(c.Argv[1], c.Argv[2])
+	conn, err := c.srv.TlsClusterDial(addr, deadline)
+	if err != nil {
+		AddReplyError(c, "-IOERR error or timeout connecting to the client")
+		return
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(deadline))
+
+	cmds := Buffer{}
+	expected := 0
+	if password != "" {
+		cmds.WriteString(CatMultiBulk([]string{"AUTH", password}))
+		expected++
+	}
+	cmds.WriteString(CatMultiBulk([]string{"SELECT", strconv.Itoa(dbid)}))
+	expected++
+	for j, key := range keys {
+		argv := []string{"RESTORE-ASKING", key, strconv.FormatInt(ttls[j], 10), payloads[j]}
+		if replace {
+			argv = append(argv, "REPLACE")
+		}
+		cmds.WriteString(CatMultiBulk(argv))
+	}
+	if _, err := conn.Write(cmds.Bytes()); err != nil {
+		AddReplyError(c, "-IOERR error or timeout writing to target instance")
+		return
+	}
+
+	reader := bufio.NewReader(conn)
+	for j := 0; j < expected; j++ {
+		line, err := reader.ReadString('\n')
+		if err != nil {
+			AddReplyError(c, "-IOERR error or timeout reading to target instance")
+			return
+		}
+		if line[0] == '-' {
+			AddReplyError(c, fmt.Sprintf("Target instance replied with error: %s", strings.TrimSpace(line[1:])))
+			return
+		}
+	}
+	var errorLine string
+	for _, key := range keys {
+		line, err := reader.ReadString('\n')
+		if err != nil {
+			AddReplyError(c, "-IOERR error or timeout reading to target instance")
+			return
+		}
+		if line[0] == '-' {
+			if errorLine == "" {
+				errorLine = strings.TrimSpace(line[1:])
+			}
+			continue
+		}
+		if !copyKeys {
+			c.Db.Delete(key)
+			atomic.AddInt64(&c.srv.Dirty, 1)
+		}
+	}
+	if errorLine != "" {
+		AddReplyError(c, fmt.Sprintf("Target instance replied with error: %s", errorLine))
+		return
+	}
+	AddReply(c, c.srv.Shared.Ok)
+}
+
+/* The key of MIGRATE is at position 3, unless the KEYS option is used. */
+func MigrateGetKeys(cmd *Command, argv []string, argc int) []int {
+	if argc > 6 {
+		for j := 6; j < argc; j++ {
+			if strings.ToUpper(argv[j]) == "KEYS" && argv[3] == "" {
+				keys := []int{}
+				for k := j + 1; k < argc; k++ {
+					keys = append(keys, k)
+				}
+				return keys
+			}
+		}
+	}
+	return []int{3}
+}
+
+/* Format the arguments as a RESP multi bulk request. */
+func CatMultiBulk(argv []string) string {
+	buf := Buffer{}
+	buf.WriteString(fmt.Sprintf("*%d\r\n", len(argv)))
+	for _, arg := range argv {
+		buf.WriteString(fmt.Sprintf("$%d\r\n", len(arg)))
+		buf.WriteString(arg)
+		buf.WriteString("\r\n")
+	}
+	return buf.String()
+}
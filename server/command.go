@@ -8,7 +8,7 @@ import (
 )
 
 type CommandProcess func(c *KiwiClient)
-type CommandGetKeysProcess func(cmd *Command, argv []string, argc int, numkeys []int)
+type CommandGetKeysProcess func(cmd *Command, argv []string, argc int) []int
 
 type Command struct {
 	Name          string
@@ -18,37 +18,125 @@ type Command struct {
 	Flags         int
 	GetKeyProcess CommandGetKeysProcess
 	/* What keys should be loaded in background when calling this command? */
-	FirstKey bool
-	LastKey  bool
-	KeyStep  int
-	Duration time.Duration
-	Calls    int
+	FirstKey int // The first argument that's a key (0 = no keys)
+	LastKey  int // The last argument that's a key (negative = from the end)
+	KeyStep  int // The step between first and last key
+	/* Statistics, see INFO commandstats and latencystats */
+	Microseconds     int64
+	Calls            int64
+	RejectedCalls    int64 // Calls rejected before the execution
+	FailedCalls      int64 // Calls executed replying with an error
+	LatencyHistogram *Histogram
 }
 
 var CommandTable = []Command{
-	{"get", GetCommand, 2, "rF", 0, nil, true, true, 1, 0, 0},
-	{"set", SetCommand, -3, "wm", 0, nil, true, true, 1, 0, 0},
-	{"setnx", SetNxCommand, 3, "wmF", 0, nil, true, true, 1, 0, 0},
-	{"setex", SetExCommand, 4, "wm", 0, nil, true, true, 1, 0, 0},
-	{"append", AppendCommand, 3, "wm", 0, nil, true, true, 1, 0, 0},
-	{"strlen", StrLenCommand, 2, "rF", 0, nil, true, true, 1, 0, 0},
-	{"del", DeleteCommand, -2, "w", 0, nil, true, false, 1, 0, 0},
-	//{"unlink", UnlinkCommand, -2, "wF", 0, nil, true, false, 1, 0 , 0},
-	{"exists", ExistsCommand, -2, "rF", 0, nil, true, false, 1, 0, 0},
-	{"incr", IncrCommand, 2, "wmF", 0, nil, true, true, 1, 0, 0},
-	{"decr", DecrCommand, 2, "wmF", 0, nil, true, true, 1, 0, 0},
-	{"mget", MGetCommand, -2, "rF", 0, nil, true, false, 1, 0, 0},
-	{"mset", MSetCommand, -3, "wm", 0, nil, true, true, 2, 0, 0},
-	{"msetnx", GetCommand, 2, "wm", 0, nil, true, true, 2, 0, 0},
-	//{"randomkey", RandomKeyCommand, 1, "rR", 0, nil, false, false, 0, 0, 0},
-	{"select", SelectCommand, 2, "lF", 0, nil, false, false, 0, 0, 0},
-	{"flushall", FlushAllCommand, -1, "w", 0, nil, false, false, 0, 0, 0},
-	{"flushall", FlushAllCommand, -1, "w", 0, nil, false, false, 0, 0, 0},
-
-}
-
-func PopulateCommandTable() {
-	for k, cmd := range CommandTable {
+	{"get", GetCommand, 2, "rF", 0, nil, 1, 1, 1, 0, 0, 0, 0, nil},
+	{"set", SetCommand, -3, "wm", 0, nil, 1, 1, 1, 0, 0, 0, 0, nil},
+	{"setnx", SetNxCommand, 3, "wmF", 0, nil, 1, 1, 1, 0, 0, 0, 0, nil},
+	{"setex", SetExCommand, 4, "wm", 0, nil, 1, 1, 1, 0, 0, 0, 0, nil},
+	{"append", AppendCommand, 3, "wm", 0, nil, 1, 1, 1, 0, 0, 0, 0, nil},
+	{"strlen", StrLenCommand, 2, "rF", 0, nil, 1, 1, 1, 0, 0, 0, 0, nil},
+	{"del", DeleteCommand, -2, "w", 0, nil, 1, -1, 1, 0, 0, 0, 0, nil},
+	//{"unlink", UnlinkCommand, -2, "wF", 0, nil, 1, -1, 1, 0 , 0},
+	{"exists", ExistsCommand, -2, "rF", 0, nil, 1, -1, 1, 0, 0, 0, 0, nil},
+	{"incr", IncrCommand, 2, "wmF", 0, nil, 1, 1, 1, 0, 0, 0, 0, nil},
+	{"decr", DecrCommand, 2, "wmF", 0, nil, 1, 1, 1, 0, 0, 0, 0, nil},
+	{"mget", MGetCommand, -2, "rF", 0, nil, 1, -1, 1, 0, 0, 0, 0, nil},
+	{"mset", MSetCommand, -3, "wm", 0, nil, 1, -1, 2, 0, 0, 0, 0, nil},
+	{"msetnx", MSetNxCommand, -3, "wm", 0, nil, 1, -1, 2, 0, 0, 0, 0, nil},
+	//{"randomkey", RandomKeyCommand, 1, "rR", 0, nil, 0, 0, 0, 0, 0, 0, 0, nil},
+	{"type", TypeCommand, 2, "rF", 0, nil, 1, 1, 1, 0, 0, 0, 0, nil},
+	{"rpush", RPushCommand, -3, "wmF", 0, nil, 1, 1, 1, 0, 0, 0, 0, nil},
+	{"lpush", LPushCommand, -3, "wmF", 0, nil, 1, 1, 1, 0, 0, 0, 0, nil},
+	{"rpushx", RPushXCommand, -3, "wmF", 0, nil, 1, 1, 1, 0, 0, 0, 0, nil},
+	{"lpushx", LPushXCommand, -3, "wmF", 0, nil, 1, 1, 1, 0, 0, 0, 0, nil},
+	{"linsert", LInsertCommand, 5, "wm", 0, nil, 1, 1, 1, 0, 0, 0, 0, nil},
+	{"rpop", RPopCommand, -2, "wF", 0, nil, 1, 1, 1, 0, 0, 0, 0, nil},
+	{"lpop", LPopCommand, -2, "wF", 0, nil, 1, 1, 1, 0, 0, 0, 0, nil},
+	{"llen", LLenCommand, 2, "rF", 0, nil, 1, 1, 1, 0, 0, 0, 0, nil},
+	{"lindex", LIndexCommand, 3, "r", 0, nil, 1, 1, 1, 0, 0, 0, 0, nil},
+	{"lset", LSetCommand, 4, "wm", 0, nil, 1, 1, 1, 0, 0, 0, 0, nil},
+	{"lrange", LRangeCommand, 4, "r", 0, nil, 1, 1, 1, 0, 0, 0, 0, nil},
+	{"ltrim", LTrimCommand, 4, "w", 0, nil, 1, 1, 1, 0, 0, 0, 0, nil},
+	{"lrem", LRemCommand, 4, "w", 0, nil, 1, 1, 1, 0, 0, 0, 0, nil},
+	{"sadd", SAddCommand, -3, "wmF", 0, nil, 1, 1, 1, 0, 0, 0, 0, nil},
+	{"srem", SRemCommand, -3, "wF", 0, nil, 1, 1, 1, 0, 0, 0, 0, nil},
+	{"sismember", SIsMemberCommand, 3, "rF", 0, nil, 1, 1, 1, 0, 0, 0, 0, nil},
+	{"scard", SCardCommand, 2, "rF", 0, nil, 1, 1, 1, 0, 0, 0, 0, nil},
+	{"sinter", SInterCommand, -2, "rS", 0, nil, 1, -1, 1, 0, 0, 0, 0, nil},
+	{"sunion", SUnionCommand, -2, "rS", 0, nil, 1, -1, 1, 0, 0, 0, 0, nil},
+	{"sdiff", SDiffCommand, -2, "rS", 0, nil, 1, -1, 1, 0, 0, 0, 0, nil},
+	{"smembers", SMembersCommand, 2, "rS", 0, nil, 1, 1, 1, 0, 0, 0, 0, nil},
+	{"zadd", ZAddCommand, -4, "wmF", 0, nil, 1, 1, 1, 0, 0, 0, 0, nil},
+	{"zincrby", ZIncrByCommand, 4, "wmF", 0, nil, 1, 1, 1, 0, 0, 0, 0, nil},
+	{"zrem", ZRemCommand, -3, "wF", 0, nil, 1, 1, 1, 0, 0, 0, 0, nil},
+	{"zrange", ZRangeCommand, -4, "r", 0, nil, 1, 1, 1, 0, 0, 0, 0, nil},
+	{"zrangebyscore", ZRangeByScoreCommand, -4, "r", 0, nil, 1, 1, 1, 0, 0, 0, 0, nil},
+	{"zcount", ZCountCommand, 4, "rF", 0, nil, 1, 1, 1, 0, 0, 0, 0, nil},
+	{"zrevrange", ZRevRangeCommand, -4, "r", 0, nil, 1, 1, 1, 0, 0, 0, 0, nil},
+	{"zcard", ZCardCommand, 2, "rF", 0, nil, 1, 1, 1, 0, 0, 0, 0, nil},
+	{"zscore", ZScoreCommand, 3, "rF", 0, nil, 1, 1, 1, 0, 0, 0, 0, nil},
+	{"zrank", ZRankCommand, 3, "rF", 0, nil, 1, 1, 1, 0, 0, 0, 0, nil},
+	{"zrevrank", ZRevRankCommand, 3, "rF", 0, nil, 1, 1, 1, 0, 0, 0, 0, nil},
+	{"hset", HSetCommand, -4, "wmF", 0, nil, 1, 1, 1, 0, 0, 0, 0, nil},
+	{"hsetnx", HSetNxCommand, 4, "wmF", 0, nil, 1, 1, 1, 0, 0, 0, 0, nil},
+	{"hget", HGetCommand, 3, "rF", 0, nil, 1, 1, 1, 0, 0, 0, 0, nil},
+	{"hmset", HMSetCommand, -4, "wmF", 0, nil, 1, 1, 1, 0, 0, 0, 0, nil},
+	{"hmget", HMGetCommand, -3, "rF", 0, nil, 1, 1, 1, 0, 0, 0, 0, nil},
+	{"hincrby", HIncrByCommand, 4, "wmF", 0, nil, 1, 1, 1, 0, 0, 0, 0, nil},
+	{"hincrbyfloat", HIncrByFloatCommand, 4, "wmF", 0, nil, 1, 1, 1, 0, 0, 0, 0, nil},
+	{"hdel", HDelCommand, -3, "wF", 0, nil, 1, 1, 1, 0, 0, 0, 0, nil},
+	{"hlen", HLenCommand, 2, "rF", 0, nil, 1, 1, 1, 0, 0, 0, 0, nil},
+	{"hstrlen", HStrLenCommand, 3, "rF", 0, nil, 1, 1, 1, 0, 0, 0, 0, nil},
+	{"hkeys", HKeysCommand, 2, "rS", 0, nil, 1, 1, 1, 0, 0, 0, 0, nil},
+	{"hvals", HValsCommand, 2, "rS", 0, nil, 1, 1, 1, 0, 0, 0, 0, nil},
+	{"hgetall", HGetAllCommand, 2, "rR", 0, nil, 1, 1, 1, 0, 0, 0, 0, nil},
+	{"hexists", HExistsCommand, 3, "rF", 0, nil, 1, 1, 1, 0, 0, 0, 0, nil},
+	{"select", SelectCommand, 2, "lF", 0, nil, 0, 0, 0, 0, 0, 0, 0, nil},
+	{"ping", PingCommand, -1, "tF", 0, nil, 0, 0, 0, 0, 0, 0, 0, nil},
+	{"echo", EchoCommand, 2, "F", 0, nil, 0, 0, 0, 0, 0, 0, 0, nil},
+	{"flushall", FlushAllCommand, -1, "w", 0, nil, 0, 0, 0, 0, 0, 0, 0, nil},
+	{"flushall", FlushAllCommand, -1, "w", 0, nil, 0, 0, 0, 0, 0, 0, 0, nil},
+	{"cluster", ClusterCommand, -2, "a", 0, nil, 0, 0, 0, 0, 0, 0, 0, nil},
+	{"asking", AskingCommand, 1, "F", 0, nil, 0, 0, 0, 0, 0, 0, 0, nil},
+	{"readonly", ReadOnlyCommand, 1, "F", 0, nil, 0, 0, 0, 0, 0, 0, 0, nil},
+	{"readwrite", ReadWriteCommand, 1, "F", 0, nil, 0, 0, 0, 0, 0, 0, 0, nil},
+	{"dump", DumpCommand, 2, "rR", 0, nil, 1, 1, 1, 0, 0, 0, 0, nil},
+	{"restore", RestoreCommand, -4, "wm", 0, nil, 1, 1, 1, 0, 0, 0, 0, nil},
+	{"restore-asking", RestoreCommand, -4, "wmk", 0, nil, 1, 1, 1, 0, 0, 0, 0, nil},
+	{"migrate", MigrateCommand, -6, "wR", 0, MigrateGetKeys, 0, 0, 0, 0, 0, 0, 0, nil},
+	{"expire", ExpireCommand, 3, "wF", 0, nil, 1, 1, 1, 0, 0, 0, 0, nil},
+	{"expireat", ExpireAtCommand, 3, "wF", 0, nil, 1, 1, 1, 0, 0, 0, 0, nil},
+	{"pexpire", PExpireCommand, 3, "wF", 0, nil, 1, 1, 1, 0, 0, 0, 0, nil},
+	{"pexpireat", PExpireAtCommand, 3, "wF", 0, nil, 1, 1, 1, 0, 0, 0, 0, nil},
+	{"ttl", TtlCommand, 2, "rF", 0, nil, 1, 1, 1, 0, 0, 0, 0, nil},
+	{"pttl", PTtlCommand, 2, "rF", 0, nil, 1, 1, 1, 0, 0, 0, 0, nil},
+	{"persist", PersistCommand, 2, "wF", 0, nil, 1, 1, 1, 0, 0, 0, 0, nil},
+	{"object", ObjectCommand, -2, "r", 0, nil, 2, 2, 1, 0, 0, 0, 0, nil},
+	{"touch", TouchCommand, -2, "rF", 0, nil, 1, -1, 1, 0, 0, 0, 0, nil},
+	{"memory", MemoryCommand, -2, "rR", 0, MemoryGetKeys, 0, 0, 0, 0, 0, 0, 0, nil},
+	{"info", InfoCommand, -1, "ltR", 0, nil, 0, 0, 0, 0, 0, 0, 0, nil},
+	{"config", ConfigCommand, -2, "lat", 0, nil, 0, 0, 0, 0, 0, 0, 0, nil},
+	{"command", CommandCommand, -1, "lt", 0, nil, 0, 0, 0, 0, 0, 0, 0, nil},
+	{"monitor", MonitorCommand, 1, "as", 0, nil, 0, 0, 0, 0, 0, 0, 0, nil},
+	{"client", ClientCommand, -2, "last", 0, nil, 0, 0, 0, 0, 0, 0, 0, nil},
+	{"slowlog", SlowlogCommand, -2, "aR", 0, nil, 0, 0, 0, 0, 0, 0, 0, nil},
+	{"latency", LatencyCommand, -2, "aslt", 0, nil, 0, 0, 0, 0, 0, 0, 0, nil},
+	{"auth", AuthCommand, -2, "sltFA", 0, nil, 0, 0, 0, 0, 0, 0, 0, nil},
+	{"acl", AclCommand, -2, "aslt", 0, nil, 0, 0, 0, 0, 0, 0, 0, nil},
+	{"hello", HelloCommand, -1, "sltFA", 0, nil, 0, 0, 0, 0, 0, 0, 0, nil},
+	{"multi", MultiCommand, 1, "sltF", 0, nil, 0, 0, 0, 0, 0, 0, 0, nil},
+	{"exec", ExecCommand, 1, "sMt", 0, nil, 0, 0, 0, 0, 0, 0, 0, nil},
+	{"discard", DiscardCommand, 1, "sltF", 0, nil, 0, 0, 0, 0, 0, 0, 0, nil},
+	{"shutdown", ShutdownCommand, -1, "aslt", 0, nil, 0, 0, 0, 0, 0, 0, 0, nil},
+}
+
+func (s *Server) PopulateCommandTable() {
+	for k := range CommandTable {
+		// Every server has its own copy of the table, with its own
+		// statistics.
+		cmd := new(Command)
+		*cmd = CommandTable[k]
 		for i := 0; i < len(cmd.CharFlags); i++ {
 			switch cmd.CharFlags[i] {
 			case 'w':
@@ -77,15 +165,42 @@ func PopulateCommandTable() {
 				cmd.Flags |= CMD_ASKING
 			case 'F':
 				cmd.Flags |= CMD_FAST
+			case 'A':
+				cmd.Flags |= CMD_NO_AUTH
 			default:
 				panic("Unsupported command flag")
 			}
 		}
-		kiwiS.Commands[cmd.Name] = &CommandTable[k]
-		kiwiS.OrigCommands[cmd.Name] = &CommandTable[k]
+		cmd.LatencyHistogram = CreateHistogram()
+		s.Commands[cmd.Name] = cmd
+		s.OrigCommands[cmd.Name] = cmd
 	}
 }
 
+/* Return the positions of the keys in argv, using the key specification of
+ * the command table or the command specific function if any. */
+func GetKeysFromCommand(cmd *Command, argv []string, argc int) []int {
+	if cmd.GetKeyProcess != nil {
+		return cmd.GetKeyProcess(cmd, argv, argc)
+	}
+	return GetKeysUsingCommandTable(cmd, argv, argc)
+}
+
+func GetKeysUsingCommandTable(cmd *Command, argv []string, argc int) []int {
+	if cmd.FirstKey == 0 {
+		return nil
+	}
+	last := cmd.LastKey
+	if last < 0 {
+		last = argc + last
+	}
+	keys := []int{}
+	for j := cmd.FirstKey; j <= last && j < argc; j += cmd.KeyStep {
+		keys = append(keys, j)
+	}
+	return keys
+}
+
 func (cmd *Command) WithFlags(flags int) bool {
 	return cmd.Flags&flags != 0
 }
@@ -107,96 +222,131 @@ func (cmd *Command) IsProcess(cmdP *CommandProcess) bool {
 // XX - exist
 // EX - expire in seconds
 // PX - expire in milliseconds
-func SetGenericCommand(c *KiwiClient, flags int, key string, okReply string, abortReply string) {
+func SetGenericCommand(c *KiwiClient, flags int, key string, val string, expire string, unit int, okReply string, abortReply string) {
 	// fmt.Println("SetGenericCommand")
-	if (flags&OBJ_SET_NX != 0 && c.Db.Exist(key)) || (flags&OBJ_SET_XX != 0 && !c.Db.Exist(key)) {
+	var milliseconds int64
+	if expire != "" {
+		var err error
+		milliseconds, err = strconv.ParseInt(expire, 10, 64)
+		if err != nil {
+			AddReplyError(c, "value is not an integer or out of range")
+			return
+		}
+		if milliseconds <= 0 {
+			AddReplyError(c, "invalid expire time in set")
+			return
+		}
+		if unit == UNIT_SECONDS {
+			milliseconds *= 1000
+		}
+	}
+	if (flags&OBJ_SET_NX != 0 && LookupKeyWrite(c.Db, key) != nil) || (flags&OBJ_SET_XX != 0 && LookupKeyWrite(c.Db, key) == nil) {
 		if abortReply != "" {
-			AddReply(c, kiwiS.Shared.Zero)
-		} else {
 			AddReply(c, abortReply)
+		} else {
+			AddReplyNull(c)
 		}
 		return
 	}
-	o := CreateStrObjectByStr(c.Argv[2])
-	c.Db.Set(key, o)
-	atomic.AddInt64(&kiwiS.Dirty, 1)
-	if okReply == "" {
-		AddReply(c, kiwiS.Shared.One)
-	} else {
+	SetKey(c.Db, key, c.srv.CreateStrObjectByStr(val))
+	if expire != "" {
+		c.Db.SetExpire(key, time.Now().Add(time.Duration(milliseconds)*time.Millisecond))
+	}
+	atomic.AddInt64(&c.srv.Dirty, 1)
+	if okReply != "" {
 		AddReply(c, okReply)
+	} else {
+		AddReply(c, c.srv.Shared.Ok)
 	}
 }
 
 var SetCommand CommandProcess = func(c *KiwiClient) {
 	// fmt.Println("SetCommand")
 	flags := OBJ_SET_NO_FLAGS
+	unit := UNIT_SECONDS
+	expire := ""
 	for j := 3; j < c.Argc; j++ {
 		a := strings.ToUpper(c.Argv[j])
+		hasNext := j < c.Argc-1
 
-		if a == "NX" && (flags&OBJ_SET_XX) != 0 {
+		if a == "NX" && (flags&OBJ_SET_XX) == 0 {
 			flags |= OBJ_SET_NX
-		} else if a == "XX" && (flags&OBJ_SET_NX) != 0 {
+		} else if a == "XX" && (flags&OBJ_SET_NX) == 0 {
 			flags |= OBJ_SET_XX
-		} else if a == "EX" && flags&OBJ_SET_PX != 0 {
+		} else if a == "EX" && flags&OBJ_SET_PX == 0 && hasNext {
 			flags |= OBJ_SET_EX
-		} else if a == "PX" && flags&OBJ_SET_EX != 0 {
+			unit = UNIT_SECONDS
+			expire = c.Argv[j+1]
+			j++
+		} else if a == "PX" && flags&OBJ_SET_EX == 0 && hasNext {
 			flags |= OBJ_SET_PX
+			unit = UNIT_MILLISECONDS
+			expire = c.Argv[j+1]
+			j++
 		} else {
-			AddReply(c, kiwiS.Shared.SyntaxErr)
+			AddReplyErrorObject(c, c.srv.Shared.SyntaxErr)
 			return
 		}
-		// TODO expire is not implemented now, so end here
 	}
-	SetGenericCommand(c, flags, c.Argv[1], kiwiS.Shared.One, kiwiS.Shared.Zero)
+	SetGenericCommand(c, flags, c.Argv[1], c.Argv[2], expire, unit, "", "")
 }
 
 var SetNxCommand CommandProcess = func(c *KiwiClient) {
-	SetGenericCommand(c, OBJ_SET_NX, c.Argv[1], kiwiS.Shared.One, kiwiS.Shared.Zero)
+	SetGenericCommand(c, OBJ_SET_NX, c.Argv[1], c.Argv[2], "", UNIT_SECONDS, c.srv.Shared.One, c.srv.Shared.Zero)
 }
 
+/* SETEX key seconds value */
 var SetExCommand CommandProcess = func(c *KiwiClient) {
-	SetGenericCommand(c, OBJ_SET_XX, c.Argv[1], kiwiS.Shared.One, kiwiS.Shared.Zero)
+	SetGenericCommand(c, OBJ_SET_NO_FLAGS, c.Argv[1], c.Argv[3], c.Argv[2], UNIT_SECONDS, "", "")
 }
 
 var FlushAllCommand CommandProcess = func(c *KiwiClient) {
-	if kiwiS.ConfigFlushAll {
+	if c.srv.ConfigFlushAll {
 		c.Db.FlushAll()
-		AddReply(c, kiwiS.Shared.Ok)
+		AddReply(c, c.srv.Shared.Ok)
 		//	TODO update aof or rdb
 	}
-	atomic.AddInt64(&kiwiS.Dirty, 1)
+	atomic.AddInt64(&c.srv.Dirty, 1)
 }
 
 var ExistsCommand CommandProcess = func(c *KiwiClient) {
 	count := 0
 	for j := 1; j < c.Argc; j++ {
-		if c.Db.Exist(c.Argv[1]) {
+		if LookupKeyRead(c.Db, c.Argv[j]) != nil {
 			count++
 		}
 	}
 	AddReplyInt(c, count)
-	// expire
-	// addReply()
 }
 
 func IncrDecrCommand(c *KiwiClient, incr int) {
-	o := c.Db.Get(c.Argv[1]).(*StrObject)
-	if o == nil {
-		o = CreateStrObjectByInt(incr)
-		c.Db.Set(c.Argv[1], o)
-	}
-	if !IsStrObjectInt(o) {
-		return
+	var o *StrObject
+	value := 0
+	if obj := LookupKeyWrite(c.Db, c.Argv[1]); obj != nil {
+		var ok bool
+		if o, ok = obj.(*StrObject); !ok {
+			AddReplyErrorObject(c, c.srv.Shared.WrongTypeErr)
+			return
+		}
+		if !IsStrObjectInt(o) {
+			AddReplyError(c, "value is not an integer or out of range")
+			return
+		}
+		value = *o.Value.(*int)
 	}
-	value := *o.Value.(*int)
 	oldValue := value
 	value += incr
 	if IsOverflowInt(oldValue, incr) {
 		AddReplyError(c, "increment or decrement would overflow")
 		return
 	}
-	ReplaceStrObjectByInt(o, &oldValue, &value)
-	atomic.AddInt64(&kiwiS.Dirty, 1)
+	if o == nil {
+		o = c.srv.CreateStrObjectByInt(value)
+	} else {
+		o = c.srv.ReplaceStrObjectByInt(o, &oldValue, &value)
+	}
+	c.Db.Set(c.Argv[1], o)
+	atomic.AddInt64(&c.srv.Dirty, 1)
 	AddReplyInt(c, value)
 }
 
@@ -211,6 +361,7 @@ var DecrCommand CommandProcess = func(c *KiwiClient) {
 var IncrByCommand CommandProcess = func(c *KiwiClient) {
 	incr, err := strconv.Atoi(c.Argv[2])
 	if err != nil {
+		AddReplyError(c, "value is not an integer or out of range")
 		return
 	}
 	IncrDecrCommand(c, incr)
@@ -219,18 +370,25 @@ var IncrByCommand CommandProcess = func(c *KiwiClient) {
 var DecrByCommand CommandProcess = func(c *KiwiClient) {
 	decr, err := strconv.Atoi(c.Argv[2])
 	if err != nil {
+		AddReplyError(c, "value is not an integer or out of range")
 		return
 	}
 	IncrDecrCommand(c, -decr)
 }
 
 var StrLenCommand CommandProcess = func(c *KiwiClient) {
-	o := DbGetOrReply(c, c.Argv[1], kiwiS.Shared.NullBulk)
+	o := DbGetOrReply(c, c.Argv[1], c.srv.Shared.Zero)
 	if o == nil {
 		return
 	}
-	str, err := GetStrObjectValueString(o.(*StrObject))
-	if err == nil {
+	so, ok := o.(*StrObject)
+	if !ok {
+		AddReplyErrorObject(c, c.srv.Shared.WrongTypeErr)
+		return
+	}
+	str, err := GetStrObjectValueString(so)
+	if err != nil {
+		AddReplyErrorObject(c, c.srv.Shared.WrongTypeErr)
 		return
 	}
 	AddReplyInt(c, len(str))
@@ -239,22 +397,25 @@ var StrLenCommand CommandProcess = func(c *KiwiClient) {
 // Cat strings
 var AppendCommand CommandProcess = func(c *KiwiClient) {
 	var length int
-	o := c.Db.Get(c.Argv[1]).(*StrObject)
-	if o == nil {
-		o = CreateStrObjectByStr(c.Argv[2])
-		c.Db.Set(c.Argv[1], o)
+	obj := LookupKeyWrite(c.Db, c.Argv[1])
+	if obj == nil {
+		c.Db.Set(c.Argv[1], c.srv.CreateStrObjectByStr(c.Argv[2]))
+		length = len(c.Argv[2])
 	} else {
-		if !CheckOType(o, OBJ_RTYPE_STR) {
+		o, ok := obj.(*StrObject)
+		if !ok || !CheckOType(o, OBJ_RTYPE_STR) {
+			AddReplyErrorObject(c, c.srv.Shared.WrongTypeErr)
 			return
 		}
-		_, length = AppendStrObject(o, c.Argv[2])
+		o, length = c.srv.AppendStrObject(o, c.Argv[2])
+		c.Db.Set(c.Argv[1], o)
 	}
-	atomic.AddInt64(&kiwiS.Dirty, 1)
+	atomic.AddInt64(&c.srv.Dirty, 1)
 	AddReplyInt(c, length)
 }
 
 func DbGetOrReply(c *KiwiClient, key string, reply string) Objector {
-	o := c.Db.Get(key)
+	o := LookupKeyRead(c.Db, key)
 	if o == nil {
 		AddReply(c, reply)
 	}
@@ -262,15 +423,20 @@ func DbGetOrReply(c *KiwiClient, key string, reply string) Objector {
 }
 
 func GetGenericCommand(c *KiwiClient) int {
-	o := DbGetOrReply(c, c.Argv[1], kiwiS.Shared.NullBulk)
+	o := DbGetOrReply(c, c.Argv[1], c.srv.Shared.Null[c.Resp])
 	if o == nil {
 		return C_OK
 	}
 	if !CheckOType(o, OBJ_RTYPE_STR) {
-		AddReply(c, kiwiS.Shared.WrongTypeErr)
+		AddReplyErrorObject(c, c.srv.Shared.WrongTypeErr)
 		return C_ERR
 	} else {
-		AddReplyBulkStrObj(c, o.(*StrObject))
+		so, ok := o.(*StrObject)
+		if !ok {
+			AddReplyErrorObject(c, c.srv.Shared.WrongTypeErr)
+			return C_ERR
+		}
+		AddReplyBulkStrObj(c, so)
 		return C_OK
 	}
 }
@@ -283,9 +449,8 @@ func GetSetCommand(c *KiwiClient) {
 	if GetGenericCommand(c) == C_ERR {
 		return
 	}
-	o := CreateStrObjectByStr(c.Argv[2])
-	c.Db.Set(c.Argv[1], o)
-	atomic.AddInt64(&kiwiS.Dirty, 1)
+	SetKey(c.Db, c.Argv[1], c.srv.CreateStrObjectByStr(c.Argv[2]))
+	atomic.AddInt64(&c.srv.Dirty, 1)
 }
 
 func MSetGenericCommand(c *KiwiClient, flags int) {
@@ -298,24 +463,23 @@ func MSetGenericCommand(c *KiwiClient, flags int) {
 	existKeyCount := 0
 	if flags&OBJ_SET_NX != 0 {
 		for j := 1; j < len(c.Argv); j += 2 {
-			if c.Db.Exist(c.Argv[j]) {
+			if LookupKeyWrite(c.Db, c.Argv[j]) != nil {
 				existKeyCount++
 			}
 		}
 		if existKeyCount != 0 {
-			AddReply(c, kiwiS.Shared.Zero)
+			AddReply(c, c.srv.Shared.Zero)
 			return
 		}
 	}
 	for j := 1; j < len(c.Argv); j += 2 {
-		o := CreateStrObjectByStr(c.Argv[j+1])
-		c.Db.Set(c.Argv[j], o)
+		SetKey(c.Db, c.Argv[j], c.srv.CreateStrObjectByStr(c.Argv[j+1]))
 	}
-	atomic.AddInt64(&kiwiS.Dirty, int64((c.Argc-1)/2))
+	atomic.AddInt64(&c.srv.Dirty, int64((c.Argc-1)/2))
 	if flags&OBJ_SET_NX != 0 {
-		AddReply(c, kiwiS.Shared.One)
+		AddReply(c, c.srv.Shared.One)
 	} else {
-		AddReply(c, kiwiS.Shared.Ok)
+		AddReply(c, c.srv.Shared.Ok)
 	}
 }
 
@@ -330,12 +494,12 @@ var MSetNxCommand CommandProcess = func(c *KiwiClient) {
 var MGetCommand CommandProcess = func(c *KiwiClient) {
 	AddReplyMultiBulkLen(c, c.Argc-1)
 	for j := 1; j < len(c.Argv); j++ {
-		o := c.Db.Get(c.Argv[j]).(*StrObject)
-		if o == nil {
-			AddReply(c, kiwiS.Shared.NullBulk)
+		o, ok := LookupKeyRead(c.Db, c.Argv[j]).(*StrObject)
+		if !ok {
+			AddReplyNull(c)
 		} else {
 			if !CheckOType(o, OBJ_RTYPE_STR) {
-				AddReply(c, kiwiS.Shared.NullBulk)
+				AddReplyNull(c)
 			} else {
 				AddReplyBulkStrObj(c, o)
 			}
@@ -343,15 +507,34 @@ var MGetCommand CommandProcess = func(c *KiwiClient) {
 	}
 }
 
+/* AUTH <password>
+ * AUTH <username> <password> */
 var AuthCommand CommandProcess = func(c *KiwiClient) {
-	if kiwiS.RequirePassword == nil {
-		AddReplyError(c, "KiwiClient sent AUTH, but no password is set")
-	} else if c.Argv[1] == *kiwiS.RequirePassword {
-		c.Authenticated = 1
-		AddReply(c, kiwiS.Shared.Ok)
+	// Only two or three argument forms are allowed.
+	if c.Argc > 3 {
+		AddReplyErrorObject(c, c.srv.Shared.SyntaxErr)
+		return
+	}
+	var username, password string
+	if c.Argc == 2 {
+		// Mimic the old behavior of giving an error for the two argument
+		// form if no password is configured.
+		if !c.srv.ACLDefaultUserRequiresAuth() {
+			AddReplyError(c, "AUTH <password> called without any password configured for the default user. Are you sure your configuration is correct?")
+			return
+		}
+		username, password = "default", c.Argv[1]
+	} else {
+		username, password = c.Argv[1], c.Argv[2]
+	}
+	// Don't keep the password around: the arguments end in the slow log.
+	for j := 1; j < c.Argc; j++ {
+		c.Argv[j] = "(redacted)"
+	}
+	if ACLAuthenticateUser(c, username, password) == C_OK {
+		AddReply(c, c.srv.Shared.Ok)
 	} else {
-		c.Authenticated = 0
-		AddReplyError(c, "invalid password")
+		AddReplyError(c, "-WRONGPASS invalid username-password pair or user is disabled.")
 	}
 }
 
@@ -370,7 +553,7 @@ func DeleteGenericCommand(c *KiwiClient, lazy bool) {
 		}
 		if deleted {
 			count++
-			atomic.AddInt64(&kiwiS.Dirty, 1)
+			atomic.AddInt64(&c.srv.Dirty, 1)
 		}
 	}
 	AddReplyInt(c, count)
@@ -380,26 +563,170 @@ var SelectCommand CommandProcess = func(c *KiwiClient) {
 	i, err := strconv.Atoi(c.Argv[1])
 	if err != nil {
 		AddReplyError(c, "invalid DB index")
+	} else if c.srv.ClusterEnabled && i != 0 {
+		AddReplyError(c, "SELECT is not allowed in cluster mode")
 	} else {
 		if SelectDB(c, i) == C_ERR {
 			AddReplyError(c, "DB index is out of range")
 		} else {
-			AddReply(c, kiwiS.Shared.Ok)
+			AddReply(c, c.srv.Shared.Ok)
 		}
 	}
 }
+
+/* PING [message]: reply with PONG, or with the message as a bulk. */
+var PingCommand CommandProcess = func(c *KiwiClient) {
+	if c.Argc > 2 {
+		AddReplyError(c, "wrong number of arguments for 'ping' command")
+		return
+	}
+	if c.Argc == 1 {
+		AddReply(c, c.srv.Shared.Pong)
+	} else {
+		AddReplyBulkStr(c, c.Argv[1])
+	}
+}
+
+var EchoCommand CommandProcess = func(c *KiwiClient) {
+	AddReplyBulkStr(c, c.Argv[1])
+}
 //
 //var RandomKeyCommand CommandProcess = func(c *KiwiClient) {
 //	key, value := c.Db.RandGet()
 //	if key == "" && value == nil {
-//		AddReply( c, kiwiS.Shared.NullBulk)
+//		AddReply( c, kiwiS.Shared.Null[c.Resp])
 //	} else {
 //		AddReplyBulkStr( c, key)
 //	}
 //}
 
-//var ExpireCommand CommandProcess = func(c *KiwiClient) {
-//	key, timeStr := c.Argv[0], c.Argv[1]
-//	timeMs := strconv.
-//
-//}
\ No newline at end of file
+/* Reply with the flags of the command as a multi bulk of status replies. */
+func addReplyCommandFlags(c *KiwiClient, cmd *Command) {
+	flagNames := []struct {
+		flag int
+		name string
+	}{
+		{CMD_WRITE, "write"},
+		{CMD_READONLY, "readonly"},
+		{CMD_DENYOOM, "denyoom"},
+		{CMD_ADMIN, "admin"},
+		{CMD_PUBSUB, "pubsub"},
+		{CMD_NOSCRIPT, "noscript"},
+		{CMD_RANDOM, "random"},
+		{CMD_SORT_FOR_SCRIPT, "sort_for_script"},
+		{CMD_LOADING, "loading"},
+		{CMD_STALE, "stale"},
+		{CMD_SKIP_MONITOR, "skip_monitor"},
+		{CMD_ASKING, "asking"},
+		{CMD_FAST, "fast"},
+	}
+	flags := []string{}
+	for _, f := range flagNames {
+		if cmd.WithFlags(f.flag) {
+			flags = append(flags, f.name)
+		}
+	}
+	if cmd.GetKeyProcess != nil {
+		flags = append(flags, "movablekeys")
+	}
+	AddReplySetLen(c, len(flags))
+	for _, flag := range flags {
+		AddReplyStatus(c, flag)
+	}
+}
+
+/* Output the representation of a command for COMMAND and COMMAND INFO. */
+func addReplyCommand(c *KiwiClient, cmd *Command) {
+	if cmd == nil {
+		AddReplyNull(c)
+		return
+	}
+	AddReplyMultiBulkLen(c, 6)
+	AddReplyBulkStr(c, cmd.Name)
+	AddReplyInt(c, cmd.Arity)
+	addReplyCommandFlags(c, cmd)
+	AddReplyInt(c, cmd.FirstKey)
+	AddReplyInt(c, cmd.LastKey)
+	AddReplyInt(c, cmd.KeyStep)
+}
+
+/* Output the statistics of a command for COMMAND STATS: calls, time spent,
+ * rejected and failed calls and the latency percentiles in microseconds. */
+func addReplyCommandStats(c *KiwiClient, cmd *Command) {
+	calls := atomic.LoadInt64(&cmd.Calls)
+	usec := atomic.LoadInt64(&cmd.Microseconds)
+	usecPerCall := 0.0
+	if calls > 0 {
+		usecPerCall = float64(usec) / float64(calls)
+	}
+	percentiles := c.srv.LatencyTrackingInfoPercentiles
+	AddReplyMapLen(c, 6+len(percentiles))
+	AddReplyBulkStr(c, "name")
+	AddReplyBulkStr(c, cmd.Name)
+	AddReplyBulkStr(c, "calls")
+	AddReplyInt(c, int(calls))
+	AddReplyBulkStr(c, "usec")
+	AddReplyInt(c, int(usec))
+	AddReplyBulkStr(c, "usec_per_call")
+	AddReplyDouble(c, usecPerCall)
+	AddReplyBulkStr(c, "rejected_calls")
+	AddReplyInt(c, int(atomic.LoadInt64(&cmd.RejectedCalls)))
+	AddReplyBulkStr(c, "failed_calls")
+	AddReplyInt(c, int(atomic.LoadInt64(&cmd.FailedCalls)))
+	for _, p := range percentiles {
+		AddReplyBulkStr(c, "p"+strconv.FormatFloat(p, 'f', -1, 64))
+		AddReplyDouble(c, float64(cmd.LatencyHistogram.ValueAtPercentile(p))/1000)
+	}
+}
+
+/* COMMAND [COUNT | INFO <command-name> ... | STATS [<command-name> ...]] */
+var CommandCommand CommandProcess = func(c *KiwiClient) {
+	if c.Argc == 1 {
+		cmds := c.srv.sortedCommands()
+		AddReplyMultiBulkLen(c, len(cmds))
+		for _, cmd := range cmds {
+			addReplyCommand(c, cmd)
+		}
+		return
+	}
+	sub := strings.ToLower(c.Argv[1])
+	if c.Argc == 2 && sub == "help" {
+		AddReplyHelp(c, []string{
+			"(no subcommand) -- Return details about all Kiwi commands.",
+			"COUNT -- Return the total number of commands in this Kiwi server.",
+			"INFO <command-name> [<command-name> ...] -- Return details about multiple Kiwi commands.",
+			"STATS [<command-name> ...] -- Return calls, time spent, rejected and failed calls and latency percentiles of the commands, only the called commands if no name is given.",
+		})
+	} else if c.Argc == 2 && sub == "count" {
+		AddReplyInt(c, len(c.srv.Commands))
+	} else if c.Argc >= 3 && sub == "info" {
+		AddReplyMultiBulkLen(c, c.Argc-2)
+		for j := 2; j < c.Argc; j++ {
+			addReplyCommand(c, c.srv.LookUpCommand(strings.ToLower(c.Argv[j])))
+		}
+	} else if sub == "stats" {
+		cmds := []*Command{}
+		if c.Argc == 2 {
+			for _, cmd := range c.srv.sortedCommands() {
+				if atomic.LoadInt64(&cmd.Calls) > 0 || atomic.LoadInt64(&cmd.RejectedCalls) > 0 {
+					cmds = append(cmds, cmd)
+				}
+			}
+		} else {
+			for j := 2; j < c.Argc; j++ {
+				cmd := c.srv.LookUpCommand(strings.ToLower(c.Argv[j]))
+				if cmd == nil {
+					AddReplyErrorFormat(c, "Unknown command '%s'", c.Argv[j])
+					return
+				}
+				cmds = append(cmds, cmd)
+			}
+		}
+		AddReplyMultiBulkLen(c, len(cmds))
+		for _, cmd := range cmds {
+			addReplyCommandStats(c, cmd)
+		}
+	} else {
+		AddReplySubcommandSyntaxError(c)
+	}
+}
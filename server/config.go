@@ -0,0 +1,924 @@
+package server
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+/*-----------------------------------------------------------------------------
+ * Config file name-value maps.
+ *----------------------------------------------------------------------------*/
+
+type ConfigEnum struct {
+	Name  string
+	Value int
+}
+
+var LogLevelEnum = []ConfigEnum{
+	{"debug", LL_DEBUG},
+	{"verbose", LL_INFO},
+	{"notice", LL_NOTICE},
+	{"warning", LL_WARNING},
+}
+
+func configEnumGetValue(enums []ConfigEnum, name string) (int, bool) {
+	for _, e := range enums {
+		if strings.EqualFold(e.Name, name) {
+			return e.Value, true
+		}
+	}
+	return 0, false
+}
+
+func configEnumGetName(enums []ConfigEnum, val int) string {
+	for _, e := range enums {
+		if e.Value == val {
+			return e.Name
+		}
+	}
+	return "unknown"
+}
+
+func configEnumNames(enums []ConfigEnum) string {
+	names := make([]string, len(enums))
+	for i, e := range enums {
+		names[i] = e.Name
+	}
+	return strings.Join(names, ", ")
+}
+
+/*-----------------------------------------------------------------------------
+ * Config table.
+ *
+ * Every configuration directive is described by a StandardConfig: Set()
+ * validates and applies a value given in the config file form, Get()
+ * returns the current value in the same form, so that it can be used by
+ * CONFIG GET and written back by CONFIG REWRITE.
+ *----------------------------------------------------------------------------*/
+
+type StandardConfig struct {
+	Name  string // The user visible name of this config
+	Alias string // An alias that can also be used for this config
+	Flags int    // Flags for this specific config
+	// Validate and apply the config value. The value is an array because
+	// some configs, like "bind", accept multiple arguments.
+	Set func(argv []string) error
+	Get func() string
+	// Called after a successful CONFIG SET, to apply the value at runtime.
+	Apply func() error
+}
+
+var (
+	errWrongArgs     = errors.New("wrong number of arguments")
+	errNotYesNo      = errors.New("argument must be 'yes' or 'no'")
+	errNotInteger    = errors.New("argument couldn't be parsed into an integer")
+	errNotMemory     = errors.New("argument must be a memory value")
+	errImmutable     = errors.New("can't set immutable config")
+	errUnknownConfig = errors.New("unrecognized parameter")
+)
+
+func createBoolConfig(name, alias string, flags int, ptr *bool) *StandardConfig {
+	return &StandardConfig{Name: name, Alias: alias, Flags: flags,
+		Set: func(argv []string) error {
+			if len(argv) != 1 {
+				return errWrongArgs
+			}
+			switch strings.ToLower(argv[0]) {
+			case "yes":
+				*ptr = true
+			case "no":
+				*ptr = false
+			default:
+				return errNotYesNo
+			}
+			return nil
+		},
+		Get: func() string {
+			if *ptr {
+				return "yes"
+			}
+			return "no"
+		},
+	}
+}
+
+func createStringConfig(name, alias string, flags int, ptr *string) *StandardConfig {
+	return &StandardConfig{Name: name, Alias: alias, Flags: flags,
+		Set: func(argv []string) error {
+			if len(argv) != 1 {
+				return errWrongArgs
+			}
+			*ptr = argv[0]
+			return nil
+		},
+		Get: func() string {
+			return *ptr
+		},
+	}
+}
+
+func createEnumConfig(name, alias string, flags int, ptr *int, enums []ConfigEnum) *StandardConfig {
+	return &StandardConfig{Name: name, Alias: alias, Flags: flags,
+		Set: func(argv []string) error {
+			if len(argv) != 1 {
+				return errWrongArgs
+			}
+			val, ok := configEnumGetValue(enums, argv[0])
+			if !ok {
+				return fmt.Errorf("argument(s) must be one of the following: %s", configEnumNames(enums))
+			}
+			*ptr = val
+			return nil
+		},
+		Get: func() string {
+			return configEnumGetName(enums, *ptr)
+		},
+	}
+}
+
+/* Parse a numeric config value in the range [min, max]. Memory configs
+ * also accept the units understood by MemToLL(). */
+func parseNumericConfig(val string, min, max int64, isMemory bool) (int64, error) {
+	var ll int64
+	if isMemory {
+		var ok bool
+		if ll, ok = MemToLL(val); !ok {
+			return 0, errNotMemory
+		}
+	} else {
+		var err error
+		if ll, err = strconv.ParseInt(val, 10, 64); err != nil {
+			return 0, errNotInteger
+		}
+	}
+	if ll < min || ll > max {
+		return 0, fmt.Errorf("argument must be between %d and %d inclusive", min, max)
+	}
+	return ll, nil
+}
+
+func createIntConfig(name, alias string, flags int, ptr *int, min, max int64, isMemory bool) *StandardConfig {
+	return &StandardConfig{Name: name, Alias: alias, Flags: flags,
+		Set: func(argv []string) error {
+			if len(argv) != 1 {
+				return errWrongArgs
+			}
+			ll, err := parseNumericConfig(argv[0], min, max, isMemory)
+			if err != nil {
+				return err
+			}
+			*ptr = int(ll)
+			return nil
+		},
+		Get: func() string {
+			return strconv.Itoa(*ptr)
+		},
+	}
+}
+
+func createInt64Config(name, alias string, flags int, ptr *int64, min, max int64, isMemory bool) *StandardConfig {
+	return &StandardConfig{Name: name, Alias: alias, Flags: flags,
+		Set: func(argv []string) error {
+			if len(argv) != 1 {
+				return errWrongArgs
+			}
+			ll, err := parseNumericConfig(argv[0], min, max, isMemory)
+			if err != nil {
+				return err
+			}
+			*ptr = ll
+			return nil
+		},
+		Get: func() string {
+			return strconv.FormatInt(*ptr, 10)
+		},
+	}
+}
+
+/* A duration expressed in the config file as an integer number of 'unit'. */
+func createDurationConfig(name, alias string, flags int, ptr *time.Duration, unit time.Duration, min, max int64) *StandardConfig {
+	return &StandardConfig{Name: name, Alias: alias, Flags: flags,
+		Set: func(argv []string) error {
+			if len(argv) != 1 {
+				return errWrongArgs
+			}
+			ll, err := parseNumericConfig(argv[0], min, max, false)
+			if err != nil {
+				return err
+			}
+			*ptr = time.Duration(ll) * unit
+			return nil
+		},
+		Get: func() string {
+			return strconv.FormatInt(int64(*ptr/unit), 10)
+		},
+	}
+}
+
+/* Build the config table, binding every directive to the field of the
+ * server it controls. */
+func (s *Server) InitConfigTable() {
+	s.configTable = []*StandardConfig{
+		/* Bool configs */
+		createBoolConfig("protected-mode", "", 0, &s.ProtectedMode),
+		createBoolConfig("tcp-keepalive", "", 0, &s.TcpKeepAlive),
+		createBoolConfig("reuseport", "", IMMUTABLE_CONFIG, &s.reusePort),
+		createBoolConfig("latency-tracking", "", 0, &s.LatencyTrackingEnabled),
+		createBoolConfig("cluster-enabled", "", IMMUTABLE_CONFIG, &s.ClusterEnabled),
+		createBoolConfig("cluster-require-full-coverage", "", 0, &s.ClusterRequireFullCoverage),
+		createBoolConfig("tls-cluster", "", IMMUTABLE_CONFIG, &s.TlsCluster),
+		createBoolConfig("partitioned-keyspace", "", IMMUTABLE_CONFIG, &s.PartitionedKeyspace),
+
+		/* String configs */
+		createStringConfig("pidfile", "", IMMUTABLE_CONFIG, &s.PidFile),
+		createStringConfig("unixsocket", "", IMMUTABLE_CONFIG, &s.UnixSocketPath),
+		createStringConfig("cluster-config-file", "", IMMUTABLE_CONFIG, &s.ClusterConfigFile),
+		createStringConfig("cluster-announce-ip", "", 0, &s.ClusterAnnounceIp),
+		createStringConfig("aclfile", "", IMMUTABLE_CONFIG, &s.AclFile),
+		createStringConfig("tls-cert-file", "", 0, &s.TlsCertFile),
+		createStringConfig("tls-key-file", "", 0, &s.TlsKeyFile),
+		createStringConfig("tls-ca-cert-file", "", 0, &s.TlsCaCertFile),
+		createStringConfig("tls-ca-cert-dir", "", 0, &s.TlsCaCertDir),
+		createStringConfig("tls-protocols", "", 0, &s.TlsProtocols),
+
+		/* Enum configs */
+		createEnumConfig("loglevel", "", 0, &s.LogLevel, LogLevelEnum),
+		createEnumConfig("maxmemory-policy", "", 0, &s.MaxMemoryPolicy, MaxMemoryPolicyTable),
+		createEnumConfig("tls-auth-clients", "", 0, &s.TlsAuthClients, TlsAuthClientsEnum),
+		createEnumConfig("supervised", "", IMMUTABLE_CONFIG, &s.SupervisedMode, SupervisedModeEnum),
+
+		/* Integer configs */
+		createIntConfig("port", "", IMMUTABLE_CONFIG, &s.Port, 0, 65535, false),
+		createIntConfig("tls-port", "", IMMUTABLE_CONFIG, &s.TlsPort, 0, 65535, false),
+		createIntConfig("databases", "", IMMUTABLE_CONFIG, &s.DbNum, 1, DEFAULT_DB_NUM, false),
+		createIntConfig("hz", "", 0, &s.Hz, CONFIG_MIN_HZ, CONFIG_MAX_HZ, false),
+		createIntConfig("shutdown-timeout", "", 0, &s.ShutdownTimeout, 0, 1<<31-1, false),
+		createIntConfig("event-loops", "", IMMUTABLE_CONFIG, &s.numLoops, -1, 1024, false),
+		createIntConfig("maxmemory-samples", "", 0, &s.MaxMemorySamples, 1, 64, false),
+		createIntConfig("lfu-log-factor", "", 0, &s.LfuLogFactor, 0, 1<<31-1, false),
+		createIntConfig("lfu-decay-time", "", 0, &s.LfuDecayTime, 0, 1<<31-1, false),
+		createIntConfig("slowlog-max-len", "", 0, &s.SlowlogMaxLen, 0, 1<<31-1, false),
+		createIntConfig("acllog-max-len", "", 0, &s.AclLogMaxLen, 0, 1<<31-1, false),
+		createInt64Config("maxclients", "", 0, &s.MaxClients, 1, 1<<31-1, false),
+		createInt64Config("slowlog-log-slower-than", "", 0, &s.SlowlogLogSlowerThan, -1, 1<<63-1, false),
+		createInt64Config("latency-monitor-threshold", "", 0, &s.LatencyMonitorThreshold, 0, 1<<63-1, false),
+
+		/* Memory configs */
+		createIntConfig("maxmemory", "", 0, &s.MaxMemory, 0, 1<<63-1, true),
+		createIntConfig("maxmemory-clients", "", 0, &s.MaxMemoryClients, 0, 1<<63-1, true),
+		createIntConfig("proto-max-bulk-len", "", 0, &s.ProtoMaxBulkLen, 1024*1024, 1<<63-1, true),
+		createIntConfig("client-query-buffer-limit", "", 0, &s.ClientMaxQueryBufLen, 1024*1024, 1<<63-1, true),
+
+		/* Duration configs */
+		createDurationConfig("timeout", "", 0, &s.ClientMaxIdleTime, time.Second, 0, 1<<31-1),
+		createDurationConfig("cluster-node-timeout", "", 0, &s.ClusterNodeTimeout, time.Millisecond, 0, 1<<63-1),
+		createDurationConfig("tls-handshake-timeout", "", IMMUTABLE_CONFIG, &s.TlsHandshakeTimeout, time.Millisecond, 1, 1<<63-1),
+
+		/* Special configs */
+		{Name: "requirepass", Flags: SENSITIVE_CONFIG,
+			Set: func(argv []string) error {
+				if len(argv) != 1 {
+					return errWrongArgs
+				}
+				// The old "requirepass" directive just translates to setting
+				// a password to the default user. The only thing we do
+				// additionally is to remember the cleartext password, so
+				// that CONFIG GET keeps working. The empty string disables
+				// authentication.
+				if argv[0] == "" {
+					s.RequirePassword = nil
+				} else {
+					password := argv[0]
+					s.RequirePassword = &password
+				}
+				s.ACLUpdateDefaultUserPassword(argv[0])
+				return nil
+			},
+			Get: func() string {
+				if s.RequirePassword == nil {
+					return ""
+				}
+				return *s.RequirePassword
+			},
+		},
+		{Name: "bind", Flags: IMMUTABLE_CONFIG | MULTI_ARG_CONFIG,
+			Set: func(argv []string) error {
+				if len(argv) == 0 || len(argv) > CONFIG_BINDADDR_MAX {
+					return errors.New("Too many bind addresses specified.")
+				}
+				s.BindAddrs = append([]string{}, argv...)
+				s.BindAddrCount = len(argv)
+				return nil
+			},
+			Get: func() string {
+				return strings.Join(s.BindAddrs, " ")
+			},
+		},
+		{Name: "latency-tracking-info-percentiles", Flags: MULTI_ARG_CONFIG,
+			Set: func(argv []string) error {
+				percentiles := make([]float64, 0, len(argv))
+				for _, arg := range argv {
+					// An empty string clears the percentiles list.
+					if arg == "" && len(argv) == 1 {
+						break
+					}
+					p, err := strconv.ParseFloat(arg, 64)
+					if err != nil || p < 0 || p > 100 {
+						return errors.New("latency-tracking-info-percentiles should be a list of numbers between 0 and 100")
+					}
+					percentiles = append(percentiles, p)
+				}
+				s.LatencyTrackingInfoPercentiles = percentiles
+				return nil
+			},
+			Get: func() string {
+				values := make([]string, len(s.LatencyTrackingInfoPercentiles))
+				for i, p := range s.LatencyTrackingInfoPercentiles {
+					values[i] = strconv.FormatFloat(p, 'f', -1, 64)
+				}
+				return strings.Join(values, " ")
+			},
+		},
+	}
+
+	// Runtime side effects of CONFIG SET.
+	applyMaxMemory := func() error {
+		if s.MaxMemory > 0 && int64(s.MaxMemory) < s.UsedMemory {
+			s.ServerLogWarnF("WARNING: the new maxmemory value set via CONFIG SET (%d) is smaller "+
+				"than the current memory usage (%d). This will result in key eviction and/or "+
+				"the inability to accept new write commands depending on the maxmemory-policy.\n",
+				s.MaxMemory, s.UsedMemory)
+		}
+		s.FreeMemoryIfNeeded()
+		return nil
+	}
+	s.LookupConfig("maxmemory").Apply = applyMaxMemory
+	s.LookupConfig("maxmemory-policy").Apply = applyMaxMemory
+	for _, name := range []string{"tls-cert-file", "tls-key-file", "tls-ca-cert-file",
+		"tls-ca-cert-dir", "tls-protocols", "tls-auth-clients"} {
+		s.LookupConfig(name).Apply = s.applyTlsCfg
+	}
+
+	// Remember the default of every config, so that CONFIG REWRITE only
+	// writes the values that were changed.
+	s.configDefaults = make(map[string]string, len(s.configTable))
+	for _, config := range s.configTable {
+		s.configDefaults[config.Name] = config.Get()
+	}
+}
+
+/* Lookup a config by the provided name or alias. */
+func (s *Server) LookupConfig(name string) *StandardConfig {
+	for _, config := range s.configTable {
+		if strings.EqualFold(config.Name, name) || (config.Alias != "" && strings.EqualFold(config.Alias, name)) {
+			return config
+		}
+	}
+	return nil
+}
+
+/*-----------------------------------------------------------------------------
+ * Config file parsing
+ *----------------------------------------------------------------------------*/
+
+/* Convert a string representing an amount of memory into the number of
+ * bytes, so for instance MemToLL("1Gb") will return 1073741824 that is
+ * (1024*1024*1024).
+ *
+ * On parsing error, if the value is negative or out of range, false is
+ * returned. */
+func MemToLL(p string) (int64, bool) {
+	unit := strings.IndexFunc(p, func(r rune) bool {
+		return !(r >= '0' && r <= '9') && r != '-'
+	})
+	num := p
+	mul := int64(1)
+	if unit != -1 {
+		num = p[:unit]
+		switch strings.ToLower(p[unit:]) {
+		case "b":
+			mul = 1
+		case "k":
+			mul = 1000
+		case "kb":
+			mul = 1024
+		case "m":
+			mul = 1000 * 1000
+		case "mb":
+			mul = 1024 * 1024
+		case "g":
+			mul = 1000 * 1000 * 1000
+		case "gb":
+			mul = 1024 * 1024 * 1024
+		default:
+			return 0, false
+		}
+	}
+	val, err := strconv.ParseInt(num, 10, 64)
+	if err != nil || val < 0 {
+		return 0, false
+	}
+	if mul > 1 && val > (1<<63-1)/mul {
+		return 0, false // Overflow
+	}
+	return val * mul, true
+}
+
+type configError struct {
+	linenum int
+	line    string
+	err     string
+}
+
+func (e *configError) Error() string {
+	return fmt.Sprintf("\n*** FATAL CONFIG FILE ERROR (Kiwi %s) ***\n"+
+		"Reading the configuration file, at line %d\n>>> '%s'\n%s",
+		KIWI_VERSION, e.linenum, e.line, e.err)
+}
+
+/* The state of a configuration being loaded, across the included files. */
+type configLoader struct {
+	s      *Server
+	reload bool
+	depth  int // Nesting of the include directive being loaded
+	// On reload the side effects of the configs are applied once all of
+	// them are set, so that related configs (like a certificate and its
+	// key) change together.
+	applied     []*StandardConfig
+	appliedErrs []*configError
+	// On reload the old values of the configs set, to restore them on
+	// failure.
+	oldConfigs []*StandardConfig
+	oldValues  []string
+}
+
+/* Parse the configuration in 'config', one directive per line. When
+ * 'reload' is true we are reloading the configuration on SIGHUP: the
+ * immutable configs can't change, so they are only checked, and on error
+ * the configs already set are restored like CONFIG SET does. */
+func (s *Server) LoadServerConfigFromString(config string, reload bool) error {
+	l := &configLoader{s: s, reload: reload}
+	err := l.load(config)
+	for i := 0; err == nil && i < len(l.applied); i++ {
+		if err = l.applied[i].Apply(); err != nil {
+			l.appliedErrs[i].err = err.Error()
+			err = l.appliedErrs[i]
+		}
+	}
+	if err != nil && reload {
+		for i := len(l.oldConfigs) - 1; i >= 0; i-- {
+			config := l.oldConfigs[i]
+			config.Set(configArgv(config, l.oldValues[i]))
+			if config.Apply != nil {
+				config.Apply()
+			}
+		}
+	}
+	return err
+}
+
+func (l *configLoader) load(config string) error {
+	s := l.s
+	lines := strings.Split(config, "\n")
+	for i, line := range lines {
+		linenum := i + 1
+		line = strings.TrimSpace(line)
+
+		// Skip comments and blank lines
+		if line == "" || line[0] == '#' {
+			continue
+		}
+
+		// Split into arguments
+		argv := SplitArgs([]byte(line))
+		if argv == nil {
+			return &configError{linenum, line, "Unbalanced quotes in configuration line"}
+		}
+
+		// Skip this line if the resulting command vector is empty.
+		if len(argv) == 0 {
+			continue
+		}
+		name := strings.ToLower(argv[0])
+
+		// Execute config directives
+		if name == "include" && len(argv) == 2 {
+			// A file including itself would recurse forever.
+			if l.depth >= CONFIG_MAX_INCLUDE_DEPTH {
+				return &configError{linenum, line, "Too many nested includes"}
+			}
+			content, err := readConfigFile(argv[1])
+			if err != nil {
+				return err
+			}
+			l.depth++
+			err = l.load(content)
+			l.depth--
+			if err != nil {
+				return err
+			}
+			continue
+		}
+		config := s.LookupConfig(name)
+		if config == nil {
+			return &configError{linenum, line, "Bad directive or wrong number of arguments"}
+		}
+		if config.Flags&MULTI_ARG_CONFIG == 0 && len(argv) != 2 {
+			return &configError{linenum, line, "wrong number of arguments"}
+		}
+		if l.reload && config.Flags&IMMUTABLE_CONFIG != 0 {
+			if config.Get() != strings.Join(argv[1:], " ") {
+				s.ServerLogWarnF("Config '%s' can't be changed without a restart, ignoring it.\n",
+					config.Name)
+			}
+			continue
+		}
+		if l.reload {
+			l.oldConfigs = append(l.oldConfigs, config)
+			l.oldValues = append(l.oldValues, config.Get())
+		}
+		if err := config.Set(argv[1:]); err != nil {
+			return &configError{linenum, line, err.Error()}
+		}
+		if l.reload && config.Apply != nil {
+			l.applied = append(l.applied, config)
+			l.appliedErrs = append(l.appliedErrs, &configError{linenum, line, ""})
+		}
+	}
+	return nil
+}
+
+/* Read a config file, "-" reads the config from stdin. */
+func readConfigFile(filename string) (string, error) {
+	var content []byte
+	var err error
+	if filename == "-" {
+		content, err = ioutil.ReadAll(os.Stdin)
+	} else {
+		content, err = ioutil.ReadFile(filename)
+	}
+	if err != nil {
+		return "", fmt.Errorf("Fatal error, can't open config file '%s': %v", filename, err)
+	}
+	return string(content), nil
+}
+
+/* Load the server configuration from the specified filename.
+ * The function appends the additional configuration directives stored
+ * in the 'options' string to the config file before loading.
+ *
+ * Both filename and options can be empty, in such a case are considered
+ * empty. This way LoadServerConfig can be used to just load a file or
+ * just load a string. A filename of "-" reads the config from stdin. */
+func (s *Server) LoadServerConfig(filename string, options string, reload bool) error {
+	var config strings.Builder
+
+	// Load the file content
+	if filename != "" {
+		content, err := readConfigFile(filename)
+		if err != nil {
+			return err
+		}
+		config.WriteString(content)
+		config.WriteByte('\n')
+	}
+
+	// Append the additional options
+	if options != "" {
+		config.WriteString(options)
+	}
+	return s.LoadServerConfigFromString(config.String(), reload)
+}
+
+/* Parse the command line of the server:
+ *
+ *   kiwi-server [/path/to/kiwi.conf] [options] [-]
+ *
+ * The first argument, if it does not start with "--", is the config file.
+ * Every "--name" starts a new directive, so that for instance
+ * "--port 6380 --bind 127.0.0.1 ::1" is turned into the config lines
+ * "port 6380" and "bind 127.0.0.1 ::1". A lone "-" reads the config from
+ * stdin. */
+func ParseCommandLineConfig(args []string) (configfile string, options string) {
+	j := 0
+	if len(args) > 0 && !strings.HasPrefix(args[0], "--") {
+		configfile = args[0]
+		j = 1
+	}
+	var opts strings.Builder
+	for ; j < len(args); j++ {
+		arg := args[j]
+		if arg == "-" && configfile == "" {
+			configfile = "-"
+		} else if strings.HasPrefix(arg, "--") {
+			// Option name
+			if opts.Len() != 0 {
+				opts.WriteByte('\n')
+			}
+			opts.WriteString(arg[2:])
+			opts.WriteByte(' ')
+		} else {
+			// Option argument
+			opts.WriteString(CatRepr(arg))
+			opts.WriteByte(' ')
+		}
+	}
+	return configfile, opts.String()
+}
+
+/* Reload the config file on SIGHUP. The command line options still
+ * override the file, as they did at startup. The immutable configs are
+ * left untouched, the other ones are set and applied as CONFIG SET would:
+ * all of them or none. It runs between commands, like the cron job. */
+func (s *Server) ReloadServerConfig() {
+	s.LockKeyspace(CRON_LOOP)
+	defer s.UnlockKeyspace()
+	if s.ConfigFile == "" {
+		s.ServerLogWarnF("SIGHUP received but the server is running without a config file.\n")
+		return
+	}
+	if err := s.LoadServerConfig(s.ConfigFile, s.ConfigOptions, true); err != nil {
+		s.ServerLogWarnF("Error reloading config file %s: %v\n", s.ConfigFile, err)
+		return
+	}
+	s.ServerLogNoticeF("Config file %s reloaded.\n", s.ConfigFile)
+}
+
+/*-----------------------------------------------------------------------------
+ * CONFIG SET implementation
+ *----------------------------------------------------------------------------*/
+
+/* Split a CONFIG SET value into the arguments of the config: configs
+ * accepting multiple arguments are split like a config file line. */
+func configArgv(config *StandardConfig, value string) []string {
+	if config.Flags&MULTI_ARG_CONFIG == 0 {
+		return []string{value}
+	}
+	argv := SplitArgs([]byte(value))
+	if len(argv) == 0 {
+		return []string{""}
+	}
+	return argv
+}
+
+func ConfigSetCommand(c *KiwiClient) {
+	if c.Argc < 4 || c.Argc%2 != 0 {
+		AddReplyErrorObject(c, c.srv.Shared.SyntaxErr)
+		return
+	}
+	n := (c.Argc - 2) / 2
+	configs := make([]*StandardConfig, n)
+	values := make([]string, n)
+	oldValues := make([]string, n)
+	var errArg string
+	var err error
+
+	// Find all relevant configs
+	for i := 0; i < n; i++ {
+		config := c.srv.LookupConfig(c.Argv[2+i*2])
+		// Fail if we couldn't find this config
+		if config == nil {
+			errArg, err = c.Argv[2+i*2], errUnknownConfig
+			break
+		}
+		// Note: it's important we run over ALL passed configs and check if
+		// we need to call a fatal error instead of failing on the first one.
+		if config.Flags&IMMUTABLE_CONFIG != 0 {
+			errArg, err = c.Argv[2+i*2], errImmutable
+			break
+		}
+		for j := 0; j < i; j++ {
+			if configs[j] == config {
+				errArg, err = c.Argv[2+i*2], errors.New("duplicate parameter")
+				break
+			}
+		}
+		if err != nil {
+			break
+		}
+		configs[i] = config
+		values[i] = c.Argv[2+i*2+1]
+	}
+	if err == nil {
+		// Set all the configs, and apply them once all were set.
+		set := 0
+		for ; set < n; set++ {
+			oldValues[set] = configs[set].Get()
+			if err = configs[set].Set(configArgv(configs[set], values[set])); err != nil {
+				errArg = configs[set].Name
+				break
+			}
+		}
+		for i := 0; err == nil && i < n; i++ {
+			if configs[i].Apply != nil {
+				if err = configs[i].Apply(); err != nil {
+					errArg = configs[i].Name
+				}
+			}
+		}
+		// On failure restore the old values of the configs we already set.
+		if err != nil {
+			for i := 0; i < set; i++ {
+				configs[i].Set(configArgv(configs[i], oldValues[i]))
+				if configs[i].Apply != nil {
+					configs[i].Apply()
+				}
+			}
+		}
+	}
+	if err != nil {
+		AddReplyErrorFormat(c, "CONFIG SET failed (possibly related to argument '%s') - %s", errArg, err)
+		return
+	}
+	AddReply(c, c.srv.Shared.Ok)
+}
+
+/*-----------------------------------------------------------------------------
+ * CONFIG GET implementation
+ *----------------------------------------------------------------------------*/
+
+func ConfigGetCommand(c *KiwiClient) {
+	matches := map[string]string{}
+	for i := 2; i < c.Argc; i++ {
+		pattern := c.Argv[i]
+		for _, config := range c.srv.configTable {
+			if StringMatch(pattern, config.Name, true) {
+				matches[config.Name] = config.Get()
+			}
+			if config.Alias != "" && StringMatch(pattern, config.Alias, true) {
+				matches[config.Alias] = config.Get()
+			}
+		}
+	}
+	names := make([]string, 0, len(matches))
+	for name := range matches {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	AddReplyMapLen(c, len(names))
+	for _, name := range names {
+		AddReplyBulkStr(c, name)
+		AddReplyBulkStr(c, matches[name])
+	}
+}
+
+/*-----------------------------------------------------------------------------
+ * CONFIG REWRITE implementation
+ *----------------------------------------------------------------------------*/
+
+const configRewriteSignature = "# Generated by CONFIG REWRITE"
+
+/* Return the config line for the given config, quoting the value when it
+ * contains spaces or special characters, so that it can be parsed back. */
+func configRewriteLine(config *StandardConfig) string {
+	value := config.Get()
+	if config.Flags&MULTI_ARG_CONFIG != 0 {
+		if value == "" {
+			return config.Name + " \"\""
+		}
+		return config.Name + " " + value
+	}
+	if value == "" || strings.ContainsAny(value, " \t\r\n\"'\\") {
+		value = CatRepr(value)
+	}
+	return config.Name + " " + value
+}
+
+/* Rewrite the configuration file at "path".
+ * If the configuration file already exists, we try at best to retain comments
+ * and overall structure.
+ *
+ * Configuration parameters that are at their default value, unless already
+ * explicitly included in the old configuration file, are not rewritten. */
+func (s *Server) RewriteConfig(path string) error {
+	var lines []string
+	if content, err := ioutil.ReadFile(path); err == nil {
+		lines = strings.Split(strings.TrimRight(string(content), "\n"), "\n")
+	} else if !os.IsNotExist(err) {
+		return err
+	}
+
+	// Map every option to the lines where it is set. The lines of the
+	// previous rewrite signature are dropped, a new one is appended if
+	// needed.
+	optionLines := map[*StandardConfig][]int{}
+	keep := make([]bool, len(lines))
+	for i, line := range lines {
+		keep[i] = true
+		trimmed := strings.TrimSpace(line)
+		if trimmed == configRewriteSignature {
+			keep[i] = false
+			continue
+		}
+		if trimmed == "" || trimmed[0] == '#' {
+			continue
+		}
+		argv := SplitArgs([]byte(trimmed))
+		if len(argv) == 0 {
+			continue
+		}
+		if config := s.LookupConfig(argv[0]); config != nil {
+			optionLines[config] = append(optionLines[config], i)
+		}
+	}
+
+	// Rewrite the options already present in the file in place, append
+	// the ones that differ from their default at the end.
+	var appended []string
+	for _, config := range s.configTable {
+		line := configRewriteLine(config)
+		if idx, ok := optionLines[config]; ok {
+			lines[idx[0]] = line
+			for _, j := range idx[1:] {
+				keep[j] = false
+			}
+		} else if config.Get() != s.configDefaults[config.Name] {
+			appended = append(appended, line)
+		}
+	}
+
+	var content strings.Builder
+	for i, line := range lines {
+		if keep[i] {
+			content.WriteString(line)
+			content.WriteByte('\n')
+		}
+	}
+	if len(appended) > 0 {
+		content.WriteString(configRewriteSignature)
+		content.WriteByte('\n')
+		for _, line := range appended {
+			content.WriteString(line)
+			content.WriteByte('\n')
+		}
+	}
+
+	// Write to a temporary file and rename it over the old one, so that
+	// a crash never leaves a truncated config file around.
+	tmpFile := fmt.Sprintf("%s/.kiwi-%d.conf.tmp", filepath.Dir(path), os.Getpid())
+	f, err := os.OpenFile(tmpFile, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+	w := bufio.NewWriter(f)
+	if _, err = w.WriteString(content.String()); err == nil {
+		if err = w.Flush(); err == nil {
+			err = f.Sync()
+		}
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(tmpFile, path)
+	}
+	if err != nil {
+		os.Remove(tmpFile)
+	}
+	return err
+}
+
+/*-----------------------------------------------------------------------------
+ * CONFIG command entry point
+ *----------------------------------------------------------------------------*/
+
+var ConfigCommand CommandProcess = func(c *KiwiClient) {
+	sub := strings.ToLower(c.Argv[1])
+	if c.Argc == 2 && sub == "help" {
+		AddReplyHelp(c, []string{
+			"GET <pattern> [<pattern> ...] -- Return parameters matching the glob-like <pattern> and their values.",
+			"SET <directive> <value> [<directive> <value> ...] -- Set the configuration <directive> to <value>.",
+			"RESETSTAT -- Reset statistics reported by INFO.",
+			"REWRITE -- Rewrite the configuration file.",
+		})
+	} else if c.Argc >= 3 && sub == "get" {
+		ConfigGetCommand(c)
+	} else if sub == "set" {
+		ConfigSetCommand(c)
+	} else if c.Argc == 2 && sub == "resetstat" {
+		c.srv.ResetServerStats()
+		AddReply(c, c.srv.Shared.Ok)
+	} else if c.Argc == 2 && sub == "rewrite" {
+		if c.srv.ConfigFile == "" {
+			AddReplyError(c, "The server is running without a config file")
+			return
+		}
+		if err := c.srv.RewriteConfig(c.srv.ConfigFile); err != nil {
+			c.srv.ServerLogWarnF("CONFIG REWRITE failed: %v\n", err)
+			AddReplyErrorFormat(c, "Rewriting config file: %v", err)
+		} else {
+			c.srv.ServerLogNoticeF("CONFIG REWRITE executed with success.\n")
+			AddReply(c, c.srv.Shared.Ok)
+		}
+	} else {
+		AddReplySubcommandSyntaxError(c)
+	}
+}
@@ -1,5 +1,8 @@
 package server
 
+const KIWI_VERSION = "0.1.0"
+const CONFIG_RUN_ID_SIZE = 40
+
 /* constants for Object */
 const OBJ_ENCODING_STR = 0
 const OBJ_ENCODING_INT = 1
@@ -32,7 +35,24 @@ const OBJ_SET_XX = 1 << 1 /* Set if key exists. */
 const OBJ_SET_EX = 1 << 2 /* Set if time in seconds is given */
 const OBJ_SET_PX = 1 << 3 /* Set if time in ms in given */
 
+/* List related stuff */
+const LIST_HEAD = 0
+const LIST_TAIL = 1
+
+/* ZADD flags */
+const ZADD_NONE = 0
+const ZADD_INCR = 1 << 0 /* Increment the score instead of setting it. */
+const ZADD_NX = 1 << 1   /* Don't touch elements not already existing. */
+const ZADD_XX = 1 << 2   /* Only touch elements already existing. */
+const ZADD_CH = 1 << 3   /* Return num of elements added or updated. */
+
+/* Set operations, see SetOperationGenericCommand() */
+const SET_OP_UNION = 0
+const SET_OP_DIFF = 1
+const SET_OP_INTER = 2
+
 const SHARED_INTEGERS = 10000
+const OBJ_SHARED_REFCOUNT = 1<<31 - 1 /* Refcount reported for shared objects */
 const SHARED_BULKHDR_LEN = 32
 
 const C_OK = 0
@@ -72,6 +92,14 @@ const CLIENT_REPLY_SKIP = 1 << 24      /* Don't send just this reply. */
 const CLIENT_LUA_DEBUG = 1 << 25       /* Run EVAL in debug mode. */
 const CLIENT_LUA_DEBUG_SYNC = 1 << 26  /* EVAL debugging without fork() */
 const CLIENT_MODULE = 1 << 27          /* Non connected client used by some module. */
+const CLIENT_NO_EVICT = 1 << 28        /* This client is protected against client memory eviction. */
+const CLIENT_INTERNAL = 1 << 29        /* Non connected client of the embedding program, see internal.go. */
+
+/* Client pause types, larger types are more restrictive
+ * pause types than smaller pause types. */
+const CLIENT_PAUSE_OFF = 0   /* Pause no commands */
+const CLIENT_PAUSE_WRITE = 1 /* Pause write commands */
+const CLIENT_PAUSE_ALL = 2   /* Pause all commands */
 
 /* KiwiClient request types */
 const PROTO_REQ_INLINE = 1
@@ -85,7 +113,9 @@ const BLOCKED_WAIT = 2   /* WAIT for synchronous replication. */
 const BLOCKED_MODULE = 3 /* Blocked by a loadable module. */
 const BLOCKED_STREAM = 4 /* XREAD. */
 const BLOCKED_ZSET = 5   /* BZPOP et al. */
-const BLOCKED_NUM = 6    /* Number of blocked states. */
+const BLOCKED_POSTPONE = 6 /* Blocked by CLIENT PAUSE */
+const BLOCKED_PARTITION = 7 /* Command forwarded to another event loop */
+const BLOCKED_NUM = 8    /* Number of blocked states. */
 
 /* Protocol and I/O related defines */
 const PROTO_MAX_QUERYBUF_LEN = 1024 * 1024 * 1024 /* 1GB max query buffer. */
@@ -98,6 +128,7 @@ const LONG_STR_SIZE = 21                      /* Bytes needed for long -> str +
 const REDIS_AUTOSYNC_BYTES = 1024 * 1024 * 32 /* fdatasync every 32MB */
 
 const LIMIT_PENDING_QUERYBUF = 4 * 1024 * 1024 /* 4mb */
+const PROTO_ASYNC_REPLY_MAX_LEN = 64 * 1024 * 1024 /* 64mb of queued monitor output */
 const CLIENT_TYPE_NORMAL = 0                   /* Normal req-reply clients + MONITORs */
 const CLIENT_TYPE_SLAVE = 1                    /* Slaves. */
 const CLIENT_TYPE_PUBSUB = 2                   /* Clients subscribed to PubSub channels. */
@@ -126,6 +157,21 @@ const LL_WARNING = 3
 const LL_RAW = (1 << 10) /* Modifier to log without timestamp */
 const CONFIG_DEFAULT_LOGLEVEL = LL_NOTICE
 
+/* Config flags */
+const IMMUTABLE_CONFIG = 1 << 0 /* Can this value only be set at startup? */
+const SENSITIVE_CONFIG = 1 << 1 /* Does this value contain sensitive information */
+const MULTI_ARG_CONFIG = 1 << 2 /* This config receives multiple arguments. */
+
+const CONFIG_MAX_INCLUDE_DEPTH = 16 /* Max nesting of the include directives */
+
+const CONFIG_MIN_HZ = 1
+const CONFIG_MAX_HZ = 500
+const CRON_LOOP = 0 /* Event loop running the cron job, see the Tick event */
+
+/* Partitioned keyspace, see partition.go */
+const PARTITION_NONE = -1 /* Keyless command, executed by any loop */
+const PARTITION_ALL = -2  /* Command executed with the world stopped */
+
 /* Command flags. Please check the command table defined in the redis.c file
  * for more information about the meaning of every flag. */
 const CMD_WRITE = 1 << 0              /* "w" flag */
@@ -144,6 +190,7 @@ const CMD_ASKING = 1 << 12            /* "k" flag */
 const CMD_FAST = 1 << 13              /* "F" flag */
 const CMD_MODULE_GETKEYS = 1 << 14    /* Use the modules getkeys interface. */
 const CMD_MODULE_NO_CLUSTER = 1 << 15 /* Deny on Redis Cluster. */
+const CMD_NO_AUTH = 1 << 16           /* "A" flag */
 
 /* Command call flags, see call() function */
 const CMD_CALL_NONE = 0
@@ -161,10 +208,164 @@ const PROPAGATE_REPL = 2
 
 const DEFAULT_DB_NUM = 16
 
+/* Instantaneous metrics tracking. */
+const STATS_METRIC_SAMPLES = 16   /* Number of samples per metric. */
+const STATS_METRIC_COMMAND = 0    /* Number of commands executed. */
+const STATS_METRIC_NET_INPUT = 1  /* Bytes read to network .*/
+const STATS_METRIC_NET_OUTPUT = 2 /* Bytes written to network. */
+const STATS_METRIC_COUNT = 3
+
+/* Latency histograms, see histogram.go */
+const HISTOGRAM_SUB_BUCKET_BITS = 4
+const HISTOGRAM_SUB_BUCKETS = 1 << HISTOGRAM_SUB_BUCKET_BITS
+const HISTOGRAM_BUCKETS = (64 - HISTOGRAM_SUB_BUCKET_BITS) * HISTOGRAM_SUB_BUCKETS
+
+/* Slow log */
+const SLOWLOG_ENTRY_MAX_ARGC = 32
+const SLOWLOG_ENTRY_MAX_STRING = 128
+const CONFIG_DEFAULT_SLOWLOG_LOG_SLOWER_THAN = 10000
+const CONFIG_DEFAULT_SLOWLOG_MAX_LEN = 128
+
+/* TLS client authentication, see tls.go */
+const TLS_CLIENT_AUTH_NO = 0
+const TLS_CLIENT_AUTH_YES = 1
+const TLS_CLIENT_AUTH_OPTIONAL = 2
+
+/* SHUTDOWN flags, see shutdown.go */
+const SHUTDOWN_NOFLAGS = 0 /* No flags. */
+const SHUTDOWN_SAVE = 1    /* Force SAVE on SHUTDOWN even if no save points are configured. */
+const SHUTDOWN_NOSAVE = 2  /* Don't SAVE on SHUTDOWN. */
+const SHUTDOWN_NOW = 4     /* Don't wait for the clients to read their replies. */
+const SHUTDOWN_FORCE = 8   /* Don't let errors prevent shutdown. */
+const CONFIG_DEFAULT_SHUTDOWN_TIMEOUT = 10 /* Seconds */
+
+/* Supervision modes, see supervised.go */
+const SUPERVISED_NONE = 0
+const SUPERVISED_AUTODETECT = 1
+const SUPERVISED_SYSTEMD = 2
+const SUPERVISED_UPSTART = 3
+
+/* ACL user flags, see acl.go */
+const USER_FLAG_ENABLED = 1 << 0 /* The user is active. */
+const USER_FLAG_ALLKEYS = 1 << 1 /* The user can mention any key. */
+const USER_FLAG_NOPASS = 1 << 2  /* The user requires no password, any provided password will work. */
+
+/* ACL check results and log reasons. */
+const ACL_OK = 0
+const ACL_DENIED_CMD = 1
+const ACL_DENIED_KEY = 2
+const ACL_DENIED_AUTH = 3 /* Only used for ACL LOG entries. */
+
+/* ACL log contexts. */
+const ACL_LOG_CTX_TOPLEVEL = 0
+const ACL_LOG_CTX_MULTI = 2
+
+const ACL_LOG_GROUPING_MAX_TIME_DELTA = 60000 /* Milliseconds. */
+const CONFIG_DEFAULT_ACLLOG_MAX_LEN = 128
+
+/* Latency monitor */
+const LATENCY_TS_LEN = 160 /* History length for every monitored event. */
+const LATENCY_GRAPH_ROWS = 4
+const CONFIG_DEFAULT_LATENCY_MONITOR_THRESHOLD = 0
+
+const ERROR_STATS_LIMIT = 128 /* Max number of error codes tracked in the error stats */
+
+/* Cluster */
+const CLUSTER_SLOTS = 16384
+const CLUSTER_OK = 0            /* Everything looks ok */
+const CLUSTER_FAIL = 1          /* The cluster can't work */
+const CLUSTER_NAMELEN = 40      /* sha1 hex length */
+const CLUSTER_PORT_INCR = 10000 /* Cluster port = baseport + PORT_INCR */
+const CLUSTER_DEFAULT_NODE_TIMEOUT = 15000
+const CLUSTER_DEFAULT_CONFIG_FILE = "nodes.conf"
+const CLUSTER_FAIL_REPORT_VALIDITY_MULT = 2 /* Fail report validity. */
+const CLUSTER_FAIL_UNDO_TIME_MULT = 2       /* Undo fail if master is back. */
+const CLUSTER_MAX_GOSSIP_ENTRIES = 3
+const CLUSTER_LINK_SEND_QUEUE = 256
+
+/* Redirection errors returned by GetNodeByQuery(). */
+const CLUSTER_REDIR_NONE = 0          /* Node can serve the request. */
+const CLUSTER_REDIR_CROSS_SLOT = 1    /* -CROSSSLOT request. */
+const CLUSTER_REDIR_UNSTABLE = 2      /* -TRYAGAIN redirection required */
+const CLUSTER_REDIR_ASK = 3           /* -ASK redirection required. */
+const CLUSTER_REDIR_MOVED = 4         /* -MOVED redirection required. */
+const CLUSTER_REDIR_DOWN_STATE = 5    /* -CLUSTERDOWN, global state. */
+const CLUSTER_REDIR_DOWN_UNBOUND = 6  /* -CLUSTERDOWN, unbound slot. */
+
+/* Cluster node flags and macros. */
+const CLUSTER_NODE_MASTER = 1 << 0    /* The node is a master */
+const CLUSTER_NODE_SLAVE = 1 << 1     /* The node is a slave */
+const CLUSTER_NODE_PFAIL = 1 << 2     /* Failure? Need acknowledge */
+const CLUSTER_NODE_FAIL = 1 << 3      /* The node is believed to be malfunctioning */
+const CLUSTER_NODE_MYSELF = 1 << 4    /* This node is myself */
+const CLUSTER_NODE_HANDSHAKE = 1 << 5 /* We have still to exchange the first ping */
+const CLUSTER_NODE_NOADDR = 1 << 6    /* We don't know the address of this node */
+const CLUSTER_NODE_MEET = 1 << 7      /* Send a MEET message to this node */
+
+/* Message types. */
+const CLUSTERMSG_TYPE_PING = 0   /* Ping */
+const CLUSTERMSG_TYPE_PONG = 1   /* Pong (reply to Ping) */
+const CLUSTERMSG_TYPE_MEET = 2   /* Meet "let's join" message */
+const CLUSTERMSG_TYPE_FAIL = 3   /* Mark node xxx as failing */
+const CLUSTERMSG_TYPE_UPDATE = 4 /* Another node slots configuration */
+const CLUSTERMSG_TYPE_COUNT = 5  /* Total number of message types. */
+
 const CONFIG_DEFAULT_PROTO_MAX_BULK_LEN = 512 * 1024 * 1024
 const CONFIG_DEFAULT_MAXMEMORY = 0
 const CONFIG_DEFAULT_MAX_CLIENTS = 10000
 
+/* Redis maxmemory strategies. Instead of using just incremental number
+ * for this defines, we use a set of flags so that testing for certain
+ * properties common to multiple policies is faster. */
+const MAXMEMORY_FLAG_LRU = 1 << 0
+const MAXMEMORY_FLAG_LFU = 1 << 1
+const MAXMEMORY_FLAG_ALLKEYS = 1 << 2
+const MAXMEMORY_FLAG_NO_SHARED_INTEGERS = MAXMEMORY_FLAG_LRU | MAXMEMORY_FLAG_LFU
+
+const MAXMEMORY_VOLATILE_LRU = (0 << 8) | MAXMEMORY_FLAG_LRU
+const MAXMEMORY_VOLATILE_LFU = (1 << 8) | MAXMEMORY_FLAG_LFU
+const MAXMEMORY_VOLATILE_TTL = 2 << 8
+const MAXMEMORY_VOLATILE_RANDOM = 3 << 8
+const MAXMEMORY_ALLKEYS_LRU = (4 << 8) | MAXMEMORY_FLAG_LRU | MAXMEMORY_FLAG_ALLKEYS
+const MAXMEMORY_ALLKEYS_LFU = (5 << 8) | MAXMEMORY_FLAG_LFU | MAXMEMORY_FLAG_ALLKEYS
+const MAXMEMORY_ALLKEYS_RANDOM = (6 << 8) | MAXMEMORY_FLAG_ALLKEYS
+const MAXMEMORY_NO_EVICTION = 7 << 8
+
+const CONFIG_DEFAULT_MAXMEMORY_POLICY = MAXMEMORY_NO_EVICTION
+const CONFIG_DEFAULT_MAXMEMORY_SAMPLES = 5
+const CONFIG_DEFAULT_LFU_DECAY_TIME = 1
+const CONFIG_DEFAULT_LFU_LOG_FACTOR = 10
+const EVPOOL_SIZE = 16 /* Size of the eviction pool. */
+const LFU_INIT_VAL = 5
+
+/* Memory accounted for every key on top of its name and value, roughly
+ * the cost of the dict entries. */
+const DB_ENTRY_OVERHEAD = 64
+const EXPIRE_ENTRY_OVERHEAD = 48
+
+/* Estimated memory used by the objects and their nested nodes, see
+ * ComputeSize(). */
+const OBJ_OVERHEAD = 48
+const STRING_OVERHEAD = 16
+const SLICE_OVERHEAD = 24
+const LIST_OVERHEAD = 128              /* List header with the sentinel nodes */
+const LIST_NODE_OVERHEAD = 32          /* Links and the interface value */
+const ZSKIPLIST_OVERHEAD = 32          /* Header, tail, length and level */
+const ZSKIPLIST_NODE_OVERHEAD = 56     /* Element, score, backward and levels */
+const ZSKIPLIST_LEVEL_OVERHEAD = 16    /* Forward pointer and span */
+const DICT_OVERHEAD = 48               /* Map header */
+const DICT_ENTRY_OVERHEAD = 40         /* Key and value headers, bucket share */
+const OBJ_COMPUTE_SIZE_DEF_SAMPLES = 5 /* Default sample size. */
+const CLIENT_OVERHEAD = 512            /* KiwiClient without the buffers */
+
+/* Expire */
+const ACTIVE_EXPIRE_CYCLE_LOOKUPS_PER_LOOP = 20 /* Loopkups per loop. */
+const ACTIVE_EXPIRE_CYCLE_SLOW_TIME_PERC = 25   /* CPU max % for keys collection */
+
+/* Units */
+const UNIT_SECONDS = 0
+const UNIT_MILLISECONDS = 1
+
 
 //type SharedConst structure {
 //	OBJ_ENCODING_STR byte
@@ -0,0 +1,38 @@
+package server
+
+/* CRC16 implementation according to CCITT standards (XMODEM).
+ *
+ * Name                       : "XMODEM", also known as "ZMODEM", "CRC-16/ACORN"
+ * Width                      : 16 bit
+ * Poly                       : 1021 (That is actually x^16 + x^12 + x^5 + 1)
+ * Initialization             : 0000
+ * Reflect Input byte         : False
+ * Reflect Output CRC         : False
+ * Xor constant to output CRC : 0000
+ * Output for "123456789"     : 31C3
+ *
+ * This is the same checksum used by Redis Cluster to map keys to hash slots. */
+
+var crc16Table [256]uint16
+
+func init() {
+	for i := 0; i < 256; i++ {
+		crc := uint16(i) << 8
+		for j := 0; j < 8; j++ {
+			if crc&0x8000 != 0 {
+				crc = crc<<1 ^ 0x1021
+			} else {
+				crc <<= 1
+			}
+		}
+		crc16Table[i] = crc
+	}
+}
+
+func Crc16(buf string) uint16 {
+	var crc uint16
+	for i := 0; i < len(buf); i++ {
+		crc = crc<<8 ^ crc16Table[byte(crc>>8)^buf[i]]
+	}
+	return crc
+}
@@ -2,18 +2,53 @@ package server
 
 import (
 	"sync"
+	"sync/atomic"
+	"time"
 )
 
+/* The keys of a Db are split in shards, one for every partition of the
+ * keyspace, see partition.go. Without partitioning a Db has a single shard.
+ * A shard is only accessed by the event loop owning its partition, or
+ * while the world is stopped, so its mutex is never contended in
+ * partitioned mode. */
+type dbShard struct {
+	dict     map[string]Objector
+	expires  map[string]time.Time         // Timeout of keys with a timeout set
+	sizes    map[string]int64             // Memory accounted for every key, see ObjectComputeSize()
+	mutex    sync.RWMutex
+	slotKeys map[int]map[string]struct{} // Hash slot -> keys, only in cluster mode
+}
+
 type Db struct {
-	dict  map[string]Objector
-	id    int
-	mutex sync.RWMutex
+	srv    *Server
+	shards []*dbShard
+	id     int
+	avgTTL int64 // Average TTL in milliseconds, just for stats
+}
+
+func createDbShard() *dbShard {
+	return &dbShard{
+		dict:     make(map[string]Objector),
+		expires:  make(map[string]time.Time),
+		sizes:    make(map[string]int64),
+		mutex:    sync.RWMutex{},
+		slotKeys: nil,
+	}
+}
+
+/* Return the shard holding key. */
+func (db *Db) shard(key string) *dbShard {
+	if len(db.shards) == 1 {
+		return db.shards[0]
+	}
+	return db.shards[db.srv.KeyPartition(key)]
 }
 
 func (db *Db) Get(key string) Objector {
-	db.mutex.RLock()
-	defer db.mutex.RUnlock()
-	return db.dict[key]
+	sh := db.shard(key)
+	sh.mutex.RLock()
+	defer sh.mutex.RUnlock()
+	return sh.dict[key]
 }
 
 //func (db *Db) GetForWrite(key Objector) Objector {
@@ -21,24 +56,119 @@ func (db *Db) Get(key string) Objector {
 //}
 
 func (db *Db) RandGet() (string, Objector) {
-	db.mutex.RLock()
-	defer db.mutex.RUnlock()
-	for key, value := range db.dict {
-		return key, value
+	for _, sh := range db.shards {
+		sh.mutex.RLock()
+		for key, value := range sh.dict {
+			sh.mutex.RUnlock()
+			return key, value
+		}
+		sh.mutex.RUnlock()
 	}
 	return "", nil
 }
 
+/* Set the value of key. Calling Set again with an object modified in place
+ * updates the memory accounted for the key. */
 func (db *Db) Set(key string, ptr Objector) {
-	db.mutex.Lock()
-	db.dict[key] = ptr
-	db.mutex.Unlock()
+	size := int64(len(key)) + DB_ENTRY_OVERHEAD + db.srv.ObjectComputeSize(ptr)
+	sh := db.shard(key)
+	sh.mutex.Lock()
+	if _, ok := sh.dict[key]; !ok && db.srv.ClusterEnabled {
+		sh.slotKeysAdd(key)
+	}
+	sh.dict[key] = ptr
+	atomic.AddInt64(&db.srv.UsedMemory, size-sh.sizes[key])
+	sh.sizes[key] = size
+	sh.mutex.Unlock()
 }
 
-func (db *Db) Delete(key string) {
-	db.mutex.Lock()
-	delete(db.dict, key)
-	db.mutex.Unlock()
+func (db *Db) Delete(key string) bool {
+	sh := db.shard(key)
+	sh.mutex.Lock()
+	defer sh.mutex.Unlock()
+	if _, ok := sh.dict[key]; !ok {
+		return false
+	}
+	sh.slotKeysDelete(key)
+	delete(sh.dict, key)
+	delete(sh.expires, key)
+	atomic.AddInt64(&db.srv.UsedMemory, -sh.sizes[key])
+	delete(sh.sizes, key)
+	return true
+}
+
+func (db *Db) SetExpire(key string, when time.Time) {
+	sh := db.shard(key)
+	sh.mutex.Lock()
+	if _, ok := sh.dict[key]; ok {
+		sh.expires[key] = when
+	}
+	sh.mutex.Unlock()
+}
+
+func (db *Db) GetExpire(key string) (time.Time, bool) {
+	sh := db.shard(key)
+	sh.mutex.RLock()
+	defer sh.mutex.RUnlock()
+	when, ok := sh.expires[key]
+	return when, ok
+}
+
+func (db *Db) RemoveExpire(key string) bool {
+	sh := db.shard(key)
+	sh.mutex.Lock()
+	defer sh.mutex.Unlock()
+	if _, ok := sh.expires[key]; !ok {
+		return false
+	}
+	delete(sh.expires, key)
+	return true
+}
+
+func (db *Db) ExpiresSize() int {
+	size := 0
+	for _, sh := range db.shards {
+		sh.mutex.RLock()
+		size += len(sh.expires)
+		sh.mutex.RUnlock()
+	}
+	return size
+}
+
+/* Return up to count random keys, taken from the keys with an expire set
+ * if volatile is true. Go maps are iterated starting from a random
+ * position, which is good enough for the eviction and expire sampling.
+ * With several shards the keys are taken from all of them. */
+func (db *Db) SampleKeys(count int, volatile bool) []string {
+	keys := make([]string, 0, count)
+	for i, sh := range db.shards {
+		// Leave room for the next shards.
+		want := count - len(keys)
+		if left := len(db.shards) - i; left > 1 {
+			want = (want + left - 1) / left
+		}
+		sh.mutex.RLock()
+		n := 0
+		if volatile {
+			for key := range sh.expires {
+				if n >= want {
+					break
+				}
+				keys = append(keys, key)
+				n++
+			}
+		} else {
+			for key := range sh.dict {
+				if n >= want {
+					break
+				}
+				keys = append(keys, key)
+				n++
+			}
+		}
+		sh.mutex.RUnlock()
+	}
+	return keys
 }
 
 func (db *Db) SetNx(key string, ptr Objector) bool {
@@ -65,21 +195,150 @@ func (db *Db) Exist(key string) bool {
 }
 
 func (db *Db) Size() int {
-	db.mutex.Lock()
-	defer db.mutex.RUnlock()
-	return len(db.dict)
+	size := 0
+	for _, sh := range db.shards {
+		sh.mutex.RLock()
+		size += len(sh.dict)
+		sh.mutex.RUnlock()
+	}
+	return size
 }
 
 func (db *Db) FlushAll() {
-	db.mutex.Lock()
-	db.dict = make(map[string]Objector)
-	db.mutex.Unlock()
+	for _, sh := range db.shards {
+		sh.mutex.Lock()
+		var freed int64
+		for _, size := range sh.sizes {
+			freed += size
+		}
+		atomic.AddInt64(&db.srv.UsedMemory, -freed)
+		sh.dict = make(map[string]Objector)
+		sh.expires = make(map[string]time.Time)
+		sh.sizes = make(map[string]int64)
+		sh.slotKeys = nil
+		sh.mutex.Unlock()
+	}
+	atomic.StoreInt64(&db.avgTTL, 0)
 }
 
-func CreateDb(id int) *Db {
-	return &Db{
-		make(map[string]Objector),
-		id,
-		sync.RWMutex{},
+/* In cluster mode we keep an index of the keys in every hash slot, used by
+ * CLUSTER COUNTKEYSINSLOT and CLUSTER GETKEYSINSLOT. */
+func (sh *dbShard) slotKeysAdd(key string) {
+	if sh.slotKeys == nil {
+		sh.slotKeys = make(map[int]map[string]struct{})
+	}
+	slot := KeyHashSlot(key)
+	keys := sh.slotKeys[slot]
+	if keys == nil {
+		keys = make(map[string]struct{})
+		sh.slotKeys[slot] = keys
+	}
+	keys[key] = struct{}{}
+}
+
+func (sh *dbShard) slotKeysDelete(key string) {
+	if sh.slotKeys == nil {
+		return
+	}
+	slot := KeyHashSlot(key)
+	if keys := sh.slotKeys[slot]; keys != nil {
+		delete(keys, key)
+		if len(keys) == 0 {
+			delete(sh.slotKeys, slot)
+		}
+	}
+}
+
+/* The keys of a slot all live in the same shard. */
+func (db *Db) slotShard(slot int) *dbShard {
+	return db.shards[slot%len(db.shards)]
+}
+
+func (db *Db) CountKeysInSlot(slot int) int {
+	sh := db.slotShard(slot)
+	sh.mutex.RLock()
+	defer sh.mutex.RUnlock()
+	return len(sh.slotKeys[slot])
+}
+
+/* Return up to count keys of the slot, or all of them if count is < 0. */
+func (db *Db) GetKeysInSlot(slot int, count int) []string {
+	sh := db.slotShard(slot)
+	sh.mutex.RLock()
+	defer sh.mutex.RUnlock()
+	keys := []string{}
+	for key := range sh.slotKeys[slot] {
+		if count >= 0 && len(keys) >= count {
+			break
+		}
+		keys = append(keys, key)
+	}
+	return keys
+}
+
+/* Update LFU when an object is accessed.
+ * Firstly, decrement the counter if the decrement time is reached.
+ * Then logarithmically increment the counter, and update the access time. */
+func (s *Server) UpdateLFU(o Objector) {
+	counter := s.LFUDecrAndReturn(o)
+	counter = s.LFULogIncr(counter)
+	o.setLFU(LFUGetTimeInMinutes()<<8 | counter)
+}
+
+/* Low level key lookup API, not actually called directly from commands
+ * implementations that should instead rely on LookupKeyRead() and
+ * LookupKeyWrite(). The access time (or the LFU counter when an LFU
+ * policy is used) of the object is updated, unless it is a shared
+ * integer: it is shared by keys that may be accessed concurrently, from
+ * other partitions. */
+func LookupKey(db *Db, key string) Objector {
+	o := db.Get(key)
+	if o != nil && db.srv.ObjectRefCount(o) != OBJ_SHARED_REFCOUNT {
+		if db.srv.MaxMemoryPolicy&MAXMEMORY_FLAG_LFU != 0 {
+			db.srv.UpdateLFU(o)
+		} else {
+			o.RefreshLRUClock(db.srv.LruClock())
+		}
+	}
+	return o
+}
+
+/* Lookup a key for read operations, or return nil if the key is not
+ * found in the specified DB. As a side effect the key is expired if
+ * its TTL is reached. */
+func LookupKeyRead(db *Db, key string) Objector {
+	ExpireIfNeeded(db, key)
+	o := LookupKey(db, key)
+	if o == nil {
+		atomic.AddInt64(&db.srv.StatKeyspaceMisses, 1)
+	} else {
+		atomic.AddInt64(&db.srv.StatKeyspaceHits, 1)
+	}
+	return o
+}
+
+/* Lookup a key for write operations, the key is expired if needed and
+ * the access time is updated like for reads. */
+func LookupKeyWrite(db *Db, key string) Objector {
+	ExpireIfNeeded(db, key)
+	return LookupKey(db, key)
+}
+
+/* High level Set operation: the key is set to the new value and any
+ * existing expire is removed. */
+func SetKey(db *Db, key string, o Objector) {
+	db.Set(key, o)
+	db.RemoveExpire(key)
+}
+
+func (s *Server) CreateDb(id int) *Db {
+	db := &Db{
+		srv:    s,
+		shards: make([]*dbShard, s.KeyspacePartitions()),
+		id:     id,
+	}
+	for i := range db.shards {
+		db.shards[i] = createDbShard()
 	}
+	return db
 }
@@ -4,25 +4,49 @@ import (
 	"fmt"
 	"sync/atomic"
 	"strings"
-	"strconv"
 	"time"
 	"github.com/zhaotong0312/kiwi/event"
+	"github.com/zhaotong0312/kiwi/resp"
 )
 
-func CreateKiwiServerEvents() (events event.Events) {
+func (s *Server) CreateKiwiServerEvents() (events event.Events) {
 	events = event.Events{
-		NumLoops: kiwiS.numLoops,
+		NumLoops: s.numLoops,
 	}
-	events.Accepted = func(conn event.Conn, flags int) (c event.Client, action event.Action) {
-		return CreateClient(conn, flags)
+	events.TLSConfig = s.TlsServerConfig
+	events.TLSHandshakeTimeout = s.TlsHandshakeTimeout
+	events.Serving = func(es *event.EventServer) (action event.Action) {
+		if p := s.partitions; p != nil {
+			if es.NumLoops != p.n {
+				s.ServerLogWarnF("The keyspace has %d partitions but the server has %d event loops\n", p.n, es.NumLoops)
+				return event.Shutdown
+			}
+			// Internal clients check the binding with the world lock
+			// held, see internal.go.
+			p.world.Lock()
+			p.es = es
+			p.world.Unlock()
+		}
+		return
+	}
+	events.Accepted = func(conn event.Conn, connFlags int) (c event.Client, action event.Action) {
+		flags := 0
+		if connFlags&event.UnixSocket != 0 {
+			flags |= CLIENT_UNIX_SOCKET
+		}
+		return s.CreateClient(conn, flags)
 	}
 
 	events.Opened = func(c event.Client) (out []byte, opts event.Options, action event.Action) {
 		// fmt.Println("Opened")
-		if kiwiS.StatConnCount > kiwiS.MaxClients {
+		if atomic.LoadInt64(&s.StatConnCount) > s.MaxClients {
+			atomic.AddInt64(&s.StatRejectedConn, 1)
 			out = append([]byte{}, "-ERROR exceeds the maximum number of clients.\r\n"...)
 			action = event.Close
 		}
+		// The input is parsed in place, only partial commands are copied
+		// to the query buffer.
+		opts.ReuseInputBuffer = true
 		return
 	}
 	events.Closed = func(c event.Client, err error) (action event.Action) {
@@ -31,204 +55,347 @@ func CreateKiwiServerEvents() (events event.Events) {
 		// fmt.Println("Closed")
 		return
 	}
-	events.Data = func(c event.Client, in []byte) (out []byte, action event.Action) {
+	events.Data = func(c event.Client, in []byte) (out [][]byte, action event.Action) {
 		cli := c.(*KiwiClient)
+		defer cli.PublishBufferSizes()
 		// fmt.Println("Data---->", string(in))
+		if cli.WithFlags(CLIENT_CLOSE_ASAP) {
+			// Killed by another client, see FreeClientAsync().
+			action = event.Close
+			return
+		}
+		if in == nil {
+			// Woken up by another goroutine: resume the command postponed
+			// by CLIENT PAUSE, if any.
+			if cli.WithFlags(CLIENT_UNBLOCKED) {
+				cli.DeleteFlags(CLIENT_UNBLOCKED)
+				cli.Btype = BLOCKED_NONE
+				ProcessCommandAndResetClient(cli)
+				// Serve the commands pipelined meanwhile.
+				ProcessInputBuffer(cli)
+			}
+			// Flush the replies queued by other event loops, see MONITOR.
+			if async := cli.TakeAsyncReply(); len(async) > 0 {
+				cli.OutBuf.Write(async)
+			}
+			out = cli.OutBuf.Take()
+			return
+		}
 		if len(in) > 0 {
-			atomic.AddInt64(&kiwiS.StatNetInputBytes, int64(len(in)))
+			atomic.AddInt64(&s.StatNetInputBytes, int64(len(in)))
 		}
 		cli.QueryCount++
-		cli.Reset(in)
-		ProcessInput(cli)
-		cli.OutBuf.WriteByte(0)
-		out = cli.OutBuf.Bytes()
-		// fmt.Println("Data---->", string(out))
+		pending := cli.InBuf.Len() > 0
+		// A blocked client keeps its input until its command is resumed:
+		// an unblocked client too, its loop wasn't woken up yet, and the
+		// postponed command is still in its argv.
+		blocked := cli.WithFlags(CLIENT_BLOCKED | CLIENT_UNBLOCKED)
+		if !pending && !blocked {
+			// Nothing pending: parse the commands from the read buffer
+			// directly, and only keep the partial command at the end.
+			n := ProcessInput(cli, in)
+			in = in[n:]
+		}
+		if len(in) > 0 {
+			// The input is appended to the query buffer, after the
+			// partial command left by the previous reads, if any.
+			if cli.InBuf.Len()+len(in) > s.ClientMaxQueryBufLen {
+				queryBuf := cli.InBuf.Bytes()
+				if !pending {
+					queryBuf = in
+				}
+				if len(queryBuf) > PROTO_DUMP_LEN {
+					queryBuf = queryBuf[:PROTO_DUMP_LEN]
+				}
+				s.ServerLogWarnF("Closing client that reached max query buffer length: %s (qbuf initial bytes: %s)\n",
+					CatClientInfoString(cli), CatRepr(string(queryBuf)))
+				atomic.AddInt64(&s.StatClientQbufLimitDisconnections, 1)
+				action = event.Close
+				return
+			}
+			cli.InBuf.Write(in)
+			// The postponed command, if any, is still pending: the input
+			// is processed once it is resumed.
+			if pending && !blocked {
+				ProcessInputBuffer(cli)
+			} else {
+				GrowQueryBuffer(cli)
+			}
+		}
+		out = cli.OutBuf.Take()
+		if cli.WithFlags(CLIENT_CLOSE_AFTER_REPLY) && len(out) == 0 {
+			action = event.Close
+		}
 		return
 	}
+	events.Release = func(c event.Client, chunk []byte) {
+		ReleaseReplyChunk(chunk)
+	}
 	events.Written = func(c event.Client, n int) (action event.Action) {
 		cli := c.(*KiwiClient)
 		// fmt.Println("Written")
-		atomic.AddInt64(&kiwiS.StatNetOutputBytes, int64(n))
+		atomic.AddInt64(&s.StatNetOutputBytes, int64(n))
 		cli.SetLastInteraction()
+		if cli.OutBuf != nil {
+			cli.OutBuf.ClearTaken()
+			cli.PublishBufferSizes()
+		}
+		if cli.WithFlags(CLIENT_CLOSE_AFTER_REPLY | CLIENT_CLOSE_ASAP) {
+			action = event.Close
+		}
 		return
 	}
+	events.Stopped = func(loop int) {
+		if p := s.partitions; p != nil {
+			p.loopStopped(loop)
+		}
+	}
+	events.Busy = func(c event.Client) bool {
+		return clientIsBusy(c.(*KiwiClient))
+	}
 	events.Shutdown = func() {
-		fmt.Println("Shutdown Action...Funished")
+		if p := s.partitions; p != nil {
+			p.world.Lock()
+			p.es = nil
+			p.world.Unlock()
+		}
 		return
 	}
+	events.Latency = func(loop int, name string, duration time.Duration) {
+		// Waiting for the commands of the other loops is their latency,
+		// not the one of this loop.
+		duration -= time.Duration(atomic.SwapInt64(&s.lockWaits[loop], 0))
+		s.LatencyAddSampleIfNeeded(name, int64(duration/time.Millisecond))
+	}
 	events.Tick = func() (delay time.Duration, action event.Action) {
-		atomic.AddInt64(&kiwiS.CronLoopCount, 1)
-		return time.Millisecond * time.Duration(1000/kiwiS.Hz), event.None
+		s.ServerCronHandler()
+		return time.Millisecond * time.Duration(1000/s.Hz), event.None
 	}
 	return
 }
 
-func Call(c *KiwiClient) {
+/* Call() is the core of Kiwi execution of a command.
+ *
+ * The following flags can be passed:
+ * CMD_CALL_NONE        No flags.
+ * CMD_CALL_SLOWLOG     Check command speed and log in the slow log if needed.
+ * CMD_CALL_STATS       Populate command stats.
+ * CMD_CALL_FULL        Alias for SLOWLOG|STATS|PROPAGATE. */
+func Call(c *KiwiClient, flags int) {
 	// fmt.Println("Call")
+	errorReplies := c.ErrorReplies
+	c.LastCmd = c.Cmd
+
+	// Send the command to clients in MONITOR mode if applicable.
+	// Administrative commands are considered too dangerous to be shown.
+	if !c.srv.Loading && c.Cmd.Flags&(CMD_SKIP_MONITOR|CMD_ADMIN) == 0 {
+		ReplicationFeedMonitors(c, c.Db.id, c.Argv, c.Argc)
+	}
+	start := time.Now()
 	c.Cmd.Process(c)
-	atomic.AddInt64(&kiwiS.StatNumCommands, 1)
+	duration := time.Since(start)
+
+	// Log the command into the Slow log and the latency monitor if needed.
+	if flags&CMD_CALL_SLOWLOG != 0 {
+		latencyEvent := "command"
+		if c.Cmd.Flags&CMD_FAST != 0 {
+			latencyEvent = "fast-command"
+		}
+		c.srv.LatencyAddSampleIfNeeded(latencyEvent, int64(duration/time.Millisecond))
+		SlowlogPushEntryIfNeeded(c, c.Argv, c.Argc, int64(duration/time.Microsecond))
+	}
+	if flags&CMD_CALL_STATS != 0 {
+		atomic.AddInt64(&c.Cmd.Microseconds, int64(duration/time.Microsecond))
+		atomic.AddInt64(&c.Cmd.Calls, 1)
+		if c.ErrorReplies != errorReplies {
+			atomic.AddInt64(&c.Cmd.FailedCalls, 1)
+		}
+		if c.srv.LatencyTrackingEnabled {
+			c.Cmd.LatencyHistogram.Record(int64(duration))
+		}
+	}
+	atomic.AddInt64(&c.srv.StatNumCommands, 1)
 }
 
 func ProcessCommand(c *KiwiClient) int {
 	// fmt.Println("ProcessCommand")
+	// Commands are executed one at a time, see multi.go, unless the
+	// keyspace is partitioned, see partition.go.
+	if c.srv.partitions == nil {
+		c.srv.LockKeyspace(c.LoopIndex())
+		defer c.srv.UnlockKeyspace()
+	}
 	cmdName := strings.ToLower(c.Argv[0])
 	// fmt.Println([]byte(cmdName))
-	c.Cmd = LookUpCommand(cmdName)
+	c.Cmd = c.srv.LookUpCommand(cmdName)
 	if c.Cmd == nil {
 		// fmt.Println("c.Cmd == nil")
-		AddReplyError(c, fmt.Sprintf("unknown command '%kiwiS'", cmdName))
+		FlagTransaction(c)
+		AddReplyError(c, fmt.Sprintf("unknown command '%.128s'", cmdName))
 		return C_OK
 	}
 	if (c.Cmd.Arity > 0 && c.Cmd.Arity != c.Argc) || c.Argc < -c.Cmd.Arity {
-		AddReplyError(c, fmt.Sprintf("wrong number of arguments for '%kiwiS' command", cmdName))
+		atomic.AddInt64(&c.Cmd.RejectedCalls, 1)
+		FlagTransaction(c)
+		AddReplyError(c, fmt.Sprintf("wrong number of arguments for '%s' command", cmdName))
 		return C_OK
 	}
-	if kiwiS.RequirePassword != nil && c.Authenticated == 0 && &c.Cmd.Process != &AuthCommand {
-		// fmt.Println("Authenticated")
-		AddReplyError(c, kiwiS.Shared.NoAuthErr)
+	if c.Authenticated == 0 && c.Cmd.Flags&CMD_NO_AUTH == 0 {
+		atomic.AddInt64(&c.Cmd.RejectedCalls, 1)
+		FlagTransaction(c)
+		AddReplyErrorObject(c, c.srv.Shared.NoAuthErr)
 		return C_OK
 	}
-	Call(c)
-	return C_OK
-}
-
-func LookUpCommand(name string) *Command {
-	return kiwiS.Commands[name]
-}
-
-func ProcessInline(c *KiwiClient) int {
-	// fmt.Println("ProcessInline")
-
-	// Search for end of line
-	queryBuf := c.InBuf.Bytes()
-	size := len(queryBuf)
-	newline := IndexOfBytes(queryBuf, 0, size, '\n')
-	if newline == -1 {
-		if size > kiwiS.ClientMaxQueryBufLen {
-			AddReplyError(c, "Protocol error: too big inline request")
-			//SetProtocolError(c, "too big inline request", 0)
-		}
-		return C_ERR
-	}
-	if newline != 0 && newline != size && queryBuf[newline-1] == '\r' {
-		// Handle the \r\n case.
-		newline--
-	}
-	/* Split the input buffer up to the \r\n */
-	argvs := SplitArgs(queryBuf[0:newline])
-	if argvs == nil {
-		AddReplyError(c, "Protocol error: unbalanced quotes in request")
-		//SetProtocolError(c, "unbalanced quotes in inline request", 0)
-		return C_ERR
+	// Check if the user can run this command according to the current
+	// ACLs.
+	if aclRet, argpos := ACLCheckAllPerm(c); aclRet != ACL_OK {
+		object := c.Cmd.Name
+		if aclRet == ACL_DENIED_KEY {
+			object = c.Argv[argpos]
+		}
+		ACLAddLogEntry(c, aclRet, ACL_LOG_CTX_TOPLEVEL, object, "")
+		atomic.AddInt64(&c.Cmd.RejectedCalls, 1)
+		FlagTransaction(c)
+		ACLReplyDenied(c, aclRet)
+		return C_OK
 	}
-
-	// Leave data after the first line of the query in the buffer
-	if len(argvs) != 0 {
-		c.Argc = 0
-		c.Argv = make([]string, len(argvs))
+	// If cluster is enabled perform the cluster redirection here.
+	// However we don't perform the redirection if:
+	// 1) The sender of this command is our master.
+	// 2) The command has no key arguments.
+	// 3) The sender is an internal client, that can't follow redirections.
+	if c.srv.ClusterEnabled && !c.WithFlags(CLIENT_INTERNAL) && ClusterProcessCommand(c) == C_ERR {
+		atomic.AddInt64(&c.Cmd.RejectedCalls, 1)
+		FlagTransaction(c)
+		c.DeleteFlags(CLIENT_ASKING)
+		return C_OK
 	}
-	for index, argv := range argvs {
-		if argv != "" {
-			c.Argv[index] = argv
-			c.Argc++
+	// Handle the maxmemory directive.
+	//
+	// First we try to free some memory if possible (if there are volatile
+	// keys in the dataset). If there are not the only thing we can do
+	// is returning an error.
+	//
+	// EXEC is checked like the commands of the transaction, that may have
+	// been queued before the limit was reached.
+	if c.srv.MaxMemory > 0 {
+		denyOOM := c.Cmd.Flags&CMD_DENYOOM != 0 ||
+			(c.Cmd.Name == "exec" && c.Mstate.CmdFlags&CMD_DENYOOM != 0)
+		if freeMemoryIfNeededAndSafe(c) == C_ERR && denyOOM {
+			atomic.AddInt64(&c.Cmd.RejectedCalls, 1)
+			if c.Cmd.Name == "exec" && c.WithFlags(CLIENT_MULTI) {
+				ExecCommandAbort(c, c.srv.Shared.OOMErr)
+				return C_OK
+			}
+			FlagTransaction(c)
+			AddReplyErrorObject(c, c.srv.Shared.OOMErr)
+			return C_OK
+		}
+	}
+	// If the server is paused, block the client until the pause has ended.
+	// Replicas and internal clients are never paused.
+	if !c.WithFlags(CLIENT_SLAVE | CLIENT_INTERNAL) {
+		ptype := c.srv.GetClientPauseType()
+		if ptype == CLIENT_PAUSE_ALL || (ptype == CLIENT_PAUSE_WRITE && c.Cmd.Flags&CMD_WRITE != 0) {
+			BlockClientForPause(c)
+			return C_OK
 		}
 	}
+	// Exec the command
+	if c.WithFlags(CLIENT_MULTI) && !IsMultiControlCommand(c.Cmd) {
+		QueueMultiCommand(c)
+		AddReply(c, c.srv.Shared.Queued)
+		return C_OK
+	}
+	if c.srv.partitions != nil {
+		c.srv.partitions.Call(c)
+	} else {
+		Call(c, CMD_CALL_FULL)
+	}
+	// The ASKING flag is only valid for the next command.
+	if c.Cmd.Name != "asking" {
+		c.DeleteFlags(CLIENT_ASKING)
+	}
 	return C_OK
 }
 
-func ProcessMultiBulk(c *KiwiClient) int {
-	if c.Argc != 0 {
-		panic("c.Argc != 0")
-	}
-	if c.MultiBulkLen == 0 {
-		star, err := c.InBuf.ReadByte()
-		if err != nil || star != '*' {
-			AddReplyError(c, fmt.Sprintf("Protocol error: expected '*', got '%c'", star))
-			//SetProtocolError(c, "expected $ but got something else", 0)
-			return C_ERR
-		}
-		bulkNumStr, err := c.InBuf.ReadStringExclude('\r')
-		if err != nil {
-			return C_ERR
-		}
+func (s *Server) LookUpCommand(name string) *Command {
+	return s.Commands[name]
+}
 
-		bulkNum, err := strconv.Atoi(bulkNumStr)
-		if err != nil || bulkNum > 1024*1024 {
-			AddReplyError(c, "Protocol error: invalid multibulk length")
-			//SetProtocolError(c, "invalid multibulk length", 0)
-			return C_ERR
-		}
-		if bulkNum <= 0 {
-			return C_OK
-		}
-		c.InBuf.ReadByte() // pass the \n
-		c.MultiBulkLen = bulkNum
-		c.Argv = make([]string, c.MultiBulkLen)
+/* Log a protocol error and close the client once the error reply has been
+ * sent: the rest of the query buffer can't be trusted. */
+func SetProtocolError(c *KiwiClient, errstr string, queryBuf []byte) {
+	if len(queryBuf) > PROTO_DUMP_LEN {
+		queryBuf = queryBuf[:PROTO_DUMP_LEN]
 	}
-	if c.MultiBulkLen < 0 {
-		return C_ERR
+	c.srv.ServerLogDebugF("Protocol error (%s) from client: %s. Query buffer during protocol error: '%s'\n",
+		errstr, CatClientInfoString(c), CatRepr(string(queryBuf)))
+	c.AddFlags(CLIENT_CLOSE_AFTER_REPLY)
+}
+
+/* Execute the command parsed in argv and, unless it was postponed, prepare
+ * the client for the next one. */
+func ProcessCommandAndResetClient(c *KiwiClient) {
+	ProcessCommand(c)
+	if !c.WithFlags(CLIENT_BLOCKED) {
+		c.UpdateReplySkip()
+		c.ResetArgv()
 	}
-	for c.MultiBulkLen > 0 {
-		// Read bulk length if unknown
-		dollar, err := c.InBuf.ReadByte()
-		if err != nil || dollar != '$' {
-			AddReplyError(c, fmt.Sprintf("Protocol error: expected '$', got '%c'", dollar))
-			return C_ERR
+}
+
+/* Execute every complete command in buf, so that pipelined commands are
+ * all served by a single read, and return the number of bytes consumed.
+ * The bytes of a partial command are not consumed: the caller must keep
+ * them until the next read completes the command. buf is not referenced
+ * once the function returns. */
+func ProcessInput(c *KiwiClient, buf []byte) int {
+	c.Parser.MaxBulkLen = c.srv.ProtoMaxBulkLen
+	pos := 0
+	for pos < len(buf) {
+		// Immediately abort if the client is blocked, or is going to be
+		// closed: the rest of the input is not processed.
+		if c.WithFlags(CLIENT_BLOCKED | CLIENT_UNBLOCKED | CLIENT_CLOSE_AFTER_REPLY | CLIENT_CLOSE_ASAP) {
+			break
 		}
-		bulkLenStr, err := c.InBuf.ReadStringExclude('\r')
+		argv, n, err := c.Parser.Parse(buf[pos:])
 		if err != nil {
-			AddReplyError(c, fmt.Sprintf("Protocol error: invalid bulk length"))
-			return C_ERR
+			AddReplyError(c, err.Error())
+			SetProtocolError(c, err.(*resp.ProtocolError).Reason, buf[pos:])
+			break
 		}
-		bulkLen, err := strconv.Atoi(bulkLenStr)
-		if err != nil || bulkLen > kiwiS.ProtoMaxBulkLen {
-			AddReplyError(c, "Protocol error: invalid bulk length")
-			return C_ERR
+		pos += n
+		if argv == nil {
+			// Still not ready to process the command.
+			break
 		}
-		c.InBuf.ReadByte() // pass the \n
-
-		bulk := c.InBuf.Next(bulkLen)
-		if len(bulk) != bulkLen {
-			AddReplyError(c, "Protocol error: invalid bulk format")
-			return C_ERR
-		}
-		cr, _ := c.InBuf.ReadByte()
-		lf, _ := c.InBuf.ReadByte()
-		if cr != '\r' || lf != '\n' {
-			AddReplyError(c, "Protocol error: invalid bulk format")
-			return C_ERR
-		}
-		c.Argv[len(c.Argv)-c.MultiBulkLen] = string(bulk)
-		c.Argc++
-		c.MultiBulkLen--
-	}
-	if c.MultiBulkLen == 0 {
-		return C_OK
+		if len(argv) == 0 {
+			// Empty lines and multibulk requests of length <= 0.
+			continue
+		}
+		c.Argv = argv
+		c.Argc = len(argv)
+		ProcessCommandAndResetClient(c)
 	}
-	return C_ERR
+	return pos
 }
 
-func ProcessInput(c *KiwiClient) {
-	if c.RequestType == 0 {
-		firstByte, _ := c.InBuf.ReadByteNotGoForward()
-		if firstByte == '*' {
-			c.RequestType = PROTO_REQ_MULTIBULK
-		} else {
-			c.RequestType = PROTO_REQ_INLINE
-		}
-	}
-	if c.RequestType == PROTO_REQ_INLINE {
-		if ProcessInline(c) != C_OK {
-		}
-	} else if c.RequestType == PROTO_REQ_MULTIBULK {
-		if ProcessMultiBulk(c) != C_OK {
+/* Execute the commands in the query buffer, see ProcessInput(). */
+func ProcessInputBuffer(c *KiwiClient) {
+	c.InBuf.Next(ProcessInput(c, c.InBuf.Bytes()))
+	GrowQueryBuffer(c)
+}
 
-		}
-	} else {
-		panic("Unknown request type")
+/* Size the query buffer for the partial command it holds. */
+func GrowQueryBuffer(c *KiwiClient) {
+	// Make room for big arguments at once, instead of growing the buffer
+	// at every read.
+	if need := c.Parser.Pending() - c.InBuf.Len(); need >= PROTO_MBULK_BIG_ARG {
+		c.InBuf.Grow(need)
 	}
-
-	if c.Argc != 0 {
-		ProcessCommand(c)
+	// Don't keep around the memory of a query buffer grown by a big
+	// request once it has been consumed.
+	if c.InBuf.Len() == 0 && c.InBuf.Cap() > LIMIT_PENDING_QUERYBUF {
+		c.InBuf = GetQueryBuffer()
 	}
 }
@@ -0,0 +1,365 @@
+package server
+
+import (
+	"math"
+	"math/rand"
+	"sort"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+/* To improve the quality of the LRU approximation we take a set of keys
+ * that are good candidate for eviction across FreeMemoryIfNeeded() calls.
+ *
+ * Entries inside the eviction pool are taken ordered by idle time, putting
+ * greater idle times to the right (ascending order).
+ *
+ * When an LFU policy is used instead, a reverse frequency indication is used
+ * instead of the idle time, so that we still evict by larger value (larger
+ * inverse frequency means to evict keys with the least frequent accesses).
+ *
+ * Empty entries have the key set to "". */
+type EvictionPoolEntry struct {
+	Idle uint64 // Object idle time (inverse frequency for LFU)
+	Key  string // Key name.
+	DbId int    // Key DB number.
+}
+
+var MaxMemoryPolicyTable = []ConfigEnum{
+	{"volatile-lru", MAXMEMORY_VOLATILE_LRU},
+	{"volatile-lfu", MAXMEMORY_VOLATILE_LFU},
+	{"volatile-random", MAXMEMORY_VOLATILE_RANDOM},
+	{"volatile-ttl", MAXMEMORY_VOLATILE_TTL},
+	{"allkeys-lru", MAXMEMORY_ALLKEYS_LRU},
+	{"allkeys-lfu", MAXMEMORY_ALLKEYS_LFU},
+	{"allkeys-random", MAXMEMORY_ALLKEYS_RANDOM},
+	{"noeviction", MAXMEMORY_NO_EVICTION},
+}
+
+func GetMaxMemoryPolicyName(policy int) string {
+	for _, p := range MaxMemoryPolicyTable {
+		if p.Value == policy {
+			return p.Name
+		}
+	}
+	return "unknown"
+}
+
+func GetMaxMemoryPolicyByName(name string) int {
+	for _, p := range MaxMemoryPolicyTable {
+		if strings.EqualFold(p.Name, name) {
+			return p.Value
+		}
+	}
+	return -1
+}
+
+/* ----------------------------------------------------------------------------
+ * Implementation of the LFU (Least Frequently Used) eviction policy.
+ *
+ * We have 24 total bits of space in each object in order to implement
+ * an LFU (Least Frequently Used) eviction policy:
+ *
+ *          16 bits      8 bits
+ *     +----------------+--------+
+ *     + Last decr time | LOG_C  |
+ *     +----------------+--------+
+ *
+ * LOG_C is a logarithmic counter that provides an indication of the access
+ * frequency. The decrement time is used in order to decrement the counter
+ * over time, so that keys that were hot in the past are not evicted last.
+ * --------------------------------------------------------------------------*/
+
+/* Return the current time in minutes, just taking the least significant
+ * 16 bits. The returned time is suitable to be stored as LDT (last decrement
+ * time) for the LFU implementation. */
+func LFUGetTimeInMinutes() uint32 {
+	return uint32(time.Now().Unix()/60) & 65535
+}
+
+/* Given an object last access time, compute the minimum number of minutes
+ * that elapsed since the last access. Handle overflow (ldt greater than
+ * the current 16 bits minutes time) considering the time as wrapping
+ * exactly once. */
+func LFUTimeElapsed(ldt uint32) uint32 {
+	now := LFUGetTimeInMinutes()
+	if now >= ldt {
+		return now - ldt
+	}
+	return 65535 - ldt + now
+}
+
+/* Logarithmically increment a counter. The greater is the current counter
+ * value the less likely is that it gets really implemented. Saturate it
+ * at 255. */
+func (s *Server) LFULogIncr(counter uint32) uint32 {
+	if counter == 255 {
+		return 255
+	}
+	r := rand.Float64()
+	baseval := float64(counter) - LFU_INIT_VAL
+	if baseval < 0 {
+		baseval = 0
+	}
+	p := 1.0 / (baseval*float64(s.LfuLogFactor) + 1)
+	if r < p {
+		counter++
+	}
+	return counter
+}
+
+/* If the object decrement time is reached decrement the LFU counter but
+ * do not update LFU fields of the object, we update the access time
+ * and counter in an explicit way when the object is really accessed. */
+func (s *Server) LFUDecrAndReturn(o Objector) uint32 {
+	lfu := o.getLFU()
+	ldt := lfu >> 8
+	counter := lfu & 255
+	var numPeriods uint32
+	if s.LfuDecayTime > 0 {
+		numPeriods = LFUTimeElapsed(ldt) / uint32(s.LfuDecayTime)
+	}
+	if numPeriods > 0 {
+		if numPeriods > counter {
+			return 0
+		}
+		return counter - numPeriods
+	}
+	return counter
+}
+
+/* Given an object returns the min number of milliseconds the object was
+ * never requested. */
+func (s *Server) EstimateObjectIdleTime(o Objector) uint64 {
+	idle := s.LruClock().Sub(o.getLRU())
+	if idle < 0 {
+		return 0
+	}
+	return uint64(idle / time.Millisecond)
+}
+
+/* This is an helper function for FreeMemoryIfNeeded(), it is used in order
+ * to populate the evictionPool with a few entries every time we want to
+ * expire a key. Keys with idle time smaller than one of the current keys
+ * are added. Keys are always added if there are free entries. */
+func EvictionPoolPopulate(db *Db, volatile bool, pool *[EVPOOL_SIZE]EvictionPoolEntry) {
+	keys := db.SampleKeys(db.srv.MaxMemorySamples, volatile)
+	for _, key := range keys {
+		o := db.Get(key)
+		if o == nil {
+			continue
+		}
+		// Calculate the idle time according to the policy. This is called
+		// idle just because the code initially handled LRU, but is in fact
+		// just a score where an higher score means better candidate.
+		var idle uint64
+		if db.srv.MaxMemoryPolicy&MAXMEMORY_FLAG_LRU != 0 {
+			idle = db.srv.EstimateObjectIdleTime(o)
+		} else if db.srv.MaxMemoryPolicy&MAXMEMORY_FLAG_LFU != 0 {
+			// When we use an LRU policy, we sort the keys by idle time
+			// so that we expire keys starting from greater idle time.
+			// However when the policy is an LFU one, we have a frequency
+			// estimation, and we want to evict keys with lower frequency
+			// first. So inside the pool we put objects using the inverted
+			// frequency subtracting the actual frequency to the maximum
+			// frequency of 255.
+			idle = 255 - uint64(db.srv.LFUDecrAndReturn(o))
+		} else if db.srv.MaxMemoryPolicy == MAXMEMORY_VOLATILE_TTL {
+			// In this case the sooner the expire the better.
+			when, ok := db.GetExpire(key)
+			if !ok {
+				continue
+			}
+			idle = math.MaxUint64 - uint64(when.UnixNano()/int64(time.Millisecond))
+		} else {
+			panic("Unknown eviction policy in EvictionPoolPopulate()")
+		}
+
+		// Insert the element inside the pool.
+		// First, find the first empty bucket or the first populated
+		// bucket that has an idle time smaller than our idle time.
+		k := 0
+		for k < EVPOOL_SIZE && pool[k].Key != "" && pool[k].Idle < idle {
+			k++
+		}
+		if k == 0 && pool[EVPOOL_SIZE-1].Key != "" {
+			// Can't insert if the element is < the worst element we have
+			// and there are no empty buckets.
+			continue
+		} else if k < EVPOOL_SIZE && pool[k].Key == "" {
+			// Inserting into empty position. No setup needed before insert.
+		} else {
+			// Inserting in the middle. Now k points to the first element
+			// greater than the element to insert.
+			if pool[EVPOOL_SIZE-1].Key == "" {
+				// Free space on the right? Insert at k shifting
+				// all the elements from k to end to the right.
+				copy(pool[k+1:], pool[k:EVPOOL_SIZE-1])
+			} else {
+				// No free space on right? Insert at k-1
+				k--
+				// Shift all elements on the left of k (included) to the
+				// left, so we discard the element with smaller idle time.
+				copy(pool[:k], pool[1:k+1])
+			}
+		}
+		pool[k] = EvictionPoolEntry{Idle: idle, Key: key, DbId: db.id}
+	}
+}
+
+/* Select the best key to evict according to the policy, or "" if there
+ * is nothing to evict. */
+func (s *Server) evictSelectKey() (string, *Db) {
+	policy := s.MaxMemoryPolicy
+	if policy&(MAXMEMORY_FLAG_LRU|MAXMEMORY_FLAG_LFU) != 0 || policy == MAXMEMORY_VOLATILE_TTL {
+		volatile := policy&MAXMEMORY_FLAG_ALLKEYS == 0
+		for {
+			// We don't want to make local-db choices when expiring keys,
+			// so to start populate the eviction pool sampling keys from
+			// every DB.
+			total := 0
+			for j := 0; j < s.DbNum; j++ {
+				db := s.Dbs[j]
+				var size int
+				if volatile {
+					size = db.ExpiresSize()
+				} else {
+					size = db.Size()
+				}
+				if size > 0 {
+					EvictionPoolPopulate(db, volatile, &s.evictionPool)
+					total += size
+				}
+			}
+			if total == 0 {
+				return "", nil // No keys to evict.
+			}
+			// Go backward from best to worst element to evict.
+			for k := EVPOOL_SIZE - 1; k >= 0; k-- {
+				if s.evictionPool[k].Key == "" {
+					continue
+				}
+				entry := s.evictionPool[k]
+				s.evictionPool[k] = EvictionPoolEntry{}
+				db := s.Dbs[entry.DbId]
+				// If the key exists, is our pick. Otherwise it is a ghost
+				// and we try the next element.
+				if volatile {
+					if _, ok := db.GetExpire(entry.Key); ok {
+						return entry.Key, db
+					}
+				} else if db.Exist(entry.Key) {
+					return entry.Key, db
+				}
+			}
+		}
+	}
+	// volatile-random and allkeys-random policy
+	if policy == MAXMEMORY_ALLKEYS_RANDOM || policy == MAXMEMORY_VOLATILE_RANDOM {
+		volatile := policy == MAXMEMORY_VOLATILE_RANDOM
+		// When evicting a random key, we try to evict a key for each DB,
+		// so we use the static 'nextDb' variable to incrementally visit
+		// all DBs.
+		for i := 0; i < s.DbNum; i++ {
+			s.evictNextDb = (s.evictNextDb + 1) % s.DbNum
+			db := s.Dbs[s.evictNextDb]
+			if keys := db.SampleKeys(1+rand.Intn(s.MaxMemorySamples), volatile); len(keys) > 0 {
+				return keys[len(keys)-1], db
+			}
+		}
+	}
+	return "", nil
+}
+
+/* This function is periodically called to see if there is memory to free
+ * according to the current "maxmemory" settings. In case we are over the
+ * memory limit, the function will try to free some memory to return back
+ * under the limit.
+ *
+ * The function returns C_OK if we are under the memory limit or if we
+ * were over the limit, but the attempt to free memory was successful.
+ * Otherwise if we are over the memory limit, but not enough memory
+ * was freed to return back under the limit, the function returns C_ERR. */
+func (s *Server) FreeMemoryIfNeeded() int {
+	if s.MaxMemory <= 0 || s.Loading {
+		return C_OK
+	}
+	if atomic.LoadInt64(&s.UsedMemory) <= int64(s.MaxMemory) {
+		return C_OK
+	}
+	if s.MaxMemoryPolicy == MAXMEMORY_NO_EVICTION {
+		return C_ERR // We need to free memory, but policy forbids.
+	}
+	// The dataset must not change while clients are paused.
+	if s.ClientsArePaused() {
+		return C_OK
+	}
+
+	s.evictionMutex.Lock()
+	defer s.evictionMutex.Unlock()
+	latency := s.LatencyStartMonitor()
+	defer func() {
+		s.LatencyAddSampleIfNeeded("eviction-cycle", LatencyEndMonitor(latency))
+	}()
+	for atomic.LoadInt64(&s.UsedMemory) > int64(s.MaxMemory) {
+		key, db := s.evictSelectKey()
+		if key == "" {
+			// Nothing to free...
+			return C_ERR
+		}
+		// We compute the amount of time spent deleting the key alone, so
+		// that big objects show up as "eviction-del" spikes.
+		evictionLatency := s.LatencyStartMonitor()
+		deleted := db.Delete(key)
+		s.LatencyAddSampleIfNeeded("eviction-del", LatencyEndMonitor(evictionLatency))
+		if deleted {
+			atomic.AddInt64(&s.StatEvictedKeys, 1)
+		}
+	}
+	return C_OK
+}
+
+/* Called by the cron to close the clients once the memory used by their
+ * buffers reaches "maxmemory-clients": the biggest clients are closed first,
+ * until the memory is back under the limit. The clients flagged with CLIENT
+ * NO-EVICT, as well as the masters and replicas, are neither counted nor
+ * evicted.
+ *
+ * The buffer sizes are the ones published by the loops of the clients, see
+ * PublishBufferSizes(), and the clients are closed by their own loops, see
+ * FreeClientAsync(). */
+func (s *Server) EvictClientsIfNeeded() {
+	if s.MaxMemoryClients <= 0 {
+		return
+	}
+	type candidate struct {
+		c    *KiwiClient
+		size int64
+	}
+	var used int64
+	var candidates []candidate
+	for _, c := range s.GetClients() {
+		if c.Conn == nil || c.WithFlags(CLIENT_NO_EVICT|CLIENT_MASTER|CLIENT_SLAVE|CLIENT_CLOSE_ASAP) {
+			continue
+		}
+		size := ClientComputeSize(c)
+		used += size
+		candidates = append(candidates, candidate{c, size})
+	}
+	if used <= int64(s.MaxMemoryClients) {
+		return
+	}
+	sort.Slice(candidates, func(i, j int) bool {
+		return candidates[i].size > candidates[j].size
+	})
+	for _, e := range candidates {
+		if used <= int64(s.MaxMemoryClients) {
+			break
+		}
+		s.ServerLogInfoF("Evicting client: %s\n", CatClientInfoString(e.c))
+		FreeClientAsync(e.c)
+		atomic.AddInt64(&s.StatEvictedClients, 1)
+		used -= e.size
+	}
+}
@@ -0,0 +1,181 @@
+package server
+
+import (
+	"strconv"
+	"sync/atomic"
+	"time"
+)
+
+/* Delete the key if it is logically expired. Returns true if the key was
+ * expired and removed. Keys are expired in two ways: lazily here, when they
+ * are accessed, and incrementally by ActiveExpireCycle() in the cron. */
+func ExpireIfNeeded(db *Db, key string) bool {
+	when, ok := db.GetExpire(key)
+	if !ok || time.Now().Before(when) {
+		return false
+	}
+	if db.Delete(key) {
+		atomic.AddInt64(&db.srv.StatExpiredKeys, 1)
+	}
+	return true
+}
+
+/* Try to expire a few timed out keys. The algorithm used is adaptive and
+ * will use few CPU cycles if there are few expiring keys, otherwise it will
+ * get more aggressive to avoid that too much memory is used by keys that can
+ * be removed from the keyspace.
+ *
+ * Every database is sampled ACTIVE_EXPIRE_CYCLE_LOOKUPS_PER_LOOP keys at a
+ * time, and the sampling is repeated as long as more than 25% of the keys
+ * were expired, or the time limit is reached. */
+func (s *Server) ActiveExpireCycle() {
+	// When clients are paused the dataset should be static not just from the
+	// POV of clients not being able to write, but also from the POV of
+	// expires and evictions of keys not being performed.
+	if s.ClientsArePaused() {
+		return
+	}
+	timelimit := time.Duration(1000000*ACTIVE_EXPIRE_CYCLE_SLOW_TIME_PERC/s.Hz/100) * time.Microsecond
+	start := time.Now()
+	latency := s.LatencyStartMonitor()
+	defer func() {
+		s.LatencyAddSampleIfNeeded("expire-cycle", LatencyEndMonitor(latency))
+	}()
+	for j := 0; j < s.DbNum; j++ {
+		db := s.Dbs[j]
+		for {
+			if db.ExpiresSize() == 0 {
+				break
+			}
+			keys := db.SampleKeys(ACTIVE_EXPIRE_CYCLE_LOOKUPS_PER_LOOP, true)
+			expired := 0
+			var ttlSum, ttlSamples int64
+			for _, key := range keys {
+				if ExpireIfNeeded(db, key) {
+					expired++
+				} else if when, ok := db.GetExpire(key); ok {
+					ttlSum += int64(time.Until(when) / time.Millisecond)
+					ttlSamples++
+				}
+			}
+			// Update the average TTL stats for this database.
+			if ttlSamples > 0 {
+				avgTTL := ttlSum / ttlSamples
+				// Do a simple running average with a few samples.
+				// We just use the current estimate with a weight of 2%
+				// and the previous estimate with a weight of 98%.
+				old := atomic.LoadInt64(&db.avgTTL)
+				if old == 0 {
+					old = avgTTL
+				}
+				atomic.StoreInt64(&db.avgTTL, (old/50)*49+(avgTTL/50))
+			}
+			if time.Since(start) > timelimit {
+				return
+			}
+			if expired <= ACTIVE_EXPIRE_CYCLE_LOOKUPS_PER_LOOP/4 {
+				break
+			}
+		}
+	}
+}
+
+/* This is the generic command implementation for EXPIRE, PEXPIRE, EXPIREAT
+ * and PEXPIREAT. Because the command second argument may be relative or
+ * absolute the "basetime" argument is used to signal what the base time is
+ * (either 0 for *AT variants of the command, or the current time for
+ * relative expires).
+ *
+ * unit is either UNIT_SECONDS or UNIT_MILLISECONDS, and is only used for
+ * the argv[2] parameter. The basetime is always specified in milliseconds. */
+func ExpireGenericCommand(c *KiwiClient, basetime int64, unit int) {
+	key := c.Argv[1]
+	when, err := strconv.ParseInt(c.Argv[2], 10, 64)
+	if err != nil {
+		AddReplyError(c, "value is not an integer or out of range")
+		return
+	}
+	if unit == UNIT_SECONDS {
+		when *= 1000
+	}
+	when += basetime
+
+	// No key, return zero.
+	if LookupKeyWrite(c.Db, key) == nil {
+		AddReply(c, c.srv.Shared.Zero)
+		return
+	}
+	deadline := time.Unix(0, when*int64(time.Millisecond))
+	if !deadline.After(time.Now()) {
+		// An expire in the past deletes the key right away.
+		c.Db.Delete(key)
+		atomic.AddInt64(&c.srv.Dirty, 1)
+		AddReply(c, c.srv.Shared.One)
+		return
+	}
+	c.Db.SetExpire(key, deadline)
+	atomic.AddInt64(&c.srv.Dirty, 1)
+	AddReply(c, c.srv.Shared.One)
+}
+
+func mstime() int64 {
+	return time.Now().UnixNano() / int64(time.Millisecond)
+}
+
+var ExpireCommand CommandProcess = func(c *KiwiClient) {
+	ExpireGenericCommand(c, mstime(), UNIT_SECONDS)
+}
+
+var ExpireAtCommand CommandProcess = func(c *KiwiClient) {
+	ExpireGenericCommand(c, 0, UNIT_SECONDS)
+}
+
+var PExpireCommand CommandProcess = func(c *KiwiClient) {
+	ExpireGenericCommand(c, mstime(), UNIT_MILLISECONDS)
+}
+
+var PExpireAtCommand CommandProcess = func(c *KiwiClient) {
+	ExpireGenericCommand(c, 0, UNIT_MILLISECONDS)
+}
+
+/* Implements TTL and PTTL */
+func TtlGenericCommand(c *KiwiClient, outputMs bool) {
+	// If the key does not exist at all, return -2
+	if LookupKeyRead(c.Db, c.Argv[1]) == nil {
+		AddReplyInt(c, -2)
+		return
+	}
+	// The key exists. Return -1 if it has no expire, or the actual
+	// TTL value otherwise.
+	when, ok := c.Db.GetExpire(c.Argv[1])
+	if !ok {
+		AddReplyInt(c, -1)
+		return
+	}
+	ttl := time.Until(when)
+	if ttl < 0 {
+		ttl = 0
+	}
+	if outputMs {
+		AddReplyInt(c, int((ttl+time.Millisecond/2)/time.Millisecond))
+	} else {
+		AddReplyInt(c, int((ttl+time.Second/2)/time.Second))
+	}
+}
+
+var TtlCommand CommandProcess = func(c *KiwiClient) {
+	TtlGenericCommand(c, false)
+}
+
+var PTtlCommand CommandProcess = func(c *KiwiClient) {
+	TtlGenericCommand(c, true)
+}
+
+var PersistCommand CommandProcess = func(c *KiwiClient) {
+	if LookupKeyWrite(c.Db, c.Argv[1]) != nil && c.Db.RemoveExpire(c.Argv[1]) {
+		atomic.AddInt64(&c.srv.Dirty, 1)
+		AddReply(c, c.srv.Shared.One)
+	} else {
+		AddReply(c, c.srv.Shared.Zero)
+	}
+}
@@ -0,0 +1,98 @@
+package server
+
+import (
+	"math/bits"
+	"sync/atomic"
+)
+
+/* A compact log-linear histogram used to track the latency of the commands.
+ *
+ * Values are split by their most significant bit, and every power of two is
+ * split again in HISTOGRAM_SUB_BUCKETS linear sub buckets, so the error of
+ * the reported percentiles is bounded to 1/HISTOGRAM_SUB_BUCKETS of the
+ * value. Values smaller than HISTOGRAM_SUB_BUCKETS are tracked exactly.
+ *
+ * Recording a value is lock free, so the histogram can be updated by all
+ * the event loops at the same time. */
+type Histogram struct {
+	counts [HISTOGRAM_BUCKETS]int64
+	total  int64
+	max    int64
+}
+
+func CreateHistogram() *Histogram {
+	return &Histogram{}
+}
+
+func histogramIndex(v int64) int {
+	if v < HISTOGRAM_SUB_BUCKETS {
+		return int(v)
+	}
+	shift := uint(bits.Len64(uint64(v)) - HISTOGRAM_SUB_BUCKET_BITS - 1)
+	return int(shift+1)*HISTOGRAM_SUB_BUCKETS + int(v>>shift) - HISTOGRAM_SUB_BUCKETS
+}
+
+/* Return the highest value that is recorded in the bucket at idx. */
+func histogramHighestEquivalentValue(idx int) int64 {
+	major, minor := idx/HISTOGRAM_SUB_BUCKETS, int64(idx%HISTOGRAM_SUB_BUCKETS)
+	if major == 0 {
+		return minor
+	}
+	shift := uint(major - 1)
+	return ((HISTOGRAM_SUB_BUCKETS+minor+1)<<shift - 1)
+}
+
+func (h *Histogram) Record(v int64) {
+	if v < 0 {
+		v = 0
+	}
+	atomic.AddInt64(&h.counts[histogramIndex(v)], 1)
+	atomic.AddInt64(&h.total, 1)
+	for {
+		max := atomic.LoadInt64(&h.max)
+		if v <= max || atomic.CompareAndSwapInt64(&h.max, max, v) {
+			break
+		}
+	}
+}
+
+func (h *Histogram) TotalCount() int64 {
+	return atomic.LoadInt64(&h.total)
+}
+
+/* Return the value at the given percentile (0-100), that is the highest
+ * value of the bucket where the percentile falls, capped to the max value
+ * recorded. */
+func (h *Histogram) ValueAtPercentile(p float64) int64 {
+	total := h.TotalCount()
+	if total == 0 {
+		return 0
+	}
+	if p > 100 {
+		p = 100
+	}
+	target := int64(p/100*float64(total) + 0.5)
+	if target < 1 {
+		target = 1
+	}
+	max := atomic.LoadInt64(&h.max)
+	var count int64
+	for idx := range h.counts {
+		count += atomic.LoadInt64(&h.counts[idx])
+		if count >= target {
+			if v := histogramHighestEquivalentValue(idx); v < max {
+				return v
+			}
+			return max
+		}
+	}
+	return max
+}
+
+func (h *Histogram) Reset() {
+	for idx := range h.counts {
+		atomic.StoreInt64(&h.counts[idx], 0)
+	}
+	atomic.StoreInt64(&h.total, 0)
+	atomic.StoreInt64(&h.max, 0)
+}
@@ -0,0 +1,133 @@
+package server
+
+import (
+	"strings"
+	"time"
+
+	"github.com/zhaotong0312/kiwi/event"
+)
+
+/* ============================ Internal clients ============================ */
+
+/* Internal clients execute commands on behalf of the program embedding the
+ * server, see the kiwi package: they run the same command implementations
+ * as the connected clients, but have no connection, and their replies are
+ * returned by Execute() instead of being written to a socket.
+ *
+ * Like the fake clients of Redis they have no user, so they are never
+ * denied by the ACLs, they are not listed by CLIENT LIST, and they are
+ * never paused nor redirected by the cluster.
+ *
+ * Without a partitioned keyspace the commands are serialized with the
+ * execution lock, see multi.go, whether or not the server is listening.
+ * With a partitioned keyspace, see partition.go, a command is executed:
+ *
+ * 1) With the world lock held, when the event loops are not running: the
+ *    internal clients are the only ones accessing the keyspace.
+ * 2) Otherwise by the loop owning its keys, or by the first loop when it
+ *    accesses the whole keyspace or no key at all. */
+func (s *Server) CreateInternalClient() *KiwiClient {
+	// The cached time is updated by the cron job in the event loops.
+	createTime := time.Now()
+	c := &KiwiClient{
+		srv:             s,
+		PeerId:          "internal",
+		OutBuf:          &ReplyList{},
+		CreateTime:      createTime,
+		lastInteraction: createTime.UnixNano(),
+		Flags:           CLIENT_INTERNAL,
+		Authenticated:   1,
+		Resp:            3,
+	}
+	c.GetNextClientId()
+	SelectDB(c, 0)
+	return c
+}
+
+/* Execute a command and return its reply, in the protocol of the client:
+ * RESP3 unless changed with HELLO. An internal client executes a single
+ * command at a time: different goroutines must use different clients. */
+func (c *KiwiClient) Execute(argv []string) []byte {
+	if len(argv) == 0 {
+		return nil
+	}
+	p := c.srv.partitions
+	if p == nil {
+		c.loop = -1
+		return c.execute(argv)
+	}
+	for {
+		p.world.Lock()
+		es := p.es
+		if es == nil {
+			c.loop = -1
+			reply := c.execute(argv)
+			p.world.Unlock()
+			return reply
+		}
+		p.world.Unlock()
+		if reply, ok := c.executeInLoop(es, argv); ok {
+			return reply
+		}
+		// The loops are gone: the event server is unbound before it is
+		// done, so the next attempt gets the world.
+		<-es.Done()
+	}
+}
+
+func (c *KiwiClient) execute(argv []string) []byte {
+	c.Argv = argv
+	c.Argc = len(argv)
+	ProcessCommand(c)
+	c.ResetArgv()
+	return c.OutBuf.Flatten()
+}
+
+/* Execute the command in the loop owning its keys. ok is false if the
+ * loops stopped before executing it. */
+func (c *KiwiClient) executeInLoop(es *event.EventServer, argv []string) (reply []byte, ok bool) {
+	loop := c.commandLoop(argv)
+	done := make(chan []byte, 1)
+	err := es.Post(loop, func() {
+		c.loop = loop
+		done <- c.execute(argv)
+	})
+	if err != nil {
+		return nil, false
+	}
+	select {
+	case reply = <-done:
+		return reply, true
+	case <-es.Done():
+		// The command may have been executed by the last iteration of
+		// the loop.
+		select {
+		case reply = <-done:
+			return reply, true
+		default:
+			return nil, false
+		}
+	}
+}
+
+/* Return the loop where the command must be executed, see the top
+ * comment. Commands that ProcessCommand() is going to reject or to queue
+ * in a transaction go to the first loop. */
+func (c *KiwiClient) commandLoop(argv []string) int {
+	cmd := c.srv.LookUpCommand(strings.ToLower(argv[0]))
+	argc := len(argv)
+	if cmd == nil || (cmd.Arity > 0 && cmd.Arity != argc) || argc < -cmd.Arity {
+		return 0
+	}
+	if c.WithFlags(CLIENT_MULTI) && !IsMultiControlCommand(cmd) {
+		return 0
+	}
+	c.Cmd, c.Argv, c.Argc = cmd, argv, argc
+	part := CommandPartition(c)
+	c.ResetArgv()
+	if part < 0 {
+		// PARTITION_NONE or PARTITION_ALL.
+		return 0
+	}
+	return part
+}
@@ -0,0 +1,537 @@
+package server
+
+import (
+	"fmt"
+	"math"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+/* The latency monitor allows to easily observe the sources of latency
+ * in a Kiwi instance using the LATENCY command. Different latency
+ * sources are monitored: the event loops, the commands, the cron, the
+ * expire cycle, eviction and the deletion of big keys. Kiwi has no
+ * persistence, so unlike Redis there is no AOF or RDB fsync event: the only
+ * fsync sampled is the one of the cluster config file, cluster-config-fsync.
+ *
+ * The event-loop samples don't include the time spent waiting for the
+ * other loops to release the keyspace, see LockKeyspace().
+ *
+ * Latency samples are only collected when they are greater or equal to
+ * the 'latency-monitor-threshold' config directive, in milliseconds.
+ * A threshold of zero disables the monitor. */
+
+/* Representation of a latency sample: the sampling time and the latency
+ * observed in milliseconds. */
+type LatencySample struct {
+	Time    int64 // We don't use time.Time to keep the samples comparable.
+	Latency int64 // Latency in milliseconds.
+}
+
+/* The latency time series for a given event. */
+type LatencyTimeSeries struct {
+	Idx     int   // Index of the next sample to store.
+	Max     int64 // Max latency observed for this event.
+	Samples [LATENCY_TS_LEN]LatencySample
+}
+
+/* Latency statistics structure. */
+type LatencyStats struct {
+	All     int64 // Absolute max latency since latest reset.
+	Avg     int64 // Average of current samples.
+	Min     int64 // Min of current samples.
+	Max     int64 // Max of current samples.
+	Mad     int64 // Mean absolute deviation.
+	Samples int   // Number of non-zero samples.
+	Period  int64 // Number of seconds since first event and now.
+}
+
+/* The latency events of a server, by event name. */
+type latencyState struct {
+	sync.Mutex
+	series map[string]*LatencyTimeSeries
+}
+
+/* Latency monitor initialization. We just need to create the map
+ * of time series, each time series is created on demand in order to
+ * avoid having a fixed list to maintain. */
+func (s *Server) LatencyMonitorInit() {
+	s.latencyEvents.Lock()
+	s.latencyEvents.series = make(map[string]*LatencyTimeSeries)
+	s.latencyEvents.Unlock()
+}
+
+/* Start measuring the latency of an operation. The returned time should
+ * be passed to LatencyEndMonitor() once the operation completes. */
+func (s *Server) LatencyStartMonitor() time.Time {
+	if s.LatencyMonitorThreshold > 0 {
+		return time.Now()
+	}
+	return time.Time{}
+}
+
+/* Return the latency in milliseconds elapsed since 'start', or zero if
+ * the monitor was disabled when the measurement started. */
+func LatencyEndMonitor(start time.Time) int64 {
+	if start.IsZero() {
+		return 0
+	}
+	return int64(time.Since(start) / time.Millisecond)
+}
+
+/* Add the sample only if the elapsed time is >= to the configured threshold. */
+func (s *Server) LatencyAddSampleIfNeeded(event string, latency int64) {
+	if s.LatencyMonitorThreshold > 0 && latency >= s.LatencyMonitorThreshold {
+		s.LatencyAddSample(event, latency)
+	}
+}
+
+/* Add the specified sample to the specified time series "event".
+ * This function is usually called via LatencyAddSampleIfNeeded(), that
+ * is a wrapper that only adds the sample if the latency is higher than
+ * the configured threshold. */
+func (s *Server) LatencyAddSample(event string, latency int64) {
+	now := time.Now().Unix()
+	s.latencyEvents.Lock()
+	defer s.latencyEvents.Unlock()
+	ts := s.latencyEvents.series[event]
+	if ts == nil {
+		ts = &LatencyTimeSeries{}
+		s.latencyEvents.series[event] = ts
+	}
+	if latency > ts.Max {
+		ts.Max = latency
+	}
+
+	// If the previous sample is in the same second, we update our old sample
+	// if this latency is > of the old one, or just return.
+	prev := (ts.Idx + LATENCY_TS_LEN - 1) % LATENCY_TS_LEN
+	if ts.Samples[prev].Time == now {
+		if latency > ts.Samples[prev].Latency {
+			ts.Samples[prev].Latency = latency
+		}
+		return
+	}
+
+	ts.Samples[ts.Idx].Time = now
+	ts.Samples[ts.Idx].Latency = latency
+	ts.Idx++
+	if ts.Idx == LATENCY_TS_LEN {
+		ts.Idx = 0
+	}
+}
+
+/* Reset data for the specified event, or all the events data if 'event' is
+ * an empty string.
+ *
+ * Note: this is O(N) even when event_to_reset is not NULL because makes
+ * the code simpler and we have a small fixed max number of events. */
+func (s *Server) LatencyResetEvent(eventToReset string) int {
+	s.latencyEvents.Lock()
+	defer s.latencyEvents.Unlock()
+	resets := 0
+	for event := range s.latencyEvents.series {
+		if eventToReset == "" || strings.EqualFold(event, eventToReset) {
+			delete(s.latencyEvents.series, event)
+			resets++
+		}
+	}
+	return resets
+}
+
+/* Return a copy of the time series of the specified event, or nil if no
+ * such event was recorded. */
+func (s *Server) latencyGetTimeSeries(event string) *LatencyTimeSeries {
+	s.latencyEvents.Lock()
+	defer s.latencyEvents.Unlock()
+	ts := s.latencyEvents.series[event]
+	if ts == nil {
+		return nil
+	}
+	cp := *ts
+	return &cp
+}
+
+/* Return the sorted names of the events having a time series. */
+func (s *Server) latencyEventNames() []string {
+	s.latencyEvents.Lock()
+	defer s.latencyEvents.Unlock()
+	names := make([]string, 0, len(s.latencyEvents.series))
+	for event := range s.latencyEvents.series {
+		names = append(names, event)
+	}
+	sort.Strings(names)
+	return names
+}
+
+/* ------------------------ Latency reporting (doctor) ---------------------- */
+
+/* Analyze the samples available for a given event and return a structure
+ * populate with different metrics, average, MAD, min, max, and so forth.
+ * Check LatencyStats for more info. */
+func AnalyzeLatencyForEvent(ts *LatencyTimeSeries) LatencyStats {
+	ls := LatencyStats{All: ts.Max, Min: math.MaxInt64}
+	now := time.Now().Unix()
+
+	// First pass, populate everything but the MAD.
+	var sum int64
+	for j := 0; j < LATENCY_TS_LEN; j++ {
+		if ts.Samples[j].Time == 0 {
+			continue
+		}
+		ls.Samples++
+		if ls.Samples == 1 {
+			ls.Min = ts.Samples[j].Latency
+			ls.Max = ts.Samples[j].Latency
+		} else {
+			if ls.Min > ts.Samples[j].Latency {
+				ls.Min = ts.Samples[j].Latency
+			}
+			if ls.Max < ts.Samples[j].Latency {
+				ls.Max = ts.Samples[j].Latency
+			}
+		}
+		sum += ts.Samples[j].Latency
+
+		// Track the oldest event time in ls.Period.
+		if ls.Period == 0 || ts.Samples[j].Time < ls.Period {
+			ls.Period = ts.Samples[j].Time
+		}
+	}
+	if ls.Samples == 0 {
+		ls.Min = 0
+		return ls
+	}
+	ls.Avg = sum / int64(ls.Samples)
+	ls.Period = now - ls.Period
+	if ls.Period == 0 {
+		ls.Period = 1
+	}
+
+	// Second pass, compute MAD.
+	sum = 0
+	for j := 0; j < LATENCY_TS_LEN; j++ {
+		if ts.Samples[j].Time == 0 {
+			continue
+		}
+		delta := ls.Avg - ts.Samples[j].Latency
+		if delta < 0 {
+			delta = -delta
+		}
+		sum += delta
+	}
+	ls.Mad = sum / int64(ls.Samples)
+	return ls
+}
+
+/* Create a human readable report of latency events for this Kiwi instance. */
+func (s *Server) CreateLatencyReport() string {
+	var report strings.Builder
+	advices := map[string]bool{}
+
+	// Return ASAP if the latency engine is disabled and it looks like it
+	// was never enabled so far.
+	names := s.latencyEventNames()
+	if len(names) == 0 && s.LatencyMonitorThreshold == 0 {
+		return "I'm sorry, Dave, I can't do that. Latency monitoring is disabled in this Kiwi instance. " +
+			"You may use \"CONFIG SET latency-monitor-threshold <milliseconds>.\" in order to enable it. " +
+			"If we weren't in a deep space mission I'd suggest to take a look at https://redis.io/topics/latency-monitor.\n"
+	}
+
+	// Show all the events stats and add for each event some event-related
+	// comment depending on the values.
+	eventid := 0
+	for _, event := range names {
+		ts := s.latencyGetTimeSeries(event)
+		if ts == nil {
+			continue
+		}
+		ls := AnalyzeLatencyForEvent(ts)
+		if ls.Samples == 0 {
+			continue
+		}
+		eventid++
+		if eventid == 1 {
+			report.WriteString("Dave, I have observed latency spikes in this Kiwi instance. " +
+				"You don't mind talking about it, do you Dave?\n\n")
+		}
+		fmt.Fprintf(&report, "%d. %s: %d latency spikes (average %dms, mean deviation %dms, period %.2f sec). "+
+			"Worst all time event %dms.", eventid, event, ls.Samples, ls.Avg, ls.Mad,
+			float64(ls.Period)/float64(ls.Samples), ts.Max)
+
+		// Fork, expire and eviction events are handled by the server itself,
+		// the other ones are caused by what clients are doing.
+		switch {
+		case event == "command" || event == "fast-command":
+			// Slow command or fast command slow because of the dataset size.
+			if event == "command" {
+				advices["slowcommand"] = true
+			} else {
+				report.WriteString(" Fast commands are unexpectedly slow, the server may be overloaded.")
+				advices["fastcommand"] = true
+			}
+		case event == "expire-cycle":
+			report.WriteString(" Many keys with the same expire time may cause long active expire cycles.")
+			advices["expirecycle"] = true
+		case strings.HasPrefix(event, "eviction-"):
+			advices["eviction"] = true
+		case event == "delete":
+			advices["delete"] = true
+		case strings.HasSuffix(event, "fsync"):
+			advices["disk"] = true
+		case event == "event-loop" || event == "cron":
+			advices["eventloop"] = true
+		}
+		report.WriteString("\n")
+	}
+
+	if eventid == 0 {
+		report.WriteString("Dave, no latency spike was observed during the lifetime of this Kiwi instance, " +
+			"not in the slightest bit. I honestly think you ought to sleep a little bit and " +
+			"think about the issue.\n")
+		return report.String()
+	}
+	if len(advices) == 0 {
+		report.WriteString("\nWhile there are latency events logged, I'm not able to suggest any easy fix. " +
+			"Please use the Kiwi community to get some help, providing this report in your help request.\n")
+		return report.String()
+	}
+
+	// Some latency is present, provide the advices.
+	report.WriteString("\nI have a few advices for you:\n\n")
+	if advices["slowcommand"] {
+		fmt.Fprintf(&report, "- Check your Slow Log to understand what are the commands you are running "+
+			"which are too slow to execute. Please check https://redis.io/commands/slowlog for more "+
+			"information.\n")
+		if s.SlowlogLogSlowerThan < 0 {
+			report.WriteString("- The slow log is disabled. Please enable it with " +
+				"CONFIG SET slowlog-log-slower-than <microseconds>.\n")
+		} else if s.SlowlogLogSlowerThan/1000 > s.LatencyMonitorThreshold {
+			fmt.Fprintf(&report, "- The configured slow log threshold (%dus) is higher than the latency "+
+				"monitor threshold (%dms). Consider lowering it so that the slow commands are logged.\n",
+				s.SlowlogLogSlowerThan, s.LatencyMonitorThreshold)
+		}
+	}
+	if advices["fastcommand"] {
+		report.WriteString("- The system is slow to execute Kiwi code paths not containing system calls. " +
+			"This usually means the system does not provide Kiwi CPU time to run for long periods. " +
+			"Check the number of event loops and the GOMAXPROCS setting.\n")
+	}
+	if advices["expirecycle"] {
+		report.WriteString("- Deleting, expiring or evicting (because of maxmemory policy) large objects is " +
+			"a blocking operation. If you have very large objects that are often deleted, expired, or " +
+			"evicted, try to fragment those objects into multiple smaller objects.\n")
+		report.WriteString("- Check if many keys are set with the same expire time, this is a common cause " +
+			"of long active expire cycles.\n")
+	}
+	if advices["eviction"] {
+		report.WriteString("- The eviction of keys is taking a lot of time. Consider raising maxmemory or " +
+			"using a less expensive maxmemory-samples value.\n")
+	}
+	if advices["delete"] {
+		report.WriteString("- Deleting large objects is a blocking operation. Consider using UNLINK " +
+			"instead of DEL for big keys.\n")
+	}
+	if advices["disk"] {
+		report.WriteString("- Syncing files to disk is slow. Check the disk I/O of this instance and " +
+			"the other processes sharing the same disk.\n")
+	}
+	if advices["eventloop"] {
+		report.WriteString("- The event loop or the server cron are slow. Check the load of the system, " +
+			"the number of connected clients and the 'hz' configuration.\n")
+	}
+	return report.String()
+}
+
+/* ---------------------- Latency command implementation -------------------- */
+
+/* LATENCY HISTORY: return time-latency samples for the specified event. */
+func LatencyCommandReplyWithSamples(c *KiwiClient, ts *LatencyTimeSeries) {
+	samples := make([]LatencySample, 0, LATENCY_TS_LEN)
+	for j := 0; j < LATENCY_TS_LEN; j++ {
+		i := (ts.Idx + j) % LATENCY_TS_LEN
+		if ts.Samples[i].Time == 0 {
+			continue
+		}
+		samples = append(samples, ts.Samples[i])
+	}
+	AddReplyMultiBulkLen(c, len(samples))
+	for _, s := range samples {
+		AddReplyMultiBulkLen(c, 2)
+		AddReplyInt(c, int(s.Time))
+		AddReplyInt(c, int(s.Latency))
+	}
+}
+
+/* LATENCY LATEST: return the latest latency for all the events classes. */
+func LatencyCommandReplyWithLatestEvents(c *KiwiClient) {
+	names := c.srv.latencyEventNames()
+	series := make([]*LatencyTimeSeries, 0, len(names))
+	for _, event := range names {
+		series = append(series, c.srv.latencyGetTimeSeries(event))
+	}
+	AddReplyMultiBulkLen(c, len(names))
+	for i, event := range names {
+		ts := series[i]
+		last := (ts.Idx + LATENCY_TS_LEN - 1) % LATENCY_TS_LEN
+		AddReplyMultiBulkLen(c, 4)
+		AddReplyBulkStr(c, event)
+		AddReplyInt(c, int(ts.Samples[last].Time))
+		AddReplyInt(c, int(ts.Samples[last].Latency))
+		AddReplyInt(c, int(ts.Max))
+	}
+}
+
+/* Render the time series as an ASCII graph: each column is a sample, the
+ * highest sample fills all the rows, the lowest one just the bottom row.
+ * Under the graph the age of every sample is written vertically, using
+ * the s/m/h/d suffixes for seconds, minutes, hours and days. */
+func LatencyCommandGenSparkeline(event string, ts *LatencyTimeSeries) string {
+	var graph strings.Builder
+	min, max := int64(-1), int64(0)
+	samples := make([]LatencySample, 0, LATENCY_TS_LEN)
+	labels := make([]string, 0, LATENCY_TS_LEN)
+	now := time.Now().Unix()
+	for j := 0; j < LATENCY_TS_LEN; j++ {
+		i := (ts.Idx + j) % LATENCY_TS_LEN
+		if ts.Samples[i].Time == 0 {
+			continue
+		}
+		s := ts.Samples[i]
+		samples = append(samples, s)
+		if s.Latency > max {
+			max = s.Latency
+		}
+		if min == -1 || s.Latency < min {
+			min = s.Latency
+		}
+		// Use as label the number of seconds / minutes / hours / days
+		// ago the event happened.
+		elapsed := now - s.Time
+		switch {
+		case elapsed < 60:
+			labels = append(labels, fmt.Sprintf("%ds", elapsed))
+		case elapsed < 3600:
+			labels = append(labels, fmt.Sprintf("%dm", elapsed/60))
+		case elapsed < 3600*24:
+			labels = append(labels, fmt.Sprintf("%dh", elapsed/3600))
+		default:
+			labels = append(labels, fmt.Sprintf("%dd", elapsed/(3600*24)))
+		}
+	}
+	if min == -1 {
+		min = 0
+	}
+
+	fmt.Fprintf(&graph, "%s - high %d ms, low %d ms (all time high %d ms)\n", event, max, min, ts.Max)
+	graph.WriteString(strings.Repeat("-", 80))
+	graph.WriteString("\n")
+
+	// Render the graph rows, from the top to the bottom.
+	levels := make([]int, len(samples))
+	for i, s := range samples {
+		if max == min {
+			levels[i] = LATENCY_GRAPH_ROWS
+		} else {
+			levels[i] = 1 + int((s.Latency-min)*(LATENCY_GRAPH_ROWS-1)/(max-min))
+		}
+	}
+	for row := LATENCY_GRAPH_ROWS; row >= 1; row-- {
+		line := make([]byte, len(samples))
+		for i, level := range levels {
+			switch {
+			case level > row:
+				line[i] = '|'
+			case level == row:
+				line[i] = '#'
+			case row == 1:
+				line[i] = '_'
+			default:
+				line[i] = ' '
+			}
+		}
+		graph.WriteString(strings.TrimRight(string(line), " "))
+		graph.WriteString("\n")
+	}
+	graph.WriteString("\n")
+
+	// Render the labels vertically.
+	maxLabel := 0
+	for _, label := range labels {
+		if len(label) > maxLabel {
+			maxLabel = len(label)
+		}
+	}
+	for row := 0; row < maxLabel; row++ {
+		line := make([]byte, len(labels))
+		for i, label := range labels {
+			if row < len(label) {
+				line[i] = label[row]
+			} else {
+				line[i] = ' '
+			}
+		}
+		graph.WriteString(strings.TrimRight(string(line), " "))
+		graph.WriteString("\n")
+	}
+	return graph.String()
+}
+
+/* LATENCY command implementations.
+ *
+ * LATENCY HISTORY: return time-latency samples for the specified event.
+ * LATENCY LATEST: return the latest latency for all the events classes.
+ * LATENCY DOCTOR: returns a human readable analysis of instance latency.
+ * LATENCY GRAPH: provide an ASCII graph of the latency of the specified event.
+ * LATENCY RESET: reset data of a specified event or all the data if no event provided. */
+var LatencyCommand CommandProcess = func(c *KiwiClient) {
+	sub := strings.ToLower(c.Argv[1])
+	if sub == "history" && c.Argc == 3 {
+		// LATENCY HISTORY <event>
+		ts := c.srv.latencyGetTimeSeries(c.Argv[2])
+		if ts == nil {
+			AddReplyMultiBulkLen(c, 0)
+			return
+		}
+		LatencyCommandReplyWithSamples(c, ts)
+	} else if sub == "graph" && c.Argc == 3 {
+		// LATENCY GRAPH <event>
+		event := c.Argv[2]
+		ts := c.srv.latencyGetTimeSeries(event)
+		if ts == nil {
+			AddReplyErrorFormat(c, "No samples available for event '%s'", event)
+			return
+		}
+		AddReplyVerbatim(c, LatencyCommandGenSparkeline(event, ts), "txt")
+	} else if sub == "latest" && c.Argc == 2 {
+		// LATENCY LATEST
+		LatencyCommandReplyWithLatestEvents(c)
+	} else if sub == "doctor" && c.Argc == 2 {
+		// LATENCY DOCTOR
+		AddReplyVerbatim(c, c.srv.CreateLatencyReport(), "txt")
+	} else if sub == "reset" && c.Argc >= 2 {
+		// LATENCY RESET
+		if c.Argc == 2 {
+			AddReplyInt(c, c.srv.LatencyResetEvent(""))
+		} else {
+			resets := 0
+			for j := 2; j < c.Argc; j++ {
+				resets += c.srv.LatencyResetEvent(c.Argv[j])
+			}
+			AddReplyInt(c, resets)
+		}
+	} else if sub == "help" && c.Argc == 2 {
+		AddReplyHelp(c, []string{
+			"DOCTOR -- Returns a human readable latency analysis report.",
+			"GRAPH <event> -- Returns an ASCII latency graph for the event class.",
+			"HISTORY <event> -- Returns time-latency samples for the event class.",
+			"LATEST -- Returns the latest latency samples for all events.",
+			"RESET [event ...] -- Resets latency data of one or more event classes.",
+			"                     (default: reset all data for all event classes)",
+		})
+	} else {
+		AddReplySubcommandSyntaxError(c)
+	}
+}
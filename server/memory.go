@@ -0,0 +1,337 @@
+package server
+
+import (
+	"fmt"
+	"runtime"
+	"runtime/debug"
+	"strconv"
+	"strings"
+	"sync/atomic"
+)
+
+/* ======================= The MEMORY command ============================== */
+
+type MemoryOverheadDb struct {
+	DbId              int
+	OverheadHtMain    int64
+	OverheadHtExpires int64
+}
+
+/* Memory overhead data, used by MEMORY STATS, MEMORY DOCTOR and INFO. The
+ * allocator numbers are taken from the Go runtime memstats. */
+type MemoryOverhead struct {
+	PeakAllocated    uint64
+	TotalAllocated   uint64
+	StartupAllocated uint64
+	ClientsNormal    int64
+	ClientsCount     int
+	Keyspace         int64 // Memory accounted for the keys, see UsedMemory
+	OverheadTotal    int64
+	Dataset          int64
+	TotalKeys        int
+	BytesPerKey      int64
+	DatasetPerc      float64
+	PeakPerc         float64
+	HeapInuse        uint64
+	HeapSys          uint64
+	Resident         uint64
+	Fragmentation    float64
+	NumGC            uint32
+	PauseTotalNs     uint64
+	Dbs              []MemoryOverheadDb
+}
+
+/* Update the peak memory, called by the cron. */
+func (s *Server) UpdatePeakMemory() {
+	ms := runtime.MemStats{}
+	runtime.ReadMemStats(&ms)
+	if ms.HeapAlloc > atomic.LoadUint64(&s.StatPeakMemory) {
+		atomic.StoreUint64(&s.StatPeakMemory, ms.HeapAlloc)
+	}
+}
+
+/* Return the memory used by the client buffers, as last published by the
+ * loop of the client, see PublishBufferSizes(). */
+func ClientComputeSize(c *KiwiClient) int64 {
+	qbuf, qbufFree, _, omem := c.BufferSizes()
+	return int64(CLIENT_OVERHEAD) + qbuf + qbufFree + omem
+}
+
+func (s *Server) GetMemoryOverheadData() *MemoryOverhead {
+	ms := runtime.MemStats{}
+	runtime.ReadMemStats(&ms)
+	mh := &MemoryOverhead{
+		TotalAllocated:   ms.HeapAlloc,
+		StartupAllocated: s.InitialMemoryUsage,
+		Keyspace:         atomic.LoadInt64(&s.UsedMemory),
+		HeapInuse:        ms.HeapInuse,
+		HeapSys:          ms.HeapSys,
+		Resident:         ms.Sys - ms.HeapReleased,
+		NumGC:            ms.NumGC,
+		PauseTotalNs:     ms.PauseTotalNs,
+	}
+	if ms.HeapAlloc > atomic.LoadUint64(&s.StatPeakMemory) {
+		atomic.StoreUint64(&s.StatPeakMemory, ms.HeapAlloc)
+	}
+	mh.PeakAllocated = atomic.LoadUint64(&s.StatPeakMemory)
+	overhead := int64(mh.StartupAllocated)
+
+	s.mutex.RLock()
+	for _, c := range s.ClientsMap {
+		mh.ClientsNormal += ClientComputeSize(c)
+		mh.ClientsCount++
+	}
+	s.mutex.RUnlock()
+	overhead += mh.ClientsNormal
+
+	for j := 0; j < s.DbNum; j++ {
+		db := s.Dbs[j]
+		keys, expires := db.Size(), db.ExpiresSize()
+		if keys == 0 {
+			continue
+		}
+		mh.TotalKeys += keys
+		mdb := MemoryOverheadDb{
+			DbId:              j,
+			OverheadHtMain:    int64(keys) * DB_ENTRY_OVERHEAD,
+			OverheadHtExpires: int64(expires) * EXPIRE_ENTRY_OVERHEAD,
+		}
+		overhead += mdb.OverheadHtMain + mdb.OverheadHtExpires
+		mh.Dbs = append(mh.Dbs, mdb)
+	}
+	mh.OverheadTotal = overhead
+
+	// The heap also holds garbage not yet collected, so the dataset
+	// computed by difference may be off, never report it as negative.
+	if mh.Dataset = int64(mh.TotalAllocated) - overhead; mh.Dataset < 0 {
+		mh.Dataset = 0
+	}
+	if mh.TotalKeys > 0 {
+		mh.BytesPerKey = (int64(mh.TotalAllocated) - int64(mh.StartupAllocated)) / int64(mh.TotalKeys)
+	}
+	if net := int64(mh.TotalAllocated) - int64(mh.StartupAllocated); net > 0 {
+		mh.DatasetPerc = float64(mh.Dataset) * 100 / float64(net)
+	}
+	if mh.PeakAllocated > 0 {
+		mh.PeakPerc = float64(mh.TotalAllocated) * 100 / float64(mh.PeakAllocated)
+	}
+	if mh.TotalAllocated > 0 {
+		mh.Fragmentation = float64(mh.Resident) / float64(mh.TotalAllocated)
+	}
+	return mh
+}
+
+/* Implementation of MEMORY DOCTOR: return a human readable analysis of
+ * the memory condition of the instance. */
+func (s *Server) GetMemoryDoctorReport() string {
+	emptyInstance := false     // Instance is empty or almost empty.
+	bigPeak := false           // Memory peak is much larger than used mem.
+	highFrag := false          // High fragmentation.
+	bigClientBuf := false      // Client buffers are too big.
+	heapOverMaxMemory := false // Heap is much larger than the maxmemory.
+	frequentGC := false        // GC takes a noticeable share of the time.
+	numReports := 0
+
+	mh := s.GetMemoryOverheadData()
+	if mh.TotalAllocated < 1024*1024*5 {
+		emptyInstance = true
+		numReports++
+	} else {
+		// Peak is > 150% of current used memory?
+		if float64(mh.PeakAllocated)/float64(mh.TotalAllocated) > 1.5 {
+			bigPeak = true
+			numReports++
+		}
+
+		// Fragmentation is higher than 1.4?
+		if mh.Fragmentation > 1.4 {
+			highFrag = true
+			numReports++
+		}
+
+		// Clients using more than 200k each average?
+		if mh.ClientsCount > 0 && mh.ClientsNormal/int64(mh.ClientsCount) > 1024*200 {
+			bigClientBuf = true
+			numReports++
+		}
+
+		// The heap holds more than twice the memory accounted for maxmemory?
+		if s.MaxMemory > 0 && mh.TotalAllocated > uint64(s.MaxMemory)*2 {
+			heapOverMaxMemory = true
+			numReports++
+		}
+
+		// More than one collection every second on average since startup?
+		if uptime := s.UnixTime.Sub(s.StartTime).Seconds(); uptime > 60 && float64(mh.NumGC) > uptime {
+			frequentGC = true
+			numReports++
+		}
+	}
+
+	report := strings.Builder{}
+	if numReports == 0 {
+		report.WriteString("Hi Sam, I can't find any memory issue in your instance. " +
+			"I can only account for what occurs on this base.")
+	} else if emptyInstance {
+		report.WriteString("Hi Sam, this instance is empty or is using very little memory, " +
+			"my issues detector can't be used in these conditions. " +
+			"Please, leave for your mission on Earth and fill it with some data. " +
+			"The new Sam and I will be back to our programming as soon as I " +
+			"finished rebooting.")
+	} else {
+		report.WriteString("Sam, I detected a few issues in this Kiwi instance memory implants:\n\n")
+		if bigPeak {
+			report.WriteString(" * Peak memory: In the past this instance used more than 150% the memory that is currently using. " +
+				"The Go runtime returns the memory to the system lazily, so the RSS of the process may still be large. " +
+				"You can use MEMORY PURGE to force the memory to be released.\n\n")
+		}
+		if highFrag {
+			report.WriteString(fmt.Sprintf(" * High fragmentation: This instance has a memory fragmentation greater than 1.4 (this means that the Resident Set Size of the Kiwi process is much larger than the sum of the logical allocations Kiwi performed). "+
+				"The runtime holds %d bytes of heap of which %d are in use, "+
+				"MEMORY PURGE may give the unused memory back to the system.\n\n", mh.HeapSys, mh.HeapInuse))
+		}
+		if bigClientBuf {
+			report.WriteString(" * Big client buffers: The clients output buffers are in general larger than 200 KB average. " +
+				"This may result from different causes, like Pub/Sub clients subscribed to channels but not receiving data fast enough, " +
+				"or clients sending large pipelines without reading the replies. " +
+				"Please use the CLIENT LIST command to analyze the client buffers.\n\n")
+		}
+		if heapOverMaxMemory {
+			report.WriteString(fmt.Sprintf(" * Heap over maxmemory: The heap uses more than twice the configured maxmemory of %d bytes. "+
+				"Maxmemory only accounts for the keyspace, the rest of the heap are clients, buffers and garbage not collected yet.\n\n",
+				s.MaxMemory))
+		}
+		if frequentGC {
+			report.WriteString(fmt.Sprintf(" * Frequent garbage collection: %d collections were performed since startup, "+
+				"with a total pause of %d ms. Workloads that create many short lived values make the collector run often.\n\n",
+				mh.NumGC, mh.PauseTotalNs/1000000))
+		}
+		report.WriteString("I'm here to keep you safe, Sam. I want to help you.\n")
+	}
+	return report.String()
+}
+
+var MemoryCommand CommandProcess = func(c *KiwiClient) {
+	sub := strings.ToLower(c.Argv[1])
+	if sub == "help" && c.Argc == 2 {
+		AddReplyHelp(c, []string{
+			"DOCTOR - Return memory problems reports.",
+			"STATS -- Return information about the memory usage of the server.",
+			"USAGE <key> [SAMPLES <count>] -- Return memory in bytes used by <key> and its value. Nested values are sampled up to <count> times (default: 5).",
+			"PURGE -- Force the Go runtime to release the memory it holds back to the operating system.",
+		})
+	} else if sub == "usage" && c.Argc >= 3 {
+		samples := OBJ_COMPUTE_SIZE_DEF_SAMPLES
+		for j := 3; j < c.Argc; j++ {
+			if strings.ToLower(c.Argv[j]) == "samples" && j+1 < c.Argc {
+				n, err := strconv.Atoi(c.Argv[j+1])
+				if err != nil || n < 0 {
+					AddReplyError(c, "value is out of range, must be positive")
+					return
+				}
+				samples = n // Zero means sample all the elements.
+				j++
+			} else {
+				AddReplyErrorObject(c, c.srv.Shared.SyntaxErr)
+				return
+			}
+		}
+		ExpireIfNeeded(c.Db, c.Argv[2])
+		o := c.Db.Get(c.Argv[2])
+		if o == nil {
+			AddReplyNull(c)
+			return
+		}
+		usage := o.ComputeSize(samples) + int64(len(c.Argv[2])) + DB_ENTRY_OVERHEAD
+		AddReplyInt(c, int(usage))
+	} else if sub == "stats" && c.Argc == 2 {
+		mh := c.srv.GetMemoryOverheadData()
+
+		AddReplyMapLen(c, 20+len(mh.Dbs))
+
+		AddReplyBulkStr(c, "peak.allocated")
+		AddReplyInt(c, int(mh.PeakAllocated))
+
+		AddReplyBulkStr(c, "total.allocated")
+		AddReplyInt(c, int(mh.TotalAllocated))
+
+		AddReplyBulkStr(c, "startup.allocated")
+		AddReplyInt(c, int(mh.StartupAllocated))
+
+		AddReplyBulkStr(c, "clients.normal")
+		AddReplyInt(c, int(mh.ClientsNormal))
+
+		for _, mdb := range mh.Dbs {
+			AddReplyBulkStr(c, fmt.Sprintf("db.%d", mdb.DbId))
+			AddReplyMapLen(c, 2)
+			AddReplyBulkStr(c, "overhead.hashtable.main")
+			AddReplyInt(c, int(mdb.OverheadHtMain))
+			AddReplyBulkStr(c, "overhead.hashtable.expires")
+			AddReplyInt(c, int(mdb.OverheadHtExpires))
+		}
+
+		AddReplyBulkStr(c, "overhead.total")
+		AddReplyInt(c, int(mh.OverheadTotal))
+
+		AddReplyBulkStr(c, "keys.count")
+		AddReplyInt(c, mh.TotalKeys)
+
+		AddReplyBulkStr(c, "keys.bytes-per-key")
+		AddReplyInt(c, int(mh.BytesPerKey))
+
+		AddReplyBulkStr(c, "keyspace.bytes")
+		AddReplyInt(c, int(mh.Keyspace))
+
+		AddReplyBulkStr(c, "dataset.bytes")
+		AddReplyInt(c, int(mh.Dataset))
+
+		AddReplyBulkStr(c, "dataset.percentage")
+		AddReplyDouble(c, mh.DatasetPerc)
+
+		AddReplyBulkStr(c, "peak.percentage")
+		AddReplyDouble(c, mh.PeakPerc)
+
+		AddReplyBulkStr(c, "allocator.allocated")
+		AddReplyInt(c, int(mh.TotalAllocated))
+
+		AddReplyBulkStr(c, "allocator.active")
+		AddReplyInt(c, int(mh.HeapInuse))
+
+		AddReplyBulkStr(c, "allocator.heap")
+		AddReplyInt(c, int(mh.HeapSys))
+
+		AddReplyBulkStr(c, "allocator.resident")
+		AddReplyInt(c, int(mh.Resident))
+
+		AddReplyBulkStr(c, "fragmentation")
+		AddReplyDouble(c, mh.Fragmentation)
+
+		AddReplyBulkStr(c, "gc.count")
+		AddReplyInt(c, int(mh.NumGC))
+
+		AddReplyBulkStr(c, "gc.pause-total-ms")
+		AddReplyInt(c, int(mh.PauseTotalNs/1000000))
+
+		AddReplyBulkStr(c, "maxmemory")
+		AddReplyInt(c, c.srv.MaxMemory)
+
+		AddReplyBulkStr(c, "maxmemory-policy")
+		AddReplyBulkStr(c, GetMaxMemoryPolicyName(c.srv.MaxMemoryPolicy))
+	} else if sub == "doctor" && c.Argc == 2 {
+		AddReplyVerbatim(c, c.srv.GetMemoryDoctorReport(), "txt")
+	} else if sub == "purge" && c.Argc == 2 {
+		debug.FreeOSMemory()
+		AddReply(c, c.srv.Shared.Ok)
+	} else {
+		AddReplySubcommandSyntaxError(c)
+	}
+}
+
+/* The key of MEMORY USAGE is at position 2, the other subcommands have
+ * no keys. */
+func MemoryGetKeys(cmd *Command, argv []string, argc int) []int {
+	if argc >= 3 && strings.ToLower(argv[1]) == "usage" {
+		return []int{2}
+	}
+	return nil
+}
@@ -0,0 +1,117 @@
+package server
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+)
+
+/* MONITOR turns a connection into a live feed of every command executed
+ * by the server. Monitors are fed from the event loop executing the
+ * command, which is usually not the one owning the monitor connection,
+ * so the feed is queued with AddReplyAsync(). */
+
+type monitorList struct {
+	sync.RWMutex
+	clients []*KiwiClient
+}
+
+/* Return the number of monitors, so that callers can skip building the
+ * feed line when nobody is listening. */
+func (s *Server) MonitorsCount() int {
+	s.monitors.RLock()
+	defer s.monitors.RUnlock()
+	return len(s.monitors.clients)
+}
+
+/* Remove a client that is going away from the monitors. */
+func RemoveMonitor(c *KiwiClient) {
+	c.srv.monitors.Lock()
+	defer c.srv.monitors.Unlock()
+	for i, m := range c.srv.monitors.clients {
+		if m == c {
+			c.srv.monitors.clients = append(c.srv.monitors.clients[:i], c.srv.monitors.clients[i+1:]...)
+			return
+		}
+	}
+}
+
+/* Return true if the argument at position 'j' of the command must not be
+ * shown to monitors: passwords are replaced by "(redacted)". */
+func isRedactedArgument(argv []string, j int) bool {
+	switch strings.ToLower(argv[0]) {
+	case "auth":
+		return true
+	case "hello":
+		// HELLO <protover> AUTH <username> <password>
+		for i := 2; i < j; i++ {
+			if strings.ToLower(argv[i]) == "auth" && (j == i+1 || j == i+2) {
+				return true
+			}
+		}
+	case "migrate":
+		// MIGRATE ... AUTH <password> / AUTH2 <username> <password>
+		for i := 6; i < j; i++ {
+			opt := strings.ToLower(argv[i])
+			if opt == "auth" && j == i+1 {
+				return true
+			}
+			if opt == "auth2" && (j == i+1 || j == i+2) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+/* Build the line sent to monitors for the command of client 'c':
+ *
+ * +1339518083.107412 [0 127.0.0.1:60866] "keys" "*" */
+func CatMonitorString(c *KiwiClient, dictid int, argv []string, argc int) string {
+	var cmdrepr strings.Builder
+	now := time.Now()
+	fmt.Fprintf(&cmdrepr, "+%d.%06d ", now.Unix(), now.Nanosecond()/1000)
+	if c.WithFlags(CLIENT_UNIX_SOCKET) {
+		fmt.Fprintf(&cmdrepr, "[%d unix:%s] ", dictid, c.srv.UnixSocketPath)
+	} else {
+		fmt.Fprintf(&cmdrepr, "[%d %s] ", dictid, c.GetPeerId(c.srv))
+	}
+	for j := 0; j < argc; j++ {
+		if j != 0 && isRedactedArgument(argv, j) {
+			cmdrepr.WriteString(CatRepr("(redacted)"))
+		} else {
+			cmdrepr.WriteString(CatRepr(argv[j]))
+		}
+		if j != argc-1 {
+			cmdrepr.WriteByte(' ')
+		}
+	}
+	cmdrepr.WriteString("\r\n")
+	return cmdrepr.String()
+}
+
+/* Send the command of client 'c' to all the monitors. */
+func ReplicationFeedMonitors(c *KiwiClient, dictid int, argv []string, argc int) {
+	if c.srv.MonitorsCount() == 0 {
+		return
+	}
+	line := CatMonitorString(c, dictid, argv, argc)
+	c.srv.monitors.RLock()
+	defer c.srv.monitors.RUnlock()
+	for _, monitor := range c.srv.monitors.clients {
+		AddReplyAsync(monitor, line)
+	}
+}
+
+var MonitorCommand CommandProcess = func(c *KiwiClient) {
+	// ignore MONITOR if already slave or in monitor mode
+	if c.WithFlags(CLIENT_SLAVE) {
+		return
+	}
+	c.AddFlags(CLIENT_SLAVE | CLIENT_MONITOR)
+	c.srv.monitors.Lock()
+	c.srv.monitors.clients = append(c.srv.monitors.clients, c)
+	c.srv.monitors.Unlock()
+	AddReply(c, c.srv.Shared.Ok)
+}
@@ -0,0 +1,135 @@
+package server
+
+import "strings"
+
+/* ================================ MULTI/EXEC ============================== */
+
+/* Commands are executed one at a time, whatever the event loop of the
+ * client: ProcessCommand() holds the execution lock while a command runs,
+ * so that every command is atomic with respect to the whole keyspace.
+ * Reading and parsing the input, and writing the replies, stay parallel in
+ * the event loops.
+ *
+ * EXEC runs all the commands queued since MULTI while holding the lock
+ * taken for EXEC itself, so that a transaction is atomic too: no other
+ * client can observe or modify the keyspace in the middle of it. */
+
+/* A command queued in a MULTI context, to be executed by EXEC. */
+type MultiCmd struct {
+	Argv []string
+	Argc int
+	Cmd  *Command
+}
+
+type MultiState struct {
+	Commands []MultiCmd // Queued commands, in order
+	CmdFlags int        // The accumulated command flags
+}
+
+/* Release all the resources associated with MULTI/EXEC state */
+func FreeClientMultiState(c *KiwiClient) {
+	c.Mstate.Commands = nil
+	c.Mstate.CmdFlags = 0
+}
+
+/* Add a new command into the MULTI commands queue */
+func QueueMultiCommand(c *KiwiClient) {
+	// No sense to waste memory if the transaction is already aborted.
+	// this is useful in case client sends these in a pipeline, or doesn't
+	// bother to read previous responses and didn't notice the multi was
+	// already aborted.
+	if c.WithFlags(CLIENT_DIRTY_EXEC) {
+		return
+	}
+	c.Mstate.Commands = append(c.Mstate.Commands, MultiCmd{
+		Argv: c.Argv,
+		Argc: c.Argc,
+		Cmd:  c.Cmd,
+	})
+	c.Mstate.CmdFlags |= c.Cmd.Flags
+}
+
+func DiscardTransaction(c *KiwiClient) {
+	FreeClientMultiState(c)
+	c.DeleteFlags(CLIENT_MULTI | CLIENT_DIRTY_EXEC)
+}
+
+/* Discard the transaction of a client whose EXEC was rejected before its
+ * execution, like a command queued by the transaction would be, replying
+ * with the reason. err is an error reply, like the shared ones. */
+func ExecCommandAbort(c *KiwiClient, err string) {
+	DiscardTransaction(c)
+	err = strings.TrimSuffix(strings.TrimPrefix(err, "-"), "\r\n")
+	AddReplyError(c, "-EXECABORT Transaction discarded because of: "+err)
+}
+
+/* Flag the transaction as DIRTY_EXEC so that EXEC will fail.
+ * Should be called every time there is an error while queueing a command. */
+func FlagTransaction(c *KiwiClient) {
+	if c.WithFlags(CLIENT_MULTI) {
+		c.AddFlags(CLIENT_DIRTY_EXEC)
+	}
+}
+
+/* Return true if the command is executed right away in a MULTI context
+ * instead of being queued. */
+func IsMultiControlCommand(cmd *Command) bool {
+	return cmd.Name == "multi" || cmd.Name == "exec" || cmd.Name == "discard"
+}
+
+var MultiCommand CommandProcess = func(c *KiwiClient) {
+	if c.WithFlags(CLIENT_MULTI) {
+		AddReplyError(c, "MULTI calls can not be nested")
+		return
+	}
+	c.AddFlags(CLIENT_MULTI)
+	AddReply(c, c.srv.Shared.Ok)
+}
+
+var DiscardCommand CommandProcess = func(c *KiwiClient) {
+	if !c.WithFlags(CLIENT_MULTI) {
+		AddReplyError(c, "DISCARD without MULTI")
+		return
+	}
+	DiscardTransaction(c)
+	AddReply(c, c.srv.Shared.Ok)
+}
+
+var ExecCommand CommandProcess = func(c *KiwiClient) {
+	if !c.WithFlags(CLIENT_MULTI) {
+		AddReplyError(c, "EXEC without MULTI")
+		return
+	}
+	// EXEC after an error while queueing a command is disallowed: the
+	// whole transaction is discarded.
+	if c.WithFlags(CLIENT_DIRTY_EXEC) {
+		AddReplyErrorObject(c, c.srv.Shared.ExecAbortErr)
+		DiscardTransaction(c)
+		return
+	}
+
+	// Exec all the queued commands. The execution lock taken for EXEC is
+	// held until the last one returns.
+	origArgv, origArgc, origCmd := c.Argv, c.Argc, c.Cmd
+	AddReplyMultiBulkLen(c, len(c.Mstate.Commands))
+	for _, mc := range c.Mstate.Commands {
+		c.Argv = mc.Argv
+		c.Argc = mc.Argc
+		c.Cmd = mc.Cmd
+
+		// ACL permissions are also checked at the time of execution in case
+		// they changed after the commands were queued.
+		if aclRet, argpos := ACLCheckAllPerm(c); aclRet != ACL_OK {
+			object := c.Cmd.Name
+			if aclRet == ACL_DENIED_KEY {
+				object = c.Argv[argpos]
+			}
+			ACLAddLogEntry(c, aclRet, ACL_LOG_CTX_MULTI, object, "")
+			ACLReplyDenied(c, aclRet)
+			continue
+		}
+		Call(c, CMD_CALL_FULL)
+	}
+	c.Argv, c.Argc, c.Cmd = origArgv, origArgc, origCmd
+	DiscardTransaction(c)
+}
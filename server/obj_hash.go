@@ -0,0 +1,296 @@
+package server
+
+import (
+	"math"
+	"strconv"
+	"sync/atomic"
+
+	"github.com/zhaotong0312/kiwi/resp"
+)
+
+/* ================================ Hash type =============================== */
+
+func (s *Server) CreateHashObject() *HashObject {
+	dict := make(map[string]string)
+	return &HashObject{
+		Object: s.CreateObject(OBJ_RTYPE_HASH, OBJ_ENCODING_HT),
+		Value:  &dict,
+	}
+}
+
+/* Lookup a hash for write operations, creating it if create is true, see
+ * listLookupWriteOrReply(). */
+func hashLookupWriteOrReply(c *KiwiClient, key string, create bool) (*HashObject, bool) {
+	obj := LookupKeyWrite(c.Db, key)
+	if obj == nil {
+		if create {
+			return c.srv.CreateHashObject(), true
+		}
+		return nil, true
+	}
+	o, ok := obj.(*HashObject)
+	if !ok {
+		AddReplyErrorObject(c, c.srv.Shared.WrongTypeErr)
+		return nil, false
+	}
+	return o, true
+}
+
+func hashLookupReadOrReply(c *KiwiClient, key string, reply string) *HashObject {
+	obj := DbGetOrReply(c, key, reply)
+	if obj == nil {
+		return nil
+	}
+	o, ok := obj.(*HashObject)
+	if !ok {
+		AddReplyErrorObject(c, c.srv.Shared.WrongTypeErr)
+		return nil
+	}
+	return o
+}
+
+func hashStore(c *KiwiClient, key string, o *HashObject) {
+	if len(*o.Value) == 0 {
+		c.Db.Delete(key)
+		return
+	}
+	c.Db.Set(key, o)
+}
+
+/* HSET key field value [field value ...]
+ * HMSET is the same command, but replies +OK. */
+func HSetGenericCommand(c *KiwiClient, hmset bool) {
+	if c.Argc%2 == 1 {
+		AddReplyErrorFormat(c, "wrong number of arguments for '%s' command", c.Cmd.Name)
+		return
+	}
+	o, ok := hashLookupWriteOrReply(c, c.Argv[1], true)
+	if !ok {
+		return
+	}
+	created := 0
+	for j := 2; j < c.Argc; j += 2 {
+		if _, ok := (*o.Value)[c.Argv[j]]; !ok {
+			created++
+		}
+		(*o.Value)[c.Argv[j]] = c.Argv[j+1]
+	}
+	c.Db.Set(c.Argv[1], o)
+	atomic.AddInt64(&c.srv.Dirty, int64((c.Argc-2)/2))
+	if hmset {
+		AddReply(c, c.srv.Shared.Ok)
+	} else {
+		AddReplyInt(c, created)
+	}
+}
+
+var HSetCommand CommandProcess = func(c *KiwiClient) {
+	HSetGenericCommand(c, false)
+}
+
+var HMSetCommand CommandProcess = func(c *KiwiClient) {
+	HSetGenericCommand(c, true)
+}
+
+/* HSETNX key field value */
+var HSetNxCommand CommandProcess = func(c *KiwiClient) {
+	o, ok := hashLookupWriteOrReply(c, c.Argv[1], true)
+	if !ok {
+		return
+	}
+	if _, ok := (*o.Value)[c.Argv[2]]; ok {
+		AddReply(c, c.srv.Shared.Zero)
+		return
+	}
+	(*o.Value)[c.Argv[2]] = c.Argv[3]
+	c.Db.Set(c.Argv[1], o)
+	atomic.AddInt64(&c.srv.Dirty, 1)
+	AddReply(c, c.srv.Shared.One)
+}
+
+var HGetCommand CommandProcess = func(c *KiwiClient) {
+	o := hashLookupReadOrReply(c, c.Argv[1], c.srv.Shared.Null[c.Resp])
+	if o == nil {
+		return
+	}
+	if value, ok := (*o.Value)[c.Argv[2]]; ok {
+		AddReplyBulkStr(c, value)
+	} else {
+		AddReplyNull(c)
+	}
+}
+
+/* HMGET key field [field ...] */
+var HMGetCommand CommandProcess = func(c *KiwiClient) {
+	// Don't abort when the key cannot be found. Non-existing keys are
+	// empty hashes, where HMGET should respond with a series of null
+	// bulks.
+	var dict map[string]string
+	if obj := LookupKeyRead(c.Db, c.Argv[1]); obj != nil {
+		o, ok := obj.(*HashObject)
+		if !ok {
+			AddReplyErrorObject(c, c.srv.Shared.WrongTypeErr)
+			return
+		}
+		dict = *o.Value
+	}
+	AddReplyMultiBulkLen(c, c.Argc-2)
+	for j := 2; j < c.Argc; j++ {
+		if value, ok := dict[c.Argv[j]]; ok {
+			AddReplyBulkStr(c, value)
+		} else {
+			AddReplyNull(c)
+		}
+	}
+}
+
+/* HDEL key field [field ...] */
+var HDelCommand CommandProcess = func(c *KiwiClient) {
+	o, ok := hashLookupWriteOrReply(c, c.Argv[1], false)
+	if !ok {
+		return
+	}
+	if o == nil {
+		AddReply(c, c.srv.Shared.Zero)
+		return
+	}
+	deleted := 0
+	for j := 2; j < c.Argc; j++ {
+		if _, ok := (*o.Value)[c.Argv[j]]; ok {
+			delete(*o.Value, c.Argv[j])
+			deleted++
+		}
+	}
+	if deleted > 0 {
+		hashStore(c, c.Argv[1], o)
+		atomic.AddInt64(&c.srv.Dirty, int64(deleted))
+	}
+	AddReplyInt(c, deleted)
+}
+
+var HLenCommand CommandProcess = func(c *KiwiClient) {
+	o := hashLookupReadOrReply(c, c.Argv[1], c.srv.Shared.Zero)
+	if o == nil {
+		return
+	}
+	AddReplyInt(c, len(*o.Value))
+}
+
+var HStrLenCommand CommandProcess = func(c *KiwiClient) {
+	o := hashLookupReadOrReply(c, c.Argv[1], c.srv.Shared.Zero)
+	if o == nil {
+		return
+	}
+	AddReplyInt(c, len((*o.Value)[c.Argv[2]]))
+}
+
+var HExistsCommand CommandProcess = func(c *KiwiClient) {
+	o := hashLookupReadOrReply(c, c.Argv[1], c.srv.Shared.Zero)
+	if o == nil {
+		return
+	}
+	if _, ok := (*o.Value)[c.Argv[2]]; ok {
+		AddReply(c, c.srv.Shared.One)
+	} else {
+		AddReply(c, c.srv.Shared.Zero)
+	}
+}
+
+/* HINCRBY key field increment */
+var HIncrByCommand CommandProcess = func(c *KiwiClient) {
+	incr, err := strconv.Atoi(c.Argv[3])
+	if err != nil {
+		AddReplyError(c, "value is not an integer or out of range")
+		return
+	}
+	o, ok := hashLookupWriteOrReply(c, c.Argv[1], true)
+	if !ok {
+		return
+	}
+	value := 0
+	if current, ok := (*o.Value)[c.Argv[2]]; ok {
+		if value, err = strconv.Atoi(current); err != nil {
+			AddReplyError(c, "hash value is not an integer")
+			return
+		}
+	}
+	if IsOverflowInt(value, incr) {
+		AddReplyError(c, "increment or decrement would overflow")
+		return
+	}
+	value += incr
+	(*o.Value)[c.Argv[2]] = strconv.Itoa(value)
+	c.Db.Set(c.Argv[1], o)
+	atomic.AddInt64(&c.srv.Dirty, 1)
+	AddReplyInt(c, value)
+}
+
+/* HINCRBYFLOAT key field increment */
+var HIncrByFloatCommand CommandProcess = func(c *KiwiClient) {
+	incr, err := strconv.ParseFloat(c.Argv[3], 64)
+	if err != nil || math.IsNaN(incr) {
+		AddReplyError(c, "value is not a valid float")
+		return
+	}
+	o, ok := hashLookupWriteOrReply(c, c.Argv[1], true)
+	if !ok {
+		return
+	}
+	value := 0.0
+	if current, ok := (*o.Value)[c.Argv[2]]; ok {
+		if value, err = strconv.ParseFloat(current, 64); err != nil {
+			AddReplyError(c, "hash value is not a float")
+			return
+		}
+	}
+	value += incr
+	if math.IsNaN(value) || math.IsInf(value, 0) {
+		AddReplyError(c, "increment would produce NaN or Infinity")
+		return
+	}
+	str := resp.FormatDouble(value)
+	(*o.Value)[c.Argv[2]] = str
+	c.Db.Set(c.Argv[1], o)
+	atomic.AddInt64(&c.srv.Dirty, 1)
+	AddReplyBulkStr(c, str)
+}
+
+/* Reply with the fields and/or the values of the hash, see HKEYS, HVALS
+ * and HGETALL. */
+func HGetAllGenericCommand(c *KiwiClient, fields bool, values bool) {
+	var empty string
+	if fields && values {
+		empty = c.srv.Shared.EmptyMap[c.Resp]
+	} else {
+		empty = c.srv.Shared.EmptyMultiBulk
+	}
+	o := hashLookupReadOrReply(c, c.Argv[1], empty)
+	if o == nil {
+		return
+	}
+	if fields && values {
+		AddReplyMapLen(c, len(*o.Value))
+	} else {
+		AddReplyMultiBulkLen(c, len(*o.Value))
+	}
+	for field, value := range *o.Value {
+		if fields {
+			AddReplyBulkStr(c, field)
+		}
+		if values {
+			AddReplyBulkStr(c, value)
+		}
+	}
+}
+
+var HKeysCommand CommandProcess = func(c *KiwiClient) {
+	HGetAllGenericCommand(c, true, false)
+}
+
+var HValsCommand CommandProcess = func(c *KiwiClient) {
+	HGetAllGenericCommand(c, false, true)
+}
+
+var HGetAllCommand CommandProcess = func(c *KiwiClient) {
+	HGetAllGenericCommand(c, true, true)
+}
@@ -0,0 +1,396 @@
+package server
+
+import (
+	"strconv"
+	"strings"
+	"sync/atomic"
+
+	"github.com/zhaotong0312/kiwi/structure"
+)
+
+/* ================================ List type =============================== */
+
+func (s *Server) CreateListObject() *ListObject {
+	return &ListObject{
+		Object: s.CreateObject(OBJ_RTYPE_LIST, OBJ_ENCODING_LINKEDLIST),
+		Value:  structure.ListCreate(),
+	}
+}
+
+/* Lookup a list for write operations: reply with an error and return nil
+ * if the key holds another type. When create is true a missing list is
+ * created, but it is only added to the keyspace by the caller. */
+func listLookupWriteOrReply(c *KiwiClient, key string, create bool) (*ListObject, bool) {
+	obj := LookupKeyWrite(c.Db, key)
+	if obj == nil {
+		if create {
+			return c.srv.CreateListObject(), true
+		}
+		return nil, true
+	}
+	o, ok := obj.(*ListObject)
+	if !ok {
+		AddReplyErrorObject(c, c.srv.Shared.WrongTypeErr)
+		return nil, false
+	}
+	return o, true
+}
+
+/* Lookup a list for read operations. If the key doesn't exist reply is
+ * sent and nil is returned, like for a wrong type. */
+func listLookupReadOrReply(c *KiwiClient, key string, reply string) *ListObject {
+	obj := DbGetOrReply(c, key, reply)
+	if obj == nil {
+		return nil
+	}
+	o, ok := obj.(*ListObject)
+	if !ok {
+		AddReplyErrorObject(c, c.srv.Shared.WrongTypeErr)
+		return nil
+	}
+	return o
+}
+
+/* Store the list after a write, or delete the key if the list is empty:
+ * empty aggregates are never kept in the keyspace. */
+func listStore(c *KiwiClient, key string, o *ListObject) {
+	if o.Value.Len() == 0 {
+		c.Db.Delete(key)
+		return
+	}
+	c.Db.Set(key, o)
+}
+
+/* Convert a range given with possibly negative indexes into a range of
+ * positive indexes. ok is false if the range is empty. */
+func listRange(start, end, length int) (int, int, bool) {
+	if start < 0 {
+		start = length + start
+	}
+	if end < 0 {
+		end = length + end
+	}
+	if start < 0 {
+		start = 0
+	}
+	if start > end || start >= length {
+		return 0, 0, false
+	}
+	if end >= length {
+		end = length - 1
+	}
+	return start, end, true
+}
+
+/* Return the elements of the list in the range, in order. */
+func listElements(o *ListObject, start, end int) []string {
+	elements := make([]string, 0, end-start+1)
+	iter := o.Value.Iterator(structure.ITERATION_DIRECTION_INORDER)
+	i := 0
+	for node := iter.Next(); iter.HasNext() && i <= end; node = iter.Next() {
+		if i >= start {
+			elements = append(elements, node.Value.(string))
+		}
+		i++
+	}
+	return elements
+}
+
+/* LPUSH/RPUSH/LPUSHX/RPUSHX key element [element ...] */
+func PushGenericCommand(c *KiwiClient, where int, xx bool) {
+	o, ok := listLookupWriteOrReply(c, c.Argv[1], !xx)
+	if !ok {
+		return
+	}
+	if o == nil {
+		AddReply(c, c.srv.Shared.Zero)
+		return
+	}
+	for j := 2; j < c.Argc; j++ {
+		if where == LIST_HEAD {
+			o.Value.LeftAppend(c.Argv[j])
+		} else {
+			o.Value.Append(c.Argv[j])
+		}
+	}
+	c.Db.Set(c.Argv[1], o)
+	atomic.AddInt64(&c.srv.Dirty, int64(c.Argc-2))
+	AddReplyInt(c, int(o.Value.Len()))
+}
+
+var LPushCommand CommandProcess = func(c *KiwiClient) {
+	PushGenericCommand(c, LIST_HEAD, false)
+}
+
+var RPushCommand CommandProcess = func(c *KiwiClient) {
+	PushGenericCommand(c, LIST_TAIL, false)
+}
+
+var LPushXCommand CommandProcess = func(c *KiwiClient) {
+	PushGenericCommand(c, LIST_HEAD, true)
+}
+
+var RPushXCommand CommandProcess = func(c *KiwiClient) {
+	PushGenericCommand(c, LIST_TAIL, true)
+}
+
+/* LPOP/RPOP key [count] */
+func PopGenericCommand(c *KiwiClient, where int) {
+	count := 1
+	if c.Argc > 3 {
+		AddReplyErrorObject(c, c.srv.Shared.SyntaxErr)
+		return
+	}
+	if c.Argc == 3 {
+		var err error
+		count, err = strconv.Atoi(c.Argv[2])
+		if err != nil || count < 0 {
+			AddReplyError(c, "value is out of range, must be positive")
+			return
+		}
+	}
+	o, ok := listLookupWriteOrReply(c, c.Argv[1], false)
+	if !ok {
+		return
+	}
+	if o == nil {
+		if c.Argc == 3 {
+			AddReplyNullArray(c)
+		} else {
+			AddReplyNull(c)
+		}
+		return
+	}
+	pop := func() string {
+		if where == LIST_HEAD {
+			return o.Value.LeftPop().(string)
+		}
+		return o.Value.Pop().(string)
+	}
+	if c.Argc == 2 {
+		AddReplyBulkStr(c, pop())
+	} else {
+		if count > int(o.Value.Len()) {
+			count = int(o.Value.Len())
+		}
+		AddReplyMultiBulkLen(c, count)
+		for j := 0; j < count; j++ {
+			AddReplyBulkStr(c, pop())
+		}
+	}
+	listStore(c, c.Argv[1], o)
+	atomic.AddInt64(&c.srv.Dirty, 1)
+}
+
+var LPopCommand CommandProcess = func(c *KiwiClient) {
+	PopGenericCommand(c, LIST_HEAD)
+}
+
+var RPopCommand CommandProcess = func(c *KiwiClient) {
+	PopGenericCommand(c, LIST_TAIL)
+}
+
+var LLenCommand CommandProcess = func(c *KiwiClient) {
+	o := listLookupReadOrReply(c, c.Argv[1], c.srv.Shared.Zero)
+	if o == nil {
+		return
+	}
+	AddReplyInt(c, int(o.Value.Len()))
+}
+
+/* LINDEX key index */
+var LIndexCommand CommandProcess = func(c *KiwiClient) {
+	index, err := strconv.Atoi(c.Argv[2])
+	if err != nil {
+		AddReplyError(c, "value is not an integer or out of range")
+		return
+	}
+	o := listLookupReadOrReply(c, c.Argv[1], c.srv.Shared.Null[c.Resp])
+	if o == nil {
+		return
+	}
+	node := o.Value.Index(index)
+	if node == nil {
+		AddReplyNull(c)
+		return
+	}
+	AddReplyBulkStr(c, node.Value.(string))
+}
+
+/* LSET key index element */
+var LSetCommand CommandProcess = func(c *KiwiClient) {
+	index, err := strconv.Atoi(c.Argv[2])
+	if err != nil {
+		AddReplyError(c, "value is not an integer or out of range")
+		return
+	}
+	o, ok := listLookupWriteOrReply(c, c.Argv[1], false)
+	if !ok {
+		return
+	}
+	if o == nil {
+		AddReplyError(c, "no such key")
+		return
+	}
+	node := o.Value.Index(index)
+	if node == nil {
+		AddReplyError(c, "index out of range")
+		return
+	}
+	node.Value = c.Argv[3]
+	c.Db.Set(c.Argv[1], o)
+	atomic.AddInt64(&c.srv.Dirty, 1)
+	AddReply(c, c.srv.Shared.Ok)
+}
+
+/* LRANGE key start stop */
+var LRangeCommand CommandProcess = func(c *KiwiClient) {
+	start, err1 := strconv.Atoi(c.Argv[2])
+	end, err2 := strconv.Atoi(c.Argv[3])
+	if err1 != nil || err2 != nil {
+		AddReplyError(c, "value is not an integer or out of range")
+		return
+	}
+	o := listLookupReadOrReply(c, c.Argv[1], c.srv.Shared.EmptyMultiBulk)
+	if o == nil {
+		return
+	}
+	start, end, ok := listRange(start, end, int(o.Value.Len()))
+	if !ok {
+		AddReply(c, c.srv.Shared.EmptyMultiBulk)
+		return
+	}
+	elements := listElements(o, start, end)
+	AddReplyMultiBulkLen(c, len(elements))
+	for _, e := range elements {
+		AddReplyBulkStr(c, e)
+	}
+}
+
+/* LTRIM key start stop */
+var LTrimCommand CommandProcess = func(c *KiwiClient) {
+	start, err1 := strconv.Atoi(c.Argv[2])
+	end, err2 := strconv.Atoi(c.Argv[3])
+	if err1 != nil || err2 != nil {
+		AddReplyError(c, "value is not an integer or out of range")
+		return
+	}
+	o, ok := listLookupWriteOrReply(c, c.Argv[1], false)
+	if !ok {
+		return
+	}
+	if o == nil {
+		AddReply(c, c.srv.Shared.Ok)
+		return
+	}
+	length := int(o.Value.Len())
+	ltrim, rtrim := length, 0
+	if start, end, ok := listRange(start, end, length); ok {
+		ltrim, rtrim = start, length-end-1
+	}
+	for j := 0; j < ltrim; j++ {
+		o.Value.LeftPop()
+	}
+	for j := 0; j < rtrim; j++ {
+		o.Value.Pop()
+	}
+	listStore(c, c.Argv[1], o)
+	atomic.AddInt64(&c.srv.Dirty, int64(ltrim+rtrim))
+	AddReply(c, c.srv.Shared.Ok)
+}
+
+/* LREM key count element
+ * Remove the first count occurrences of element, from the tail when count
+ * is negative, or all of them when count is 0. */
+var LRemCommand CommandProcess = func(c *KiwiClient) {
+	toremove, err := strconv.Atoi(c.Argv[2])
+	if err != nil {
+		AddReplyError(c, "value is not an integer or out of range")
+		return
+	}
+	o, ok := listLookupWriteOrReply(c, c.Argv[1], false)
+	if !ok {
+		return
+	}
+	if o == nil {
+		AddReply(c, c.srv.Shared.Zero)
+		return
+	}
+	direction := structure.ITERATION_DIRECTION_INORDER
+	if toremove < 0 {
+		toremove = -toremove
+		direction = structure.ITERATION_DIRECTION_REVERSE_ORDER
+	}
+	// Nodes are removed once the iteration is done: a removed node is
+	// unlinked from the list.
+	var nodes []*structure.ListNode
+	iter := o.Value.Iterator(direction)
+	for node := iter.Next(); iter.HasNext(); node = iter.Next() {
+		if node.Value.(string) == c.Argv[3] {
+			nodes = append(nodes, node)
+			if toremove != 0 && len(nodes) == toremove {
+				break
+			}
+		}
+	}
+	for _, node := range nodes {
+		o.Value.RemoveNode(node)
+	}
+	if len(nodes) > 0 {
+		listStore(c, c.Argv[1], o)
+		atomic.AddInt64(&c.srv.Dirty, int64(len(nodes)))
+	}
+	AddReplyInt(c, len(nodes))
+}
+
+/* LINSERT key BEFORE|AFTER pivot element */
+var LInsertCommand CommandProcess = func(c *KiwiClient) {
+	var after bool
+	switch strings.ToLower(c.Argv[2]) {
+	case "after":
+		after = true
+	case "before":
+		after = false
+	default:
+		AddReplyErrorObject(c, c.srv.Shared.SyntaxErr)
+		return
+	}
+	o, ok := listLookupWriteOrReply(c, c.Argv[1], false)
+	if !ok {
+		return
+	}
+	if o == nil {
+		AddReply(c, c.srv.Shared.Zero)
+		return
+	}
+	// The list is rebuilt around the pivot: the nodes can't be linked in
+	// the middle of the list from outside the structure package.
+	elements := listElements(o, 0, int(o.Value.Len())-1)
+	pos := -1
+	for j, e := range elements {
+		if e == c.Argv[3] {
+			pos = j
+			break
+		}
+	}
+	if pos == -1 {
+		AddReplyInt(c, -1)
+		return
+	}
+	if after {
+		pos++
+	}
+	o.Value.Clear()
+	for j, e := range elements {
+		if j == pos {
+			o.Value.Append(c.Argv[4])
+		}
+		o.Value.Append(e)
+	}
+	if pos == len(elements) {
+		o.Value.Append(c.Argv[4])
+	}
+	c.Db.Set(c.Argv[1], o)
+	atomic.AddInt64(&c.srv.Dirty, 1)
+	AddReplyInt(c, int(o.Value.Len()))
+}
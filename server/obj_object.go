@@ -1,14 +1,16 @@
 package server
 
 import (
+	"strings"
 	"time"
-	"kiwi/src/structure"
+	"github.com/zhaotong0312/kiwi/structure"
 )
 
 type Object struct {
 	OType    byte
 	Encoding byte
 	Lru      time.Time
+	Lfu      uint32 // LFU data: 16 bits access time in minutes, 8 bits counter
 	//RefConut int
 }
 
@@ -25,6 +27,7 @@ type ListObject struct {
 type ZSetObject struct {
 	Object
 	Value *structure.ZSkiplist
+	Dict  map[string]float64 // Member -> score
 }
 
 type HashObject struct {
@@ -46,11 +49,14 @@ type Objector interface {
 	getEncodeInString() string
 	getLRU() time.Time
 	setLRU(lru time.Time)
+	getLFU() uint32
+	setLFU(lfu uint32)
+	ComputeSize(samples int) int64
 	//getRefCount() int
 	//setRefCount(refCount int)
 	//IncrRefCount() int
 	//DecrRefCount() int
-	RefreshLRUClock()
+	RefreshLRUClock(clock time.Time)
 }
 
 func (o *Object) getOType() byte {
@@ -92,6 +98,8 @@ func (o *Object) getEncodeInString() string {
 		return "int"
 	case OBJ_ENCODING_HT:
 		return "hashtable"
+	case OBJ_ENCODING_LINKEDLIST:
+		return "linkedlist"
 	case OBJ_ENCODING_QUICKLIST:
 		return "quicklist"
 	case OBJ_ENCODING_ZIPLIST:
@@ -117,6 +125,14 @@ func (o *Object) setLRU(lru time.Time) {
 	o.Lru = lru
 }
 
+func (o *Object) getLFU() uint32 {
+	return o.Lfu
+}
+
+func (o *Object) setLFU(lfu uint32) {
+	o.Lfu = lfu
+}
+
 //func (o *Object) getRefCount() int {
 //	return o.RefConut
 //}
@@ -144,21 +160,230 @@ func (o *Object) setLRU(lru time.Time) {
 //	return o.RefConut
 //}
 
-func (o *Object) RefreshLRUClock() {
-	o.Lru = LruClock()
+func (o *Object) RefreshLRUClock(clock time.Time) {
+	o.Lru = clock
 }
 
 /* functions for Objects */
-func CreateObject(otype byte, encoding byte) Object {
+func (s *Server) CreateObject(otype byte, encoding byte) Object {
 	obj := Object{
 		OType:    otype,
 		Encoding: encoding,
-		Lru:      LruClock(),
+		Lru:      s.LruClock(),
+		Lfu:      LFUGetTimeInMinutes()<<8 | LFU_INIT_VAL,
 		//RefConut: 1,
 	}
 	return obj
 }
 
+/* ---------------------------- Memory usage ---------------------------------
+ *
+ * Every object is able to estimate the memory it uses, including the nested
+ * nodes of the aggregate types. For aggregates only "samples" elements are
+ * inspected and the average element size is used to estimate the whole
+ * value, when samples is 0 all the elements are inspected. */
+
+/* Return the memory used by a value stored inside an aggregate object. */
+func ElementComputeSize(v interface{}) int64 {
+	switch e := v.(type) {
+	case nil:
+		return 0
+	case string:
+		return STRING_OVERHEAD + int64(len(e))
+	case *string:
+		return STRING_OVERHEAD + 8 + int64(len(*e))
+	case []byte:
+		return SLICE_OVERHEAD + int64(cap(e))
+	case Objector:
+		return e.ComputeSize(0)
+	default:
+		return 8
+	}
+}
+
+/* Given the size of the first "sampled" elements, estimate the size of
+ * all the "length" elements. */
+func estimateSize(elesize int64, sampled int, length int) int64 {
+	if sampled == 0 {
+		return 0
+	}
+	return elesize / int64(sampled) * int64(length)
+}
+
+func (o *IntObject) ComputeSize(samples int) int64 {
+	return OBJ_OVERHEAD + 8
+}
+
+func (o *ListObject) ComputeSize(samples int) int64 {
+	size := int64(OBJ_OVERHEAD + LIST_OVERHEAD)
+	if o.Value == nil {
+		return size
+	}
+	var elesize int64
+	sampled := 0
+	iter := o.Value.Iterator(structure.ITERATION_DIRECTION_INORDER)
+	for node := iter.Next(); iter.HasNext() && (samples == 0 || sampled < samples); node = iter.Next() {
+		elesize += LIST_NODE_OVERHEAD + ElementComputeSize(node.Value)
+		sampled++
+	}
+	return size + estimateSize(elesize, sampled, int(o.Value.Len()))
+}
+
+func (o *ZSetObject) ComputeSize(samples int) int64 {
+	size := int64(OBJ_OVERHEAD + ZSKIPLIST_OVERHEAD)
+	if o.Value == nil {
+		return size
+	}
+	// The header node always has the max number of levels.
+	size += ZSKIPLIST_NODE_OVERHEAD + ZSKIPLIST_LEVEL_OVERHEAD*int64(len(o.Value.Header.Level))
+	var elesize int64
+	sampled := 0
+	for node := o.Value.Header.Level[0].Forward; node != nil && (samples == 0 || sampled < samples); node = node.Level[0].Forward {
+		elesize += ZSKIPLIST_NODE_OVERHEAD + ZSKIPLIST_LEVEL_OVERHEAD*int64(len(node.Level)) + int64(len(node.Ele))
+		sampled++
+	}
+	size += estimateSize(elesize, sampled, o.Value.Len)
+	// The dict shares the members with the skiplist.
+	return size + DICT_OVERHEAD + int64(len(o.Dict))*(DICT_ENTRY_OVERHEAD+8)
+}
+
+/* Compute the size of a map used by the hash and set types. Go maps are
+ * iterated in random order, so the sampled elements are random. */
+func dictComputeSize(dict map[string]string, samples int) int64 {
+	size := int64(DICT_OVERHEAD)
+	var elesize int64
+	sampled := 0
+	for field, value := range dict {
+		if samples != 0 && sampled >= samples {
+			break
+		}
+		elesize += DICT_ENTRY_OVERHEAD + int64(len(field)) + int64(len(value))
+		sampled++
+	}
+	return size + estimateSize(elesize, sampled, len(dict))
+}
+
+func (o *HashObject) ComputeSize(samples int) int64 {
+	if o.Value == nil {
+		return OBJ_OVERHEAD
+	}
+	return OBJ_OVERHEAD + dictComputeSize(*o.Value, samples)
+}
+
+func (o *SetObject) ComputeSize(samples int) int64 {
+	if o.Value == nil {
+		return OBJ_OVERHEAD
+	}
+	return OBJ_OVERHEAD + dictComputeSize(*o.Value, samples)
+}
+
+/* Return the memory accounted for the object in the keyspace. Shared
+ * objects are not accounted, they are never freed. */
+func (s *Server) ObjectComputeSize(o Objector) int64 {
+	if s.ObjectRefCount(o) == OBJ_SHARED_REFCOUNT {
+		return 0
+	}
+	return o.ComputeSize(OBJ_COMPUTE_SIZE_DEF_SAMPLES)
+}
+
 func CheckOType(o Objector, otype byte) bool {
 	return o != nil && o.getOType() == otype
 }
+
+/* Return the refcount of the object as seen by OBJECT REFCOUNT. Objects
+ * are not reference counted, only the shared integers have more than one
+ * owner. */
+func (s *Server) ObjectRefCount(o Objector) int {
+	if so, ok := o.(*StrObject); ok && IsStrObjectInt(so) {
+		if i := *so.Value.(*int); IsSharedInt(i) && s.Shared.Integers[i] == so {
+			return OBJ_SHARED_REFCOUNT
+		}
+	}
+	return 1
+}
+
+/* Lookup the object of OBJECT subcommands without touching it, so that
+ * the introspection does not alter the access time or frequency. */
+func ObjectCommandLookupOrReply(c *KiwiClient, key string, reply string) Objector {
+	ExpireIfNeeded(c.Db, key)
+	o := c.Db.Get(key)
+	if o == nil {
+		AddReply(c, reply)
+	}
+	return o
+}
+
+/* Object command allows to inspect the internals of an Redis Object.
+ * Usage: OBJECT <refcount|encoding|idletime|freq> <key> */
+var ObjectCommand CommandProcess = func(c *KiwiClient) {
+	sub := strings.ToLower(c.Argv[1])
+	if c.Argc == 2 && sub == "help" {
+		AddReplyHelp(c, []string{
+			"ENCODING <key> -- Return the kind of internal representation used in order to store the value associated with a key.",
+			"FREQ <key> -- Return the access frequency index of the key. The returned integer is proportional to the logarithm of the recent access frequency of the key.",
+			"IDLETIME <key> -- Return the idle time of the key, that is the approximated number of seconds elapsed since the last access to the key.",
+			"REFCOUNT <key> -- Return the number of references of the value associated with the specified key.",
+		})
+		return
+	}
+	if c.Argc != 3 {
+		AddReplySubcommandSyntaxError(c)
+		return
+	}
+	o := ObjectCommandLookupOrReply(c, c.Argv[2], c.srv.Shared.Null[c.Resp])
+	if o == nil {
+		return
+	}
+	switch sub {
+	case "encoding":
+		AddReplyBulkStr(c, o.getEncodeInString())
+	case "refcount":
+		AddReplyInt(c, c.srv.ObjectRefCount(o))
+	case "idletime":
+		if c.srv.MaxMemoryPolicy&MAXMEMORY_FLAG_LFU != 0 {
+			AddReplyError(c, "An LFU maxmemory policy is selected, idle time not tracked. Please note that when switching between policies at runtime LRU and LFU data will take some time to adjust.")
+			return
+		}
+		AddReplyInt(c, int(c.srv.EstimateObjectIdleTime(o)/1000))
+	case "freq":
+		if c.srv.MaxMemoryPolicy&MAXMEMORY_FLAG_LFU == 0 {
+			AddReplyError(c, "An LFU maxmemory policy is not selected, access frequency not tracked. Please note that when switching between policies at runtime LRU and LFU data will take some time to adjust.")
+			return
+		}
+		// LFUDecrAndReturn should be called in case of the key has not
+		// been accessed for a long time, because we update the access
+		// time only when the key is read or overwritten.
+		AddReplyInt(c, int(c.srv.LFUDecrAndReturn(o)))
+	default:
+		AddReplySubcommandSyntaxError(c)
+	}
+}
+
+/* TOUCH key1 [key2 key3 ... keyN]
+ * Alters the last access time of the keys, returns the number of keys
+ * that exist. */
+var TouchCommand CommandProcess = func(c *KiwiClient) {
+	touched := 0
+	for j := 1; j < c.Argc; j++ {
+		if LookupKeyRead(c.Db, c.Argv[j]) != nil {
+			touched++
+		}
+	}
+	AddReplyInt(c, touched)
+}
+
+/* TYPE key */
+var TypeCommand CommandProcess = func(c *KiwiClient) {
+	o := LookupKeyRead(c.Db, c.Argv[1])
+	switch {
+	case o == nil:
+		AddReplyStatus(c, "none")
+	case o.getOType() == OBJ_RTYPE_INT:
+		// Integers are strings for the clients.
+		AddReplyStatus(c, "string")
+	case o.getOType() == OBJ_RTYPE_ZSET:
+		AddReplyStatus(c, "zset")
+	default:
+		AddReplyStatus(c, o.getOTypeInString())
+	}
+}
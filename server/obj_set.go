@@ -0,0 +1,194 @@
+package server
+
+import (
+	"sort"
+	"sync/atomic"
+)
+
+/* ================================ Set type ================================ */
+
+/* The members of a set are the keys of a map, the values are unused. */
+func (s *Server) CreateSetObject() *SetObject {
+	dict := make(map[string]string)
+	return &SetObject{
+		Object: s.CreateObject(OBJ_RTYPE_SET, OBJ_ENCODING_HT),
+		Value:  &dict,
+	}
+}
+
+/* Lookup a set for write operations, creating it if create is true, see
+ * listLookupWriteOrReply(). */
+func setLookupWriteOrReply(c *KiwiClient, key string, create bool) (*SetObject, bool) {
+	obj := LookupKeyWrite(c.Db, key)
+	if obj == nil {
+		if create {
+			return c.srv.CreateSetObject(), true
+		}
+		return nil, true
+	}
+	o, ok := obj.(*SetObject)
+	if !ok {
+		AddReplyErrorObject(c, c.srv.Shared.WrongTypeErr)
+		return nil, false
+	}
+	return o, true
+}
+
+func setLookupReadOrReply(c *KiwiClient, key string, reply string) *SetObject {
+	obj := DbGetOrReply(c, key, reply)
+	if obj == nil {
+		return nil
+	}
+	o, ok := obj.(*SetObject)
+	if !ok {
+		AddReplyErrorObject(c, c.srv.Shared.WrongTypeErr)
+		return nil
+	}
+	return o
+}
+
+func setStore(c *KiwiClient, key string, o *SetObject) {
+	if len(*o.Value) == 0 {
+		c.Db.Delete(key)
+		return
+	}
+	c.Db.Set(key, o)
+}
+
+/* SADD key member [member ...] */
+var SAddCommand CommandProcess = func(c *KiwiClient) {
+	o, ok := setLookupWriteOrReply(c, c.Argv[1], true)
+	if !ok {
+		return
+	}
+	added := 0
+	for j := 2; j < c.Argc; j++ {
+		if _, ok := (*o.Value)[c.Argv[j]]; !ok {
+			(*o.Value)[c.Argv[j]] = ""
+			added++
+		}
+	}
+	if added > 0 {
+		c.Db.Set(c.Argv[1], o)
+		atomic.AddInt64(&c.srv.Dirty, int64(added))
+	}
+	AddReplyInt(c, added)
+}
+
+/* SREM key member [member ...] */
+var SRemCommand CommandProcess = func(c *KiwiClient) {
+	o, ok := setLookupWriteOrReply(c, c.Argv[1], false)
+	if !ok {
+		return
+	}
+	if o == nil {
+		AddReply(c, c.srv.Shared.Zero)
+		return
+	}
+	deleted := 0
+	for j := 2; j < c.Argc; j++ {
+		if _, ok := (*o.Value)[c.Argv[j]]; ok {
+			delete(*o.Value, c.Argv[j])
+			deleted++
+		}
+	}
+	if deleted > 0 {
+		setStore(c, c.Argv[1], o)
+		atomic.AddInt64(&c.srv.Dirty, int64(deleted))
+	}
+	AddReplyInt(c, deleted)
+}
+
+var SIsMemberCommand CommandProcess = func(c *KiwiClient) {
+	o := setLookupReadOrReply(c, c.Argv[1], c.srv.Shared.Zero)
+	if o == nil {
+		return
+	}
+	if _, ok := (*o.Value)[c.Argv[2]]; ok {
+		AddReply(c, c.srv.Shared.One)
+	} else {
+		AddReply(c, c.srv.Shared.Zero)
+	}
+}
+
+var SCardCommand CommandProcess = func(c *KiwiClient) {
+	o := setLookupReadOrReply(c, c.Argv[1], c.srv.Shared.Zero)
+	if o == nil {
+		return
+	}
+	AddReplyInt(c, len(*o.Value))
+}
+
+var SMembersCommand CommandProcess = func(c *KiwiClient) {
+	o := setLookupReadOrReply(c, c.Argv[1], c.srv.Shared.EmptySet[c.Resp])
+	if o == nil {
+		return
+	}
+	AddReplySetLen(c, len(*o.Value))
+	for member := range *o.Value {
+		AddReplyBulkStr(c, member)
+	}
+}
+
+/* SINTER/SUNION/SDIFF key [key ...]
+ * Missing keys are empty sets. The members are replied sorted, so that
+ * the reply doesn't depend on the iteration order of the maps. */
+func SetOperationGenericCommand(c *KiwiClient, op int) {
+	sets := make([]map[string]string, 0, c.Argc-1)
+	for j := 1; j < c.Argc; j++ {
+		obj := LookupKeyRead(c.Db, c.Argv[j])
+		if obj == nil {
+			sets = append(sets, nil)
+			continue
+		}
+		o, ok := obj.(*SetObject)
+		if !ok {
+			AddReplyErrorObject(c, c.srv.Shared.WrongTypeErr)
+			return
+		}
+		sets = append(sets, *o.Value)
+	}
+	result := make(map[string]struct{})
+	for member := range sets[0] {
+		result[member] = struct{}{}
+	}
+	for _, set := range sets[1:] {
+		switch op {
+		case SET_OP_INTER:
+			for member := range result {
+				if _, ok := set[member]; !ok {
+					delete(result, member)
+				}
+			}
+		case SET_OP_UNION:
+			for member := range set {
+				result[member] = struct{}{}
+			}
+		case SET_OP_DIFF:
+			for member := range set {
+				delete(result, member)
+			}
+		}
+	}
+	members := make([]string, 0, len(result))
+	for member := range result {
+		members = append(members, member)
+	}
+	sort.Strings(members)
+	AddReplySetLen(c, len(members))
+	for _, member := range members {
+		AddReplyBulkStr(c, member)
+	}
+}
+
+var SInterCommand CommandProcess = func(c *KiwiClient) {
+	SetOperationGenericCommand(c, SET_OP_INTER)
+}
+
+var SUnionCommand CommandProcess = func(c *KiwiClient) {
+	SetOperationGenericCommand(c, SET_OP_UNION)
+}
+
+var SDiffCommand CommandProcess = func(c *KiwiClient) {
+	SetOperationGenericCommand(c, SET_OP_DIFF)
+}
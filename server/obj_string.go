@@ -1,9 +1,11 @@
 package server
 
 import (
+	"fmt"
 	"strconv"
 	"math"
 	"errors"
+	"github.com/zhaotong0312/kiwi/resp"
 )
 
 type StrObject struct {
@@ -15,6 +17,15 @@ func IsSharedInt(i int) bool {
 	return 0 <= i && i < SHARED_INTEGERS
 }
 
+/* When an LRU or LFU maxmemory policy is used every key needs its own
+ * object to track the access time, so shared integers are not used. */
+func (s *Server) UseSharedInt(i int) bool {
+	if s.MaxMemory > 0 && s.MaxMemoryPolicy&MAXMEMORY_FLAG_NO_SHARED_INTEGERS != 0 {
+		return false
+	}
+	return IsSharedInt(i)
+}
+
 func IsOverflowInt(oldValue int, incr int) bool {
 	return (incr < 0 && oldValue < 0 && incr < math.MinInt64-oldValue) ||
 		(incr > 0 && oldValue > 0 && incr > math.MaxInt64-oldValue)
@@ -45,22 +56,22 @@ func GetStrObjectValueString(o *StrObject) (string, error) {
 	return "", errors.New("not StrObject")
 }
 
-func CreateStrObjectByStr(str string) *StrObject {
-	obj := CreateObject(OBJ_RTYPE_STR, OBJ_ENCODING_STR)
+func (s *Server) CreateStrObjectByStr(str string) *StrObject {
+	obj := s.CreateObject(OBJ_RTYPE_STR, OBJ_ENCODING_STR)
 	o := StrObject{
 		Object: obj,
 		Value:  &str,
 	}
-	return StrObjectEncode(&o)
+	return s.StrObjectEncode(&o)
 }
 
-func CreateStrObjectByInt(i int) *StrObject {
-	if IsSharedInt(i) {
-		o := kiwiS.Shared.Integers[i]
+func (s *Server) CreateStrObjectByInt(i int) *StrObject {
+	if s.UseSharedInt(i) {
+		o := s.Shared.Integers[i]
 		//o.IncrRefCount()
 		return o
 	}
-	obj := CreateObject(OBJ_RTYPE_STR, OBJ_ENCODING_INT)
+	obj := s.CreateObject(OBJ_RTYPE_STR, OBJ_ENCODING_INT)
 	o := StrObject{
 		Object: obj,
 		Value:  &i,
@@ -68,18 +79,18 @@ func CreateStrObjectByInt(i int) *StrObject {
 	return &o
 }
 
-func ReplaceStrObjectByInt(o *StrObject, oldValue *int, newValue *int) *StrObject {
+func (s *Server) ReplaceStrObjectByInt(o *StrObject, oldValue *int, newValue *int) *StrObject {
 	if !IsSharedInt(*oldValue) && !IsSharedInt(*newValue) {
 		o.Value = newValue
-		o.RefreshLRUClock()
+		o.RefreshLRUClock(s.LruClock())
 		return o
 	} else {
 		//o.DecrRefCount()
-		return CreateStrObjectByInt(*newValue)
+		return s.CreateStrObjectByInt(*newValue)
 	}
 }
 
-func AppendStrObject(o *StrObject, b string) (*StrObject, int) {
+func (s *Server) AppendStrObject(o *StrObject, b string) (*StrObject, int) {
 	var length int
 	if b == "" {
 		length = StrObjectLength(o)
@@ -91,26 +102,34 @@ func AppendStrObject(o *StrObject, b string) (*StrObject, int) {
 		length = len(str)
 	}
 	if IsStrObjectInt(o) {
-		str := strconv.Itoa(*o.Value.(*int))
-		str = CatString(str, b)
-		o.Value = &str
-		o.setEncode(OBJ_ENCODING_STR)
-		length = len(str)
+		// The object may be a shared integer, never modify it in place.
+		str := CatString(strconv.Itoa(*o.Value.(*int)), b)
+		return s.CreateStrObjectByStr(str), len(str)
+	}
+	return s.StrObjectEncode(o), length
+}
+
+func (o *StrObject) ComputeSize(samples int) int64 {
+	if IsStrObjectInt(o) {
+		return OBJ_OVERHEAD + 8
+	}
+	if IsStrObjectString(o) {
+		return OBJ_OVERHEAD + STRING_OVERHEAD + int64(len(*o.Value.(*string)))
 	}
-	return StrObjectEncode(o), length
+	return OBJ_OVERHEAD
 }
 
-func StrObjectEncode(o *StrObject) *StrObject {
+func (s *Server) StrObjectEncode(o *StrObject) *StrObject {
 	if !IsStrObjectString(o) {
 		return o
 	}
 
 	i, err := strconv.Atoi(*o.Value.(*string))
 	if err == nil {
-		if IsSharedInt(i) {
+		if s.UseSharedInt(i) {
 			//o.DecrRefCount()
-			//kiwiS.Shared.Integers[i].IncrRefCount()
-			return kiwiS.Shared.Integers[i]
+			//s.Shared.Integers[i].IncrRefCount()
+			return s.Shared.Integers[i]
 		} else {
 			o.Value = &i
 			o.setEncode(OBJ_ENCODING_INT)
@@ -134,10 +153,10 @@ func StrObjectLength(o *StrObject) int {
 
 /* Get a decoded version of an encoded object (returned as a new object).
  * If the object is already raw-encoded just increment the ref count. */
-func StrObjectDecode(o *StrObject) *StrObject {
+func (s *Server) StrObjectDecode(o *StrObject) *StrObject {
 	if IsStrObjectInt(o) {
 		str := strconv.Itoa(*o.Value.(*int))
-		return CreateStrObjectByStr(str)
+		return s.CreateStrObjectByStr(str)
 	}
 	return o
 }
@@ -177,94 +196,41 @@ func CatString(a string, b string) string {
  * as in: "foo"bar or "foo'
  */
 func SplitArgs(args []byte) []string {
-	var vector []string
-	for i := 0; i < len(args); i++ {
-		// skip blanks
-		for i < len(args) && IsSpace(args[i]) {
-			i++
-		}
-		if i < len(args) {
-			inQoutes := false
-			inSingleQoutes := false
-			done := false
-			buf := Buffer{}
-			for !done {
-				if inQoutes {
-					if args[i] == '\\' && args[i+1] == 'x' && IsHexDigit(args[i+2]) && IsHexDigit(args[i+3]) {
-						b := HexDigitToInt(args[i+2])*16 + HexDigitToInt(args[i+3])
-						buf.WriteByte(b)
-						i += 3
-					} else if args[i] == '\\' && i+1 < len(args) {
-						i++
-						switch args[i] {
-						case 'n':
-							buf.WriteByte('\n')
-						case 'r':
-							buf.WriteByte('\r')
-						case 't':
-							buf.WriteByte('\t')
-						case 'b':
-							buf.WriteByte('\b')
-						case 'a':
-							buf.WriteByte('\a')
-						default:
-							buf.WriteByte(args[i])
-						}
-					} else if args[i] == '"' {
-						// closing quote must be followed by a space or nothing at all.
-						if i+1 < len(args) && !IsSpace(args[i+1]) {
-							return nil
-						}
-						done = true
-					} else if i >= len(args) {
-						/* unterminated quotes */
-						return nil
-					} else {
-						buf.WriteByte(args[i])
-					}
-				} else if inSingleQoutes {
-					if args[i] == '\\' && args[i+1] == '\'' {
-						buf.WriteByte('\'')
-						i++
-					} else if args[i] == '\'' {
-						// closing quote must be followed by a space or nothing at all.
-						if i+1 < len(args) && !IsSpace(args[i+1]) {
-							return nil
-						}
-						done = true
-					} else if i >= len(args) {
-						return nil
-					} else {
-						buf.WriteByte(args[i])
-					}
-				} else {
-					switch args[i] {
-					case ' ':
-						done = true
-					case '\n':
-						done = true
-					case '\r':
-						done = true
-					case '\t':
-						done = true
-					case 0:
-						done = true
-					case '"':
-						inQoutes = true
-					case '\'':
-						inSingleQoutes = true
-					default:
-						buf.WriteByte(args[i])
-					}
-				}
-				if i < len(args) {
-					i++
-				}
+	return resp.SplitArgs(args)
+}
+
+/* Return a quoted representation of the string "s" where all the
+ * non-printable characters (tested with isprint()) are turned into
+ * escapes in the form "\n\r\a...." or "\x<hex-number>".
+ *
+ * The result is in the same format SplitArgs() is able to parse. */
+func CatRepr(s string) string {
+	repr := make([]byte, 0, len(s)+2)
+	repr = append(repr, '"')
+	for i := 0; i < len(s); i++ {
+		switch ch := s[i]; ch {
+		case '\\', '"':
+			repr = append(repr, '\\', ch)
+		case '\n':
+			repr = append(repr, '\\', 'n')
+		case '\r':
+			repr = append(repr, '\\', 'r')
+		case '\t':
+			repr = append(repr, '\\', 't')
+		case '\a':
+			repr = append(repr, '\\', 'a')
+		case '\b':
+			repr = append(repr, '\\', 'b')
+		default:
+			if ch >= ' ' && ch <= '~' {
+				repr = append(repr, ch)
+			} else {
+				repr = append(repr, fmt.Sprintf("\\x%02x", ch)...)
 			}
-			vector = append(vector, buf.String())
 		}
 	}
-	return vector
+	repr = append(repr, '"')
+	return string(repr)
 }
 
 func IsHexDigit(b byte) bool {
@@ -338,3 +304,103 @@ func getStrByStrObject(key *StrObject) string {
 		return *key.Value.(*string)
 	}
 }
+
+/* Glob-style pattern matching. */
+func StringMatch(pattern, str string, nocase bool) bool {
+	return stringMatchImpl(pattern, str, nocase, 0)
+}
+
+func stringMatchImpl(pattern, str string, nocase bool, nesting int) bool {
+	// Protection against abusive patterns.
+	if nesting > 1000 {
+		return false
+	}
+	lower := func(b byte) byte {
+		if nocase && 'A' <= b && b <= 'Z' {
+			return b + ('a' - 'A')
+		}
+		return b
+	}
+	for len(pattern) > 0 && len(str) > 0 {
+		switch pattern[0] {
+		case '*':
+			for len(pattern) > 1 && pattern[1] == '*' {
+				pattern = pattern[1:]
+			}
+			if len(pattern) == 1 {
+				return true // match
+			}
+			for len(str) > 0 {
+				if stringMatchImpl(pattern[1:], str, nocase, nesting+1) {
+					return true // match
+				}
+				str = str[1:]
+			}
+			return false // no match
+		case '?':
+			str = str[1:]
+		case '[':
+			pattern = pattern[1:]
+			not := len(pattern) > 0 && pattern[0] == '^'
+			if not {
+				pattern = pattern[1:]
+			}
+			match := false
+			for {
+				if len(pattern) == 0 {
+					break
+				}
+				if pattern[0] == '\\' && len(pattern) >= 2 {
+					pattern = pattern[1:]
+					if pattern[0] == str[0] {
+						match = true
+					}
+				} else if pattern[0] == ']' {
+					break
+				} else if len(pattern) >= 3 && pattern[1] == '-' {
+					start, end := lower(pattern[0]), lower(pattern[2])
+					if start > end {
+						start, end = end, start
+					}
+					pattern = pattern[2:]
+					c := lower(str[0])
+					if c >= start && c <= end {
+						match = true
+					}
+				} else if lower(pattern[0]) == lower(str[0]) {
+					match = true
+				}
+				pattern = pattern[1:]
+			}
+			if len(pattern) == 0 {
+				// Pattern ended without the closing bracket.
+				return false
+			}
+			if not {
+				match = !match
+			}
+			if !match {
+				return false // no match
+			}
+			str = str[1:]
+		case '\\':
+			if len(pattern) >= 2 {
+				pattern = pattern[1:]
+			}
+			fallthrough
+		default:
+			if lower(pattern[0]) != lower(str[0]) {
+				return false // no match
+			}
+			str = str[1:]
+		}
+		pattern = pattern[1:]
+		if len(str) == 0 {
+			for len(pattern) > 0 && pattern[0] == '*' {
+				pattern = pattern[1:]
+			}
+			break
+		}
+	}
+	return len(pattern) == 0 && len(str) == 0
+}
@@ -0,0 +1,436 @@
+package server
+
+import (
+	"errors"
+	"math"
+	"strconv"
+	"strings"
+	"sync/atomic"
+
+	"github.com/zhaotong0312/kiwi/structure"
+)
+
+/* ============================= Sorted set type ============================ */
+
+/* A sorted set is a skiplist ordered by score, then by member, and a map
+ * from the members to their scores. */
+func (s *Server) CreateZsetObject() *ZSetObject {
+	return &ZSetObject{
+		Object: s.CreateObject(OBJ_RTYPE_ZSET, OBJ_ENCODING_SKIPLIST),
+		Value:  structure.ZSkiplistCreate(),
+		Dict:   make(map[string]float64),
+	}
+}
+
+/* Lookup a sorted set for write operations, creating it if create is true,
+ * see listLookupWriteOrReply(). */
+func zsetLookupWriteOrReply(c *KiwiClient, key string, create bool) (*ZSetObject, bool) {
+	obj := LookupKeyWrite(c.Db, key)
+	if obj == nil {
+		if create {
+			return c.srv.CreateZsetObject(), true
+		}
+		return nil, true
+	}
+	o, ok := obj.(*ZSetObject)
+	if !ok {
+		AddReplyErrorObject(c, c.srv.Shared.WrongTypeErr)
+		return nil, false
+	}
+	return o, true
+}
+
+func zsetLookupReadOrReply(c *KiwiClient, key string, reply string) *ZSetObject {
+	obj := DbGetOrReply(c, key, reply)
+	if obj == nil {
+		return nil
+	}
+	o, ok := obj.(*ZSetObject)
+	if !ok {
+		AddReplyErrorObject(c, c.srv.Shared.WrongTypeErr)
+		return nil
+	}
+	return o
+}
+
+func zsetStore(c *KiwiClient, key string, o *ZSetObject) {
+	if len(o.Dict) == 0 {
+		c.Db.Delete(key)
+		return
+	}
+	c.Db.Set(key, o)
+}
+
+/* Add or update the score of a member. Return true if the member was
+ * added. */
+func (o *ZSetObject) add(member string, score float64) bool {
+	if current, ok := o.Dict[member]; ok {
+		if current != score {
+			o.Value.ZSkiplistDelete(current, member)
+			o.Value.ZSkiplistInsert(score, member)
+			o.Dict[member] = score
+		}
+		return false
+	}
+	o.Value.ZSkiplistInsert(score, member)
+	o.Dict[member] = score
+	return true
+}
+
+func (o *ZSetObject) remove(member string) bool {
+	score, ok := o.Dict[member]
+	if !ok {
+		return false
+	}
+	o.Value.ZSkiplistDelete(score, member)
+	delete(o.Dict, member)
+	return true
+}
+
+/* Parse a score, "+inf" and "-inf" included. */
+func parseScore(str string) (float64, bool) {
+	score, err := strconv.ParseFloat(str, 64)
+	if err != nil || math.IsNaN(score) {
+		return 0, false
+	}
+	return score, true
+}
+
+/* Parse a score range like "(1 5" or "-inf +inf": a "(" prefix excludes
+ * the bound from the range. */
+func parseScoreRange(min, max string) (*structure.ZScoreRangeSpec, error) {
+	spec := &structure.ZScoreRangeSpec{}
+	var ok bool
+	if strings.HasPrefix(min, "(") {
+		spec.Minex = true
+		min = min[1:]
+	}
+	if strings.HasPrefix(max, "(") {
+		spec.Maxex = true
+		max = max[1:]
+	}
+	if spec.Min, ok = parseScore(min); !ok {
+		return nil, errors.New("min or max is not a float")
+	}
+	if spec.Max, ok = parseScore(max); !ok {
+		return nil, errors.New("min or max is not a float")
+	}
+	return spec, nil
+}
+
+/* Reply with a member, and its score if withscores is set. RESP3 clients
+ * get every member and its score in a nested array. */
+func addReplyZsetElement(c *KiwiClient, node *structure.ZSkiplistNode, withscores bool) {
+	if !withscores {
+		AddReplyBulkStr(c, node.Ele)
+		return
+	}
+	if c.Resp > 2 {
+		AddReplyMultiBulkLen(c, 2)
+	}
+	AddReplyBulkStr(c, node.Ele)
+	AddReplyDouble(c, node.Score)
+}
+
+func addReplyZsetLen(c *KiwiClient, length int, withscores bool) {
+	if withscores && c.Resp == 2 {
+		length *= 2
+	}
+	AddReplyMultiBulkLen(c, length)
+}
+
+/* ZADD key [NX|XX] [CH] [INCR] score member [score member ...] */
+func ZAddGenericCommand(c *KiwiClient, flags int) {
+	scoreidx := 2
+	for ; scoreidx < c.Argc; scoreidx++ {
+		switch strings.ToLower(c.Argv[scoreidx]) {
+		case "nx":
+			flags |= ZADD_NX
+		case "xx":
+			flags |= ZADD_XX
+		case "ch":
+			flags |= ZADD_CH
+		case "incr":
+			flags |= ZADD_INCR
+		default:
+			goto parsed
+		}
+	}
+parsed:
+	elements := c.Argc - scoreidx
+	if elements%2 != 0 || elements == 0 {
+		AddReplyErrorObject(c, c.srv.Shared.SyntaxErr)
+		return
+	}
+	elements /= 2
+	if flags&ZADD_NX != 0 && flags&ZADD_XX != 0 {
+		AddReplyError(c, "XX and NX options at the same time are not compatible")
+		return
+	}
+	if flags&ZADD_INCR != 0 && elements > 1 {
+		AddReplyError(c, "INCR option supports a single increment-element pair")
+		return
+	}
+	// Parse all the scores first, so that the command is atomic: nothing
+	// is added if a score is not valid.
+	scores := make([]float64, elements)
+	for j := 0; j < elements; j++ {
+		var ok bool
+		if scores[j], ok = parseScore(c.Argv[scoreidx+j*2]); !ok {
+			AddReplyError(c, "value is not a valid float")
+			return
+		}
+	}
+	o, ok := zsetLookupWriteOrReply(c, c.Argv[1], flags&ZADD_XX == 0)
+	if !ok {
+		return
+	}
+	if o == nil {
+		// XX on a missing key.
+		if flags&ZADD_INCR != 0 {
+			AddReplyNull(c)
+		} else {
+			AddReply(c, c.srv.Shared.Zero)
+		}
+		return
+	}
+	added, updated := 0, 0
+	var score float64
+	for j := 0; j < elements; j++ {
+		member := c.Argv[scoreidx+j*2+1]
+		score = scores[j]
+		current, exists := o.Dict[member]
+		if (exists && flags&ZADD_NX != 0) || (!exists && flags&ZADD_XX != 0) {
+			if flags&ZADD_INCR != 0 {
+				// The element was not added nor updated.
+				zsetStore(c, c.Argv[1], o)
+				AddReplyNull(c)
+				return
+			}
+			continue
+		}
+		if flags&ZADD_INCR != 0 && exists {
+			score += current
+			if math.IsNaN(score) {
+				AddReplyError(c, "resulting score is not a number (NaN)")
+				return
+			}
+		}
+		if o.add(member, score) {
+			added++
+		} else if current != score {
+			updated++
+		}
+	}
+	zsetStore(c, c.Argv[1], o)
+	atomic.AddInt64(&c.srv.Dirty, int64(added+updated))
+	if flags&ZADD_INCR != 0 {
+		AddReplyDouble(c, score)
+	} else if flags&ZADD_CH != 0 {
+		AddReplyInt(c, added+updated)
+	} else {
+		AddReplyInt(c, added)
+	}
+}
+
+var ZAddCommand CommandProcess = func(c *KiwiClient) {
+	ZAddGenericCommand(c, ZADD_NONE)
+}
+
+/* ZINCRBY key increment member */
+var ZIncrByCommand CommandProcess = func(c *KiwiClient) {
+	ZAddGenericCommand(c, ZADD_INCR)
+}
+
+/* ZREM key member [member ...] */
+var ZRemCommand CommandProcess = func(c *KiwiClient) {
+	o, ok := zsetLookupWriteOrReply(c, c.Argv[1], false)
+	if !ok {
+		return
+	}
+	if o == nil {
+		AddReply(c, c.srv.Shared.Zero)
+		return
+	}
+	deleted := 0
+	for j := 2; j < c.Argc; j++ {
+		if o.remove(c.Argv[j]) {
+			deleted++
+		}
+	}
+	if deleted > 0 {
+		zsetStore(c, c.Argv[1], o)
+		atomic.AddInt64(&c.srv.Dirty, int64(deleted))
+	}
+	AddReplyInt(c, deleted)
+}
+
+var ZCardCommand CommandProcess = func(c *KiwiClient) {
+	o := zsetLookupReadOrReply(c, c.Argv[1], c.srv.Shared.Zero)
+	if o == nil {
+		return
+	}
+	AddReplyInt(c, len(o.Dict))
+}
+
+var ZScoreCommand CommandProcess = func(c *KiwiClient) {
+	o := zsetLookupReadOrReply(c, c.Argv[1], c.srv.Shared.Null[c.Resp])
+	if o == nil {
+		return
+	}
+	if score, ok := o.Dict[c.Argv[2]]; ok {
+		AddReplyDouble(c, score)
+	} else {
+		AddReplyNull(c)
+	}
+}
+
+/* ZRANK/ZREVRANK key member */
+func ZRankGenericCommand(c *KiwiClient, reverse bool) {
+	o := zsetLookupReadOrReply(c, c.Argv[1], c.srv.Shared.Null[c.Resp])
+	if o == nil {
+		return
+	}
+	score, ok := o.Dict[c.Argv[2]]
+	if !ok {
+		AddReplyNull(c)
+		return
+	}
+	// Ranks of the skiplist start from 1.
+	rank := o.Value.ZSkiplistGetRank(score, c.Argv[2])
+	if reverse {
+		AddReplyInt(c, len(o.Dict)-rank)
+	} else {
+		AddReplyInt(c, rank-1)
+	}
+}
+
+var ZRankCommand CommandProcess = func(c *KiwiClient) {
+	ZRankGenericCommand(c, false)
+}
+
+var ZRevRankCommand CommandProcess = func(c *KiwiClient) {
+	ZRankGenericCommand(c, true)
+}
+
+/* ZRANGE/ZREVRANGE key start stop [WITHSCORES] */
+func ZRangeGenericCommand(c *KiwiClient, reverse bool) {
+	start, err1 := strconv.Atoi(c.Argv[2])
+	end, err2 := strconv.Atoi(c.Argv[3])
+	if err1 != nil || err2 != nil {
+		AddReplyError(c, "value is not an integer or out of range")
+		return
+	}
+	withscores := false
+	if c.Argc == 5 && strings.ToLower(c.Argv[4]) == "withscores" {
+		withscores = true
+	} else if c.Argc >= 5 {
+		AddReplyErrorObject(c, c.srv.Shared.SyntaxErr)
+		return
+	}
+	o := zsetLookupReadOrReply(c, c.Argv[1], c.srv.Shared.EmptyMultiBulk)
+	if o == nil {
+		return
+	}
+	length := len(o.Dict)
+	start, end, ok := listRange(start, end, length)
+	if !ok {
+		AddReply(c, c.srv.Shared.EmptyMultiBulk)
+		return
+	}
+	addReplyZsetLen(c, end-start+1, withscores)
+	var node *structure.ZSkiplistNode
+	if reverse {
+		node = o.Value.ZSkiplistGetElementByRank(length - start)
+	} else {
+		node = o.Value.ZSkiplistGetElementByRank(start + 1)
+	}
+	for j := start; j <= end; j++ {
+		addReplyZsetElement(c, node, withscores)
+		if reverse {
+			node = node.Backward
+		} else {
+			node = node.Level[0].Forward
+		}
+	}
+}
+
+var ZRangeCommand CommandProcess = func(c *KiwiClient) {
+	ZRangeGenericCommand(c, false)
+}
+
+var ZRevRangeCommand CommandProcess = func(c *KiwiClient) {
+	ZRangeGenericCommand(c, true)
+}
+
+/* ZRANGEBYSCORE key min max [WITHSCORES] [LIMIT offset count] */
+var ZRangeByScoreCommand CommandProcess = func(c *KiwiClient) {
+	spec, err := parseScoreRange(c.Argv[2], c.Argv[3])
+	if err != nil {
+		AddReplyError(c, err.Error())
+		return
+	}
+	withscores := false
+	offset, limit := 0, -1
+	for j := 4; j < c.Argc; j++ {
+		switch {
+		case strings.ToLower(c.Argv[j]) == "withscores":
+			withscores = true
+		case strings.ToLower(c.Argv[j]) == "limit" && j+2 < c.Argc:
+			var err1, err2 error
+			offset, err1 = strconv.Atoi(c.Argv[j+1])
+			limit, err2 = strconv.Atoi(c.Argv[j+2])
+			if err1 != nil || err2 != nil {
+				AddReplyError(c, "value is not an integer or out of range")
+				return
+			}
+			j += 2
+		default:
+			AddReplyErrorObject(c, c.srv.Shared.SyntaxErr)
+			return
+		}
+	}
+	o := zsetLookupReadOrReply(c, c.Argv[1], c.srv.Shared.EmptyMultiBulk)
+	if o == nil {
+		return
+	}
+	var nodes []*structure.ZSkiplistNode
+	if offset >= 0 {
+		node := o.Value.ZSkiplistFirstInRange(spec)
+		for ; node != nil && offset > 0; offset-- {
+			node = node.Level[0].Forward
+		}
+		for ; node != nil && limit != 0; node = node.Level[0].Forward {
+			if !structure.ZSkiplistValueLteMax(node.Score, spec) {
+				break
+			}
+			nodes = append(nodes, node)
+			limit--
+		}
+	}
+	addReplyZsetLen(c, len(nodes), withscores)
+	for _, node := range nodes {
+		addReplyZsetElement(c, node, withscores)
+	}
+}
+
+/* ZCOUNT key min max */
+var ZCountCommand CommandProcess = func(c *KiwiClient) {
+	spec, err := parseScoreRange(c.Argv[2], c.Argv[3])
+	if err != nil {
+		AddReplyError(c, err.Error())
+		return
+	}
+	o := zsetLookupReadOrReply(c, c.Argv[1], c.srv.Shared.Zero)
+	if o == nil {
+		return
+	}
+	count := 0
+	for node := o.Value.ZSkiplistFirstInRange(spec); node != nil; node = node.Level[0].Forward {
+		if !structure.ZSkiplistValueLteMax(node.Score, spec) {
+			break
+		}
+		count++
+	}
+	AddReplyInt(c, count)
+}
@@ -0,0 +1,320 @@
+package server
+
+import (
+	"runtime"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/zhaotong0312/kiwi/event"
+)
+
+/* ========================== Partitioned keyspace ========================== */
+
+/* With "partitioned-keyspace yes" the keys are hash-partitioned across the
+ * event loops: the keys of a hash slot, see KeyHashSlot(), belong to the
+ * partition slot % loops, and only the loop with the same index accesses
+ * them. Commands don't take the execution lock of multi.go, so that
+ * single-key workloads scale with the number of loops:
+ *
+ * 1) A command whose keys all belong to the partition of the loop of the
+ *    client is executed right away.
+ * 2) A command whose keys all belong to another partition is forwarded to
+ *    the owning loop. The client is blocked meanwhile, and a proxy client
+ *    executes the command there, collecting the reply. The reply is then
+ *    handed back to the loop of the client, that unblocks it.
+ * 3) Commands with keys in several partitions, and commands accessing the
+ *    whole keyspace like FLUSHALL or INFO, stop the world: every other
+ *    loop is parked between two events until the command returns. The
+ *    cron job stops the world too.
+ *
+ * Keyless commands flagged "fast" that neither read nor write the dataset,
+ * like SELECT or AUTH, are executed right away whatever the loop.
+ *
+ * Keys can be forced in the same partition with hash tags, like in cluster
+ * mode: {user1000}.following and {user1000}.followers share a partition,
+ * so MGET or a transaction accessing both never stops the world. */
+
+/* A stop the world request, see LockKeyspace(). */
+type worldStop struct {
+	parked  sync.WaitGroup // Done by every loop once parked
+	release chan struct{}  // Closed to resume the loops
+}
+
+type Partitions struct {
+	es      *event.EventServer
+	n       int               // Number of partitions, one per loop
+	world   sync.Mutex        // Held while the world is stopped
+	park    []chan *worldStop // Pending stop request of every loop
+	stopped *worldStop        // Current stop request, if the world is stopped
+	exited  []int32           // Set once a loop stopped, see loopStopped()
+}
+
+/* Return the partitions of the keyspace, or nil if the keyspace is not
+ * partitioned. The loops are not running yet: the event server is bound by
+ * the Serving event. */
+func (s *Server) CreatePartitions() *Partitions {
+	if !s.PartitionedKeyspace {
+		return nil
+	}
+	// Resolve the number of loops like the event server does.
+	n := s.numLoops
+	if n < 0 {
+		n = runtime.NumCPU()
+	} else if n == 0 {
+		n = 1
+	}
+	p := &Partitions{n: n, park: make([]chan *worldStop, n), exited: make([]int32, n)}
+	for i := range p.park {
+		p.park[i] = make(chan *worldStop, 1)
+	}
+	return p
+}
+
+/* Number of partitions of the keyspace, 1 if it is not partitioned. */
+func (s *Server) KeyspacePartitions() int {
+	if s.partitions == nil {
+		return 1
+	}
+	return s.partitions.n
+}
+
+/* Return the partition owning key. */
+func (s *Server) KeyPartition(key string) int {
+	if s.partitions == nil {
+		return 0
+	}
+	return KeyHashSlot(key) % s.partitions.n
+}
+
+/* Return the partition where the command must be executed: the partition
+ * of its keys, PARTITION_NONE if it can be executed by any loop, or
+ * PARTITION_ALL if it needs the world stopped. */
+func (s *Server) commandPartition(cmd *Command, argv []string, argc int) int {
+	keys := GetKeysFromCommand(cmd, argv, argc)
+	if len(keys) == 0 {
+		if cmd.WithFlags(CMD_FAST) && !cmd.WithFlags(CMD_READONLY|CMD_WRITE) {
+			return PARTITION_NONE
+		}
+		return PARTITION_ALL
+	}
+	part := s.KeyPartition(argv[keys[0]])
+	for _, pos := range keys[1:] {
+		if s.KeyPartition(argv[pos]) != part {
+			return PARTITION_ALL
+		}
+	}
+	return part
+}
+
+/* Return the partition where the current command of the client must be
+ * executed. EXEC goes where all its queued commands can be executed. */
+func CommandPartition(c *KiwiClient) int {
+	if c.Cmd.Name != "exec" {
+		return c.srv.commandPartition(c.Cmd, c.Argv, c.Argc)
+	}
+	part := PARTITION_NONE
+	for _, mc := range c.Mstate.Commands {
+		p := c.srv.commandPartition(mc.Cmd, mc.Argv, mc.Argc)
+		switch {
+		case p == PARTITION_NONE:
+			// Keyless commands like SELECT modify the client: the
+			// transaction can't be executed by a proxy.
+			return PARTITION_ALL
+		case p == PARTITION_ALL || (part != PARTITION_NONE && p != part):
+			return PARTITION_ALL
+		}
+		part = p
+	}
+	return part
+}
+
+/* Execute the current command of the client in its partition, see the top
+ * comment. */
+func (p *Partitions) Call(c *KiwiClient) {
+	self := c.LoopIndex()
+	if self < 0 {
+		// An internal client holding the whole keyspace already.
+		Call(c, CMD_CALL_FULL)
+		return
+	}
+	switch part := CommandPartition(c); part {
+	case PARTITION_NONE, self:
+		Call(c, CMD_CALL_FULL)
+	case PARTITION_ALL:
+		p.stopWorld(self)
+		Call(c, CMD_CALL_FULL)
+		p.startWorld()
+	default:
+		p.forward(c, self, part)
+	}
+}
+
+/* Execute the command of the client in the loop owning the partition. The
+ * client is blocked until the reply is handed back to its loop. */
+func (p *Partitions) forward(c *KiwiClient, self int, part int) {
+	proxy := &KiwiClient{
+		srv:           c.srv,
+		Id:            c.Id,
+		Conn:          c.Conn,
+		Db:            c.Db,
+		Name:          c.Name,
+		PeerId:        c.PeerId,
+		OutBuf:        &ReplyList{},
+		Argc:          c.Argc,
+		Argv:          c.Argv,
+		Cmd:           c.Cmd,
+		User:          c.User,
+		Flags:         atomic.LoadInt64(&c.Flags),
+		Authenticated: c.Authenticated,
+		Resp:          c.Resp,
+		ErrorReplies:  c.ErrorReplies,
+		Mstate:        c.Mstate,
+	}
+	c.AddFlags(CLIENT_BLOCKED)
+	c.Btype = BLOCKED_PARTITION
+	// Posting only fails once the loops are closing, and the client is
+	// going to be closed with them.
+	p.es.Post(part, func() {
+		Call(proxy, CMD_CALL_FULL)
+		p.es.Post(self, func() {
+			resumeForwardedClient(c, proxy)
+		})
+	})
+}
+
+/* Called in the loop of the client once the proxy executed its command:
+ * the reply is moved to the client, that is unblocked at once, as the
+ * command is complete. The commands pipelined meanwhile are served, and
+ * the client woken up only to write the replies. */
+func resumeForwardedClient(c *KiwiClient, proxy *KiwiClient) {
+	if c.Conn == nil {
+		// The client was closed meanwhile.
+		proxy.OutBuf.Release()
+		return
+	}
+	c.OutBuf.Append(proxy.OutBuf)
+	c.LastCmd = proxy.LastCmd
+	c.ErrorReplies = proxy.ErrorReplies
+	if !proxy.WithFlags(CLIENT_MULTI) {
+		// The proxy executed EXEC.
+		DiscardTransaction(c)
+	}
+	c.DeleteFlags(CLIENT_BLOCKED)
+	c.Btype = BLOCKED_NONE
+	c.UpdateReplySkip()
+	c.ResetArgv()
+	ProcessInputBuffer(c)
+	c.Conn.Wake()
+}
+
+/* Stop the world: wait for every other loop to park. self is the index of
+ * the calling loop, that keeps parking on behalf of the other loops until
+ * it gets the world, or they could wait for each other forever. */
+func (p *Partitions) stopWorld(self int) {
+	for !p.world.TryLock() {
+		select {
+		case ws := <-p.park[self]:
+			ws.park()
+		default:
+			runtime.Gosched()
+		}
+	}
+	ws := &worldStop{release: make(chan struct{})}
+	for i := 0; i < p.n; i++ {
+		if i == self {
+			continue
+		}
+		ws.parked.Add(1)
+		p.park[i] <- ws
+		i := i
+		p.es.Post(i, func() {
+			// The loop may have parked for this request already while
+			// waiting for the world itself.
+			select {
+			case ws := <-p.park[i]:
+				ws.park()
+			default:
+			}
+		})
+		if atomic.LoadInt32(&p.exited[i]) != 0 {
+			p.parkExited(i)
+		}
+	}
+	ws.parked.Wait()
+	p.stopped = ws
+}
+
+func (p *Partitions) startWorld() {
+	close(p.stopped.release)
+	p.stopped = nil
+	p.world.Unlock()
+}
+
+func (ws *worldStop) park() {
+	ws.parked.Done()
+	<-ws.release
+}
+
+/* Called once a loop stopped, when the server is shutting down: it never
+ * parks again, but doesn't access its partition anymore either, so it is
+ * counted as parked by the pending and future stop requests. */
+func (p *Partitions) loopStopped(loop int) {
+	atomic.StoreInt32(&p.exited[loop], 1)
+	p.parkExited(loop)
+}
+
+/* Count a stopped loop as parked for its pending stop request, if any.
+ * Either the loop or the stopping loop takes the request, see
+ * stopWorld(). */
+func (p *Partitions) parkExited(loop int) {
+	select {
+	case ws := <-p.park[loop]:
+		ws.parked.Done()
+	default:
+	}
+}
+
+/* Get exclusive access to the whole keyspace, from the loop with index
+ * loop. Without partitioning this is just the execution lock.
+ *
+ * The time spent waiting for the other loops is not counted in the
+ * event-loop latency of this loop, see the Latency event. */
+func (s *Server) LockKeyspace(loop int) {
+	if loop >= 0 && loop < len(s.lockWaits) {
+		start := time.Now()
+		defer func() {
+			atomic.AddInt64(&s.lockWaits[loop], int64(time.Since(start)))
+		}()
+	}
+	if s.partitions == nil {
+		s.execMutex.Lock()
+		return
+	}
+	s.partitions.stopWorld(loop)
+}
+
+func (s *Server) UnlockKeyspace() {
+	if s.partitions == nil {
+		s.execMutex.Unlock()
+		return
+	}
+	s.partitions.startWorld()
+}
+
+/* Evicting keys accesses every partition: with a partitioned keyspace the
+ * world is stopped, only once the memory limit is actually reached. */
+func freeMemoryIfNeededAndSafe(c *KiwiClient) int {
+	if c.srv.partitions == nil {
+		return c.srv.FreeMemoryIfNeeded()
+	}
+	if atomic.LoadInt64(&c.srv.UsedMemory) <= int64(c.srv.MaxMemory) {
+		return C_OK
+	}
+	if c.LoopIndex() < 0 {
+		return c.srv.FreeMemoryIfNeeded()
+	}
+	c.srv.LockKeyspace(c.LoopIndex())
+	defer c.srv.UnlockKeyspace()
+	return c.srv.FreeMemoryIfNeeded()
+}
@@ -3,18 +3,70 @@ package server
 import (
 	"strconv"
 	"fmt"
-	"sync/atomic"
+	"strings"
+	"github.com/zhaotong0312/kiwi/resp"
 )
 
+/* Replies are emitted by type: commands call the helper of the type they
+ * reply with (AddReplyMapLen, AddReplyNull, AddReplyDouble, ...), and the
+ * helper encodes it according to the protocol negotiated by the client
+ * with HELLO. RESP2 clients get the closest RESP2 type: maps are flat
+ * arrays, doubles and verbatim strings are bulk strings, booleans are
+ * integers. The encoding itself is done by the resp package. */
+
 func AddReply(c *KiwiClient, str string) {
 	if c.PrepareClientToWrite() != C_OK {
 		return
 	}
-	n, err := c.OutBuf.WriteString(str)
-	if err != nil {
+	// The output bytes are accounted when written to the socket.
+	c.OutBuf.WriteString(str)
+}
+
+/* Add a string without copying it when it is big enough, see
+ * ReplyList.WriteStringRef(). */
+func AddReplyRef(c *KiwiClient, str string) {
+	if c.PrepareClientToWrite() != C_OK {
+		return
+	}
+	c.OutBuf.WriteStringRef(str)
+}
+
+/* Add a reply encoded with the resp package. */
+func AddReplyBytes(c *KiwiClient, b []byte) {
+	if c.PrepareClientToWrite() != C_OK {
 		return
 	}
-	atomic.AddInt64(&kiwiS.StatNetOutputBytes, int64(n))
+	c.OutBuf.Write(b)
+}
+
+/* Queue a reply for a client that may be owned by another event loop,
+ * as monitors are. The reply is appended to the async buffer of the
+ * client, and the connection is woken up so that its own loop sends it. */
+func AddReplyAsync(c *KiwiClient, str string) {
+	c.asyncMutex.Lock()
+	pending := len(c.asyncOut)
+	if pending+len(str) > PROTO_ASYNC_REPLY_MAX_LEN {
+		// The client can't keep up, don't let the buffer grow forever.
+		c.asyncMutex.Unlock()
+		FreeClientAsync(c)
+		return
+	}
+	c.asyncOut = append(c.asyncOut, str...)
+	c.asyncMutex.Unlock()
+	// Only the first pending reply needs a wake up, the loop flushes
+	// everything that was queued in the meantime.
+	if pending == 0 && c.Conn != nil {
+		c.Conn.Wake()
+	}
+}
+
+/* Return and clear the replies queued with AddReplyAsync(). */
+func (c *KiwiClient) TakeAsyncReply() []byte {
+	c.asyncMutex.Lock()
+	defer c.asyncMutex.Unlock()
+	out := c.asyncOut
+	c.asyncOut = nil
+	return out
 }
 
 func AddReplyStrObj(c *KiwiClient, o *StrObject) {
@@ -29,16 +81,47 @@ func AddReplyStrObj(c *KiwiClient, o *StrObject) {
 	}
 }
 
+/* Newlines would end the error reply early, and let the rest of the
+ * string, that may come from the client, be read as another reply. */
+var errorReplySanitizer = strings.NewReplacer("\r", " ", "\n", " ")
+
 func AddReplyError(c *KiwiClient, str string) {
-	if len(str) != 0 || str[0] != '-' {
-		AddReply(c, "-ERR ")
+	if len(str) == 0 || str[0] != '-' {
+		str = "-ERR " + str
+	}
+	if strings.ContainsAny(str, "\r\n") {
+		str = errorReplySanitizer.Replace(str)
 	}
 	AddReply(c, str)
 	AddReply(c, "\r\n")
+	AfterErrorReply(c, str)
+}
+
+/* Add a preformatted error reply, like the shared ones, that already
+ * starts with '-' and ends with CRLF. */
+func AddReplyErrorObject(c *KiwiClient, str string) {
+	AddReply(c, str)
+	AfterErrorReply(c, str)
+}
+
+/* Update the error stats with the error code of the reply, that is the
+ * first word of the error: "-WRONGTYPE Operation against ..." is accounted
+ * as WRONGTYPE. */
+func AfterErrorReply(c *KiwiClient, str string) {
+	code := "ERR"
+	if len(str) > 1 && str[0] == '-' {
+		if end := strings.IndexAny(str, " \r\n"); end > 1 {
+			code = str[1:end]
+		} else if end == -1 {
+			code = str[1:]
+		}
+	}
+	c.srv.IncrementErrorCount(code)
+	c.ErrorReplies++
 }
 
 func AddReplyErrorFormat(c *KiwiClient, format string, a ...interface{}) {
-	str := fmt.Sprintf(format, a)
+	str := fmt.Sprintf(format, a...)
 	AddReplyError(c, str)
 }
 
@@ -49,41 +132,42 @@ func AddReplyStatus(c *KiwiClient, str string) {
 }
 
 func (s *Server) AddReplyStatusFormat(c *KiwiClient, format string, a ...interface{}) {
-	str := fmt.Sprintf(format, a)
+	str := fmt.Sprintf(format, a...)
 	AddReplyStatus(c, str)
 }
 
-//func (kiwiS *Server) AddReplyHelp(c *KiwiClient, help []string) {
-//	cmd := c.Argv[0]
-//	kiwiS.AddReplyStatusFormat(c, "%kiwiS <subcommand> arg arg ... arg. Subcommands are:", cmd)
-//	for _, h := range help {
-//		kiwiS.AddReplyStatus(c, h)
-//	}
-//}
+func AddReplyHelp(c *KiwiClient, help []string) {
+	cmd := strings.ToUpper(c.Argv[0])
+	AddReplyMultiBulkLen(c, len(help)+1)
+	AddReplyStatus(c, fmt.Sprintf("%s <subcommand> arg arg ... arg. Subcommands are:", cmd))
+	for _, h := range help {
+		AddReplyStatus(c, h)
+	}
+}
+
+func AddReplySubcommandSyntaxError(c *KiwiClient) {
+	AddReplyErrorFormat(c, "Unknown subcommand or wrong number of arguments for '%.128s'. Try %s HELP",
+		c.Argv[1], strings.ToUpper(c.Argv[0]))
+}
 
 func AddReplyIntWithPrifix(c *KiwiClient, i int, prefix byte) {
 	/* Things like $3\r\n or *2\r\n are emitted very often by the protocol
 	so we have a few shared objects to use if the integer is small
 	like it is most of the times. */
 	if prefix == '*' && i >= 0 && i < SHARED_BULKHDR_LEN {
-		AddReply(c, kiwiS.Shared.MultiBulkHDR[i])
+		AddReply(c, c.srv.Shared.MultiBulkHDR[i])
 	} else if prefix == '$' && i >= 0 && i < SHARED_BULKHDR_LEN {
-		AddReply(c, kiwiS.Shared.BulkHDR[i])
-	} else {
-		str := strconv.Itoa(i)
-		buf := Buffer{}
-		buf.WriteByte(prefix)
-		buf.WriteString(str)
-		buf.WriteString("\r\n")
-		AddReply(c, buf.String())
+		AddReply(c, c.srv.Shared.BulkHDR[i])
+	} else if c.PrepareClientToWrite() == C_OK {
+		c.OutBuf.AppendHeader(resp.Type(prefix), int64(i))
 	}
 }
 
 func AddReplyInt(c *KiwiClient, i int) {
 	if i == 0 {
-		AddReply(c, kiwiS.Shared.Zero)
+		AddReply(c, c.srv.Shared.Zero)
 	} else if i == 1 {
-		AddReply(c, kiwiS.Shared.One)
+		AddReply(c, c.srv.Shared.One)
 	} else {
 		AddReplyIntWithPrifix(c, i, ':')
 	}
@@ -93,6 +177,82 @@ func AddReplyMultiBulkLen(c *KiwiClient, length int) {
 	AddReplyIntWithPrifix(c, length, '*')
 }
 
+/* Add the length of a map of 'length' key-value pairs. */
+func AddReplyMapLen(c *KiwiClient, length int) {
+	if c.Resp == 2 {
+		AddReplyMultiBulkLen(c, length*2)
+	} else {
+		AddReplyIntWithPrifix(c, length, byte(resp.Map))
+	}
+}
+
+func AddReplySetLen(c *KiwiClient, length int) {
+	if c.Resp == 2 {
+		AddReplyMultiBulkLen(c, length)
+	} else {
+		AddReplyIntWithPrifix(c, length, byte(resp.Set))
+	}
+}
+
+/* Add the length of an out-of-band push message. RESP2 clients can only
+ * receive them as arrays, when they are in a state, like Pub/Sub, where no
+ * other reply is expected. */
+func AddReplyPushLen(c *KiwiClient, length int) {
+	if c.Resp == 2 {
+		AddReplyMultiBulkLen(c, length)
+	} else {
+		AddReplyIntWithPrifix(c, length, byte(resp.Push))
+	}
+}
+
+func AddReplyNull(c *KiwiClient) {
+	AddReply(c, c.srv.Shared.Null[c.Resp])
+}
+
+/* A null array, used in RESP2 when there is no array to return, for example
+ * on timeouts. */
+func AddReplyNullArray(c *KiwiClient) {
+	AddReply(c, c.srv.Shared.NullArray[c.Resp])
+}
+
+func AddReplyBool(c *KiwiClient, b bool) {
+	if c.Resp == 2 {
+		if b {
+			AddReply(c, c.srv.Shared.One)
+		} else {
+			AddReply(c, c.srv.Shared.Zero)
+		}
+	} else {
+		var buf [4]byte
+		AddReplyBytes(c, resp.AppendBool(buf[:0], b))
+	}
+}
+
+/* Add a string that is meant to be shown as is to the user, like the
+ * output of INFO. 'ext' is the three characters format of the text, "txt"
+ * for plain text or "mkd" for markdown. */
+func AddReplyVerbatim(c *KiwiClient, str string, ext string) {
+	if c.Resp == 2 {
+		AddReplyBulkStr(c, str)
+		return
+	}
+	AddReplyIntWithPrifix(c, len(str)+len(ext)+1, byte(resp.VerbatimString))
+	AddReply(c, ext)
+	AddReply(c, ":")
+	AddReplyRef(c, str)
+	AddReply(c, c.srv.Shared.Crlf)
+}
+
+/* Add an integer that may not fit in 64 bits, in its decimal
+ * representation. */
+func AddReplyBigNum(c *KiwiClient, num string) {
+	if c.Resp == 2 {
+		AddReplyBulkStr(c, num)
+		return
+	}
+	AddReplyBytes(c, resp.AppendBigNumber(nil, num))
+}
+
 /* Create the length prefix of a bulk reply, example: $2234 */
 func AddReplyBulkLenOfStr(c *KiwiClient, str string) {
 	length := len(str)
@@ -107,22 +267,26 @@ func AddReplyBulkStrObj(c *KiwiClient, o *StrObject) {
 	str, err := GetStrObjectValueString(o)
 	// fmt.Println(">>>>>>>>>>>>>>>>", str)
 	if err == nil {
-		AddReplyBulkLenOfStr(c, str)
-	} else {
-		return
+		AddReplyBulkStr(c, str)
 	}
-	AddReply(c, str)
-	AddReply(c, kiwiS.Shared.Crlf)
 }
 
+/* Add a bulk reply. Big values are referenced by the reply rather than
+ * copied into it. */
 func AddReplyBulkStr(c *KiwiClient, str string) {
-	if str == "" {
-		AddReply(c, kiwiS.Shared.NullBulk)
-	} else {
-		AddReplyBulkLenOfStr(c, str)
-		AddReply(c, str)
-		AddReply(c, kiwiS.Shared.Crlf)
+	AddReplyBulkLenOfStr(c, str)
+	AddReplyRef(c, str)
+	AddReply(c, c.srv.Shared.Crlf)
+}
+
+/* Add a double as a bulk reply in RESP2, or as a double in RESP3 */
+func AddReplyDouble(c *KiwiClient, d float64) {
+	if c.Resp == 2 {
+		AddReplyBulkStr(c, resp.FormatDouble(d))
+		return
 	}
+	var buf [32]byte
+	AddReplyBytes(c, resp.AppendDouble(buf[:0], d))
 }
 
 func AddReplyBulkInt(c *KiwiClient, i int) {
@@ -156,7 +320,7 @@ func AddReplyBulkInt(c *KiwiClient, i int) {
 //}
 //
 //func AddBufferError(buf *Buffer, str string) {
-//	if len(str) != 0 || str[0] != '-' {
+//	if len(str) == 0 || str[0] != '-' {
 //		AddBuffer(buf, "-ERR ")
 //	}
 //	AddBuffer(buf, str)
@@ -0,0 +1,176 @@
+package server
+
+import (
+	"sync"
+	"unsafe"
+
+	"github.com/zhaotong0312/kiwi/resp"
+)
+
+/* The replies of a client are accumulated in a list of chunks, that is
+ * handed as is to the event loop and written with a single writev, so
+ * that a reply is never copied once encoded.
+ *
+ * Chunks are PROTO_REPLY_CHUNK_BYTES long and pooled: the loop gives them
+ * back once written, see ReleaseReplyChunk(). Strings longer than a chunk,
+ * like big bulk values, are not copied at all: the list references the
+ * string itself, that is immutable, until it has been written. */
+
+var replyChunkPool = sync.Pool{
+	New: func() interface{} {
+		return new([PROTO_REPLY_CHUNK_BYTES]byte)
+	},
+}
+
+func getReplyChunk() []byte {
+	return replyChunkPool.Get().(*[PROTO_REPLY_CHUNK_BYTES]byte)[:0]
+}
+
+/* Give a chunk back to the pool once it has been written. Referenced
+ * strings are longer than a chunk, so only the pooled chunks have
+ * exactly the capacity of a chunk. */
+func ReleaseReplyChunk(b []byte) {
+	if cap(b) != PROTO_REPLY_CHUNK_BYTES {
+		return
+	}
+	replyChunkPool.Put((*[PROTO_REPLY_CHUNK_BYTES]byte)(b[:PROTO_REPLY_CHUNK_BYTES]))
+}
+
+/* Return the bytes of a string without copying them. The slice must never
+ * be written to. */
+func stringBytes(s string) []byte {
+	return *(*[]byte)(unsafe.Pointer(&struct {
+		string
+		Cap int
+	}{s, len(s)}))
+}
+
+type ReplyList struct {
+	bufs  [][]byte // The chunks, the last one is filled by the next writes
+	size  int      // Bytes in the chunks
+	taken int      // Chunks handed to the loop still referenced by bufs
+}
+
+func (r *ReplyList) Len() int { return r.size }
+
+/* Memory used by the reply, referenced strings included. */
+func (r *ReplyList) Cap() int {
+	n := 0
+	for _, b := range r.bufs {
+		n += cap(b)
+	}
+	return n
+}
+
+/* Return the index of the last chunk, making sure that it has room for n
+ * more bytes, up to a whole chunk. */
+func (r *ReplyList) tail(n int) int {
+	r.ClearTaken()
+	last := len(r.bufs) - 1
+	if n > PROTO_REPLY_CHUNK_BYTES {
+		n = PROTO_REPLY_CHUNK_BYTES
+	}
+	if last == -1 || cap(r.bufs[last])-len(r.bufs[last]) < n {
+		r.bufs = append(r.bufs, getReplyChunk())
+		last++
+	}
+	return last
+}
+
+func (r *ReplyList) WriteString(s string) {
+	r.size += len(s)
+	for len(s) > 0 {
+		last := r.tail(1)
+		b := r.bufs[last]
+		n := copy(b[len(b):cap(b)], s)
+		r.bufs[last] = b[:len(b)+n]
+		s = s[n:]
+	}
+}
+
+func (r *ReplyList) Write(p []byte) {
+	r.size += len(p)
+	for len(p) > 0 {
+		last := r.tail(1)
+		b := r.bufs[last]
+		n := copy(b[len(b):cap(b)], p)
+		r.bufs[last] = b[:len(b)+n]
+		p = p[n:]
+	}
+}
+
+/* Add a string to the reply, referencing it instead of copying it when it
+ * is longer than a chunk. */
+func (r *ReplyList) WriteStringRef(s string) {
+	if len(s) <= PROTO_REPLY_CHUNK_BYTES {
+		r.WriteString(s)
+		return
+	}
+	r.ClearTaken()
+	r.bufs = append(r.bufs, stringBytes(s))
+	r.size += len(s)
+}
+
+/* Encode a header like "$3\r\n" or "*2\r\n" in place, in the last chunk. */
+func (r *ReplyList) AppendHeader(t resp.Type, n int64) {
+	last := r.tail(24)
+	b := r.bufs[last]
+	r.bufs[last] = resp.AppendHeader(b, t, n)
+	r.size += len(r.bufs[last]) - len(b)
+}
+
+/* Move the chunks of o at the end of the list, leaving o empty. */
+func (r *ReplyList) Append(o *ReplyList) {
+	r.ClearTaken()
+	o.ClearTaken()
+	r.bufs = append(r.bufs, o.bufs...)
+	r.size += o.size
+	o.bufs = nil
+	o.size = 0
+}
+
+/* Hand the chunks to the event loop, that releases them once written. The
+ * returned slice is only valid until the next write to the list. */
+func (r *ReplyList) Take() [][]byte {
+	out := r.bufs
+	r.bufs = r.bufs[:0]
+	r.size = 0
+	r.taken = len(out)
+	return out
+}
+
+/* Forget the chunks handed to the loop, so that the list doesn't keep the
+ * referenced strings alive. The loop must have queued them already. */
+func (r *ReplyList) ClearTaken() {
+	if r.taken == 0 {
+		return
+	}
+	stale := r.bufs[len(r.bufs):r.taken]
+	for i := range stale {
+		stale[i] = nil
+	}
+	r.taken = 0
+}
+
+/* Return the reply as a single buffer, giving its chunks back to the
+ * pool: for the clients without a connection. */
+func (r *ReplyList) Flatten() []byte {
+	r.ClearTaken()
+	out := make([]byte, 0, r.size)
+	for _, b := range r.bufs {
+		out = append(out, b...)
+	}
+	r.Release()
+	return out
+}
+
+/* Discard the reply, giving its chunks back to the pool. */
+func (r *ReplyList) Release() {
+	r.ClearTaken()
+	for i, b := range r.bufs {
+		ReleaseReplyChunk(b)
+		r.bufs[i] = nil
+	}
+	r.bufs = r.bufs[:0]
+	r.size = 0
+}
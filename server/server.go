@@ -1,9 +1,13 @@
 package server
 
 import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
 	"sync"
 	"fmt"
 	"strconv"
+	"strings"
 	"time"
 	"os"
 	"io/ioutil"
@@ -11,9 +15,11 @@ import (
 	"path/filepath"
 	"net"
 	"os/signal"
+	"runtime"
 	"syscall"
 	"sync/atomic"
-	"kiwi/src/structure"
+	"github.com/zhaotong0312/kiwi/structure"
+	"github.com/zhaotong0312/kiwi/event"
 )
 
 type accepted struct {
@@ -23,8 +29,13 @@ type accepted struct {
 
 type Server struct {
 	Pid                  int
+	RunId                string // ID always different at every exec.
 	PidFile              string
+	SupervisedMode       int  // SUPERVISED_*, see supervised.go
+	Supervised           bool // True if supervised by upstart or systemd
+	ShutdownTimeout      int  // Seconds given to the clients to read their replies on shutdown
 	ConfigFile           string
+	ConfigOptions        string // Command line options, applied over the config file on reload
 	ExecFile             string
 	ExecArgv             []string
 	Hz                   int // serverCron() calls frequency in hertz
@@ -32,21 +43,37 @@ type Server struct {
 	DbNum                int
 	Commands             map[string]*Command
 	OrigCommands         map[string]*Command
+	StartTime            time.Time // Server start time
 	UnixTime             time.Time // UnixTime in nanosecond
-	LruClock             time.Time // Clock for LRU eviction
+	lruClock             time.Time // Clock for LRU eviction
 	CronLoopCount        int64
 	NextClientId         int64
 	Port                 int // TCP listening port
 	BindAddrs            []string
 	BindAddrCount        int       // Number of addresses in test_server.bindaddr[]
 	UnixSocketPath       string    // UNIX socket path
+	TlsPort              int       // TLS listening port, 0 to disable
+	TlsCluster           bool      // Use TLS for the cluster bus
+	TlsCertFile          string
+	TlsKeyFile           string
+	TlsCaCertFile        string
+	TlsCaCertDir         string
+	TlsProtocols         string        // Accepted protocols, like "TLSv1.2 TLSv1.3"
+	TlsAuthClients       int           // TLS_CLIENT_AUTH_*
+	TlsHandshakeTimeout  time.Duration // Connections not secured in time are closed
 	Clients              *structure.List // List of active clients
 	ClientsMap           map[int64]*KiwiClient
 	ClientMaxQueryBufLen int
 	ClientMaxReplyBufLen int
 	MaxClients           int64
+	ClientPauseType      int32     // Current pause type, CLIENT_PAUSE_*
+	ClientPauseEndTime   time.Time // Time when we undo clients_paused
+	pausedClients        []*KiwiClient // List of postponed clients
+	pauseMutex           sync.Mutex
 	ProtectedMode        bool // Don't accept external connections.
 	RequirePassword      *string
+	AclFile              string // ACL users file, see acl.go
+	AclLogMaxLen         int    // Max number of entries of the ACL LOG
 	TcpKeepAlive         bool
 	ProtoMaxBulkLen      int
 	ClientMaxIdleTime    time.Duration
@@ -57,78 +84,215 @@ type Server struct {
 	StatNetOutputBytes int64
 	StatNetInputBytes  int64
 	StatNumCommands    int64
+	StatNumConnections int64 // Number of connections received
+	StatKeyspaceHits   int64 // Number of successful lookups of keys
+	StatKeyspaceMisses int64 // Number of failed lookups of keys
+	StatTotalErrorReplies int64 // Total number of issued error replies
+	StatClientQbufLimitDisconnections int64 // Clients closed for exceeding client-query-buffer-limit
+	ErrorStats         map[string]int64 // Error replies count by error code
+	SlowlogLogSlowerThan           int64     // SLOWLOG time limit (to get logged), in microseconds
+	SlowlogMaxLen                  int       // SLOWLOG max number of items logged
+	LatencyMonitorThreshold        int64     // Latency monitor threshold, in milliseconds (0 = disabled)
+	LatencyTrackingEnabled         bool      // Track the latency histogram of the commands
+	LatencyTrackingInfoPercentiles []float64 // Percentiles reported by INFO latencystats
+	statMutex          sync.Mutex
+	instMetric         [STATS_METRIC_COUNT]InstMetric
 	ConfigFlushAll     bool
 	MaxMemory          int
+	MaxMemoryPolicy    int   // Policy for key eviction
+	MaxMemorySamples   int   // Precision of random sampling
+	MaxMemoryClients   int   // Limit of the memory of the clients, see EvictClientsIfNeeded()
+	LfuLogFactor       int   // LFU logarithmic counter factor
+	LfuDecayTime       int   // LFU counter decay factor, in minutes
+	UsedMemory         int64 // Memory accounted for the keyspace
+	InitialMemoryUsage uint64 // Heap used after initialization
+	StatPeakMemory     uint64 // Max heap used
+	StatExpiredKeys    int64 // Number of expired keys
+	StatEvictedKeys    int64 // Number of evicted keys (maxmemory)
+	StatEvictedClients int64 // Number of evicted clients (maxmemory-clients)
+	evictNextDb        int
 	Loading            bool
 	LogLevel           int
+	ClusterEnabled             bool
+	ClusterConfigFile          string
+	ClusterNodeTimeout         time.Duration
+	ClusterRequireFullCoverage bool
+	ClusterAnnounceIp          string
+	Cluster                    *ClusterState
 	CloseCh            chan struct{}
 	mutex              sync.RWMutex
+	execMutex          sync.Mutex // Held while a command runs, see multi.go
+	acl                aclState
+	DefaultUser        *User // Used by new connections, it can't be deleted
+	configTable        []*StandardConfig
+	configDefaults     map[string]string // Values before the config file, see CONFIG REWRITE
+	evictionPool       [EVPOOL_SIZE]EvictionPoolEntry
+	evictionMutex      sync.Mutex
+	latencyEvents      latencyState
+	lockWaits          []int64 // Time each loop waited for the keyspace, see LockKeyspace()
+	monitors           monitorList
+	slowlog            Slowlog
+	tlsCtx             atomic.Value
+	PartitionedKeyspace bool
+	partitions         *Partitions // Partitions of the keyspace, see partition.go
 	wg                 sync.WaitGroup
-	events             Events
+	events             event.Events
 	reusePort          bool
 	numLoops           int
-	eventServer        *mpEventServer
+	es                 *event.EventServer
+	shutdownOnce       sync.Once
+	pidFile            *os.File // The pidfile locked by CreatePidFile()
+	shutdownAsap       int32    // A signal requested a shutdown, see SignalHandle()
+	shutdownRequested  int32    // The server was asked to shut down
 }
 
-var kiwiS *Server
-
-func LruClock() time.Time {
-	if 1000/kiwiS.Hz <= LRU_CLOCK_RESOLUTION {
-		return kiwiS.LruClock
+func (s *Server) LruClock() time.Time {
+	if 1000/s.Hz <= LRU_CLOCK_RESOLUTION {
+		return s.lruClock
 	} else {
 		return GetLruClock()
 	}
 }
 
+/* Generate a random hex string of len characters, used for the run id
+ * and the cluster node names. */
+func GetRandomHexChars(len int) string {
+	b := make([]byte, (len+1)/2)
+	rand.Read(b)
+	return hex.EncodeToString(b)[:len]
+}
+
 func GetLruClock() time.Time {
 	return time.Now()
 }
 
-func UpdateCachedTime() {
-	kiwiS.UnixTime = time.Now()
+func (s *Server) UpdateCachedTime() {
+	s.UnixTime = time.Now()
 }
 
-func UpdateLRUClock() {
-	kiwiS.LruClock = time.Now()
+func (s *Server) UpdateLRUClock() {
+	s.lruClock = time.Now()
 }
 
-func ServerCronHandler() {
-	//kiwiS.mutex.Lock()
-	//defer kiwiS.mutex.Unlock()
-	kiwiS.wg.Add(1)
-	defer kiwiS.wg.Done()
-	UpdateCachedTime()
-	UpdateLRUClock()
-	atomic.AddInt64(&kiwiS.CronLoopCount, 1)
+func (s *Server) ServerCronHandler() {
+	// The cron job expires and evicts keys: it runs between commands. It
+	// runs in the first event loop, see the Tick event.
+	s.LockKeyspace(CRON_LOOP)
+	defer s.UnlockKeyspace()
+	s.wg.Add(1)
+	defer s.wg.Done()
+	latency := s.LatencyStartMonitor()
+	defer func() {
+		s.LatencyAddSampleIfNeeded("cron", LatencyEndMonitor(latency))
+	}()
+	s.UpdateCachedTime()
+	s.UpdateLRUClock()
+	// Clients are paused up to a given time, unpause them once it elapsed.
+	s.ClientsArePaused()
+	/* We received a SIGTERM or SIGINT, shutting down here in a safe way, as
+	 * it is not ok doing so inside the signal handler. */
+	if atomic.CompareAndSwapInt32(&s.shutdownAsap, 1, 0) {
+		if s.PrepareForShutdown(SHUTDOWN_NOFLAGS) == C_ERR {
+			s.ServerLogWarnF("SIGTERM received but errors trying to shut down the server, check the logs for more information\n")
+		}
+	}
+	s.ActiveExpireCycle()
+	s.EvictClientsIfNeeded()
+	s.UpdatePeakMemory()
+	s.TrackInstantaneousMetrics()
+	if s.ClusterEnabled {
+		s.ClusterCron()
+	}
+	atomic.AddInt64(&s.CronLoopCount, 1)
 }
 
-func ServerCron() {
-	kiwiS.wg.Add(1)
-	defer kiwiS.wg.Done()
+func (s *Server) ServerCron() {
+	s.wg.Add(1)
+	defer s.wg.Done()
 	for {
 		select {
-		case <-kiwiS.CloseCh:
-			kiwiS.ServerLogDebugF("-->%v\n", "ServerCron ------ SHUTDOWN")
+		case <-s.CloseCh:
+			s.ServerLogDebugF("-->%v\n", "ServerCron ------ SHUTDOWN")
 			return
-		case <-time.After(time.Millisecond * time.Duration(1000/kiwiS.Hz)):
-			go ServerCronHandler()
+		case <-time.After(time.Millisecond * time.Duration(1000/s.Hz)):
+			go s.ServerCronHandler()
 		}
 	}
 }
 
-func ServerExists() (int, error) {
-	// fmt.Println(os.TempDir() + "kiwi.pid")
-	if kiwiPidFile, err1 := os.Open(os.TempDir() + "kiwi.pid"); err1 == nil {
-		defer kiwiPidFile.Close()
-		if pidStr, err2 := ioutil.ReadAll(kiwiPidFile); err2 == nil {
-			if pid, err3 := strconv.Atoi(string(pidStr)); err3 == nil {
-				if _, err4 := os.FindProcess(pid); err4 == nil {
-					return pid, errors.New(fmt.Sprintf("Error! Wiki server is now runing. Pid is %d", pid))
-				}
+/* Return the pid of the running server that wrote pidFile, and an error
+ * saying so. A missing pidfile, or one left by a process that is gone,
+ * means there is no such server. */
+func ServerExists(pidFile string) (int, error) {
+	if pidFile == "" {
+		return 0, nil
+	}
+	pidStr, err := ioutil.ReadFile(pidFile)
+	if err != nil {
+		return 0, nil
+	}
+	pid, err := strconv.Atoi(strings.TrimSpace(string(pidStr)))
+	if err != nil || pid <= 0 || pid == os.Getpid() {
+		return 0, nil
+	}
+	/* Signal 0 checks that the process exists without disturbing it. EPERM
+	 * means it exists but belongs to another user. */
+	if err := syscall.Kill(pid, 0); err != nil && err != syscall.EPERM {
+		return 0, nil
+	}
+	return pid, errors.New(fmt.Sprintf("Kiwi server is already running, pid %d in %s", pid, pidFile))
+}
+
+/* Write the pid of the server to the pidfile, unless another running server
+ * owns it. The pidfile stays locked with flock() while the server runs, so
+ * that of two servers started together only one can take it, and a pidfile
+ * left by a crash is reused. It is removed by CloseServer(). */
+func (s *Server) CreatePidFile() error {
+	if s.PidFile == "" {
+		return nil
+	}
+	for {
+		f, err := os.OpenFile(s.PidFile, os.O_RDWR|os.O_CREATE, 0644)
+		if err != nil {
+			return fmt.Errorf("Failed to open PID file %s: %v", s.PidFile, err)
+		}
+		if err := syscall.Flock(int(f.Fd()), syscall.LOCK_EX|syscall.LOCK_NB); err != nil {
+			f.Close()
+			if _, err := ServerExists(s.PidFile); err != nil {
+				return err
 			}
+			return fmt.Errorf("Kiwi server is already running, %s is locked", s.PidFile)
+		}
+		/* The owner may have removed the pidfile between our open() and
+		 * flock(): then the lock is on a file that's gone, try again. */
+		fi, err := f.Stat()
+		if cur, err2 := os.Stat(s.PidFile); err != nil || err2 != nil || !os.SameFile(fi, cur) {
+			f.Close()
+			continue
+		}
+		if err := f.Truncate(0); err == nil {
+			_, err = f.WriteString(fmt.Sprintf("%d\n", s.Pid))
 		}
+		if err != nil {
+			f.Close()
+			return fmt.Errorf("Failed to write PID file %s: %v", s.PidFile, err)
+		}
+		s.pidFile = f
+		return nil
 	}
-	return 0, nil
+}
+
+/* Remove the pidfile, if this server wrote it. It is unlinked before the
+ * lock is released, so that no other server can take it in between. */
+func (s *Server) RemovePidFile() {
+	if s.pidFile == nil {
+		return
+	}
+	if err := os.Remove(s.PidFile); err != nil && !os.IsNotExist(err) {
+		s.ServerLogWarnF("Failed to remove PID file %s: %v\n", s.PidFile, err)
+	}
+	s.pidFile.Close()
+	s.pidFile = nil
 }
 
 //func CreateServer() *Server {
@@ -204,19 +368,20 @@ func ServerExists() (int, error) {
 //	return nil
 //}
 
-func InitServer() {
-	// fmt.Println("CreateServer")
-	pidFile := os.TempDir() + "kiwi.pid"
-	unixSocketPath := os.TempDir() + "kiwi.sock"
+/* Create a server with the default configuration. Its config table is
+ * ready to be loaded, see NewServer(). */
+func newServer() *Server {
+	pidFile := filepath.Join(os.TempDir(), "kiwi.pid")
 	pid := os.Getpid()
-	fmt.Println("Pid", pid)
 
-	configPath, _ := filepath.Abs(filepath.Dir(os.Args[0]))
 	nowTime := time.Now()
-	kiwiS = &Server{
+	s := &Server{
 		Pid:                  pid,
+		RunId:                GetRandomHexChars(CONFIG_RUN_ID_SIZE),
 		PidFile:              pidFile,
-		ConfigFile:           configPath,
+		SupervisedMode:       SUPERVISED_NONE,
+		ShutdownTimeout:      CONFIG_DEFAULT_SHUTDOWN_TIMEOUT,
+		ConfigFile:           "",
 		ExecFile:             os.Args[0],
 		ExecArgv:             os.Args,
 		Hz:                   10,
@@ -224,20 +389,27 @@ func InitServer() {
 		DbNum:                DEFAULT_DB_NUM,
 		Commands:             make(map[string]*Command),
 		OrigCommands:         make(map[string]*Command),
+		StartTime:            nowTime,
 		UnixTime:             nowTime,
-		LruClock:             nowTime,
+		lruClock:             nowTime,
 		CronLoopCount:        0,
 		NextClientId:         0,
 		Port:                 9988,
-		BindAddrs:            []string{},
-		BindAddrCount:        0,
-		UnixSocketPath:       unixSocketPath,
+		BindAddrs:            []string{"0.0.0.0"},
+		BindAddrCount:        1,
+		TlsPort:              0,
+		TlsCluster:           false,
+		TlsAuthClients:       TLS_CLIENT_AUTH_YES,
+		TlsHandshakeTimeout:  event.DefaultTLSHandshakeTimeout,
+		UnixSocketPath:       "",
 		Clients:              nil,
 		ClientsMap:           make(map[int64]*KiwiClient),
-		ClientMaxQueryBufLen: PROTO_INLINE_MAX_SIZE,
+		ClientMaxQueryBufLen: PROTO_MAX_QUERYBUF_LEN,
 		MaxClients:           CONFIG_DEFAULT_MAX_CLIENTS,
 		ProtectedMode:        true,
 		RequirePassword:      nil,
+		AclFile:              "",
+		AclLogMaxLen:         CONFIG_DEFAULT_ACLLOG_MAX_LEN,
 		TcpKeepAlive:         true,
 		ProtoMaxBulkLen:      CONFIG_DEFAULT_PROTO_MAX_BULK_LEN,
 		ClientMaxIdleTime:    5 * time.Second,
@@ -247,71 +419,228 @@ func InitServer() {
 		StatNetOutputBytes: 0,
 		StatNetInputBytes:  0,
 		StatNumCommands:    0,
+		StatNumConnections: 0,
+		StatKeyspaceHits:   0,
+		StatKeyspaceMisses: 0,
+		ErrorStats:         make(map[string]int64),
+		SlowlogLogSlowerThan:           CONFIG_DEFAULT_SLOWLOG_LOG_SLOWER_THAN,
+		SlowlogMaxLen:                  CONFIG_DEFAULT_SLOWLOG_MAX_LEN,
+		LatencyMonitorThreshold:        CONFIG_DEFAULT_LATENCY_MONITOR_THRESHOLD,
+		LatencyTrackingEnabled:         true,
+		LatencyTrackingInfoPercentiles: []float64{50, 99, 99.9},
 		ConfigFlushAll:     false,
 		MaxMemory:          CONFIG_DEFAULT_MAXMEMORY,
+		MaxMemoryPolicy:    CONFIG_DEFAULT_MAXMEMORY_POLICY,
+		MaxMemorySamples:   CONFIG_DEFAULT_MAXMEMORY_SAMPLES,
+		LfuLogFactor:       CONFIG_DEFAULT_LFU_LOG_FACTOR,
+		LfuDecayTime:       CONFIG_DEFAULT_LFU_DECAY_TIME,
+		UsedMemory:         0,
+		StatExpiredKeys:    0,
+		StatEvictedKeys:    0,
 		Loading:            false,
-		LogLevel:           LL_DEBUG,
+		LogLevel:           CONFIG_DEFAULT_LOGLEVEL,
+		ClusterEnabled:             false,
+		ClusterConfigFile:          CLUSTER_DEFAULT_CONFIG_FILE,
+		ClusterNodeTimeout:         CLUSTER_DEFAULT_NODE_TIMEOUT * time.Millisecond,
+		ClusterRequireFullCoverage: true,
+		ClusterAnnounceIp:          "",
+		Cluster:                    nil,
 		CloseCh:            make(chan struct{}, 1),
 		mutex:              sync.RWMutex{},
 		wg:                 sync.WaitGroup{},
 		reusePort:          false,
 		numLoops:           -1,
-		eventServer:        nil,
-	}
-	for i := 0; i < kiwiS.DbNum; i++ {
-		kiwiS.Dbs[i] = CreateDb(i)
-	}
-	kiwiS.Clients = structure.ListCreate()
-	kiwiS.BindAddrs = append(kiwiS.BindAddrs, "0.0.0.0")
-	kiwiS.BindAddrCount++
-	CreateShared()
-	PopulateCommandTable()
-	kiwiS.events = CreateKiwiServerEvents()
-	//if pid, err1 := ServerExists(); err1 == nil {
-	//	pid = os.Getpid()
-	//	if kiwiPidFile, err2 := os.Create(pidFile); err2 == nil {
-	//		kiwiPidFile.WriteString(fmt.Sprintf("%d", pid))
-	//		kiwiPidFile.Close()
-	//	}
-	//
-	//} else {
-	//	// fmt.Println(err1)
-	//}
+		es:                 nil,
+	}
+	s.PopulateCommandTable()
+	s.ACLInit()
+	s.InitConfigTable()
+	return s
 }
 
-func StartServer() {
-	if kiwiS == nil {
-		return
+/* Create a server configured by 'config', the content of a config file:
+ * one directive per line, like "port 6380". Every server has its own
+ * keyspace, command table and shared objects, so that several servers
+ * can run in the same process. The server is not listening until
+ * Start() is called. */
+func NewServer(config string) (*Server, error) {
+	s := newServer()
+	if err := s.LoadServerConfigFromString(config, false); err != nil {
+		return nil, err
+	}
+	if err := s.initServer(); err != nil {
+		return nil, err
 	}
-	addrs := generateAddrs()
-	kiwiS.wg.Add(1)
-	go EventServe(kiwiS.events, addrs...)
-	go SignalHandle()
+	return s, nil
 }
 
+/* Create a server from its command line, see ParseCommandLineConfig():
+ * an optional config file followed by "--name value" options overriding
+ * it. */
+func NewServerFromArgs(args []string) (*Server, error) {
+	s := newServer()
+	configfile, options := ParseCommandLineConfig(args)
+	if configfile != "" && configfile != "-" {
+		s.ConfigFile, _ = filepath.Abs(configfile)
+	}
+	s.ConfigOptions = options
+	if err := s.LoadServerConfig(configfile, options, false); err != nil {
+		return nil, err
+	}
+	if err := s.initServer(); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
 
-func generateAddrs() (addrs []string) {
+/* Initialize the server once its configuration is loaded. */
+func (s *Server) initServer() error {
+	if s.TlsEnabled() {
+		if err := s.TlsConfigure(); err != nil {
+			return fmt.Errorf("Failed to configure TLS: %v", err)
+		}
+	}
+	s.partitions = s.CreatePartitions()
+	for i := 0; i < s.DbNum; i++ {
+		s.Dbs[i] = s.CreateDb(i)
+	}
+	s.Clients = structure.ListCreate()
+	s.CreateShared()
+	s.ACLLoadUsersAtStartup()
+	s.ServerIsSupervised()
+	s.SlowlogInit()
+	s.LatencyMonitorInit()
+	if s.ClusterEnabled {
+		s.ClusterInit()
+	}
+	s.events = s.CreateKiwiServerEvents()
+	ms := runtime.MemStats{}
+	runtime.ReadMemStats(&ms)
+	s.InitialMemoryUsage = ms.HeapAlloc
+	return nil
+}
+
+/* Start listening and serving the clients, in the background. */
+func (s *Server) Start() error {
+	if err := s.ClusterStart(); err != nil {
+		return err
+	}
+	es, err := event.CreateEventServer(s.events, s.generateAddrs()...)
+	if err != nil {
+		s.closeClusterBus()
+		return err
+	}
+	s.es = es
+	s.lockWaits = make([]int64, es.NumLoops)
+	go event.Serve(es)
+	s.serverSupervisedReady()
+	return nil
+}
+
+/* Stop the server: the listeners and the connections are closed. Shutdown
+ * waits for the event loops to return, unless ctx is done first. See
+ * PrepareForShutdown() for the graceful shutdown of SHUTDOWN. */
+func (s *Server) Shutdown(ctx context.Context) error {
+	s.closeListenersAndClients(0)
+	if s.es == nil {
+		return nil
+	}
+	select {
+	case <-s.es.Done():
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+/* Return the address of the first listener, nil if the server is not
+ * started. */
+func (s *Server) Addr() net.Addr {
+	if s.es == nil || len(s.es.Addrs) == 0 {
+		return nil
+	}
+	return s.es.Addrs[0]
+}
+
+/* Wait until the server is closed. */
+func (s *Server) Wait() {
+	if s.es != nil {
+		<-s.es.Done()
+	}
+}
+
+
+func (s *Server) generateAddrs() (addrs []string) {
 	addrs = []string{}
-	for _, addr := range kiwiS.BindAddrs {
-		addrs = append(addrs, fmt.Sprintf("%s://%s:%d?reuseport=%t", "tcp", addr, kiwiS.Port, kiwiS.reusePort))
+	if s.UnixSocketPath != "" {
+		addrs = append(addrs, "unix://"+s.UnixSocketPath)
+	}
+	for _, addr := range s.BindAddrs {
+		// Port 0 disables the plaintext listeners.
+		if s.Port != 0 {
+			addrs = append(addrs, fmt.Sprintf("%s://%s:%d?reuseport=%t", "tcp", addr, s.Port, s.reusePort))
+		}
+		if s.TlsPort != 0 {
+			addrs = append(addrs, fmt.Sprintf("%s://%s:%d?reuseport=%t", "tls", addr, s.TlsPort, s.reusePort))
+		}
 	}
 	return addrs
 }
 
-func SignalHandle() {
+/* Handle the signals until the server is closed: SIGHUP reloads the
+ * config file, SIGINT and SIGTERM schedule a shutdown, performed by
+ * serverCron() as SHUTDOWN would. */
+func (s *Server) SignalHandle() {
 	c := make(chan os.Signal, 1)
-	signal.Notify(c, syscall.SIGINT, syscall.SIGTERM)
-	<-c
-	fmt.Println("signalShutdown")
-	kiwiS.eventServer.signalShutdown()
-}
-
-func WaitEventServerClosed() {
-	kiwiS.wg.Wait()
+	signal.Notify(c, syscall.SIGINT, syscall.SIGTERM, syscall.SIGHUP)
+	defer signal.Stop(c)
+	var done <-chan struct{}
+	if s.es != nil {
+		done = s.es.Done()
+	}
+	for {
+		var sig os.Signal
+		select {
+		case sig = <-c:
+		case <-done:
+			return
+		}
+		if sig == syscall.SIGHUP {
+			s.ServerLogNoticeF("Received SIGHUP, reloading the config file.\n")
+			if s.es != nil {
+				s.es.Post(CRON_LOOP, s.ReloadServerConfig)
+			} else {
+				s.ReloadServerConfig()
+			}
+			continue
+		}
+		msg := "Received SIGTERM scheduling shutdown..."
+		if sig == syscall.SIGINT {
+			msg = "Received SIGINT scheduling shutdown..."
+		}
+		/* SIGINT is often delivered via Ctrl+C in an interactive session.
+		 * If we receive the signal the second time, we interpret this as
+		 * the user really wanting to quit ASAP without waiting to drain
+		 * the clients. */
+		if sig == syscall.SIGINT && (atomic.LoadInt32(&s.shutdownAsap) == 1 ||
+			atomic.LoadInt32(&s.shutdownRequested) == 1) {
+			s.ServerLogWarnF("You insist... exiting now.\n")
+			s.RemovePidFile()
+			os.Exit(1)
+		}
+		s.ServerLogNoticeF("%s\n", msg)
+		atomic.StoreInt32(&s.shutdownAsap, 1)
+	}
 }
 
-func CloseServer() {
-	fmt.Println("CloseServer")
-	//defer os.Remove(kiwiS.UnixSocketPath)
-	//defer os.Remove(kiwiS.PidFile)
+/* Release what the server holds outside of the process once it is
+ * stopped: the pidfile, the unix socket being removed with its listener.
+ * It returns an error if the server stopped without being asked to. */
+func (s *Server) CloseServer() error {
+	s.RemovePidFile()
+	if atomic.LoadInt32(&s.shutdownRequested) == 0 {
+		return errors.New("The server stopped unexpectedly")
+	}
+	s.ServerLogNoticeF("Kiwi is now ready to exit, bye bye...\n")
+	return nil
 }
@@ -1,7 +1,7 @@
 package server
 
 import (
-	"fmt"
+	"github.com/zhaotong0312/kiwi/resp"
 )
 
 type Shared struct {
@@ -20,13 +20,22 @@ type Shared struct {
 	LoadingErr     string // "-LOADING Redis is loading the dataset in memory\r\n"
 	SyntaxErr      string // "-ERR syntax error\r\n"
 	WrongTypeErr   string // "-WRONGTYPE Operation against a key holding the wrong kind of value\r\n"
+	ExecAbortErr   string // "-EXECABORT Transaction discarded because of previous errors.\r\n"
+	Queued         string // "+QUEUED\r\n"
+	Pong           string // "+PONG\r\n"
 	Integers       [SHARED_INTEGERS]*StrObject
 	MultiBulkHDR   [SHARED_BULKHDR_LEN]string // "*<value>\r\n"
 	BulkHDR        [SHARED_BULKHDR_LEN]string // "$<value>\r\n"
+	/* Replies that depend on the protocol of the client, indexed by
+	 * the protocol version: Null[c.Resp]. */
+	Null      [4]string // "$-1\r\n" or "_\r\n"
+	NullArray [4]string // "*-1\r\n" or "_\r\n"
+	EmptyMap  [4]string // "*0\r\n" or "%0\r\n"
+	EmptySet  [4]string // "*0\r\n" or "~0\r\n"
 }
 
-func CreateShared() *Shared {
-	kiwiS.ServerLogDebugF("-->%v\n", "CreateShared")
+func (s *Server) CreateShared() *Shared {
+	s.ServerLogDebugF("-->%v\n", "CreateShared")
 
 	so := Shared{
 		Crlf:           "\r\n",
@@ -44,23 +53,30 @@ func CreateShared() *Shared {
 		LoadingErr:     "-LOADING Redis is loading the dataset in memory\r\n",
 		SyntaxErr:      "-ERR syntax error\r\n",
 		WrongTypeErr:   "-WRONGTYPE Operation against a key holding the wrong kind of value\r\n",
+		ExecAbortErr:   "-EXECABORT Transaction discarded because of previous errors.\r\n",
+		Queued:         "+QUEUED\r\n",
+		Pong:           "+PONG\r\n",
 		Integers:       [SHARED_INTEGERS]*StrObject{},
 		MultiBulkHDR:   [SHARED_BULKHDR_LEN]string{}, // "*<value>\r\n"
 		BulkHDR:        [SHARED_BULKHDR_LEN]string{}, // "$<value>\r\n"
+		Null:           [4]string{"", "", "$-1\r\n", "_\r\n"},
+		NullArray:      [4]string{"", "", "*-1\r\n", "_\r\n"},
+		EmptyMap:       [4]string{"", "", "*0\r\n", "%0\r\n"},
+		EmptySet:       [4]string{"", "", "*0\r\n", "~0\r\n"},
 	}
 	for i := 0; i < SHARED_INTEGERS; i++ {
 		v := i
 		so.Integers[i] = &StrObject{
-			CreateObject(OBJ_RTYPE_STR, OBJ_ENCODING_INT),
+			s.CreateObject(OBJ_RTYPE_STR, OBJ_ENCODING_INT),
 			&v,
 		}
 	}
 	for i := 0; i < SHARED_BULKHDR_LEN; i++ {
-		so.MultiBulkHDR[i] = fmt.Sprintf("*%d\r\n", i)
+		so.MultiBulkHDR[i] = string(resp.AppendArrayLen(nil, i))
 	}
 	for i := 0; i < SHARED_BULKHDR_LEN; i++ {
-		so.BulkHDR[i] = fmt.Sprintf("$%d\r\n", i)
+		so.BulkHDR[i] = string(resp.AppendHeader(nil, resp.BulkString, int64(i)))
 	}
-	kiwiS.Shared = &so
-	return kiwiS.Shared
+	s.Shared = &so
+	return s.Shared
 }
@@ -0,0 +1,136 @@
+package server
+
+import (
+	"errors"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+/*-----------------------------------------------------------------------------
+ * Shutdown
+ *
+ * SHUTDOWN, SIGTERM and SIGINT stop the server gracefully: the listeners
+ * stop accepting connections and the clients stop being read, while the
+ * commands already received complete and their replies are written, up to
+ * shutdown-timeout seconds. Then the clients are closed, and Wait()
+ * returns: CloseServer() removes the pidfile.
+ *----------------------------------------------------------------------------*/
+
+/* The dataset is only kept in memory: there is nothing to save, and a
+ * SAVE can't be honored. */
+var errNoPersistence = errors.New("there is no persistence, the DB can't be saved")
+
+/* Save the dataset before exiting, if required by the flags or by the save
+ * points of the configuration. */
+func (s *Server) saveOnShutdown(flags int) error {
+	if flags&SHUTDOWN_SAVE != 0 {
+		return errNoPersistence
+	}
+	return nil
+}
+
+/* Prepare the server to exit, and begin closing it. C_ERR is returned,
+ * and the server keeps running, if an error prevents the shutdown, like
+ * a failed SAVE. SHUTDOWN_FORCE ignores those errors. */
+func (s *Server) PrepareForShutdown(flags int) int {
+	s.ServerLogWarnF("User requested shutdown...\n")
+	if flags&SHUTDOWN_NOSAVE == 0 {
+		if err := s.saveOnShutdown(flags); err != nil {
+			if flags&SHUTDOWN_FORCE == 0 {
+				s.ServerLogWarnF("Error trying to save the DB, can't exit: %v\n", err)
+				return C_ERR
+			}
+			s.ServerLogWarnF("Error trying to save the DB. Exit anyway: %v\n", err)
+		}
+	}
+	/* NOW doesn't wait for the clients to read their replies. */
+	drain := time.Duration(s.ShutdownTimeout) * time.Second
+	if flags&SHUTDOWN_NOW != 0 {
+		drain = 0
+	}
+	s.closeListenersAndClients(drain)
+	return C_OK
+}
+
+/* Cancel a shutdown scheduled by a signal, that serverCron() didn't start
+ * yet. Once started, a shutdown can't be aborted. */
+func (s *Server) AbortShutdown() int {
+	if !atomic.CompareAndSwapInt32(&s.shutdownAsap, 1, 0) {
+		return C_ERR
+	}
+	s.ServerLogWarnF("Shutdown manually aborted.\n")
+	return C_OK
+}
+
+/* Stop accepting connections and close the clients, once they drained
+ * their replies if drain is not zero. The event loops return once they
+ * are done, see Wait(). */
+func (s *Server) closeListenersAndClients(drain time.Duration) {
+	s.shutdownOnce.Do(func() {
+		atomic.StoreInt32(&s.shutdownRequested, 1)
+		s.serverSupervisedStopping()
+		close(s.CloseCh)
+		s.closeClusterBus()
+		if s.es == nil {
+			return
+		}
+		if drain > 0 {
+			s.es.GracefulShutdown(drain)
+		} else {
+			s.es.Shutdown()
+		}
+	})
+}
+
+/* Return true if the client has a command in progress, whose reply is
+ * yet to be queued: it is executed by another event loop, or resumed. */
+func clientIsBusy(c *KiwiClient) bool {
+	if c.WithFlags(CLIENT_UNBLOCKED) {
+		return true
+	}
+	return c.WithFlags(CLIENT_BLOCKED) && c.Btype == BLOCKED_PARTITION
+}
+
+/* SHUTDOWN [NOSAVE|SAVE] [NOW] [FORCE] [ABORT] */
+var ShutdownCommand CommandProcess = func(c *KiwiClient) {
+	flags := SHUTDOWN_NOFLAGS
+	abort := false
+	for j := 1; j < c.Argc; j++ {
+		switch strings.ToLower(c.Argv[j]) {
+		case "nosave":
+			flags |= SHUTDOWN_NOSAVE
+		case "save":
+			flags |= SHUTDOWN_SAVE
+		case "now":
+			flags |= SHUTDOWN_NOW
+		case "force":
+			flags |= SHUTDOWN_FORCE
+		case "abort":
+			abort = true
+		default:
+			AddReplyErrorObject(c, c.srv.Shared.SyntaxErr)
+			return
+		}
+	}
+	if (abort && flags != SHUTDOWN_NOFLAGS) ||
+		(flags&SHUTDOWN_NOSAVE != 0 && flags&SHUTDOWN_SAVE != 0) {
+		/* Illegal combo. */
+		AddReplyErrorObject(c, c.srv.Shared.SyntaxErr)
+		return
+	}
+
+	if abort {
+		if c.srv.AbortShutdown() == C_OK {
+			AddReply(c, c.srv.Shared.Ok)
+		} else {
+			AddReplyError(c, "No shutdown in progress.")
+		}
+		return
+	}
+
+	/* On success there is no reply: the client is closed with the others. */
+	if c.srv.PrepareForShutdown(flags) == C_ERR {
+		AddReplyError(c, "Errors trying to SHUTDOWN. Check logs.")
+	}
+}
@@ -0,0 +1,156 @@
+package server
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/zhaotong0312/kiwi/structure"
+)
+
+/* Slowlog implements a system that is able to remember the latest N
+ * queries that took more than M microseconds to execute.
+ *
+ * The execution time to reach to be logged in the slow log is set
+ * using the 'slowlog-log-slower-than' config directive, that is also
+ * readable and writable using the CONFIG SET/GET command.
+ *
+ * The slow queries log is actually not "logged" in the Kiwi log file
+ * but is accessible thanks to the SLOWLOG command. */
+
+/* This structure defines an entry inside the slow log list */
+type SlowlogEntry struct {
+	Argv       []string
+	Id         int64     // Unique entry identifier.
+	Duration   int64     // Time spent by the query, in microseconds.
+	Time       time.Time // Unix time at which the query was executed.
+	PeerId     string    // Client network address.
+	ClientName string    // Client name.
+}
+
+type Slowlog struct {
+	entries *structure.List // Newest entries on the left
+	entryId int64
+	mutex   sync.Mutex
+}
+
+/* Create a new slowlog entry. */
+func SlowlogCreateEntry(c *KiwiClient, argv []string, argc int, duration int64) *SlowlogEntry {
+	slargc := argc
+	if slargc > SLOWLOG_ENTRY_MAX_ARGC {
+		slargc = SLOWLOG_ENTRY_MAX_ARGC
+	}
+	se := &SlowlogEntry{
+		Argv:       make([]string, slargc),
+		Duration:   duration,
+		Time:       time.Now(),
+		PeerId:     c.GetPeerId(c.srv),
+		ClientName: c.Name,
+	}
+	for j := 0; j < slargc; j++ {
+		// Logging too many arguments is a useless memory waste, so we stop
+		// at SLOWLOG_ENTRY_MAX_ARGC, but use the last argument to specify
+		// how many remaining arguments there were in the original command.
+		if slargc != argc && j == slargc-1 {
+			se.Argv[j] = fmt.Sprintf("... (%d more arguments)", argc-slargc+1)
+		} else if len(argv[j]) > SLOWLOG_ENTRY_MAX_STRING {
+			// Trim too long strings as well...
+			se.Argv[j] = fmt.Sprintf("%s... (%d more bytes)", argv[j][:SLOWLOG_ENTRY_MAX_STRING],
+				len(argv[j])-SLOWLOG_ENTRY_MAX_STRING)
+		} else {
+			se.Argv[j] = argv[j]
+		}
+	}
+	return se
+}
+
+/* Initialize the slow log. This function should be called a single time
+ * at server startup. */
+func (s *Server) SlowlogInit() {
+	s.slowlog.entries = structure.ListCreate()
+	s.slowlog.entryId = 0
+}
+
+/* Push a new entry into the slow log.
+ * This function will make sure to trim the slow log accordingly to the
+ * configured max length. */
+func SlowlogPushEntryIfNeeded(c *KiwiClient, argv []string, argc int, duration int64) {
+	if c.srv.SlowlogLogSlowerThan < 0 {
+		return // Slowlog disabled
+	}
+	if duration < c.srv.SlowlogLogSlowerThan {
+		return
+	}
+	se := SlowlogCreateEntry(c, argv, argc, duration)
+	c.srv.slowlog.mutex.Lock()
+	defer c.srv.slowlog.mutex.Unlock()
+	se.Id = c.srv.slowlog.entryId
+	c.srv.slowlog.entryId++
+	c.srv.slowlog.entries.LeftAppend(se)
+
+	// Remove old entries if needed.
+	for int(c.srv.slowlog.entries.Len()) > c.srv.SlowlogMaxLen {
+		c.srv.slowlog.entries.Pop()
+	}
+}
+
+/* Remove all the entries from the current slow log. */
+func (s *Server) SlowlogReset() {
+	s.slowlog.mutex.Lock()
+	defer s.slowlog.mutex.Unlock()
+	s.slowlog.entries.Clear()
+}
+
+/* The SLOWLOG command. Implements all the subcommands needed to handle the
+ * slow log. */
+var SlowlogCommand CommandProcess = func(c *KiwiClient) {
+	sub := strings.ToLower(c.Argv[1])
+	if c.Argc == 2 && sub == "help" {
+		AddReplyHelp(c, []string{
+			"GET [count] -- Return top entries from the slowlog (default: 10). Entries are made of:",
+			"    id, timestamp, time in microseconds, arguments array, client IP and port, client name",
+			"LEN -- Return the length of the slowlog.",
+			"RESET -- Reset the slowlog.",
+		})
+	} else if c.Argc == 2 && sub == "reset" {
+		c.srv.SlowlogReset()
+		AddReply(c, c.srv.Shared.Ok)
+	} else if c.Argc == 2 && sub == "len" {
+		AddReplyInt(c, int(c.srv.slowlog.entries.Len()))
+	} else if (c.Argc == 2 || c.Argc == 3) && sub == "get" {
+		count := 10
+		if c.Argc == 3 {
+			n, err := strconv.Atoi(c.Argv[2])
+			if err != nil || n < 0 {
+				AddReplyError(c, "value is out of range, must be positive")
+				return
+			}
+			count = n
+		}
+		c.srv.slowlog.mutex.Lock()
+		entries := []*SlowlogEntry{}
+		iter := c.srv.slowlog.entries.Iterator(structure.ITERATION_DIRECTION_INORDER)
+		for node := iter.Next(); iter.HasNext() && len(entries) < count; node = iter.Next() {
+			entries = append(entries, node.Value.(*SlowlogEntry))
+		}
+		c.srv.slowlog.mutex.Unlock()
+
+		AddReplyMultiBulkLen(c, len(entries))
+		for _, se := range entries {
+			AddReplyMultiBulkLen(c, 6)
+			AddReplyInt(c, int(se.Id))
+			AddReplyInt(c, int(se.Time.Unix()))
+			AddReplyInt(c, int(se.Duration))
+			AddReplyMultiBulkLen(c, len(se.Argv))
+			for _, arg := range se.Argv {
+				AddReplyBulkStr(c, arg)
+			}
+			AddReplyBulkStr(c, se.PeerId)
+			AddReplyBulkStr(c, se.ClientName)
+		}
+	} else {
+		AddReplySubcommandSyntaxError(c)
+	}
+}
@@ -1 +1,461 @@
 package server
+
+import (
+	"fmt"
+	"os"
+	"runtime"
+	"sort"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"syscall"
+	"time"
+)
+
+/* ======================= Instantaneous metrics ============================
+ *
+ * Add a sample to the operations per second array of samples, the samples
+ * are taken by the cron and used to report the instantaneous ops/sec and
+ * the network kbps in INFO stats. */
+
+type InstMetric struct {
+	lastSampleTime  time.Time // Timestamp of last sample
+	lastSampleCount int64     // Count in last sample
+	samples         [STATS_METRIC_SAMPLES]int64
+	idx             int
+}
+
+func (s *Server) TrackInstantaneousMetric(metric int, currentReading int64) {
+	m := &s.instMetric[metric]
+	now := time.Now()
+	if !m.lastSampleTime.IsZero() {
+		t := now.Sub(m.lastSampleTime)
+		ops := currentReading - m.lastSampleCount
+		var opsSec int64
+		if t > 0 {
+			opsSec = ops * int64(time.Second) / int64(t)
+		}
+		m.samples[m.idx] = opsSec
+		m.idx = (m.idx + 1) % STATS_METRIC_SAMPLES
+	}
+	m.lastSampleTime = now
+	m.lastSampleCount = currentReading
+}
+
+/* Return the mean of all the samples. */
+func (s *Server) GetInstantaneousMetric(metric int) int64 {
+	s.statMutex.Lock()
+	defer s.statMutex.Unlock()
+	var sum int64
+	for _, sample := range s.instMetric[metric].samples {
+		sum += sample
+	}
+	return sum / STATS_METRIC_SAMPLES
+}
+
+/* Called by the cron to sample the metrics. */
+func (s *Server) TrackInstantaneousMetrics() {
+	s.statMutex.Lock()
+	defer s.statMutex.Unlock()
+	s.TrackInstantaneousMetric(STATS_METRIC_COMMAND, atomic.LoadInt64(&s.StatNumCommands))
+	s.TrackInstantaneousMetric(STATS_METRIC_NET_INPUT, atomic.LoadInt64(&s.StatNetInputBytes))
+	s.TrackInstantaneousMetric(STATS_METRIC_NET_OUTPUT, atomic.LoadInt64(&s.StatNetOutputBytes))
+}
+
+/* ============================ Error stats ================================= */
+
+/* Increment the count of the error code. To avoid unbounded memory usage
+ * only ERROR_STATS_LIMIT different codes are tracked, the total count is
+ * always updated. */
+func (s *Server) IncrementErrorCount(code string) {
+	atomic.AddInt64(&s.StatTotalErrorReplies, 1)
+	s.statMutex.Lock()
+	defer s.statMutex.Unlock()
+	if _, ok := s.ErrorStats[code]; !ok && len(s.ErrorStats) >= ERROR_STATS_LIMIT {
+		return
+	}
+	s.ErrorStats[code]++
+}
+
+func (s *Server) ResetErrorTableStats() {
+	s.statMutex.Lock()
+	s.ErrorStats = make(map[string]int64)
+	s.statMutex.Unlock()
+	atomic.StoreInt64(&s.StatTotalErrorReplies, 0)
+}
+
+/* Resets the stats that we expose via INFO or other means that we want
+ * to reset via CONFIG RESETSTAT. */
+func (s *Server) ResetCommandTableStats() {
+	for _, cmd := range s.Commands {
+		atomic.StoreInt64(&cmd.Microseconds, 0)
+		atomic.StoreInt64(&cmd.Calls, 0)
+		atomic.StoreInt64(&cmd.RejectedCalls, 0)
+		atomic.StoreInt64(&cmd.FailedCalls, 0)
+		cmd.LatencyHistogram.Reset()
+	}
+}
+
+func (s *Server) ResetServerStats() {
+	atomic.StoreInt64(&s.StatNumCommands, 0)
+	atomic.StoreInt64(&s.StatNumConnections, 0)
+	atomic.StoreInt64(&s.StatExpiredKeys, 0)
+	atomic.StoreInt64(&s.StatEvictedKeys, 0)
+	atomic.StoreInt64(&s.StatEvictedClients, 0)
+	atomic.StoreInt64(&s.StatKeyspaceHits, 0)
+	atomic.StoreInt64(&s.StatKeyspaceMisses, 0)
+	atomic.StoreInt64(&s.StatRejectedConn, 0)
+	atomic.StoreInt64(&s.StatClientQbufLimitDisconnections, 0)
+	atomic.StoreInt64(&s.StatNetInputBytes, 0)
+	atomic.StoreInt64(&s.StatNetOutputBytes, 0)
+	atomic.StoreUint64(&s.StatPeakMemory, 0)
+	s.statMutex.Lock()
+	s.instMetric = [STATS_METRIC_COUNT]InstMetric{}
+	s.statMutex.Unlock()
+	s.ResetErrorTableStats()
+	s.ResetCommandTableStats()
+}
+
+/* ================================ INFO ==================================== */
+
+/* Convert an amount of bytes into a human readable string in the form
+ * of 100B, 2G, 100M, 4K, and so forth. */
+func BytesToHuman(n uint64) string {
+	d := float64(n)
+	switch {
+	case n < 1024:
+		return fmt.Sprintf("%dB", n)
+	case n < 1024*1024:
+		return fmt.Sprintf("%.2fK", d/1024)
+	case n < 1024*1024*1024:
+		return fmt.Sprintf("%.2fM", d/(1024*1024))
+	case n < 1024*1024*1024*1024:
+		return fmt.Sprintf("%.2fG", d/(1024*1024*1024))
+	default:
+		return fmt.Sprintf("%.2fT", d/(1024*1024*1024*1024))
+	}
+}
+
+var infoDefaultSections = []string{"server", "clients", "memory", "persistence", "stats", "cpu", "errorstats", "cluster", "keyspace"}
+var infoAllSections = []string{"server", "clients", "memory", "persistence", "stats", "cpu", "commandstats", "errorstats", "latencystats", "cluster", "keyspace"}
+
+/* Create the string returned by the INFO command. This is decoupled
+ * by the INFO command itself as we need to report the same information
+ * on memory corruption problems. */
+func (s *Server) GenKiwiInfoString(sections []string) string {
+	want := make(map[string]bool)
+	if len(sections) == 0 {
+		sections = []string{"default"}
+	}
+	for _, section := range sections {
+		switch section = strings.ToLower(section); section {
+		case "default":
+			for _, s := range infoDefaultSections {
+				want[s] = true
+			}
+		case "all", "everything":
+			for _, s := range infoAllSections {
+				want[s] = true
+			}
+		default:
+			want[section] = true
+		}
+	}
+
+	info := strings.Builder{}
+	sep := func() {
+		if info.Len() > 0 {
+			info.WriteString("\r\n")
+		}
+	}
+	now := time.Now()
+
+	// Server
+	if want["server"] {
+		uptime := int64(now.Sub(s.StartTime) / time.Second)
+		sep()
+		fmt.Fprintf(&info, "# Server\r\n"+
+			"kiwi_version:%s\r\n"+
+			"go_version:%s\r\n"+
+			"os:%s %s\r\n"+
+			"arch_bits:%d\r\n"+
+			"multiplexing_api:epoll\r\n"+
+			"process_id:%d\r\n"+
+			"run_id:%s\r\n"+
+			"tcp_port:%d\r\n"+
+			"uptime_in_seconds:%d\r\n"+
+			"uptime_in_days:%d\r\n"+
+			"hz:%d\r\n"+
+			"event_loops:%d\r\n"+
+			"executable:%s\r\n"+
+			"config_file:%s\r\n",
+			KIWI_VERSION,
+			runtime.Version(),
+			runtime.GOOS, runtime.GOARCH,
+			32<<(^uint(0)>>63),
+			os.Getpid(),
+			s.RunId,
+			s.Port,
+			uptime,
+			uptime/(3600*24),
+			s.Hz,
+			s.numLoops,
+			s.ExecFile,
+			s.ConfigFile)
+	}
+
+	// Clients
+	if want["clients"] {
+		var maxIn, maxOut int64
+		s.mutex.RLock()
+		for _, c := range s.ClientsMap {
+			// The buffers of the clients of the other loops can't be
+			// accessed, see PublishBufferSizes().
+			qbuf, qbufFree, _, omem := c.BufferSizes()
+			if qbuf+qbufFree > maxIn {
+				maxIn = qbuf + qbufFree
+			}
+			if omem > maxOut {
+				maxOut = omem
+			}
+		}
+		s.mutex.RUnlock()
+		sep()
+		fmt.Fprintf(&info, "# Clients\r\n"+
+			"connected_clients:%d\r\n"+
+			"maxclients:%d\r\n"+
+			"client_recent_max_input_buffer:%d\r\n"+
+			"client_recent_max_output_buffer:%d\r\n"+
+			"blocked_clients:%d\r\n",
+			atomic.LoadInt64(&s.StatConnCount),
+			s.MaxClients,
+			maxIn,
+			maxOut,
+			s.BlockedClientsCount())
+	}
+
+	// Memory
+	if want["memory"] {
+		mh := s.GetMemoryOverheadData()
+		sep()
+		fmt.Fprintf(&info, "# Memory\r\n"+
+			"used_memory:%d\r\n"+
+			"used_memory_human:%s\r\n"+
+			"used_memory_rss:%d\r\n"+
+			"used_memory_rss_human:%s\r\n"+
+			"used_memory_peak:%d\r\n"+
+			"used_memory_peak_human:%s\r\n"+
+			"used_memory_peak_perc:%.2f%%\r\n"+
+			"used_memory_overhead:%d\r\n"+
+			"used_memory_startup:%d\r\n"+
+			"used_memory_dataset:%d\r\n"+
+			"used_memory_dataset_perc:%.2f%%\r\n"+
+			"used_memory_keyspace:%d\r\n"+
+			"used_memory_keyspace_human:%s\r\n"+
+			"maxmemory:%d\r\n"+
+			"maxmemory_human:%s\r\n"+
+			"maxmemory_policy:%s\r\n"+
+			"mem_fragmentation_ratio:%.2f\r\n"+
+			"mem_clients_normal:%d\r\n"+
+			"gc_heap_sys:%d\r\n"+
+			"gc_heap_inuse:%d\r\n"+
+			"gc_count:%d\r\n"+
+			"gc_pause_total_ms:%d\r\n",
+			mh.TotalAllocated,
+			BytesToHuman(mh.TotalAllocated),
+			mh.Resident,
+			BytesToHuman(mh.Resident),
+			mh.PeakAllocated,
+			BytesToHuman(mh.PeakAllocated),
+			mh.PeakPerc,
+			mh.OverheadTotal,
+			mh.StartupAllocated,
+			mh.Dataset,
+			mh.DatasetPerc,
+			mh.Keyspace,
+			BytesToHuman(uint64(mh.Keyspace)),
+			s.MaxMemory,
+			BytesToHuman(uint64(s.MaxMemory)),
+			GetMaxMemoryPolicyName(s.MaxMemoryPolicy),
+			mh.Fragmentation,
+			mh.ClientsNormal,
+			mh.HeapSys,
+			mh.HeapInuse,
+			mh.NumGC,
+			mh.PauseTotalNs/1000000)
+	}
+
+	// Persistence, there is no RDB or AOF yet: only the changes are tracked.
+	if want["persistence"] {
+		loading := 0
+		if s.Loading {
+			loading = 1
+		}
+		sep()
+		fmt.Fprintf(&info, "# Persistence\r\n"+
+			"loading:%d\r\n"+
+			"rdb_changes_since_last_save:%d\r\n"+
+			"rdb_bgsave_in_progress:0\r\n"+
+			"aof_enabled:0\r\n",
+			loading,
+			atomic.LoadInt64(&s.Dirty))
+	}
+
+	// Stats
+	if want["stats"] {
+		sep()
+		fmt.Fprintf(&info, "# Stats\r\n"+
+			"total_connections_received:%d\r\n"+
+			"total_commands_processed:%d\r\n"+
+			"instantaneous_ops_per_sec:%d\r\n"+
+			"total_net_input_bytes:%d\r\n"+
+			"total_net_output_bytes:%d\r\n"+
+			"instantaneous_input_kbps:%.2f\r\n"+
+			"instantaneous_output_kbps:%.2f\r\n"+
+			"rejected_connections:%d\r\n"+
+			"expired_keys:%d\r\n"+
+			"evicted_keys:%d\r\n"+
+			"evicted_clients:%d\r\n"+
+			"keyspace_hits:%d\r\n"+
+			"keyspace_misses:%d\r\n"+
+			"total_error_replies:%d\r\n"+
+			"client_query_buffer_limit_disconnections:%d\r\n",
+			atomic.LoadInt64(&s.StatNumConnections),
+			atomic.LoadInt64(&s.StatNumCommands),
+			s.GetInstantaneousMetric(STATS_METRIC_COMMAND),
+			atomic.LoadInt64(&s.StatNetInputBytes),
+			atomic.LoadInt64(&s.StatNetOutputBytes),
+			float64(s.GetInstantaneousMetric(STATS_METRIC_NET_INPUT))/1024,
+			float64(s.GetInstantaneousMetric(STATS_METRIC_NET_OUTPUT))/1024,
+			atomic.LoadInt64(&s.StatRejectedConn),
+			atomic.LoadInt64(&s.StatExpiredKeys),
+			atomic.LoadInt64(&s.StatEvictedKeys),
+			atomic.LoadInt64(&s.StatEvictedClients),
+			atomic.LoadInt64(&s.StatKeyspaceHits),
+			atomic.LoadInt64(&s.StatKeyspaceMisses),
+			atomic.LoadInt64(&s.StatTotalErrorReplies),
+			atomic.LoadInt64(&s.StatClientQbufLimitDisconnections))
+	}
+
+	// CPU
+	if want["cpu"] {
+		self := syscall.Rusage{}
+		syscall.Getrusage(syscall.RUSAGE_SELF, &self)
+		sep()
+		fmt.Fprintf(&info, "# CPU\r\n"+
+			"used_cpu_sys:%d.%06d\r\n"+
+			"used_cpu_user:%d.%06d\r\n"+
+			"goroutines:%d\r\n",
+			self.Stime.Sec, self.Stime.Usec,
+			self.Utime.Sec, self.Utime.Usec,
+			runtime.NumGoroutine())
+	}
+
+	// Command statistics
+	if want["commandstats"] {
+		sep()
+		info.WriteString("# Commandstats\r\n")
+		for _, cmd := range s.sortedCommands() {
+			calls := atomic.LoadInt64(&cmd.Calls)
+			rejected := atomic.LoadInt64(&cmd.RejectedCalls)
+			failed := atomic.LoadInt64(&cmd.FailedCalls)
+			if calls == 0 && rejected == 0 && failed == 0 {
+				continue
+			}
+			usec := atomic.LoadInt64(&cmd.Microseconds)
+			usecPerCall := 0.0
+			if calls > 0 {
+				usecPerCall = float64(usec) / float64(calls)
+			}
+			fmt.Fprintf(&info, "cmdstat_%s:calls=%d,usec=%d,usec_per_call=%.2f,rejected_calls=%d,failed_calls=%d\r\n",
+				cmd.Name, calls, usec, usecPerCall, rejected, failed)
+		}
+	}
+
+	// Error statistics
+	if want["errorstats"] {
+		sep()
+		info.WriteString("# Errorstats\r\n")
+		s.statMutex.Lock()
+		codes := make([]string, 0, len(s.ErrorStats))
+		for code := range s.ErrorStats {
+			codes = append(codes, code)
+		}
+		sort.Strings(codes)
+		for _, code := range codes {
+			fmt.Fprintf(&info, "errorstat_%s:count=%d\r\n", code, s.ErrorStats[code])
+		}
+		s.statMutex.Unlock()
+	}
+
+	// Latency statistics
+	if want["latencystats"] {
+		sep()
+		info.WriteString("# Latencystats\r\n")
+		if s.LatencyTrackingEnabled {
+			for _, cmd := range s.sortedCommands() {
+				if cmd.LatencyHistogram.TotalCount() == 0 {
+					continue
+				}
+				fmt.Fprintf(&info, "latency_percentiles_usec_%s:%s\r\n",
+					cmd.Name, s.fillPercentileDistributionLatencies(cmd.LatencyHistogram))
+			}
+		}
+	}
+
+	// Cluster
+	if want["cluster"] {
+		enabled := 0
+		if s.ClusterEnabled {
+			enabled = 1
+		}
+		sep()
+		fmt.Fprintf(&info, "# Cluster\r\n"+
+			"cluster_enabled:%d\r\n", enabled)
+	}
+
+	// Key space
+	if want["keyspace"] {
+		sep()
+		info.WriteString("# Keyspace\r\n")
+		for j := 0; j < s.DbNum; j++ {
+			db := s.Dbs[j]
+			keys, vkeys := db.Size(), db.ExpiresSize()
+			if keys > 0 || vkeys > 0 {
+				fmt.Fprintf(&info, "db%d:keys=%d,expires=%d,avg_ttl=%d\r\n",
+					j, keys, vkeys, atomic.LoadInt64(&db.avgTTL))
+			}
+		}
+	}
+	return info.String()
+}
+
+/* Return the commands sorted by name. */
+func (s *Server) sortedCommands() []*Command {
+	cmds := make([]*Command, 0, len(s.Commands))
+	for _, cmd := range s.Commands {
+		cmds = append(cmds, cmd)
+	}
+	sort.Slice(cmds, func(i, j int) bool {
+		return cmds[i].Name < cmds[j].Name
+	})
+	return cmds
+}
+
+/* Format the configured percentiles of the histogram in microseconds,
+ * like "p50=1.003,p99=3.007,p99.9=5.023". */
+func (s *Server) fillPercentileDistributionLatencies(h *Histogram) string {
+	b := strings.Builder{}
+	for j, p := range s.LatencyTrackingInfoPercentiles {
+		if j > 0 {
+			b.WriteByte(',')
+		}
+		fmt.Fprintf(&b, "p%s=%.3f", strconv.FormatFloat(p, 'f', -1, 64),
+			float64(h.ValueAtPercentile(p))/1000)
+	}
+	return b.String()
+}
+
+var InfoCommand CommandProcess = func(c *KiwiClient) {
+	AddReplyVerbatim(c, c.srv.GenKiwiInfoString(c.Argv[1:c.Argc]), "txt")
+}
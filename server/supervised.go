@@ -0,0 +1,105 @@
+package server
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"syscall"
+)
+
+/*-----------------------------------------------------------------------------
+ * Supervision by upstart or systemd
+ *
+ * With "supervised systemd" the server tells systemd, on the socket of
+ * the NOTIFY_SOCKET environment variable, when it is ready to accept
+ * connections and when it is stopping, as for a Type=notify unit. With
+ * "supervised upstart" it raises SIGSTOP once ready, as expected by
+ * "expect stop" jobs. "supervised auto" picks one from the environment.
+ *----------------------------------------------------------------------------*/
+
+var SupervisedModeEnum = []ConfigEnum{
+	{"no", SUPERVISED_NONE},
+	{"auto", SUPERVISED_AUTODETECT},
+	{"systemd", SUPERVISED_SYSTEMD},
+	{"upstart", SUPERVISED_UPSTART},
+}
+
+/* Resolve the supervision mode from the configuration and the environment,
+ * and return true if the server is supervised. */
+func (s *Server) ServerIsSupervised() bool {
+	if s.SupervisedMode == SUPERVISED_AUTODETECT {
+		if os.Getenv("UPSTART_JOB") != "" {
+			s.SupervisedMode = SUPERVISED_UPSTART
+		} else if os.Getenv("NOTIFY_SOCKET") != "" {
+			s.SupervisedMode = SUPERVISED_SYSTEMD
+		} else {
+			s.SupervisedMode = SUPERVISED_NONE
+		}
+	}
+	switch s.SupervisedMode {
+	case SUPERVISED_UPSTART:
+		if os.Getenv("UPSTART_JOB") == "" {
+			s.ServerLogWarnF("upstart supervision requested, but UPSTART_JOB not found!\n")
+			return false
+		}
+		/* The children of the server must not stop as well. */
+		os.Unsetenv("UPSTART_JOB")
+	case SUPERVISED_SYSTEMD:
+		if os.Getenv("NOTIFY_SOCKET") == "" {
+			s.ServerLogWarnF("systemd supervision requested or auto-detected, but NOTIFY_SOCKET environment variable not found!\n")
+			return false
+		}
+	default:
+		return false
+	}
+	s.Supervised = true
+	return true
+}
+
+/* Send a state change, like "READY=1\n", to the service manager. See
+ * sd_notify(3). */
+func (s *Server) ServerCommunicateSystemd(state string) error {
+	path := os.Getenv("NOTIFY_SOCKET")
+	if path == "" {
+		return nil
+	}
+	/* A leading '@' stands for the Linux abstract namespace. */
+	if path[0] == '@' {
+		path = "\x00" + path[1:]
+	}
+	conn, err := net.DialUnix("unixgram", nil, &net.UnixAddr{Name: path, Net: "unixgram"})
+	if err != nil {
+		return fmt.Errorf("Can't connect to systemd socket %s: %v", os.Getenv("NOTIFY_SOCKET"), err)
+	}
+	defer conn.Close()
+	if _, err := conn.Write([]byte(state)); err != nil {
+		return fmt.Errorf("Can't send notification to systemd: %v", err)
+	}
+	return nil
+}
+
+/* Tell the supervisor that the server is ready to accept connections. */
+func (s *Server) serverSupervisedReady() {
+	if !s.Supervised {
+		return
+	}
+	switch s.SupervisedMode {
+	case SUPERVISED_SYSTEMD:
+		s.ServerLogNoticeF("Systemd supervision: notifying readiness.\n")
+		if err := s.ServerCommunicateSystemd(fmt.Sprintf("STATUS=Ready to accept connections\nMAINPID=%d\nREADY=1\n", s.Pid)); err != nil {
+			s.ServerLogWarnF("%v\n", err)
+		}
+	case SUPERVISED_UPSTART:
+		s.ServerLogNoticeF("Upstart supervision: raising SIGSTOP.\n")
+		syscall.Kill(os.Getpid(), syscall.SIGSTOP)
+	}
+}
+
+/* Tell the supervisor that the server is stopping. */
+func (s *Server) serverSupervisedStopping() {
+	if s.Supervised && s.SupervisedMode == SUPERVISED_SYSTEMD {
+		if err := s.ServerCommunicateSystemd("STOPPING=1\n"); err != nil {
+			s.ServerLogWarnF("%v\n", err)
+		}
+	}
+}
@@ -0,0 +1,220 @@
+package server
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+/* TLS support.
+ *
+ * Clients connect with TLS to the tls-port, while the cluster bus and
+ * MIGRATE use TLS when tls-cluster is enabled. The configuration is built
+ * by TlsConfigure() from the tls-* directives, and is swapped atomically:
+ * changing any of the directives with CONFIG SET (or reloading the config
+ * file) loads the certificates again, and new connections use them while
+ * established connections are not affected. */
+
+var TlsAuthClientsEnum = []ConfigEnum{
+	{"no", TLS_CLIENT_AUTH_NO},
+	{"yes", TLS_CLIENT_AUTH_YES},
+	{"optional", TLS_CLIENT_AUTH_OPTIONAL},
+}
+
+/* The current TLS configuration, nil until TlsConfigure() succeeds. */
+type tlsContext struct {
+	server *tls.Config // Used to accept connections.
+	client *tls.Config // Used to connect to other nodes.
+}
+
+/* Return true if TLS is used for clients or for the cluster bus. */
+func (s *Server) TlsEnabled() bool {
+	return s.TlsPort != 0 || s.TlsCluster
+}
+
+/* Parse the tls-protocols directive, a space separated list of protocols
+ * like "TLSv1.2 TLSv1.3", into the min and max versions to accept. */
+func tlsParseProtocols(protocols string) (uint16, uint16, error) {
+	if protocols == "" {
+		return tls.VersionTLS12, tls.VersionTLS13, nil
+	}
+	var min, max uint16
+	for _, p := range strings.Fields(protocols) {
+		var v uint16
+		switch strings.ToLower(p) {
+		case "tlsv1":
+			v = tls.VersionTLS10
+		case "tlsv1.1":
+			v = tls.VersionTLS11
+		case "tlsv1.2":
+			v = tls.VersionTLS12
+		case "tlsv1.3":
+			v = tls.VersionTLS13
+		default:
+			return 0, 0, errors.New("Invalid tls-protocols specified. Use a combination of 'TLSv1', 'TLSv1.1', 'TLSv1.2' and 'TLSv1.3'.")
+		}
+		if min == 0 || v < min {
+			min = v
+		}
+		if v > max {
+			max = v
+		}
+	}
+	return min, max, nil
+}
+
+/* Load the CA certificates from tls-ca-cert-file and every file of
+ * tls-ca-cert-dir. */
+func tlsLoadCaCerts(file, dir string) (*x509.CertPool, error) {
+	pool := x509.NewCertPool()
+	files := []string{}
+	if file != "" {
+		files = append(files, file)
+	}
+	if dir != "" {
+		entries, err := os.ReadDir(dir)
+		if err != nil {
+			return nil, fmt.Errorf("Failed to configure CA certificate(s) directory '%s': %v", dir, err)
+		}
+		for _, e := range entries {
+			if !e.IsDir() {
+				files = append(files, filepath.Join(dir, e.Name()))
+			}
+		}
+	}
+	for _, f := range files {
+		pem, err := os.ReadFile(f)
+		if err != nil {
+			return nil, fmt.Errorf("Failed to configure CA certificate(s) file '%s': %v", f, err)
+		}
+		if !pool.AppendCertsFromPEM(pem) && f == file {
+			return nil, fmt.Errorf("Failed to configure CA certificate(s) file '%s': no certificates found", f)
+		}
+	}
+	return pool, nil
+}
+
+/* Build the TLS configuration from the tls-* directives and make it the
+ * current one. On error the current configuration is left untouched. */
+func (s *Server) TlsConfigure() error {
+	if s.TlsCertFile == "" {
+		return errors.New("No tls-cert-file configured!")
+	}
+	if s.TlsKeyFile == "" {
+		return errors.New("No tls-key-file configured!")
+	}
+	if (s.TlsAuthClients != TLS_CLIENT_AUTH_NO || s.TlsCluster) &&
+		s.TlsCaCertFile == "" && s.TlsCaCertDir == "" {
+		return errors.New("Either tls-ca-cert-file or tls-ca-cert-dir must be specified when tls-cluster or tls-auth-clients are enabled!")
+	}
+	cert, err := tls.LoadX509KeyPair(s.TlsCertFile, s.TlsKeyFile)
+	if err != nil {
+		return fmt.Errorf("Failed to load certificate: %s: %v", s.TlsCertFile, err)
+	}
+	minVersion, maxVersion, err := tlsParseProtocols(s.TlsProtocols)
+	if err != nil {
+		return err
+	}
+	var cas *x509.CertPool
+	if s.TlsCaCertFile != "" || s.TlsCaCertDir != "" {
+		if cas, err = tlsLoadCaCerts(s.TlsCaCertFile, s.TlsCaCertDir); err != nil {
+			return err
+		}
+	}
+
+	server := &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		ClientCAs:    cas,
+		MinVersion:   minVersion,
+		MaxVersion:   maxVersion,
+	}
+	switch s.TlsAuthClients {
+	case TLS_CLIENT_AUTH_YES:
+		server.ClientAuth = tls.RequireAndVerifyClientCert
+	case TLS_CLIENT_AUTH_OPTIONAL:
+		server.ClientAuth = tls.VerifyClientCertIfGiven
+	default:
+		server.ClientAuth = tls.NoClientCert
+	}
+	// Nodes are addressed by IP: like for clients, we verify the chain of
+	// their certificate but not the host name.
+	client := &tls.Config{
+		Certificates:       []tls.Certificate{cert},
+		MinVersion:         minVersion,
+		MaxVersion:         maxVersion,
+		InsecureSkipVerify: true,
+		VerifyConnection: func(cs tls.ConnectionState) error {
+			if len(cs.PeerCertificates) == 0 {
+				return errors.New("tls: the node sent no certificate")
+			}
+			opts := x509.VerifyOptions{Roots: cas, Intermediates: x509.NewCertPool()}
+			for _, c := range cs.PeerCertificates[1:] {
+				opts.Intermediates.AddCert(c)
+			}
+			_, err := cs.PeerCertificates[0].Verify(opts)
+			return err
+		},
+	}
+	s.tlsCtx.Store(&tlsContext{server: server, client: client})
+	return nil
+}
+
+/* Apply function of the tls-* directives: reload the configuration when
+ * TLS is in use. */
+func (s *Server) applyTlsCfg() error {
+	if !s.TlsEnabled() {
+		return nil
+	}
+	if err := s.TlsConfigure(); err != nil {
+		return err
+	}
+	s.ServerLogNoticeF("TLS configuration reloaded.\n")
+	return nil
+}
+
+/* Return the configuration used to accept TLS connections, or nil if TLS
+ * is not configured. */
+func (s *Server) TlsServerConfig() *tls.Config {
+	if ctx, ok := s.tlsCtx.Load().(*tlsContext); ok {
+		return ctx.server
+	}
+	return nil
+}
+
+/* Wrap a listener of the cluster bus, so that it accepts TLS connections if
+ * tls-cluster is enabled. Every handshake uses the current configuration,
+ * and other nodes must always present a valid certificate. */
+func (s *Server) TlsClusterListener(ln net.Listener) net.Listener {
+	if !s.TlsCluster {
+		return ln
+	}
+	return tls.NewListener(ln, &tls.Config{
+		GetConfigForClient: func(*tls.ClientHelloInfo) (*tls.Config, error) {
+			config := s.TlsServerConfig()
+			if config == nil {
+				return nil, errors.New("TLS is not configured")
+			}
+			config = config.Clone()
+			config.ClientAuth = tls.RequireAndVerifyClientCert
+			return config, nil
+		},
+	})
+}
+
+/* Connect to another node, using TLS if tls-cluster is enabled. */
+func (s *Server) TlsClusterDial(addr string, timeout time.Duration) (net.Conn, error) {
+	if !s.TlsCluster {
+		return net.DialTimeout("tcp", addr, timeout)
+	}
+	ctx, ok := s.tlsCtx.Load().(*tlsContext)
+	if !ok {
+		return nil, errors.New("TLS is not configured")
+	}
+	return tls.DialWithDialer(&net.Dialer{Timeout: timeout}, "tcp", addr, ctx.client)
+}
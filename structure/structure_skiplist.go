@@ -59,7 +59,7 @@ func (zsl *ZSkiplist) ZSkiplistInsert(score float64, ele string) *ZSkiplistNode
 		}
 		for x.Level[i].Forward != nil &&
 			(x.Level[i].Forward.Score < score ||
-				(x.Level[i].Forward.Score == score && x.Level[i].Forward.Ele != ele)) {
+				(x.Level[i].Forward.Score == score && x.Level[i].Forward.Ele < ele)) {
 			rank[i] += x.Level[i].Span
 			x = x.Level[i].Forward
 		}
@@ -122,7 +122,7 @@ func (zsl *ZSkiplist) ZSkiplistDeleteNode(x *ZSkiplistNode, update [ZSKIPLIST_MA
 	} else {
 		zsl.Tail = x.Backward
 	}
-	for zsl.Level > 1 && zsl.Header.Level[zsl.Level-1].Forward != nil {
+	for zsl.Level > 1 && zsl.Header.Level[zsl.Level-1].Forward == nil {
 		zsl.Level--
 	}
 	zsl.Len--
@@ -134,7 +134,7 @@ func (zsl *ZSkiplist) ZSkiplistDelete(score float64, ele string) bool {
 	for i := zsl.Level - 1; i >= 0; i-- {
 		for x.Level[i].Forward != nil &&
 			(x.Level[i].Forward.Score < score ||
-				(x.Level[i].Forward.Score == score && x.Level[i].Forward.Ele != ele)) {
+				(x.Level[i].Forward.Score == score && x.Level[i].Forward.Ele < ele)) {
 			x = x.Level[i].Forward
 		}
 		update[i] = x
@@ -218,12 +218,7 @@ func (zsl *ZSkiplist) ZSkiplistDeleteRangeByScore(rangeSpec *ZScoreRangeSpec, di
 	x := zsl.Header
 	removed := 0
 	for i := zsl.Level - 1; i >= 0; i-- {
-		lteMin := x.Level[i].Forward.Score < rangeSpec.Min
-		if !lteMin { // (!lteMin) ==> (Score >= Min), check if Score == Min is admitted
-			lteMin = rangeSpec.Minex && x.Level[i].Forward.Score == rangeSpec.Min
-		}
-
-		for x.Level[i].Forward != nil && lteMin {
+		for x.Level[i].Forward != nil && !ZSkiplistValueGteMin(x.Level[i].Forward.Score, rangeSpec) {
 			x = x.Level[i].Forward
 		}
 		update[i] = x
@@ -313,7 +308,7 @@ func (zsl *ZSkiplist) ZSkiplistGetRank(score float64, ele string) int {
 			x = x.Level[i].Forward
 		}
 	}
-	if x.Ele != "" && x.Ele <= ele {
+	if x != zsl.Header && x.Ele == ele {
 		return rank
 	}
 	return 0
@@ -389,7 +384,7 @@ func ZSkiplistValueLteMax(value float64, rangeSpec *ZScoreRangeSpec) bool {
 	if rangeSpec.Maxex { // exclude Max
 		return value < rangeSpec.Max
 	} else { // include Max
-		return value >= rangeSpec.Max
+		return value <= rangeSpec.Max
 	}
 }
 
@@ -0,0 +1,164 @@
+package test
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestAclSetUser(t *testing.T) {
+	c := dial(t, startServer(t, ""))
+	c.run([]cmdTest{
+		{"acl whoami", "default"},
+		{"acl users", "[default]"},
+		{"acl setuser analytics on >secret ~stats:* +@read -@dangerous", "+OK"},
+		{"acl setuser analytics +get", "+OK"},
+		{"acl getuser nosuch", "(nil)"},
+		{"acl users", "[analytics default]"},
+		{"acl setuser analytics bogus", "-ERR Error in ACL SETUSER modifier 'bogus': *"},
+		{"acl setuser analytics +nosuchcommand", "-ERR Error in ACL SETUSER modifier '+nosuchcommand': *"},
+		{"acl setuser analytics +@nosuchcategory", "-ERR Error in ACL SETUSER modifier '+@nosuchcategory': *"},
+		// There is no Pub/Sub, nor channel rules.
+		{"acl setuser analytics &*", "-ERR Error in ACL SETUSER modifier '&*': Syntax error"},
+		{"acl setuser analytics resetchannels", "-ERR Error in ACL SETUSER modifier 'resetchannels': Syntax error"},
+		{`acl setuser "a b"`, "-ERR Usernames can't contain spaces or null characters"},
+		{"acl deluser default", "-ERR The 'default' user cannot be removed"},
+		{"acl cat nosuch", "-ERR Unknown category 'nosuch'"},
+		{"acl genpass 0", "-ERR ACL GENPASS argument must be the number of bits for the output password, a positive number up to 4096"},
+		{"acl log -1", "-ERR value is out of range, must be positive"},
+		{"acl save", "-ERR This Kiwi instance is not configured to use an ACL file. *"},
+		{"acl nosuch", "-ERR Unknown subcommand or wrong number of arguments for 'nosuch'. Try ACL HELP"},
+	})
+	// A rule that fails leaves the user unchanged.
+	user := c.do("acl getuser analytics")
+	for _, want := range []string{"[flags [on] passwords [", " commands -@all +@read -@dangerous +get keys [stats:*]]"} {
+		if !strings.Contains(user, want) {
+			t.Errorf("acl getuser analytics = %q, missing %q", user, want)
+		}
+	}
+	// The passwords are hashed.
+	if strings.Contains(user, "secret") || strings.Contains(c.do("acl list"), "secret") {
+		t.Errorf("the password is shown in clear: %q", user)
+	}
+	if got := c.do("acl genpass 32"); len(got) != 8 {
+		t.Errorf("acl genpass 32 = %q", got)
+	}
+	categories := c.do("acl cat")
+	for _, category := range []string{"read", "write", "admin", "dangerous"} {
+		if !strings.Contains(" "+strings.Trim(categories, "[]")+" ", " "+category+" ") {
+			t.Errorf("acl cat = %q, missing %s", categories, category)
+		}
+	}
+	if got := c.do("acl cat read"); !strings.Contains(got, " get ") || strings.Contains(got, " set ") {
+		t.Errorf("acl cat read = %q", got)
+	}
+	c.run([]cmdTest{
+		{"acl deluser analytics nosuch", ":1"},
+		{"acl users", "[default]"},
+	})
+}
+
+// A read only user for the analytics jobs.
+func TestAclPermissions(t *testing.T) {
+	db := startServer(t, "")
+	admin, c := dial(t, db), dial(t, db)
+	admin.run([]cmdTest{
+		{"acl setuser analytics on >secret ~stats:* +@read", "+OK"},
+		{"set stats:a 1", "+OK"},
+		{"set private 1", "+OK"},
+	})
+	c.run([]cmdTest{
+		{"auth analytics wrong", "-WRONGPASS invalid username-password pair or user is disabled."},
+		{"auth nosuch secret", "-WRONGPASS invalid username-password pair or user is disabled."},
+		{"auth analytics secret", "+OK"},
+		{"acl whoami", "-NOPERM this user has no permissions to run the 'acl' command or its subcommand"},
+		{"get stats:a", "1"},
+		{"get private", "-NOPERM this user has no permissions to access one of the keys used as arguments"},
+		{"mget stats:a private", "-NOPERM this user has no permissions to access one of the keys used as arguments"},
+		{"set stats:a 2", "-NOPERM this user has no permissions to run the 'set' command or its subcommand"},
+		{"auth a b c", "-ERR syntax error"},
+	})
+	log := admin.do("acl log")
+	for _, want := range []string{
+		"[count :1 reason command context toplevel object set username analytics ",
+		"[count :2 reason key context toplevel object private username analytics ",
+		"[count :1 reason command context toplevel object acl username analytics ",
+		// The failed authentications are grouped by username.
+		"[count :1 reason auth context toplevel object AUTH username nosuch ",
+		"[count :1 reason auth context toplevel object AUTH username analytics ",
+	} {
+		if !strings.Contains(log, want) {
+			t.Errorf("acl log = %q, missing %q", log, want)
+		}
+	}
+	if got := admin.do("acl log 1"); !strings.HasPrefix(got, "[[count :1 reason command context toplevel object set ") {
+		t.Errorf("acl log 1 = %q, want the last denial", got)
+	}
+	admin.run([]cmdTest{
+		{"acl log reset", "+OK"},
+		{"acl log", "[]"},
+		{"acl setuser analytics off", "+OK"},
+	})
+	c.run([]cmdTest{
+		{"auth analytics secret", "-WRONGPASS invalid username-password pair or user is disabled."},
+	})
+
+	// Deleting a user disconnects its clients.
+	c2 := dial(t, db)
+	admin.do("acl setuser analytics on")
+	c2.run([]cmdTest{
+		{"auth analytics secret", "+OK"},
+	})
+	admin.run([]cmdTest{
+		{"acl deluser analytics", ":1"},
+	})
+	c2.conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err := c2.r.ReadValue(); err == nil {
+		t.Error("the client of a deleted user is still connected")
+	}
+}
+
+func TestAclRequirePass(t *testing.T) {
+	c := dial(t, startServer(t, "requirepass foo"))
+	c.run([]cmdTest{
+		{"get a", "-NOAUTH Authentication required."},
+		{"auth bar", "-WRONGPASS invalid username-password pair or user is disabled."},
+		{"auth foo", "+OK"},
+		{"get a", "(nil)"},
+		{"auth default foo", "+OK"},
+	})
+}
+
+func TestAclFile(t *testing.T) {
+	aclfile := filepath.Join(t.TempDir(), "users.acl")
+	if err := os.WriteFile(aclfile, []byte("user jobs on nopass ~jobs:* +@read\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	c := dial(t, startServer(t, "aclfile "+aclfile))
+	c.run([]cmdTest{
+		{"acl users", "[default jobs]"},
+		{"acl setuser other on nopass +get ~*", "+OK"},
+		{"acl save", "+OK"},
+		{"acl deluser other", ":1"},
+		{"acl load", "+OK"},
+		{"acl users", "[default jobs other]"},
+	})
+	saved, err := os.ReadFile(aclfile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(saved), "user other on nopass ") {
+		t.Errorf("acl file = %q", saved)
+	}
+
+	if err := os.WriteFile(aclfile, []byte("user jobs on bogus\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	c.run([]cmdTest{
+		{"acl load", "-ERR *"},
+		// The users are unchanged when the file is invalid.
+		{"acl users", "[default jobs other]"},
+	})
+}
@@ -0,0 +1,161 @@
+package test
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestClient(t *testing.T) {
+	db := startServer(t, "")
+	c, other := dial(t, db), dial(t, db)
+	id := c.do("client id")[1:]
+	otherID := other.do("client id")[1:]
+	c.run([]cmdTest{
+		{"client getname", "(nil)"},
+		{`client setname "a b"`, "-ERR Client names cannot contain spaces, newlines or special characters."},
+		{"client setname tester", "+OK"},
+		{"client getname", "tester"},
+		{"client list type bogus", "-ERR Unknown client type 'bogus'"},
+		{"client list id abc", "-ERR Invalid client ID"},
+		{"client list id " + otherID, "id=" + otherID + " *"},
+		{"client list bogus", "-ERR syntax error"},
+		{"client no-evict maybe", "-ERR syntax error"},
+		{"client no-evict on", "+OK"},
+	})
+	if info := c.do("client info"); !strings.Contains(info, " flags=Ue ") {
+		t.Errorf("client info = %q, missing the e flag", info)
+	}
+	c.run([]cmdTest{
+		{"client no-evict off", "+OK"},
+		{"client nosuch", "-ERR Unknown subcommand or wrong number of arguments for 'nosuch'. Try CLIENT HELP"},
+		{"client pause abc", "-ERR timeout is not an integer or out of range"},
+		{"client pause 10 bogus", "-ERR CLIENT PAUSE mode must be WRITE or ALL"},
+		{"client pause 10 write", "+OK"},
+		{"client unpause", "+OK"},
+	})
+	info := c.do("client info")
+	for _, field := range []string{"id=" + id + " ", " name=tester ", " flags=U ", " db=0 ", " cmd=client "} {
+		if !strings.Contains(info, field) {
+			t.Errorf("client info = %q, missing %q", info, field)
+		}
+	}
+	for _, cmd := range []string{"client list", "client list type normal"} {
+		if list := c.do(cmd); strings.Count(list, "\n") != 2 || !strings.Contains(list, "name=tester") {
+			t.Errorf("%s = %q", cmd, list)
+		}
+	}
+	if help := c.do("client help"); !strings.Contains(help, "NO-EVICT (on|off)") {
+		t.Errorf("client help = %q", help)
+	}
+
+	// The replies are skipped, the commands are executed.
+	c.send("client reply off")
+	c.send("set a 1")
+	c.send("client reply skip")
+	c.run([]cmdTest{
+		{"client reply on", "+OK"},
+		{"get a", "1"},
+	})
+	c.send("client reply skip")
+	c.send("set a 2")
+	c.run([]cmdTest{
+		{"get a", "2"},
+		{"client reply bogus", "-ERR syntax error"},
+	})
+
+	c.run([]cmdTest{
+		{"client kill 1.2.3.4:5", "-ERR No such client"},
+		{"client kill id 0", "-ERR client-id should be greater than 0"},
+		{"client kill id " + id, ":0"},
+		{"client kill skipme maybe", "-ERR syntax error"},
+		{"client kill id " + otherID, ":1"},
+	})
+	waitFor(t, "the client to be killed", func() bool {
+		return strings.Count(c.do("client list"), "\n") == 1
+	})
+}
+
+// The commands postponed by CLIENT PAUSE are resumed before the commands
+// sent meanwhile, and after them.
+func TestClientPause(t *testing.T) {
+	db := startServer(t, "event-loops 4")
+	admin := dial(t, db)
+	for round := 0; round < 20; round++ {
+		c := dial(t, db)
+		id := c.do("client id")[1:]
+		admin.run([]cmdTest{
+			{"client pause 100000 write", "+OK"},
+		})
+		c.write(fmt.Sprintf("set k%d 1\r\nget k%d\r\n", round, round))
+		waitFor(t, "the client to be postponed", func() bool {
+			return strings.Contains(admin.do("client list id "+id), " flags=b")
+		})
+		// The client keeps sending while it is unpaused.
+		done := make(chan struct{})
+		go func() {
+			defer close(done)
+			for i := 0; i < 200; i++ {
+				c.conn.Write([]byte(fmt.Sprintf("incr n%d\r\n", round)))
+			}
+		}()
+		admin.run([]cmdTest{
+			{"client unpause", "+OK"},
+		})
+		<-done
+		if got := c.read(); got != "+OK" {
+			t.Fatalf("set = %q", got)
+		}
+		if got := c.read(); got != "1" {
+			t.Fatalf("get = %q", got)
+		}
+		for i := 1; i <= 200; i++ {
+			if got := c.read(); got != fmt.Sprintf(":%d", i) {
+				t.Fatalf("incr %d = %q", i, got)
+			}
+		}
+	}
+}
+
+// The clients of the other loops are listed, measured and killed while
+// they run commands.
+func TestClientListConcurrent(t *testing.T) {
+	db := startServer(t, "event-loops 4")
+	admin := dial(t, db)
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		o := dial(t, db)
+		wg.Add(2)
+		go func(i int) {
+			defer wg.Done()
+			for j := 0; ; j++ {
+				line := fmt.Sprintf("set k%d %s\r\nget k%d\r\n", i, strings.Repeat("x", j%20*100), i)
+				if _, err := o.conn.Write([]byte(line)); err != nil {
+					return
+				}
+			}
+		}(i)
+		go func() {
+			defer wg.Done()
+			for {
+				o.conn.SetReadDeadline(time.Now().Add(10 * time.Second))
+				if _, err := o.r.ReadValue(); err != nil {
+					return
+				}
+			}
+		}()
+	}
+	for i := 0; i < 10; i++ {
+		admin.do("client list")
+		admin.do("info clients")
+		admin.do("memory stats")
+	}
+	// Every client but the admin is killed.
+	waitFor(t, "the clients to be killed", func() bool {
+		admin.do("client kill skipme yes")
+		return strings.Count(admin.do("client list"), "\n") == 1
+	})
+	wg.Wait()
+}
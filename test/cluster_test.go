@@ -0,0 +1,105 @@
+package test
+
+import (
+	"fmt"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func startClusterNode(t *testing.T) (*testConn, int) {
+	port := freePort(t)
+	db := startServer(t, fmt.Sprintf("port %d\ncluster-enabled yes\ncluster-node-timeout 1000\n"+
+		"cluster-config-file %s\n", port, filepath.Join(t.TempDir(), "nodes.conf")))
+	return dial(t, db), port
+}
+
+func TestClusterDisabled(t *testing.T) {
+	c := dial(t, startServer(t, ""))
+	c.run([]cmdTest{
+		{"cluster info", "-ERR This instance has cluster support disabled"},
+		{"asking", "-ERR This instance has cluster support disabled"},
+		{"select 1", "+OK"},
+	})
+}
+
+func TestClusterSingleNode(t *testing.T) {
+	c, _ := startClusterNode(t)
+	c.run([]cmdTest{
+		{"cluster keyslot foo", ":12182"},
+		{"cluster keyslot {user}.name", ":5474"},
+		{"cluster keyslot {user}.mail", ":5474"},
+		{"cluster keyslot {}foo", ":9500"},
+		{"set foo bar", "-CLUSTERDOWN Hash slot not served"},
+		{"cluster addslots 100000", "-ERR Invalid or out of range slot"},
+		{"cluster addslots 0 0", "-ERR Slot 0 specified multiple times"},
+		{"cluster nosuchsubcommand", "-ERR Unknown subcommand or wrong number of arguments for 'nosuchsubcommand'. Try CLUSTER HELP."},
+		{args("cluster addslots", 0, 16383), "+OK"},
+		{"cluster addslots 0", "-ERR Slot 0 is already busy"},
+		{"set foo bar", "+OK"},
+		{"get foo", "bar"},
+		{"mset a 1 b 2", "-CROSSSLOT Keys in request don't hash to the same slot"},
+		{"mset {t}a 1 {t}b 2", "+OK"},
+		{"cluster countkeysinslot 12182", ":1"},
+		{"cluster getkeysinslot 12182 10", "[foo]"},
+		{"cluster getkeysinslot 12182 -1", "-ERR Invalid number of keys"},
+		{"select 1", "-ERR SELECT is not allowed in cluster mode"},
+		{"select 0", "+OK"},
+		{"cluster delslots 12182", "+OK"},
+		{"get foo", "-CLUSTERDOWN Hash slot not served"},
+	})
+	if info := c.do("cluster info"); !strings.Contains(info, "cluster_slots_assigned:16383") {
+		t.Errorf("cluster info = %q", info)
+	}
+}
+
+func TestClusterRedirection(t *testing.T) {
+	a, portA := startClusterNode(t)
+	b, portB := startClusterNode(t)
+	idB := b.do("cluster myid")
+
+	if got := a.do(fmt.Sprintf("cluster meet 127.0.0.1 %d", portB)); got != "+OK" {
+		t.Fatalf("cluster meet = %q", got)
+	}
+	waitFor(t, "the handshake", func() bool {
+		return !strings.Contains(a.do("cluster nodes"), "handshake") &&
+			strings.Count(b.do("cluster nodes"), "\n") == 2
+	})
+	a.run([]cmdTest{
+		{args("cluster addslots", 0, 8191), "+OK"},
+	})
+	b.run([]cmdTest{
+		{args("cluster addslots", 8192, 16383), "+OK"},
+	})
+	waitFor(t, "the cluster to be ok", func() bool {
+		return strings.Contains(a.do("cluster info"), "cluster_state:ok") &&
+			strings.Contains(b.do("cluster info"), "cluster_state:ok")
+	})
+
+	// foo hashes to 12182, served by b.
+	a.run([]cmdTest{
+		{"set foo bar", fmt.Sprintf("-MOVED 12182 127.0.0.1:%d", portB)},
+		{"set bar foo", "+OK"}, // 5061
+	})
+	b.run([]cmdTest{
+		{"set foo bar", "+OK"},
+		{"get bar", fmt.Sprintf("-MOVED 5061 127.0.0.1:%d", portA)},
+	})
+
+	// Migrate slot 5061 from a to b: a redirects the missing keys with ASK,
+	// and b only serves them after ASKING.
+	b.run([]cmdTest{
+		{"cluster setslot 5061 importing " + a.do("cluster myid"), "+OK"},
+	})
+	a.run([]cmdTest{
+		{"cluster setslot 5061 migrating " + idB, "+OK"},
+		{"get bar", "foo"},
+		{"get {bar}.new", fmt.Sprintf("-ASK 5061 127.0.0.1:%d", portB)},
+	})
+	b.run([]cmdTest{
+		{"get {bar}.new", fmt.Sprintf("-MOVED 5061 127.0.0.1:%d", portA)},
+		{"asking", "+OK"},
+		{"get {bar}.new", "(nil)"},
+		{"get {bar}.new", fmt.Sprintf("-MOVED 5061 127.0.0.1:%d", portA)},
+	})
+}
@@ -0,0 +1,75 @@
+package test
+
+import (
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func TestCommand(t *testing.T) {
+	c := dial(t, startServer(t, ""))
+	c.run([]cmdTest{
+		{"command info get", "[[get :2 [+readonly +fast] :1 :1 :1]]"},
+		{"command info SET nosuch", "[[set :-3 [+write +denyoom] :1 :1 :1] (nil)]"},
+		{"command info mset", "[[mset :-3 [+write +denyoom] :1 :-1 :2]]"},
+		{"command info", "-ERR Unknown subcommand or wrong number of arguments for 'info'. Try COMMAND HELP"},
+		{"command count now", "-ERR Unknown subcommand or wrong number of arguments for 'count'. Try COMMAND HELP"},
+		{"command nosuch", "-ERR Unknown subcommand or wrong number of arguments for 'nosuch'. Try COMMAND HELP"},
+		{"command help", "[+COMMAND <subcommand> arg arg ... arg. Subcommands are: *"},
+	})
+	count, err := strconv.Atoi(strings.TrimPrefix(c.do("command count"), ":"))
+	if err != nil || count < 50 {
+		t.Fatalf("command count = %d, %v", count, err)
+	}
+	if all := c.do("command"); strings.Count(all, "[") != 2*count+1 || !strings.Contains(all, "[get :2 [+readonly +fast] :1 :1 :1]") {
+		t.Errorf("command = %q", all)
+	}
+}
+
+func TestCommandStats(t *testing.T) {
+	c := dial(t, startServer(t, ""))
+	c.run([]cmdTest{
+		{"command stats", "[]"},
+		{"set a 1", "+OK"},
+		{"get a", "1"},
+		{"get a", "1"},
+		{"get", "-ERR wrong number of arguments for 'get' command"},
+		{"rpush l x", ":1"},
+		{"get l", "-WRONGTYPE Operation against a key holding the wrong kind of value"},
+		{"command stats nosuch", "-ERR Unknown command 'nosuch'"},
+	})
+	stats := c.do("command stats get")
+	for _, field := range []string{"[[name get calls :3 usec :", " rejected_calls :1 failed_calls :1 p50 ", " p99 ", " p99.9 "} {
+		if !strings.Contains(stats, field) {
+			t.Errorf("command stats get = %q, missing %q", stats, field)
+		}
+	}
+	// Without names, only the commands called so far are listed.
+	stats = c.do("command stats")
+	for _, name := range []string{"name set ", "name get ", "name rpush ", "name command "} {
+		if !strings.Contains(stats, name) {
+			t.Errorf("command stats = %q, missing %q", stats, name)
+		}
+	}
+	if strings.Contains(stats, "name lpush ") {
+		t.Errorf("command stats = %q, lists lpush", stats)
+	}
+
+	info := c.do("info latencystats")
+	if !strings.Contains(info, "latency_percentiles_usec_get:p50=") || !strings.Contains(info, ",p99.9=") {
+		t.Errorf("info latencystats = %q", info)
+	}
+	c.run([]cmdTest{
+		{"config set latency-tracking-info-percentiles \"50 90\"", "+OK"},
+		{"config get latency-tracking-info-percentiles", "[latency-tracking-info-percentiles 50 90]"},
+		{"config set latency-tracking-info-percentiles 101", "-ERR CONFIG SET failed (possibly related to argument 'latency-tracking-info-percentiles') - *"},
+		{"command stats set", "[[name set calls :1 usec :*"},
+	})
+	if stats := c.do("command stats set"); !strings.Contains(stats, " p50 ") || !strings.Contains(stats, " p90 ") || strings.Contains(stats, " p99 ") {
+		t.Errorf("command stats set = %q, want p50 and p90", stats)
+	}
+	c.run([]cmdTest{
+		{"config set latency-tracking no", "+OK"},
+		{"info latencystats", "# Latencystats\r\n"},
+	})
+}
@@ -0,0 +1,122 @@
+package test
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/zhaotong0312/kiwi"
+	"github.com/zhaotong0312/kiwi/server"
+)
+
+func TestConfigSetGet(t *testing.T) {
+	c := dial(t, startServer(t, ""))
+	c.run([]cmdTest{
+		{"config get maxmemory", "[maxmemory 0]"},
+		{"config get nosuchconfig", "[]"},
+		{"config set maxmemory 10mb", "+OK"},
+		{"config get maxmemory", "[maxmemory 10485760]"},
+		{"config set maxmemory-policy allkeys-lru maxmemory-samples 10", "+OK"},
+		{"config get maxmemory*", "[maxmemory 10485760 maxmemory-clients 0 maxmemory-policy allkeys-lru maxmemory-samples 10]"},
+		// The configs are all set, or none.
+		{"config set maxmemory 1mb maxmemory-policy bogus",
+			"-ERR CONFIG SET failed (possibly related to argument 'maxmemory-policy') - *"},
+		{"config get maxmemory", "[maxmemory 10485760]"},
+		{"config set maxmemory 1mb maxmemory 2mb", "-ERR CONFIG SET failed (possibly related to argument 'maxmemory') - duplicate parameter"},
+		{"config set port 1", "-ERR CONFIG SET failed (possibly related to argument 'port') - can't set immutable config"},
+		{"config set nosuchconfig 1", "-ERR CONFIG SET failed (possibly related to argument 'nosuchconfig') - unrecognized parameter"},
+		{"config set hz 0", "-ERR CONFIG SET failed (possibly related to argument 'hz') - *"},
+		{"config set maxmemory", "-ERR syntax error"},
+		{"config rewrite", "-ERR The server is running without a config file"},
+	})
+}
+
+func TestConfigReload(t *testing.T) {
+	db := startServer(t, "")
+	c := dial(t, db)
+	srv := db.Server()
+	srv.ConfigFile = filepath.Join(t.TempDir(), "kiwi.conf")
+	reload := func(config string) {
+		t.Helper()
+		if err := os.WriteFile(srv.ConfigFile, []byte(config), 0644); err != nil {
+			t.Fatal(err)
+		}
+		srv.ReloadServerConfig()
+	}
+
+	reload("maxmemory 1mb\nslowlog-max-len 20\n# The immutable configs are ignored.\ndatabases 4\n")
+	c.run([]cmdTest{
+		{"config get maxmemory", "[maxmemory 1048576]"},
+		{"config get slowlog-max-len", "[slowlog-max-len 20]"},
+		{"config get databases", "[databases 16]"},
+	})
+
+	// A config file with an error is not applied at all.
+	reload("maxmemory 2mb\nslowlog-max-len 30\nmaxmemory-policy bogus\n")
+	c.run([]cmdTest{
+		{"config get maxmemory", "[maxmemory 1048576]"},
+		{"config get slowlog-max-len", "[slowlog-max-len 20]"},
+	})
+
+	reload("maxmemory 3mb\ninclude " + srv.ConfigFile + "\n")
+	c.run([]cmdTest{
+		{"config get maxmemory", "[maxmemory 1048576]"},
+	})
+}
+
+// The command line options still override the reloaded config file.
+func TestConfigReloadOptions(t *testing.T) {
+	dir := t.TempDir()
+	file := filepath.Join(dir, "kiwi.conf")
+	if err := os.WriteFile(file, []byte("maxmemory 1mb\nslowlog-max-len 20\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	s, err := server.NewServerFromArgs([]string{file, "--port", "0", "--unixsocket", filepath.Join(dir, "kiwi.sock"), "--maxmemory", "2mb"})
+	if err != nil {
+		t.Fatalf("NewServerFromArgs: %v", err)
+	}
+	if err := s.Start(); err != nil {
+		t.Fatalf("Start: %v", err)
+	}
+	defer s.Shutdown(context.Background())
+	c := dialServer(t, s)
+	c.run([]cmdTest{
+		{"config get maxmemory", "[maxmemory 2097152]"},
+		{"config get slowlog-max-len", "[slowlog-max-len 20]"},
+	})
+	if err := os.WriteFile(file, []byte("maxmemory 3mb\nslowlog-max-len 30\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	s.ReloadServerConfig()
+	c.run([]cmdTest{
+		{"config get maxmemory", "[maxmemory 2097152]"},
+		{"config get slowlog-max-len", "[slowlog-max-len 30]"},
+	})
+}
+
+func TestConfigInclude(t *testing.T) {
+	dir := t.TempDir()
+	included := filepath.Join(dir, "included.conf")
+	if err := os.WriteFile(included, []byte("hz 42\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	c := dial(t, startServer(t, "include "+included+"\n"))
+	c.run([]cmdTest{
+		{"config get hz", "[hz 42]"},
+	})
+
+	self := filepath.Join(dir, "self.conf")
+	if err := os.WriteFile(self, []byte("include "+self+"\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	db, err := kiwi.Open("include " + self + "\n")
+	if err == nil {
+		db.Close()
+		t.Fatal("Open succeeded with a file including itself")
+	}
+	if !strings.Contains(err.Error(), "Too many nested includes") {
+		t.Errorf("Open: %v", err)
+	}
+}
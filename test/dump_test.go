@@ -0,0 +1,145 @@
+package test
+
+import (
+	"encoding/binary"
+	"fmt"
+	"hash/crc64"
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/zhaotong0312/kiwi/resp"
+)
+
+// doArgs sends a command of binary safe arguments and returns its reply,
+// formatted by format.
+func (c *testConn) doArgs(argv ...string) string {
+	c.t.Helper()
+	c.write(string(resp.AppendCommand(nil, argv...)))
+	return c.read()
+}
+
+// sorted sorts the elements of a formatted aggregate, like the members of
+// a set.
+func sorted(reply string) string {
+	elems := strings.Fields(strings.Trim(reply, "[]"))
+	sort.Strings(elems)
+	return "[" + strings.Join(elems, " ") + "]"
+}
+
+// payload builds a DUMP payload of the given type and body.
+func payload(rtype byte, body string) string {
+	b := append([]byte{rtype}, body...)
+	b = append(b, 1, 0)
+	return string(binary.LittleEndian.AppendUint64(b, crc64.Checksum(b, crc64.MakeTable(crc64.ECMA))))
+}
+
+// The values of every type are restored as they were dumped.
+func TestDumpRestore(t *testing.T) {
+	c := dial(t, startServer(t, ""))
+	c.run([]cmdTest{
+		{"set s \"a\x00b\"", "+OK"},
+		{"set i 12345", "+OK"},
+		{"rpush l x \"\" x " + strings.Repeat("y", 300), ":4"},
+		{"sadd set a b c", ":3"},
+		{"hset h f1 v1 f2 \"\"", ":2"},
+		{"zadd z 1.5 a -inf b 2 c", ":3"},
+	})
+	reads := map[string]string{
+		"s":   "get %s",
+		"i":   "get %s",
+		"l":   "lrange %s 0 -1",
+		"set": "smembers %s",
+		"h":   "hgetall %s",
+		"z":   "zrange %s 0 -1 withscores",
+	}
+	for key, read := range reads {
+		dump := c.do("dump " + key)
+		if got := c.doArgs("restore", key+".copy", "0", dump); got != "+OK" {
+			t.Errorf("restore of %s = %q", key, got)
+			continue
+		}
+		want, got := c.do(fmt.Sprintf(read, key)), c.do(fmt.Sprintf(read, key+".copy"))
+		if key == "set" || key == "h" {
+			want, got = sorted(want), sorted(got)
+		}
+		if got != want {
+			t.Errorf("restored %s = %q, want %q", key, got, want)
+		}
+		if c.do("type "+key) != c.do("type "+key+".copy") {
+			t.Errorf("restored %s is a %s", key, c.do("type "+key+".copy"))
+		}
+	}
+
+	dump := c.do("dump l")
+	c.run([]cmdTest{
+		{"dump missing", "(nil)"},
+		{"zscore z.copy b", "-inf"},
+		{"zrank z.copy c", ":2"},
+	})
+	for _, tt := range []struct {
+		argv []string
+		want string
+	}{
+		{[]string{"restore", "l", "0", dump}, "-BUSYKEY Target key name already exists."},
+		{[]string{"restore", "s", "0", dump, "replace"}, "+OK"},
+		{[]string{"restore", "ttl", "100000", dump}, "+OK"},
+		{[]string{"restore", "x", "-1", dump}, "-ERR Invalid TTL value, must be >= 0"},
+		{[]string{"restore", "x", "0", dump, "bogus"}, "-ERR syntax error"},
+		{[]string{"restore", "x", "0", dump[:len(dump)-1] + "x"}, "-ERR DUMP payload version or checksum are wrong"},
+		{[]string{"restore", "x", "0", "short"}, "-ERR DUMP payload version or checksum are wrong"},
+		// The payloads with a valid checksum are checked too.
+		{[]string{"restore", "x", "0", payload(2, "\x03\x01a")}, "-ERR Bad data format"},
+		{[]string{"restore", "x", "0", payload(2, "\x01\x01ab")}, "-ERR Bad data format"},
+		{[]string{"restore", "x", "0", payload(2, "\x00")}, "-ERR Bad data format"},
+		{[]string{"restore", "x", "0", payload(2, "\xff\xff\xff\xff\xff\xff\xff\xff\x7f")}, "-ERR Bad data format"},
+		{[]string{"restore", "x", "0", payload(3, "\x01\x01a\x00")}, "-ERR Bad data format"},
+		{[]string{"restore", "x", "0", payload(9, "")}, "-ERR Bad data format"},
+	} {
+		if got := c.doArgs(tt.argv...); got != tt.want {
+			t.Errorf("%s %s = %q, want %q", tt.argv[0], tt.argv[1], got, tt.want)
+		}
+	}
+	c.run([]cmdTest{
+		{"lrange s 0 -1", "[x  x " + strings.Repeat("y", 300) + "]"},
+		{"exists x", ":0"},
+	})
+	var pttl int
+	if fmt.Sscanf(c.do("pttl ttl"), ":%d", &pttl); pttl < 90000 || pttl > 100000 {
+		t.Errorf("pttl ttl = %d", pttl)
+	}
+}
+
+// MIGRATE moves the keys of every type to another server.
+func TestMigrate(t *testing.T) {
+	port := freePort(t)
+	src := dial(t, startServer(t, ""))
+	dst := dial(t, startServer(t, fmt.Sprintf("port %d", port)))
+	src.run([]cmdTest{
+		{"set s v", "+OK"},
+		{"rpush l a b", ":2"},
+		{"sadd set a", ":1"},
+		{"hset h f v", ":1"},
+		{"zadd z 1 a", ":1"},
+		{"pexpire l 100000", ":1"},
+		{fmt.Sprintf("migrate 127.0.0.1 %d missing 0 1000", port), "+NOKEY"},
+		{fmt.Sprintf("migrate 127.0.0.1 %d s 0 1000", port), "+OK"},
+		{fmt.Sprintf("migrate 127.0.0.1 %d \"\" 0 1000 copy keys l set h z", port), "+OK"},
+		{"exists s", ":0"},
+		{"exists l set h z", ":4"},
+		{fmt.Sprintf("migrate 127.0.0.1 %d l 0 1000", port), "-ERR Target instance replied with error: BUSYKEY Target key name already exists."},
+		{fmt.Sprintf("migrate 127.0.0.1 %d \"\" 0 1000 replace keys l set h z", port), "+OK"},
+		{"exists l set h z", ":0"},
+	})
+	dst.run([]cmdTest{
+		{"get s", "v"},
+		{"lrange l 0 -1", "[a b]"},
+		{"smembers set", "[a]"},
+		{"hgetall h", "[f v]"},
+		{"zrange z 0 -1 withscores", "[a 1]"},
+		{"pttl l", ":*"},
+	})
+	if pttl := dst.do("pttl l"); pttl == ":-1" {
+		t.Error("the TTL of l was not migrated")
+	}
+}
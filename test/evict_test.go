@@ -0,0 +1,215 @@
+package test
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+const oomErr = "-OOM command not allowed when used memory > 'maxmemory'."
+
+func TestMaxmemoryNoEviction(t *testing.T) {
+	c := dial(t, startServer(t, "maxmemory-policy noeviction"))
+	for i := 0; i < 10; i++ {
+		c.do(fmt.Sprintf("set k%d %d", i, i))
+	}
+	c.run([]cmdTest{
+		{"config set maxmemory 1", "+OK"},
+		// Only the commands that may use more memory are denied.
+		{"set a 1", oomErr},
+		{"rpush l a", oomErr},
+		{"get k1", "1"},
+		{"del k1", ":1"},
+		{"expire k2 100", ":1"},
+		{"config set maxmemory 0", "+OK"},
+		{"set a 1", "+OK"},
+	})
+	if got := c.info("evicted_keys"); got != "0" {
+		t.Errorf("evicted_keys = %s", got)
+	}
+	if got := c.info("db0"); !strings.HasPrefix(got, "keys=10,") {
+		t.Errorf("db0 = %s", got)
+	}
+}
+
+func TestMaxmemoryConfig(t *testing.T) {
+	c := dial(t, startServer(t, ""))
+	c.run([]cmdTest{
+		{"config get maxmemory-policy", "[maxmemory-policy noeviction]"},
+		{"config set maxmemory-policy volatile-ttl", "+OK"},
+		{"config set maxmemory-policy bogus", "-ERR CONFIG SET failed (possibly related to argument 'maxmemory-policy') - *"},
+		{"config set maxmemory-samples 0", "-ERR CONFIG SET failed (possibly related to argument 'maxmemory-samples') - *"},
+		{"config set maxmemory -1", "-ERR CONFIG SET failed (possibly related to argument 'maxmemory') - *"},
+		{"config set maxmemory 1gb", "+OK"},
+		{"config get maxmemory", "[maxmemory 1073741824]"},
+	})
+	if got := c.info("maxmemory_policy"); got != "volatile-ttl" {
+		t.Errorf("maxmemory_policy = %s", got)
+	}
+}
+
+// Every policy evicts down to the limit. The volatile policies only evict
+// the keys with an expire, and fail once there are none left.
+func TestMaxmemoryEviction(t *testing.T) {
+	for _, policy := range []string{
+		"allkeys-lru", "allkeys-lfu", "allkeys-random",
+		"volatile-lru", "volatile-lfu", "volatile-random", "volatile-ttl",
+	} {
+		t.Run(policy, func(t *testing.T) {
+			db := startServer(t, "maxmemory-samples 64\nmaxmemory-policy "+policy)
+			srv := db.Server()
+			c := dial(t, db)
+			for i := 0; i < 20; i++ {
+				c.do(fmt.Sprintf("set p%d %s", i, strings.Repeat("x", 100)))
+				c.do(fmt.Sprintf("set v%d %s ex %d", i, strings.Repeat("x", 100), 1000+i))
+			}
+			limit := atomic.LoadInt64(&srv.UsedMemory) * 3 / 4
+			c.run([]cmdTest{
+				{"config set maxmemory " + strconv.FormatInt(limit, 10), "+OK"},
+				{"set a 1", "+OK"},
+			})
+			// The keys are evicted before the command runs: the command
+			// itself may use more.
+			if used := atomic.LoadInt64(&srv.UsedMemory); used > limit+200 {
+				t.Errorf("used memory %d > maxmemory %d", used, limit)
+			}
+			if evicted, _ := strconv.Atoi(c.info("evicted_keys")); evicted == 0 {
+				t.Error("no key was evicted")
+			}
+			if !strings.HasPrefix(policy, "volatile-") {
+				return
+			}
+			if got := c.do("exists" + persistentKeys()); got != ":20" {
+				t.Errorf("exists of the keys without expire = %s, want :20", got)
+			}
+			if policy == "volatile-ttl" {
+				// The keys expiring first are evicted first.
+				c.run([]cmdTest{
+					{"exists v0", ":0"},
+					{"exists v19", ":1"},
+				})
+			}
+			c.run([]cmdTest{
+				{"config set maxmemory 1", "+OK"},
+				{"set b 1", oomErr},
+				{"exists v19", ":0"},
+			})
+		})
+	}
+}
+
+func persistentKeys() string {
+	var b strings.Builder
+	for i := 0; i < 20; i++ {
+		fmt.Fprintf(&b, " p%d", i)
+	}
+	return b.String()
+}
+
+func TestExpire(t *testing.T) {
+	c := dial(t, startServer(t, ""))
+	c.run([]cmdTest{
+		{"set a 1", "+OK"},
+		{"ttl a", ":-1"},
+		{"pttl missing", ":-2"},
+		{"expire missing 10", ":0"},
+		{"expire a 100", ":1"},
+		{"ttl a", ":100"},
+		{"expire a x", "-ERR value is not an integer or out of range"},
+		{"persist a", ":1"},
+		{"persist a", ":0"},
+		{"ttl a", ":-1"},
+		{"pexpireat a " + strconv.FormatInt(time.Now().Add(time.Hour).UnixNano()/1e6, 10), ":1"},
+		{"expireat a " + strconv.FormatInt(time.Now().Add(-time.Hour).Unix(), 10), ":1"},
+		{"exists a", ":0"},
+		{"set a 1 ex 0", "-ERR invalid expire time in set"},
+		{"set a 1 ex x", "-ERR value is not an integer or out of range"},
+		{"set a 1 ex 10 px 100", "-ERR syntax error"},
+		{"set a 1 ex", "-ERR syntax error"},
+		{"setex a 100 1", "+OK"},
+		{"ttl a", ":100"},
+		// Setting a key removes its expire.
+		{"set a 2", "+OK"},
+		{"ttl a", ":-1"},
+	})
+
+	// The expired keys are removed by the cron, without being accessed.
+	c.do("set b 1 px 50")
+	waitFor(t, "the active expire", func() bool {
+		return c.info("expired_keys") == "1"
+	})
+	if got := c.info("db0"); !strings.HasPrefix(got, "keys=1,") {
+		t.Errorf("db0 = %s", got)
+	}
+	c.run([]cmdTest{
+		{"get b", "(nil)"},
+	})
+}
+
+func TestStringCommands(t *testing.T) {
+	c := dial(t, startServer(t, ""))
+	c.run([]cmdTest{
+		// An empty string is an empty bulk, not a null one.
+		{`set e ""`, "+OK"},
+		{"get e", ""},
+		{"strlen e", ":0"},
+		{"get missing", "(nil)"},
+		{"mget e missing", "[ (nil)]"},
+		{"set a 1 nx", "+OK"},
+		{"set a 2 nx", "(nil)"},
+		{"set a 3 xx", "+OK"},
+		{"set b 3 xx", "(nil)"},
+		{"set a 1 nx xx", "-ERR syntax error"},
+		{"setnx a 4", ":0"},
+		{"setnx b 4", ":1"},
+		{"incr a", ":4"},
+		{"decr b", ":3"},
+		{"incr e", "-ERR value is not an integer or out of range"},
+		{"append a x", ":2"},
+		{"append new x", ":1"},
+		{"mset c 1 d 2", "+OK"},
+		{"mset c 1 d", "-ERR wrong number of arguments for MSET"},
+		{"msetnx c 1 f 2", ":0"},
+		{"msetnx f 1 g 2", ":1"},
+		{"mget c d f g", "[1 2 1 2]"},
+		{"get", "-ERR wrong number of arguments for 'get' command"},
+	})
+}
+
+// The biggest clients are closed once the clients use more memory than
+// maxmemory-clients, unless they are protected by CLIENT NO-EVICT.
+func TestMaxmemoryClients(t *testing.T) {
+	db := startServer(t, "maxmemory-clients 1mb")
+	admin, big, protected := dial(t, db), dial(t, db), dial(t, db)
+	admin.run([]cmdTest{
+		{"config get maxmemory-clients", "[maxmemory-clients 1048576]"},
+		{"config set maxmemory-clients -1", "-ERR CONFIG SET failed (possibly related to argument 'maxmemory-clients') - *"},
+	})
+	protected.run([]cmdTest{
+		{"client no-evict on", "+OK"},
+	})
+	// The query buffers grow for the big arguments being read.
+	for _, c := range []*testConn{protected, big} {
+		c.write("*3\r\n$3\r\nset\r\n$1\r\na\r\n$2000000\r\n" + strings.Repeat("x", 100000))
+	}
+	if !big.closed() {
+		t.Error("the biggest client was not evicted")
+	}
+	protected.write(strings.Repeat("x", 1900000) + "\r\n")
+	if got := protected.read(); got != "+OK" {
+		t.Errorf("set = %q", got)
+	}
+	protected.run([]cmdTest{
+		{"strlen a", ":2000000"},
+		{"client no-evict off", "+OK"},
+	})
+	admin.run([]cmdTest{
+		{"ping", "+PONG"},
+	})
+	if got := admin.info("evicted_clients"); got != "1" {
+		t.Errorf("evicted_clients = %s", got)
+	}
+}
@@ -0,0 +1,88 @@
+package test
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/zhaotong0312/kiwi/resp"
+)
+
+func TestInfoSections(t *testing.T) {
+	c := dial(t, startServer(t, ""))
+	tests := []struct {
+		cmd     string
+		has     []string
+		hasNone []string
+	}{
+		{"info", []string{"# Server\r\n", "# Stats\r\n", "# Errorstats\r\n", "# Keyspace\r\n"}, []string{"# Commandstats"}},
+		{"info default", []string{"# Server\r\n", "# Keyspace\r\n"}, []string{"# Latencystats"}},
+		{"info commandstats", []string{"# Commandstats\r\n", "cmdstat_info:calls="}, []string{"# Server"}},
+		{"info CPU memory", []string{"# CPU\r\n", "# Memory\r\n"}, []string{"# Server", "# Stats"}},
+		{"info all", []string{"# Server\r\n", "# Commandstats\r\n", "# Latencystats\r\n"}, nil},
+		{"info nosuchsection", nil, []string{"#"}},
+	}
+	for _, tt := range tests {
+		info := c.do(tt.cmd)
+		for _, s := range tt.has {
+			if !strings.Contains(info, s) {
+				t.Errorf("%s: missing %q", tt.cmd, s)
+			}
+		}
+		for _, s := range tt.hasNone {
+			if strings.Contains(info, s) {
+				t.Errorf("%s: unexpected %q", tt.cmd, s)
+			}
+		}
+	}
+}
+
+func TestInfoErrorStats(t *testing.T) {
+	c := dial(t, startServer(t, ""))
+	c.run([]cmdTest{
+		{"nosuchcommand", "-ERR unknown command 'nosuchcommand'"},
+		{"get", "-ERR wrong number of arguments for 'get' command"},
+		{"lpush a x", ":1"},
+		{"get a", "-WRONGTYPE Operation against a key holding the wrong kind of value"},
+	})
+	info := c.do("info errorstats")
+	for _, s := range []string{"errorstat_ERR:count=2\r\n", "errorstat_WRONGTYPE:count=1\r\n"} {
+		if !strings.Contains(info, s) {
+			t.Errorf("info errorstats = %q, missing %q", info, s)
+		}
+	}
+	if info := c.do("info stats"); !strings.Contains(info, "total_error_replies:3\r\n") {
+		t.Errorf("info stats = %q, want total_error_replies:3", info)
+	}
+	if info := c.do("info commandstats"); !strings.Contains(info, "cmdstat_get:calls=1,") ||
+		!strings.Contains(info, "rejected_calls=1,failed_calls=1") {
+		t.Errorf("info commandstats = %q", info)
+	}
+
+	c.run([]cmdTest{
+		{"config resetstat", "+OK"},
+		{"config resetstat now", "-ERR Unknown subcommand or wrong number of arguments for 'resetstat'. Try CONFIG HELP"},
+		{"config resetstat", "+OK"},
+		{"info errorstats", "# Errorstats\r\n"},
+	})
+	if info := c.do("info stats"); !strings.Contains(info, "total_error_replies:0\r\n") {
+		t.Errorf("info stats = %q, want total_error_replies:0", info)
+	}
+}
+
+// The command name is echoed in the error: it must not end the reply early.
+func TestErrorReplyInjection(t *testing.T) {
+	c := dial(t, startServer(t, ""))
+	c.write(string(resp.AppendCommand(nil, "unknown\r\n+OK")))
+	if got, want := c.read(), "-ERR unknown command 'unknown  +ok'"; got != want {
+		t.Errorf("reply = %q, want %q", got, want)
+	}
+	c.run([]cmdTest{
+		{"set a 1", "+OK"},
+		{"nosuchcommand" + strings.Repeat("x", 200),
+			"-ERR unknown command 'nosuchcommand" + strings.Repeat("x", 115) + "'"},
+		{"cluster " + strings.Repeat("x", 200), "-ERR This instance has cluster support disabled"},
+		{"config " + strings.Repeat("x", 200),
+			"-ERR Unknown subcommand or wrong number of arguments for '" + strings.Repeat("x", 128) + "'. Try CONFIG HELP"},
+		{"get a", "1"},
+	})
+}
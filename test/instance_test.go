@@ -0,0 +1,139 @@
+package test
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"net"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/zhaotong0312/kiwi/resp"
+	"github.com/zhaotong0312/kiwi/server"
+)
+
+// newServer creates and starts a server listening on a unix socket. The
+// server is shut down at the end of the test.
+func newServer(t *testing.T, config string) *server.Server {
+	t.Helper()
+	sock := filepath.Join(t.TempDir(), "kiwi.sock")
+	s, err := server.NewServer("port 0\nunixsocket " + sock + "\n" + config)
+	if err != nil {
+		t.Fatalf("NewServer: %v", err)
+	}
+	if s.Addr() != nil {
+		t.Errorf("Addr before Start = %v", s.Addr())
+	}
+	if err := s.Start(); err != nil {
+		t.Fatalf("Start: %v", err)
+	}
+	t.Cleanup(func() { s.Shutdown(context.Background()) })
+	return s
+}
+
+func dialServer(t *testing.T, s *server.Server) *testConn {
+	t.Helper()
+	conn, err := net.Dial(s.Addr().Network(), s.Addr().String())
+	if err != nil {
+		t.Fatalf("dial %v: %v", s.Addr(), err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	return &testConn{t: t, conn: conn, r: resp.NewReader(bufio.NewReader(conn))}
+}
+
+func TestNewServerErrors(t *testing.T) {
+	for _, tt := range []struct {
+		config string
+		want   string
+	}{
+		{"nosuch 1", "Bad directive or wrong number of arguments"},
+		{"maxmemory-policy bogus", "argument(s) must be one of the following: *"},
+		{"databases 0", "argument must be between 1 and *"},
+		{"tls-port 6390", "Failed to configure TLS: No tls-cert-file configured!"},
+	} {
+		_, err := server.NewServer(tt.config)
+		if err == nil || !strings.Contains(err.Error(), strings.TrimSuffix(tt.want, "*")) {
+			t.Errorf("NewServer(%q) = %v, want %q", tt.config, err, tt.want)
+		}
+	}
+
+	// The address is already in use.
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	s, err := server.NewServer(fmt.Sprintf("bind 127.0.0.1\nport %d", ln.Addr().(*net.TCPAddr).Port))
+	if err != nil {
+		t.Fatalf("NewServer: %v", err)
+	}
+	if err := s.Start(); err == nil {
+		s.Shutdown(context.Background())
+		t.Error("Start on a port in use succeeded")
+	}
+	if s.Addr() != nil {
+		t.Errorf("Addr after a failed Start = %v", s.Addr())
+	}
+}
+
+// The servers of the same process don't share any state.
+func TestServerInstances(t *testing.T) {
+	s1, s2 := newServer(t, "maxmemory 1mb"), newServer(t, "databases 4")
+	c1, c2 := dialServer(t, s1), dialServer(t, s2)
+	c1.run([]cmdTest{
+		{"set a 1", "+OK"},
+		{"acl setuser worker on nopass +@all ~*", "+OK"},
+		{"config set slowlog-log-slower-than 0", "+OK"},
+		{"get a", "1"},
+	})
+	c2.run([]cmdTest{
+		{"get a", "(nil)"},
+		{"acl users", "[default]"},
+		{"config get maxmemory", "[maxmemory 0]"},
+		{"config get slowlog-log-slower-than", "[slowlog-log-slower-than 10000]"},
+		{"select 4", "-ERR DB index is out of range"},
+		{"slowlog len", ":0"},
+		{"command stats set", "[[name set calls :0 *"},
+	})
+	c1.run([]cmdTest{
+		{"config get databases", "[databases 16]"},
+		{"select 4", "+OK"},
+		{"command stats get", "[[name get calls :1 *"},
+	})
+
+	// Shutting down a server leaves the others running.
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	if err := s1.Shutdown(ctx); err != nil {
+		t.Fatalf("Shutdown: %v", err)
+	}
+	if !c1.closed() {
+		t.Error("the connection was not closed by Shutdown")
+	}
+	c2.run([]cmdTest{
+		{"ping", "+PONG"},
+	})
+}
+
+func TestNewServerFromArgs(t *testing.T) {
+	sock := filepath.Join(t.TempDir(), "kiwi.sock")
+	s, err := server.NewServerFromArgs([]string{"--port", "0", "--unixsocket", sock, "--maxmemory", "2mb"})
+	if err != nil {
+		t.Fatalf("NewServerFromArgs: %v", err)
+	}
+	if err := s.Start(); err != nil {
+		t.Fatalf("Start: %v", err)
+	}
+	defer s.Shutdown(context.Background())
+	if s.Addr().String() != sock {
+		t.Errorf("Addr = %v, want %s", s.Addr(), sock)
+	}
+	dialServer(t, s).run([]cmdTest{
+		{"config get maxmemory", "[maxmemory 2097152]"},
+	})
+	if _, err := server.NewServerFromArgs([]string{"--nosuch", "1"}); err == nil {
+		t.Error("NewServerFromArgs with an unknown option succeeded")
+	}
+}
@@ -0,0 +1,71 @@
+package test
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/zhaotong0312/kiwi/server"
+)
+
+func TestLatency(t *testing.T) {
+	db := startServer(t, "latency-monitor-threshold 100")
+	c := dial(t, db)
+	c.run([]cmdTest{
+		{"latency latest", "[]"},
+		{"latency history command", "[]"},
+		{"latency graph command", "-ERR No samples available for event 'command'"},
+		{"latency reset", ":0"},
+		{"latency history", "-ERR Unknown subcommand or wrong number of arguments for 'history'. Try LATENCY HELP"},
+		{"latency nosuch", "-ERR Unknown subcommand or wrong number of arguments for 'nosuch'. Try LATENCY HELP"},
+		{"latency", "-ERR wrong number of arguments for 'latency' command"},
+		{"latency help", "[+LATENCY <subcommand> arg arg ... arg. Subcommands are: *"},
+	})
+	if got := c.do("latency doctor"); !strings.Contains(got, "no latency spike was observed") {
+		t.Errorf("latency doctor = %q", got)
+	}
+
+	srv := db.Server()
+	srv.LatencyAddSampleIfNeeded("command", 50)
+	srv.LatencyAddSampleIfNeeded("command", 150)
+	srv.LatencyAddSampleIfNeeded("cluster-config-fsync", 120)
+	if got := c.do("latency latest"); !strings.HasPrefix(got, "[[cluster-config-fsync :") || !strings.HasSuffix(got, " :150 :150]]") {
+		t.Errorf("latency latest = %q", got)
+	}
+	if got := c.do("latency history command"); !strings.HasSuffix(got, " :150]]") {
+		t.Errorf("latency history command = %q", got)
+	}
+	if got := c.do("latency graph command"); !strings.HasPrefix(got, "command - high 150 ms, low 150 ms (all time high 150 ms)\n") {
+		t.Errorf("latency graph command = %q", got)
+	}
+	doctor := c.do("latency doctor")
+	for _, want := range []string{"1. cluster-config-fsync: 1 latency spikes", "2. command: 1 latency spikes", "Syncing files to disk is slow", "Slow Log"} {
+		if !strings.Contains(doctor, want) {
+			t.Errorf("latency doctor = %q, missing %q", doctor, want)
+		}
+	}
+	c.run([]cmdTest{
+		{"latency reset command nosuch", ":1"},
+		{"latency latest", "[[cluster-config-fsync *"},
+		{"latency reset", ":1"},
+		{"latency latest", "[]"},
+	})
+}
+
+// Waiting for another loop to release the keyspace is not a latency of the
+// waiting loop.
+func TestLatencyEventLoopLockWait(t *testing.T) {
+	db := startServer(t, "latency-monitor-threshold 100\nevent-loops 2")
+	c := dial(t, db)
+	srv := db.Server()
+	srv.LockKeyspace(server.CRON_LOOP)
+	c.send("set a 1")
+	time.Sleep(300 * time.Millisecond)
+	srv.UnlockKeyspace()
+	if got := c.read(); got != "+OK" {
+		t.Fatalf("set a 1 = %q", got)
+	}
+	c.run([]cmdTest{
+		{"latency history event-loop", "[]"},
+	})
+}
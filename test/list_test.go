@@ -5,7 +5,7 @@ import (
 	"time"
 	"sync"
 	"math/rand"
-	"kiwi/src/structure"
+	"github.com/zhaotong0312/kiwi/structure"
 	"testing"
 )
 
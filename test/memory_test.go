@@ -0,0 +1,94 @@
+package test
+
+import (
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func TestMemoryUsage(t *testing.T) {
+	c := dial(t, startServer(t, ""))
+	c.run([]cmdTest{
+		{"set a x", "+OK"},
+		{"set b " + strings.Repeat("x", 1000), "+OK"},
+		{"memory usage missing", "(nil)"},
+		{"memory usage a samples -1", "-ERR value is out of range, must be positive"},
+		{"memory usage a samples x", "-ERR value is out of range, must be positive"},
+		{"memory usage a bogus", "-ERR syntax error"},
+		{"memory usage a samples", "-ERR syntax error"},
+		{"memory usage", "-ERR Unknown subcommand or wrong number of arguments for 'usage'. Try MEMORY HELP"},
+		{"memory nosuch", "-ERR Unknown subcommand or wrong number of arguments for 'nosuch'. Try MEMORY HELP"},
+		{"memory purge", "+OK"},
+		{"memory help", "[+MEMORY <subcommand> arg arg ... arg. Subcommands are: *"},
+	})
+	usage := func(cmd string) int {
+		t.Helper()
+		got := c.do(cmd)
+		n, err := strconv.Atoi(strings.TrimPrefix(got, ":"))
+		if err != nil || n <= 0 {
+			t.Fatalf("%s = %q", cmd, got)
+		}
+		return n
+	}
+	if small, big := usage("memory usage a"), usage("memory usage b"); big-small < 999 {
+		t.Errorf("memory usage of a 1000 bytes value = %d, of a 1 byte value = %d", big, small)
+	}
+
+	// The nested values are sampled: the estimate of a list of elements of
+	// different sizes depends on the number of samples.
+	c.do(args("rpush l", 1, 10))
+	c.do("rpush l " + strings.Repeat("x", 1000))
+	sampled, all := usage("memory usage l samples 1"), usage("memory usage l samples 0")
+	if sampled == all || all < 1000 {
+		t.Errorf("memory usage of a list: %d with 1 sample, %d with all of them", sampled, all)
+	}
+	for _, cmd := range []string{"hset h a 1", "sadd s a", "zadd z 1 a"} {
+		c.do(cmd)
+		usage("memory usage " + strings.Fields(cmd)[1])
+	}
+}
+
+func TestMemoryStats(t *testing.T) {
+	c := dial(t, startServer(t, "maxmemory 1mb\nmaxmemory-policy allkeys-lru"))
+	c.run([]cmdTest{
+		{"set a 1", "+OK"},
+		{"select 2", "+OK"},
+		{"set b 1", "+OK"},
+		{"set c 1", "+OK"},
+	})
+	got := c.do("memory stats")
+	fields := strings.Fields(strings.NewReplacer("[", " ", "]", " ").Replace(got))
+	stats := make(map[string]string)
+	for i := 0; i+1 < len(fields); i += 2 {
+		if strings.HasPrefix(fields[i], "db.") {
+			// The databases have nested maps of overheads.
+			stats[fields[i]] = ""
+			i += 3
+			continue
+		}
+		stats[fields[i]] = fields[i+1]
+	}
+	for field, want := range map[string]string{
+		"keys.count":       ":3",
+		"maxmemory":        ":1048576",
+		"maxmemory-policy": "allkeys-lru",
+		"db.0":             "",
+		"db.2":             "",
+	} {
+		if stats[field] != want {
+			t.Errorf("memory stats %s = %q, want %q in %s", field, stats[field], want, got)
+		}
+	}
+	for _, field := range []string{"peak.allocated", "total.allocated", "keyspace.bytes", "dataset.bytes", "allocator.heap", "gc.count"} {
+		if _, ok := stats[field]; !ok {
+			t.Errorf("memory stats has no %s: %s", field, got)
+		}
+	}
+	if _, ok := stats["db.1"]; ok {
+		t.Errorf("memory stats reports the empty db 1: %s", got)
+	}
+	// The report depends on the heap of the whole test process.
+	if got := c.do("memory doctor"); !strings.Contains(got, "Sam") {
+		t.Errorf("memory doctor = %q", got)
+	}
+}
@@ -0,0 +1,44 @@
+package test
+
+import (
+	"regexp"
+	"testing"
+)
+
+func TestMonitor(t *testing.T) {
+	db := startServer(t, "event-loops 2")
+	m := dial(t, db)
+	m.run([]cmdTest{
+		{"monitor now", "-ERR wrong number of arguments for 'monitor' command"},
+		{"monitor", "+OK"},
+	})
+	// The clients may be served by another loop than the monitor.
+	c1, c2 := dial(t, db), dial(t, db)
+	c1.run([]cmdTest{
+		{`set a "hello world"`, "+OK"},
+		{"select 2", "+OK"},
+	})
+	c2.run([]cmdTest{
+		{`get "a\nb"`, "(nil)"},
+		// The admin commands are not shown.
+		{"config get maxmemory", "[maxmemory 0]"},
+		{"auth user secret", "-WRONGPASS invalid username-password pair or user is disabled."},
+		{"hello 3 auth user secret setname x", "-WRONGPASS invalid username-password pair or user is disabled."},
+	})
+	c1.run([]cmdTest{
+		{"get a", "(nil)"},
+	})
+	for _, want := range []string{
+		`^\+\d+\.\d{6} \[0 [^\]]+\] "set" "a" "hello world"$`,
+		`^\+\d+\.\d{6} \[0 [^\]]+\] "select" "2"$`,
+		`^\+\d+\.\d{6} \[0 [^\]]+\] "get" "a\\nb"$`,
+		// The passwords are redacted.
+		`^\+\d+\.\d{6} \[0 [^\]]+\] "auth" "\(redacted\)" "\(redacted\)"$`,
+		`^\+\d+\.\d{6} \[0 [^\]]+\] "hello" "3" "auth" "\(redacted\)" "\(redacted\)" "setname" "x"$`,
+		`^\+\d+\.\d{6} \[2 [^\]]+\] "get" "a"$`,
+	} {
+		if got := m.read(); !regexp.MustCompile(want).MatchString(got) {
+			t.Errorf("monitor = %q, want %s", got, want)
+		}
+	}
+}
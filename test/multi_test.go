@@ -0,0 +1,81 @@
+package test
+
+import (
+	"testing"
+)
+
+func TestMultiExec(t *testing.T) {
+	c := dial(t, startServer(t, ""))
+	c.run([]cmdTest{
+		{"exec", "-ERR EXEC without MULTI"},
+		{"discard", "-ERR DISCARD without MULTI"},
+		{"multi", "+OK"},
+		{"multi", "-ERR MULTI calls can not be nested"},
+		{"set a 1", "+QUEUED"},
+		{"incr a", "+QUEUED"},
+		{"lpush a x", "+QUEUED"},
+		{"get a", "+QUEUED"},
+		{"exec", "[+OK :2 -WRONGTYPE Operation against a key holding the wrong kind of value 2]"},
+		{"multi", "+OK"},
+		{"set a 10", "+QUEUED"},
+		{"discard", "+OK"},
+		{"get a", "2"},
+		{"multi", "+OK"},
+		{"exec", "[]"},
+	})
+}
+
+func TestMultiQueueingErrors(t *testing.T) {
+	c := dial(t, startServer(t, ""))
+	c.run([]cmdTest{
+		{"multi", "+OK"},
+		{"set a 1", "+QUEUED"},
+		{"nosuchcommand", "-ERR unknown command 'nosuchcommand'"},
+		{"get", "-ERR wrong number of arguments for 'get' command"},
+		{"exec", "-EXECABORT Transaction discarded because of previous errors."},
+		{"get a", "(nil)"},
+		{"exec", "-ERR EXEC without MULTI"},
+	})
+}
+
+func TestMultiExecOOM(t *testing.T) {
+	db := startServer(t, "maxmemory-policy noeviction")
+	c, admin := dial(t, db), dial(t, db)
+	c.run([]cmdTest{
+		{"set a 1", "+OK"},
+		{"multi", "+OK"},
+		{"set b 2", "+QUEUED"},
+		{"get a", "+QUEUED"},
+	})
+	// The limit is reached after the commands were queued: EXEC is
+	// rejected like they would be.
+	admin.run([]cmdTest{
+		{"config set maxmemory 1", "+OK"},
+	})
+	c.run([]cmdTest{
+		{"exec", "-EXECABORT Transaction discarded because of: OOM command not allowed when used memory > 'maxmemory'."},
+		{"get b", "(nil)"},
+		{"set b 2", "-OOM command not allowed when used memory > 'maxmemory'."},
+		// A read only transaction is still allowed.
+		{"multi", "+OK"},
+		{"get a", "+QUEUED"},
+		{"exec", "[1]"},
+	})
+}
+
+func TestMultiExecCluster(t *testing.T) {
+	c, _ := startClusterNode(t)
+	c.run([]cmdTest{
+		{args("cluster addslots", 0, 16383), "+OK"},
+		{"multi", "+OK"},
+		{"set {t}a 1", "+QUEUED"},
+		{"set {t}b 2", "+QUEUED"},
+		{"exec", "[+OK +OK]"},
+		// Every command can be served, but not atomically.
+		{"multi", "+OK"},
+		{"set a 1", "+QUEUED"},
+		{"set b 2", "+QUEUED"},
+		{"exec", "-EXECABORT Transaction discarded because of: CROSSSLOT Keys in request don't hash to the same slot"},
+		{"get a", "(nil)"},
+	})
+}
@@ -0,0 +1,78 @@
+package test
+
+import (
+	"strconv"
+	"sync"
+	"testing"
+)
+
+func TestObject(t *testing.T) {
+	c := dial(t, startServer(t, ""))
+	c.run([]cmdTest{
+		{"set n 100", "+OK"},
+		{"set big 123456789", "+OK"},
+		{"set s hello", "+OK"},
+		{"rpush l a b", ":2"},
+		{"object encoding n", "int"},
+		{"object encoding big", "int"},
+		{"object encoding s", "raw"},
+		{"object encoding missing", "(nil)"},
+		// The small integers are shared.
+		{"object refcount n", ":2147483647"},
+		{"object refcount big", ":1"},
+		{"object refcount s", ":1"},
+		{"object idletime s", ":0"},
+		{"object freq s", "-ERR An LFU maxmemory policy is not selected, access frequency not tracked.*"},
+		{"object nosuch s", "-ERR Unknown subcommand or wrong number of arguments for 'nosuch'. Try OBJECT HELP"},
+		{"object encoding", "-ERR Unknown subcommand or wrong number of arguments for 'encoding'. Try OBJECT HELP"},
+		{"object help", "[+OBJECT <subcommand> arg arg ... arg. Subcommands are: *"},
+		{"touch n s missing", ":2"},
+		{"touch", "-ERR wrong number of arguments for 'touch' command"},
+	})
+}
+
+func TestObjectLFU(t *testing.T) {
+	c := dial(t, startServer(t, "maxmemory-policy allkeys-lfu"))
+	c.run([]cmdTest{
+		{"set s hello", "+OK"},
+		{"object freq s", ":5"},
+		{"object idletime s", "-ERR An LFU maxmemory policy is selected, idle time not tracked.*"},
+	})
+	for i := 0; i < 100; i++ {
+		c.do("get s")
+	}
+	if freq, _ := strconv.Atoi(c.do("object freq s")[1:]); freq <= 5 {
+		t.Errorf("object freq after 100 reads = %d, want > 5", freq)
+	}
+	// OBJECT doesn't count as an access.
+	before := c.do("object freq s")
+	c.do("object encoding s")
+	if after := c.do("object freq s"); after != before {
+		t.Errorf("object freq = %s after OBJECT ENCODING, was %s", after, before)
+	}
+}
+
+// The shared integers are read by the keys of all the partitions at once:
+// reading them must not update them. Run with -race.
+func TestObjectSharedIntegersConcurrentAccess(t *testing.T) {
+	db := startServer(t, "partitioned-keyspace yes\nevent-loops 4\nmaxmemory-policy allkeys-lfu")
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		c := dial(t, db)
+		key := "k" + strconv.Itoa(i)
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			c.send("set " + key + " 1")
+			c.read()
+			for j := 0; j < 200; j++ {
+				c.send("get " + key)
+				if got := c.read(); got != "1" {
+					t.Errorf("get %s = %q", key, got)
+					return
+				}
+			}
+		}()
+	}
+	wg.Wait()
+}
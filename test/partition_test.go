@@ -0,0 +1,165 @@
+package test
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestPartitionedKeyspace(t *testing.T) {
+	db := startServer(t, "event-loops 4\npartitioned-keyspace yes")
+	srv := db.Server()
+	if n := srv.KeyspacePartitions(); n != 4 {
+		t.Fatalf("%d partitions, want 4", n)
+	}
+	// The keys with the same hash tag share a partition.
+	if srv.KeyPartition("{user1}.following") != srv.KeyPartition("{user1}.followers") {
+		t.Error("{user1}.following and {user1}.followers are in different partitions")
+	}
+	var a, b string
+	for i := 0; b == ""; i++ {
+		key := fmt.Sprintf("k%d", i)
+		if a == "" {
+			a = key
+		} else if srv.KeyPartition(key) != srv.KeyPartition(a) {
+			b = key
+		}
+	}
+
+	// The clients are spread across the loops: every client accesses keys
+	// of its own and of foreign partitions.
+	clients := make([]*testConn, 8)
+	for i := range clients {
+		clients[i] = dial(t, db)
+	}
+	c := clients[0]
+	c.run([]cmdTest{
+		{"config set partitioned-keyspace no", "-ERR CONFIG SET failed (possibly related to argument 'partitioned-keyspace') - can't set immutable config"},
+		{"set " + a + " 1", "+OK"},
+		{"set " + b + " 2", "+OK"},
+		{"rpush {user1}.following x y", ":2"},
+		{"sadd {user1}.followers z", ":1"},
+		// The commands with keys in several partitions stop the world.
+		{"mget " + a + " " + b + " missing", "[1 2 (nil)]"},
+		{"mset " + a + " 3 " + b + " 4", "+OK"},
+		{"msetnx " + a + " 5 new 6", ":0"},
+		{"del " + a + " " + b, ":2"},
+		{"select 1", "+OK"},
+		{"set " + a + " 1", "+OK"},
+		{"select 0", "+OK"},
+		{"exists " + a, ":0"},
+		{"multi", "+OK"},
+		{"lpop {user1}.following", "+QUEUED"},
+		{"smembers {user1}.followers", "+QUEUED"},
+		{"set " + b + " 1", "+QUEUED"},
+		{"exec", "[x [z] +OK]"},
+		{"lpush " + b + " x", "-WRONGTYPE Operation against a key holding the wrong kind of value"},
+	})
+	for _, o := range clients[1:] {
+		o.run([]cmdTest{
+			{"get " + b, "1"},
+			{"lrange {user1}.following 0 -1", "[y]"},
+		})
+	}
+
+	// The forwarded commands of concurrent clients are not lost.
+	var wg sync.WaitGroup
+	for _, o := range clients {
+		wg.Add(1)
+		go func(o *testConn) {
+			defer wg.Done()
+			var b strings.Builder
+			for i := 0; i < 500; i++ {
+				fmt.Fprintf(&b, "incr n%d\r\nrpush l%d %d\r\n", i%16, i%16, i)
+			}
+			o.conn.Write([]byte(b.String()))
+			for i := 0; i < 1000; i++ {
+				if _, err := o.r.ReadValue(); err != nil {
+					t.Errorf("read: %v", err)
+					return
+				}
+			}
+		}(o)
+	}
+	wg.Wait()
+	total := 0
+	for i := 0; i < 16; i++ {
+		got := c.do(fmt.Sprintf("get n%d", i))
+		n := 0
+		fmt.Sscan(got, &n)
+		total += n
+		if llen := c.do(fmt.Sprintf("llen l%d", i)); llen != fmt.Sprintf(":%d", n) {
+			t.Errorf("llen l%d = %s, want %d", i, llen, n)
+		}
+	}
+	if total != 8*500 {
+		t.Errorf("the counters sum to %d, want %d", total, 8*500)
+	}
+	// INFO reads every partition.
+	if got := c.info("db0"); !strings.HasPrefix(got, "keys=35,") {
+		t.Errorf("db0 = %s", got)
+	}
+}
+
+// The replies of the pipelined commands of concurrent clients come in
+// order, whether the commands are forwarded, stop the world or are
+// executed right away.
+func TestPartitionedPipelines(t *testing.T) {
+	db := startServer(t, "event-loops 4\npartitioned-keyspace yes")
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		o := dial(t, db)
+		wg.Add(2)
+		go func(i int) {
+			defer wg.Done()
+			for j := 0; j < 300; j += 10 {
+				var b strings.Builder
+				for k := j; k < j+10; k++ {
+					fmt.Fprintf(&b, "incr n%d\r\nappend s%d x\r\nmget n%d s%d\r\nmulti\r\nincr m%d\r\nexec\r\n", k%16, k%16, k%16, i, k%16)
+				}
+				o.conn.Write([]byte(b.String()))
+			}
+		}(i)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 300; j++ {
+				for _, want := range []string{":", ":", "[", "+OK", "+QUEUED", "["} {
+					o.conn.SetReadDeadline(time.Now().Add(10 * time.Second))
+					v, err := o.r.ReadValue()
+					if err != nil {
+						t.Errorf("read: %v", err)
+						return
+					}
+					if got := format(v); !strings.HasPrefix(got, want) {
+						t.Errorf("reply %d = %q, want %s...", j, got, want)
+						return
+					}
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	c := dial(t, db)
+	for _, prefix := range []string{"n", "m"} {
+		total := 0
+		for i := 0; i < 16; i++ {
+			n := 0
+			fmt.Sscan(c.do(fmt.Sprintf("get %s%d", prefix, i)), &n)
+			total += n
+		}
+		if total != 8*300 {
+			t.Errorf("the %s counters sum to %d, want %d", prefix, total, 8*300)
+		}
+	}
+	total := 0
+	for i := 0; i < 16; i++ {
+		n := 0
+		fmt.Sscan(c.do(fmt.Sprintf("strlen s%d", i))[1:], &n)
+		total += n
+	}
+	if total != 8*300 {
+		t.Errorf("the strings are %d bytes long, want %d", total, 8*300)
+	}
+}
@@ -0,0 +1,149 @@
+package test
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/zhaotong0312/kiwi/resp"
+)
+
+// closed checks that the server closed the connection.
+func (c *testConn) closed() bool {
+	c.t.Helper()
+	c.conn.SetReadDeadline(time.Now().Add(10 * time.Second))
+	_, err := c.r.ReadValue()
+	return err != nil
+}
+
+func TestPipeline(t *testing.T) {
+	c := dial(t, startServer(t, ""))
+
+	// Every command of a single write is executed.
+	var b strings.Builder
+	for i := 0; i < 10000; i++ {
+		b.Write(resp.AppendCommand(nil, "rpush", "l", fmt.Sprint(i)))
+	}
+	c.write(b.String())
+	for i := 1; i <= 10000; i++ {
+		if got := c.read(); got != fmt.Sprintf(":%d", i) {
+			t.Fatalf("rpush reply %d = %q", i, got)
+		}
+	}
+
+	// The inline and multibulk commands may be mixed.
+	c.write("set a 1\r\n*2\r\n$3\r\nget\r\n$1\r\na\r\nincr a\nget a\r\n\r\n")
+	for _, want := range []string{"+OK", "1", ":2", "2"} {
+		if got := c.read(); got != want {
+			t.Errorf("pipelined reply = %q, want %q", got, want)
+		}
+	}
+	c.run([]cmdTest{
+		{"llen l", ":10000"},
+		{"lindex l -1", "9999"},
+	})
+}
+
+// The commands split across reads are executed once complete.
+func TestPartialRequests(t *testing.T) {
+	c := dial(t, startServer(t, ""))
+	for _, req := range []string{
+		"*3\r\n$3\r\nset\r\n$1\r\na\r\n$5\r\nhello\r\n",
+		"set b \"hello world\"\r\n",
+	} {
+		for i := 0; i < len(req); i++ {
+			c.write(req[i : i+1])
+			// Let the server read every byte on its own.
+			time.Sleep(time.Millisecond)
+		}
+		if got := c.read(); got != "+OK" {
+			t.Errorf("%q = %q", req, got)
+		}
+	}
+	c.run([]cmdTest{
+		{"mget a b", "[hello hello world]"},
+	})
+
+	// The arguments bigger than the read buffer are read in many reads,
+	// and may be followed by the next command.
+	big := strings.Repeat("x", 1024*1024+7)
+	cmd := string(resp.AppendCommand(nil, "set", "big", big)) + "strlen big\r\n"
+	for len(cmd) > 0 {
+		n := 100000
+		if n > len(cmd) {
+			n = len(cmd)
+		}
+		c.write(cmd[:n])
+		cmd = cmd[n:]
+	}
+	for _, want := range []string{"+OK", ":1048583"} {
+		if got := c.read(); got != want {
+			t.Errorf("set big = %q, want %q", got, want)
+		}
+	}
+	if got := c.do("get big"); got != big {
+		t.Errorf("get big = %d bytes, want %d", len(got), len(big))
+	}
+}
+
+func TestProtocolErrors(t *testing.T) {
+	db := startServer(t, "proto-max-bulk-len 1mb")
+	for _, tt := range []struct {
+		req  string
+		want string
+	}{
+		{"*x\r\n", "-ERR Protocol error: invalid multibulk length"},
+		{"*1\r\n+get\r\n", "-ERR Protocol error: expected '$', got '+'"},
+		{"*1\r\n$x\r\n", "-ERR Protocol error: invalid bulk length"},
+		{"*1\r\n$2000000\r\n", "-ERR Protocol error: invalid bulk length"},
+		{"*1\r\n$3\r\ngetx\r\n", "-ERR Protocol error: invalid bulk format"},
+		{"*1\r\n$" + strings.Repeat("1", 100000), "-ERR Protocol error: too big bulk count string"},
+		{"set a \"b\r\n", "-ERR Protocol error: unbalanced quotes in request"},
+		{strings.Repeat("x", 100000), "-ERR Protocol error: too big inline request"},
+	} {
+		c := dial(t, db)
+		// The commands before the error are executed.
+		c.write("ping\r\n" + tt.req)
+		if got := c.read(); got != "+PONG" {
+			t.Errorf("ping = %q", got)
+		}
+		if got := c.read(); got != tt.want {
+			t.Errorf("%.20q = %q, want %q", tt.req, got, tt.want)
+		}
+		// The rest of the input can't be trusted.
+		if !c.closed() {
+			t.Errorf("%.20q: the connection is still open", tt.req)
+		}
+	}
+
+	// The empty requests are ignored.
+	c := dial(t, db)
+	c.write("\r\n*0\r\n*-1\r\n")
+	c.run([]cmdTest{
+		{"ping", "+PONG"},
+		{"nosuch a", "-ERR unknown command 'nosuch'"},
+	})
+}
+
+func TestQueryBufferLimit(t *testing.T) {
+	db := startServer(t, "client-query-buffer-limit 1mb")
+	c, admin := dial(t, db), dial(t, db)
+	c.run([]cmdTest{
+		{"config get client-query-buffer-limit", "[client-query-buffer-limit 1048576]"},
+		{"config set client-query-buffer-limit 1000", "-ERR CONFIG SET failed (possibly related to argument 'client-query-buffer-limit') - *"},
+	})
+	// A request within the limit is accepted.
+	c.run([]cmdTest{
+		{"set a " + strings.Repeat("x", 512*1024), "+OK"},
+	})
+	c.write("*3\r\n$3\r\nset\r\n$1\r\na\r\n$2000000\r\n")
+	// The server may close the connection before the end of the write.
+	c.conn.Write([]byte(strings.Repeat("x", 1100000)))
+	if !c.closed() {
+		t.Error("the client reached the query buffer limit and is still connected")
+	}
+	if got := admin.info("client_query_buffer_limit_disconnections"); got != "1" {
+		t.Errorf("client_query_buffer_limit_disconnections = %s", got)
+	}
+}
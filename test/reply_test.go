@@ -0,0 +1,66 @@
+package test
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+)
+
+// The values around the size of a reply chunk are copied in the chunks or
+// referenced by the reply.
+func TestLargeReplies(t *testing.T) {
+	c := dial(t, startServer(t, ""))
+	sizes := []int{0, 1, 16*1024 - 10, 16*1024 - 1, 16 * 1024, 16*1024 + 1, 100000, 4 * 1024 * 1024}
+	for i, size := range sizes {
+		c.do(fmt.Sprintf("set k%d \"%s\"", i, strings.Repeat(string(rune('a'+i)), size)))
+	}
+	for i, size := range sizes {
+		if got := c.do(fmt.Sprintf("get k%d", i)); got != strings.Repeat(string(rune('a'+i)), size) {
+			t.Errorf("get of a %d bytes value = %d bytes", size, len(got))
+		}
+	}
+	got := c.do("mget k2 k4 k5 missing k3")
+	want := fmt.Sprintf("[%s %s %s (nil) %s]", strings.Repeat("c", sizes[2]), strings.Repeat("e", sizes[4]),
+		strings.Repeat("f", sizes[5]), strings.Repeat("d", sizes[3]))
+	if got != want {
+		t.Errorf("mget of the big values = %d bytes, want %d", len(got), len(want))
+	}
+
+	// A reply of many small elements fills many chunks.
+	for i := 0; i < 100000; i += 1000 {
+		c.do(args("rpush l", i, i+999))
+	}
+	elems := strings.Fields(strings.Trim(c.do("lrange l 0 -1"), "[]"))
+	if len(elems) != 100000 || elems[0] != "0" || elems[99999] != "99999" {
+		t.Errorf("lrange l 0 -1 = %d elements", len(elems))
+	}
+}
+
+// The replies are written as the client reads them, and keep the values
+// of when the commands were executed.
+func TestPendingReplies(t *testing.T) {
+	db := startServer(t, "")
+	c, other := dial(t, db), dial(t, db)
+	big := strings.Repeat("x", 1024*1024)
+	c.do("set big " + big)
+	c.write(strings.Repeat("get big\r\nincr n\r\n", 50))
+	// The key is overwritten before the replies are read.
+	waitFor(t, "the pipelined commands", func() bool {
+		return other.do("get n") == "50"
+	})
+	other.run([]cmdTest{
+		{"set big y", "+OK"},
+		{"append big z", ":2"},
+	})
+	for i := 1; i <= 50; i++ {
+		if got := c.read(); got != big {
+			t.Fatalf("get big %d = %d bytes, want %d", i, len(got), len(big))
+		}
+		if got := c.read(); got != fmt.Sprintf(":%d", i) {
+			t.Fatalf("incr n = %q, want :%d", got, i)
+		}
+	}
+	c.run([]cmdTest{
+		{"get big", "yz"},
+	})
+}
@@ -0,0 +1,122 @@
+package test
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/zhaotong0312/kiwi/resp"
+)
+
+// value sends a command line and returns its reply, not formatted, to
+// check its type.
+func (c *testConn) value(line string) resp.Value {
+	c.t.Helper()
+	c.send(line)
+	c.conn.SetReadDeadline(time.Now().Add(10 * time.Second))
+	v, err := c.r.ReadValue()
+	if err != nil {
+		c.t.Fatalf("read: %v", err)
+	}
+	return v
+}
+
+func TestHello(t *testing.T) {
+	db := startServer(t, "")
+	c := dial(t, db)
+	c.run([]cmdTest{
+		{"hello x", "-ERR Protocol version is not an integer or out of range"},
+		{"hello 1", "-NOPROTO unsupported protocol version"},
+		{"hello 4", "-NOPROTO unsupported protocol version"},
+		{"hello 3 bogus", "-ERR Syntax error in HELLO option 'bogus'"},
+		{"hello 3 auth user", "-ERR Syntax error in HELLO option 'auth'"},
+		{"hello 3 setname", "-ERR Syntax error in HELLO option 'setname'"},
+		{`hello 3 setname "a b"`, "-ERR Client names cannot contain spaces, newlines or special characters."},
+		{"hello 3 auth nosuch wrong", "-WRONGPASS invalid username-password pair or user is disabled."},
+	})
+	// The failed HELLO don't switch the protocol.
+	if got := c.do("hello"); !strings.Contains(got, " proto :2 ") {
+		t.Errorf("hello = %q, want proto 2", got)
+	}
+	v := c.value("hello 3 setname worker")
+	if v.Type != resp.Map || !strings.Contains(format(v), " proto :3 ") || !strings.HasSuffix(format(v), " mode standalone role master modules []]") {
+		t.Fatalf("hello 3 = %c %s", v.Type, format(v))
+	}
+	c.run([]cmdTest{
+		{"client getname", "worker"},
+		{"hello 2", "[server kiwi version *"},
+		{"get missing", "(nil)"},
+	})
+
+	// HELLO authenticates the clients.
+	c.run([]cmdTest{
+		{"config set requirepass secret", "+OK"},
+	})
+	c2 := dial(t, db)
+	c2.run([]cmdTest{
+		{"hello 3", "-NOAUTH HELLO must be called with the client already authenticated, *"},
+		{"get a", "-NOAUTH Authentication required."},
+		{"hello 3 auth default secret", "[server kiwi *"},
+		{"get a", "(nil)"},
+	})
+}
+
+// The replies are typed in RESP3, and the same commands downgrade them
+// in RESP2.
+func TestResp3Replies(t *testing.T) {
+	c := dial(t, startServer(t, ""))
+	c.run([]cmdTest{
+		{"hset h a 1", ":1"},
+		{"sadd s x", ":1"},
+		{"zadd z 1.5 a 2 b", ":2"},
+		{"set k v", "+OK"},
+	})
+	for _, tt := range []struct {
+		cmd          string
+		resp2, resp3 resp.Type
+		want         string
+	}{
+		{"get missing", resp.Null, resp.Null, "(nil)"},
+		{"hgetall h", resp.Array, resp.Map, "[a 1]"},
+		{"hgetall missing", resp.Array, resp.Map, "[]"},
+		{"smembers s", resp.Array, resp.Set, "[x]"},
+		{"smembers missing", resp.Array, resp.Set, "[]"},
+		{"zscore z a", resp.BulkString, resp.Double, "1.5"},
+		{"zscore z missing", resp.Null, resp.Null, "(nil)"},
+		{"client info", resp.BulkString, resp.VerbatimString, "id=*"},
+		{"memory stats", resp.Array, resp.Map, "[peak.allocated *"},
+		{"get k", resp.BulkString, resp.BulkString, "v"},
+	} {
+		for _, proto := range []string{"2", "3"} {
+			c.do("hello " + proto)
+			want := tt.resp2
+			if proto == "3" {
+				want = tt.resp3
+			}
+			v := c.value(tt.cmd)
+			got := format(v)
+			if v.Type == resp.Double {
+				got = scalar(v)
+			}
+			if v.Type != want || !match(got, tt.want) {
+				t.Errorf("RESP%s %s = %v %q, want %v %q", proto, tt.cmd, v.Type, got, want, tt.want)
+			}
+		}
+	}
+	if v := c.value("client info"); v.Format != "txt" {
+		t.Errorf("client info format = %q, want txt", v.Format)
+	}
+
+	// The members and their scores are nested pairs in RESP3.
+	c.run([]cmdTest{
+		{"hello 2", "[server *"},
+		{"zrange z 0 -1 withscores", "[a 1.5 b 2]"},
+		{"hello 3", "[server *"},
+		{"zrange z 0 -1 withscores", "[[a ,1.5] [b ,2]]"},
+		{"zrange z 0 -1", "[a b]"},
+		{"command info get", "[[get :2 [+readonly +fast] :1 :1 :1]]"},
+	})
+	if v := c.value("command info get"); v.Elems[0].Elems[2].Type != resp.Set {
+		t.Errorf("command info flags = %v, want a set", v.Elems[0].Elems[2].Type)
+	}
+}
@@ -0,0 +1,214 @@
+package test
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/zhaotong0312/kiwi"
+	"github.com/zhaotong0312/kiwi/resp"
+)
+
+// The servers of the tests listen on a unix socket in the temporary
+// directory of the test, unless their configuration sets a port.
+
+// startServer opens a server with config and serves it. The server is
+// closed at the end of the test.
+func startServer(t *testing.T, config string) *kiwi.DB {
+	t.Helper()
+	sock := filepath.Join(t.TempDir(), "kiwi.sock")
+	if !strings.Contains(config, "port ") {
+		config = "port 0\n" + config
+	}
+	db, err := kiwi.Open("bind 127.0.0.1\nunixsocket " + sock + "\n" + config)
+	if err != nil {
+		t.Fatalf("Open: %v", err)
+	}
+	if err := db.Serve(); err != nil {
+		db.Close()
+		t.Fatalf("Serve: %v", err)
+	}
+	t.Cleanup(func() { db.Close() })
+	return db
+}
+
+// freePort returns a free TCP port, whose cluster bus port is free too.
+func freePort(t *testing.T) int {
+	t.Helper()
+	for i := 0; i < 100; i++ {
+		ln, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		port := ln.Addr().(*net.TCPAddr).Port
+		if port+10000 > 65535 {
+			ln.Close()
+			continue
+		}
+		bus, err := net.Listen("tcp", "127.0.0.1:"+strconv.Itoa(port+10000))
+		ln.Close()
+		if err == nil {
+			bus.Close()
+			return port
+		}
+	}
+	t.Fatal("no free port")
+	return 0
+}
+
+type testConn struct {
+	t    *testing.T
+	conn net.Conn
+	r    *resp.Reader
+}
+
+// dial connects to the first listener of db. The connection is closed at
+// the end of the test.
+func dial(t *testing.T, db *kiwi.DB) *testConn {
+	t.Helper()
+	addr := db.Addr()
+	conn, err := net.Dial(addr.Network(), addr.String())
+	if err != nil {
+		t.Fatalf("dial %v: %v", addr, err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	return &testConn{t: t, conn: conn, r: resp.NewReader(bufio.NewReader(conn))}
+}
+
+// write sends raw bytes, without reading the reply.
+func (c *testConn) write(s string) {
+	c.t.Helper()
+	if _, err := c.conn.Write([]byte(s)); err != nil {
+		c.t.Fatalf("write: %v", err)
+	}
+}
+
+// send sends a command line, split like kiwi-cli does, without reading
+// the reply.
+func (c *testConn) send(line string) {
+	c.t.Helper()
+	argv := resp.SplitArgs([]byte(line))
+	if argv == nil {
+		c.t.Fatalf("invalid command line %q", line)
+	}
+	c.write(string(resp.AppendCommand(nil, argv...)))
+}
+
+// read reads a reply, formatted by format.
+func (c *testConn) read() string {
+	c.t.Helper()
+	c.conn.SetReadDeadline(time.Now().Add(10 * time.Second))
+	v, err := c.r.ReadValue()
+	if err != nil {
+		c.t.Fatalf("read: %v", err)
+	}
+	return format(v)
+}
+
+// do sends a command line and returns its reply, formatted by format.
+func (c *testConn) do(line string) string {
+	c.t.Helper()
+	c.send(line)
+	return c.read()
+}
+
+// format writes a reply on one line: simple strings as "+OK", errors as
+// "-ERR ...", integers as ":1", bulk strings as they are, nulls as "(nil)"
+// and aggregates as "[a b c]".
+func format(v resp.Value) string {
+	switch v.Type {
+	case resp.SimpleString, resp.Error, resp.Integer, resp.Double, resp.BigNumber, resp.BulkError:
+		return string(v.Type) + scalar(v)
+	case resp.BulkString, resp.VerbatimString:
+		return v.Str
+	case resp.Null:
+		return "(nil)"
+	case resp.Boolean:
+		if v.Bool {
+			return "#t"
+		}
+		return "#f"
+	}
+	elems := make([]string, len(v.Elems))
+	for i, e := range v.Elems {
+		elems[i] = format(e)
+	}
+	return "[" + strings.Join(elems, " ") + "]"
+}
+
+func scalar(v resp.Value) string {
+	switch v.Type {
+	case resp.Integer:
+		return strconv.FormatInt(v.Int, 10)
+	case resp.Double:
+		return resp.FormatDouble(v.Float)
+	}
+	return v.Str
+}
+
+// cmdTest is a command line and its expected reply, formatted by format.
+// A trailing "*" in the reply matches any suffix.
+type cmdTest struct {
+	cmd  string
+	want string
+}
+
+func match(got, want string) bool {
+	if strings.HasSuffix(want, "*") {
+		return strings.HasPrefix(got, want[:len(want)-1])
+	}
+	return got == want
+}
+
+// run executes the commands in order, checking their replies.
+func (c *testConn) run(tests []cmdTest) {
+	c.t.Helper()
+	for _, tt := range tests {
+		if got := c.do(tt.cmd); !match(got, tt.want) {
+			cmd := tt.cmd
+			if len(cmd) > 60 {
+				cmd = cmd[:60] + "..."
+			}
+			c.t.Errorf("%s = %q, want %q", cmd, got, tt.want)
+		}
+	}
+}
+
+// info returns the value of a field of INFO, like "evicted_keys".
+func (c *testConn) info(field string) string {
+	c.t.Helper()
+	for _, line := range strings.Split(c.do("info all"), "\r\n") {
+		if strings.HasPrefix(line, field+":") {
+			return line[len(field)+1:]
+		}
+	}
+	c.t.Fatalf("no %s in INFO", field)
+	return ""
+}
+
+// waitFor calls cond until it returns true, failing the test after a few
+// seconds.
+func waitFor(t *testing.T, what string, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(10 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timeout waiting for %s", what)
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+}
+
+func args(cmd string, from, to int) string {
+	var b strings.Builder
+	b.WriteString(cmd)
+	for i := from; i <= to; i++ {
+		fmt.Fprintf(&b, " %d", i)
+	}
+	return b.String()
+}
@@ -0,0 +1,150 @@
+package test
+
+import (
+	"fmt"
+	"os"
+	"os/signal"
+	"strings"
+	"sync/atomic"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/zhaotong0312/kiwi/server"
+)
+
+// stopped waits for the server to be closed.
+func stopped(s *server.Server) bool {
+	done := make(chan struct{})
+	go func() {
+		s.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return true
+	case <-time.After(10 * time.Second):
+		return false
+	}
+}
+
+func TestShutdown(t *testing.T) {
+	c := dialServer(t, newServer(t, ""))
+	c.run([]cmdTest{
+		{"shutdown bogus", "-ERR syntax error"},
+		{"shutdown nosave save", "-ERR syntax error"},
+		{"shutdown abort now", "-ERR syntax error"},
+		{"shutdown abort", "-ERR No shutdown in progress."},
+		// There is no persistence: SAVE fails, unless forced.
+		{"shutdown save", "-ERR Errors trying to SHUTDOWN. Check logs."},
+		{"shutdown save now", "-ERR Errors trying to SHUTDOWN. Check logs."},
+		{"ping", "+PONG"},
+	})
+
+	for _, flags := range []string{"", "nosave", "now", "nosave now", "force", "save force"} {
+		s := newServer(t, "")
+		c, other := dialServer(t, s), dialServer(t, s)
+		c.send("shutdown " + flags)
+		if !c.closed() || !other.closed() {
+			t.Errorf("the clients were not closed by SHUTDOWN %s", flags)
+		}
+		if !stopped(s) {
+			t.Fatalf("the server was not closed by SHUTDOWN %s", flags)
+		}
+	}
+}
+
+// The replies of the commands received before SHUTDOWN are written before
+// the clients are closed, unless NOW is given.
+func TestShutdownDrain(t *testing.T) {
+	big := strings.Repeat("x", 1024*1024)
+	for _, flags := range []string{"nosave", "nosave now"} {
+		s := newServer(t, "")
+		c, admin := dialServer(t, s), dialServer(t, s)
+		admin.do("set big " + big)
+		c.write(strings.Repeat("get big\r\nincr n\r\n", 50))
+		waitFor(t, "the pipelined commands", func() bool {
+			return admin.do("get n") == "50"
+		})
+		admin.send("shutdown " + flags)
+		replies := 0
+		for ; replies < 100; replies++ {
+			c.conn.SetReadDeadline(time.Now().Add(10 * time.Second))
+			v, err := c.r.ReadValue()
+			if err != nil {
+				break
+			}
+			want := big
+			if replies%2 == 1 {
+				want = fmt.Sprintf(":%d", replies/2+1)
+			}
+			if got := format(v); got != want {
+				t.Fatalf("SHUTDOWN %s: reply %d = %.20q, want %.20q", flags, replies, got, want)
+			}
+		}
+		if flags == "nosave" && (replies != 100 || !c.closed()) {
+			t.Errorf("SHUTDOWN %s: %d replies before the client was closed, want 100", flags, replies)
+		}
+		if flags == "nosave now" && replies == 100 {
+			t.Errorf("SHUTDOWN %s waited for the replies to be read", flags)
+		}
+		if !stopped(s) {
+			t.Fatalf("the server was not closed by SHUTDOWN %s", flags)
+		}
+	}
+}
+
+// SIGTERM schedules a shutdown, run by the cron unless aborted first.
+func TestShutdownSignal(t *testing.T) {
+	// The test must not be killed by a signal sent before the servers
+	// handle them.
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, syscall.SIGTERM)
+	defer signal.Stop(sigs)
+	term := func() { syscall.Kill(os.Getpid(), syscall.SIGTERM) }
+
+	// The cron runs once a second, leaving the time to abort after its
+	// first run at startup.
+	s := newServer(t, "hz 1")
+	go s.SignalHandle()
+	c := dialServer(t, s)
+	waitFor(t, "the first cron run", func() bool {
+		return atomic.LoadInt64(&s.CronLoopCount) > 0
+	})
+	waitFor(t, "the shutdown to be scheduled", func() bool {
+		term()
+		return c.do("shutdown abort") == "+OK"
+	})
+	c.run([]cmdTest{
+		{"ping", "+PONG"},
+	})
+
+	s = newServer(t, "")
+	go s.SignalHandle()
+	c = dialServer(t, s)
+	c.run([]cmdTest{
+		{"ping", "+PONG"},
+	})
+	done := make(chan struct{})
+	go func() {
+		s.Wait()
+		close(done)
+	}()
+	for i := 0; ; i++ {
+		term()
+		select {
+		case <-done:
+			if !c.closed() {
+				t.Error("the client was not closed on SIGTERM")
+			}
+			if err := s.CloseServer(); err != nil {
+				t.Errorf("CloseServer after SIGTERM: %v", err)
+			}
+			return
+		case <-time.After(100 * time.Millisecond):
+		}
+		if i == 100 {
+			t.Fatal("the server was not closed on SIGTERM")
+		}
+	}
+}
@@ -0,0 +1,70 @@
+package test
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+)
+
+func TestSlowlog(t *testing.T) {
+	c := dial(t, startServer(t, "slowlog-log-slower-than 0"))
+	c.run([]cmdTest{
+		{"slowlog reset", "+OK"},
+		// The RESET itself is logged once executed.
+		{"slowlog len", ":1"},
+		{"client setname tester", "+OK"},
+		{"set a 1", "+OK"},
+		{"slowlog get 0", "[]"},
+		{"slowlog get -1", "-ERR value is out of range, must be positive"},
+		{"slowlog get a", "-ERR value is out of range, must be positive"},
+		{"slowlog get 1 2", "-ERR Unknown subcommand or wrong number of arguments for 'get'. Try SLOWLOG HELP"},
+		{"slowlog nosuch", "-ERR Unknown subcommand or wrong number of arguments for 'nosuch'. Try SLOWLOG HELP"},
+	})
+	c.do("set a 1")
+	if got := c.do("slowlog get 1"); !strings.Contains(got, " [set a 1] ") || !strings.HasSuffix(got, " tester]]") {
+		t.Errorf("slowlog get 1 = %q, want the last SET by tester", got)
+	}
+	help := c.do("slowlog help")
+	for _, line := range []string{"+LEN -- Return the length of the slowlog.", "+RESET -- Reset the slowlog."} {
+		if !strings.Contains(help, line) {
+			t.Errorf("slowlog help = %q, missing %q", help, line)
+		}
+	}
+
+	// The newest entries come first.
+	c.do("slowlog reset")
+	c.do("set b 2")
+	entries := c.do("slowlog get 3")
+	newer, older := strings.Index(entries, "[set b 2]"), strings.Index(entries, "[slowlog reset]")
+	if newer == -1 || older == -1 || newer > older {
+		t.Errorf("slowlog get 3 = %q", entries)
+	}
+
+	// Long arguments and long commands are trimmed.
+	c.do("set k " + strings.Repeat("x", 200))
+	if got, want := c.do("slowlog get 1"), "[set k "+strings.Repeat("x", 128)+"... (72 more bytes)]"; !strings.Contains(got, want) {
+		t.Errorf("slowlog get 1 = %q, want %q", got, want)
+	}
+	c.do(args("rpush l", 1, 40))
+	if got, want := c.do("slowlog get 1"), " 29 ... (11 more arguments)] "; !strings.Contains(got, want) {
+		t.Errorf("slowlog get 1 = %q, want %q", got, want)
+	}
+}
+
+func TestSlowlogConfig(t *testing.T) {
+	c := dial(t, startServer(t, "slowlog-log-slower-than 0\nslowlog-max-len 3"))
+	for i := 0; i < 10; i++ {
+		c.do(fmt.Sprintf("set k%d v", i))
+	}
+	c.run([]cmdTest{
+		{"slowlog len", ":3"},
+		{"config set slowlog-log-slower-than -1", "+OK"},
+		{"slowlog reset", "+OK"},
+		{"set a 1", "+OK"},
+		{"slowlog len", ":0"},
+		// Only the commands slower than the threshold are logged.
+		{"config set slowlog-log-slower-than 10000000", "+OK"},
+		{"set a 1", "+OK"},
+		{"slowlog len", ":0"},
+	})
+}
@@ -0,0 +1,101 @@
+package test
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/zhaotong0312/kiwi/server"
+)
+
+// Of two servers with the same pidfile, only one takes it.
+func TestPidFile(t *testing.T) {
+	pidfile := filepath.Join(t.TempDir(), "kiwi.pid")
+	s1 := newServer(t, "pidfile "+pidfile)
+	if err := s1.CreatePidFile(); err != nil {
+		t.Fatalf("CreatePidFile: %v", err)
+	}
+	if got, _ := os.ReadFile(pidfile); string(got) != fmt.Sprintf("%d\n", os.Getpid()) {
+		t.Errorf("pidfile = %q, want %d", got, os.Getpid())
+	}
+	s2 := newServer(t, "pidfile "+pidfile)
+	if err := s2.CreatePidFile(); err == nil || !strings.Contains(err.Error(), "is locked") {
+		t.Errorf("CreatePidFile of a second server: %v, want already running", err)
+	}
+
+	// The pidfile is removed once the server is closed, and free for
+	// another server then.
+	s1.Shutdown(context.Background())
+	s1.CloseServer()
+	if _, err := os.Stat(pidfile); !os.IsNotExist(err) {
+		t.Errorf("the pidfile is left after CloseServer: %v", err)
+	}
+	if err := s2.CreatePidFile(); err != nil {
+		t.Errorf("CreatePidFile after the first server was closed: %v", err)
+	}
+	s2.RemovePidFile()
+}
+
+// A pidfile left by a process that is gone is reused.
+func TestStalePidFile(t *testing.T) {
+	cmd := exec.Command("true")
+	if err := cmd.Run(); err != nil {
+		t.Skipf("no process to spawn: %v", err)
+	}
+	pidfile := filepath.Join(t.TempDir(), "kiwi.pid")
+	if err := os.WriteFile(pidfile, []byte(fmt.Sprintf("%d\n", cmd.Process.Pid)), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if pid, err := server.ServerExists(pidfile); err != nil {
+		t.Errorf("ServerExists of a stale pidfile = %d, %v", pid, err)
+	}
+	s := newServer(t, "pidfile "+pidfile)
+	if err := s.CreatePidFile(); err != nil {
+		t.Fatalf("CreatePidFile over a stale pidfile: %v", err)
+	}
+	defer s.RemovePidFile()
+	if got, _ := os.ReadFile(pidfile); string(got) != fmt.Sprintf("%d\n", os.Getpid()) {
+		t.Errorf("pidfile = %q, want %d", got, os.Getpid())
+	}
+}
+
+// With "supervised systemd" the readiness and the shutdown are notified on
+// NOTIFY_SOCKET.
+func TestSupervisedSystemd(t *testing.T) {
+	sock := filepath.Join(t.TempDir(), "notify.sock")
+	ln, err := net.ListenUnixgram("unixgram", &net.UnixAddr{Name: sock, Net: "unixgram"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	t.Setenv("NOTIFY_SOCKET", sock)
+	notified := func() string {
+		t.Helper()
+		buf := make([]byte, 1024)
+		ln.SetReadDeadline(time.Now().Add(5 * time.Second))
+		n, err := ln.Read(buf)
+		if err != nil {
+			t.Fatalf("no notification: %v", err)
+		}
+		return string(buf[:n])
+	}
+
+	s := newServer(t, "supervised auto")
+	if !s.Supervised || s.SupervisedMode != server.SUPERVISED_SYSTEMD {
+		t.Errorf("supervised auto = %v, mode %d", s.Supervised, s.SupervisedMode)
+	}
+	if got := notified(); !strings.Contains(got, "\nREADY=1\n") || !strings.Contains(got, fmt.Sprintf("MAINPID=%d\n", os.Getpid())) {
+		t.Errorf("notification on start = %q", got)
+	}
+	dialServer(t, s).write("shutdown nosave\r\n")
+	if got := notified(); got != "STOPPING=1\n" {
+		t.Errorf("notification on shutdown = %q", got)
+	}
+	s.Wait()
+}
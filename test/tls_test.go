@@ -0,0 +1,306 @@
+package test
+
+import (
+	"bufio"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"fmt"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/zhaotong0312/kiwi/resp"
+)
+
+// testCA signs the certificates of the tests, written in a temporary
+// directory.
+type testCA struct {
+	t    *testing.T
+	dir  string
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+	file string
+	pool *x509.CertPool
+}
+
+func newTestCA(t *testing.T) *testCA {
+	t.Helper()
+	ca := &testCA{t: t, dir: t.TempDir(), pool: x509.NewCertPool()}
+	ca.cert, ca.key, ca.file = ca.issue("ca", true)
+	ca.pool.AddCert(ca.cert)
+	return ca
+}
+
+// issue creates a certificate for name, signed by the CA, and writes it
+// and its key in name.crt and name.key. The CA certificate itself is
+// self-signed.
+func (ca *testCA) issue(name string, isCA bool) (*x509.Certificate, *ecdsa.PrivateKey, string) {
+	ca.t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		ca.t.Fatal(err)
+	}
+	serial, err := rand.Int(rand.Reader, big.NewInt(1<<62))
+	if err != nil {
+		ca.t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: serial,
+		Subject:      pkix.Name{CommonName: name},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		IPAddresses:  []net.IP{net.IPv4(127, 0, 0, 1)},
+	}
+	parent, signer := template, key
+	if isCA {
+		template.IsCA = true
+		template.BasicConstraintsValid = true
+		template.KeyUsage |= x509.KeyUsageCertSign
+	} else {
+		parent, signer = ca.cert, ca.key
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, parent, &key.PublicKey, signer)
+	if err != nil {
+		ca.t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		ca.t.Fatal(err)
+	}
+	keyDer, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		ca.t.Fatal(err)
+	}
+	file := filepath.Join(ca.dir, name+".crt")
+	ca.write(file, "CERTIFICATE", der)
+	ca.write(filepath.Join(ca.dir, name+".key"), "EC PRIVATE KEY", keyDer)
+	return cert, key, file
+}
+
+func (ca *testCA) write(file, typ string, der []byte) {
+	ca.t.Helper()
+	if err := os.WriteFile(file, pem.EncodeToMemory(&pem.Block{Type: typ, Bytes: der}), 0600); err != nil {
+		ca.t.Fatal(err)
+	}
+}
+
+// config returns the tls-* directives to serve name.crt on a free port.
+func (ca *testCA) config(name string) (string, int) {
+	ca.t.Helper()
+	ca.issue(name, false)
+	port := freePort(ca.t)
+	return fmt.Sprintf("port 0\ntls-port %d\ntls-cert-file %s\ntls-key-file %s\ntls-ca-cert-file %s\n",
+		port, filepath.Join(ca.dir, name+".crt"), filepath.Join(ca.dir, name+".key"), ca.file), port
+}
+
+// client returns a configuration trusting the CA, presenting the
+// certificate name.crt unless name is empty.
+func (ca *testCA) client(name string) *tls.Config {
+	ca.t.Helper()
+	config := &tls.Config{RootCAs: ca.pool, ServerName: "127.0.0.1"}
+	if name != "" {
+		ca.issue(name, false)
+		cert, err := tls.LoadX509KeyPair(filepath.Join(ca.dir, name+".crt"), filepath.Join(ca.dir, name+".key"))
+		if err != nil {
+			ca.t.Fatal(err)
+		}
+		config.Certificates = []tls.Certificate{cert}
+	}
+	return config
+}
+
+// dialTLS connects with TLS to port. The connection is closed at the end
+// of the test.
+func dialTLS(t *testing.T, port int, config *tls.Config) (*testConn, error) {
+	t.Helper()
+	conn, err := tls.DialWithDialer(&net.Dialer{Timeout: 5 * time.Second}, "tcp", fmt.Sprintf("127.0.0.1:%d", port), config)
+	if err != nil {
+		return nil, err
+	}
+	t.Cleanup(func() { conn.Close() })
+	return &testConn{t: t, conn: conn, r: resp.NewReader(bufio.NewReader(conn))}, nil
+}
+
+// refused checks that a connection with config fails, during the
+// handshake or at the first command: with TLSv1.3 the client handshake
+// completes before the server verifies the client certificate.
+func refused(t *testing.T, port int, config *tls.Config) bool {
+	t.Helper()
+	conn, err := tls.DialWithDialer(&net.Dialer{Timeout: 5 * time.Second}, "tcp", fmt.Sprintf("127.0.0.1:%d", port), config)
+	if err != nil {
+		return true
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	if _, err := conn.Write([]byte("PING\r\n")); err != nil {
+		return true
+	}
+	_, err = resp.NewReader(bufio.NewReader(conn)).ReadValue()
+	return err != nil
+}
+
+func TestTls(t *testing.T) {
+	ca := newTestCA(t)
+	config, port := ca.config("server")
+	db := startServer(t, config+"tls-auth-clients no")
+	c, err := dialTLS(t, port, ca.client(""))
+	if err != nil {
+		t.Fatal(err)
+	}
+	big := strings.Repeat("x", 100000)
+	c.run([]cmdTest{
+		{"ping", "+PONG"},
+		{"set a " + big, "+OK"},
+		{"get a", big},
+	})
+	// The commands are pipelined across the TLS records.
+	c.write(strings.Repeat("*2\r\n$4\r\nincr\r\n$1\r\nn\r\n", 1000))
+	for i := 1; i <= 1000; i++ {
+		if got := c.read(); got != fmt.Sprintf(":%d", i) {
+			t.Fatalf("incr n = %q, want :%d", got, i)
+		}
+	}
+	// The unix socket is still plaintext.
+	dial(t, db).run([]cmdTest{
+		{"get n", "1000"},
+	})
+
+	// A plaintext client of the TLS port gets no reply.
+	plain, err := net.Dial("tcp", fmt.Sprintf("127.0.0.1:%d", port))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer plain.Close()
+	plain.SetDeadline(time.Now().Add(5 * time.Second))
+	plain.Write([]byte("PING\r\n"))
+	if line, err := bufio.NewReader(plain).ReadString('\n'); err == nil && line == "+PONG\r\n" {
+		t.Error("the TLS port replied to a plaintext client")
+	}
+	if _, err := dialTLS(t, port, &tls.Config{RootCAs: x509.NewCertPool(), ServerName: "127.0.0.1"}); err == nil {
+		t.Error("the certificate of the server is trusted without the CA")
+	}
+}
+
+func TestTlsAuthClients(t *testing.T) {
+	ca := newTestCA(t)
+	other := newTestCA(t)
+	config, port := ca.config("server")
+	c := dial(t, startServer(t, config))
+
+	// The clients must present a certificate signed by the CA by default.
+	if refused(t, port, ca.client("client")) {
+		t.Error("a client with a valid certificate is refused")
+	}
+	if !refused(t, port, ca.client("")) {
+		t.Error("a client without certificate is accepted")
+	}
+	untrusted := ca.client("")
+	untrusted.Certificates = other.client("client").Certificates
+	if !refused(t, port, untrusted) {
+		t.Error("a client with a certificate of another CA is accepted")
+	}
+
+	c.run([]cmdTest{
+		{"config get tls-auth-clients", "[tls-auth-clients yes]"},
+		{"config set tls-auth-clients optional", "+OK"},
+	})
+	if refused(t, port, ca.client("")) || refused(t, port, ca.client("client")) {
+		t.Error("a client is refused with tls-auth-clients optional")
+	}
+	if !refused(t, port, untrusted) {
+		t.Error("a client with a certificate of another CA is accepted with tls-auth-clients optional")
+	}
+}
+
+func TestTlsReload(t *testing.T) {
+	ca := newTestCA(t)
+	config, port := ca.config("server")
+	db := startServer(t, config+"tls-auth-clients no")
+	c := dial(t, db)
+	old, err := dialTLS(t, port, ca.client(""))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The new certificate is used by the new connections, while the
+	// established ones are not affected.
+	ca.issue("renewed", false)
+	c.run([]cmdTest{
+		{"config set tls-cert-file " + filepath.Join(ca.dir, "renewed.crt") + " tls-key-file " + filepath.Join(ca.dir, "renewed.key"), "+OK"},
+	})
+	conn, err := dialTLS(t, port, ca.client(""))
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.run([]cmdTest{
+		{"ping", "+PONG"},
+	})
+	if name := conn.conn.(*tls.Conn).ConnectionState().PeerCertificates[0].Subject.CommonName; name != "renewed" {
+		t.Errorf("the new connection got the certificate of %s", name)
+	}
+	old.run([]cmdTest{
+		{"ping", "+PONG"},
+	})
+
+	// An invalid configuration is refused and the current one is kept.
+	c.run([]cmdTest{
+		{"config set tls-cert-file " + filepath.Join(ca.dir, "nosuch.crt"), "-ERR CONFIG SET failed (possibly related to argument 'tls-cert-file') - *"},
+		{"config get tls-cert-file", "[tls-cert-file " + filepath.Join(ca.dir, "renewed.crt") + "]"},
+		{"config set tls-protocols TLSv9", "-ERR CONFIG SET failed (possibly related to argument 'tls-protocols') - *"},
+		{"config set tls-protocols TLSv1.3", "+OK"},
+	})
+	if _, err := dialTLS(t, port, ca.client("")); err != nil {
+		t.Errorf("dial with TLSv1.3: %v", err)
+	}
+	tls12 := ca.client("")
+	tls12.MaxVersion = tls.VersionTLS12
+	if !refused(t, port, tls12) {
+		t.Error("a TLSv1.2 client is accepted with tls-protocols TLSv1.3")
+	}
+}
+
+// The connections that don't complete the handshake in time are closed.
+func TestTlsHandshakeTimeout(t *testing.T) {
+	ca := newTestCA(t)
+	config, port := ca.config("server")
+	c := dial(t, startServer(t, config+"tls-auth-clients no\ntls-handshake-timeout 200"))
+	c.run([]cmdTest{
+		{"config get tls-handshake-timeout", "[tls-handshake-timeout 200]"},
+	})
+	idle, err := net.Dial("tcp", fmt.Sprintf("127.0.0.1:%d", port))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer idle.Close()
+	idle.SetDeadline(time.Now().Add(5 * time.Second))
+	start := time.Now()
+	if n, err := idle.Read(make([]byte, 1)); err == nil || n != 0 {
+		t.Fatalf("read = %d, %v, want the connection closed", n, err)
+	}
+	if elapsed := time.Since(start); elapsed > 4*time.Second {
+		t.Errorf("the connection was closed after %v", elapsed)
+	}
+	waitFor(t, "the idle connection to be freed", func() bool {
+		return c.info("connected_clients") == "1"
+	})
+	// The handshakes completed in time are not affected.
+	tc, err := dialTLS(t, port, ca.client(""))
+	if err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(300 * time.Millisecond)
+	tc.run([]cmdTest{
+		{"ping", "+PONG"},
+	})
+}
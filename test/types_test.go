@@ -0,0 +1,206 @@
+package test
+
+import (
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+)
+
+func TestListCommands(t *testing.T) {
+	c := dial(t, startServer(t, ""))
+	c.run([]cmdTest{
+		{"rpush l b c d", ":3"},
+		{"lpush l a", ":4"},
+		{"lrange l 0 -1", "[a b c d]"},
+		{"lrange l -2 -1", "[c d]"},
+		{"lrange l -100 1", "[a b]"},
+		{"lrange l 2 100", "[c d]"},
+		{"lrange l 3 1", "[]"},
+		{"lrange l a 1", "-ERR value is not an integer or out of range"},
+		{"lrange missing 0 -1", "[]"},
+		{"lindex l -1", "d"},
+		{"lindex l 4", "(nil)"},
+		{"lset l -1 e", "+OK"},
+		{"lset l 4 e", "-ERR index out of range"},
+		{"lset missing 0 e", "-ERR no such key"},
+		{"linsert l before c x", ":5"},
+		{"linsert l middle c x", "-ERR syntax error"},
+		{"lrem l 0 x", ":1"},
+		{"ltrim l 1 -1", "+OK"},
+		{"lrange l 0 -1", "[b c e]"},
+		{"rpushx missing a", ":0"},
+		{"lpushx l z", ":4"},
+		{"lpop l 2", "[z b]"},
+		{"lpop l -1", "-ERR value is out of range, must be positive"},
+		{"rpop l", "e"},
+		{"llen l", ":1"},
+		// The empty list is deleted.
+		{"rpop l", "c"},
+		{"exists l", ":0"},
+		{"lpop l", "(nil)"},
+		{"rpush l a b", ":2"},
+		{"ltrim l 5 10", "+OK"},
+		{"exists l", ":0"},
+	})
+}
+
+func TestHashCommands(t *testing.T) {
+	c := dial(t, startServer(t, ""))
+	c.run([]cmdTest{
+		{"hset h a 1 b 2", ":2"},
+		{"hset h a 3", ":0"},
+		{"hset h a", "-ERR wrong number of arguments for 'hset' command"},
+		{"hsetnx h a 4", ":0"},
+		{"hsetnx h c 4", ":1"},
+		{"hget h a", "3"},
+		{"hget h missing", "(nil)"},
+		{"hmset h d 5", "+OK"},
+		{"hmget h a missing d", "[3 (nil) 5]"},
+		{"hexists h a", ":1"},
+		{"hstrlen h a", ":1"},
+		{"hlen h", ":4"},
+		{"hincrby h a 10", ":13"},
+		{"hincrby h a x", "-ERR value is not an integer or out of range"},
+		{"hset h s x", ":1"},
+		{"hincrby h s 1", "-ERR hash value is not an integer"},
+		{"hincrby h a 9223372036854775807", "-ERR increment or decrement would overflow"},
+		{"hincrbyfloat h b 0.5", "2.5"},
+		{"hincrbyfloat h s 1", "-ERR hash value is not a float"},
+		{"hincrbyfloat h b x", "-ERR value is not a valid float"},
+		{"hdel h s c d missing", ":3"},
+		{"hkeys h", "*"},
+		{"hlen h", ":2"},
+		// The empty hash is deleted.
+		{"hdel h a b", ":2"},
+		{"exists h", ":0"},
+		{"hgetall h", "[]"},
+		{"hlen h", ":0"},
+	})
+}
+
+func TestSetCommands(t *testing.T) {
+	c := dial(t, startServer(t, ""))
+	c.run([]cmdTest{
+		{"sadd s a b c a", ":3"},
+		{"sadd t b c d", ":3"},
+		{"sismember s a", ":1"},
+		{"sismember s d", ":0"},
+		{"scard s", ":3"},
+		{"scard missing", ":0"},
+		{"sinter s t missing", "[]"},
+		{"srem s a missing", ":1"},
+		{"smembers missing", "[]"},
+		// The empty set is deleted.
+		{"srem s b c", ":2"},
+		{"exists s", ":0"},
+		{"srem s a", ":0"},
+	})
+	for cmd, want := range map[string][]string{
+		"sinter t t":    {"b", "c", "d"},
+		"sunion t s2":   {"b", "c", "d"},
+		"sdiff t s2":    {"b", "c", "d"},
+		"smembers t":    {"b", "c", "d"},
+		"sdiff t t":     {},
+		"sunion s2 s3":  {},
+		"sinter t s2 t": {},
+	} {
+		if got := c.do(cmd); !sameMembers(got, want) {
+			t.Errorf("%s = %s, want %v", cmd, got, want)
+		}
+	}
+}
+
+func TestZsetCommands(t *testing.T) {
+	c := dial(t, startServer(t, ""))
+	c.run([]cmdTest{
+		{"zadd z 1 a 2 b 3 c", ":3"},
+		{"zadd z 1 a 2 b 3 c", ":0"},
+		{"zadd z ch 1 a 5 b 3 d", ":2"},
+		{"zadd z nx 10 a 4 e", ":1"},
+		{"zscore z a", "1"},
+		{"zadd z xx 10 a 6 f", ":0"},
+		{"zscore z a", "10"},
+		{"zscore z f", "(nil)"},
+		{"zadd z xx ch 11 a 6 f", ":1"},
+		{"zadd z incr 2 a", "13"},
+		{"zadd z nx incr 2 a", "(nil)"},
+		{"zadd z xx incr 2 g", "(nil)"},
+		{"zadd z xx nx 1 a", "-ERR XX and NX options at the same time are not compatible"},
+		{"zadd z incr 1 a 1 b", "-ERR INCR option supports a single increment-element pair"},
+		{"zadd z 1 a 2", "-ERR syntax error"},
+		{"zadd z nx 1", "-ERR syntax error"},
+		{"zadd z nx", "-ERR wrong number of arguments for 'zadd' command"},
+		{"zadd z 1 a x b", "-ERR value is not a valid float"},
+		{"zscore z b", "5"},
+		{"zadd missing xx 1 a", ":0"},
+		{"exists missing", ":0"},
+		{"zincrby z 2.5 c", "5.5"},
+		{"zincrby z x c", "-ERR value is not a valid float"},
+		{"zcard z", ":5"},
+		{"zrange z 0 -1", "[d e b c a]"},
+		{"zrange z -2 -1 withscores", "[c 5.5 a 13]"},
+		{"zrange z -100 0", "[d]"},
+		{"zrange z 3 1", "[]"},
+		{"zrange z 0 a", "-ERR value is not an integer or out of range"},
+		{"zrange z 0 1 bogus", "-ERR syntax error"},
+		{"zrevrange z 0 1", "[a c]"},
+		{"zrevrange z -1 -1", "[d]"},
+		{"zrank z b", ":2"},
+		{"zrevrank z b", ":2"},
+		{"zrank z missing", "(nil)"},
+		{"zrangebyscore z 4 (5.5", "[e b]"},
+		{"zrangebyscore z -inf +inf withscores limit 1 2", "[e 4 b 5]"},
+		{"zrangebyscore z a 1", "-ERR min or max is not a float"},
+		{"zrangebyscore z 0 1 limit 1", "-ERR syntax error"},
+		{"zcount z (4 +inf", ":3"},
+		{"zrem z a b missing", ":2"},
+		// The empty sorted set is deleted.
+		{"zrem z c d e", ":3"},
+		{"exists z", ":0"},
+		{"zrange z 0 -1", "[]"},
+		{"zcard z", ":0"},
+	})
+}
+
+func TestWrongType(t *testing.T) {
+	c := dial(t, startServer(t, ""))
+	c.run([]cmdTest{
+		{"set s x", "+OK"},
+		{"rpush l a", ":1"},
+		{"hset h a 1", ":1"},
+		{"sadd st a", ":1"},
+		{"zadd z 1 a", ":1"},
+	})
+	const wrongType = "-WRONGTYPE Operation against a key holding the wrong kind of value"
+	for _, cmd := range []string{
+		"lpush s a", "lrange h 0 -1", "llen z", "lpop st",
+		"hset l a 1", "hget s a", "hgetall z", "hlen st",
+		"sadd h a", "smembers l", "sismember z a", "sinter st s",
+		"zadd st 1 a", "zrange s 0 -1", "zscore h a", "zincrby l 1 a",
+		"get l", "incr z", "append h a",
+	} {
+		if got := c.do(cmd); got != wrongType {
+			t.Errorf("%s = %q", cmd, got)
+		}
+	}
+	c.run([]cmdTest{
+		{"type s", "+string"},
+		{"type l", "+list"},
+		{"type h", "+hash"},
+		{"type st", "+set"},
+		{"type z", "+zset"},
+		{"type missing", "+none"},
+	})
+}
+
+// sameMembers reports whether the array reply got has the members want, in
+// any order.
+func sameMembers(got string, want []string) bool {
+	if !strings.HasPrefix(got, "[") || !strings.HasSuffix(got, "]") {
+		return false
+	}
+	members := strings.Fields(got[1 : len(got)-1])
+	sort.Strings(members)
+	return len(members) == len(want) && (len(want) == 0 || reflect.DeepEqual(members, want))
+}